@@ -0,0 +1,297 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+)
+
+// maxDistinctURIs caps memory used for counting URIs. Once reached,
+// new URIs are counted under otherURIs.
+const (
+	maxDistinctURIs = 100000
+	otherURIs       = "(other)"
+)
+
+// countEntry is a single row of a top-N table
+type countEntry struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// rateEntry is the number of requests in one interval
+type rateEntry struct {
+	Start    time.Time `json:"start"`
+	Requests int64     `json:"requests"`
+	PerSec   float64   `json:"per_sec"`
+}
+
+// analysisReport is the output of `bhctl analyze`, text or JSON
+type analysisReport struct {
+	Files           []string       `json:"files"`
+	Requests        int64          `json:"requests"`
+	First           *time.Time     `json:"first,omitempty"`
+	Last            *time.Time     `json:"last,omitempty"`
+	TopURIs         []countEntry   `json:"top_uris"`
+	Methods         []countEntry   `json:"methods"`
+	Statuses        []countEntry   `json:"statuses"` // empty unless responses were recorded (bhproxy)
+	BodyBytes       int64          `json:"body_bytes"`
+	BodyPercentiles map[string]int `json:"body_percentiles"`
+	Interval        string         `json:"interval"`
+	Rate            []rateEntry    `json:"rate"`
+}
+
+// analyzer accumulates counters over all records
+type analyzer struct {
+	interval  time.Duration
+	requests  int64
+	uris      map[string]int64
+	methods   map[string]int64
+	statuses  map[string]int64 // only for requests recorded with a response
+	bodySizes []uint32
+	bodyBytes int64
+	buckets   map[int64]int64 // interval start (unix nano) -> count
+	first     time.Time
+	last      time.Time
+	mmap      bool // map local uncompressed archives (archive.OpenArchiveMapped)
+}
+
+func newAnalyzer(interval time.Duration) *analyzer {
+	return &analyzer{
+		interval: interval,
+		uris:     make(map[string]int64),
+		methods:  make(map[string]int64),
+		statuses: make(map[string]int64),
+		buckets:  make(map[int64]int64),
+	}
+}
+
+// add accounts for one request
+func (an *analyzer) add(req *fbr.Request) {
+
+	an.requests++
+
+	uri := req.Uri()
+	if i := bytes.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+	if _, ok := an.uris[string(uri)]; ok || len(an.uris) < maxDistinctURIs {
+		an.uris[string(uri)]++
+	} else {
+		an.uris[otherURIs]++
+	}
+	an.methods[string(req.Method())]++
+	if status := req.Status(); status != 0 {
+		an.statuses[strconv.Itoa(int(status))]++
+	}
+
+	size := req.BodyLength()
+	an.bodySizes = append(an.bodySizes, uint32(size))
+	an.bodyBytes += int64(size)
+
+	ts := recordTime(req)
+	if ts.IsZero() {
+		return
+	}
+	an.buckets[ts.Truncate(an.interval).UnixNano()]++
+	if an.first.IsZero() || ts.Before(an.first) {
+		an.first = ts
+	}
+	if ts.After(an.last) {
+		an.last = ts
+	}
+}
+
+// addArchive streams one archive through the analyzer
+func (an *analyzer) addArchive(fileName string) (err error) {
+
+	const archiveFileReadBufSize = 65536 // 64 K
+
+	var rf archive.Archive
+	if an.mmap {
+		rf, err = archive.OpenArchiveMapped(fileName, archiveFileReadBufSize)
+	} else {
+		rf, err = archive.OpenArchive(fileName, archiveFileReadBufSize)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Unable to open archive file: %s", fileName)
+	}
+	defer rf.Close()
+
+	for {
+		umr, err := request.GetNextRequest(rf, false)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "corrupted archive %s", fileName)
+		}
+		an.add(umr.Request())
+		umr.Release()
+	}
+}
+
+// topN sorts counts descending (then by key) and keeps the first n, 0 for all
+func topN(counts map[string]int64, n int) (entries []countEntry) {
+	entries = make([]countEntry, 0, len(counts))
+	for key, count := range counts {
+		entries = append(entries, countEntry{key, count})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// report summarizes what was accumulated
+func (an *analyzer) report(files []string, top int) *analysisReport {
+
+	rep := &analysisReport{
+		Files:     files,
+		Requests:  an.requests,
+		TopURIs:   topN(an.uris, top),
+		Methods:   topN(an.methods, 0),
+		Statuses:  topN(an.statuses, 0),
+		BodyBytes: an.bodyBytes,
+		Interval:  an.interval.String(),
+		Rate:      []rateEntry{},
+	}
+	if !an.first.IsZero() {
+		first, last := an.first.UTC(), an.last.UTC()
+		rep.First, rep.Last = &first, &last
+	}
+
+	rep.BodyPercentiles = make(map[string]int)
+	if len(an.bodySizes) > 0 {
+		sort.Slice(an.bodySizes, func(i, j int) bool { return an.bodySizes[i] < an.bodySizes[j] })
+		for _, p := range []int{50, 90, 99} {
+			rep.BodyPercentiles[fmt.Sprintf("p%d", p)] = int(an.bodySizes[(len(an.bodySizes)-1)*p/100])
+		}
+		rep.BodyPercentiles["max"] = int(an.bodySizes[len(an.bodySizes)-1])
+	}
+
+	starts := make([]int64, 0, len(an.buckets))
+	for start := range an.buckets {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	for _, start := range starts {
+		count := an.buckets[start]
+		rep.Rate = append(rep.Rate, rateEntry{
+			Start:    time.Unix(0, start).UTC(),
+			Requests: count,
+			PerSec:   float64(count) / an.interval.Seconds()})
+	}
+	return rep
+}
+
+// printText prints the report for humans
+func (rep *analysisReport) printText(w io.Writer) {
+
+	fmt.Fprintf(w, "Files:      %d\n", len(rep.Files))
+	fmt.Fprintf(w, "Requests:   %d\n", rep.Requests)
+	if rep.First != nil {
+		fmt.Fprintf(w, "Time range: %s - %s\n", rep.First.Format(time.RFC3339), rep.Last.Format(time.RFC3339))
+	}
+
+	table := func(title string, entries []countEntry) {
+		fmt.Fprintf(w, "\n%s:\n", title)
+		if len(entries) == 0 {
+			fmt.Fprintf(w, "  (none recorded)\n")
+		}
+		for _, e := range entries {
+			pct := 0.0
+			if rep.Requests > 0 {
+				pct = float64(e.Count) * 100 / float64(rep.Requests)
+			}
+			fmt.Fprintf(w, "  %10d  %5.1f%%  %s\n", e.Count, pct, e.Key)
+		}
+	}
+	table("Top URIs", rep.TopURIs)
+	table("Methods", rep.Methods)
+	table("Response status", rep.Statuses)
+
+	fmt.Fprintf(w, "\nBody size:  total %s", humanBytes(rep.BodyBytes))
+	for _, p := range []string{"p50", "p90", "p99", "max"} {
+		if v, ok := rep.BodyPercentiles[p]; ok {
+			fmt.Fprintf(w, ", %s %s", p, humanBytes(int64(v)))
+		}
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "\nRequests per second (%s intervals):\n", rep.Interval)
+	if len(rep.Rate) == 0 {
+		fmt.Fprintf(w, "  (no timestamps)\n")
+	}
+	layout := time.RFC3339
+	if interval, _ := time.ParseDuration(rep.Interval); interval < time.Second {
+		layout = "2006-01-02T15:04:05.000Z07:00"
+	}
+	for _, r := range rep.Rate {
+		fmt.Fprintf(w, "  %s  %10d  %10.2f/s\n", r.Start.Format(layout), r.Requests, r.PerSec)
+	}
+}
+
+// runAnalyze prints a traffic report over one or more archives
+func runAnalyze(args []string) (err error) {
+
+	fs := newFlagSet("analyze", "<archive-url>...")
+	top := fs.IntP("top", "n", 20, "Number of top URIs to show")
+	interval := fs.DurationP("interval", "i", time.Minute, "Interval for the requests per second table")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	mmap := fs.Bool("mmap", false, "Memory map local uncompressed archives instead of reading them")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	an := newAnalyzer(*interval)
+	an.mmap = *mmap
+	for _, fileName := range fs.Args() {
+		err = an.addArchive(fileName)
+		if err != nil {
+			return err
+		}
+	}
+
+	rep := an.report(fs.Args(), *top)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rep)
+	}
+	rep.printText(os.Stdout)
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopN(t *testing.T) {
+
+	counts := map[string]int64{"/a": 2, "/b": 5, "/c": 2, "/d": 1}
+	if got := fmt.Sprint(topN(counts, 3)); got != "[{/b 5} {/a 2} {/c 2}]" {
+		t.Fatalf("got %s", got)
+	}
+	if got := topN(counts, 0); len(got) != 4 {
+		t.Fatalf("got %v", got)
+	}
+	if got := topN(nil, 3); got == nil || len(got) != 0 { // [] in JSON
+		t.Fatalf("got %v", got)
+	}
+}
+
+// analyzeTestArchive has 4 requests, 3 of them to /a, in two 10s intervals
+func analyzeTestArchive(t *testing.T) string {
+	return writeArchive(t, tempDir(t), false,
+		testRequest(0, "GET", "/a?x=1", "", ""),
+		testRequest(1, "GET", "/a?y", "", ""),
+		testRequest(5, "POST", "/b", "", strings.Repeat("b", 100)),
+		testRequest(12, "POST", "/a", "", strings.Repeat("a", 10)))
+}
+
+func TestAnalyze(t *testing.T) {
+
+	fileName := analyzeTestArchive(t)
+	out, err := captureOutput(t, runAnalyze, "--json", "-i", "10s", "-n", "1", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rep analysisReport
+	if err = json.Unmarshal([]byte(out), &rep); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(0, testTime).UTC()
+	if rep.Requests != 4 || len(rep.Files) != 1 || !rep.First.Equal(start) || !rep.Last.Equal(start.Add(12*time.Second)) ||
+		fmt.Sprint(rep.TopURIs) != "[{/a 3}]" || fmt.Sprint(rep.Methods) != "[{GET 2} {POST 2}]" ||
+		len(rep.Statuses) != 0 || rep.BodyBytes != 110 || rep.Interval != "10s" {
+		t.Fatalf("got %+v", rep)
+	}
+	if got := fmt.Sprint(rep.BodyPercentiles); got != "map[max:100 p50:0 p90:10 p99:10]" {
+		t.Fatalf("got percentiles %s", got)
+	}
+	if len(rep.Rate) != 2 || !rep.Rate[0].Start.Equal(start) || rep.Rate[0].Requests != 3 || rep.Rate[0].PerSec != 0.3 ||
+		!rep.Rate[1].Start.Equal(start.Add(10*time.Second)) || rep.Rate[1].Requests != 1 {
+		t.Fatalf("got rate %+v", rep.Rate)
+	}
+}
+
+func TestAnalyzeText(t *testing.T) {
+
+	fileName := analyzeTestArchive(t)
+	out, err := captureOutput(t, runAnalyze, "-i", "10s", fileName, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Files:      2\nRequests:   8\nTime range: 2020-09-13T12:26:40Z - 2020-09-13T12:26:52Z\n",
+		"\nTop URIs:\n           6   75.0%  /a\n           2   25.0%  /b\n",
+		"\nResponse status:\n  (none recorded)\n",
+		"\nBody size:  total 220B, p50 0B, p90 100B, p99 100B, max 100B\n",
+		"\nRequests per second (10s intervals):\n  2020-09-13T12:26:40Z           6        0.60/s\n" +
+			"  2020-09-13T12:26:50Z           2        0.20/s\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("no %q in %s", want, out)
+		}
+	}
+
+	// Intervals below a second are shown with milliseconds
+	out, err = captureOutput(t, runAnalyze, "-i", "500ms", fileName)
+	if err != nil || !strings.Contains(out, "  2020-09-13T12:26:52.000Z           1        2.00/s\n") {
+		t.Fatalf("got %s, %v", out, err)
+	}
+}
+
+func TestAnalyzeErrors(t *testing.T) {
+
+	fileName := analyzeTestArchive(t)
+	if _, err := captureOutput(t, runAnalyze, "-i", "0s", fileName); err != errUsage {
+		t.Fatalf("got %v with no interval", err)
+	}
+	if _, err := captureOutput(t, runAnalyze, fileName+".missing"); err == nil {
+		t.Fatal("no error for a missing archive")
+	}
+}
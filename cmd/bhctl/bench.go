@@ -0,0 +1,277 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+)
+
+// benchMaxDistinctBytes caps memory used by pre-built records. Records are
+// written round robin, so there must be enough distinct ones for codecs not
+// to find whole records repeated within their window.
+const benchMaxDistinctBytes = 16 << 20
+
+// benchResult is one row of the `bhctl bench` table
+type benchResult struct {
+	backend    string
+	codec      string
+	bufferSize int
+	rawBytes   int64 // frames written (uncompressed)
+	fileBytes  int64 // size of the archive file
+	write      time.Duration
+	read       time.Duration
+}
+
+// benchFrames builds `n` distinct request frames with bodies of `size` bytes.
+// Bodies are JSON-like: field names repeat, values are random. They compress
+// roughly like real bid requests do, rather than not at all or perfectly.
+func benchFrames(n, size int) (frames [][]byte, err error) {
+
+	words := []string{"id", "imp", "banner", "site", "device", "user", "geo", "price", "ts", "ext"}
+	rnd := rand.New(rand.NewSource(1))
+	var body, frame bytes.Buffer
+	for i := 0; i < n; i++ {
+		body.Reset()
+		body.WriteByte('{')
+		for body.Len() < size {
+			fmt.Fprintf(&body, `"%s":"%x",`, words[rnd.Intn(len(words))], rnd.Int63())
+		}
+		b := body.Bytes()[:size]
+
+		mr := request.CreateRequest(
+			[]byte("BENCH-"+strconv.Itoa(i)), []byte("POST"), []byte("/bench?n="+strconv.Itoa(i)),
+			[]byte("Host: localhost\r\nContent-Type: application/json\r\n\r\n"), b)
+		frame.Reset()
+		_, err = mr.WriteFrame(&frame)
+		mr.Release()
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, append([]byte(nil), frame.Bytes()...))
+	}
+	return frames, nil
+}
+
+// benchWriter opens a file for the benchmark. lz4, zstd, snappy and none are
+// written by lib/archive, the same as `blackhole` records. Other codecs are only
+// written by bhctl (convert, split), so they go through the same writer.
+// Both start with file header `header`. `finish` closes the file and returns
+// its name in `dir`.
+func benchWriter(dir, codec string, bufferSize int, header []byte) (w io.Writer, finish func() (string, error), err error) {
+
+	if _, err := common.CodecExtension(codec); err == nil {
+		rf, err := archive.NewArchive(dir, "bench", ".fbf",
+			common.Compression(codec),
+			common.BufferSize(bufferSize),
+			common.FileHeader(func() []byte { return header }),
+			common.Logger(common.DefaultLogger))
+		if err != nil {
+			return nil, nil, err
+		}
+		return rf, func() (string, error) {
+			err := rf.Close()
+			if err != nil {
+				return "", err
+			}
+			for _, details := range rf.FinalizedFiles() {
+				return details.FileName, nil
+			}
+			return "", errors.New("no file was written")
+		}, nil
+	}
+
+	name := fmt.Sprintf("bench_%s_%d_%d.fbf", codec, bufferSize, time.Now().UnixNano())
+	ow, err := newOutputWriterSize(dir, name, codec, bufferSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = ow.Write(header)
+	if err != nil {
+		ow.Abort()
+		return nil, nil, err
+	}
+	return ow, func() (string, error) {
+		return ow.Name(), ow.Close()
+	}, nil
+}
+
+// benchOne writes `records` frames to a new file in `dir`, then reads it back
+func benchOne(dir, codec string, bufferSize int, frames [][]byte, records int) (res benchResult, name string, err error) {
+
+	// The file header is written by both writers: count it so that an
+	// uncompressed archive has a ratio of 1. Headers carry their creation
+	// time, so their length varies: the one counted is the one written.
+	header := request.FileHeader()
+	res = benchResult{codec: codec, bufferSize: bufferSize, rawBytes: int64(len(header))}
+	if archive.IsLocal(dir) {
+		res.backend = "file"
+	} else {
+		res.backend = dir[:strings.Index(dir, "://")]
+	}
+
+	start := time.Now()
+	w, finish, err := benchWriter(dir, codec, bufferSize, header)
+	if err != nil {
+		return res, "", errors.Wrapf(err, "Unable to create archive in %s", dir)
+	}
+	for i := 0; i < records; i++ {
+		frame := frames[i%len(frames)]
+		_, err = w.Write(frame)
+		if err != nil {
+			finish()
+			return res, "", errors.Wrapf(err, "Write failed (%s, buffer %d)", codec, bufferSize)
+		}
+		res.rawBytes += int64(len(frame))
+	}
+	name, err = finish()
+	if err != nil {
+		return res, name, errors.Wrapf(err, "Unable to close archive (%s, buffer %d)", codec, bufferSize)
+	}
+	res.write = time.Since(start)
+
+	fileName := strings.TrimSuffix(dir, "/") + "/" + name
+	if archive.IsLocal(dir) {
+		fi, err := os.Stat(strings.TrimPrefix(fileName, "file://"))
+		if err == nil {
+			res.fileBytes = fi.Size()
+		}
+	}
+
+	start = time.Now()
+	rf, err := archive.OpenArchive(fileName, bufferSize)
+	if err != nil {
+		return res, name, errors.Wrapf(err, "Unable to open %s", fileName)
+	}
+	defer rf.Close()
+	n := 0
+	for {
+		umr, err := request.GetNextRequest(rf, false)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, name, errors.Wrapf(err, "Unable to read back %s", fileName)
+		}
+		umr.Release()
+		n++
+	}
+	res.read = time.Since(start)
+	if n != records {
+		return res, name, errors.Errorf("Read back %d records from %s, wrote %d", n, fileName, records)
+	}
+	return res, name, nil
+}
+
+// mbps is throughput in MB/s of uncompressed data
+func mbps(n int64, d time.Duration) float64 {
+	return float64(n) / (1 << 20) / d.Seconds()
+}
+
+func printBenchResults(results []benchResult, records int) {
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "BACKEND\tCODEC\tBUFFER\tFILE SIZE\tRATIO\tWRITE MB/s\tWRITE REC/s\tREAD MB/s\tREAD REC/s\t")
+	for _, r := range results {
+		size, ratio := "-", "-"
+		if r.fileBytes > 0 {
+			size = humanBytes(r.fileBytes)
+			ratio = fmt.Sprintf("%.2f", float64(r.rawBytes)/float64(r.fileBytes))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%.1f\t%.0f\t%.1f\t%.0f\t\n",
+			r.backend, r.codec, humanBytes(int64(r.bufferSize)), size, ratio,
+			mbps(r.rawBytes, r.write), float64(records)/r.write.Seconds(),
+			mbps(r.rawBytes, r.read), float64(records)/r.read.Seconds())
+	}
+	tw.Flush()
+}
+
+// runBench measures write and read throughput of every directory (backend),
+// codec and buffer size combination
+func runBench(args []string) (err error) {
+
+	fs := newFlagSet("bench", "[dir-url...]")
+	records := fs.IntP("records", "n", 10000, "Number of records written to each archive")
+	size := fs.IntP("size", "s", 1024, "Body size of each record, in bytes")
+	codecs := fs.StringSliceP("codecs", "c", []string{"none", "lz4", "zstd"},
+		"Codecs to compare: lz4, zstd, snappy, gzip, none")
+	bufferSizes := fs.IntSliceP("buffer-sizes", "b", []int{0, 65536}, "Buffer sizes to compare (0 - unbuffered)")
+	keep := fs.BoolP("keep", "k", false, "Keep the archives written (local directories only, remote ones are always kept)")
+	err = parseArgs(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	for _, codec := range *codecs {
+		if _, ok := codecExtensions[codec]; !ok {
+			fmt.Fprintf(os.Stderr, "Unknown codec: %q\n\n", codec)
+			fs.Usage()
+			return errUsage
+		}
+	}
+	if *records <= 0 || *size < 0 {
+		return errors.New("Number of records must be positive and size not negative")
+	}
+
+	dirs := fs.Args()
+	if len(dirs) == 0 {
+		tmpDir, err := ioutil.TempDir("", "bhctl-bench")
+		if err != nil {
+			return errors.Wrap(err, "Unable to create temporary directory")
+		}
+		defer os.RemoveAll(tmpDir)
+		dirs = []string{tmpDir}
+	}
+
+	distinct := *records
+	if maxDistinct := benchMaxDistinctBytes / (*size + 1); distinct > maxDistinct {
+		distinct = maxDistinct
+	}
+	if distinct < 1 {
+		distinct = 1
+	}
+	frames, err := benchFrames(distinct, *size)
+	if err != nil {
+		return errors.Wrap(err, "Unable to build records")
+	}
+
+	var results []benchResult
+	for _, dir := range dirs {
+		for _, codec := range *codecs {
+			for _, bufferSize := range *bufferSizes {
+				res, name, err := benchOne(dir, codec, bufferSize, frames, *records)
+				if name != "" && !*keep && archive.IsLocal(dir) {
+					archive.Delete(dir, []string{name})
+				}
+				if err != nil {
+					return err
+				}
+				results = append(results, res)
+			}
+		}
+	}
+	printBenchResults(results, *records)
+	return nil
+}
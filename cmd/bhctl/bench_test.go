@@ -0,0 +1,106 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/request"
+	"go.uber.org/zap"
+)
+
+func TestBenchFrames(t *testing.T) {
+
+	frames, err := benchFrames(3, 100)
+	if err != nil || len(frames) != 3 {
+		t.Fatalf("got %d frames, %v", len(frames), err)
+	}
+	again, _ := benchFrames(3, 100)
+	bodies := map[string]bool{}
+	for i := range frames {
+		body, bodyAgain := benchBody(t, frames[i]), benchBody(t, again[i])
+		if len(body) != 100 || body[0] != '{' || body != bodyAgain {
+			t.Fatalf("frame %d: got body %q, then %q", i, body, bodyAgain)
+		}
+		bodies[body] = true
+	}
+	if len(bodies) != 3 {
+		t.Fatal("bodies not distinct")
+	}
+}
+
+// benchBody is the body of the request of a frame
+func benchBody(t *testing.T, frame []byte) string {
+	umr, err := request.GetNextFrame(bytes.NewReader(frame), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer umr.Release()
+	return string(umr.Request().BodyBytes())
+}
+
+// An uncompressed archive is as large as what was written to it
+func TestBenchOne(t *testing.T) {
+
+	common.DefaultLogger = zap.NewNop() // as set by parseArgs
+	frames, err := benchFrames(10, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, codec := range []string{"none", "gzip"} {
+		res, name, err := benchOne(tempDir(t), codec, 4096, frames, 25)
+		if err != nil || name == "" || res.backend != "file" || res.write <= 0 || res.read <= 0 {
+			t.Fatalf("%s: got %+v, %s, %v", codec, res, name, err)
+		}
+		if codec == "none" && res.fileBytes != res.rawBytes {
+			t.Fatalf("%d bytes written, file of %d", res.rawBytes, res.fileBytes)
+		}
+	}
+}
+
+func TestBench(t *testing.T) {
+
+	dir := tempDir(t)
+	out, err := captureOutput(t, runBench, "-n", "50", "-s", "100", "-c", "none,lz4,gzip", "-b", "0,4096", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != 7 || !strings.Contains(lines[0], "BACKEND") || !strings.Contains(lines[1], " 1.00 ") {
+		t.Fatalf("got %s", out)
+	}
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 0 {
+		t.Fatalf("%d archives left", len(infos))
+	}
+
+	if _, err = captureOutput(t, runBench, "-n", "10", "-c", "lz4", "-b", "0", "--keep", dir); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 1 {
+		t.Fatalf("%d archives kept", len(infos))
+	}
+}
+
+func TestBenchErrors(t *testing.T) {
+
+	if _, err := captureOutput(t, runBench, "-c", "brotli"); err != errUsage {
+		t.Fatalf("got %v with an unknown codec", err)
+	}
+	if _, err := captureOutput(t, runBench, "-n", "0"); err == nil {
+		t.Fatal("no error without records")
+	}
+}
@@ -0,0 +1,413 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+)
+
+// jsonRecord is one line of `bhctl convert --to jsonl` output. Bodies that
+// are not valid UTF-8 go into BodyBase64 instead of Body.
+type jsonRecord struct {
+	ID         string           `json:"id"`
+	Time       string           `json:"time,omitempty"`
+	Method     string           `json:"method"`
+	URI        string           `json:"uri"`
+	Headers    []request.Header `json:"headers"`
+	Body       string           `json:"body,omitempty"`
+	BodyBase64 string           `json:"body_base64,omitempty"`
+	BodySize   int              `json:"body_size"`
+	Response   *jsonResponse    `json:"response,omitempty"` // recorded by bhproxy only
+}
+
+// jsonResponse is the response recorded along with a request
+type jsonResponse struct {
+	Status     int              `json:"status"`
+	Headers    []request.Header `json:"headers"`
+	Body       string           `json:"body,omitempty"`
+	BodyBase64 string           `json:"body_base64,omitempty"`
+	BodySize   int              `json:"body_size"`
+	DurationMs float64          `json:"duration_ms"`
+}
+
+// bodyText returns a body as text, or base64 encoded if not valid UTF-8
+func bodyText(body []byte) (text, b64 string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return "", base64.StdEncoding.EncodeToString(body)
+}
+
+// newJSONRecord flattens a request into a jsonRecord
+func newJSONRecord(req *fbr.Request, stripBody bool) *jsonRecord {
+
+	jr := &jsonRecord{
+		ID:       string(req.Id()),
+		Method:   string(req.Method()),
+		URI:      string(req.Uri()),
+		Headers:  request.SplitHeaders(req.Headers()),
+		BodySize: req.BodyLength(),
+	}
+	if ts := recordTime(req); !ts.IsZero() {
+		jr.Time = ts.UTC().Format(time.RFC3339Nano)
+	}
+	if !stripBody {
+		jr.Body, jr.BodyBase64 = bodyText(req.BodyBytes())
+	}
+	if req.Status() != 0 {
+		jr.Response = &jsonResponse{
+			Status:     int(req.Status()),
+			Headers:    request.SplitHeaders(req.ResponseHeaders()),
+			BodySize:   req.ResponseBodyLength(),
+			DurationMs: float64(req.Duration()) / float64(time.Millisecond),
+		}
+		if !stripBody {
+			jr.Response.Body, jr.Response.BodyBase64 = bodyText(req.ResponseBodyBytes())
+		}
+	}
+	return jr
+}
+
+// HAR 1.2 (http://www.softwareishard.com/blog/har-12-spec/). Responses are
+// only there if recorded by bhproxy, otherwise they are left empty; fields
+// are there because the spec makes them mandatory.
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"` // "base64" if body is not valid UTF-8
+}
+
+type harRequest struct {
+	Method      string           `json:"method"`
+	URL         string           `json:"url"`
+	HTTPVersion string           `json:"httpVersion"`
+	Cookies     []harNameValue   `json:"cookies"`
+	Headers     []request.Header `json:"headers"`
+	QueryString []harNameValue   `json:"queryString"`
+	PostData    *harPostData     `json:"postData,omitempty"`
+	HeadersSize int              `json:"headersSize"`
+	BodySize    int              `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harResponse struct {
+	Status      int              `json:"status"`
+	StatusText  string           `json:"statusText"`
+	HTTPVersion string           `json:"httpVersion"`
+	Cookies     []harNameValue   `json:"cookies"`
+	Headers     []request.Header `json:"headers"`
+	Content     harContent       `json:"content"`
+	RedirectURL string           `json:"redirectURL"`
+	HeadersSize int              `json:"headersSize"`
+	BodySize    int              `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    int `json:"send"`
+	Wait    int `json:"wait"`
+	Receive int `json:"receive"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            int         `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ID              string      `json:"_id"`
+}
+
+// newHAREntry converts a request to a HAR entry. Recorded URIs are usually
+// relative, so the Host header and `scheme` are used to make them absolute.
+func newHAREntry(req *fbr.Request, scheme string, stripBody bool) *harEntry {
+
+	jr := newJSONRecord(req, stripBody)
+	entry := &harEntry{
+		StartedDateTime: jr.Time,
+		ID:              jr.ID,
+		Request: harRequest{
+			Method:      jr.Method,
+			URL:         jr.URI,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     jr.Headers,
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    jr.BodySize,
+		},
+		Response: harResponse{
+			Cookies:     []harNameValue{},
+			Headers:     []request.Header{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+	}
+	if entry.StartedDateTime == "" {
+		entry.StartedDateTime = time.Unix(0, 0).UTC().Format(time.RFC3339Nano)
+	}
+	if entry.Request.Headers == nil {
+		entry.Request.Headers = []request.Header{}
+	}
+
+	if u, err := url.Parse(jr.URI); err == nil {
+		if !u.IsAbs() {
+			u.Scheme = scheme
+			u.Host = request.HeaderValue(jr.Headers, "Host")
+			entry.Request.URL = u.String()
+		}
+		for name, values := range u.Query() {
+			for _, value := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{name, value})
+			}
+		}
+	}
+
+	if !stripBody && jr.BodySize > 0 {
+		entry.Request.PostData = &harPostData{
+			MimeType: request.HeaderValue(jr.Headers, "Content-Type"),
+			Text:     jr.Body,
+		}
+		if jr.BodyBase64 != "" {
+			entry.Request.PostData.Text = jr.BodyBase64
+			entry.Request.PostData.Encoding = "base64"
+		}
+	}
+
+	if resp := jr.Response; resp != nil {
+		entry.Response.Status = resp.Status
+		entry.Response.StatusText = http.StatusText(resp.Status)
+		entry.Response.HTTPVersion = "HTTP/1.1"
+		entry.Response.Headers = resp.Headers
+		if entry.Response.Headers == nil {
+			entry.Response.Headers = []request.Header{}
+		}
+		entry.Response.RedirectURL = request.HeaderValue(resp.Headers, "Location")
+		entry.Response.BodySize = resp.BodySize
+		entry.Response.Content = harContent{
+			Size:     resp.BodySize,
+			MimeType: request.HeaderValue(resp.Headers, "Content-Type"),
+			Text:     resp.Body,
+		}
+		if resp.BodyBase64 != "" {
+			entry.Response.Content.Text = resp.BodyBase64
+			entry.Response.Content.Encoding = "base64"
+		}
+		entry.Time = int(resp.DurationMs)
+		entry.Timings.Wait = int(resp.DurationMs)
+	}
+	return entry
+}
+
+// converter writes records out in one of the `--to` formats
+type converter struct {
+	to        string
+	scheme    string
+	stripBody bool
+	dict      *request.Dictionary // archives: compress requests with it
+	plain     bool                // archives: write requests uncompressed
+	ow        *outputWriter
+	enc       *json.Encoder
+	buf       []byte // frame being written
+}
+
+func (cv *converter) begin() (err error) {
+	cv.enc = json.NewEncoder(cv.ow)
+	cv.enc.SetEscapeHTML(false)
+	if cv.to == "har" {
+		_, err = fmt.Fprintf(cv.ow, `{"log":{"version":"1.2","creator":{"name":"bhctl","version":%q},"entries":[`, buildTS)
+	}
+	return err
+}
+
+func (cv *converter) write(umr *request.UnmarshalledRequest) (err error) {
+
+	switch cv.to {
+	case "jsonl":
+		if umr.IsHeader() {
+			return nil
+		}
+		err = cv.enc.Encode(newJSONRecord(umr.Request(), cv.stripBody))
+		cv.ow.Records++
+	case "har":
+		if umr.IsHeader() {
+			return nil
+		}
+		if cv.ow.Records > 0 {
+			_, err = cv.ow.Write([]byte{','})
+			if err != nil {
+				return err
+			}
+		}
+		err = cv.enc.Encode(newHAREntry(umr.Request(), cv.scheme, cv.stripBody))
+		cv.ow.Records++
+	default: // archive, only re-compressed
+		if umr.IsHeader() && cv.dict != nil {
+			_, err = cv.ow.Write(cv.dict.FileHeader())
+			return err
+		}
+		if umr.IsHeader() || (!cv.stripBody && cv.dict == nil && !(cv.plain && umr.IsCompressed())) {
+			return cv.ow.writeFrame(umr)
+		}
+		payload := umr.Payload()
+		if cv.stripBody {
+			req := umr.Request()
+			mr := request.CreateRequestAt(req.Timestamp(),
+				req.Id(), req.Method(), req.Uri(), req.Headers(), nil)
+			defer mr.Release()
+			payload = mr.Bytes()
+		}
+		if cv.dict != nil {
+			cv.buf = cv.dict.AppendFrame(cv.buf[:0], payload)
+		} else {
+			cv.buf = request.AppendFrame(cv.buf[:0], payload)
+		}
+		_, err = cv.ow.Write(cv.buf)
+		cv.ow.Records++
+	}
+	return err
+}
+
+func (cv *converter) end() (err error) {
+	if cv.to == "har" {
+		_, err = cv.ow.Write([]byte("]}}\n"))
+	}
+	return err
+}
+
+// convertFile converts a single archive into `outDir`
+func convertFile(fileName, outDir string, cv *converter, codec string) (err error) {
+
+	const archiveFileReadBufSize = 65536 // 64 K
+
+	rf, err := archive.OpenArchive(fileName, archiveFileReadBufSize)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to open archive file: %s", fileName)
+	}
+	defer rf.Close()
+
+	name := baseName(fileName)
+	switch cv.to {
+	case "jsonl", "har":
+		name += "." + cv.to
+	default:
+		name += ".fbf"
+		codec = cv.to
+	}
+	cv.ow, err = newOutputWriter(outDir, name, codec)
+	if err != nil {
+		return err
+	}
+
+	err = cv.begin()
+	for err == nil {
+		var umr *request.UnmarshalledRequest
+		umr, err = request.GetNextFrame(rf, false)
+		if err == io.EOF {
+			err = cv.end()
+			break
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "corrupted archive after %d records", cv.ow.Records)
+			break
+		}
+		err = cv.write(umr)
+		umr.Release()
+	}
+	if err != nil {
+		cv.ow.Abort()
+		return errors.Wrapf(err, "unable to convert %s", fileName)
+	}
+
+	err = cv.ow.Close()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\t%d records\n", cv.ow.Name(), cv.ow.Records)
+	return nil
+}
+
+// runConvert re-encodes archives: recompress, strip bodies or change format
+func runConvert(args []string) (err error) {
+
+	fs := newFlagSet("convert", "<archive-url>...")
+	to := fs.StringP("to", "t", "", "Output format: lz4, zstd, snappy, gzip, none (archives), jsonl or har")
+	codec := fs.StringP("codec", "c", "none", "Compression for jsonl/har output: lz4, zstd, snappy, gzip or none")
+	outDir := fs.StringP("output-dir", "o", ".", "Directory (or s3/az/adls/gs/sftp/hdfs URL) to write converted files to")
+	stripBodies := fs.Bool("strip-bodies", false, "Drop request bodies")
+	scheme := fs.String("scheme", "http", "Scheme used to build absolute URLs in har output")
+	dictFile := fs.String("dictionary", "",
+		"Archive output: compress requests one by one with this zstd dictionary (see bhctl dict), or none to write them uncompressed again")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	_, isCodec := codecExtensions[*to]
+	if !isCodec && *to != "jsonl" && *to != "har" {
+		fmt.Fprintf(os.Stderr, "Unknown output format: %q\n\n", *to)
+		fs.Usage()
+		return errUsage
+	}
+	if _, ok := codecExtensions[*codec]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown codec: %q\n\n", *codec)
+		fs.Usage()
+		return errUsage
+	}
+
+	var dict *request.Dictionary
+	if *dictFile != "" && *dictFile != "none" {
+		raw, err := ioutil.ReadFile(*dictFile)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to read dictionary %s", *dictFile)
+		}
+		dict, err = request.NewDictionary(raw)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to use dictionary %s", *dictFile)
+		}
+	}
+
+	for _, fileName := range fs.Args() {
+		cv := &converter{to: *to, scheme: *scheme, stripBody: *stripBodies, dict: dict, plain: *dictFile == "none"}
+		err = convertFile(fileName, *outDir, cv, *codec)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
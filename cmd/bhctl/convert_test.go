@@ -0,0 +1,198 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/request"
+)
+
+// convertTestArchive has a text body, a binary one and a recorded response
+func convertTestArchive(t *testing.T) string {
+	return writeArchive(t, tempDir(t), false,
+		testRequest(1, "POST", "/a?x=1&x=2", "Host: example.com\r\nContent-Type: text/plain\r\n\r\n", "text"),
+		testRequest(2, "PUT", "/b", "Host: example.com\r\n\r\n", "\xff\x00"),
+		request.CreateExchangeAt(testTime+3e9, []byte("id-3"), []byte("GET"), []byte("https://api.example.com/c"),
+			[]byte("Host: example.com\r\n\r\n"), nil, &request.Response{Status: 201,
+				Headers: []byte("Content-Type: application/json\r\nLocation: /c/1\r\n\r\n"), Body: []byte(`{"id":1}`),
+				Duration: 1500 * time.Millisecond}))
+}
+
+func TestBodyText(t *testing.T) {
+
+	if text, b64 := bodyText([]byte("héllo")); text != "héllo" || b64 != "" {
+		t.Fatalf("got %q, %q", text, b64)
+	}
+	if text, b64 := bodyText([]byte{0xff, 0}); text != "" || b64 != "/wA=" {
+		t.Fatalf("got %q, %q", text, b64)
+	}
+}
+
+func TestConvertJSONL(t *testing.T) {
+
+	fileName := convertTestArchive(t)
+	outDir := tempDir(t)
+	out, err := captureOutput(t, runConvert, "--to", "jsonl", "-o", outDir, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := baseName(fileName) + ".jsonl"
+	if out != name+"\t3 records\n" {
+		t.Fatalf("got %q", out)
+	}
+	fp, err := os.Open(filepath.Join(outDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	var records []jsonRecord
+	for sc := bufio.NewScanner(fp); sc.Scan(); {
+		var jr jsonRecord
+		if err = json.Unmarshal(sc.Bytes(), &jr); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, jr)
+	}
+	if len(records) != 3 {
+		t.Fatalf("got %d records", len(records))
+	}
+	a, b, c := records[0], records[1], records[2]
+	if a.ID != "id-1" || a.Time != time.Unix(0, testTime+1e9).UTC().Format(time.RFC3339Nano) || a.Method != "POST" ||
+		a.URI != "/a?x=1&x=2" || len(a.Headers) != 2 || a.Headers[1] != (request.Header{Name: "Content-Type", Value: "text/plain"}) ||
+		a.Body != "text" || a.BodyBase64 != "" || a.BodySize != 4 || a.Response != nil {
+		t.Fatalf("got %+v", a)
+	}
+	if b.Body != "" || b.BodyBase64 != "/wA=" || b.BodySize != 2 {
+		t.Fatalf("got %+v", b)
+	}
+	if r := c.Response; r == nil || r.Status != 201 || len(r.Headers) != 2 || r.Body != `{"id":1}` || r.BodySize != 8 ||
+		r.DurationMs != 1500 {
+		t.Fatalf("got response %+v", r)
+	}
+
+	// Sizes are kept when bodies are stripped
+	if _, err = captureOutput(t, runConvert, "--to", "jsonl", "--strip-bodies", "-c", "gzip", "-o", outDir, fileName); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := os.Open(filepath.Join(outDir, name+".gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gz.Close()
+	zr, err := gzip.NewReader(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stripped jsonRecord
+	if err = json.NewDecoder(zr).Decode(&stripped); err != nil {
+		t.Fatal(err)
+	}
+	if stripped.ID != "id-1" || stripped.Body != "" || stripped.BodySize != 4 {
+		t.Fatalf("got %+v", stripped)
+	}
+}
+
+func TestConvertHAR(t *testing.T) {
+
+	fileName := convertTestArchive(t)
+	outDir := tempDir(t)
+	if _, err := captureOutput(t, runConvert, "--to", "har", "--scheme", "https", "-o", outDir, fileName); err != nil {
+		t.Fatal(err)
+	}
+	fp, err := os.Open(filepath.Join(outDir, baseName(fileName)+".har"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	var har struct {
+		Log struct {
+			Version string
+			Entries []harEntry
+		}
+	}
+	if err = json.NewDecoder(fp).Decode(&har); err != nil {
+		t.Fatal(err)
+	}
+	if har.Log.Version != "1.2" || len(har.Log.Entries) != 3 {
+		t.Fatalf("got %+v", har.Log)
+	}
+
+	a := har.Log.Entries[0]
+	if a.Request.URL != "https://example.com/a?x=1&x=2" || len(a.Request.QueryString) != 2 ||
+		a.Request.QueryString[1] != (harNameValue{"x", "2"}) || a.Request.PostData == nil ||
+		*a.Request.PostData != (harPostData{MimeType: "text/plain", Text: "text"}) || a.Response.Status != 0 ||
+		a.Response.BodySize != -1 {
+		t.Fatalf("got %+v", a)
+	}
+	if b := har.Log.Entries[1]; b.Request.PostData == nil || b.Request.PostData.Text != "/wA=" ||
+		b.Request.PostData.Encoding != "base64" {
+		t.Fatalf("got %+v", b)
+	}
+
+	// Absolute URIs are kept, the response is there when recorded
+	c := har.Log.Entries[2]
+	if c.Request.URL != "https://api.example.com/c" || c.Request.PostData != nil || c.Time != 1500 ||
+		c.Response.Status != 201 || c.Response.StatusText != "Created" || c.Response.RedirectURL != "/c/1" ||
+		c.Response.Content != (harContent{Size: 8, MimeType: "application/json", Text: `{"id":1}`}) {
+		t.Fatalf("got %+v", c)
+	}
+}
+
+// Archives are recompressed, with bodies dropped if asked to
+func TestConvertArchive(t *testing.T) {
+
+	fileName := convertTestArchive(t)
+	outDir := tempDir(t)
+	if _, err := captureOutput(t, runConvert, "--to", "zstd", "--strip-bodies", "-o", outDir, fileName); err != nil {
+		t.Fatal(err)
+	}
+	converted := filepath.Join(outDir, baseName(fileName)+".fbf.zst")
+	var uris []string
+	err := forEachRequest(converted, func(req *fbr.Request, offset int64) error {
+		if req.BodyLength() != 0 || req.Timestamp() == 0 {
+			t.Fatalf("%s: got a body of %d bytes, timestamp %d", req.Uri(), req.BodyLength(), req.Timestamp())
+		}
+		uris = append(uris, string(req.Uri()))
+		return nil
+	})
+	if err != nil || len(uris) != 3 || uris[2] != "https://api.example.com/c" {
+		t.Fatalf("got %q, %v", uris, err)
+	}
+	if st, err := scanArchive(converted); err != nil || st.header == nil {
+		t.Fatalf("got %+v, %v", st, err)
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+
+	fileName := convertTestArchive(t)
+	for _, args := range [][]string{
+		{"--to", "xml", fileName},
+		{"--to", "jsonl", "-c", "brotli", fileName},
+	} {
+		if _, err := captureOutput(t, runConvert, args...); err != errUsage {
+			t.Fatalf("%q: got %v", args, err)
+		}
+	}
+	if _, err := captureOutput(t, runConvert, "--to", "jsonl", "-o", tempDir(t), fileName+".missing"); err == nil {
+		t.Fatal("no error for a missing archive")
+	}
+}
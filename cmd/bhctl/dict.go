@@ -0,0 +1,103 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+)
+
+// dictSamples collects request payloads (flatbuffers, decompressed) of
+// archives, up to `max` requests
+func dictSamples(files []string, max int) (samples [][]byte, total int64, err error) {
+
+	const archiveFileReadBufSize = 65536 // 64 K
+	const maxBytes = 1 << 30             // samples are all held in memory
+
+	for _, fileName := range files {
+		rf, err := archive.OpenArchive(fileName, archiveFileReadBufSize)
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "Unable to open archive file: %s", fileName)
+		}
+		for len(samples) < max && total < maxBytes {
+			umr, err := request.GetNextRequest(rf, false)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				rf.Close()
+				return nil, 0, errors.Wrapf(err, "corrupted archive %s", fileName)
+			}
+			samples = append(samples, append([]byte(nil), umr.Payload()...))
+			total += int64(len(umr.Payload()))
+			umr.Release()
+		}
+		rf.Close()
+		if len(samples) >= max || total >= maxBytes {
+			break
+		}
+	}
+	return samples, total, nil
+}
+
+// runDict trains a zstd dictionary on the requests of sample archives, for
+// `blackhole --dictionary` and `convert --dictionary`
+func runDict(args []string) (err error) {
+
+	fs := newFlagSet("dict", "<archive-url>...")
+	output := fs.StringP("output", "o", "requests.dict", "Dictionary file to write")
+	size := fs.IntP("size", "s", request.DefaultDictSize, "Dictionary size in bytes")
+	max := fs.IntP("samples", "n", 100000, "Requests to train on, at most (from the first archives)")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *size < 1024 || *max <= 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	samples, total, err := dictSamples(fs.Args(), *max)
+	if err != nil {
+		return err
+	}
+	raw, err := request.TrainDictionary(samples, *size)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(*output, raw, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to write %s", *output)
+	}
+
+	// What the samples would take as frames compressed with it
+	dict, err := request.NewDictionary(raw)
+	if err != nil {
+		return err
+	}
+	var frames int64
+	var buf []byte
+	for _, sample := range samples {
+		buf = dict.AppendFrame(buf[:0], sample)
+		frames += int64(len(buf))
+	}
+	fmt.Printf("%s\t%d bytes\tid %d\n", *output, len(raw), dict.ID())
+	fmt.Printf("%d requests, %d bytes: %d bytes compressed one by one (%.1f%%)\n",
+		len(samples), total, frames, 100*float64(frames)/float64(total))
+	return nil
+}
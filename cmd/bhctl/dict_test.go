@@ -0,0 +1,195 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/request"
+	"go.uber.org/zap"
+)
+
+// dictTestArchive has `n` similar JSON API calls, as dictionaries are
+// trained on
+func dictTestArchive(t *testing.T, dir string, n int) string {
+	var reqs []*request.MarshalledRequest
+	for i := 0; i < n; i++ {
+		reqs = append(reqs, testRequest(i, "POST", fmt.Sprintf("/api/v1/events/%d", i),
+			"Host: api.example.com\r\nContent-Type: application/json\r\nUser-Agent: client/1.0\r\n\r\n",
+			fmt.Sprintf(`{"event": "click", "user": "user-%d", "page": "/products/%d", "ts": %d}`, i%7, i%13, 1600000000+i)))
+	}
+	return writeArchive(t, dir, false, reqs...)
+}
+
+// compressedFrames counts requests of an archive, and those compressed
+// with a dictionary
+func compressedFrames(t *testing.T, fileName string) (compressed, total int) {
+
+	t.Helper()
+	rf, err := archive.OpenArchive(fileName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	for {
+		umr, err := request.GetNextFrame(rf, false)
+		if err == io.EOF {
+			return compressed, total
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !umr.IsHeader() {
+			total++
+			if umr.IsCompressed() {
+				compressed++
+			}
+		}
+		umr.Release()
+	}
+}
+
+func TestDictSamples(t *testing.T) {
+
+	common.DefaultLogger = zap.NewNop() // as set by parseArgs
+	dir := tempDir(t)
+	a := writeArchive(t, dir, false, testRequest(0, "GET", "/a", "", ""), testRequest(1, "GET", "/b", "", ""))
+	b := writeArchive(t, dir, true, testRequest(2, "GET", "/c", "", ""), testRequest(3, "GET", "/d", "", ""))
+
+	var want [][]byte
+	var wantTotal int64
+	for i, uri := range []string{"/a", "/b", "/c"} {
+		mr := testRequest(i, "GET", uri, "", "")
+		want = append(want, append([]byte(nil), mr.Bytes()...))
+		wantTotal += int64(len(mr.Bytes()))
+		mr.Release()
+	}
+	samples, total, err := dictSamples([]string{a, b}, 3)
+	if err != nil || len(samples) != 3 || total != wantTotal {
+		t.Fatalf("got %d samples, %d bytes, %v", len(samples), total, err)
+	}
+	for i := range want {
+		if !bytes.Equal(samples[i], want[i]) {
+			t.Fatalf("sample %d: got %q, want %q", i, samples[i], want[i])
+		}
+	}
+	if _, _, err = dictSamples([]string{filepath.Join(dir, "missing.fbf")}, 3); err == nil {
+		t.Fatal("no error for a missing archive")
+	}
+}
+
+func TestDict(t *testing.T) {
+
+	dir := tempDir(t)
+	fileName := dictTestArchive(t, dir, 200)
+	dictFile := filepath.Join(dir, "events.dict")
+	out, err := captureOutput(t, runDict, "-o", dictFile, "-s", "4096", "-n", "150", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(dictFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict, err := request.NewDictionary(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out, "\n")
+	if len(lines) != 3 || lines[0] != fmt.Sprintf("%s\t%d bytes\tid %d", dictFile, len(raw), dict.ID()) ||
+		!strings.HasPrefix(lines[1], "150 requests, ") {
+		t.Fatalf("got %q", out)
+	}
+	var requests, bytes, compressed int64
+	var ratio float64
+	if _, err = fmt.Sscanf(lines[1], "%d requests, %d bytes: %d bytes compressed one by one (%f%%)",
+		&requests, &bytes, &compressed, &ratio); err != nil || compressed >= bytes || ratio >= 100 {
+		t.Fatalf("got %q, %v", lines[1], err)
+	}
+}
+
+func TestDictErrors(t *testing.T) {
+
+	dir := tempDir(t)
+	for _, args := range [][]string{
+		{"-s", "1023", "requests.fbf"},
+		{"-n", "0", "requests.fbf"},
+	} {
+		if _, err := captureOutput(t, runDict, args...); err != errUsage {
+			t.Fatalf("%q: got %v", args, err)
+		}
+	}
+	writeFiles(t, dir, map[string]string{"empty.fbf": ""})
+	if _, err := captureOutput(t, runDict, "-o", filepath.Join(dir, "requests.dict"), filepath.Join(dir, "empty.fbf")); err == nil {
+		t.Fatal("no error without samples")
+	}
+
+	// Too few to train on
+	fileName := dictTestArchive(t, dir, 5)
+	if _, err := captureOutput(t, runDict, "-o", filepath.Join(dir, "requests.dict"), fileName); err == nil {
+		t.Fatal("no error with too few samples")
+	}
+}
+
+// Archives converted with a dictionary read back the same, and converted
+// with none are plain again
+func TestConvertDictionary(t *testing.T) {
+
+	dir := tempDir(t)
+	fileName := dictTestArchive(t, dir, 200)
+	dictFile := filepath.Join(dir, "events.dict")
+	if _, err := captureOutput(t, runDict, "-o", dictFile, "-s", "4096", fileName); err != nil {
+		t.Fatal(err)
+	}
+	want := readURIs(t, fileName)
+
+	dictDir := tempDir(t)
+	out, err := captureOutput(t, runConvert, "--to", "none", "--dictionary", dictFile, "-o", dictDir, fileName)
+	converted := filepath.Join(dictDir, baseName(fileName)+".fbf")
+	if err != nil || out != baseName(fileName)+".fbf\t200 records\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	if compressed, total := compressedFrames(t, converted); compressed != 200 || total != 200 {
+		t.Fatalf("%d of %d requests compressed", compressed, total)
+	}
+	if got := readURIs(t, converted); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("got %q", got)
+	}
+
+	plainDir := tempDir(t)
+	if _, err = captureOutput(t, runConvert, "--to", "none", "--dictionary", "none", "-o", plainDir, converted); err != nil {
+		t.Fatal(err)
+	}
+	plain := filepath.Join(plainDir, baseName(fileName)+".fbf")
+	if compressed, total := compressedFrames(t, plain); compressed != 0 || total != 200 {
+		t.Fatalf("%d of %d requests compressed", compressed, total)
+	}
+	if got := readURIs(t, plain); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("got %q", got)
+	}
+
+	writeFiles(t, dir, map[string]string{"bad.dict": "not a dictionary"})
+	for _, dictFile := range []string{filepath.Join(dir, "bad.dict"), filepath.Join(dir, "missing.dict")} {
+		if _, err = captureOutput(t, runConvert, "--to", "none", "--dictionary", dictFile, "-o", tempDir(t), fileName); err == nil {
+			t.Fatalf("%s: no error", dictFile)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/request"
+)
+
+// exporters are the targets of `bhctl export <target>`, same layout as commands
+var exporters = []command{
+	{"es", "Bulk index request metadata into Elasticsearch/OpenSearch", runExportES},
+	{"bigquery", "Load request metadata into a BigQuery table (load jobs or streaming)", runExportBigQuery},
+	{"vegeta", "Write requests as vegeta targets (json or http format, with bodies)", runExportVegeta},
+	{"k6", "Write requests as a k6 data file and a script replaying it", runExportK6},
+}
+
+// exportUsage lists the export targets
+func exportUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s export <target> [options] <archive-url>...\n\nTargets:\n", os.Args[0])
+	for _, cmd := range exporters {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+}
+
+// runExport dispatches to one of the exporters
+func runExport(args []string) (err error) {
+
+	if len(args) < 1 || args[0] == "-h" || args[0] == "--help" {
+		exportUsage()
+		return errUsage
+	}
+	for _, cmd := range exporters {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unknown export target: %s\n\n", args[0])
+	exportUsage()
+	return errUsage
+}
+
+// requestRow is the flat view of a request used by exporters that load
+// into databases and search engines: the things people filter on get
+// their own columns, raw headers are kept as one string.
+type requestRow struct {
+	ID          string     `json:"id"`
+	Time        *time.Time `json:"time,omitempty"`
+	Method      string     `json:"method"`
+	URI         string     `json:"uri"`
+	Path        string     `json:"path"`
+	Query       string     `json:"query,omitempty"`
+	Host        string     `json:"host,omitempty"`
+	UserAgent   string     `json:"user_agent,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+	Headers     string     `json:"headers"`
+	BodySize    int        `json:"body_size"`
+	Body        string     `json:"body,omitempty"`
+	Archive     string     `json:"archive"`
+	Offset      int64      `json:"offset"`
+}
+
+// newRequestRow flattens a request. Bodies are included only if `withBody`
+// and valid UTF-8 (binary bodies are of little use in these targets).
+func newRequestRow(req *fbr.Request, archiveName string, offset int64, withBody bool) *requestRow {
+
+	row := &requestRow{
+		ID:       string(req.Id()),
+		Method:   string(req.Method()),
+		URI:      string(req.Uri()),
+		Headers:  strings.TrimSpace(string(req.Headers())),
+		BodySize: req.BodyLength(),
+		Archive:  archiveName,
+		Offset:   offset,
+	}
+	if ts := recordTime(req); !ts.IsZero() {
+		ts = ts.UTC()
+		row.Time = &ts
+	}
+	row.Path = row.URI
+	if u, err := url.ParseRequestURI(row.URI); err == nil {
+		row.Path, row.Query = u.Path, u.RawQuery
+	}
+	headers := request.SplitHeaders(req.Headers())
+	row.Host = request.HeaderValue(headers, "Host")
+	row.UserAgent = request.HeaderValue(headers, "User-Agent")
+	row.ContentType = request.HeaderValue(headers, "Content-Type")
+	if body := req.BodyBytes(); withBody && utf8.Valid(body) {
+		row.Body = string(body)
+	}
+	return row
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+// bqSchema matches requestRow. Used when the table is created by us.
+var bqSchema = bigquery.Schema{
+	{Name: "id", Type: bigquery.StringFieldType, Required: true},
+	{Name: "time", Type: bigquery.TimestampFieldType},
+	{Name: "method", Type: bigquery.StringFieldType},
+	{Name: "uri", Type: bigquery.StringFieldType},
+	{Name: "path", Type: bigquery.StringFieldType},
+	{Name: "query", Type: bigquery.StringFieldType},
+	{Name: "host", Type: bigquery.StringFieldType},
+	{Name: "user_agent", Type: bigquery.StringFieldType},
+	{Name: "content_type", Type: bigquery.StringFieldType},
+	{Name: "headers", Type: bigquery.StringFieldType},
+	{Name: "body_size", Type: bigquery.IntegerFieldType},
+	{Name: "body", Type: bigquery.StringFieldType},
+	{Name: "archive", Type: bigquery.StringFieldType},
+	{Name: "offset", Type: bigquery.IntegerFieldType},
+}
+
+// bqRow adapts requestRow for the streaming API. The insert ID makes
+// retries (and exporting the same archive twice, within BigQuery's
+// de-duplication window) idempotent.
+type bqRow struct {
+	*requestRow
+}
+
+// Save implements bigquery.ValueSaver
+func (r bqRow) Save() (row map[string]bigquery.Value, insertID string, err error) {
+	row = map[string]bigquery.Value{
+		"id":           r.ID,
+		"method":       r.Method,
+		"uri":          r.URI,
+		"path":         r.Path,
+		"query":        r.Query,
+		"host":         r.Host,
+		"user_agent":   r.UserAgent,
+		"content_type": r.ContentType,
+		"headers":      r.Headers,
+		"body_size":    r.BodySize,
+		"body":         r.Body,
+		"archive":      r.Archive,
+		"offset":       r.Offset,
+	}
+	if r.Time != nil {
+		row["time"] = *r.Time
+	}
+	return row, fmt.Sprintf("%s:%d", r.Archive, r.Offset), nil
+}
+
+// bqLoadRow is a line of the newline delimited JSON used for load jobs.
+// BigQuery timestamps have microsecond precision and load jobs refuse more digits.
+type bqLoadRow struct {
+	*requestRow
+	Time string `json:"time,omitempty"`
+}
+
+func newBQLoadRow(row *requestRow) *bqLoadRow {
+	lr := &bqLoadRow{requestRow: row}
+	if row.Time != nil {
+		lr.Time = row.Time.Format("2006-01-02T15:04:05.000000Z07:00")
+	}
+	return lr
+}
+
+// ensureTable creates the table, partitioned by day on `time`, if it's missing
+func ensureTable(ctx context.Context, table *bigquery.Table) (err error) {
+
+	_, err = table.Metadata(ctx)
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*googleapi.Error); !ok || e.Code != http.StatusNotFound {
+		return errors.Wrapf(err, "unable to look up table %s", table.FullyQualifiedName())
+	}
+	err = table.Create(ctx, &bigquery.TableMetadata{
+		Schema:           bqSchema,
+		TimePartitioning: &bigquery.TimePartitioning{Field: "time", Type: bigquery.DayPartitioningType},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to create table %s", table.FullyQualifiedName())
+	}
+	fmt.Fprintf(os.Stderr, "Created table %s\n", table.FullyQualifiedName())
+	return nil
+}
+
+// writeLoadFile writes an archive as gzipped newline delimited JSON for a load job
+func writeLoadFile(fileName string, w io.Writer, bodies bool) (rows int64, err error) {
+
+	zw := gzip.NewWriter(w)
+	enc := json.NewEncoder(zw)
+	enc.SetEscapeHTML(false)
+	archiveName := path.Base(fileName)
+	err = forEachRequest(fileName, func(req *fbr.Request, offset int64) error {
+		rows++
+		return enc.Encode(newBQLoadRow(newRequestRow(req, archiveName, offset, bodies)))
+	})
+	if err != nil {
+		return rows, err
+	}
+	return rows, zw.Close()
+}
+
+// stageToGCS uploads a load file to gs://bucket/prefix and returns the object
+func stageToGCS(ctx context.Context, client *storage.Client, staging, localPath string) (obj *storage.ObjectHandle, err error) {
+
+	bucket, prefix := staging, ""
+	if i := strings.Index(staging, "/"); i >= 0 {
+		bucket, prefix = staging[:i], strings.Trim(staging[i+1:], "/")
+	}
+	name := path.Join(prefix, path.Base(localPath))
+
+	fp, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	obj = client.Bucket(bucket).Object(name)
+	ow := obj.NewWriter(ctx)
+	ow.ContentType = "application/gzip" // not Content-Encoding: load jobs want the raw gzip
+	_, err = io.Copy(ow, fp)
+	if err == nil {
+		err = ow.Close()
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to upload to gs://%s/%s", bucket, name)
+	}
+	return obj, nil
+}
+
+// bqLoad loads one archive with a load job: from GCS if `staging` is set,
+// else uploaded with the job itself.
+func bqLoad(ctx context.Context, table *bigquery.Table, gcs *storage.Client, staging, fileName string, bodies bool) (rows int64, err error) {
+
+	tmp, err := ioutil.TempFile("", baseName(fileName)+"_*.json.gz")
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	rows, err = writeLoadFile(fileName, tmp, bodies)
+	if err != nil {
+		return rows, err
+	}
+
+	var loader *bigquery.Loader
+	if gcs != nil {
+		obj, err := stageToGCS(ctx, gcs, staging, tmp.Name())
+		if err != nil {
+			return rows, err
+		}
+		defer obj.Delete(ctx)
+		src := bigquery.NewGCSReference(fmt.Sprintf("gs://%s/%s", obj.BucketName(), obj.ObjectName()))
+		src.SourceFormat = bigquery.JSON
+		src.Compression = bigquery.Gzip
+		loader = table.LoaderFrom(src)
+	} else {
+		_, err = tmp.Seek(0, io.SeekStart)
+		if err != nil {
+			return rows, err
+		}
+		src := bigquery.NewReaderSource(tmp)
+		src.SourceFormat = bigquery.JSON
+		loader = table.LoaderFrom(src)
+	}
+	loader.WriteDisposition = bigquery.WriteAppend
+
+	job, err := loader.Run(ctx)
+	if err != nil {
+		return rows, errors.Wrap(err, "unable to start load job")
+	}
+	status, err := job.Wait(ctx)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return rows, errors.Wrapf(err, "load job %s failed", job.ID())
+	}
+	return rows, nil
+}
+
+// bqStream inserts one archive with the streaming API, in batches
+func bqStream(ctx context.Context, table *bigquery.Table, fileName string, bodies bool, batchSize int) (rows int64, err error) {
+
+	inserter := table.Inserter()
+	archiveName := path.Base(fileName)
+	batch := make([]bigquery.ValueSaver, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := inserter.Put(ctx, batch)
+		if err != nil {
+			return errors.Wrapf(err, "streaming insert failed")
+		}
+		rows += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+	err = forEachRequest(fileName, func(req *fbr.Request, offset int64) error {
+		batch = append(batch, bqRow{newRequestRow(req, archiveName, offset, bodies)})
+		if len(batch) >= batchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	return rows, err
+}
+
+// runExportBigQuery loads request metadata rows into a BigQuery table
+func runExportBigQuery(args []string) (err error) {
+
+	fs := newFlagSet("export bigquery", "<archive-url>...")
+	project := fs.String("project", os.Getenv("GOOGLE_CLOUD_PROJECT"), "GCP project (default $GOOGLE_CLOUD_PROJECT)")
+	dataset := fs.String("dataset", "", "Dataset (must exist)")
+	tableName := fs.String("table", "requests", "Table, created partitioned by day if missing")
+	method := fs.String("method", "load", "load (load jobs) or stream (streaming inserts)")
+	staging := fs.String("gcs-staging", "", "With --method load, stage files in gs://bucket/prefix instead of uploading with the job")
+	bodies := fs.Bool("bodies", false, "Include request bodies (UTF-8 bodies only)")
+	batchSize := fs.Int("batch-size", 500, "Rows per streaming insert")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *project == "" || *dataset == "" || (*method != "load" && *method != "stream") || *batchSize <= 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	// Credentials come from the environment (GOOGLE_APPLICATION_CREDENTIALS,
+	// gcloud auth application-default login or the metadata server)
+	ctx := context.Background()
+	client, err := bigquery.NewClient(ctx, *project)
+	if err != nil {
+		return errors.Wrap(err, "unable to create BigQuery client")
+	}
+	defer client.Close()
+
+	var gcs *storage.Client
+	if *method == "load" && *staging != "" {
+		gcs, err = storage.NewClient(ctx)
+		if err != nil {
+			return errors.Wrap(err, "unable to create GCS client")
+		}
+		defer gcs.Close()
+	}
+
+	table := client.Dataset(*dataset).Table(*tableName)
+	err = ensureTable(ctx, table)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, fileName := range fs.Args() {
+		start := time.Now()
+		var rows int64
+		if *method == "stream" {
+			rows, err = bqStream(ctx, table, fileName, *bodies, *batchSize)
+		} else {
+			rows, err = bqLoad(ctx, table, gcs, strings.TrimPrefix(*staging, "gs://"), fileName, *bodies)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "export of %s failed", fileName)
+		}
+		total += rows
+		fmt.Printf("%s\t%d rows in %s, %d so far\n", fileName, rows, time.Since(start).Round(time.Millisecond), total)
+	}
+	return nil
+}
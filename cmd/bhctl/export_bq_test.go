@@ -0,0 +1,235 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+func TestBQRow(t *testing.T) {
+
+	ts := time.Unix(0, testTime+1234567891).UTC()
+	row := &requestRow{ID: "id-1", Time: &ts, Method: "GET", URI: "/a", Archive: "requests_1.fbf", Offset: 42}
+	values, insertID, err := bqRow{row}.Save()
+	if err != nil || insertID != "requests_1.fbf:42" || values["id"] != "id-1" || values["time"] != ts ||
+		values["offset"] != int64(42) || len(values) != len(bqSchema) {
+		t.Fatalf("got %v, %s, %v", values, insertID, err)
+	}
+
+	// Load jobs take microseconds at most
+	buf, err := json.Marshal(newBQLoadRow(row))
+	if err != nil || !bytes.Contains(buf, []byte(`"time":"2020-09-13T12:26:41.234567Z"`)) {
+		t.Fatalf("got %s, %v", buf, err)
+	}
+	row.Time = nil
+	if values, _, _ = (bqRow{row}).Save(); values["time"] != nil {
+		t.Fatalf("got time %v", values["time"])
+	}
+	if buf, _ = json.Marshal(newBQLoadRow(row)); bytes.Contains(buf, []byte(`"time"`)) {
+		t.Fatalf("got %s", buf)
+	}
+}
+
+func TestWriteLoadFile(t *testing.T) {
+
+	fileName := writeArchive(t, tempDir(t), false, testRequest(1, "GET", "/a", "", "a"), testRequest(2, "GET", "/b", "", ""))
+	var buf bytes.Buffer
+	rows, err := writeLoadFile(fileName, &buf, true)
+	if err != nil || rows != 2 {
+		t.Fatalf("got %d rows, %v", rows, err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []map[string]interface{}
+	for sc := bufio.NewScanner(zr); sc.Scan(); {
+		var line map[string]interface{}
+		if err = json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 || lines[0]["uri"] != "/a" || lines[0]["body"] != "a" || lines[0]["time"] != "2020-09-13T12:26:41.000000Z" ||
+		lines[1]["archive"] != filepath.Base(fileName) {
+		t.Fatalf("got %v", lines)
+	}
+}
+
+// fakeBigQuery is the part of the BigQuery API to look up, create and stream
+// into the `requests` table of project `p`, dataset `d`
+type fakeBigQuery struct {
+	mu        sync.Mutex
+	partition string
+	fields    int
+	inserts   int
+	insertIDs []string
+	rows      []map[string]interface{}
+}
+
+func (f *fakeBigQuery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tables := "/bigquery/v2/projects/p/datasets/d/tables"
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == tables+"/requests":
+		if f.fields == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":404,"message":"Not found: Table p:d.requests"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"tableReference":{"projectId":"p","datasetId":"d","tableId":"requests"}}`)
+	case r.Method == http.MethodPost && r.URL.Path == tables:
+		var table struct {
+			TimePartitioning struct{ Field string }
+			Schema           struct{ Fields []json.RawMessage }
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &table)
+		f.partition, f.fields = table.TimePartitioning.Field, len(table.Schema.Fields)
+		w.Write(body)
+	case r.Method == http.MethodPost && r.URL.Path == tables+"/requests/insertAll":
+		var req struct {
+			Rows []struct {
+				InsertID string                 `json:"insertId"`
+				JSON     map[string]interface{} `json:"json"`
+			}
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.inserts++
+		for _, row := range req.Rows {
+			f.insertIDs = append(f.insertIDs, row.InsertID)
+			f.rows = append(f.rows, row.JSON)
+		}
+		fmt.Fprint(w, `{"kind":"bigquery#tableDataInsertAllResponse"}`)
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+	}
+}
+
+// fakeBigQueryTable is table p:d.requests of `f`
+func fakeBigQueryTable(t *testing.T, f *fakeBigQuery) *bigquery.Table {
+
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	client, err := bigquery.NewClient(context.Background(), "p",
+		option.WithEndpoint(srv.URL+"/bigquery/v2/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client.Dataset("d").Table("requests")
+}
+
+func TestEnsureTable(t *testing.T) {
+
+	f := &fakeBigQuery{}
+	table := fakeBigQueryTable(t, f)
+	if err := ensureTable(context.Background(), table); err != nil {
+		t.Fatal(err)
+	}
+	if f.partition != "time" || f.fields != len(bqSchema) {
+		t.Fatalf("created partitioned on %q, with %d fields", f.partition, f.fields)
+	}
+	f.partition = ""
+	if err := ensureTable(context.Background(), table); err != nil || f.partition != "" {
+		t.Fatalf("got %v, created again: %v", err, f.partition != "")
+	}
+}
+
+func TestBQStream(t *testing.T) {
+
+	f := &fakeBigQuery{}
+	fileName := writeArchive(t, tempDir(t), false,
+		testRequest(1, "GET", "/a", "", ""), testRequest(2, "GET", "/b", "", ""), testRequest(3, "GET", "/c", "", ""))
+	rows, err := bqStream(context.Background(), fakeBigQueryTable(t, f), fileName, false, 2)
+	if err != nil || rows != 3 || f.inserts != 2 || len(f.rows) != 3 {
+		t.Fatalf("got %d rows in %d inserts, %v", rows, f.inserts, err)
+	}
+	name := filepath.Base(fileName)
+	if !strings.HasPrefix(f.insertIDs[0], name+":") || f.insertIDs[0] == f.insertIDs[1] || f.rows[2]["uri"] != "/c" {
+		t.Fatalf("got %q, %v", f.insertIDs, f.rows)
+	}
+}
+
+func TestStageToGCS(t *testing.T) {
+
+	var name, contentType, data string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/upload/storage/v1/b/bucket/o" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		var attrs struct{ Name, ContentType string }
+		part, _ := mr.NextPart()
+		json.NewDecoder(part).Decode(&attrs)
+		part, _ = mr.NextPart()
+		content, _ := ioutil.ReadAll(part)
+		name, contentType, data = attrs.Name, attrs.ContentType, string(content)
+		fmt.Fprintf(w, `{"bucket":"bucket","name":%q}`, attrs.Name)
+	}))
+	defer srv.Close()
+	client, err := storage.NewClient(context.Background(),
+		option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	dir := tempDir(t)
+	writeFiles(t, dir, map[string]string{"requests_1.json.gz": "rows"})
+	obj, err := stageToGCS(context.Background(), client, "bucket/staging/", filepath.Join(dir, "requests_1.json.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.BucketName() != "bucket" || obj.ObjectName() != "staging/requests_1.json.gz" || name != obj.ObjectName() ||
+		contentType != "application/gzip" || data != "rows" {
+		t.Fatalf("uploaded %s (%s): %q", name, contentType, data)
+	}
+}
+
+func TestExportBigQueryUsage(t *testing.T) {
+
+	for _, args := range [][]string{
+		{"--project", "", "--dataset", "d", "x.fbf"},
+		{"--project", "p", "x.fbf"},
+		{"--project", "p", "--dataset", "d", "--method", "copy", "x.fbf"},
+		{"--project", "p", "--dataset", "d", "--method", "stream", "--batch-size", "0", "x.fbf"},
+	} {
+		if _, err := captureOutput(t, runExportBigQuery, args...); err != errUsage {
+			t.Fatalf("%q: got %v", args, err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/pkg/errors"
+)
+
+// esMapping is used when the index does not exist yet. Works with
+// Elasticsearch 7+ and OpenSearch (no type names, no ES-only field types).
+const esMapping = `{
+  "mappings": {
+    "properties": {
+      "id":           {"type": "keyword"},
+      "time":         {"type": "date", "format": "strict_date_optional_time_nanos"},
+      "method":       {"type": "keyword"},
+      "uri":          {"type": "text", "fields": {"raw": {"type": "keyword", "ignore_above": 2048}}},
+      "path":         {"type": "keyword", "ignore_above": 2048},
+      "query":        {"type": "text"},
+      "host":         {"type": "keyword"},
+      "user_agent":   {"type": "text", "fields": {"raw": {"type": "keyword", "ignore_above": 512}}},
+      "content_type": {"type": "keyword"},
+      "headers":      {"type": "text"},
+      "body_size":    {"type": "long"},
+      "body":         {"type": "text"},
+      "archive":      {"type": "keyword"},
+      "offset":       {"type": "long"}
+    }
+  }
+}`
+
+// esClient talks to the REST API directly: only _bulk and index creation
+// are needed, not worth a client library that is tied to one server flavor.
+type esClient struct {
+	baseURL  string
+	index    string
+	user     string
+	password string
+	apiKey   string
+	http     *http.Client
+}
+
+func (es *esClient) do(method, uri, contentType string, body io.Reader) (respBody []byte, status int, err error) {
+
+	req, err := http.NewRequest(method, es.baseURL+uri, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if es.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+es.apiKey)
+	} else if es.user != "" {
+		req.SetBasicAuth(es.user, es.password)
+	}
+	resp, err := es.http.Do(req)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "%s %s failed", method, uri)
+	}
+	defer resp.Body.Close()
+	respBody, err = ioutil.ReadAll(resp.Body)
+	return respBody, resp.StatusCode, err
+}
+
+// ensureIndex creates the index with esMapping unless it already exists
+func (es *esClient) ensureIndex() (err error) {
+
+	_, status, err := es.do(http.MethodHead, "/"+es.index, "", nil)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusOK {
+		return nil
+	}
+	body, status, err := es.do(http.MethodPut, "/"+es.index, "application/json", strings.NewReader(esMapping))
+	if err != nil {
+		return err
+	}
+	if status >= 300 {
+		return errors.Errorf("unable to create index %s: HTTP %d: %s", es.index, status, body)
+	}
+	fmt.Fprintf(os.Stderr, "Created index %s\n", es.index)
+	return nil
+}
+
+// esBulkResponse is the part of the _bulk response we look at
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// bulk sends one _bulk request. Any failed document fails the export.
+func (es *esClient) bulk(payload []byte) (err error) {
+
+	body, status, err := es.do(http.MethodPost, "/"+es.index+"/_bulk", "application/x-ndjson", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if status >= 300 {
+		return errors.Errorf("bulk request failed: HTTP %d: %s", status, body)
+	}
+	var resp esBulkResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return errors.Wrap(err, "unable to parse bulk response")
+	}
+	if resp.Errors {
+		for _, item := range resp.Items {
+			for _, result := range item {
+				if result.Status >= 300 {
+					return errors.Errorf("bulk indexing failed: HTTP %d: %s", result.Status, result.Error)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// runExportES bulk indexes requests into Elasticsearch/OpenSearch
+func runExportES(args []string) (err error) {
+
+	fs := newFlagSet("export es", "<archive-url>...")
+	baseURL := fs.String("url", "http://localhost:9200", "Elasticsearch/OpenSearch URL")
+	index := fs.String("index", "blackhole-requests", "Index to write to")
+	user := fs.String("user", "", "Basic auth as user:password (or set ES_USER / ES_PASSWORD)")
+	apiKey := fs.String("api-key", "", "API key (or set ES_API_KEY)")
+	bodies := fs.Bool("bodies", false, "Index request bodies too (UTF-8 bodies only)")
+	batchSize := fs.Int("batch-size", 1000, "Documents per bulk request")
+	noCreate := fs.Bool("no-create-index", false, "Don't create the index (with mapping) if it's missing")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *batchSize <= 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	es := &esClient{
+		baseURL: strings.TrimRight(*baseURL, "/"),
+		index:   *index,
+		apiKey:  *apiKey,
+		http:    &http.Client{Timeout: 2 * time.Minute},
+	}
+	if es.apiKey == "" {
+		es.apiKey = os.Getenv("ES_API_KEY")
+	}
+	es.user, es.password = os.Getenv("ES_USER"), os.Getenv("ES_PASSWORD")
+	if *user != "" {
+		parts := strings.SplitN(*user, ":", 2)
+		es.user = parts[0]
+		if len(parts) > 1 {
+			es.password = parts[1]
+		}
+	}
+
+	if !*noCreate {
+		err = es.ensureIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	var payload bytes.Buffer
+	enc := json.NewEncoder(&payload)
+	enc.SetEscapeHTML(false)
+	pending, total := 0, 0
+
+	flush := func() error {
+		if pending == 0 {
+			return nil
+		}
+		err := es.bulk(payload.Bytes())
+		if err != nil {
+			return err
+		}
+		total += pending
+		pending = 0
+		payload.Reset()
+		return nil
+	}
+
+	for _, fileName := range fs.Args() {
+		archiveName := path.Base(fileName)
+		err = forEachRequest(fileName, func(req *fbr.Request, offset int64) error {
+			row := newRequestRow(req, archiveName, offset, *bodies)
+			// _id from archive+offset, so that exporting the same archive again
+			// overwrites instead of duplicating (request IDs may repeat)
+			action := map[string]map[string]string{"index": {"_id": fmt.Sprintf("%s:%d", archiveName, offset)}}
+			err := enc.Encode(action)
+			if err == nil {
+				err = enc.Encode(row)
+			}
+			if err != nil {
+				return err
+			}
+			pending++
+			if pending >= *batchSize {
+				return flush()
+			}
+			return nil
+		})
+		if err == nil {
+			err = flush()
+		}
+		if err != nil {
+			return errors.Wrapf(err, "export of %s failed after %d documents", fileName, total)
+		}
+		fmt.Printf("%s\t%d documents indexed so far\n", fileName, total)
+	}
+	return nil
+}
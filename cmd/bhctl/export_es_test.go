@@ -0,0 +1,181 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/request"
+)
+
+func TestRunExport(t *testing.T) {
+
+	for _, args := range [][]string{nil, {"-h"}, {"xml"}} {
+		if err := runExport(args); err != errUsage {
+			t.Fatalf("%q: got %v", args, err)
+		}
+	}
+}
+
+func TestNewRequestRow(t *testing.T) {
+
+	mr := testRequest(1, "POST", "/search?q=x&n=1",
+		"Host: example.com\r\nUser-Agent: curl/7.0\r\nContent-Type: application/json\r\n\r\n", `{"q":"x"}`)
+	umr := mr.Unmarshalled()
+	defer umr.Release()
+	row := newRequestRow(umr.Request(), "requests_1.fbf", 42, true)
+	if row.ID != "id-1" || row.Time == nil || !row.Time.Equal(time.Unix(0, testTime+1e9)) || row.Method != "POST" ||
+		row.URI != "/search?q=x&n=1" || row.Path != "/search" || row.Query != "q=x&n=1" || row.Host != "example.com" ||
+		row.UserAgent != "curl/7.0" || row.ContentType != "application/json" ||
+		row.Headers != "Host: example.com\r\nUser-Agent: curl/7.0\r\nContent-Type: application/json" ||
+		row.BodySize != 9 || row.Body != `{"q":"x"}` || row.Archive != "requests_1.fbf" || row.Offset != 42 {
+		t.Fatalf("got %+v", row)
+	}
+	if row = newRequestRow(umr.Request(), "", 0, false); row.Body != "" || row.BodySize != 9 {
+		t.Fatalf("got %+v", row)
+	}
+
+	// Binary bodies are left out, URIs that don't parse are paths
+	mr2 := request.CreateRequestAt(0, []byte("x"), []byte("GET"), []byte("*"), nil, []byte{0xff})
+	umr2 := mr2.Unmarshalled()
+	defer umr2.Release()
+	if row = newRequestRow(umr2.Request(), "", 0, true); row.Body != "" || row.Path != "*" || row.Time != nil {
+		t.Fatalf("got %+v", row)
+	}
+}
+
+// fakeES is the part of the Elasticsearch API the exporter uses
+type fakeES struct {
+	mu       sync.Mutex
+	index    string
+	created  bool
+	mapping  string
+	auth     []string
+	bulks    int
+	ids      []string
+	docs     []requestRow
+	failDocs bool
+}
+
+func (f *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+	switch {
+	case r.Method == http.MethodHead && r.URL.Path == "/"+f.index:
+		if !f.created {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == http.MethodPut && r.URL.Path == "/"+f.index:
+		body, _ := ioutil.ReadAll(r.Body)
+		f.created, f.mapping = true, string(body)
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	case r.Method == http.MethodPost && r.URL.Path == "/"+f.index+"/_bulk":
+		if r.Header.Get("Content-Type") != "application/x-ndjson" {
+			http.Error(w, "bad content type", http.StatusBadRequest)
+			return
+		}
+		f.bulks++
+		sc := bufio.NewScanner(r.Body)
+		for sc.Scan() {
+			var action struct {
+				Index struct {
+					ID string `json:"_id"`
+				}
+			}
+			var doc requestRow
+			json.Unmarshal(sc.Bytes(), &action)
+			sc.Scan()
+			json.Unmarshal(sc.Bytes(), &doc)
+			f.ids = append(f.ids, action.Index.ID)
+			f.docs = append(f.docs, doc)
+		}
+		if f.failDocs {
+			fmt.Fprint(w, `{"errors":true,"items":[{"index":{"status":201}},{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"errors":false,"items":[]}`)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func TestExportES(t *testing.T) {
+
+	f := &fakeES{index: "captures"}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	dir := tempDir(t)
+	fileName := writeArchive(t, dir, false,
+		testRequest(1, "GET", "/a", "", ""), testRequest(2, "GET", "/b", "", "b"), testRequest(3, "GET", "/c", "", ""))
+	out, err := captureOutput(t, runExportES, "--url", srv.URL+"/", "--index", "captures", "--batch-size", "2",
+		"--user", "elastic:secret", "--bodies", fileName)
+	if err != nil || out != fileName+"\t3 documents indexed so far\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	if !f.created || !strings.Contains(f.mapping, `"offset":       {"type": "long"}`) || f.bulks != 2 || len(f.docs) != 3 {
+		t.Fatalf("created %v, %d bulk requests, %d documents", f.created, f.bulks, len(f.docs))
+	}
+	name := filepath.Base(fileName)
+	if f.ids[0] != fmt.Sprintf("%s:%d", name, f.docs[0].Offset) || f.docs[1].URI != "/b" || f.docs[1].Body != "b" ||
+		f.docs[2].Archive != name {
+		t.Fatalf("got %q, %+v", f.ids, f.docs)
+	}
+	if f.auth[0] != "Basic ZWxhc3RpYzpzZWNyZXQ=" {
+		t.Fatalf("got authorization %q", f.auth[0])
+	}
+
+	// Index there already, documents of the same archive replaced
+	f.auth = nil
+	if _, err = captureOutput(t, runExportES, "--url", srv.URL, "--index", "captures", "--api-key", "key", fileName); err != nil {
+		t.Fatal(err)
+	}
+	if f.bulks != 3 || len(f.docs) != 6 || f.ids[3] != f.ids[0] || f.docs[4].Body != "" || f.auth[0] != "ApiKey key" {
+		t.Fatalf("%d bulk requests, %d documents, authorization %q", f.bulks, len(f.docs), f.auth)
+	}
+}
+
+func TestExportESErrors(t *testing.T) {
+
+	f := &fakeES{index: "captures", failDocs: true}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	fileName := writeArchive(t, tempDir(t), false, testRequest(1, "GET", "/a", "", ""))
+	_, err := captureOutput(t, runExportES, "--url", srv.URL, "--index", "captures", fileName)
+	if err == nil || !strings.Contains(err.Error(), "bulk indexing failed: HTTP 400") {
+		t.Fatalf("got %v", err)
+	}
+
+	// The index is left alone with --no-create-index
+	f = &fakeES{index: "captures"}
+	srv2 := httptest.NewServer(f)
+	defer srv2.Close()
+	_, err = captureOutput(t, runExportES, "--url", srv2.URL, "--index", "other", "--no-create-index", fileName)
+	if err == nil || !strings.Contains(err.Error(), "bulk request failed: HTTP 400") || f.created {
+		t.Fatalf("got %v", err)
+	}
+	if _, err = captureOutput(t, runExportES, "--batch-size", "0", fileName); err != errUsage {
+		t.Fatalf("got %v with no batch size", err)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/pkg/errors"
+)
+
+// k6Request is one entry of the data file read by the generated k6 script
+type k6Request struct {
+	Method  string            `json:"method"`
+	URI     string            `json:"uri"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	BodyB64 string            `json:"body_b64,omitempty"` // non UTF-8 bodies
+}
+
+// k6Script replays the data file in order, spread over VUs, once
+var k6Script = template.Must(template.New("k6").Parse(`// Generated by bhctl export k6. Run with:
+//   k6 run -e TARGET=http://host:port {{.Script}}
+import http from 'k6/http';
+import encoding from 'k6/encoding';
+import exec from 'k6/execution';
+import { SharedArray } from 'k6/data';
+
+const requests = new SharedArray('requests', () => JSON.parse(open('./{{.Data}}')));
+const target = __ENV.TARGET || {{.Target}};
+
+export const options = {
+  scenarios: {
+    replay: {
+      executor: 'shared-iterations',
+      vus: {{.VUs}},
+      iterations: requests.length,
+      maxDuration: '{{.MaxDuration}}',
+    },
+  },
+};
+
+export default function () {
+  const r = requests[exec.scenario.iterationInTest];
+  const body = r.body_b64 ? encoding.b64decode(r.body_b64, 'std', 'b') : r.body;
+  http.request(r.method, target + r.uri, body || null, { headers: r.headers });
+}
+`))
+
+// runExportK6 writes archives as a k6 data file plus a script replaying it
+func runExportK6(args []string) (err error) {
+
+	fs := newFlagSet("export k6", "<archive-url>...")
+	outDir := fs.StringP("output-dir", "o", ".", "Directory to write the script and data file to")
+	name := fs.StringP("name", "n", "replay", "Base name of files: <name>.js and <name>.json")
+	target := fs.StringP("target", "t", "http://localhost:8080", "Default base URL (TARGET environment variable overrides)")
+	vus := fs.Int("vus", 10, "Virtual users of the generated scenario")
+	maxDuration := fs.String("max-duration", "30m", "maxDuration of the generated scenario")
+	keepHost := fs.Bool("keep-host", false, "Send the recorded Host header instead of the one of the target")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *vus <= 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	err = os.MkdirAll(*outDir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to create %s", *outDir)
+	}
+	dataFile := filepath.Join(*outDir, *name+".json")
+	fp, err := os.Create(dataFile)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to create %s", dataFile)
+	}
+	defer fp.Close()
+	w := bufio.NewWriterSize(fp, 65536)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	// A JSON array written one element per line, so huge archives don't
+	// have to be held in memory
+	n := 0
+	w.WriteString("[\n")
+	for _, fileName := range fs.Args() {
+		err = forEachRequest(fileName, func(req *fbr.Request, offset int64) error {
+			kr := &k6Request{Method: string(req.Method()), URI: string(req.Uri())}
+			names, values := exportHeaders(req, *keepHost)
+			if len(names) > 0 {
+				kr.Headers = make(map[string]string, len(names))
+				for _, name := range names {
+					kr.Headers[name] = strings.Join(values[name], ", ")
+				}
+			}
+			kr.Body, kr.BodyB64 = bodyText(req.BodyBytes())
+			if n > 0 {
+				w.WriteString(",")
+			}
+			n++
+			return enc.Encode(kr)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "export of %s failed after %d requests", fileName, n)
+		}
+	}
+	w.WriteString("]\n")
+	err = w.Flush()
+	if err != nil {
+		return errors.Wrapf(err, "Unable to write %s", dataFile)
+	}
+
+	scriptFile := filepath.Join(*outDir, *name+".js")
+	sp, err := os.Create(scriptFile)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to create %s", scriptFile)
+	}
+	defer sp.Close()
+	targetJS, _ := json.Marshal(strings.TrimRight(*target, "/")) // a JS string literal
+	err = k6Script.Execute(sp, map[string]interface{}{
+		"Script":      *name + ".js",
+		"Data":        *name + ".json",
+		"Target":      string(targetJS),
+		"VUs":         *vus,
+		"MaxDuration": *maxDuration,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Unable to write %s", scriptFile)
+	}
+	fmt.Printf("%s\t%d requests\n%s\n", dataFile, n, scriptFile)
+	return nil
+}
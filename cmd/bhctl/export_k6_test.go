@@ -0,0 +1,97 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExportK6(t *testing.T) {
+
+	dir := tempDir(t)
+	fileName := writeArchive(t, dir, false,
+		testRequest(0, "POST", "/a", exportTestHeaders, "hi"),
+		testRequest(1, "PUT", "/b?x=1", "Host: example.com\r\n\r\n", "\xff\x00"))
+	writeFiles(t, dir, map[string]string{"empty.fbf": ""})
+	empty := filepath.Join(dir, "empty.fbf")
+	outDir := filepath.Join(dir, "k6")
+	out, err := captureOutput(t, runExportK6, "-o", outDir, "-n", "test", "-t", "http://api.example.com/", "--vus", "2",
+		fileName, empty)
+	dataFile, scriptFile := filepath.Join(outDir, "test.json"), filepath.Join(outDir, "test.js")
+	if err != nil || out != dataFile+"\t2 requests\n"+scriptFile+"\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+
+	data, err := ioutil.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []k6Request
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("%s: %v", data, err)
+	}
+	want := []k6Request{
+		{Method: "POST", URI: "/a", Headers: map[string]string{"X-A": "1, 2", "X-B": "b"}, Body: "hi"},
+		{Method: "PUT", URI: "/b?x=1", BodyB64: "/wA="},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v", got)
+	}
+
+	script, err := ioutil.ReadFile(scriptFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"k6 run -e TARGET=http://host:port test.js",
+		"open('./test.json')",
+		`const target = __ENV.TARGET || "http://api.example.com";`,
+		"vus: 2,",
+		"maxDuration: '30m',",
+	} {
+		if !strings.Contains(string(script), s) {
+			t.Fatalf("%q not in script:\n%s", s, script)
+		}
+	}
+}
+
+// With nothing recorded the data file is still an array
+func TestExportK6Empty(t *testing.T) {
+
+	dir := tempDir(t)
+	writeFiles(t, dir, map[string]string{"empty.fbf": ""})
+	if _, err := captureOutput(t, runExportK6, "-o", dir, filepath.Join(dir, "empty.fbf")); err != nil {
+		t.Fatal(err)
+	}
+	var got []k6Request
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "replay.json"))
+	if err := json.Unmarshal(data, &got); err != nil || len(got) != 0 {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
+
+func TestExportK6Errors(t *testing.T) {
+
+	dir := tempDir(t)
+	if _, err := captureOutput(t, runExportK6, "--vus", "0", "-o", dir, "requests.fbf"); err != errUsage {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := captureOutput(t, runExportK6, "-o", dir, filepath.Join(dir, "missing.fbf")); err == nil {
+		t.Fatal("no error for a missing archive")
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+)
+
+// skippedExportHeaders are recorded headers that load tools set themselves.
+// Host is dropped as well unless asked for.
+var skippedExportHeaders = map[string]bool{
+	"content-length":    true,
+	"connection":        true,
+	"keep-alive":        true,
+	"transfer-encoding": true,
+	"te":                true,
+	"upgrade":           true,
+}
+
+// exportHeaders returns the recorded headers to send again with a load tool,
+// grouped by name in the original order of first appearance.
+func exportHeaders(req *fbr.Request, keepHost bool) (names []string, values map[string][]string) {
+	values = make(map[string][]string)
+	for _, h := range request.SplitHeaders(req.Headers()) {
+		lname := strings.ToLower(h.Name)
+		if skippedExportHeaders[lname] || (lname == "host" && !keepHost) {
+			continue
+		}
+		if _, ok := values[h.Name]; !ok {
+			names = append(names, h.Name)
+		}
+		values[h.Name] = append(values[h.Name], h.Value)
+	}
+	return names, values
+}
+
+// vegetaTarget is one line of vegeta's JSON target format (`-format=json`)
+type vegetaTarget struct {
+	Method string              `json:"method"`
+	URL    string              `json:"url"`
+	Body   []byte              `json:"body,omitempty"` // base64, as vegeta expects
+	Header map[string][]string `json:"header,omitempty"`
+}
+
+// vegetaWriter writes vegeta targets in either of its formats
+type vegetaWriter struct {
+	w        *bufio.Writer
+	enc      *json.Encoder
+	format   string // json or http
+	bodyDir  string // http format: where bodies are written, one file each
+	target   string // base URL
+	keepHost bool
+	n        int
+}
+
+func (vw *vegetaWriter) write(req *fbr.Request) (err error) {
+
+	vw.n++
+	url := vw.target + string(req.Uri())
+	names, values := exportHeaders(req, vw.keepHost)
+	body := req.BodyBytes()
+
+	if vw.format == "json" {
+		return vw.enc.Encode(&vegetaTarget{
+			Method: string(req.Method()),
+			URL:    url,
+			Body:   body,
+			Header: values,
+		})
+	}
+
+	// http format: request line, headers, optional @body-file, blank line
+	fmt.Fprintf(vw.w, "%s %s\n", req.Method(), url)
+	for _, name := range names {
+		for _, value := range values[name] {
+			fmt.Fprintf(vw.w, "%s: %s\n", name, value)
+		}
+	}
+	if len(body) > 0 {
+		bodyFile := filepath.Join(vw.bodyDir, fmt.Sprintf("%08d.body", vw.n))
+		err = ioutil.WriteFile(bodyFile, body, 0644)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to write body file %s", bodyFile)
+		}
+		abs, err := filepath.Abs(bodyFile)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(vw.w, "@%s\n", abs)
+	}
+	_, err = vw.w.WriteString("\n")
+	return err
+}
+
+// runExportVegeta writes archives as vegeta targets
+func runExportVegeta(args []string) (err error) {
+
+	fs := newFlagSet("export vegeta", "<archive-url>...")
+	target := fs.StringP("target", "t", "", "Base URL requests are sent to. Example http://localhost:8080")
+	format := fs.String("format", "json", "Target format: json (bodies inline) or http (bodies in --body-dir)")
+	output := fs.StringP("output", "o", "-", "Targets file (- for stdout)")
+	bodyDir := fs.String("body-dir", "", "With --format http, directory for body files (default <output>.bodies)")
+	keepHost := fs.Bool("keep-host", false, "Send the recorded Host header instead of the one of --target")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *target == "" || (*format != "json" && *format != "http") {
+		fs.Usage()
+		return errUsage
+	}
+
+	vw := &vegetaWriter{
+		format:   *format,
+		target:   strings.TrimRight(*target, "/"),
+		keepHost: *keepHost,
+	}
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		fp, err := os.Create(*output)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to create %s", *output)
+		}
+		defer fp.Close()
+		out = fp
+	}
+	vw.w = bufio.NewWriterSize(out, 65536)
+	vw.enc = json.NewEncoder(vw.w)
+	vw.enc.SetEscapeHTML(false)
+
+	if vw.format == "http" {
+		vw.bodyDir = *bodyDir
+		if vw.bodyDir == "" {
+			if *output == "-" {
+				return errors.New("Please supply --body-dir when writing http targets to stdout")
+			}
+			vw.bodyDir = *output + ".bodies"
+		}
+		err = os.MkdirAll(vw.bodyDir, 0755)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to create %s", vw.bodyDir)
+		}
+	}
+
+	for _, fileName := range fs.Args() {
+		err = forEachRequest(fileName, func(req *fbr.Request, offset int64) error {
+			return vw.write(req)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "export of %s failed after %d targets", fileName, vw.n)
+		}
+	}
+	err = vw.w.Flush()
+	if err != nil {
+		return errors.Wrap(err, "Unable to write targets")
+	}
+	fmt.Fprintf(os.Stderr, "%d targets written\n", vw.n)
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// exportTestHeaders are recorded headers, some of which load tools set themselves
+const exportTestHeaders = "Host: example.com\r\nContent-Length: 2\r\nX-A: 1\r\nConnection: close\r\nX-B: b\r\nX-A: 2\r\n\r\n"
+
+func TestExportHeaders(t *testing.T) {
+
+	umr := testRequest(0, "POST", "/", exportTestHeaders, "").Unmarshalled()
+	defer umr.Release()
+	names, values := exportHeaders(umr.Request(), false)
+	if strings.Join(names, ",") != "X-A,X-B" ||
+		!reflect.DeepEqual(values, map[string][]string{"X-A": {"1", "2"}, "X-B": {"b"}}) {
+		t.Fatalf("got %q, %q", names, values)
+	}
+	if names, values = exportHeaders(umr.Request(), true); strings.Join(names, ",") != "Host,X-A,X-B" ||
+		values["Host"][0] != "example.com" {
+		t.Fatalf("got %q, %q", names, values)
+	}
+}
+
+func TestExportVegetaJSON(t *testing.T) {
+
+	dir := tempDir(t)
+	fileName := writeArchive(t, dir, false,
+		testRequest(0, "POST", "/a", exportTestHeaders, "hi"),
+		testRequest(1, "GET", "/b?x=1", "Host: example.com\r\n\r\n", ""))
+	output := filepath.Join(dir, "targets.json")
+	if _, err := captureOutput(t, runExportVegeta, "-t", "http://localhost:8080/", "-o", output, fileName); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"method":"POST","url":"http://localhost:8080/a","body":"aGk=","header":{"X-A":["1","2"],"X-B":["b"]}}
+{"method":"GET","url":"http://localhost:8080/b?x=1"}
+`
+	if string(data) != want {
+		t.Fatalf("got %s", data)
+	}
+	var vt vegetaTarget
+	if err = json.Unmarshal(data[:strings.IndexByte(string(data), '\n')], &vt); err != nil || string(vt.Body) != "hi" {
+		t.Fatalf("got %+v, %v", vt, err)
+	}
+}
+
+func TestExportVegetaHTTP(t *testing.T) {
+
+	dir := tempDir(t)
+	fileName := writeArchive(t, dir, false,
+		testRequest(0, "POST", "/a", exportTestHeaders, "hi"),
+		testRequest(1, "GET", "/b", "Host: example.com\r\n\r\n", ""))
+	output := filepath.Join(dir, "targets.txt")
+	_, err := captureOutput(t, runExportVegeta, "-t", "http://localhost:8080", "--format", "http", "--keep-host",
+		"-o", output, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyFile, _ := filepath.Abs(filepath.Join(output+".bodies", "00000001.body"))
+	want := "POST http://localhost:8080/a\nHost: example.com\nX-A: 1\nX-A: 2\nX-B: b\n@" + bodyFile + "\n\n" +
+		"GET http://localhost:8080/b\nHost: example.com\n\n"
+	if data, err := ioutil.ReadFile(output); err != nil || string(data) != want {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	if body, err := ioutil.ReadFile(bodyFile); err != nil || string(body) != "hi" {
+		t.Fatalf("got body %q, %v", body, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(output+".bodies", "*")); len(files) != 1 {
+		t.Fatalf("got body files %q", files)
+	}
+}
+
+func TestExportVegetaErrors(t *testing.T) {
+
+	dir := tempDir(t)
+	fileName := writeArchive(t, dir, false, testRequest(0, "GET", "/", "", ""))
+	for _, args := range [][]string{
+		{fileName},
+		{"-t", "http://localhost", "--format", "csv", fileName},
+	} {
+		if _, err := captureOutput(t, runExportVegeta, args...); err != errUsage {
+			t.Fatalf("%q: got %v", args, err)
+		}
+	}
+	if _, err := captureOutput(t, runExportVegeta, "-t", "http://localhost", "--format", "http", fileName); err == nil {
+		t.Fatal("no error for http targets to stdout without --body-dir")
+	}
+	if _, err := captureOutput(t, runExportVegeta, "-t", "http://localhost", "-o", filepath.Join(dir, "out.json"),
+		filepath.Join(dir, "missing.fbf")); err == nil {
+		t.Fatal("no error for a missing archive")
+	}
+}
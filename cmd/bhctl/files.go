@@ -0,0 +1,218 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/pkg/errors"
+)
+
+// humanBytes formats a byte count as 1.5K, 20.0M etc.
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// runLs lists archive files. Names printed are the ones `bhctl rm` expects.
+func runLs(args []string) (err error) {
+
+	fs := newFlagSet("ls", "<dir-url>...")
+	long := fs.BoolP("long", "l", false, "Show size and modification time as well")
+	human := fs.BoolP("human-readable", "H", false, "With -l, print sizes like 1.5K, 20M")
+	match := fs.StringP("match", "m", "", "Only list files whose base name matches this glob, e.g. '*.fbf.lz4'")
+	byTime := fs.BoolP("time", "t", false, "Sort by modification time, most recent first")
+	newest := fs.Int("newest", 0, "Only list the N most recent files (implies -t)")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range fs.Args() {
+		entries, err := archive.ListMatching(dir, *match)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to list %s", dir)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		if *byTime || *newest > 0 {
+			entries = archive.Newest(entries, *newest)
+		}
+		if fs.NArg() > 1 {
+			fmt.Printf("%s:\n", dir)
+		}
+		for _, entry := range entries {
+			if !*long {
+				fmt.Println(entry.Name)
+				continue
+			}
+			size := fmt.Sprintf("%d", entry.Size)
+			if *human {
+				size = humanBytes(entry.Size)
+			}
+			fmt.Printf("%12s  %s  %s\n", size, entry.ModTime.Format(time.RFC3339), entry.Name)
+		}
+	}
+	return nil
+}
+
+// runRm deletes the named files (as printed by `bhctl ls`) from a directory
+func runRm(args []string) (err error) {
+
+	fs := newFlagSet("rm", "<dir-url> [name...]")
+	all := fs.BoolP("all", "a", false, "Delete every file in the directory")
+	dryRun := fs.BoolP("dryrun", "n", false, "Only print what would be deleted")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	dir, names := fs.Arg(0), fs.Args()[1:]
+	if *all {
+		if len(names) > 0 {
+			return errors.New("Please use either --all or a list of names, not both")
+		}
+		names, err = archive.List(dir)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to list %s", dir)
+		}
+	}
+	if len(names) == 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	if *dryRun {
+		for _, name := range names {
+			fmt.Printf("Would delete: %s\n", name)
+		}
+		return nil
+	}
+	return archive.Delete(dir, names)
+}
+
+// runCp copies files into a directory, possibly across backends
+func runCp(args []string) (err error) {
+
+	fs := newFlagSet("cp", "<src-file-url>... <dst-dir-url>")
+	err = parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+
+	srcFiles, dstDir := fs.Args()[:fs.NArg()-1], fs.Arg(fs.NArg()-1)
+	for _, srcFile := range srcFiles {
+		err = archive.Copy(srcFile, dstDir)
+		if err != nil {
+			return err
+		}
+		if verbose {
+			fmt.Printf("Copied: %s -> %s\n", srcFile, dstDir)
+		}
+	}
+	return nil
+}
+
+// runDu prints number of files and total size of each directory
+func runDu(args []string) (err error) {
+
+	fs := newFlagSet("du", "<dir-url>...")
+	human := fs.BoolP("human-readable", "H", false, "Print sizes like 1.5K, 20M")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range fs.Args() {
+		entries, err := archive.ListDetails(dir)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to list %s", dir)
+		}
+		var total int64
+		for _, entry := range entries {
+			total += entry.Size
+		}
+		size := fmt.Sprintf("%d", total)
+		if *human {
+			size = humanBytes(total)
+		}
+		fmt.Printf("%8d files  %12s  %s\n", len(entries), size, dir)
+	}
+	return nil
+}
+
+// statJSON is a line of `bhctl stat --json`
+type statJSON struct {
+	URL      string    `json:"url"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+	Records  *int64    `json:"records,omitempty"`
+	Checksum string    `json:"checksum,omitempty"`
+}
+
+// runStat prints size, modification time, record count and checksum of
+// archive files, without downloading them
+func runStat(args []string) (err error) {
+
+	fs := newFlagSet("stat", "<file-url>...")
+	human := fs.BoolP("human-readable", "H", false, "Print sizes like 1.5K, 20M")
+	asJSON := fs.Bool("json", false, "Print one JSON object per file")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, fileName := range fs.Args() {
+		st, err := archive.Stat(fileName)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			line := statJSON{URL: st.Name, Size: st.Size, ModTime: st.ModTime, Checksum: st.Checksum}
+			if st.Records >= 0 {
+				line.Records = &st.Records
+			}
+			err = enc.Encode(line)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		size := fmt.Sprintf("%d", st.Size)
+		if *human {
+			size = humanBytes(st.Size)
+		}
+		records, checksum := "-", "-"
+		if st.Records >= 0 {
+			records = fmt.Sprintf("%d", st.Records)
+		}
+		if st.Checksum != "" {
+			checksum = st.Checksum
+		}
+		fmt.Printf("%12s  %s  %10s  %16s  %s\n", size, st.ModTime.Format(time.RFC3339), records, checksum, st.Name)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"go.uber.org/zap"
+)
+
+func TestHumanBytes(t *testing.T) {
+
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1536, "1.5K"},
+		{20 << 20, "20.0M"},
+		{3 << 40, "3.0T"},
+	}
+	for _, tt := range tests {
+		if got := humanBytes(tt.n); got != tt.want {
+			t.Fatalf("%d: got %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestLs(t *testing.T) {
+
+	a, b := tempDir(t), tempDir(t)
+	writeFiles(t, a, map[string]string{"b.fbf": "bb", "a.fbf": "a"})
+	writeFiles(t, b, map[string]string{"c.fbf": "ccc"})
+	out, err := captureOutput(t, runLs, a)
+	if err != nil || out != "a.fbf\nb.fbf\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+
+	// A heading per directory when there are several
+	out, err = captureOutput(t, runLs, a, b)
+	if err != nil || out != a+":\na.fbf\nb.fbf\n"+b+":\nc.fbf\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	out, err = captureOutput(t, runLs, "-l", b)
+	if err != nil || !regexp.MustCompile(`^ {11}3  \d{4}-\d\d-\d\dT\S+  c\.fbf\n$`).MatchString(out) {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	if _, err = captureOutput(t, runLs); err != errUsage {
+		t.Fatalf("got %v without a directory", err)
+	}
+}
+
+func TestLsMatch(t *testing.T) {
+
+	dir := tempDir(t)
+	now := time.Now()
+	files := map[string]time.Time{
+		"a.fbf.lz4": now.Add(-2 * time.Hour),
+		"b.fbf":     now,
+		"c.fbf.lz4": now.Add(-time.Hour),
+		"d.fbf.lz4": now.Add(-3 * time.Hour),
+	}
+	for name, modTime := range files {
+		writeFiles(t, dir, map[string]string{name: name})
+		if err := os.Chtimes(filepath.Join(dir, name), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--match", "*.lz4"}, "a.fbf.lz4\nc.fbf.lz4\nd.fbf.lz4\n"},
+		{[]string{"-t"}, "b.fbf\nc.fbf.lz4\na.fbf.lz4\nd.fbf.lz4\n"},
+		{[]string{"--newest", "2"}, "b.fbf\nc.fbf.lz4\n"},
+		{[]string{"-m", "*.lz4", "--newest", "2"}, "c.fbf.lz4\na.fbf.lz4\n"},
+		{[]string{"-m", "*.gz"}, ""},
+	}
+	for _, tt := range tests {
+		out, err := captureOutput(t, runLs, append(tt.args, dir)...)
+		if err != nil || out != tt.want {
+			t.Fatalf("%q: got %q, %v", tt.args, out, err)
+		}
+	}
+	if _, err := captureOutput(t, runLs, "-m", "[", dir); err == nil {
+		t.Fatal("no error for an invalid pattern")
+	}
+}
+
+func TestRm(t *testing.T) {
+
+	dir := tempDir(t)
+	writeFiles(t, dir, map[string]string{"a.fbf": "a", "b.fbf": "b", "c.fbf": "c"})
+	out, err := captureOutput(t, runRm, "-n", dir, "a.fbf")
+	if err != nil || out != "Would delete: a.fbf\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	if _, err = captureOutput(t, runRm, dir, "a.fbf"); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir, "b.fbf", "c.fbf")
+
+	if _, err = captureOutput(t, runRm, "--all", dir, "b.fbf"); err == nil {
+		t.Fatal("no error with both --all and names")
+	}
+	if _, err = captureOutput(t, runRm, dir); err != errUsage {
+		t.Fatalf("got %v without names", err)
+	}
+	if _, err = captureOutput(t, runRm, "--all", dir); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir)
+}
+
+func TestCp(t *testing.T) {
+
+	src, dst := tempDir(t), tempDir(t)
+	writeFiles(t, src, map[string]string{"a.fbf": "a", "b.fbf": "bb"})
+	if _, err := captureOutput(t, runCp, filepath.Join(src, "a.fbf"), filepath.Join(src, "b.fbf"), dst); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dst, "a.fbf", "b.fbf")
+	if data, _ := ioutil.ReadFile(filepath.Join(dst, "b.fbf")); string(data) != "bb" {
+		t.Fatalf("copied %q", data)
+	}
+	if _, err := captureOutput(t, runCp, filepath.Join(src, "missing.fbf"), dst); err == nil {
+		t.Fatal("no error copying a missing file")
+	}
+	if _, err := captureOutput(t, runCp, dst); err != errUsage {
+		t.Fatalf("got %v without a destination", err)
+	}
+}
+
+func TestDu(t *testing.T) {
+
+	dir := tempDir(t)
+	writeFiles(t, dir, map[string]string{"a.fbf": "a", "b.fbf": string(make([]byte, 2047))})
+	out, err := captureOutput(t, runDu, dir)
+	if err != nil || out != "       2 files          2048  "+dir+"\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	out, err = captureOutput(t, runDu, "-H", dir)
+	if err != nil || out != "       2 files          2.0K  "+dir+"\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+}
+
+func TestStat(t *testing.T) {
+
+	dir := tempDir(t)
+	rf, err := archive.NewArchive(dir, "requests", ".fbf", common.Compress(false), common.Logger(zap.NewNop()),
+		common.Index(true), common.ChecksumFooter(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = testRequest(i, "GET", "/", "", "").SaveRequest(rf, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var indexed string
+	for _, details := range rf.FinalizedFiles() {
+		indexed = filepath.Join(dir, details.FileName)
+	}
+	plain := writeArchive(t, dir, false, testRequest(0, "GET", "/", "", ""))
+	data, err := ioutil.ReadFile(indexed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := len(data)
+
+	out, err := captureOutput(t, runStat, indexed, plain)
+	lines := strings.Split(out, "\n")
+	text := regexp.MustCompile(`^ +(\d+)  \d{4}-\d\d-\d\dT\S+  +(\S+)  +(\S+)  (\S+)$`)
+	if err != nil || len(lines) != 3 {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	if m := text.FindStringSubmatch(lines[0]); m == nil || m[1] != strconv.Itoa(size) || m[2] != "3" ||
+		!regexp.MustCompile(`^[0-9A-F]{16}$`).MatchString(m[3]) || m[4] != indexed {
+		t.Fatalf("got %q", lines[0])
+	}
+	if m := text.FindStringSubmatch(lines[1]); m == nil || m[2] != "-" || m[3] != "-" || m[4] != plain {
+		t.Fatalf("got %q", lines[1])
+	}
+
+	out, err = captureOutput(t, runStat, "--json", indexed, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(strings.NewReader(out))
+	var withIndex, without statJSON
+	if err = dec.Decode(&withIndex); err != nil || withIndex.URL != indexed || withIndex.Size != int64(size) ||
+		withIndex.Records == nil || *withIndex.Records != 3 || len(withIndex.Checksum) != 16 {
+		t.Fatalf("got %+v, %v", withIndex, err)
+	}
+	if err = dec.Decode(&without); err != nil || without.Records != nil || without.Checksum != "" {
+		t.Fatalf("got %+v, %v", without, err)
+	}
+	if !strings.Contains(out, `"records":3`) || strings.Count(out, `"records"`) != 1 {
+		t.Fatalf("got %s", out)
+	}
+
+	if _, err = captureOutput(t, runStat, filepath.Join(dir, "missing.fbf")); err == nil {
+		t.Fatal("no error for a missing file")
+	}
+	if _, err = captureOutput(t, runStat, "tcp://127.0.0.1:9000/requests.fbf"); err == nil {
+		t.Fatal("no error for a backend without Stat")
+	}
+}
+
+// checkFiles fails unless `dir` has files `want`, sorted
+func checkFiles(t *testing.T, dir string, want ...string) {
+
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, info := range infos {
+		got = append(got, info.Name())
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got files %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got files %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+)
+
+// errNoMatch makes bhctl exit with 1 without printing anything, like grep
+var errNoMatch = errors.New("no match")
+
+// grepOptions controls what `bhctl grep` searches and prints
+type grepOptions struct {
+	re       *regexp.Regexp
+	bodies   bool
+	idsOnly  bool
+	maxCount int64
+}
+
+// matches is true if any of the searched fields match
+func (opt *grepOptions) matches(req *fbr.Request) bool {
+	return opt.re.Match(req.Uri()) ||
+		opt.re.Match(req.Headers()) ||
+		(opt.bodies && opt.re.Match(req.BodyBytes()))
+}
+
+// grepArchive prints requests of one archive that match. Offsets printed are
+// of the frame in the uncompressed stream, as `bhctl verify` reports them.
+func grepArchive(fileName string, opt *grepOptions) (found int64, err error) {
+
+	const archiveFileReadBufSize = 65536 // 64 K
+
+	rf, err := archive.OpenArchive(fileName, archiveFileReadBufSize)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to open archive file: %s", fileName)
+	}
+	defer rf.Close()
+
+	cr := &countingReader{r: rf}
+	for opt.maxCount <= 0 || found < opt.maxCount {
+		offset := cr.n
+		umr, err := request.GetNextFrame(cr, false)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return found, errors.Wrapf(err, "corrupted archive %s at byte offset %d", fileName, offset)
+		}
+		if umr.IsHeader() {
+			umr.Release()
+			continue
+		}
+		req := umr.Request()
+		if opt.matches(req) {
+			found++
+			if opt.idsOnly {
+				fmt.Printf("%s\n", req.Id())
+			} else {
+				fmt.Printf("%s:%d:%s\t%s %s\n", fileName, offset, req.Id(), req.Method(), req.Uri())
+			}
+		}
+		umr.Release()
+	}
+	return found, nil
+}
+
+// runGrep searches archives for requests matching a regular expression
+func runGrep(args []string) (err error) {
+
+	fs := newFlagSet("grep", "<regex> <archive-url>...")
+	bodies := fs.BoolP("body", "b", false, "Search request bodies as well")
+	ignoreCase := fs.BoolP("ignore-case", "i", false, "Case insensitive match")
+	idsOnly := fs.BoolP("ids", "l", false, "Print only request IDs (one per line, for `replay -i`)")
+	maxCount := fs.Int64P("max-count", "m", 0, "Stop after this many matches per archive")
+	err = parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+
+	expr := fs.Arg(0)
+	if *ignoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return errors.Wrapf(err, "invalid regular expression")
+	}
+
+	opt := &grepOptions{re: re, bodies: *bodies, idsOnly: *idsOnly, maxCount: *maxCount}
+	var total int64
+	for _, fileName := range fs.Args()[1:] {
+		found, err := grepArchive(fileName, opt)
+		if err != nil {
+			return err
+		}
+		total += found
+	}
+	if total == 0 {
+		return errNoMatch
+	}
+	return nil
+}
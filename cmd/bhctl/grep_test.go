@@ -0,0 +1,75 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/request"
+)
+
+func TestGrep(t *testing.T) {
+
+	fileName := writeArchive(t, tempDir(t), false,
+		testRequest(1, "GET", "/users/1", "Host: example.com\r\n\r\n", ""),
+		testRequest(2, "POST", "/orders", "Host: example.com\r\nX-User: 2\r\n\r\n", `{"user": "Alice"}`),
+		testRequest(3, "GET", "/USERS/3", "Host: example.com\r\n\r\n", ""))
+
+	// Offsets are of the frames, after the file header
+	offsets := []int{headerLen(t, fileName)}
+	for i, mr := range []*request.MarshalledRequest{
+		testRequest(1, "GET", "/users/1", "Host: example.com\r\n\r\n", ""),
+		testRequest(2, "POST", "/orders", "Host: example.com\r\nX-User: 2\r\n\r\n", `{"user": "Alice"}`),
+	} {
+		offsets = append(offsets, offsets[i]+mr.FrameSize())
+		mr.Release()
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"users"}, fmt.Sprintf("%s:%d:id-1\tGET /users/1\n", fileName, offsets[0])},
+		{[]string{"-i", "users"}, fmt.Sprintf("%s:%d:id-1\tGET /users/1\n%s:%d:id-3\tGET /USERS/3\n",
+			fileName, offsets[0], fileName, offsets[2])},
+		{[]string{"-l", "X-User: 2"}, "id-2\n"},
+		{[]string{"-l", "alice"}, ""},
+		{[]string{"-l", "-b", "-i", "alice"}, "id-2\n"},
+		{[]string{"-l", "-m", "1", "example"}, "id-1\n"},
+	}
+	for _, tt := range tests {
+		out, err := captureOutput(t, runGrep, append(tt.args, fileName)...)
+		if tt.want == "" && err != errNoMatch {
+			t.Fatalf("%q: got %v", tt.args, err)
+		}
+		if tt.want != "" && err != nil {
+			t.Fatalf("%q: %v", tt.args, err)
+		}
+		if out != tt.want {
+			t.Fatalf("%q: got %q, want %q", tt.args, out, tt.want)
+		}
+	}
+
+	// Matches of all archives count
+	out, err := captureOutput(t, runGrep, "-l", "-m", "1", "example", fileName, fileName)
+	if err != nil || out != "id-1\nid-1\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	if _, err = captureOutput(t, runGrep, "(", fileName); err == nil || err == errNoMatch {
+		t.Fatalf("got %v for an invalid regex", err)
+	}
+	if _, err = captureOutput(t, runGrep, "users"); err != errUsage {
+		t.Fatalf("got %v without an archive", err)
+	}
+}
@@ -0,0 +1,358 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+)
+
+// logFormats are the access log formats known by name, written as nginx
+// log_format strings. Apache's common/combined are the same as nginx's.
+var logFormats = map[string]string{
+	"combined": `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`,
+	"common":   `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent`,
+	// AWS Application Load Balancer. Fields after domain_name are ignored.
+	"alb": `$alb_type $time_iso8601 $alb_elb $remote_addr $alb_target $alb_request_processing_time $request_time ` +
+		`$alb_response_processing_time $status $alb_target_status $alb_received_bytes $body_bytes_sent "$request" ` +
+		`"$http_user_agent" $alb_ssl_cipher $alb_ssl_protocol $alb_target_group_arn "$http_x_amzn_trace_id" "$alb_domain_name"`,
+}
+
+var logVarRegexp = regexp.MustCompile(`\$[a-z0-9_]+`)
+
+// logParser extracts fields of one access log format
+type logParser struct {
+	re   *regexp.Regexp
+	vars []string // variable name of each capture group, without $
+}
+
+// newLogParser compiles an nginx log_format string into a regex. A variable
+// inside double quotes matches up to the closing quote (escaped quotes
+// allowed), one inside brackets up to `]`, and any other one a run of non
+// blank characters.
+func newLogParser(format string) (lp *logParser, err error) {
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	last := 0
+	lp = &logParser{}
+	for _, loc := range logVarRegexp.FindAllStringIndex(format, -1) {
+		expr.WriteString(regexp.QuoteMeta(format[last:loc[0]]))
+		switch {
+		case loc[0] > 0 && format[loc[0]-1] == '"':
+			expr.WriteString(`((?:[^"\\]|\\.)*)`)
+		case loc[0] > 0 && format[loc[0]-1] == '[':
+			expr.WriteString(`([^\]]*)`)
+		default:
+			expr.WriteString(`(\S*)`)
+		}
+		lp.vars = append(lp.vars, format[loc[0]+1:loc[1]])
+		last = loc[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(format[last:]))
+	if len(lp.vars) == 0 {
+		return nil, errors.Errorf("No $variables in log format %q", format)
+	}
+	lp.re, err = regexp.Compile(expr.String())
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid log format %q", format)
+	}
+	return lp, nil
+}
+
+// logEntry is a request reconstructed from a log line
+type logEntry struct {
+	ts       time.Time
+	id       string
+	method   string
+	uri      string
+	headers  []string // `Name: value`, Host first
+	status   int
+	duration time.Duration
+}
+
+// unescapeLogValue undoes nginx escaping of quoted values (\" and \xHH)
+func unescapeLogValue(v string) string {
+	if !strings.Contains(v, `\`) {
+		return v
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' || i+1 == len(v) {
+			b.WriteByte(v[i])
+			continue
+		}
+		if v[i+1] == 'x' && i+3 < len(v) {
+			if c, err := strconv.ParseUint(v[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		i++
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// parse returns the request of one log line. ok is false if the line does
+// not match the format or has no request line.
+func (lp *logParser) parse(line string) (e logEntry, ok bool) {
+
+	m := lp.re.FindStringSubmatch(line)
+	if m == nil {
+		return e, false
+	}
+
+	var host, args string
+	var headers []string
+	for i, name := range lp.vars {
+		v := unescapeLogValue(m[i+1])
+		if v == "-" || v == "" {
+			continue
+		}
+		switch {
+		case name == "request":
+			parts := strings.Fields(v)
+			if len(parts) < 2 {
+				return e, false
+			}
+			e.method, e.uri = parts[0], parts[1]
+		case name == "request_method":
+			e.method = v
+		case name == "request_uri":
+			e.uri = v
+		case name == "uri" && e.uri == "":
+			e.uri = v
+		case name == "args" || name == "query_string":
+			args = v
+		case name == "host" || name == "http_host":
+			host = v
+		case name == "request_id":
+			e.id = v
+		case name == "status":
+			e.status, _ = strconv.Atoi(v)
+		case name == "request_time":
+			if sec, err := strconv.ParseFloat(v, 64); err == nil && sec >= 0 {
+				e.duration = time.Duration(sec * float64(time.Second))
+			}
+		case name == "time_local":
+			e.ts, _ = time.Parse("02/Jan/2006:15:04:05 -0700", v)
+		case name == "time_iso8601":
+			e.ts, _ = time.Parse(time.RFC3339Nano, v)
+		case name == "msec":
+			if sec, err := strconv.ParseFloat(v, 64); err == nil {
+				e.ts = time.Unix(0, int64(sec*float64(time.Second)))
+			}
+		case name == "content_type":
+			headers = append(headers, "Content-Type: "+v)
+		case strings.HasPrefix(name, "http_"):
+			key := textproto.CanonicalMIMEHeaderKey(strings.Replace(name[len("http_"):], "_", "-", -1))
+			headers = append(headers, key+": "+v)
+		}
+	}
+	if e.method == "" || e.uri == "" {
+		return e, false
+	}
+
+	// Load balancers log absolute URLs: keep the path, use the host
+	if strings.Contains(e.uri, "://") {
+		if u, err := url.Parse(e.uri); err == nil {
+			if host == "" {
+				host = u.Host
+				if h, port := splitPort(host); port == "80" || port == "443" {
+					host = h
+				}
+			}
+			e.uri = u.RequestURI()
+		}
+	}
+	if args != "" && !strings.Contains(e.uri, "?") {
+		e.uri += "?" + args
+	}
+	if host != "" {
+		e.headers = append(e.headers, "Host: "+host)
+	}
+	e.headers = append(e.headers, headers...)
+	return e, true
+}
+
+// splitPort splits host:port. port is empty if there is none.
+func splitPort(hostport string) (host, port string) {
+	i := strings.LastIndexByte(hostport, ':')
+	if i < 0 || strings.HasSuffix(hostport, "]") {
+		return hostport, ""
+	}
+	return hostport[:i], hostport[i+1:]
+}
+
+// importLog converts one access log into an archive in `outDir`
+func importLog(fileName, outDir, codec string, lp *logParser, defaultHost string) (err error) {
+
+	fp, err := os.Open(fileName)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to open %s", fileName)
+	}
+	defer fp.Close()
+	var r io.Reader = bufio.NewReader(fp)
+	zr, err := common.NewDecompressor(fileName, r) // rotated logs are often gzipped
+	if err != nil {
+		return errors.Wrapf(err, "Unable to open %s", fileName)
+	}
+	if zr != nil {
+		defer zr.Close()
+		r = zr
+	}
+
+	name := strings.TrimSuffix(baseName(fileName), ".log") + ".fbf"
+	ow, err := newOutputWriter(outDir, name, codec)
+	if err != nil {
+		return err
+	}
+	_, err = ow.Write(request.FileHeader())
+	if err != nil {
+		ow.Abort()
+		return errors.Wrapf(err, "Unable to write %s", ow.Name())
+	}
+
+	var headers bytes.Buffer
+	lineNo, skipped := 0, 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 65536), 1<<20) // long URIs and user agents
+	for scanner.Scan() {
+		lineNo++
+		e, ok := lp.parse(scanner.Text())
+		if !ok {
+			skipped++
+			if verbose {
+				fmt.Fprintf(os.Stderr, "%s:%d: does not match the log format\n", fileName, lineNo)
+			}
+			continue
+		}
+
+		headers.Reset()
+		if defaultHost != "" && (len(e.headers) == 0 || !strings.HasPrefix(e.headers[0], "Host: ")) {
+			headers.WriteString("Host: " + defaultHost + "\r\n")
+		}
+		for _, h := range e.headers {
+			headers.WriteString(h + "\r\n")
+		}
+		headers.WriteString("\r\n")
+
+		var ts int64 // 0 - unknown, as in archives recorded before timestamps
+		if !e.ts.IsZero() {
+			ts = e.ts.UnixNano()
+		}
+		if e.id == "" {
+			e.id = "LOG-" + strconv.FormatInt(ts, 10) + "-" + strconv.Itoa(lineNo)
+		}
+		var resp *request.Response
+		if e.status != 0 {
+			resp = &request.Response{Status: e.status, Duration: e.duration}
+		}
+
+		mr := request.CreateExchangeAt(ts, []byte(e.id), []byte(e.method), []byte(e.uri),
+			headers.Bytes(), nil, resp)
+		_, err = mr.WriteFrame(ow)
+		mr.Release()
+		if err != nil {
+			ow.Abort()
+			return errors.Wrapf(err, "Unable to write %s", ow.Name())
+		}
+		ow.Records++
+	}
+	if err = scanner.Err(); err != nil {
+		ow.Abort()
+		return errors.Wrapf(err, "Unable to read %s after line %d", fileName, lineNo)
+	}
+
+	err = ow.Close()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\t%d records\t%d lines skipped\n", ow.Name(), ow.Records, skipped)
+	return nil
+}
+
+// runImport reconstructs requests from web server access logs, or from
+// Postman collections
+func runImport(args []string) (err error) {
+
+	fs := newFlagSet("import", "<log-or-collection-file>...")
+	format := fs.StringP("format", "f", "combined",
+		"Input format: combined (nginx/Apache default), common, alb, an nginx log_format string, or postman (collection JSON)")
+	outDir := fs.StringP("output-dir", "o", ".", "Directory (or s3/az/adls/gs/sftp/hdfs URL) to write archives to")
+	codec := fs.StringP("codec", "c", "lz4", "Compression: lz4, zstd, snappy, gzip or none")
+	host := fs.String("host", "", "Host header of requests whose log line has none")
+	envFile := fs.StringP("environment", "e", "", "postman: environment file to resolve variables with")
+	vars := fs.StringArray("var", nil, "postman: set a variable, as name=value (repeatable)")
+	iterations := fs.IntP("iterations", "n", 1, "postman: number of times the collection is written")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if _, ok := codecExtensions[*codec]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown codec: %q\n\n", *codec)
+		fs.Usage()
+		return errUsage
+	}
+
+	if *format == "postman" {
+		if *iterations <= 0 {
+			fs.Usage()
+			return errUsage
+		}
+		for _, fileName := range fs.Args() {
+			err = importPostman(fileName, *outDir, *codec, *envFile, *vars, *iterations)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	logFormat, ok := logFormats[*format]
+	if !ok {
+		if !strings.Contains(*format, "$") {
+			fmt.Fprintf(os.Stderr, "Unknown log format: %q\n\n", *format)
+			fs.Usage()
+			return errUsage
+		}
+		logFormat = *format
+	}
+	lp, err := newLogParser(logFormat)
+	if err != nil {
+		return err
+	}
+
+	for _, fileName := range fs.Args() {
+		err = importLog(fileName, *outDir, *codec, lp, *host)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,476 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+)
+
+// Postman collection format v2.0/v2.1, only the parts needed to rebuild requests
+
+type pmCollection struct {
+	Info     struct{ Name string } `json:"info"`
+	Item     []pmItem              `json:"item"`
+	Variable []pmKeyValue          `json:"variable"`
+	Auth     *pmAuth               `json:"auth"`
+}
+
+// pmItem is either a folder (Item set) or a request
+type pmItem struct {
+	Name    string          `json:"name"`
+	Item    []pmItem        `json:"item"`
+	Request json.RawMessage `json:"request"` // object, or just a URL string
+	Auth    *pmAuth         `json:"auth"`
+}
+
+type pmRequest struct {
+	Method string          `json:"method"`
+	Header []pmKeyValue    `json:"header"`
+	URL    json.RawMessage `json:"url"` // object, or just a URL string
+	Body   *pmBody         `json:"body"`
+	Auth   *pmAuth         `json:"auth"`
+}
+
+type pmURL struct {
+	Raw      string       `json:"raw"`
+	Protocol string       `json:"protocol"`
+	Host     []string     `json:"host"`
+	Port     string       `json:"port"`
+	Path     []string     `json:"path"`
+	Query    []pmKeyValue `json:"query"`
+}
+
+type pmBody struct {
+	Mode       string       `json:"mode"`
+	Raw        string       `json:"raw"`
+	URLEncoded []pmKeyValue `json:"urlencoded"`
+	FormData   []pmKeyValue `json:"formdata"`
+	GraphQL    *struct {
+		Query     string `json:"query"`
+		Variables string `json:"variables"`
+	} `json:"graphql"`
+	Options struct {
+		Raw struct{ Language string } `json:"raw"`
+	} `json:"options"`
+}
+
+type pmKeyValue struct {
+	Key      string      `json:"key"`
+	Value    interface{} `json:"value"` // usually a string, sometimes a number or bool
+	Type     string      `json:"type"`  // formdata: text or file
+	Disabled bool        `json:"disabled"`
+	Enabled  *bool       `json:"enabled"` // environment files use enabled instead
+}
+
+func (kv *pmKeyValue) value() string {
+	switch v := kv.Value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (kv *pmKeyValue) on() bool {
+	return !kv.Disabled && (kv.Enabled == nil || *kv.Enabled)
+}
+
+// pmAuth holds v2.1 auth (list of key/value) per type
+type pmAuth struct {
+	Type   string       `json:"type"`
+	Bearer []pmKeyValue `json:"bearer"`
+	Basic  []pmKeyValue `json:"basic"`
+	APIKey []pmKeyValue `json:"apikey"`
+}
+
+func pmParam(params []pmKeyValue, key string) string {
+	for i := range params {
+		if params[i].Key == key {
+			return params[i].value()
+		}
+	}
+	return ""
+}
+
+// pmRawLanguages maps the language of raw bodies to a Content-Type
+var pmRawLanguages = map[string]string{
+	"json":       "application/json",
+	"xml":        "application/xml",
+	"html":       "text/html",
+	"javascript": "application/javascript",
+	"text":       "text/plain",
+}
+
+var pmVarRegexp = regexp.MustCompile(`{{\s*([^{}]+?)\s*}}`)
+
+// postmanImporter resolves variables and turns collection items into requests
+type postmanImporter struct {
+	vars       map[string]string
+	unresolved map[string]bool
+	rnd        *rand.Rand
+}
+
+// resolve replaces {{variables}}, including the common dynamic ones
+// ($guid, $timestamp, $randomInt). Values may refer to other variables.
+func (pi *postmanImporter) resolve(s string) string {
+	for depth := 0; depth < 10 && strings.Contains(s, "{{"); depth++ {
+		changed := false
+		s = pmVarRegexp.ReplaceAllStringFunc(s, func(m string) string {
+			name := pmVarRegexp.FindStringSubmatch(m)[1]
+			if v, ok := pi.vars[name]; ok {
+				changed = true
+				return v
+			}
+			switch name {
+			case "$guid", "$randomUUID":
+				var b [16]byte
+				pi.rnd.Read(b[:])
+				b[6] = b[6]&0x0f | 0x40
+				b[8] = b[8]&0x3f | 0x80
+				changed = true
+				return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+			case "$timestamp":
+				changed = true
+				return strconv.FormatInt(time.Now().Unix(), 10)
+			case "$randomInt":
+				changed = true
+				return strconv.Itoa(pi.rnd.Intn(1001))
+			}
+			pi.unresolved[name] = true
+			return m
+		})
+		if !changed {
+			break
+		}
+	}
+	return s
+}
+
+// pmImported is a request ready to be archived
+type pmImported struct {
+	method  string
+	uri     string
+	headers []string
+	body    []byte
+}
+
+// buildURL returns the resolved URL of a request
+func (pi *postmanImporter) buildURL(raw json.RawMessage) (u *url.URL, err error) {
+
+	var s string
+	if json.Unmarshal(raw, &s) != nil {
+		var pu pmURL
+		err = json.Unmarshal(raw, &pu)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid url")
+		}
+		s = pu.Raw
+		if s == "" { // no raw: assemble from parts
+			s = strings.Join(pu.Host, ".")
+			if pu.Protocol != "" {
+				s = pu.Protocol + "://" + s
+			}
+			if pu.Port != "" {
+				s += ":" + pu.Port
+			}
+			s += "/" + strings.Join(pu.Path, "/")
+			var q []string
+			for i := range pu.Query {
+				if pu.Query[i].on() {
+					q = append(q, pu.Query[i].Key+"="+pu.Query[i].value())
+				}
+			}
+			if len(q) > 0 {
+				s += "?" + strings.Join(q, "&")
+			}
+		}
+	}
+	s = pi.resolve(s)
+	if !strings.Contains(s, "://") {
+		s = "http://" + s // Postman allows URLs without a scheme
+	}
+	return url.Parse(s)
+}
+
+// build turns one collection request into a request to archive. `auth` is
+// the one inherited from folders and the collection.
+func (pi *postmanImporter) build(item *pmItem, auth *pmAuth) (imp *pmImported, err error) {
+
+	var pr pmRequest
+	var rawURL string
+	if json.Unmarshal(item.Request, &rawURL) == nil {
+		pr.URL, _ = json.Marshal(rawURL)
+	} else if err = json.Unmarshal(item.Request, &pr); err != nil {
+		return nil, errors.Wrap(err, "invalid request")
+	}
+	if pr.Auth != nil {
+		auth = pr.Auth
+	}
+
+	u, err := pi.buildURL(pr.URL)
+	if err != nil {
+		return nil, err
+	}
+	imp = &pmImported{method: strings.ToUpper(pr.Method)}
+	if imp.method == "" {
+		imp.method = "GET"
+	}
+
+	imp.headers = append(imp.headers, "Host: "+u.Host)
+	var contentType string
+	for i := range pr.Header {
+		h := &pr.Header[i]
+		if !h.on() {
+			continue
+		}
+		value := pi.resolve(h.value())
+		if strings.EqualFold(h.Key, "Content-Type") {
+			contentType = value
+			continue // added with the body
+		}
+		if strings.EqualFold(h.Key, "Host") {
+			imp.headers[0] = "Host: " + value
+			continue
+		}
+		imp.headers = append(imp.headers, h.Key+": "+value)
+	}
+
+	if auth != nil {
+		switch auth.Type {
+		case "bearer":
+			imp.headers = append(imp.headers, "Authorization: Bearer "+pi.resolve(pmParam(auth.Bearer, "token")))
+		case "basic":
+			creds := pi.resolve(pmParam(auth.Basic, "username")) + ":" + pi.resolve(pmParam(auth.Basic, "password"))
+			imp.headers = append(imp.headers, "Authorization: Basic "+base64.StdEncoding.EncodeToString([]byte(creds)))
+		case "apikey":
+			key, value := pi.resolve(pmParam(auth.APIKey, "key")), pi.resolve(pmParam(auth.APIKey, "value"))
+			if pmParam(auth.APIKey, "in") == "query" {
+				q := u.Query()
+				q.Set(key, value)
+				u.RawQuery = q.Encode()
+			} else {
+				imp.headers = append(imp.headers, key+": "+value)
+			}
+		}
+	}
+	imp.uri = u.RequestURI()
+
+	if pr.Body != nil {
+		var bodyType string
+		imp.body, bodyType, err = pi.buildBody(pr.Body)
+		if err != nil {
+			return nil, err
+		}
+		if contentType == "" {
+			contentType = bodyType
+		}
+	}
+	if contentType != "" {
+		imp.headers = append(imp.headers, "Content-Type: "+contentType)
+	}
+	return imp, nil
+}
+
+// buildBody returns the body and, if known from the mode, its Content-Type
+func (pi *postmanImporter) buildBody(b *pmBody) (body []byte, contentType string, err error) {
+
+	switch b.Mode {
+	case "raw":
+		return []byte(pi.resolve(b.Raw)), pmRawLanguages[b.Options.Raw.Language], nil
+	case "urlencoded":
+		form := url.Values{}
+		for i := range b.URLEncoded {
+			if b.URLEncoded[i].on() {
+				form.Add(pi.resolve(b.URLEncoded[i].Key), pi.resolve(b.URLEncoded[i].value()))
+			}
+		}
+		return []byte(form.Encode()), "application/x-www-form-urlencoded", nil
+	case "formdata":
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for i := range b.FormData {
+			f := &b.FormData[i]
+			if !f.on() {
+				continue
+			}
+			if f.Type == "file" {
+				// File contents are not in the collection: send an empty file
+				_, err = mw.CreateFormFile(pi.resolve(f.Key), "file")
+			} else {
+				err = mw.WriteField(pi.resolve(f.Key), pi.resolve(f.value()))
+			}
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		err = mw.Close()
+		return buf.Bytes(), mw.FormDataContentType(), err
+	case "graphql":
+		if b.GraphQL == nil {
+			return nil, "", nil
+		}
+		payload := map[string]interface{}{"query": pi.resolve(b.GraphQL.Query)}
+		if vars := strings.TrimSpace(pi.resolve(b.GraphQL.Variables)); vars != "" {
+			payload["variables"] = json.RawMessage(vars)
+		}
+		body, err = json.Marshal(payload)
+		return body, "application/json", err
+	}
+	return nil, "", nil // none, file (contents not in the collection)
+}
+
+// walkPostman calls fn for every request of a (folder) item list, depth first, in
+// collection order, with the auth inherited from the enclosing folders
+func walkPostman(items []pmItem, auth *pmAuth, path string, fn func(item *pmItem, auth *pmAuth, path string) error) error {
+	for i := range items {
+		item := &items[i]
+		itemAuth := auth
+		if item.Auth != nil {
+			itemAuth = item.Auth
+		}
+		itemPath := strings.TrimPrefix(path+" / "+item.Name, " / ")
+		if len(item.Request) == 0 {
+			if err := walkPostman(item.Item, itemAuth, itemPath, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(item, itemAuth, itemPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPostmanVars reads variables of a Postman environment file
+func loadPostmanVars(fileName string, vars map[string]string) (err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to read environment %s", fileName)
+	}
+	var env struct {
+		Values []pmKeyValue `json:"values"`
+	}
+	err = json.Unmarshal(data, &env)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid environment %s", fileName)
+	}
+	for i := range env.Values {
+		if env.Values[i].on() {
+			vars[env.Values[i].Key] = env.Values[i].value()
+		}
+	}
+	return nil
+}
+
+// importPostman converts a collection into an archive in `outDir`. The
+// collection is written `iterations` times; dynamic variables are
+// resolved again for each request.
+func importPostman(fileName, outDir, codec string, envFile string, overrides []string, iterations int) (err error) {
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to read %s", fileName)
+	}
+	var coll pmCollection
+	err = json.Unmarshal(data, &coll)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid Postman collection %s", fileName)
+	}
+
+	// Precedence, lowest first: collection, environment, command line
+	pi := &postmanImporter{
+		vars:       make(map[string]string),
+		unresolved: make(map[string]bool),
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for i := range coll.Variable {
+		if coll.Variable[i].on() {
+			pi.vars[coll.Variable[i].Key] = coll.Variable[i].value()
+		}
+	}
+	if envFile != "" {
+		err = loadPostmanVars(envFile, pi.vars)
+		if err != nil {
+			return err
+		}
+	}
+	for _, kv := range overrides {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("Variables must be given as name=value, got %q", kv)
+		}
+		pi.vars[parts[0]] = parts[1]
+	}
+
+	name := strings.TrimSuffix(strings.TrimSuffix(baseName(fileName), ".json"), ".postman_collection") + ".fbf"
+	ow, err := newOutputWriter(outDir, name, codec)
+	if err != nil {
+		return err
+	}
+	_, err = ow.Write(request.FileHeader())
+
+	var headers bytes.Buffer
+	for iter := 0; iter < iterations && err == nil; iter++ {
+		err = walkPostman(coll.Item, coll.Auth, "", func(item *pmItem, auth *pmAuth, path string) error {
+			imp, err := pi.build(item, auth)
+			if err != nil {
+				return errors.Wrapf(err, "request %q", path)
+			}
+			headers.Reset()
+			for _, h := range imp.headers {
+				headers.WriteString(h + "\r\n")
+			}
+			headers.WriteString("\r\n")
+			ts := time.Now().UnixNano()
+			id := "PM-" + strconv.FormatInt(ts, 10) + "-" + strconv.FormatInt(ow.Records+1, 10)
+			mr := request.CreateRequestAt(ts, []byte(id), []byte(imp.method), []byte(imp.uri), headers.Bytes(), imp.body)
+			_, err = mr.WriteFrame(ow)
+			mr.Release()
+			if err == nil {
+				ow.Records++
+			}
+			return err
+		})
+	}
+	if err != nil {
+		ow.Abort()
+		return errors.Wrapf(err, "Unable to import %s", fileName)
+	}
+	err = ow.Close()
+	if err != nil {
+		return err
+	}
+	for name := range pi.unresolved {
+		fmt.Fprintf(os.Stderr, "%s: variable {{%s}} is not defined, left as is\n", fileName, name)
+	}
+	fmt.Printf("%s\t%d records\n", ow.Name(), ow.Records)
+	return nil
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/fbr"
+)
+
+// newTestImporter is a postmanImporter of variables `vars`
+func newTestImporter(vars map[string]string) *postmanImporter {
+	return &postmanImporter{vars: vars, unresolved: make(map[string]bool), rnd: rand.New(rand.NewSource(1))}
+}
+
+func TestPostmanResolve(t *testing.T) {
+
+	pi := newTestImporter(map[string]string{"host": "api.example.com", "base": "https://{{ host }}/v1", "loop": "{{loop}}"})
+	if got := pi.resolve("{{base}}/items/{{id}}"); got != "https://api.example.com/v1/items/{{id}}" {
+		t.Fatalf("got %q", got)
+	}
+	if got := pi.resolve("{{loop}}"); got != "{{loop}}" {
+		t.Fatalf("got %q", got)
+	}
+	if !pi.unresolved["id"] || len(pi.unresolved) != 1 {
+		t.Fatalf("got unresolved %v", pi.unresolved)
+	}
+	dynamic := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12} [0-9]{1,4} [0-9]{10}$`)
+	if got := pi.resolve("{{$guid}} {{$randomInt}} {{$timestamp}}"); !dynamic.MatchString(got) {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestPostmanBuild(t *testing.T) {
+
+	bearer := &pmAuth{Type: "bearer", Bearer: []pmKeyValue{{Key: "token", Value: "{{token}}"}}}
+	tests := []struct {
+		name    string
+		request string
+		auth    *pmAuth
+		method  string
+		uri     string
+		headers string
+		body    string
+	}{
+		{"url only", `"{{host}}/a?b=1"`, nil,
+			"GET", "/a?b=1", "Host: api.example.com", ""},
+		{"url parts", `{"method": "delete", "url": {"protocol": "https", "host": ["api", "example", "com"], "port": "8443",
+			"path": ["items", "{{id}}"], "query": [{"key": "a", "value": 1}, {"key": "b", "value": "2", "disabled": true}]}}`, nil,
+			"DELETE", "/items/7?a=1", "Host: api.example.com:8443", ""},
+		{"headers and inherited auth", `{"method": "GET", "url": "http://{{host}}/", "header": [
+			{"key": "X-Id", "value": "{{id}}"}, {"key": "X-Off", "value": "1", "disabled": true}, {"key": "host", "value": "other"}]}`,
+			bearer, "GET", "/", "Host: other|X-Id: 7|Authorization: Bearer secret", ""},
+		{"own auth", `{"url": "http://{{host}}/", "auth": {"type": "basic",
+			"basic": [{"key": "username", "value": "u"}, {"key": "password", "value": "p"}]}}`, bearer,
+			"GET", "/", "Host: api.example.com|Authorization: Basic dTpw", ""},
+		{"api key in query", `{"url": "http://{{host}}/a?x=1", "auth": {"type": "apikey",
+			"apikey": [{"key": "key", "value": "k"}, {"key": "value", "value": "v"}, {"key": "in", "value": "query"}]}}`, nil,
+			"GET", "/a?k=v&x=1", "Host: api.example.com", ""},
+		{"raw json", `{"method": "POST", "url": "http://{{host}}/", "body": {"mode": "raw", "raw": "{\"id\": {{id}}}",
+			"options": {"raw": {"language": "json"}}}}`, nil,
+			"POST", "/", "Host: api.example.com|Content-Type: application/json", `{"id": 7}`},
+		{"content type of headers", `{"method": "POST", "url": "http://{{host}}/", "header": [
+			{"key": "content-type", "value": "text/csv"}], "body": {"mode": "urlencoded",
+			"urlencoded": [{"key": "a b", "value": "{{id}}"}, {"key": "c", "value": "d", "disabled": true}]}}`, nil,
+			"POST", "/", "Host: api.example.com|Content-Type: text/csv", "a+b=7"},
+		{"graphql", `{"method": "POST", "url": "http://{{host}}/graphql", "body": {"mode": "graphql",
+			"graphql": {"query": "{ item(id: {{id}}) { name } }", "variables": " {\"a\": 1} "}}}`, nil,
+			"POST", "/graphql", "Host: api.example.com|Content-Type: application/json",
+			`{"query":"{ item(id: 7) { name } }","variables":{"a":1}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pi := newTestImporter(map[string]string{"host": "api.example.com", "id": "7", "token": "secret"})
+			imp, err := pi.build(&pmItem{Request: json.RawMessage(tt.request)}, tt.auth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if imp.method != tt.method || imp.uri != tt.uri || strings.Join(imp.headers, "|") != tt.headers ||
+				string(imp.body) != tt.body {
+				t.Fatalf("got %s %s %q %q", imp.method, imp.uri, imp.headers, imp.body)
+			}
+		})
+	}
+}
+
+func TestPostmanFormData(t *testing.T) {
+
+	pi := newTestImporter(map[string]string{"v": "value"})
+	body, contentType, err := pi.buildBody(&pmBody{Mode: "formdata", FormData: []pmKeyValue{
+		{Key: "field", Value: "{{v}}"}, {Key: "upload", Type: "file"}, {Key: "off", Value: "x", Disabled: true}}})
+	if err != nil || !strings.HasPrefix(contentType, "multipart/form-data; boundary=") {
+		t.Fatalf("got %q, %v", contentType, err)
+	}
+	for _, s := range []string{
+		"Content-Disposition: form-data; name=\"field\"\r\n\r\nvalue\r\n",
+		"Content-Disposition: form-data; name=\"upload\"; filename=\"file\"\r\n",
+	} {
+		if !strings.Contains(string(body), s) {
+			t.Fatalf("%q not in %q", s, body)
+		}
+	}
+	if strings.Contains(string(body), "off") {
+		t.Fatalf("disabled field in %q", body)
+	}
+}
+
+// Folders are walked depth first, their auth inherited
+func TestImportPostman(t *testing.T) {
+
+	dir := tempDir(t)
+	writeFiles(t, dir, map[string]string{
+		"api.postman_collection.json": `{
+  "info": {"name": "API"},
+  "variable": [{"key": "host", "value": "collection.example.com"}, {"key": "token", "value": "t1"}],
+  "auth": {"type": "bearer", "bearer": [{"key": "token", "value": "{{token}}"}]},
+  "item": [
+    {"name": "folder", "auth": {"type": "noauth"}, "item": [
+      {"name": "list", "request": {"method": "GET", "url": "{{host}}/items"}}
+    ]},
+    {"name": "create", "request": {"method": "POST", "url": "{{host}}/items",
+      "body": {"mode": "raw", "raw": "{{name}}"}}}
+  ]
+}`,
+		"env.json": `{"values": [{"key": "host", "value": "env.example.com"}, {"key": "name", "value": "n1"},
+			{"key": "token", "value": "off", "enabled": false}]}`,
+	})
+	outDir := tempDir(t)
+	out, err := captureOutput(t, runImport, "-f", "postman", "-c", "none", "-o", outDir, "-n", "2",
+		"-e", filepath.Join(dir, "env.json"), "--var", "name=n2", filepath.Join(dir, "api.postman_collection.json"))
+	if err != nil || out != "api.fbf\t4 records\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+
+	var got []string
+	err = forEachRequest(filepath.Join(outDir, "api.fbf"), func(req *fbr.Request, offset int64) error {
+		if !strings.HasPrefix(string(req.Id()), "PM-") {
+			t.Fatalf("got ID %q", req.Id())
+		}
+		got = append(got, strings.Join([]string{string(req.Method()), string(req.Uri()), string(req.Headers()),
+			string(req.BodyBytes())}, " "))
+		return nil
+	})
+	list := "GET /items Host: env.example.com\r\n\r\n "
+	create := "POST /items Host: env.example.com\r\nAuthorization: Bearer t1\r\n\r\n n2"
+	if want := []string{list, create, list, create}; err != nil || strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestImportPostmanErrors(t *testing.T) {
+
+	dir := tempDir(t)
+	writeFiles(t, dir, map[string]string{
+		"bad.json":  `{"item": [`,
+		"coll.json": `{"item": [{"name": "a", "request": {"url": "http://example.com/"}}]}`,
+		"url.json":  `{"item": [{"name": "a", "request": {"url": 1}}]}`,
+	})
+	for _, args := range [][]string{
+		{filepath.Join(dir, "bad.json")},
+		{filepath.Join(dir, "missing.json")},
+		{"--var", "novalue", filepath.Join(dir, "coll.json")},
+		{"-e", filepath.Join(dir, "bad.json"), filepath.Join(dir, "coll.json")},
+		{filepath.Join(dir, "url.json")},
+	} {
+		args = append([]string{"-f", "postman", "-c", "none", "-o", dir}, args...)
+		if _, err := captureOutput(t, runImport, args...); err == nil {
+			t.Fatalf("%q: no error", args)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.fbf*")); len(files) != 0 {
+		t.Fatalf("got files %q", files)
+	}
+}
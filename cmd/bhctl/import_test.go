@@ -0,0 +1,180 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/fbr"
+)
+
+func TestUnescapeLogValue(t *testing.T) {
+
+	tests := map[string]string{
+		`plain`:            `plain`,
+		`say \"hi\"`:       `say "hi"`,
+		`\x22q\x22 \x5Cx`:  `"q" \x`,
+		`bad \xZZ`:         `bad xZZ`,
+		`trailing \`:       `trailing \`,
+		`\\x41 stays \\x4`: `\x41 stays \x4`,
+	}
+	for v, want := range tests {
+		if got := unescapeLogValue(v); got != want {
+			t.Fatalf("%s: got %q, want %q", v, got, want)
+		}
+	}
+}
+
+func TestSplitPort(t *testing.T) {
+
+	tests := []struct{ hostport, host, port string }{
+		{"example.com:8080", "example.com", "8080"},
+		{"example.com", "example.com", ""},
+		{"[::1]:443", "[::1]", "443"},
+		{"[::1]", "[::1]", ""},
+	}
+	for _, tt := range tests {
+		if host, port := splitPort(tt.hostport); host != tt.host || port != tt.port {
+			t.Fatalf("%s: got %q, %q", tt.hostport, host, port)
+		}
+	}
+}
+
+func TestLogParser(t *testing.T) {
+
+	tests := []struct {
+		format, line string
+		want         logEntry
+	}{
+		{logFormats["combined"],
+			`10.0.0.1 - - [13/Sep/2020:12:26:40 +0000] "GET /a?x=1 HTTP/1.1" 200 612 "https://ref/\"q\"" "curl/7.68.0"`,
+			logEntry{ts: time.Unix(1600000000, 0), method: "GET", uri: "/a?x=1", status: 200,
+				headers: []string{`Referer: https://ref/"q"`, "User-Agent: curl/7.68.0"}}},
+		{logFormats["common"],
+			`10.0.0.1 - bob [13/Sep/2020:14:26:40 +0200] "DELETE /a HTTP/1.1" 204 0`,
+			logEntry{ts: time.Unix(1600000000, 0), method: "DELETE", uri: "/a", status: 204}},
+		// Absolute URL: the host and the path of it, default port dropped
+		{logFormats["alb"],
+			`https 2020-09-13T12:26:40.5Z app/lb/50dc6c495c0c9188 10.0.0.1:5000 10.0.1.1:80 0.000 0.250 0.000 201 201 ` +
+				`100 200 "POST https://api.example.com:443/items?n=1 HTTP/1.1" "curl/7" ECDHE TLSv1.2 ` +
+				`arn:aws:elasticloadbalancing:tg "Root=1-abc" "api.example.com" "arn:cert" 0 2020-09-13T12:26:40.2Z "forward"`,
+			logEntry{ts: time.Unix(1600000000, 5e8), method: "POST", uri: "/items?n=1", status: 201,
+				duration: 250 * time.Millisecond,
+				headers:  []string{"Host: api.example.com", "User-Agent: curl/7", "X-Amzn-Trace-Id: Root=1-abc"}}},
+		{`$request_id $http_host "$request_method $uri" $args $content_type $msec $http_x_forwarded_for`,
+			`r-1 api.example.com "PUT /items/1" v=2 application/json 1600000000.500 -`,
+			logEntry{ts: time.Unix(1600000000, 5e8), id: "r-1", method: "PUT", uri: "/items/1?v=2",
+				headers: []string{"Host: api.example.com", "Content-Type: application/json"}}},
+	}
+	for _, tt := range tests {
+		lp, err := newLogParser(tt.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, ok := lp.parse(tt.line)
+		if !ok || !e.ts.Equal(tt.want.ts) || e.id != tt.want.id || e.method != tt.want.method || e.uri != tt.want.uri ||
+			e.status != tt.want.status || e.duration != tt.want.duration ||
+			strings.Join(e.headers, "|") != strings.Join(tt.want.headers, "|") {
+			t.Fatalf("%s: got %+v, %v", tt.line, e, ok)
+		}
+	}
+}
+
+func TestLogParserNoMatch(t *testing.T) {
+
+	lp, err := newLogParser(logFormats["common"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"",
+		`10.0.0.1 - - [13/Sep/2020:12:26:40 +0000] "-" 400 0`,
+		`10.0.0.1 - - [13/Sep/2020:12:26:40 +0000] "GET" 400 0`,
+		`not a log line`,
+	} {
+		if e, ok := lp.parse(line); ok {
+			t.Fatalf("%q: got %+v", line, e)
+		}
+	}
+	if _, err = newLogParser("no variables"); err == nil {
+		t.Fatal("no error without variables")
+	}
+}
+
+func TestImportLog(t *testing.T) {
+
+	dir := tempDir(t)
+	lines := `10.0.0.1 - - [13/Sep/2020:12:26:40 +0000] "GET /a HTTP/1.1" 200 612 "-" "curl/7.68.0"
+garbage
+10.0.0.1 - - [13/Sep/2020:12:26:41 +0000] "POST http://api.example.com/b HTTP/1.1" 201 0 "-" "-"
+`
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(lines))
+	zw.Close()
+	writeFiles(t, dir, map[string]string{"access.log.gz": gz.String()})
+	outDir := tempDir(t)
+	out, err := captureOutput(t, runImport, "-c", "none", "--host", "default.example.com", "-o", outDir,
+		filepath.Join(dir, "access.log.gz"))
+	if err != nil || out != "access.fbf\t2 records\t1 lines skipped\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+
+	var got []string
+	err = forEachRequest(filepath.Join(outDir, "access.fbf"), func(req *fbr.Request, offset int64) error {
+		got = append(got, strings.Join([]string{string(req.Id()), string(req.Method()), string(req.Uri()),
+			string(req.Headers()), time.Unix(0, req.Timestamp()).UTC().Format(time.RFC3339)}, " "))
+		if req.Status() == 0 {
+			t.Fatalf("%s: no status", req.Uri())
+		}
+		return nil
+	})
+	want := []string{
+		"LOG-1600000000000000000-1 GET /a Host: default.example.com\r\nUser-Agent: curl/7.68.0\r\n\r\n 2020-09-13T12:26:40Z",
+		"LOG-1600000001000000000-3 POST /b Host: api.example.com\r\n\r\n 2020-09-13T12:26:41Z",
+	}
+	if err != nil || strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if st, err := scanArchive(filepath.Join(outDir, "access.fbf")); err != nil || st.header == nil {
+		t.Fatalf("got %+v, %v", st, err)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+
+	dir := tempDir(t)
+	writeFiles(t, dir, map[string]string{"access.log": ""})
+	fileName := filepath.Join(dir, "access.log")
+	for _, args := range [][]string{
+		{"-f", "apache", fileName},
+		{"-c", "brotli", fileName},
+		{"-f", "postman", "-n", "0", fileName},
+	} {
+		if _, err := captureOutput(t, runImport, args...); err != errUsage {
+			t.Fatalf("%q: got %v", args, err)
+		}
+	}
+	if _, err := captureOutput(t, runImport, "-o", dir, fileName+".missing"); err == nil {
+		t.Fatal("no error for a missing log")
+	}
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 1 {
+		t.Fatalf("got %d files", len(infos))
+	}
+}
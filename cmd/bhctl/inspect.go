@@ -0,0 +1,183 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/frame"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+)
+
+// archiveStats is what `bhctl inspect` collects while streaming an archive
+type archiveStats struct {
+	header      *frame.Header
+	records     int64
+	compressed  int64 // records compressed with the dictionary of the header
+	bodyBytes   int64
+	streamBytes int64
+	first, last time.Time
+}
+
+// recordTime returns when a request was recorded. Archives written before
+// the timestamp field was added only have it in blackhole generated IDs
+// (FH-<unix-nano>-<n>). Zero time if neither is available.
+func recordTime(req *fbr.Request) time.Time {
+	if ts := req.Timestamp(); ts != 0 {
+		return time.Unix(0, ts)
+	}
+	id := req.Id()
+	if !bytes.HasPrefix(id, []byte("FH-")) {
+		return time.Time{}
+	}
+	id = id[3:]
+	if i := bytes.IndexByte(id, '-'); i > 0 {
+		id = id[:i]
+	}
+	ns, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// add accounts for one record
+func (st *archiveStats) add(req *fbr.Request) {
+	st.records++
+	st.bodyBytes += int64(req.BodyLength())
+	ts := recordTime(req)
+	if ts.IsZero() {
+		return
+	}
+	if st.first.IsZero() || ts.Before(st.first) {
+		st.first = ts
+	}
+	if ts.After(st.last) {
+		st.last = ts
+	}
+}
+
+// scanArchive reads the whole archive once and collects its stats
+func scanArchive(fileName string) (st *archiveStats, err error) {
+
+	const archiveFileReadBufSize = 65536 // 64 K
+
+	rf, err := archive.OpenArchive(fileName, archiveFileReadBufSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to open archive file: %s", fileName)
+	}
+	defer rf.Close()
+
+	st = &archiveStats{}
+	for {
+		umr, err := request.GetNextFrame(rf, false)
+		if err == io.EOF {
+			return st, nil
+		}
+		if err != nil {
+			return st, errors.Wrapf(err, "corrupted archive after %d records (%d bytes)", st.records, st.streamBytes)
+		}
+		st.streamBytes += int64(umr.FrameSize())
+		if umr.IsHeader() {
+			h, err := umr.Header()
+			if err != nil {
+				umr.Release()
+				return st, errors.Wrapf(err, "bad file header at byte %d", st.streamBytes)
+			}
+			if st.header == nil {
+				st.header = &h
+			}
+		} else {
+			st.add(umr.Request())
+			if umr.IsCompressed() {
+				st.compressed++
+			}
+		}
+		umr.Release()
+	}
+}
+
+// codecName guesses the compression codec from the file name, the same way
+// the archive reader decides
+func codecName(fileName string) string {
+	for codec, ext := range codecExtensions {
+		if ext != "" && strings.HasSuffix(strings.ToLower(fileName), ext) {
+			return codec
+		}
+	}
+	return "none"
+}
+
+// runInspect prints a summary of one or more archive files
+func runInspect(args []string) (err error) {
+
+	fs := newFlagSet("inspect", "<archive-url>...")
+	human := fs.BoolP("human-readable", "H", false, "Print sizes like 1.5K, 20M")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	size := func(n int64) string {
+		if *human {
+			return humanBytes(n)
+		}
+		return fmt.Sprintf("%d", n)
+	}
+
+	for i, fileName := range fs.Args() {
+		st, err := scanArchive(fileName)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("File:           %s\n", fileName)
+		fmt.Printf("Codec:          %s\n", codecName(fileName))
+		if st.header != nil {
+			h := st.header
+			fmt.Printf("Header:         %s v%d, created %s on %s\n",
+				h.Format, h.Version, h.Created.Format(time.RFC3339), h.Host)
+			fmt.Printf("Schema:         %s v%d\n", h.Schema, h.SchemaVersion)
+			if len(h.Dict) > 0 {
+				fmt.Printf("Dict bytes:     %s (%d records compressed with it)\n", size(int64(len(h.Dict))), st.compressed)
+			}
+		} else {
+			fmt.Printf("Header:         none (legacy archive)\n")
+			fmt.Printf("Schema:         %s v1 (assumed)\n", fbr.SchemaName)
+		}
+		fmt.Printf("Records:        %d\n", st.records)
+		if !st.first.IsZero() {
+			fmt.Printf("Time range:     %s - %s (%s)\n", st.first.Format(time.RFC3339), st.last.Format(time.RFC3339),
+				st.last.Sub(st.first).Round(time.Millisecond))
+		} else {
+			fmt.Printf("Time range:     unknown\n")
+		}
+		avg := int64(0)
+		if st.records > 0 {
+			avg = st.bodyBytes / st.records
+		}
+		fmt.Printf("Body bytes:     %s (avg %s)\n", size(st.bodyBytes), size(avg))
+		fmt.Printf("Stream bytes:   %s (uncompressed)\n", size(st.streamBytes))
+	}
+	return nil
+}
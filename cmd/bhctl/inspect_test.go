@@ -0,0 +1,102 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/request"
+)
+
+func TestRecordTime(t *testing.T) {
+
+	tests := []struct {
+		ts   int64
+		id   string
+		want int64
+	}{
+		{testTime, "FH-1-2", testTime},
+		{0, "FH-1600000000000000001-7", testTime + 1},
+		{0, "FH-1600000000000000001", testTime + 1},
+		{0, "FH-x-1", 0},
+		{0, "id-1", 0},
+	}
+	for _, tt := range tests {
+		mr := request.CreateRequestAt(tt.ts, []byte(tt.id), []byte("GET"), []byte("/"), nil, nil)
+		umr := mr.Unmarshalled()
+		got := recordTime(umr.Request())
+		if (tt.want == 0 && !got.IsZero()) || (tt.want != 0 && got.UnixNano() != tt.want) {
+			t.Fatalf("%d %s: got %s", tt.ts, tt.id, got)
+		}
+		umr.Release()
+	}
+}
+
+func TestCodecName(t *testing.T) {
+
+	tests := map[string]string{
+		"requests_1.fbf":     "none",
+		"requests_1.fbf.lz4": "lz4",
+		"requests_1.fbf.GZ":  "gzip",
+		"requests_1.fbf.zst": "zstd",
+		"requests_1.fbf.sz":  "snappy",
+	}
+	for fileName, want := range tests {
+		if got := codecName(fileName); got != want {
+			t.Fatalf("%s: got %s, want %s", fileName, got, want)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+
+	dir := tempDir(t)
+	fileName := writeArchive(t, dir, false,
+		testRequest(1, "POST", "/a", "", "a"),
+		testRequest(3, "POST", "/b", "", "bbbb"),
+		testRequest(2, "GET", "/c", "", "c"))
+	out, err := captureOutput(t, runInspect, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, last := time.Unix(0, testTime+1e9).Format(time.RFC3339), time.Unix(0, testTime+3e9).Format(time.RFC3339)
+	for _, want := range []string{
+		"File:           " + fileName + "\n",
+		"Codec:          none\n",
+		"Header:         blackhole v",
+		"Schema:         fbr.Request v",
+		"Records:        3\n",
+		"Time range:     " + first + " - " + last + " (2s)\n",
+		"Body bytes:     6 (avg 2)\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("no %q in %s", want, out)
+		}
+	}
+
+	// Archives written before the header was added
+	legacy := writeArchive(t, tempDir(t), true, testRequest(1, "GET", "/", "", ""))
+	out, err = captureOutput(t, runInspect, fileName, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "\n\nFile:           "+legacy+"\n") ||
+		!strings.Contains(out, "Header:         none (legacy archive)\nSchema:         fbr.Request v1 (assumed)\n") {
+		t.Fatalf("got %s", out)
+	}
+	if _, err = captureOutput(t, runInspect, fileName+".missing"); err == nil {
+		t.Fatal("no error for a missing archive")
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+/*
+`bhctl` manages archives recorded by `blackhole`. Every command works the same
+way across local directories and s3/az/adls/gs/sftp/hdfs URLs (see lib/archive for URL formats).
+
+ Usage: bhctl <command> [options] [arguments]
+
+ Commands:
+   ls       List archive files in one or more directories
+   rm       Delete archive files from a directory
+   cp       Copy archive files (as is) into a directory
+   du       Show number of files and total bytes in directories
+   stat     Show size, modification time, record count and checksum of archives
+   inspect  Show header, schema, record count and time range of archives
+   split    Split an archive into chunks of N records, with a manifest
+   convert  Recompress archives or convert them to jsonl/har
+   dict     Train a zstd dictionary on the requests of sample archives
+   verify   Check framing, checksums and records of archives or split manifests
+   analyze  Report top URIs, methods, body sizes and request rate
+   grep     Find requests whose URI, headers or body match a regex
+   tail     Print one line per request, following files being recorded
+   openapi  Infer a draft OpenAPI 3 spec (paths, parameters, body schemas) from captures
+   export   Export requests to other systems (run `export -h` for targets)
+   import   Build archives from nginx/Apache/ALB access logs or Postman collections
+   metrics  Serve Prometheus metrics on archive counts, bytes and age per prefix
+   bench    Measure write/read throughput of backends, codecs and buffer sizes
+
+ Run `bhctl <command> -h` for options of a command.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var buildTS string
+
+// errUsage is returned by commands when arguments are missing or wrong.
+// Usage is already printed by then.
+var errUsage = errors.New("invalid usage")
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"ls", "List archive files in one or more directories", runLs},
+	{"rm", "Delete archive files from a directory", runRm},
+	{"cp", "Copy archive files (as is) into a directory", runCp},
+	{"du", "Show number of files and total bytes in directories", runDu},
+	{"stat", "Show size, modification time, record count and checksum of archives", runStat},
+	{"inspect", "Show header, schema, record count and time range of archives", runInspect},
+	{"split", "Split an archive into chunks of N records, with a manifest", runSplit},
+	{"convert", "Recompress archives or convert them to jsonl/har", runConvert},
+	{"dict", "Train a zstd dictionary on the requests of sample archives", runDict},
+	{"verify", "Check framing, checksums and records of archives or split manifests", runVerify},
+	{"analyze", "Report top URIs, methods, body sizes and request rate", runAnalyze},
+	{"grep", "Find requests whose URI, headers or body match a regex", runGrep},
+	{"tail", "Print one line per request, following files being recorded", runTail},
+	{"openapi", "Infer a draft OpenAPI 3 spec (paths, parameters, body schemas) from captures", runOpenAPI},
+	{"export", "Export requests to other systems (run `export -h` for targets)", runExport},
+	{"import", "Build archives from nginx/Apache/ALB access logs or Postman collections", runImport},
+	{"metrics", "Serve Prometheus metrics on archive counts, bytes and age per prefix", runMetrics},
+	{"bench", "Measure write/read throughput of backends, codecs and buffer sizes", runBench},
+}
+
+var verbose bool
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s (Build ts: %s)\n\n  %s <command> [options] [arguments]\n\nCommands:\n",
+		os.Args[0], buildTS, os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun `%s <command> -h` for options of a command.\n", os.Args[0])
+}
+
+// newFlagSet returns a FlagSet for a command with the common options added
+func newFlagSet(name, arguments string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.BoolVarP(&verbose, "verbose", "v", false, "Verbose output")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [options] %s\n\n", os.Args[0], name, arguments)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses command arguments and sets up logging. Returns errUsage
+// if there are fewer than `minArgs` positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string, minArgs int) (err error) {
+
+	err = fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if verbose {
+		common.DefaultLogger, err = zap.NewDevelopment()
+		if err != nil {
+			return err
+		}
+	} else {
+		common.DefaultLogger = zap.NewNop()
+	}
+	if fs.NArg() < minArgs {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+func main() {
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := os.Args[1]
+	if name == "-h" || name == "--help" || name == "help" {
+		usage()
+		return
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			err := cmd.run(os.Args[2:])
+			if err == errUsage {
+				os.Exit(2)
+			}
+			if err == errNoMatch {
+				os.Exit(1)
+			}
+			if err == errVerifyFailed { // details are already printed
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+				os.Exit(1)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %s: %+v\n", name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+	usage()
+	os.Exit(2)
+}
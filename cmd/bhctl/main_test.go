@@ -0,0 +1,146 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/request"
+	"go.uber.org/zap"
+)
+
+// tempDir is a directory removed at the end of the test
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bhctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// writeFiles writes files of `dir`, name to content
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		fileName := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// captureOutput runs a command and returns what it printed
+func captureOutput(t *testing.T, run func(args []string) error, args ...string) (string, error) {
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	out := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- data
+	}()
+	err = run(args)
+	os.Stdout = saved
+	w.Close()
+	return string(<-out), err
+}
+
+// testRequest is a request recorded `sec` seconds after testTime
+func testRequest(sec int, method, uri, headers, body string) *request.MarshalledRequest {
+	return request.CreateRequestAt(testTime+int64(sec)*1e9, []byte(fmt.Sprintf("id-%d", sec)),
+		[]byte(method), []byte(uri), []byte(headers), []byte(body))
+}
+
+// testTime is when test requests are recorded, unix nano
+const testTime = 1600000000 * 1e9
+
+// writeArchive writes an uncompressed archive of `reqs` in `dir`, with the
+// file header unless `legacy`, and returns its name
+func writeArchive(t *testing.T, dir string, legacy bool, reqs ...*request.MarshalledRequest) string {
+
+	options := []func(*common.BasicArchive) error{common.Compress(false), common.Logger(zap.NewNop())}
+	if !legacy {
+		options = append(options, common.FileHeader(request.FileHeader))
+	}
+	rf, err := archive.NewArchive(dir, "requests", ".fbf", options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mr := range reqs {
+		if err = mr.SaveRequest(rf, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, details := range rf.FinalizedFiles() {
+		return filepath.Join(dir, details.FileName)
+	}
+	t.Fatal("no file written")
+	return ""
+}
+
+// headerLen is the length of the file header of an uncompressed archive.
+// Headers carry their creation time, so their length varies.
+func headerLen(t *testing.T, fileName string) int {
+
+	t.Helper()
+	fp, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	umr, err := request.GetNextFrame(fp, false)
+	if err != nil || !umr.IsHeader() {
+		t.Fatalf("no file header: %v", err)
+	}
+	defer umr.Release()
+	return umr.FrameSize()
+}
+
+// readURIs returns the URIs of the requests of an archive
+func readURIs(t *testing.T, fileName string) (uris []string) {
+
+	t.Helper()
+	rf, err := archive.OpenArchive(fileName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	for {
+		umr, err := request.GetNextRequest(rf, false)
+		if err == io.EOF {
+			return uris
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		uris = append(uris, string(umr.Request().Uri()))
+		umr.Release()
+	}
+}
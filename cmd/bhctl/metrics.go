@@ -0,0 +1,200 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// storageMetrics are the gauges exported by `bhctl metrics`, one series per prefix.
+// Values are from the last scan: listing large buckets is too slow (and
+// costly) to do on every scrape.
+type storageMetrics struct {
+	files        *prometheus.GaugeVec
+	bytes        *prometheus.GaugeVec
+	oldest       *prometheus.GaugeVec
+	newest       *prometheus.GaugeVec
+	lastScan     *prometheus.GaugeVec
+	scanDuration *prometheus.GaugeVec
+	scanErrors   *prometheus.CounterVec
+}
+
+func newStorageMetrics(reg prometheus.Registerer) *storageMetrics {
+
+	gauge := func(name, help string) *prometheus.GaugeVec {
+		g := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "blackhole",
+			Subsystem: "archive",
+			Name:      name,
+			Help:      help,
+		}, []string{"prefix"})
+		reg.MustRegister(g)
+		return g
+	}
+	sm := &storageMetrics{
+		files:        gauge("files", "Number of archive files under the prefix"),
+		bytes:        gauge("bytes", "Total size of archive files under the prefix"),
+		oldest:       gauge("oldest_timestamp_seconds", "Modification time of the oldest archive file"),
+		newest:       gauge("newest_timestamp_seconds", "Modification time of the newest archive file"),
+		lastScan:     gauge("last_scan_timestamp_seconds", "Time the prefix was last listed successfully"),
+		scanDuration: gauge("scan_duration_seconds", "Time it took to list the prefix"),
+		scanErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "blackhole",
+			Subsystem: "archive",
+			Name:      "scan_errors_total",
+			Help:      "Number of failed listings of the prefix",
+		}, []string{"prefix"}),
+	}
+	reg.MustRegister(sm.scanErrors)
+	return sm
+}
+
+// scan lists one prefix and updates its series. On error the previous values
+// are kept, so a flaky listing doesn't show up as storage going to zero.
+func (sm *storageMetrics) scan(prefix string) (err error) {
+
+	start := time.Now()
+	entries, err := archive.ListDetails(prefix)
+	if err != nil {
+		sm.scanErrors.WithLabelValues(prefix).Inc()
+		return errors.Wrapf(err, "Unable to list %s", prefix)
+	}
+
+	var total int64
+	var oldest, newest time.Time
+	for _, entry := range entries {
+		total += entry.Size
+		if oldest.IsZero() || entry.ModTime.Before(oldest) {
+			oldest = entry.ModTime
+		}
+		if entry.ModTime.After(newest) {
+			newest = entry.ModTime
+		}
+	}
+
+	sm.files.WithLabelValues(prefix).Set(float64(len(entries)))
+	sm.bytes.WithLabelValues(prefix).Set(float64(total))
+	if len(entries) > 0 {
+		sm.oldest.WithLabelValues(prefix).Set(float64(oldest.UnixNano()) / 1e9)
+		sm.newest.WithLabelValues(prefix).Set(float64(newest.UnixNano()) / 1e9)
+	} else {
+		// No files: no meaningful age. Dashboards see the series disappear
+		sm.oldest.DeleteLabelValues(prefix)
+		sm.newest.DeleteLabelValues(prefix)
+	}
+	sm.lastScan.WithLabelValues(prefix).SetToCurrentTime()
+	sm.scanDuration.WithLabelValues(prefix).Set(time.Since(start).Seconds())
+	return nil
+}
+
+// scanAll scans every prefix once, logging failures
+func (sm *storageMetrics) scanAll(prefixes []string) {
+	for _, prefix := range prefixes {
+		err := sm.scan(prefix)
+		if err != nil {
+			common.DefaultLogger.Error("Scan failed", zap.String("prefix", prefix), zap.Error(err))
+		}
+	}
+}
+
+// metricsPrefixes returns the prefixes from the command line and, if given,
+// the `prefixes` list of a config file (yaml, json or toml, as viper reads it)
+func metricsPrefixes(configFile string, args []string) (prefixes []string, err error) {
+
+	prefixes = append(prefixes, args...)
+	if configFile == "" {
+		return prefixes, nil
+	}
+	v := viper.New()
+	v.SetConfigFile(configFile)
+	err = v.ReadInConfig()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read %s", configFile)
+	}
+	return append(prefixes, v.GetStringSlice("prefixes")...), nil
+}
+
+// runMetrics serves Prometheus metrics about archive storage usage
+func runMetrics(args []string) (err error) {
+
+	fs := newFlagSet("metrics", "[<dir-url>...]")
+	listen := fs.StringP("listen", "l", ":9418", "Address to serve /metrics on")
+	interval := fs.DurationP("interval", "i", 5*time.Minute, "How often prefixes are listed")
+	configFile := fs.StringP("config", "c", "", "Config file with a `prefixes` list of dir URLs")
+	once := fs.Bool("once", false, "Scan once, print metrics in text format (e.g. for a textfile collector) and exit")
+	err = parseArgs(fs, args, 0)
+	if err != nil {
+		return err
+	}
+
+	prefixes, err := metricsPrefixes(*configFile, fs.Args())
+	if err != nil {
+		return err
+	}
+	if len(prefixes) == 0 || *interval <= 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	reg := prometheus.NewRegistry()
+	sm := newStorageMetrics(reg)
+
+	if *once {
+		failed := false
+		for _, prefix := range prefixes {
+			err = sm.scan(prefix)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				failed = true
+			}
+		}
+		mfs, err := reg.Gather()
+		if err != nil {
+			return err
+		}
+		for _, mf := range mfs {
+			_, err = expfmt.MetricFamilyToText(os.Stdout, mf)
+			if err != nil {
+				return err
+			}
+		}
+		if failed {
+			return errors.New("some prefixes could not be listed")
+		}
+		return nil
+	}
+
+	go func() {
+		for {
+			sm.scanAll(prefixes)
+			time.Sleep(*interval)
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	fmt.Fprintf(os.Stderr, "Serving metrics for %d prefixes on %s/metrics\n", len(prefixes), *listen)
+	return http.ListenAndServe(*listen, mux)
+}
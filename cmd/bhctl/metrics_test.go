@@ -0,0 +1,91 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsPrefixes(t *testing.T) {
+
+	dir := tempDir(t)
+	writeFiles(t, dir, map[string]string{"metrics.yaml": "prefixes:\n  - s3://bucket/a\n  - /data/b\n"})
+	prefixes, err := metricsPrefixes(filepath.Join(dir, "metrics.yaml"), []string{"/data/c"})
+	if err != nil || strings.Join(prefixes, " ") != "/data/c s3://bucket/a /data/b" {
+		t.Fatalf("got %q, %v", prefixes, err)
+	}
+	if prefixes, err = metricsPrefixes("", []string{"/data/c"}); err != nil || len(prefixes) != 1 {
+		t.Fatalf("got %q, %v", prefixes, err)
+	}
+	if _, err = metricsPrefixes(filepath.Join(dir, "missing.yaml"), nil); err == nil {
+		t.Fatal("no error for a missing config file")
+	}
+}
+
+func TestMetricsOnce(t *testing.T) {
+
+	a, b := tempDir(t), tempDir(t)
+	writeFiles(t, a, map[string]string{"x.fbf": "xxx", "y.fbf": "yyyyy"})
+	for name, sec := range map[string]int64{"x.fbf": 1600000000, "y.fbf": 1600000100} {
+		mtime := time.Unix(sec, 0)
+		if err := os.Chtimes(filepath.Join(a, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := captureOutput(t, runMetrics, "--once", a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`blackhole_archive_files{prefix="` + a + `"} 2` + "\n",
+		`blackhole_archive_files{prefix="` + b + `"} 0` + "\n",
+		`blackhole_archive_bytes{prefix="` + a + `"} 8` + "\n",
+		`blackhole_archive_oldest_timestamp_seconds{prefix="` + a + `"} 1.6e+09` + "\n",
+		`blackhole_archive_newest_timestamp_seconds{prefix="` + a + `"} 1.6000001e+09` + "\n",
+		`blackhole_archive_last_scan_timestamp_seconds{prefix="` + b + `"} `,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("no %q in %s", want, out)
+		}
+	}
+
+	// No age for empty prefixes
+	if strings.Contains(out, `blackhole_archive_oldest_timestamp_seconds{prefix="`+b+`"}`) {
+		t.Fatalf("got the age of an empty prefix in %s", out)
+	}
+}
+
+func TestMetricsOnceFailed(t *testing.T) {
+
+	a := tempDir(t)
+	collector := "tcp://127.0.0.1:9000" // not listable
+	out, err := captureOutput(t, runMetrics, "--once", a, collector)
+	if err == nil || !strings.Contains(out, `blackhole_archive_scan_errors_total{prefix="`+collector+`"} 1`+"\n") ||
+		!strings.Contains(out, `blackhole_archive_files{prefix="`+a+`"} 0`+"\n") {
+		t.Fatalf("got %s, %v", out, err)
+	}
+}
+
+func TestMetricsUsage(t *testing.T) {
+
+	if _, err := captureOutput(t, runMetrics, "--once"); err != errUsage {
+		t.Fatalf("got %v without prefixes", err)
+	}
+	if _, err := captureOutput(t, runMetrics, "-i", "0s", tempDir(t)); err != errUsage {
+		t.Fatalf("got %v with no interval", err)
+	}
+}
@@ -0,0 +1,615 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// OpenAPI 3 document, only what `bhctl openapi` fills in. Field order is
+// the order of the output.
+
+type oaDocument struct {
+	OpenAPI string                             `json:"openapi" yaml:"openapi"`
+	Info    oaInfo                             `json:"info" yaml:"info"`
+	Servers []oaServer                         `json:"servers,omitempty" yaml:"servers,omitempty"`
+	Paths   map[string]map[string]*oaOperation `json:"paths" yaml:"paths"`
+}
+
+type oaInfo struct {
+	Title       string `json:"title" yaml:"title"`
+	Version     string `json:"version" yaml:"version"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+type oaServer struct {
+	URL string `json:"url" yaml:"url"`
+}
+
+type oaOperation struct {
+	Summary     string                 `json:"summary,omitempty" yaml:"summary,omitempty"`
+	Parameters  []oaParameter          `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+	RequestBody *oaBody                `json:"requestBody,omitempty" yaml:"requestBody,omitempty"`
+	Responses   map[string]*oaResponse `json:"responses" yaml:"responses"`
+}
+
+type oaParameter struct {
+	Name     string    `json:"name" yaml:"name"`
+	In       string    `json:"in" yaml:"in"`
+	Required bool      `json:"required" yaml:"required"`
+	Schema   *oaSchema `json:"schema" yaml:"schema"`
+	Example  string    `json:"example,omitempty" yaml:"example,omitempty"`
+}
+
+type oaBody struct {
+	Content map[string]oaMedia `json:"content" yaml:"content"`
+}
+
+type oaMedia struct {
+	Schema *oaSchema `json:"schema" yaml:"schema"`
+}
+
+type oaResponse struct {
+	Description string             `json:"description" yaml:"description"`
+	Content     map[string]oaMedia `json:"content,omitempty" yaml:"content,omitempty"`
+}
+
+type oaSchema struct {
+	Type       string               `json:"type,omitempty" yaml:"type,omitempty"`
+	Format     string               `json:"format,omitempty" yaml:"format,omitempty"`
+	Nullable   bool                 `json:"nullable,omitempty" yaml:"nullable,omitempty"`
+	Properties map[string]*oaSchema `json:"properties,omitempty" yaml:"properties,omitempty"`
+	Required   []string             `json:"required,omitempty" yaml:"required,omitempty"`
+	Items      *oaSchema            `json:"items,omitempty" yaml:"items,omitempty"`
+}
+
+// schemaNode accumulates JSON values seen at one place in bodies
+type schemaNode struct {
+	types     map[string]bool // JSON types: object, array, string, number, integer, boolean, null
+	props     map[string]*schemaNode
+	propCount map[string]int // in how many of the objects each property was present
+	objects   int
+	items     *schemaNode
+}
+
+func newSchemaNode() *schemaNode {
+	return &schemaNode{types: make(map[string]bool)}
+}
+
+func (sn *schemaNode) add(v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		sn.types["null"] = true
+	case bool:
+		sn.types["boolean"] = true
+	case string:
+		sn.types["string"] = true
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			sn.types["integer"] = true
+		} else {
+			sn.types["number"] = true
+		}
+	case []interface{}:
+		sn.types["array"] = true
+		if sn.items == nil {
+			sn.items = newSchemaNode()
+		}
+		for _, item := range v {
+			sn.items.add(item)
+		}
+	case map[string]interface{}:
+		sn.types["object"] = true
+		sn.objects++
+		if sn.props == nil {
+			sn.props = make(map[string]*schemaNode)
+			sn.propCount = make(map[string]int)
+		}
+		for key, value := range v {
+			p, ok := sn.props[key]
+			if !ok {
+				p = newSchemaNode()
+				sn.props[key] = p
+			}
+			p.add(value)
+			sn.propCount[key]++
+		}
+	}
+}
+
+// schema returns the OpenAPI schema of everything seen. Properties present
+// in every sampled object are required. Mixed types leave the type out.
+func (sn *schemaNode) schema() *oaSchema {
+
+	s := &oaSchema{Nullable: sn.types["null"]}
+	types := make([]string, 0, len(sn.types))
+	for t := range sn.types {
+		if t != "null" {
+			types = append(types, t)
+		}
+	}
+	if len(types) == 2 && sn.types["integer"] && sn.types["number"] {
+		types = []string{"number"}
+	}
+	if len(types) != 1 {
+		return s
+	}
+	s.Type = types[0]
+	switch s.Type {
+	case "object":
+		s.Properties = make(map[string]*oaSchema, len(sn.props))
+		for key, p := range sn.props {
+			s.Properties[key] = p.schema()
+			if sn.propCount[key] == sn.objects {
+				s.Required = append(s.Required, key)
+			}
+		}
+		sort.Strings(s.Required)
+	case "array":
+		if sn.items != nil {
+			s.Items = sn.items.schema()
+		} else {
+			s.Items = &oaSchema{}
+		}
+	}
+	return s
+}
+
+// paramStats is what was seen of a query parameter
+type paramStats struct {
+	count   int
+	example string
+	allInt  bool
+}
+
+// bodyStats are bodies of one content type, sampled
+type bodyStats struct {
+	json    *schemaNode // nil if bodies are not JSON
+	form    map[string]bool
+	sampled int
+}
+
+// opStats accumulates requests of one method on one path template
+type opStats struct {
+	count     int
+	example   string // first concrete path
+	query     map[string]*paramStats
+	bodies    map[string]*bodyStats // by content type (request)
+	responses map[int]map[string]*bodyStats
+}
+
+func newOpStats() *opStats {
+	return &opStats{
+		query:     make(map[string]*paramStats),
+		bodies:    make(map[string]*bodyStats),
+		responses: make(map[int]map[string]*bodyStats),
+	}
+}
+
+// mediaType returns the media type of a Content-Type header, defaulting
+// to what the body looks like
+func mediaType(contentType string, body []byte) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if contentType != "" {
+		return contentType
+	}
+	if b := bytes.TrimSpace(body); len(b) > 0 && (b[0] == '{' || b[0] == '[') && json.Valid(b) {
+		return "application/json"
+	}
+	return "application/octet-stream"
+}
+
+// sampleBody adds a body to `stats` unless `maxSamples` were already seen
+func sampleBody(stats map[string]*bodyStats, contentType string, body []byte, maxSamples int) {
+
+	mt := mediaType(contentType, body)
+	bs, ok := stats[mt]
+	if !ok {
+		bs = &bodyStats{}
+		stats[mt] = bs
+	}
+	if bs.sampled >= maxSamples {
+		return
+	}
+	bs.sampled++
+	switch {
+	case strings.Contains(mt, "json"):
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var v interface{}
+		if dec.Decode(&v) == nil {
+			if bs.json == nil {
+				bs.json = newSchemaNode()
+			}
+			bs.json.add(v)
+		}
+	case mt == "application/x-www-form-urlencoded":
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			if bs.form == nil {
+				bs.form = make(map[string]bool)
+			}
+			for key := range values {
+				bs.form[key] = true
+			}
+		}
+	}
+}
+
+func (bs *bodyStats) schema(mediaType string) *oaSchema {
+	switch {
+	case bs.json != nil:
+		return bs.json.schema()
+	case bs.form != nil:
+		s := &oaSchema{Type: "object", Properties: make(map[string]*oaSchema)}
+		for key := range bs.form {
+			s.Properties[key] = &oaSchema{Type: "string"}
+		}
+		return s
+	case strings.HasPrefix(mediaType, "text/"):
+		return &oaSchema{Type: "string"}
+	}
+	return &oaSchema{Type: "string", Format: "binary"}
+}
+
+func bodyContent(stats map[string]*bodyStats) map[string]oaMedia {
+	content := make(map[string]oaMedia, len(stats))
+	for mt, bs := range stats {
+		content[mt] = oaMedia{Schema: bs.schema(mt)}
+	}
+	return content
+}
+
+// Path segments that are obviously values, not names. Tokens with digits
+// must be long, so that /v1/ or /ipv4/ stay literal.
+var (
+	numericSegment = regexp.MustCompile(`^\d+$`)
+	uuidSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegment     = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	tokenSegment   = regexp.MustCompile(`^[A-Za-z0-9_-]{20,}$`)
+)
+
+func isIDSegment(seg string) bool {
+	return numericSegment.MatchString(seg) || uuidSegment.MatchString(seg) || hexSegment.MatchString(seg) ||
+		(tokenSegment.MatchString(seg) && strings.ContainsAny(seg, "0123456789"))
+}
+
+// paramSegment is the placeholder of a path parameter in the trie
+const paramSegment = "{}"
+
+// pathNode is a node of the trie of path segments
+type pathNode struct {
+	children map[string]*pathNode
+	ops      map[string]*opStats // requests ending here, by method
+}
+
+func newPathNode() *pathNode {
+	return &pathNode{children: make(map[string]*pathNode), ops: make(map[string]*opStats)}
+}
+
+// merge moves everything of `other` into `pn`
+func (pn *pathNode) merge(other *pathNode) {
+	for seg, child := range other.children {
+		if mine, ok := pn.children[seg]; ok {
+			mine.merge(child)
+		} else {
+			pn.children[seg] = child
+		}
+	}
+	for method, op := range other.ops {
+		mine, ok := pn.ops[method]
+		if !ok {
+			pn.ops[method] = op
+			continue
+		}
+		mine.count += op.count
+		for name, ps := range op.query {
+			if m, ok := mine.query[name]; ok {
+				m.count += ps.count
+				m.allInt = m.allInt && ps.allInt
+			} else {
+				mine.query[name] = ps
+			}
+		}
+		for mt, bs := range op.bodies {
+			if _, ok := mine.bodies[mt]; !ok {
+				mine.bodies[mt] = bs
+			}
+		}
+		for status, stats := range op.responses {
+			if _, ok := mine.responses[status]; !ok {
+				mine.responses[status] = stats
+			}
+		}
+	}
+}
+
+// collapse turns segments with more than `maxLiteral` distinct values under
+// the same parent into a parameter
+func (pn *pathNode) collapse(maxLiteral int) {
+	literals := 0
+	for seg := range pn.children {
+		if seg != paramSegment {
+			literals++
+		}
+	}
+	if literals > maxLiteral {
+		param, ok := pn.children[paramSegment]
+		if !ok {
+			param = newPathNode()
+			pn.children[paramSegment] = param
+		}
+		for seg, child := range pn.children {
+			if seg != paramSegment {
+				param.merge(child)
+				delete(pn.children, seg)
+			}
+		}
+	}
+	for _, child := range pn.children {
+		child.collapse(maxLiteral)
+	}
+}
+
+// openAPIBuilder collects requests into a trie and writes the document
+type openAPIBuilder struct {
+	root       *pathNode
+	hosts      map[string]int
+	samples    int
+	requests   int
+	maxLiteral int
+}
+
+func (ob *openAPIBuilder) add(req *fbr.Request) {
+
+	ob.requests++
+	u, err := url.ParseRequestURI(string(req.Uri()))
+	if err != nil {
+		return
+	}
+	headers := request.SplitHeaders(req.Headers())
+	if host := request.HeaderValue(headers, "Host"); host != "" {
+		ob.hosts[host]++
+	}
+
+	node := ob.root
+	for _, seg := range strings.Split(strings.Trim(u.Path, "/"), "/") {
+		if seg == "" {
+			continue
+		}
+		if isIDSegment(seg) {
+			seg = paramSegment
+		}
+		child, ok := node.children[seg]
+		if !ok {
+			child = newPathNode()
+			node.children[seg] = child
+		}
+		node = child
+	}
+
+	method := strings.ToLower(string(req.Method()))
+	op, ok := node.ops[method]
+	if !ok {
+		op = newOpStats()
+		op.example = u.Path
+		node.ops[method] = op
+	}
+	op.count++
+	for name, values := range u.Query() {
+		ps, ok := op.query[name]
+		if !ok {
+			ps = &paramStats{example: values[0], allInt: true}
+			op.query[name] = ps
+		}
+		ps.count++
+		if _, err := strconv.ParseInt(values[0], 10, 64); err != nil {
+			ps.allInt = false
+		}
+	}
+	if body := req.BodyBytes(); len(body) > 0 {
+		sampleBody(op.bodies, request.HeaderValue(headers, "Content-Type"), body, ob.samples)
+	}
+	if status := int(req.Status()); status != 0 {
+		stats, ok := op.responses[status]
+		if !ok {
+			stats = make(map[string]*bodyStats)
+			op.responses[status] = stats
+		}
+		if body := req.ResponseBodyBytes(); len(body) > 0 {
+			respHeaders := request.SplitHeaders(req.ResponseHeaders())
+			sampleBody(stats, request.HeaderValue(respHeaders, "Content-Type"), body, ob.samples)
+		}
+	}
+}
+
+// paramName names a path parameter after the segment before it:
+// /users/{userId}, otherwise {param1}, {param2}...
+func paramName(prev string, taken map[string]bool) string {
+	name := ""
+	if prev != "" && !strings.HasPrefix(prev, "{") {
+		name = strings.TrimSuffix(prev, "s") + "Id"
+	}
+	for i := 1; name == "" || taken[name]; i++ {
+		name = "param" + strconv.Itoa(i)
+	}
+	taken[name] = true
+	return name
+}
+
+// operations walks the trie and fills in `paths`
+func (ob *openAPIBuilder) operations(node *pathNode, segs []string, params []string, paths map[string]map[string]*oaOperation) {
+
+	if len(node.ops) > 0 {
+		path := "/" + strings.Join(segs, "/")
+		ops := make(map[string]*oaOperation, len(node.ops))
+		for method, st := range node.ops {
+			op := &oaOperation{
+				Summary:   fmt.Sprintf("%d requests, e.g. %s", st.count, st.example),
+				Responses: make(map[string]*oaResponse),
+			}
+			for _, name := range params {
+				op.Parameters = append(op.Parameters, oaParameter{
+					Name: name, In: "path", Required: true, Schema: &oaSchema{Type: "string"}})
+			}
+			names := make([]string, 0, len(st.query))
+			for name := range st.query {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				ps := st.query[name]
+				schema := &oaSchema{Type: "string"}
+				if ps.allInt {
+					schema.Type = "integer"
+				}
+				op.Parameters = append(op.Parameters, oaParameter{
+					Name: name, In: "query", Required: ps.count == st.count, Schema: schema, Example: ps.example})
+			}
+			if len(st.bodies) > 0 {
+				op.RequestBody = &oaBody{Content: bodyContent(st.bodies)}
+			}
+			for status, stats := range st.responses {
+				resp := &oaResponse{Description: "Observed response"}
+				if len(stats) > 0 {
+					resp.Content = bodyContent(stats)
+				}
+				op.Responses[strconv.Itoa(status)] = resp
+			}
+			if len(op.Responses) == 0 { // responses were not recorded
+				op.Responses["default"] = &oaResponse{Description: "Not recorded"}
+			}
+			ops[method] = op
+		}
+		paths[path] = ops
+	}
+
+	taken := make(map[string]bool, len(params))
+	for _, p := range params {
+		taken[p] = true
+	}
+	for seg, child := range node.children {
+		childParams := params
+		if seg == paramSegment {
+			prev := ""
+			if len(segs) > 0 {
+				prev = segs[len(segs)-1]
+			}
+			name := paramName(prev, taken)
+			delete(taken, name) // siblings may use the same name
+			seg = "{" + name + "}"
+			childParams = append(append([]string(nil), params...), name)
+		}
+		ob.operations(child, append(append([]string(nil), segs...), seg), childParams, paths)
+	}
+}
+
+func (ob *openAPIBuilder) document(title string) *oaDocument {
+
+	ob.root.collapse(ob.maxLiteral)
+	doc := &oaDocument{
+		OpenAPI: "3.0.3",
+		Info: oaInfo{
+			Title:       title,
+			Version:     "0.0.0",
+			Description: fmt.Sprintf("Draft inferred by bhctl openapi from %d captured requests", ob.requests),
+		},
+		Paths: make(map[string]map[string]*oaOperation),
+	}
+	best := ""
+	for host, n := range ob.hosts {
+		if best == "" || n > ob.hosts[best] || (n == ob.hosts[best] && host < best) {
+			best = host
+		}
+	}
+	if best != "" {
+		doc.Servers = []oaServer{{URL: "http://" + best}}
+	}
+	ob.operations(ob.root, nil, nil, doc.Paths)
+	return doc
+}
+
+// runOpenAPI infers a draft OpenAPI 3 spec from captured requests
+func runOpenAPI(args []string) (err error) {
+
+	fs := newFlagSet("openapi", "<archive-url>...")
+	title := fs.String("title", "Inferred API", "Title of the spec")
+	format := fs.StringP("format", "f", "yaml", "Output format: yaml or json")
+	output := fs.StringP("output", "o", "-", "File to write the spec to (- for stdout)")
+	samples := fs.IntP("samples", "s", 20, "Bodies sampled per operation and content type to infer schemas")
+	maxLiteral := fs.Int("max-literal", 50,
+		"Distinct values of a path segment above which it becomes a parameter")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if (*format != "yaml" && *format != "json") || *maxLiteral <= 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	ob := &openAPIBuilder{
+		root:       newPathNode(),
+		hosts:      make(map[string]int),
+		samples:    *samples,
+		maxLiteral: *maxLiteral,
+	}
+	for _, fileName := range fs.Args() {
+		err = forEachRequest(fileName, func(req *fbr.Request, offset int64) error {
+			ob.add(req)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	doc := ob.document(*title)
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		fp, err := os.Create(*output)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to create %s", *output)
+		}
+		defer fp.Close()
+		out = fp
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(doc)
+	}
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return errors.Wrap(err, "Unable to encode spec")
+	}
+	_, err = out.Write(data)
+	return err
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/request"
+	"gopkg.in/yaml.v2"
+)
+
+// schemaJSON is a schema as JSON, for comparisons
+func schemaJSON(t *testing.T, s *oaSchema) string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSchemaNode(t *testing.T) {
+
+	sn := newSchemaNode()
+	for _, body := range []string{
+		`{"id": 1, "price": 2, "name": "a", "tags": ["x"], "any": 1, "empty": []}`,
+		`{"id": 2, "price": 2.5, "name": null, "tags": [], "any": "1", "empty": []}`,
+		`{"id": 3, "note": "n", "tags": ["y", "z"], "empty": []}`,
+	} {
+		sn.add(mustDecode(t, body))
+	}
+	want := `{"type":"object","properties":{"any":{},"empty":{"type":"array","items":{}},"id":{"type":"integer"},` +
+		`"name":{"type":"string","nullable":true},"note":{"type":"string"},"price":{"type":"number"},` +
+		`"tags":{"type":"array","items":{"type":"string"}}},"required":["empty","id","tags"]}`
+	if got := schemaJSON(t, sn.schema()); got != want {
+		t.Fatalf("got %s", got)
+	}
+}
+
+// mustDecode decodes JSON the way bodies are sampled
+func mustDecode(t *testing.T, s string) interface{} {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestSampleBody(t *testing.T) {
+
+	stats := map[string]*bodyStats{}
+	sampleBody(stats, "application/json; charset=utf-8", []byte(`{"a": 1}`), 1)
+	sampleBody(stats, "Application/JSON", []byte(`{"b": 1}`), 1) // over maxSamples
+	sampleBody(stats, "application/x-www-form-urlencoded", []byte("c=1&d=2&c=3"), 1)
+	sampleBody(stats, "", []byte("{not json"), 1)
+	sampleBody(stats, "text/plain", []byte("hi"), 1)
+	got := map[string]string{}
+	for mt, media := range bodyContent(stats) {
+		got[mt] = schemaJSON(t, media.Schema)
+	}
+	want := map[string]string{
+		"application/json":                  `{"type":"object","properties":{"a":{"type":"integer"}},"required":["a"]}`,
+		"application/x-www-form-urlencoded": `{"type":"object","properties":{"c":{"type":"string"},"d":{"type":"string"}}}`,
+		"application/octet-stream":          `{"type":"string","format":"binary"}`,
+		"text/plain":                        `{"type":"string"}`,
+	}
+	if stats["application/json"].sampled != 1 || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q", got)
+	}
+	// Bodies without a content type are JSON if they look like it
+	if mt := mediaType("", []byte(` [1, 2] `)); mt != "application/json" {
+		t.Fatalf("got %s", mt)
+	}
+}
+
+func TestIsIDSegment(t *testing.T) {
+
+	tests := map[string]bool{
+		"42":                                   true,
+		"3f2504e0-4f89-41d3-9a0c-0305e82c3301": true,
+		"deadbeefdeadbeef":                     true,
+		"abcdefghij0123456789":                 true,
+		"users":                                false,
+		"v1":                                   false,
+		"ipv4":                                 false,
+		"deadbeef":                             false,
+		"abcdefghijklmnopqrstuvwxyz":           false,
+		"abc.def0123456789012345":              false,
+	}
+	for seg, want := range tests {
+		if got := isIDSegment(seg); got != want {
+			t.Fatalf("%s: got %v", seg, got)
+		}
+	}
+}
+
+func TestParamName(t *testing.T) {
+
+	taken := map[string]bool{}
+	for _, tt := range []struct{ prev, want string }{
+		{"users", "userId"},
+		{"users", "param1"},
+		{"{userId}", "param2"},
+		{"", "param3"},
+	} {
+		if got := paramName(tt.prev, taken); got != tt.want {
+			t.Fatalf("%s: got %s, want %s", tt.prev, got, tt.want)
+		}
+	}
+}
+
+// Segments with too many values become parameters, what was seen of them merged
+func TestPathNodeCollapse(t *testing.T) {
+
+	ob := &openAPIBuilder{root: newPathNode(), hosts: map[string]int{}, samples: 10, maxLiteral: 2}
+	for _, uri := range []string{"/files/a/meta?x=1", "/files/b/meta?x=2&y=1", "/files/c", "/v1/health", "/v1/ready"} {
+		mr := testRequest(0, "GET", uri, "", "")
+		umr := mr.Unmarshalled()
+		ob.add(umr.Request())
+		umr.Release()
+	}
+	doc := ob.document("t")
+	var paths []string
+	for path := range doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	if strings.Join(paths, " ") != "/files/{fileId} /files/{fileId}/meta /v1/health /v1/ready" {
+		t.Fatalf("got %q", paths)
+	}
+	op := doc.Paths["/files/{fileId}/meta"]["get"]
+	if !strings.HasPrefix(op.Summary, "2 requests, e.g. /files/") || len(op.Parameters) != 3 ||
+		op.Parameters[0].Name != "fileId" || op.Parameters[0].In != "path" ||
+		op.Parameters[1].Name != "x" || !op.Parameters[1].Required || op.Parameters[1].Schema.Type != "integer" ||
+		op.Parameters[2].Name != "y" || op.Parameters[2].Required {
+		t.Fatalf("got %+v", op)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+
+	dir := tempDir(t)
+	fileName := writeArchive(t, dir, false,
+		testRequest(0, "GET", "/users/42/orders/7", "Host: a.example.com\r\n\r\n", ""),
+		testRequest(1, "GET", "/users/43/orders/8?expand=1", "Host: a.example.com\r\n\r\n", ""),
+		testRequest(2, "GET", "/search?q=x&n=1", "Host: a.example.com\r\n\r\n", ""),
+		testRequest(3, "GET", "/search?q=y&n=z", "Host: b.example.com\r\n\r\n", ""),
+		request.CreateExchangeAt(testTime, []byte("id-4"), []byte("POST"), []byte("/items"),
+			[]byte("Host: b.example.com\r\nContent-Type: application/json\r\n\r\n"), []byte(`{"id": 1, "name": "a"}`),
+			&request.Response{Status: 201, Headers: []byte("Content-Type: application/json\r\n\r\n"),
+				Body: []byte(`{"id": 1}`), Duration: time.Millisecond}),
+		testRequest(5, "POST", "/items", "Content-Type: application/json\r\n\r\n", `{"id": 2.5}`))
+	output := filepath.Join(dir, "spec.json")
+	if _, err := captureOutput(t, runOpenAPI, "-f", "json", "--title", "Test", "-o", output, fileName); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc oaDocument
+	if err = json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != "3.0.3" || doc.Info.Title != "Test" ||
+		doc.Info.Description != "Draft inferred by bhctl openapi from 6 captured requests" ||
+		len(doc.Servers) != 1 || doc.Servers[0].URL != "http://a.example.com" || len(doc.Paths) != 3 {
+		t.Fatalf("got %s", data)
+	}
+
+	users := doc.Paths["/users/{userId}/orders/{orderId}"]["get"]
+	if users == nil || users.Summary != "2 requests, e.g. /users/42/orders/7" || len(users.Parameters) != 3 ||
+		users.Parameters[0].Name != "userId" || users.Parameters[1].Name != "orderId" ||
+		users.Parameters[2] != (oaParameter{Name: "expand", In: "query", Schema: users.Parameters[2].Schema, Example: "1"}) ||
+		users.Responses["default"] == nil {
+		t.Fatalf("got %s", data)
+	}
+	search := doc.Paths["/search"]["get"]
+	if search == nil || len(search.Parameters) != 2 ||
+		search.Parameters[0].Name != "n" || search.Parameters[0].Schema.Type != "string" || !search.Parameters[0].Required ||
+		search.Parameters[1].Name != "q" || search.Parameters[1].Example != "x" {
+		t.Fatalf("got %s", data)
+	}
+	items := doc.Paths["/items"]["post"]
+	if items == nil || items.RequestBody == nil || items.Responses["201"] == nil || len(items.Responses) != 1 {
+		t.Fatalf("got %s", data)
+	}
+	if got := schemaJSON(t, items.RequestBody.Content["application/json"].Schema); got !=
+		`{"type":"object","properties":{"id":{"type":"number"},"name":{"type":"string"}},"required":["id"]}` {
+		t.Fatalf("got %s", got)
+	}
+	if got := schemaJSON(t, items.Responses["201"].Content["application/json"].Schema); got !=
+		`{"type":"object","properties":{"id":{"type":"integer"}},"required":["id"]}` {
+		t.Fatalf("got %s", got)
+	}
+
+	// The same document as YAML
+	out, err := captureOutput(t, runOpenAPI, "--title", "Test", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var yamlDoc oaDocument
+	if err = yaml.Unmarshal([]byte(out), &yamlDoc); err != nil || !reflect.DeepEqual(yamlDoc, doc) {
+		t.Fatalf("got %s, %v", out, err)
+	}
+}
+
+func TestOpenAPIErrors(t *testing.T) {
+
+	dir := tempDir(t)
+	for _, args := range [][]string{
+		{"-f", "xml", "requests.fbf"},
+		{"--max-literal", "0", "requests.fbf"},
+	} {
+		if _, err := captureOutput(t, runOpenAPI, args...); err != errUsage {
+			t.Fatalf("%q: got %v", args, err)
+		}
+	}
+	if _, err := captureOutput(t, runOpenAPI, filepath.Join(dir, "missing.fbf")); err == nil {
+		t.Fatal("no error for a missing archive")
+	}
+}
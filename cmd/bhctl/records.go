@@ -0,0 +1,60 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+)
+
+// forEachRequest calls fn for every request in an archive, with the byte offset
+// of its frame in the uncompressed stream. `req` is only valid during the call.
+func forEachRequest(fileName string, fn func(req *fbr.Request, offset int64) error) (err error) {
+
+	const archiveFileReadBufSize = 65536 // 64 K
+
+	rf, err := archive.OpenArchive(fileName, archiveFileReadBufSize)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to open archive file: %s", fileName)
+	}
+	defer rf.Close()
+
+	cr := &countingReader{r: rf}
+	for {
+		offset := cr.n
+		umr, err := request.GetNextFrame(cr, false)
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil && !umr.IsHeader() {
+			err = umr.VerifyCRC()
+		}
+		if err != nil {
+			if umr != nil {
+				umr.Release()
+			}
+			return errors.Wrapf(err, "corrupted archive %s at byte offset %d", fileName, offset)
+		}
+		if !umr.IsHeader() {
+			err = fn(umr.Request(), offset)
+		}
+		umr.Release()
+		if err != nil {
+			return err
+		}
+	}
+}
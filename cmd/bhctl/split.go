@@ -0,0 +1,170 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+)
+
+// manifestChunk describes one file written by `bhctl split`
+type manifestChunk struct {
+	File     string `json:"file"`
+	Records  int64  `json:"records"`
+	Bytes    int64  `json:"bytes"`    // uncompressed
+	Checksum string `json:"checksum"` // xxhash of the uncompressed stream
+}
+
+// manifest is written next to the chunks by `bhctl split`
+type manifest struct {
+	Source          string          `json:"source"`
+	Created         time.Time       `json:"created"`
+	RecordsPerChunk int64           `json:"records_per_chunk"`
+	Records         int64           `json:"records"`
+	Chunks          []manifestChunk `json:"chunks"`
+}
+
+// manifestSuffix is appended to the base name of the source archive
+const manifestSuffix = ".manifest.json"
+
+// runSplit splits an archive into chunks of N records each
+func runSplit(args []string) (err error) {
+
+	fs := newFlagSet("split", "<archive-url>")
+	records := fs.Int64P("records", "r", 100000, "Number of records per chunk")
+	outDir := fs.StringP("output-dir", "o", ".", "Directory (or s3/az/adls/gs/sftp/hdfs URL) to write chunks and manifest to")
+	codec := fs.StringP("codec", "c", "lz4", "Compression of the chunks: lz4 or none")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *records <= 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	const archiveFileReadBufSize = 65536 // 64 K
+
+	fileName := fs.Arg(0)
+	rf, err := archive.OpenArchive(fileName, archiveFileReadBufSize)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to open archive file: %s", fileName)
+	}
+	defer rf.Close()
+
+	base := baseName(fileName)
+	man := manifest{Source: fileName, Created: time.Now().UTC(), RecordsPerChunk: *records}
+
+	var header *request.UnmarshalledRequest // copied to the start of every chunk
+	defer func() {
+		if header != nil {
+			header.Release()
+		}
+	}()
+
+	var ow *outputWriter
+	defer func() {
+		if ow != nil {
+			ow.Abort()
+		}
+	}()
+
+	closeChunk := func() error {
+		err := ow.Close()
+		if err != nil {
+			return err
+		}
+		man.Chunks = append(man.Chunks, manifestChunk{
+			File: ow.Name(), Records: ow.Records, Bytes: ow.Bytes, Checksum: ow.Checksum()})
+		man.Records += ow.Records
+		fmt.Printf("%s\t%d records\n", ow.Name(), ow.Records)
+		ow = nil
+		return nil
+	}
+
+	for {
+		umr, err := request.GetNextFrame(rf, false)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "corrupted archive after %d records", man.Records)
+		}
+		if umr.IsHeader() {
+			if header == nil {
+				header = umr
+			} else {
+				umr.Release()
+			}
+			continue
+		}
+
+		if ow == nil {
+			name := fmt.Sprintf("%s.part%05d.fbf", base, len(man.Chunks)+1)
+			ow, err = newOutputWriter(*outDir, name, *codec)
+			if err != nil {
+				umr.Release()
+				return err
+			}
+			if header != nil {
+				err = ow.writeFrame(header)
+			}
+		}
+		if err == nil {
+			err = ow.writeFrame(umr)
+		}
+		umr.Release()
+		if err != nil {
+			return errors.Wrapf(err, "unable to write %s", ow.Name())
+		}
+
+		if ow.Records >= *records {
+			err = closeChunk()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if ow != nil {
+		err = closeChunk()
+		if err != nil {
+			return err
+		}
+	}
+
+	buf, err := json.MarshalIndent(man, "", "  ")
+	if err != nil {
+		return err
+	}
+	mw, err := newOutputWriter(*outDir, base+manifestSuffix, "none")
+	if err != nil {
+		return err
+	}
+	_, err = mw.Write(append(buf, '\n'))
+	if err != nil {
+		mw.Abort()
+		return errors.Wrap(err, "unable to write manifest")
+	}
+	err = mw.Close()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\t%d chunks, %d records\n", mw.Name(), len(man.Chunks), man.Records)
+	return nil
+}
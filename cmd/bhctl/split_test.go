@@ -0,0 +1,97 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBaseName(t *testing.T) {
+
+	tests := map[string]string{
+		"requests_1.fbf":          "requests_1",
+		"dir/requests_1.fbf.lz4":  "requests_1",
+		"requests_1.fbf.zst.tmp":  "requests_1",
+		"s3://bucket/x/a.part1.z": "a.part1.z",
+	}
+	for fileName, want := range tests {
+		if got := baseName(fileName); got != want {
+			t.Fatalf("%s: got %s, want %s", fileName, got, want)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+
+	fileName := writeArchive(t, tempDir(t), false,
+		testRequest(0, "GET", "/0", "", ""), testRequest(1, "GET", "/1", "", ""), testRequest(2, "GET", "/2", "", ""),
+		testRequest(3, "GET", "/3", "", ""), testRequest(4, "GET", "/4", "", ""))
+	outDir := tempDir(t)
+	out, err := captureOutput(t, runSplit, "-r", "2", "-o", outDir, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := baseName(fileName)
+	if want := fmt.Sprintf("%[1]s.part00001.fbf.lz4\t2 records\n%[1]s.part00002.fbf.lz4\t2 records\n"+
+		"%[1]s.part00003.fbf.lz4\t1 records\n%[1]s.manifest.json\t3 chunks, 5 records\n", base); out != want {
+		t.Fatalf("got %q, want %q", out, want)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(outDir, base+manifestSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var man manifest
+	if err = json.Unmarshal(data, &man); err != nil {
+		t.Fatal(err)
+	}
+	if man.Source != fileName || man.RecordsPerChunk != 2 || man.Records != 5 || len(man.Chunks) != 3 {
+		t.Fatalf("got manifest %+v", man)
+	}
+
+	// Every chunk starts with the header of the source
+	var reqs []string
+	for _, chunk := range man.Chunks {
+		chunkFile := filepath.Join(outDir, chunk.File)
+		st, err := scanArchive(chunkFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.header == nil || st.records != chunk.Records || st.streamBytes != chunk.Bytes || chunk.Checksum == "" {
+			t.Fatalf("chunk %+v: got %+v", chunk, st)
+		}
+		reqs = append(reqs, readURIs(t, chunkFile)...)
+	}
+	if strings.Join(reqs, " ") != "/0 /1 /2 /3 /4" {
+		t.Fatalf("got requests %q", reqs)
+	}
+}
+
+func TestSplitErrors(t *testing.T) {
+
+	fileName := writeArchive(t, tempDir(t), false, testRequest(0, "GET", "/0", "", ""))
+	if _, err := captureOutput(t, runSplit, "-r", "0", fileName); err != errUsage {
+		t.Fatalf("got %v with no records per chunk", err)
+	}
+	if _, err := captureOutput(t, runSplit, "-c", "brotli", "-o", tempDir(t), fileName); err == nil {
+		t.Fatal("no error with an unknown codec")
+	}
+	if _, err := captureOutput(t, runSplit, "-o", tempDir(t), fileName+".missing"); err == nil {
+		t.Fatal("no error for a missing archive")
+	}
+}
@@ -0,0 +1,254 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+)
+
+// tailPollInterval is how often we look for new data and new files
+const tailPollInterval = 500 * time.Millisecond
+
+// followReader reads a file that is still being written. At end of file it
+// waits for more data instead of returning io.EOF, until the writer renames
+// the .tmp file to its final name (or deletes it).
+//
+// This is the same idea as `waitForData` in request.ReadFull, but done below
+// the decompressor: an lz4 reader that sees EOF in the middle of a block can't
+// recover, while this way it never sees EOF until the file is complete.
+type followReader struct {
+	fp      *os.File
+	tmpPath string
+	idle    func() // called once, the first time we catch up with the writer
+}
+
+func (fr *followReader) Read(p []byte) (n int, err error) {
+	for {
+		n, err = fr.fp.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		if fr.idle != nil {
+			fr.idle()
+			fr.idle = nil
+		}
+		if _, err := os.Stat(fr.tmpPath); os.IsNotExist(err) {
+			return fr.fp.Read(p) // finalized: whatever is left is all there is
+		}
+		time.Sleep(tailPollInterval)
+	}
+}
+
+// tailPrinter prints summary lines. Until `live` is set, only the last `keep`
+// lines are kept (like tail -n) and printed when the reader catches up.
+type tailPrinter struct {
+	mu     *sync.Mutex // shared by all files being followed
+	prefix string
+	keep   int
+	lines  []string
+	live   bool
+}
+
+func (tp *tailPrinter) add(req *fbr.Request) {
+	ts := ""
+	if t := recordTime(req); !t.IsZero() {
+		ts = t.UTC().Format("2006-01-02T15:04:05.000Z") + " "
+	}
+	line := fmt.Sprintf("%s%s%s %s %s %s", tp.prefix, ts, req.Id(), req.Method(), req.Uri(), humanBytes(int64(req.BodyLength())))
+	if !tp.live {
+		tp.lines = append(tp.lines, line)
+		if len(tp.lines) > tp.keep {
+			tp.lines = tp.lines[1:]
+		}
+		return
+	}
+	tp.mu.Lock()
+	fmt.Println(line)
+	tp.mu.Unlock()
+}
+
+// goLive prints what was kept so far and switches to printing right away
+func (tp *tailPrinter) goLive() {
+	tp.mu.Lock()
+	for _, line := range tp.lines {
+		fmt.Println(line)
+	}
+	tp.mu.Unlock()
+	tp.lines = nil
+	tp.live = true
+}
+
+// tailFile prints summaries of requests in a local archive. Files still being
+// written (.tmp) are followed until they are finalized if `follow` is set.
+func tailFile(fileName string, follow bool, tp *tailPrinter) (err error) {
+
+	fp, err := os.Open(strings.TrimPrefix(fileName, "file://"))
+	if err != nil {
+		return errors.Wrapf(err, "Unable to open %s", fileName)
+	}
+	defer fp.Close()
+
+	var stream io.Reader = fp
+	following := follow && strings.HasSuffix(fileName, ".tmp")
+	if following {
+		stream = &followReader{fp: fp, tmpPath: fp.Name(), idle: tp.goLive}
+	} else {
+		dataLen, err := common.VerifyFooter(fp)
+		if err != nil {
+			return err
+		}
+		stream = io.LimitReader(fp, dataLen)
+	}
+	zr, err := common.NewDecompressor(fileName, stream)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to open %s", fileName)
+	}
+	if zr != nil {
+		defer zr.Close()
+		stream = zr
+	}
+	if !following {
+		// No buffering when following: lz4 keeps reading until the buffer
+		// given to it is full, which would hold back requests already there.
+		stream = bufio.NewReader(stream)
+	}
+
+	for {
+		umr, err := request.GetNextFrame(stream, false)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "corrupted archive %s", fileName)
+		}
+		if !umr.IsHeader() {
+			tp.add(umr.Request())
+		}
+		umr.Release()
+	}
+	if !tp.live {
+		tp.goLive()
+	}
+	return nil
+}
+
+// activeFiles lists archive files still being written in dir
+func activeFiles(dir string) (files []string, err error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".tmp") && strings.Contains(entry.Name(), ".fbf") {
+			files = append(files, path.Join(dir, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// tailDir follows every file being written in a recorder output (or staging)
+// directory, picking up new files as they get created on rotation.
+func tailDir(dir string, follow bool, keep int) (err error) {
+
+	mu := &sync.Mutex{}
+	seen := make(map[string]bool)
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, 1)
+	first := true
+
+	for {
+		files, err := activeFiles(dir)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to list %s", dir)
+		}
+		for _, fileName := range files {
+			if seen[fileName] {
+				continue
+			}
+			seen[fileName] = true
+			tp := &tailPrinter{mu: mu, keep: keep, prefix: path.Base(fileName) + " "}
+			if !first {
+				tp.live = true // created after we started: all of it is new
+			}
+			wg.Add(1)
+			go func(fileName string) {
+				defer wg.Done()
+				err := tailFile(fileName, follow, tp)
+				if err != nil && !os.IsNotExist(errors.Cause(err)) { // finalized before we got to it
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}(fileName)
+		}
+		first = false
+
+		if !follow {
+			wg.Wait()
+			break
+		}
+		select {
+		case err = <-errs:
+			return err
+		case <-time.After(tailPollInterval):
+		}
+	}
+
+	select {
+	case err = <-errs:
+	default:
+	}
+	return err
+}
+
+// runTail prints one line per request of an archive, optionally following it
+func runTail(args []string) (err error) {
+
+	fs := newFlagSet("tail", "<dir-or-archive>")
+	follow := fs.BoolP("follow", "f", false, "Keep printing requests as they are recorded")
+	keep := fs.IntP("lines", "n", 10, "Print only the last N requests already recorded")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	target := fs.Arg(0)
+	if !archive.IsLocal(target) {
+		return errors.Errorf("tail works on local files only: remote archives are uploaded once complete")
+	}
+	target = strings.TrimPrefix(target, "file://")
+
+	fi, err := os.Stat(target)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to open %s", target)
+	}
+	if fi.IsDir() {
+		return tailDir(target, *follow, *keep)
+	}
+	return tailFile(target, *follow, &tailPrinter{mu: &sync.Mutex{}, keep: *keep})
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/request"
+	"go.uber.org/zap"
+)
+
+// tailLine is what tail prints for testRequest(sec, "GET", uri, "", body)
+func tailLine(sec int, uri, size string) string {
+	return time.Unix(0, testTime+int64(sec)*1e9).UTC().Format("2006-01-02T15:04:05.000Z") +
+		fmt.Sprintf(" id-%d GET ", sec) + uri + " " + size
+}
+
+func TestTail(t *testing.T) {
+
+	fileName := writeArchive(t, tempDir(t), false,
+		testRequest(1, "GET", "/a", "", ""), testRequest(2, "GET", "/b", "", "bb"), testRequest(3, "GET", "/c", "", ""))
+	out, err := captureOutput(t, runTail, "-n", "2", fileName)
+	if err != nil || out != tailLine(2, "/b", "2B")+"\n"+tailLine(3, "/c", "0B")+"\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	if _, err = captureOutput(t, runTail, "s3://bucket/requests.fbf"); err == nil {
+		t.Fatal("no error for a remote archive")
+	}
+	if _, err = captureOutput(t, runTail, fileName+".missing"); err == nil {
+		t.Fatal("no error for a missing archive")
+	}
+}
+
+func TestActiveFiles(t *testing.T) {
+
+	dir := tempDir(t)
+	writeFiles(t, dir, map[string]string{"a.fbf.lz4.tmp": "", "b.fbf": "", "c.json.tmp": "", "d.fbf.tmp/e": ""})
+	files, err := activeFiles(dir)
+	if err != nil || len(files) != 1 || files[0] != filepath.Join(dir, "a.fbf.lz4.tmp") {
+		t.Fatalf("got %q, %v", files, err)
+	}
+}
+
+// The reader waits for more data at the end of a file still being recorded,
+// until it is finalized
+func TestFollowReader(t *testing.T) {
+
+	dir := tempDir(t)
+	rf, err := archive.NewArchive(dir, "requests", ".fbf", common.Compress(false), common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testRequest(1, "GET", "/a", "", "").SaveRequest(rf, true); err != nil {
+		t.Fatal(err)
+	}
+	files, err := activeFiles(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got %q, %v", files, err)
+	}
+	fp, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	idle := make(chan struct{})
+	fr := &followReader{fp: fp, tmpPath: fp.Name(), idle: func() { close(idle) }}
+	uris := make(chan string)
+	go func() {
+		defer close(uris)
+		for {
+			umr, err := request.GetNextFrame(fr, false)
+			if err != nil {
+				return
+			}
+			uris <- string(umr.Request().Uri())
+			umr.Release()
+		}
+	}()
+	if uri := <-uris; uri != "/a" {
+		t.Fatalf("got %s", uri)
+	}
+	<-idle
+	if err = testRequest(2, "GET", "/b", "", "").SaveRequest(rf, true); err != nil {
+		t.Fatal(err)
+	}
+	if uri := <-uris; uri != "/b" {
+		t.Fatalf("got %s", uri)
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if uri, ok := <-uris; ok {
+		t.Fatalf("got %s after the file was finalized", uri)
+	}
+}
+
+// Files being recorded in a directory are printed with their name
+func TestTailDir(t *testing.T) {
+
+	dir := tempDir(t)
+	writeArchive(t, dir, false, testRequest(1, "GET", "/done", "", ""))
+	rf, err := archive.NewArchive(dir, "requests", ".fbf",
+		common.Compress(false), common.Logger(zap.NewNop()), common.FileHeader(request.FileHeader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	if err = testRequest(2, "GET", "/a", "", "a").SaveRequest(rf, true); err != nil {
+		t.Fatal(err)
+	}
+	files, err := activeFiles(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got %q, %v", files, err)
+	}
+	out, err := captureOutput(t, runTail, dir)
+	if err != nil || out != filepath.Base(files[0])+" "+tailLine(2, "/a", "1B")+"\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/cespare/xxhash"
+	"github.com/pkg/errors"
+)
+
+// errVerifyFailed is returned once all files are checked, if any of them was bad
+var errVerifyFailed = errors.New("verification failed")
+
+// countingReader counts bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// verifyResult is what verifyArchive found
+type verifyResult struct {
+	records  int64
+	checksum string // same format as manifest checksums
+	noCRC    int64  // records written without a checksum (older archives)
+}
+
+// verifyArchive reads the whole archive and stops at the first bad frame.
+// The error says at which (uncompressed) byte offset that frame starts.
+func verifyArchive(fileName string) (res verifyResult, err error) {
+
+	const archiveFileReadBufSize = 65536 // 64 K
+
+	rf, err := archive.OpenArchive(fileName, archiveFileReadBufSize)
+	if err != nil {
+		return res, errors.Wrapf(err, "Unable to open archive file: %s", fileName)
+	}
+	defer rf.Close()
+
+	xh := xxhash.New()
+	cr := &countingReader{r: io.TeeReader(rf, xh)}
+	for {
+		offset := cr.n
+		umr, err := request.GetNextFrame(cr, false)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = umr.VerifyCRC()
+			if err == nil {
+				err = umr.Validate()
+			}
+		}
+		if err != nil {
+			if umr != nil {
+				umr.Release()
+			}
+			return res, errors.Wrapf(err, "bad frame at byte offset %d (record %d)", offset, res.records+1)
+		}
+		if !umr.IsHeader() {
+			res.records++
+			if !umr.HasCRC() {
+				res.noCRC++
+			}
+		}
+		umr.Release()
+	}
+	res.checksum = fmt.Sprintf("%0X", xh.Sum64())
+	return res, nil
+}
+
+// verifyManifest verifies every chunk listed in a `bhctl split` manifest,
+// including the record counts and checksums recorded in it.
+func verifyManifest(manifestFile string) (ok bool, err error) {
+
+	rf, err := archive.OpenArchive(manifestFile, 0)
+	if err != nil {
+		return false, errors.Wrapf(err, "Unable to open manifest: %s", manifestFile)
+	}
+	buf, err := ioutil.ReadAll(rf)
+	rf.Close()
+	if err != nil {
+		return false, errors.Wrapf(err, "Unable to read manifest: %s", manifestFile)
+	}
+	var man manifest
+	err = json.Unmarshal(buf, &man)
+	if err != nil {
+		return false, errors.Wrapf(err, "Unable to parse manifest: %s", manifestFile)
+	}
+
+	ok = true
+	dir := manifestFile[:strings.LastIndex(manifestFile, "/")+1]
+	var records int64
+	for _, chunk := range man.Chunks {
+		fileName := dir + path.Base(chunk.File)
+		res, err := verifyArchive(fileName)
+		switch {
+		case err != nil:
+			fmt.Printf("CORRUPT\t%s\t%v\n", fileName, err)
+			ok = false
+		case res.records != chunk.Records:
+			fmt.Printf("MISMATCH\t%s\t%d records, manifest says %d\n", fileName, res.records, chunk.Records)
+			ok = false
+		case res.checksum != chunk.Checksum:
+			fmt.Printf("MISMATCH\t%s\tchecksum %s, manifest says %s\n", fileName, res.checksum, chunk.Checksum)
+			ok = false
+		default:
+			fmt.Printf("OK\t%s\t%d records\n", fileName, res.records)
+		}
+		records += res.records
+	}
+	if records != man.Records {
+		fmt.Printf("MISMATCH\t%s\t%d records in chunks, manifest says %d\n", manifestFile, records, man.Records)
+		ok = false
+	}
+	return ok, nil
+}
+
+// runVerify checks archives (or manifests written by `bhctl split`)
+func runVerify(args []string) (err error) {
+
+	fs := newFlagSet("verify", "<archive-or-manifest-url>...")
+	err = parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	for _, fileName := range fs.Args() {
+		if strings.HasSuffix(fileName, manifestSuffix) {
+			ok, err := verifyManifest(fileName)
+			if err != nil {
+				return err
+			}
+			failed = failed || !ok
+			continue
+		}
+
+		res, err := verifyArchive(fileName)
+		if err != nil {
+			fmt.Printf("CORRUPT\t%s\t%v\n", fileName, err)
+			failed = true
+			continue
+		}
+		note := ""
+		if res.noCRC > 0 {
+			note = fmt.Sprintf(" (%d without checksum)", res.noCRC)
+		}
+		fmt.Printf("OK\t%s\t%d records%s\n", fileName, res.records, note)
+	}
+	if failed {
+		return errVerifyFailed
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/frame"
+)
+
+func TestVerify(t *testing.T) {
+
+	dir := tempDir(t)
+	fileName := writeArchive(t, dir, false, testRequest(1, "GET", "/a", "", "a"), testRequest(2, "GET", "/b", "", "b"))
+	out, err := captureOutput(t, runVerify, fileName)
+	if err != nil || out != "OK\t"+fileName+"\t2 records\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+
+	// A byte changed in the second record
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := testRequest(1, "GET", "/a", "", "a")
+	offset := headerLen(t, fileName) + mr.FrameSize()
+	mr.Release()
+	data[len(data)-1] ^= 1
+	corrupt := filepath.Join(dir, "corrupt.fbf")
+	if err = ioutil.WriteFile(corrupt, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = captureOutput(t, runVerify, corrupt, fileName)
+	if err != errVerifyFailed || !strings.HasPrefix(out,
+		fmt.Sprintf("CORRUPT\t%s\tbad frame at byte offset %d (record 2): ", corrupt, offset)) ||
+		!strings.HasSuffix(out, "\nOK\t"+fileName+"\t2 records\n") {
+		t.Fatalf("got %q, %v", out, err)
+	}
+
+	// Cut in the middle of a frame
+	if err = ioutil.WriteFile(corrupt, data[:len(data)-2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = captureOutput(t, runVerify, corrupt); err != errVerifyFailed || !strings.HasPrefix(out, "CORRUPT\t") {
+		t.Fatalf("got %q, %v", out, err)
+	}
+}
+
+// Archives written before frames had a checksum are fine, and counted
+func TestVerifyNoCRC(t *testing.T) {
+
+	mr := testRequest(1, "GET", "/a", "", "")
+	payload := mr.Bytes()
+	data := make([]byte, frame.PrefixLen, frame.PrefixLen+len(payload))
+	frame.PutPrefix(data, len(payload), 0)
+	data = append(data, payload...)
+	mr.Release()
+	fileName := filepath.Join(tempDir(t), "requests_1.fbf")
+	if err := ioutil.WriteFile(fileName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := captureOutput(t, runVerify, fileName)
+	if err != nil || out != "OK\t"+fileName+"\t1 records (1 without checksum)\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+}
+
+// Chunks of a split are checked against what the manifest says
+func TestVerifyManifest(t *testing.T) {
+
+	fileName := writeArchive(t, tempDir(t), false,
+		testRequest(1, "GET", "/a", "", ""), testRequest(2, "GET", "/b", "", ""), testRequest(3, "GET", "/c", "", ""))
+	outDir := tempDir(t)
+	if _, err := captureOutput(t, runSplit, "-r", "2", "-o", outDir, fileName); err != nil {
+		t.Fatal(err)
+	}
+	base := baseName(fileName)
+	manifestFile := filepath.Join(outDir, base+manifestSuffix)
+	chunk1, chunk2 := filepath.Join(outDir, base+".part00001.fbf.lz4"), filepath.Join(outDir, base+".part00002.fbf.lz4")
+	out, err := captureOutput(t, runVerify, manifestFile)
+	if err != nil || out != "OK\t"+chunk1+"\t2 records\nOK\t"+chunk2+"\t1 records\n" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+
+	data, err := ioutil.ReadFile(manifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var man manifest
+	if err = json.Unmarshal(data, &man); err != nil {
+		t.Fatal(err)
+	}
+	checksum := man.Chunks[1].Checksum
+	man.Chunks[0].Records = 3
+	man.Chunks[1].Checksum = "0"
+	if data, err = json.Marshal(man); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(manifestFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = captureOutput(t, runVerify, manifestFile)
+	if want := "MISMATCH\t" + chunk1 + "\t2 records, manifest says 3\n" +
+		"MISMATCH\t" + chunk2 + "\tchecksum " + checksum + ", manifest says 0\n"; err != errVerifyFailed || out != want {
+		t.Fatalf("got %q, %v", out, err)
+	}
+
+	if _, err = captureOutput(t, runVerify, filepath.Join(outDir, "missing"+manifestSuffix)); err == nil ||
+		err == errVerifyFailed {
+		t.Fatalf("got %v for a missing manifest", err)
+	}
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/cespare/xxhash"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/pkg/errors"
+)
+
+// codecExtensions maps codec names accepted on the command line to file extensions
+var codecExtensions = map[string]string{
+	"lz4":    ".lz4",
+	"gzip":   ".gz",
+	"zstd":   ".zst",
+	"snappy": ".sz",
+	"none":   "",
+}
+
+// outputWriter writes a single output file of a bhctl command. Files are
+// written locally with a .tmp suffix and moved into place at Close. If the
+// destination directory is remote, the file is staged in a temporary directory
+// and uploaded at Close.
+//
+// Checksum covers the bytes written to outputWriter (i.e. before compression),
+// so it is the same no matter which codec is used.
+type outputWriter struct {
+	dstDir    string
+	stageDir  string // set only for remote destinations, removed at Close
+	localPath string
+	fp        *os.File
+	bw        *bufio.Writer  // nil if unbuffered
+	zw        io.WriteCloser // codec, nil for none
+	w         io.Writer      // top of the stack
+	xh        hash.Hash64
+	Records   int64 // request frames written with writeFrame
+	Bytes     int64 // bytes written (uncompressed)
+}
+
+// baseName strips archive extensions (.fbf, .lz4 etc.) from a file name
+func baseName(fileName string) string {
+	name := path.Base(fileName)
+	for _, ext := range []string{".tmp", ".lz4", ".gz", ".zst", ".sz", ".fbf"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
+
+// newOutputWriter creates file `name` (plus the codec extension) in `dstDir`
+func newOutputWriter(dstDir, name, codec string) (ow *outputWriter, err error) {
+	return newOutputWriterSize(dstDir, name, codec, 65536)
+}
+
+// newOutputWriterSize is like newOutputWriter with the size of the file write
+// buffer given (0 - unbuffered)
+func newOutputWriterSize(dstDir, name, codec string, bufferSize int) (ow *outputWriter, err error) {
+
+	ext, ok := codecExtensions[codec]
+	if !ok {
+		return nil, errors.Errorf("unknown codec %s", codec)
+	}
+
+	ow = &outputWriter{dstDir: dstDir, xh: xxhash.New()}
+	localDir := strings.TrimPrefix(dstDir, "file://")
+	if !archive.IsLocal(dstDir) {
+		ow.stageDir, err = ioutil.TempDir("", "bhctl")
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to create staging directory")
+		}
+		localDir = ow.stageDir
+	} else {
+		err = os.MkdirAll(localDir, 0755)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to create directory %s", localDir)
+		}
+	}
+
+	ow.localPath = path.Join(localDir, name+ext)
+	ow.fp, err = os.OpenFile(ow.localPath+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		ow.cleanup()
+		return nil, errors.Wrapf(err, "unable to create %s.tmp", ow.localPath)
+	}
+	ow.w = ow.fp
+	if bufferSize > 0 {
+		ow.bw = bufio.NewWriterSize(ow.fp, bufferSize)
+		ow.w = ow.bw
+	}
+	under := ow.w
+
+	switch codec {
+	case "lz4":
+		ow.zw = lz4.NewWriter(under)
+	case "gzip":
+		ow.zw = gzip.NewWriter(under)
+	case "zstd":
+		ow.zw, err = zstd.NewWriter(under)
+		if err != nil {
+			ow.cleanup()
+			return nil, errors.Wrap(err, "unable to create zstd encoder")
+		}
+	case "snappy":
+		ow.zw = s2.NewWriter(under, s2.WriterSnappyCompat())
+	}
+	if ow.zw != nil {
+		ow.w = ow.zw
+	}
+	return ow, nil
+}
+
+// Name is the final file name, without directory
+func (ow *outputWriter) Name() string {
+	return path.Base(ow.localPath)
+}
+
+// Checksum is the xxhash of everything written so far, formatted
+// the same way as the checksum-only archive does it
+func (ow *outputWriter) Checksum() string {
+	return fmt.Sprintf("%0X", ow.xh.Sum64())
+}
+
+func (ow *outputWriter) Write(p []byte) (n int, err error) {
+	n, err = ow.w.Write(p)
+	ow.xh.Write(p[:n])
+	ow.Bytes += int64(n)
+	return n, err
+}
+
+// writeFrame copies a frame as is. Only request frames count as records.
+func (ow *outputWriter) writeFrame(umr *request.UnmarshalledRequest) (err error) {
+	_, err = umr.WriteFrame(ow)
+	if err == nil && !umr.IsHeader() {
+		ow.Records++
+	}
+	return err
+}
+
+// cleanup removes anything left behind locally. Safe to call more than once.
+func (ow *outputWriter) cleanup() {
+	if ow.fp != nil {
+		ow.fp.Close()
+		os.Remove(ow.localPath + ".tmp")
+		ow.fp = nil
+	}
+	if ow.stageDir != "" {
+		os.RemoveAll(ow.stageDir)
+		ow.stageDir = ""
+	}
+}
+
+// Abort closes and removes the partially written file
+func (ow *outputWriter) Abort() {
+	ow.cleanup()
+}
+
+// Close flushes the file and moves (or uploads) it to its final place
+func (ow *outputWriter) Close() (err error) {
+
+	defer ow.cleanup()
+
+	if ow.zw != nil {
+		err = ow.zw.Close()
+		if err != nil {
+			return errors.Wrapf(err, "unable to flush %s", ow.localPath)
+		}
+	}
+	if ow.bw != nil {
+		err = ow.bw.Flush()
+		if err != nil {
+			return errors.Wrapf(err, "unable to flush %s", ow.localPath)
+		}
+	}
+	err = ow.fp.Close()
+	ow.fp = nil
+	if err != nil {
+		return errors.Wrapf(err, "unable to close %s", ow.localPath)
+	}
+	err = os.Rename(ow.localPath+".tmp", ow.localPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to rename %s.tmp", ow.localPath)
+	}
+
+	if ow.stageDir != "" {
+		err = archive.Store(ow.localPath, ow.dstDir)
+		if err != nil {
+			return errors.Wrapf(err, "unable to upload %s to %s", ow.Name(), ow.dstDir)
+		}
+	}
+	return nil
+}
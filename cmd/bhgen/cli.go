@@ -0,0 +1,104 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+/*
+`bhgen` generates synthetic requests from a spec file and either sends them
+to a target host (like `replay` does) or writes them to an archive (like
+`blackhole` does). Useful to seed test captures without real traffic.
+
+	Usage of ./bhgen:
+	 -b, --buffer-size int           Buffer size of archive files (0 - default, unbuffered)
+	 -d, --duration duration         Stop after this long. Overrides `duration` of the spec
+	     --dry-run                   Print requests instead of sending or saving them
+	 -o, --output-directory string   Output directory (or URL) to write requests to
+	 -r, --rate float                Requests per second (0 - as fast as possible). Overrides `rate` of the spec
+	 -n, --requests int              Number of requests to generate. Overrides `count` of the spec
+	     --seed int                  Random seed. Overrides `seed` of the spec (0 - random)
+	 -s, --spec string               Spec file (yaml, json or toml)
+	 -H, --target-host string        Target host (host:port) to send requests to
+	 -t, --threads int               Number of sender or recorder threads (default 5)
+	 -q, --quiet                     Print only errors
+	 -v, --verbose                   Verbose output
+
+See the README for the spec format.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+var buildTS string
+
+type cmdArgs struct {
+	specFile   string
+	count      int
+	duration   time.Duration
+	rate       float64
+	seed       int64
+	targetHost string
+	outputDir  string
+	dryRun     bool
+	numThreads int
+	bufferSize int
+	quiet      bool
+	verbose    bool
+}
+
+func processCmdline() (args cmdArgs, err error) {
+
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s (Build ts: %s)\n\n", os.Args[0], buildTS)
+		pflag.PrintDefaults()
+	}
+
+	pflag.StringVarP(&args.specFile, "spec", "s", "", "Spec file (yaml, json or toml)")
+	pflag.IntVarP(&args.count, "requests", "n", 0,
+		"Number of requests to generate. Overrides `count` of the spec")
+	pflag.DurationVarP(&args.duration, "duration", "d", 0,
+		"Stop after this long. Overrides `duration` of the spec")
+	pflag.Float64VarP(&args.rate, "rate", "r", 0,
+		"Requests per second (0 - as fast as possible). Overrides `rate` of the spec")
+	pflag.Int64VarP(&args.seed, "seed", "", 0, "Random seed. Overrides `seed` of the spec (0 - random)")
+	pflag.StringVarP(&args.targetHost, "target-host", "H", "", "Target host (host:port) to send requests to")
+	pflag.StringVarP(&args.outputDir, "output-directory", "o", "", "Output directory (or URL) to write requests to")
+	pflag.BoolVarP(&args.dryRun, "dry-run", "", false, "Print requests instead of sending or saving them")
+	pflag.IntVarP(&args.numThreads, "threads", "t", 5, "Number of sender or recorder threads")
+	pflag.IntVarP(&args.bufferSize, "buffer-size", "b", 0, "Buffer size of archive files (0 - default, unbuffered)")
+	pflag.BoolVarP(&args.quiet, "quiet", "q", false, "Print only errors")
+	pflag.BoolVarP(&args.verbose, "verbose", "v", false, "Verbose output")
+	pflag.Parse()
+
+	if args.specFile == "" {
+		pflag.Usage()
+		return args, errors.New("Please supply a spec file")
+	}
+	outputs := 0
+	for _, set := range []bool{args.targetHost != "", args.outputDir != "", args.dryRun} {
+		if set {
+			outputs++
+		}
+	}
+	if outputs != 1 {
+		pflag.Usage()
+		return args, errors.New("Please supply exactly one of --target-host, --output-directory or --dry-run")
+	}
+	if args.numThreads <= 0 {
+		return args, errors.Errorf("Number of threads must be positive, got %d", args.numThreads)
+	}
+	return args, nil
+}
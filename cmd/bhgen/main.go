@@ -0,0 +1,226 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/adobe/blackhole/lib/recorder"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/adobe/blackhole/lib/sender"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func newLogger(verbose bool) (*zap.Logger, error) {
+
+	zapLevel := zapcore.InfoLevel
+	if verbose {
+		zapLevel = zapcore.DebugLevel
+	}
+	zapConfig := zap.Config{
+		Level:             zap.NewAtomicLevelAt(zapLevel),
+		DisableCaller:     true,
+		DisableStacktrace: true,
+		Development:       verbose,
+		Encoding:          "console",
+		EncoderConfig:     zap.NewDevelopmentEncoderConfig(),
+		OutputPaths:       []string{"stderr"},
+		ErrorOutputPaths:  []string{"stderr"},
+	}
+	return zapConfig.Build()
+}
+
+// sink is where generated requests go: an archive (recorder) or sender workers
+type sink struct {
+	rec     *recorder.Recorder
+	reqChan chan *request.UnmarshalledRequest
+	wg      sync.WaitGroup
+	stats   sender.Stats
+}
+
+func newSink(args *cmdArgs, logger *zap.Logger) (s *sink, err error) {
+
+	s = &sink{}
+	if args.outputDir != "" {
+		s.rec, err = recorder.New(
+			recorder.OutputDir(args.outputDir),
+			recorder.Threads(args.numThreads),
+			recorder.BufferSize(args.bufferSize),
+			recorder.Logger(logger))
+		if err != nil {
+			return nil, err
+		}
+		return s, s.rec.Start()
+	}
+
+	s.reqChan = make(chan *request.UnmarshalledRequest)
+	// Errors are counted, not acted upon: nothing reads errorRespChan
+	errorRespChan := make(chan bool, args.numThreads)
+	for i := 0; i < args.numThreads; i++ {
+		wrk := sender.NewWorker(s.reqChan, errorRespChan, args.targetHost, &s.wg, i)
+		wrk.WithOption(sender.Quiet(args.quiet), sender.Dryrun(args.dryRun),
+			sender.CollectStats(&s.stats))
+		s.wg.Add(1)
+		go wrk.Run()
+	}
+	return s, nil
+}
+
+func (s *sink) put(mr *request.MarshalledRequest) {
+	if s.rec != nil {
+		s.rec.Record(mr)
+		return
+	}
+	s.reqChan <- mr.Unmarshalled()
+}
+
+// close waits for requests to be sent or saved
+func (s *sink) close(logger *zap.Logger) error {
+	if s.rec != nil {
+		err := s.rec.Stop()
+		logger.Info("Recorded", zap.Int64("requests", s.rec.Count()))
+		return err
+	}
+	close(s.reqChan)
+	s.wg.Wait()
+	st := s.stats.Snapshot()
+	logger.Info("Sent",
+		zap.Int64("sent", st.Sent),
+		zap.Int64("failed", st.Failed))
+	return nil
+}
+
+// generate runs until `count` requests were generated, `duration` elapsed or
+// `stop` is closed. A rate of 0 means as fast as the sink accepts them.
+func generate(g *generator, s *sink, count int, duration time.Duration, rate float64,
+	stop <-chan struct{}) (n int, err error) {
+
+	start := time.Now()
+	var deadline <-chan time.Time
+	if duration > 0 {
+		t := time.NewTimer(duration)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	for count == 0 || n < count {
+		if rate > 0 {
+			// Pace against the start time rather than the previous request,
+			// so that slow sends don't lower the overall rate
+			due := start.Add(time.Duration(float64(n) / rate * float64(time.Second)))
+			if wait := time.Until(due); wait > 0 {
+				t := time.NewTimer(wait)
+				select {
+				case <-t.C:
+				case <-deadline:
+					t.Stop()
+					return n, nil
+				case <-stop:
+					t.Stop()
+					return n, nil
+				}
+			}
+		}
+		select {
+		case <-deadline:
+			return n, nil
+		case <-stop:
+			return n, nil
+		default:
+		}
+
+		mr, err := g.next()
+		if err != nil {
+			return n, errors.Wrapf(err, "Unable to generate request %d", n+1)
+		}
+		s.put(mr)
+		n++
+	}
+	return n, nil
+}
+
+func main() {
+
+	args, err := processCmdline()
+	if err != nil {
+		log.Fatalf("%+v", err)
+	}
+	logger, err := newLogger(args.verbose)
+	if err != nil {
+		log.Fatalf("%+v", err)
+	}
+	logger.Debug("Built", zap.String("TS", buildTS))
+
+	sp, err := loadSpec(args.specFile)
+	if err != nil {
+		logger.Fatal("FATAL", zap.Error(err))
+	}
+	if args.count > 0 {
+		sp.Count = args.count
+	}
+	if args.duration > 0 {
+		sp.Duration = args.duration
+	}
+	if args.rate > 0 {
+		sp.Rate = args.rate
+	}
+	if args.seed != 0 {
+		sp.Seed = args.seed
+	}
+	if sp.Count == 0 && sp.Duration == 0 {
+		logger.Warn("No count or duration given. Generating until interrupted.")
+	}
+
+	g, err := newGenerator(sp)
+	if err != nil {
+		logger.Fatal("FATAL", zap.Error(err))
+	}
+	s, err := newSink(&args, logger)
+	if err != nil {
+		logger.Fatal("FATAL", zap.Error(err))
+	}
+
+	stop := make(chan struct{})
+	sigChan := make(chan os.Signal, 1) // Docs recommend a buffer of 1
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigChan
+		logger.Info("Received", zap.String("signal", sig.String()))
+		close(stop)
+	}()
+
+	logger.Info("Generating",
+		zap.Int("count", sp.Count),
+		zap.Duration("duration", sp.Duration),
+		zap.Float64("rate", sp.Rate),
+		zap.Int("request-kinds", len(g.kinds)))
+	start := time.Now()
+	n, genErr := generate(g, s, sp.Count, sp.Duration, sp.Rate, stop)
+	err = s.close(logger)
+	logger.Info("Done",
+		zap.Int("generated", n),
+		zap.Duration("elapsed", time.Since(start)))
+	if genErr != nil {
+		logger.Fatal("FATAL", zap.Error(genErr))
+	}
+	if err != nil {
+		logger.Fatal("FATAL", zap.Error(err))
+	}
+}
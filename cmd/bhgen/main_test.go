@@ -0,0 +1,83 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func testGenerator(t *testing.T) *generator {
+	g, err := newGenerator(spec{Requests: []requestSpec{{URI: "/items/{{seq}}"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+// Requests generated are recorded to the output directory
+func TestGenerateToArchive(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bhgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := newSink(&cmdArgs{outputDir: dir, numThreads: 2}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := generate(testGenerator(t), s, 50, 0, 0, nil)
+	if err != nil || n != 50 {
+		t.Fatalf("generated %d, %v", n, err)
+	}
+	if err = s.close(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.rec.Count(); got != 50 {
+		t.Fatalf("recorded %d", got)
+	}
+}
+
+// Requests are paced at the rate until the duration is over
+func TestGenerateRate(t *testing.T) {
+
+	s, err := newSink(&cmdArgs{dryRun: true, quiet: true, numThreads: 1}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close(zap.NewNop())
+	n, err := generate(testGenerator(t), s, 0, 300*time.Millisecond, 100, nil)
+	if err != nil || n < 20 || n > 31 {
+		t.Fatalf("generated %d, %v", n, err)
+	}
+}
+
+// Closing `stop` ends generation
+func TestGenerateStop(t *testing.T) {
+
+	s, err := newSink(&cmdArgs{dryRun: true, quiet: true, numThreads: 1}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close(zap.NewNop())
+	stop := make(chan struct{})
+	close(stop)
+	if n, err := generate(testGenerator(t), s, 0, 0, 1, stop); err != nil || n > 1 {
+		t.Fatalf("generated %d, %v", n, err)
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// spec describes the traffic to generate
+type spec struct {
+	Host     string        // Host header of generated requests
+	Rate     float64       // requests per second (0 - as fast as possible)
+	Count    int           // stop after this many requests
+	Duration time.Duration // stop after this long
+	Seed     int64         // random seed (0 - random)
+	Requests []requestSpec
+}
+
+// requestSpec is one kind of request. URI, headers and body are Go templates
+// (text/template) with the functions of templateFuncs.
+type requestSpec struct {
+	Name    string
+	Weight  int // relative frequency (default 1)
+	Method  string
+	URI     string   `mapstructure:"uri"`
+	Headers []string // `Name: value`
+	Body    string
+}
+
+func loadSpec(fileName string) (s spec, err error) {
+
+	v := viper.New()
+	v.SetConfigFile(fileName)
+	err = v.ReadInConfig()
+	if err != nil {
+		return s, errors.Wrapf(err, "Unable to read spec %s", fileName)
+	}
+	err = v.Unmarshal(&s)
+	if err != nil {
+		return s, errors.Wrapf(err, "Invalid spec %s", fileName)
+	}
+	if len(s.Requests) == 0 {
+		return s, errors.Errorf("No requests in spec %s", fileName)
+	}
+	if s.Host == "" {
+		s.Host = "localhost"
+	}
+	return s, nil
+}
+
+// generator creates requests from a spec. Not safe for concurrent use.
+type generator struct {
+	host     string
+	kinds    []requestKind
+	totalW   int
+	rnd      *rand.Rand
+	seq      int64
+	buf      bytes.Buffer
+	headersb bytes.Buffer
+}
+
+type requestKind struct {
+	name    string
+	weight  int
+	method  []byte
+	uri     *template.Template
+	headers []*template.Template
+	body    *template.Template
+}
+
+func newGenerator(s spec) (g *generator, err error) {
+
+	seed := s.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	g = &generator{host: s.Host, rnd: rand.New(rand.NewSource(seed))}
+
+	funcs := g.templateFuncs()
+	parse := func(name, text string) (*template.Template, error) {
+		return template.New(name).Funcs(funcs).Parse(text)
+	}
+
+	for i, rs := range s.Requests {
+		k := requestKind{name: rs.Name, weight: rs.Weight, method: []byte(strings.ToUpper(rs.Method))}
+		if k.name == "" {
+			k.name = "request " + strconv.Itoa(i+1)
+		}
+		if k.weight == 0 {
+			k.weight = 1
+		}
+		if k.weight < 0 {
+			return nil, errors.Errorf("%s: weight must be positive, got %d", k.name, k.weight)
+		}
+		if len(k.method) == 0 {
+			k.method = []byte("GET")
+		}
+		if rs.URI == "" {
+			return nil, errors.Errorf("%s: uri is required", k.name)
+		}
+		k.uri, err = parse(k.name+" uri", rs.URI)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: invalid uri template", k.name)
+		}
+		for _, h := range rs.Headers {
+			t, err := parse(k.name+" header", h)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s: invalid header template", k.name)
+			}
+			k.headers = append(k.headers, t)
+		}
+		k.body, err = parse(k.name+" body", rs.Body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: invalid body template", k.name)
+		}
+		g.kinds = append(g.kinds, k)
+		g.totalW += k.weight
+	}
+	return g, nil
+}
+
+// templateFuncs are the functions available to templates
+func (g *generator) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		// seq is the number of the request being generated, from 1
+		"seq": func() int64 { return g.seq },
+		"uuid": func() string {
+			var b [16]byte
+			g.rnd.Read(b[:])
+			b[6] = b[6]&0x0f | 0x40 // version 4
+			b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+			return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+		},
+		// randInt returns a number in [min, max]
+		"randInt": func(min, max int) int {
+			if max <= min {
+				return min
+			}
+			return min + g.rnd.Intn(max-min+1)
+		},
+		"choice": func(values ...string) string {
+			if len(values) == 0 {
+				return ""
+			}
+			return values[g.rnd.Intn(len(values))]
+		},
+		"randString": func(n int) string {
+			const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+			b := make([]byte, n)
+			for i := range b {
+				b[i] = letters[g.rnd.Intn(len(letters))]
+			}
+			return string(b)
+		},
+		"now":  func() string { return time.Now().UTC().Format(time.RFC3339) },
+		"unix": func() int64 { return time.Now().Unix() },
+	}
+}
+
+// pick returns a request kind at random, according to weights
+func (g *generator) pick() *requestKind {
+	n := g.rnd.Intn(g.totalW)
+	for i := range g.kinds {
+		n -= g.kinds[i].weight
+		if n < 0 {
+			return &g.kinds[i]
+		}
+	}
+	return &g.kinds[len(g.kinds)-1]
+}
+
+// next generates a request. Caller must Release() it (or hand it over to
+// something that does).
+func (g *generator) next() (mr *request.MarshalledRequest, err error) {
+
+	g.seq++
+	k := g.pick()
+
+	uri, err := g.execute(k.uri)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: uri", k.name)
+	}
+
+	// Recorded headers: `Name: value` lines ending with an empty line
+	hb := &g.headersb
+	hb.Reset()
+	hb.WriteString("Host: " + g.host + "\r\n")
+	for _, t := range k.headers {
+		h, err := g.execute(t)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: header", k.name)
+		}
+		hb.WriteString(strings.TrimSpace(h) + "\r\n")
+	}
+	hb.WriteString("\r\n")
+
+	body, err := g.execute(k.body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: body", k.name)
+	}
+
+	ts := time.Now().UnixNano()
+	id := "GEN-" + strconv.FormatInt(ts, 10) + "-" + strconv.FormatInt(g.seq, 10)
+	return request.CreateRequestAt(ts,
+		[]byte(id), k.method, []byte(uri), hb.Bytes(), []byte(body)), nil
+}
+
+func (g *generator) execute(t *template.Template) (string, error) {
+	g.buf.Reset()
+	err := t.Execute(&g.buf, nil)
+	return g.buf.String(), err
+}
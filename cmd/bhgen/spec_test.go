@@ -0,0 +1,145 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// writeSpec writes `yaml` to a spec file removed at the end of the test
+func writeSpec(t *testing.T, yaml string) string {
+	dir, err := ioutil.TempDir("", "bhgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fileName := filepath.Join(dir, "spec.yaml")
+	if err = ioutil.WriteFile(fileName, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestLoadSpec(t *testing.T) {
+
+	s, err := loadSpec(writeSpec(t, `
+rate: 100.5
+count: 1000
+duration: 1m30s
+seed: 42
+requests:
+  - name: search
+    weight: 3
+    method: get
+    uri: /search?q={{randString 8}}
+    headers:
+      - "Accept: application/json"
+  - uri: /events
+    method: POST
+    body: '{"id": "{{uuid}}"}'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Host != "localhost" || s.Rate != 100.5 || s.Count != 1000 || s.Duration != 90*time.Second || s.Seed != 42 {
+		t.Fatalf("got %+v", s)
+	}
+	if len(s.Requests) != 2 || s.Requests[0].URI != "/search?q={{randString 8}}" || s.Requests[0].Weight != 3 ||
+		len(s.Requests[0].Headers) != 1 || s.Requests[1].Body != `{"id": "{{uuid}}"}` {
+		t.Fatalf("got requests %+v", s.Requests)
+	}
+
+	if _, err = loadSpec(writeSpec(t, "host: example.com\n")); err == nil {
+		t.Fatal("no error without requests")
+	}
+	if _, err = loadSpec(filepath.Join(filepath.Dir(writeSpec(t, "")), "missing.yaml")); err == nil {
+		t.Fatal("no error for a missing spec")
+	}
+}
+
+func TestNewGeneratorErrors(t *testing.T) {
+
+	tests := []struct {
+		name string
+		rs   requestSpec
+	}{
+		{"no uri", requestSpec{}},
+		{"negative weight", requestSpec{URI: "/", Weight: -1}},
+		{"bad uri", requestSpec{URI: "/{{"}},
+		{"bad header", requestSpec{URI: "/", Headers: []string{"A: {{nope}}"}}},
+		{"bad body", requestSpec{URI: "/", Body: "{{end}}"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newGenerator(spec{Requests: []requestSpec{tt.rs}}); err == nil {
+				t.Fatal("no error")
+			}
+		})
+	}
+}
+
+func TestGenerate(t *testing.T) {
+
+	g, err := newGenerator(spec{Host: "api.example.com", Seed: 1, Requests: []requestSpec{{
+		Method:  "post",
+		URI:     "/items/{{seq}}?n={{randInt 5 9}}&c={{choice \"a\" \"b\"}}",
+		Headers: []string{"  X-Id: {{uuid}}  ", "X-Name: {{randString 4}}"},
+		Body:    "{{randInt 3 3}}",
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := regexp.MustCompile(`^/items/([0-9]+)\?n=[5-9]&c=[ab]$`)
+	headers := regexp.MustCompile(`^Host: api\.example\.com\r\n` +
+		`X-Id: [0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}\r\n` +
+		`X-Name: [a-zA-Z0-9]{4}\r\n\r\n$`)
+	for i := 1; i <= 20; i++ {
+		mr, err := g.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := mr.Unmarshalled()
+		req := r.Request()
+		m := uri.FindStringSubmatch(string(req.Uri()))
+		if string(req.Method()) != "POST" || m == nil || m[1] != strconv.Itoa(i) || !headers.Match(req.Headers()) ||
+			string(req.BodyBytes()) != "3" {
+			t.Fatalf("request %d: got %s %s %q %q", i, req.Method(), req.Uri(), req.Headers(), req.BodyBytes())
+		}
+		r.Release()
+	}
+}
+
+// Kinds of requests come as often as their weight tells
+func TestGenerateWeights(t *testing.T) {
+
+	g, err := newGenerator(spec{Seed: 1, Requests: []requestSpec{
+		{Name: "a", URI: "/a", Weight: 3},
+		{Name: "b", URI: "/b"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		counts[g.pick().name]++
+	}
+	if counts["a"] < 2800 || counts["a"] > 3200 || counts["a"]+counts["b"] != 4000 {
+		t.Fatalf("got %v", counts)
+	}
+}
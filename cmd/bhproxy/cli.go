@@ -0,0 +1,85 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+/*
+`bhproxy` is a recording reverse proxy. Unlike `blackhole`, which answers every
+request itself, requests are forwarded to an upstream and clients get its real
+responses. Request/response pairs are recorded to an archive URL.
+
+	Usage of ./bhproxy:
+	 -b, --buffer-size int           Buffer size (0 - default, unbuffered)
+	 -l, --listen string             Address to listen on (default ":8080")
+	 -o, --output-directory string   Output directory (or URL) for recorded requests
+	     --preserve-host             Send the Host header of the client to the upstream
+	 -t, --recorder-threads int      Number of recorder threads (default 5)
+	     --timeout duration          Timeout of upstream requests (default 30s)
+	     --tls-cert string           Certificate (PEM) to terminate TLS with
+	     --tls-key string            Private key (PEM) of --tls-cert
+	 -u, --upstream string           Upstream to forward requests to. Example http://localhost:8081, https://canary.domain.com
+	 -v, --verbose                   Verbose output
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+var buildTS string
+
+type cmdArgs struct {
+	listen       string
+	upstream     string
+	preserveHost bool
+	timeout      time.Duration
+	tlsCert      string
+	tlsKey       string
+	outputDir    string
+	numThreads   int
+	bufferSize   int
+	verbose      bool
+}
+
+func processCmdline() (args cmdArgs, err error) {
+
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s (Build ts: %s)\n\n", os.Args[0], buildTS)
+		pflag.PrintDefaults()
+	}
+
+	pflag.StringVarP(&args.listen, "listen", "l", ":8080", "Address to listen on")
+	pflag.StringVarP(&args.upstream, "upstream", "u", "",
+		"Upstream to forward requests to. Example http://localhost:8081, https://canary.domain.com")
+	pflag.BoolVarP(&args.preserveHost, "preserve-host", "", false,
+		"Send the Host header of the client to the upstream")
+	pflag.DurationVarP(&args.timeout, "timeout", "", 30*time.Second, "Timeout of upstream requests")
+	pflag.StringVarP(&args.tlsCert, "tls-cert", "", "", "Certificate (PEM) to terminate TLS with")
+	pflag.StringVarP(&args.tlsKey, "tls-key", "", "", "Private key (PEM) of --tls-cert")
+	pflag.StringVarP(&args.outputDir, "output-directory", "o", "", "Output directory (or URL) for recorded requests")
+	pflag.IntVarP(&args.numThreads, "recorder-threads", "t", 5, "Number of recorder threads")
+	pflag.IntVarP(&args.bufferSize, "buffer-size", "b", 0, "Buffer size (0 - default, unbuffered)")
+	pflag.BoolVarP(&args.verbose, "verbose", "v", false, "Verbose output")
+	pflag.Parse()
+
+	if args.upstream == "" || args.outputDir == "" {
+		pflag.Usage()
+		return args, errors.New("Please supply both --upstream and --output-directory")
+	}
+	if (args.tlsCert == "") != (args.tlsKey == "") {
+		return args, errors.New("Please supply both --tls-cert and --tls-key, or neither")
+	}
+	return args, nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/adobe/blackhole/lib/recorder"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func newLogger(verbose bool) (*zap.Logger, error) {
+
+	zapLevel := zapcore.InfoLevel
+	if verbose {
+		zapLevel = zapcore.DebugLevel
+	}
+	zapConfig := zap.Config{
+		Level:             zap.NewAtomicLevelAt(zapLevel),
+		DisableCaller:     true,
+		DisableStacktrace: true,
+		Development:       verbose,
+		Encoding:          "console",
+		EncoderConfig:     zap.NewDevelopmentEncoderConfig(),
+		OutputPaths:       []string{"stderr"},
+		ErrorOutputPaths:  []string{"stderr"},
+	}
+	return zapConfig.Build()
+}
+
+func main() {
+
+	args, err := processCmdline()
+	if err != nil {
+		log.Fatalf("%+v", err)
+	}
+	logger, err := newLogger(args.verbose)
+	if err != nil {
+		log.Fatalf("%+v", err)
+	}
+	logger.Debug("Built", zap.String("TS", buildTS))
+
+	rec, err := recorder.New(
+		recorder.OutputDir(args.outputDir),
+		recorder.Threads(args.numThreads),
+		recorder.BufferSize(args.bufferSize),
+		recorder.Logger(logger),
+		recorder.OnError(func(err error) {
+			logger.Fatal("Recorder thread failed", zap.Error(err))
+		}))
+	if err != nil {
+		logger.Fatal("FATAL", zap.Error(err))
+	}
+	px, err := newProxy(args.upstream, &args, rec, logger)
+	if err != nil {
+		logger.Fatal("FATAL", zap.Error(err))
+	}
+	err = rec.Start()
+	if err != nil {
+		logger.Fatal("Unable to start recorder", zap.Error(err))
+	}
+
+	ln, err := net.Listen("tcp4", args.listen)
+	if err != nil {
+		logger.Fatal("Unable to listen", zap.String("address", args.listen), zap.Error(err))
+	}
+	srv := &fasthttp.Server{
+		Handler: px.handler,
+		Name:    "bhproxy",
+	}
+
+	// Stop accepting requests first, then finalize archives. Otherwise the
+	// last files would be left as .tmp (and not uploaded)
+	sigChan := make(chan os.Signal, 1) // Docs recommend a buffer of 1
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		s := <-sigChan
+		logger.Info("Received", zap.String("signal", s.String()))
+		err := srv.Shutdown()
+		if err != nil {
+			logger.Error("Unable to shutdown HTTP service", zap.Error(err))
+		}
+		err = rec.Stop()
+		if err != nil {
+			logger.Fatal("FATAL", zap.Error(err))
+		}
+		logger.Info("Recorded", zap.Int64("requests", rec.Count()))
+		close(done)
+	}()
+
+	logger.Info("Proxying",
+		zap.String("listen", args.listen),
+		zap.String("upstream", args.upstream),
+		zap.Bool("tls", args.tlsCert != ""))
+	if args.tlsCert != "" {
+		err = srv.ServeTLS(ln, args.tlsCert, args.tlsKey)
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != nil {
+		logger.Fatal("HTTP server failed", zap.Error(err))
+	}
+	<-done
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/adobe/blackhole/lib/recorder"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// hopHeaders are not forwarded in either direction (RFC 7230, section 6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// proxy forwards requests to a single upstream and records each exchange
+type proxy struct {
+	client       *fasthttp.HostClient
+	scheme       string
+	host         string
+	preserveHost bool
+	timeout      time.Duration
+	rec          *recorder.Recorder
+	logger       *zap.Logger
+}
+
+func newProxy(upstream string, args *cmdArgs, rec *recorder.Recorder, logger *zap.Logger) (px *proxy, err error) {
+
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid upstream %s", upstream)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("Upstream must be an http(s)://host[:port] URL, got %s", upstream)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	return &proxy{
+		client: &fasthttp.HostClient{
+			Addr:                          addr,
+			IsTLS:                         u.Scheme == "https",
+			DisableHeaderNamesNormalizing: true, // forward headers as received
+			DisablePathNormalizing:        true,
+		},
+		scheme:       u.Scheme,
+		host:         u.Host,
+		preserveHost: args.preserveHost,
+		timeout:      args.timeout,
+		rec:          rec,
+		logger:       logger,
+	}, nil
+}
+
+// handler forwards the request, copies the response back to the client and
+// records both. Upstream failures are answered (and recorded) as 502.
+func (px *proxy) handler(ctx *fasthttp.RequestCtx) {
+
+	start := time.Now()
+
+	// ctx.Request is left as received, it is what gets recorded
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	ctx.Request.CopyTo(req)
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.SetRequestURIBytes(ctx.RequestURI())
+	req.URI().SetScheme(px.scheme)
+	req.URI().SetHost(px.host)
+	if px.preserveHost {
+		req.UseHostHeader = true
+		req.Header.SetHostBytes(ctx.Host())
+	} else {
+		req.Header.SetHost(px.host)
+	}
+	clientIP := ctx.RemoteIP().String()
+	if prior := req.Header.Peek("X-Forwarded-For"); len(prior) > 0 {
+		clientIP = string(prior) + ", " + clientIP
+	}
+	req.Header.Set("X-Forwarded-For", clientIP)
+
+	resp := &ctx.Response
+	err := px.client.DoTimeout(req, resp, px.timeout)
+	if err != nil {
+		px.logger.Warn("Upstream request failed", zap.ByteString("uri", ctx.RequestURI()), zap.Error(err))
+		resp.Reset()
+		resp.SetStatusCode(fasthttp.StatusBadGateway)
+		resp.SetBodyString("Bad Gateway\n")
+	}
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+
+	px.record(ctx, resp, start)
+}
+
+// record saves the request as received from the client along with the
+// response sent back to it
+func (px *proxy) record(ctx *fasthttp.RequestCtx, resp *fasthttp.Response, start time.Time) {
+
+	// fasthttp gives the status line with the headers, recorded headers don't have it
+	respHeaders := resp.Header.Header()
+	if i := bytes.IndexByte(respHeaders, '\n'); i >= 0 {
+		respHeaders = respHeaders[i+1:]
+	}
+
+	px.rec.Record(request.CreateExchangeFromFastHTTPCtx(ctx, start.UnixNano(),
+		&request.Response{
+			Status:   resp.StatusCode(),
+			Headers:  respHeaders,
+			Body:     resp.Body(),
+			Duration: time.Since(start),
+		}))
+}
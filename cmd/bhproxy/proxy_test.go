@@ -0,0 +1,226 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/recorder"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// tempDir is a directory removed at the end of the test
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bhproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestNewProxy(t *testing.T) {
+
+	for _, upstream := range []string{"", "localhost:8081", "ftp://localhost", "http://", "http://[::1"} {
+		if _, err := newProxy(upstream, &cmdArgs{}, nil, zap.NewNop()); err == nil {
+			t.Fatalf("%q: no error", upstream)
+		}
+	}
+
+	tests := []struct {
+		upstream, addr string
+		tls            bool
+	}{
+		{"http://localhost:8081", "localhost:8081", false},
+		{"http://localhost", "localhost:80", false},
+		{"https://canary.domain.com", "canary.domain.com:443", true},
+		{"https://[::1]", "[::1]:443", true},
+	}
+	for _, tt := range tests {
+		px, err := newProxy(tt.upstream, &cmdArgs{}, nil, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if px.client.Addr != tt.addr || px.client.IsTLS != tt.tls {
+			t.Fatalf("%s: got %s, TLS %v", tt.upstream, px.client.Addr, px.client.IsTLS)
+		}
+	}
+}
+
+// serve has `handler` listen on a local port until the end of the test, and
+// returns its address
+func serve(t *testing.T, handler fasthttp.RequestHandler) string {
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fasthttp.Server{Handler: handler}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Shutdown() })
+	return ln.Addr().String()
+}
+
+// startProxy runs a proxy to `upstream` recording to `dir`, and returns its
+// address along with its recorder
+func startProxy(t *testing.T, upstream, dir string, args cmdArgs) (string, *recorder.Recorder) {
+
+	rec, err := recorder.New(recorder.OutputDir(dir), recorder.Compress(false), recorder.Threads(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rec.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if args.timeout == 0 {
+		args.timeout = 5 * time.Second
+	}
+	px, err := newProxy(upstream, &args, rec, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serve(t, px.handler), rec
+}
+
+// send sends a GET of `uri` with `headers` to the proxy at `addr`
+func send(t *testing.T, addr, uri string, headers map[string]string) *fasthttp.Response {
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI("http://" + addr + uri)
+	req.UseHostHeader = true
+	req.Header.SetHost("client.example.com")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp := &fasthttp.Response{}
+	if err := fasthttp.DoTimeout(req, resp, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// recordedExchange is the only request recorded to `dir`, calling `check` with it
+func recordedExchange(t *testing.T, dir string, check func(r *request.UnmarshalledRequest)) {
+
+	files, _ := filepath.Glob(filepath.Join(dir, "requests_*.fbf"))
+	if len(files) != 1 {
+		t.Fatalf("got files %q", files)
+	}
+	rf, err := archive.OpenArchive(files[0], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	umr, err := request.GetNextRequest(rf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(umr)
+	umr.Release()
+	if _, err = request.GetNextRequest(rf, false); err != io.EOF {
+		t.Fatalf("more than one request: %v", err)
+	}
+}
+
+// Requests are forwarded without hop-by-hop headers, and recorded as
+// received along with the response
+func TestProxy(t *testing.T) {
+
+	for _, preserveHost := range []bool{false, true} {
+		t.Run(map[bool]string{false: "upstream host", true: "preserve host"}[preserveHost], func(t *testing.T) {
+			var host, forwardedFor, proxyAuth string
+			upstream := serve(t, func(ctx *fasthttp.RequestCtx) {
+				host = string(ctx.Host())
+				forwardedFor = string(ctx.Request.Header.Peek("X-Forwarded-For"))
+				proxyAuth = string(ctx.Request.Header.Peek("Proxy-Authorization"))
+				ctx.Response.Header.Set("X-Upstream", "1")
+				ctx.Response.Header.Set("Proxy-Authenticate", "Basic")
+				ctx.SetStatusCode(fasthttp.StatusCreated)
+				ctx.SetBodyString("answer to " + string(ctx.RequestURI()))
+			})
+			dir := tempDir(t)
+			addr, rec := startProxy(t, "http://"+upstream, dir, cmdArgs{preserveHost: preserveHost})
+
+			resp := send(t, addr, "/items?id=1", map[string]string{
+				"X-Request-ID":        "id-1",
+				"X-Forwarded-For":     "10.0.0.1",
+				"Proxy-Authorization": "Basic dXNlcg==",
+			})
+			if resp.StatusCode() != fasthttp.StatusCreated || string(resp.Body()) != "answer to /items?id=1" ||
+				string(resp.Header.Peek("X-Upstream")) != "1" || len(resp.Header.Peek("Proxy-Authenticate")) != 0 {
+				t.Fatalf("got %d %q\n%s", resp.StatusCode(), resp.Body(), resp.Header.Header())
+			}
+			wantHost := upstream
+			if preserveHost {
+				wantHost = "client.example.com"
+			}
+			if host != wantHost || forwardedFor != "10.0.0.1, 127.0.0.1" || proxyAuth != "" {
+				t.Fatalf("upstream got Host %q, X-Forwarded-For %q, Proxy-Authorization %q", host, forwardedFor, proxyAuth)
+			}
+			if err := rec.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			recordedExchange(t, dir, func(umr *request.UnmarshalledRequest) {
+				r := umr.Request()
+				if string(r.Id()) != "id-1" || string(r.Method()) != "GET" || string(r.Uri()) != "/items?id=1" ||
+					!strings.Contains(string(r.Headers()), "Host: client.example.com\r\n") ||
+					!strings.Contains(string(r.Headers()), "Proxy-Authorization: Basic dXNlcg==\r\n") {
+					t.Fatalf("recorded %s %s %s\n%s", r.Id(), r.Method(), r.Uri(), r.Headers())
+				}
+				if r.Status() != fasthttp.StatusCreated || string(r.ResponseBodyBytes()) != "answer to /items?id=1" ||
+					strings.HasPrefix(string(r.ResponseHeaders()), "HTTP/") || // no status line
+					!strings.Contains(string(r.ResponseHeaders()), "X-Upstream: 1\r\n") ||
+					strings.Contains(string(r.ResponseHeaders()), "Proxy-Authenticate") || r.Duration() <= 0 {
+					t.Fatalf("recorded response %d %q\n%s", r.Status(), r.ResponseBodyBytes(), r.ResponseHeaders())
+				}
+			})
+		})
+	}
+}
+
+// An upstream that can't be reached is answered, and recorded, as 502
+func TestProxyBadGateway(t *testing.T) {
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := ln.Addr().String()
+	ln.Close()
+	dir := tempDir(t)
+	addr, rec := startProxy(t, "http://"+upstream, dir, cmdArgs{})
+
+	if resp := send(t, addr, "/", nil); resp.StatusCode() != fasthttp.StatusBadGateway {
+		t.Fatalf("got status %d", resp.StatusCode())
+	}
+	if err = rec.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	recordedExchange(t, dir, func(umr *request.UnmarshalledRequest) {
+		if r := umr.Request(); r.Status() != fasthttp.StatusBadGateway || string(r.ResponseBodyBytes()) != "Bad Gateway\n" {
+			t.Fatalf("recorded %d %q", r.Status(), r.ResponseBodyBytes())
+		}
+	})
+}
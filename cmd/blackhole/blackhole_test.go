@@ -28,8 +28,7 @@ import (
 
 // serve serves http request using provided fasthttp handler
 func serve(server *fasthttp.Server, req *http.Request, count int) (err error) {
-	ln := fasthttputil.NewInmemoryListener()
-	defer ln.Close()
+	ln := fasthttputil.NewInmemoryListener() // closed by shutDown, through server.Shutdown()
 
 	go func() {
 		err := server.Serve(ln)
@@ -16,6 +16,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
@@ -38,6 +39,7 @@ func waitForINTSignal(rc *runtimeContext, args cmdArgs) {
 
 	s := <-rc.interruptChan
 	rc.logger.Info("Received", zap.String("signal", s.String()))
+	go cancelUploads(rc, args.stopTimeout)
 	err := shutDown(rc)
 	if err != nil {
 		rc.logger.Fatal("FATAL", zap.Error(err))
@@ -45,8 +47,30 @@ func waitForINTSignal(rc *runtimeContext, args cmdArgs) {
 	os.Exit(1)
 }
 
+// cancelUploads cancels the uploads of output files still running `timeout`
+// after the shutdown started (0 - never), or once a second signal is
+// received, for a hung upload not to hold the shutdown: files whose upload
+// is cancelled are left for --recover, as when an upload fails.
+func cancelUploads(rc *runtimeContext, timeout time.Duration) {
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case s := <-rc.interruptChan:
+		rc.logger.Warn("Received again, cancelling uploads", zap.String("signal", s.String()))
+	case <-expired:
+		rc.logger.Warn("Shutdown timed out, cancelling uploads", zap.Duration("timeout", timeout))
+	case <-rc.done:
+		return
+	}
+	rc.cancel()
+}
+
 func shutDown(rc *runtimeContext) (err error) {
 
+	rc.stop()
 	if rc.activeProfile != nil {
 		rc.activeProfile.Stop()
 	}
@@ -60,23 +84,21 @@ func shutDown(rc *runtimeContext) (err error) {
 		}
 	}
 
-	if recordReqChan != nil {
-		close(recordReqChan)
+	if activeRecorder != nil {
+		err = activeRecorder.Stop()
+		if err != nil {
+			return err
+		}
 	}
-
-	// **********************************************************
-	// WARNING: DO NOT SET recordReqChan CHANNEL TO NIL
-	// A nil channel is not equivalent to a "closed" channel.
-	// Behavior is completely opposite (block vs release)
-	// https://dave.cheney.net/2014/03/19/channel-axioms
-	// We want all readers to come out of the for-range/select
-	// Initially I had set it to nil to help the
-	// logic at < see MARK-b5688e1019ad >
-	// but that was a bad idea.
-	// **********************************************************
-
-	rc.logger.Info("shutdown: Waiting for all reader threads to exit")
-	rc.wgConsumers.Wait()
-	rc.logger.Info("All reader threads finished")
+	if rc.registry != nil {
+		err = rc.registry.close()
+		if err != nil {
+			rc.logger.Error("Manifest failed", zap.Error(err))
+		}
+	}
+	if rc.admin != nil {
+		rc.admin.Shutdown()
+	}
+	close(rc.done)
 	return nil
 }
@@ -14,14 +14,43 @@ governing permissions and limitations under the License.
 `blackhole` serves as an HTTP endpoint with optional recording ability
 
  Usage of ./blackhole (Build ts: 2020-03-23T21:22:49Z):
+      --admin-address string      Serve the admin API (files recorded so far) on this host:port
       --block-profile             (for debug only) Block profile this run
   -b, --buffer-size int           Buffer size (0 - default, unbuffered)
+      --checksum-footer           End output files with a checksum of their content, checked by readers before reading them
   -c, --compress                  Compress output (or not)
+      --compression string        Codec of compressed output files: lz4, zstd, snappy or none (default lz4)
+      --coalesce-records int      Hold this many requests per recorder thread and write them together (0 - write what is queued right away)
       --cpu-profile               (for debug only) CPU profile this run
+      --dictionary string         Compress requests one by one with this zstd dictionary (see bhctl dict), instead of files with lz4
+      --encryption-key string     Encrypt output files (AES-256-GCM) with the key in this file: 32 bytes, hex or base64
+      --fallback-directory string Where to go on recording when files can't be written to the output directory
+      --file-name string          Name output files after this template, e.g. {prefix}/dt={date}/{hostname}-{timestamp}-{seq}.{ext} (placeholders: see README)
+      --finalize-backoff duration Wait between the first two attempts to finalize an output file, doubled after each one (default 1s)
+      --finalize-retries int      Try again this many times to finalize (e.g. upload) an output file that failed to (0 - the thread fails)
+      --flush-every duration      Flush and sync archive files to disk this often, so a crash loses at most that much (0 - at rotation only)
+      --flush-records int         Flush and sync archive files to disk every N requests of a recorder thread (0 - never)
+      --index                     Write an index of request IDs next to output files (.idx), so replay -i finds a request without reading all
+      --leftovers string          What --recover does with files left incomplete by a crash: recover, delete, or quarantine (moved to quarantine/ of the staging directory) (default recover)
+      --manifest string           Write the list of files recorded in this run to this JSON file, updated as files are finalized
+      --max-file-records int      Start a new output file once one holds this many requests (0 - no limit)
+      --max-file-size int         Start a new output file once one is this large, in MB (0 - no limit, rotate on time only)
+      --max-recorder-threads int  Add recorder threads under load, up to this many, and retire them when idle (0 - fixed at --recorder-threads)
       --mem-profile               (for debug only) MEM profile this run
       --mutex-profile             (for debug only) Mutex profile this run
-  -o, --output-directory string   Output directory for saved requests
+  -o, --output-directory stringArray Output directory for saved requests (- to stream them to stdout), repeat to save them to each one (default [null://])
+      --retention duration        Delete output files older than this, on startup and then every hour (0 - keep all)
+      --retry-directory string    Local directory where output files that could not be finalized, retries included, are moved, instead of the thread failing
   -t, --recorder-threads int      Number of recorder threads (default 5)
+      --recover                   On startup, finalize archive files left incomplete by a crash (default true)
+      --recover-older-than duration Recover only leftover files untouched for this long, not those of an instance still running (0 - all)
+      --spill-directory string    Local directory where requests go when recorder queues are full, instead of blocking
+      --spill-size int            Largest size of the spill file, in MB (0 - no limit)
+      --shutdown-timeout duration Cancel uploads of output files still running this long after a shutdown signal, leaving them for --recover (0 - wait, until a second signal)
+      --ssh-key string            Private key to upload files to an sftp:// output directory with (default: ssh agent, ~/.ssh keys)
+      --staging-directory string  Local directory where files of s3://, az://, gs:// (...) output directories are staged until uploaded (default: system temporary directory)
+      --stream-upload             Upload files to an s3:// output directory as they are written, instead of staging them on local disk
+      --upload-bandwidth int      Cap uploads of output files to s3:// and az:// at this many MB/s, all recorder threads together (0 - no limit)
   -v, --verbose                   Verbose output
 
 */
@@ -30,6 +59,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/pflag"
 )
@@ -43,9 +73,39 @@ type cmdArgs struct {
 	blockProfile bool
 	verbose      bool
 	compress     bool
+	compression  string
+	footer       bool
+	index        bool
 	bufferSize   int // for performance testing only
-	outputDir    string
+	outputDir    string   // the first -o
+	teeDirs      []string // the other ones, written the same
+	fallbackDir  string
+	fileName     string
+	dictionary   string
+	keyFile      string
 	numThreads   int
+	maxFileSize  int
+	maxRecords   int
+	maxThreads   int
+	flushEvery   time.Duration
+	flushRecords int
+	coalesce     int
+	recover      bool
+	recoverAge   time.Duration
+	retention    time.Duration
+	stopTimeout  time.Duration
+	retries      int
+	retryBackoff time.Duration
+	retryDir     string
+	leftovers    string
+	stageDir     string
+	spillDir     string
+	spillSize    int
+	sshKey       string
+	streamUpload bool
+	uploadMBps   int
+	adminAddr    string
+	manifest     string
 	skip_stats   bool
 }
 
@@ -71,12 +131,72 @@ func processCmdline() (args cmdArgs, err error) {
 		"Skip stats (slight performance increase)")
 	pflag.BoolVarP(&args.compress, "compress", "c", false,
 		"Compress output (or not)")
+	pflag.BoolVarP(&args.footer, "checksum-footer", "", false,
+		"End output files with a checksum of their content, checked by readers before reading them")
+	pflag.BoolVarP(&args.index, "index", "", false,
+		"Write an index of request IDs next to output files (.idx), so replay -i finds a request without reading all")
+	pflag.StringVarP(&args.compression, "compression", "", "",
+		"Codec of compressed output files: lz4, zstd, snappy or none (default lz4)")
 	pflag.IntVarP(&args.bufferSize, "buffer-size", "b", 0,
 		"Buffer size (0 - default, unbuffered)")
+	pflag.IntVarP(&args.maxFileSize, "max-file-size", "", 0,
+		"Start a new output file once one is this large, in MB (0 - no limit, rotate on time only)")
+	pflag.IntVarP(&args.maxRecords, "max-file-records", "", 0,
+		"Start a new output file once one holds this many requests (0 - no limit)")
 	pflag.IntVarP(&args.numThreads, "recorder-threads", "t", 5, "Number of recorder threads")
-	pflag.StringVarP(&args.outputDir, "output-directory", "o", "", "Output directory for saved requests")
+	pflag.IntVarP(&args.maxThreads, "max-recorder-threads", "", 0,
+		"Add recorder threads under load, up to this many, and retire them when idle (0 - fixed at --recorder-threads)")
+	pflag.DurationVarP(&args.flushEvery, "flush-every", "", 0,
+		"Flush and sync archive files to disk this often, so a crash loses at most that much (0 - at rotation only)")
+	pflag.IntVarP(&args.flushRecords, "flush-records", "", 0,
+		"Flush and sync archive files to disk every N requests of a recorder thread (0 - never)")
+	pflag.IntVarP(&args.coalesce, "coalesce-records", "", 0,
+		"Hold this many requests per recorder thread and write them together (0 - write what is queued right away)")
+	pflag.BoolVarP(&args.recover, "recover", "", true,
+		"On startup, finalize archive files left incomplete by a crash")
+	pflag.DurationVarP(&args.recoverAge, "recover-older-than", "", 0,
+		"Recover only leftover files untouched for this long, not those of an instance still running (0 - all)")
+	pflag.DurationVarP(&args.retention, "retention", "", 0,
+		"Delete output files older than this, on startup and then every hour (0 - keep all)")
+	pflag.DurationVarP(&args.stopTimeout, "shutdown-timeout", "", 0,
+		"Cancel uploads of output files still running this long after a shutdown signal, leaving them for --recover (0 - wait, until a second signal)")
+	pflag.IntVarP(&args.retries, "finalize-retries", "", 0,
+		"Try again this many times to finalize (e.g. upload) an output file that failed to (0 - the thread fails)")
+	pflag.DurationVarP(&args.retryBackoff, "finalize-backoff", "", time.Second,
+		"Wait between the first two attempts to finalize an output file, doubled after each one")
+	pflag.StringVarP(&args.retryDir, "retry-directory", "", "",
+		"Local directory where output files that could not be finalized, retries included, are moved, instead of the thread failing")
+	pflag.StringVarP(&args.leftovers, "leftovers", "", "recover",
+		"What --recover does with files left incomplete by a crash: recover, delete, or quarantine (moved to quarantine/ of the staging directory)")
+	outputDirs := pflag.StringArrayP("output-directory", "o", []string{"null://"},
+		"Output directory for saved requests (- to stream them to stdout), repeat to save them to each one")
+	pflag.StringVarP(&args.dictionary, "dictionary", "", "",
+		"Compress requests one by one with this zstd dictionary (see bhctl dict), instead of files with lz4")
+	pflag.StringVarP(&args.keyFile, "encryption-key", "", "",
+		"Encrypt output files (AES-256-GCM) with the key in this file: 32 bytes, hex or base64")
+	pflag.StringVarP(&args.fileName, "file-name", "", "",
+		"Name output files after this template, e.g. {prefix}/dt={date}/{hostname}-{timestamp}-{seq}.{ext} (placeholders: see README)")
+	pflag.StringVarP(&args.fallbackDir, "fallback-directory", "", "",
+		"Where to go on recording when files can't be written to the output directory")
+	pflag.StringVarP(&args.stageDir, "staging-directory", "", "",
+		"Local directory where files of s3://, az://, gs:// (...) output directories are staged until uploaded (default: system temporary directory)")
+	pflag.StringVarP(&args.spillDir, "spill-directory", "", "",
+		"Local directory where requests go when recorder queues are full, instead of blocking")
+	pflag.IntVarP(&args.spillSize, "spill-size", "", 0,
+		"Largest size of the spill file, in MB (0 - no limit)")
+	pflag.StringVarP(&args.sshKey, "ssh-key", "", "",
+		"Private key to upload files to an sftp:// output directory with (default: ssh agent, ~/.ssh keys)")
+	pflag.BoolVarP(&args.streamUpload, "stream-upload", "", false,
+		"Upload files to an s3:// output directory as they are written, instead of staging them on local disk")
+	pflag.IntVarP(&args.uploadMBps, "upload-bandwidth", "", 0,
+		"Cap uploads of output files to s3:// and az:// at this many MB/s, all recorder threads together (0 - no limit)")
+	pflag.StringVarP(&args.adminAddr, "admin-address", "", "",
+		"Serve the admin API (files recorded so far) on this host:port")
+	pflag.StringVarP(&args.manifest, "manifest", "", "",
+		"Write the list of files recorded in this run to this JSON file, updated as files are finalized")
 	pflag.Usage = usage
 	pflag.Parse()
+	args.outputDir, args.teeDirs = (*outputDirs)[0], (*outputDirs)[1:]
 
 	return args, nil
 }
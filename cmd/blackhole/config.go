@@ -13,6 +13,10 @@ governing permissions and limitations under the License.
 package main
 
 import (
+	"strings"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/notify"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 )
@@ -35,5 +39,140 @@ func loadConfig(rc *runtimeContext) (err error) {
 			return errors.Wrapf(err, "Config file was found, but encountered an error reading it")
 		}
 	}
+	loadS3Endpoint()
+	loadS3Credentials()
+	return loadS3Upload()
+}
+
+// loadS3Endpoint points s3:// URLs to the S3-compatible store configured under
+// `s3`, if any (the environment is used otherwise, see s3f.SetEndpoint):
+//
+//	s3:
+//	  endpoint: https://minio.lab.example.com:9000
+//	  path_style: true
+//	  insecure: false
+func loadS3Endpoint() {
+	if viper.IsSet("s3.endpoint") {
+		archive.SetS3Endpoint(viper.GetString("s3.endpoint"),
+			viper.GetBool("s3.path_style"), viper.GetBool("s3.insecure"))
+	}
+}
+
+// loadS3Credentials sets the AWS profile, region and role used for s3://
+// configured under `s3`, if any (the environment is used otherwise, see
+// s3f.SetCredentials):
+//
+//	s3:
+//	  profile: capture
+//	  region: eu-west-1
+//	  role_arn: arn:aws:iam::123456789012:role/blackhole-writer
+func loadS3Credentials() {
+	if viper.IsSet("s3.profile") || viper.IsSet("s3.region") || viper.IsSet("s3.role_arn") {
+		archive.SetS3Credentials(viper.GetString("s3.profile"), viper.GetString("s3.region"),
+			viper.GetString("s3.role_arn"))
+	}
+}
+
+// loadS3Upload sets the parameters of objects uploaded to s3:// configured
+// under `s3`, if any (the environment is used otherwise, see
+// s3f.SetUploadOptions):
+//
+//	s3:
+//	  storage_class: STANDARD_IA
+//	  sse: aws:kms
+//	  kms_key_id: alias/captures
+//	  tagging: team=capture&retention=30d
+func loadS3Upload() error {
+	if viper.IsSet("s3.storage_class") || viper.IsSet("s3.sse") || viper.IsSet("s3.kms_key_id") || viper.IsSet("s3.tagging") {
+		return archive.SetS3Upload(viper.GetString("s3.storage_class"), viper.GetString("s3.sse"),
+			viper.GetString("s3.kms_key_id"), viper.GetString("s3.tagging"))
+	}
 	return nil
 }
+
+// loadNotifier returns the notifier configured under `notify`, or nil if
+// there is none. Example:
+//
+//	notify:
+//	  webhook:
+//	    url: https://pipeline.example.com/hooks/blackhole
+//	    headers:
+//	      Authorization: Bearer xyz
+//	    timeout: 10s
+//	    retries: 3
+//	  sqs:
+//	    queue_url: https://sqs.us-east-1.amazonaws.com/123456789012/captures
+//	  sns:
+//	    topic_arn: arn:aws:sns:us-east-1:123456789012:captures
+//	  eventgrid:
+//	    endpoint: https://captures.westus2-1.eventgrid.azure.net/api/events
+//	    key: <topic access key>
+//	  queue:
+//	    name: captures
+//
+// sqs and sns require an s3:// output directory, eventgrid and queue an az:// one.
+func loadNotifier(rc *runtimeContext, outDir string) (n notify.Notifier, err error) {
+
+	var notifiers []notify.Notifier
+	if viper.IsSet("notify.webhook") {
+		options := []func(*notify.Webhook) error{}
+		for name, value := range viper.GetStringMapString("notify.webhook.headers") {
+			options = append(options, notify.Header(name, value))
+		}
+		if viper.IsSet("notify.webhook.timeout") {
+			options = append(options, notify.Timeout(viper.GetDuration("notify.webhook.timeout")))
+		}
+		if viper.IsSet("notify.webhook.retries") {
+			options = append(options, notify.Retries(viper.GetInt("notify.webhook.retries")))
+		}
+		wh, err := notify.NewWebhook(viper.GetString("notify.webhook.url"), options...)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid \"notify.webhook\" config")
+		}
+		notifiers = append(notifiers, wh)
+	}
+
+	if (viper.IsSet("notify.sqs") || viper.IsSet("notify.sns")) && !strings.HasPrefix(outDir, "s3://") {
+		return nil, errors.Errorf("\"notify.sqs\" and \"notify.sns\" require an s3:// output directory, got %q", outDir)
+	}
+	if viper.IsSet("notify.sqs") {
+		q, err := notify.NewSQS(viper.GetString("notify.sqs.queue_url"))
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid \"notify.sqs\" config")
+		}
+		notifiers = append(notifiers, q)
+	}
+	if viper.IsSet("notify.sns") {
+		t, err := notify.NewSNS(viper.GetString("notify.sns.topic_arn"))
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid \"notify.sns\" config")
+		}
+		notifiers = append(notifiers, t)
+	}
+
+	if (viper.IsSet("notify.eventgrid") || viper.IsSet("notify.queue")) && !strings.HasPrefix(outDir, "az://") {
+		return nil, errors.Errorf("\"notify.eventgrid\" and \"notify.queue\" require an az:// output directory, got %q", outDir)
+	}
+	if viper.IsSet("notify.eventgrid") {
+		eg, err := notify.NewEventGrid(viper.GetString("notify.eventgrid.endpoint"), viper.GetString("notify.eventgrid.key"))
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid \"notify.eventgrid\" config")
+		}
+		notifiers = append(notifiers, eg)
+	}
+	if viper.IsSet("notify.queue") {
+		sq, err := notify.NewStorageQueue(viper.GetString("notify.queue.name"))
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid \"notify.queue\" config")
+		}
+		notifiers = append(notifiers, sq)
+	}
+
+	switch len(notifiers) {
+	case 0:
+		return nil, nil
+	case 1:
+		return notifiers[0], nil
+	}
+	return notify.All(notifiers...), nil
+}
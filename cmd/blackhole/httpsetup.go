@@ -14,53 +14,129 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
 	"net"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
 )
 
+// tlsEntry is one certificate of the `tls` config
+type tlsEntry struct {
+	Cert    string   `mapstructure:"cert"`
+	PrivKey string   `mapstructure:"privkey"`
+	Hosts   []string `mapstructure:"hosts"` // names served, default: those of the certificate
+}
+
+// load returns the certificate and the hostnames it is served for. `idx`
+// is only used in error messages.
+func (e *tlsEntry) load(idx string) (cert tls.Certificate, hosts []string, err error) {
+	if e.Cert == "" {
+		return cert, nil, errors.Errorf("\"tls\"%s must include a string subkey \"cert\" with certificate PEM filepath", idx)
+	}
+	if e.PrivKey == "" {
+		return cert, nil, errors.Errorf("\"tls\"%s must include a string subkey \"privkey\" with private key PEM filepath", idx)
+	}
+	cert, err = tls.LoadX509KeyPair(e.Cert, e.PrivKey)
+	if err != nil {
+		return cert, nil, errors.Wrapf(err, "Error loading cert=%s key=%s",
+			e.Cert, e.PrivKey)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return cert, nil, errors.Wrapf(err, "Error parsing cert=%s", e.Cert)
+	}
+
+	hosts = e.Hosts
+	if len(hosts) == 0 {
+		hosts = cert.Leaf.DNSNames
+		if len(hosts) == 0 && cert.Leaf.Subject.CommonName != "" {
+			hosts = []string{cert.Leaf.Subject.CommonName}
+		}
+	}
+	return cert, hosts, nil
+}
+
+// sniCertificates picks the certificate of the hostname a client asks for
+// (SNI): exact name first, then a wildcard (`*.foobar.com`), else the first
+// certificate configured.
+type sniCertificates struct {
+	byName map[string]*tls.Certificate
+	first  *tls.Certificate
+}
+
+func (sc *sniCertificates) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := sc.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := sc.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return sc.first, nil
+}
+
 // loadTLSConfig loads TLS option optionally based on `viper` config.
 // config is not passed in. `viper` knows where to search for config.
 // `viper` config was already loaded from main via `loadConfig()` call.
+// `tls` is either one cert/privkey pair or a list of them, the right one
+// being served by SNI.
 // returns *tls.Config, nil if TLS is requested
 // returns nil, nil if TLS is not requested
 func loadTLSConfig(rc *runtimeContext) (cfg *tls.Config, err error) {
-	tlsConfig := viper.Get("tls")
-	if v, ok := tlsConfig.(map[string]interface{}); ok && v != nil {
-		certFile, ok := v["cert"].(string)
-		if !ok {
-			return nil, errors.Errorf("\"tls\" key must include a string subkey \"cert\"")
-		}
-		privKeyFile, ok := v["privkey"].(string)
-		if !ok {
-			return nil, errors.Errorf("\"tls\" key must include a string subkey \"privkey\"")
-		}
-		if certFile == "" {
-			return nil, errors.Wrapf(err, "\"tls\" key must have a subkey \"cert\" with certifcate PEM filepath")
-		}
-		if privKeyFile == "" {
-			return nil, errors.Wrapf(err, "\"tls\" key must have a subkey \"privkey\" with private key PEM filepath")
+	var entries []tlsEntry
+	switch viper.Get("tls").(type) {
+	case nil:
+	case []interface{}:
+		err = viper.UnmarshalKey("tls", &entries)
+	default:
+		entries = make([]tlsEntry, 1)
+		err = viper.UnmarshalKey("tls", &entries[0])
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "\"tls\" key must be a cert/privkey pair or a list of them")
+	}
+	if len(entries) == 0 {
+		rc.logger.Warn("No TLS certificate configured")
+		return nil, nil
+	}
+
+	sc := &sniCertificates{byName: make(map[string]*tls.Certificate)}
+	cfg = &tls.Config{GetCertificate: sc.getCertificate}
+	var certHosts [][]string
+	for i := range entries {
+		idx := ""
+		if len(entries) > 1 {
+			idx = fmt.Sprintf(" entry #%d", i)
 		}
-		cert, err := tls.LoadX509KeyPair(certFile, privKeyFile)
+		cert, hosts, err := entries[i].load(idx)
 		if err != nil {
-			return nil, errors.Wrapf(err, "Error loading cert=%s key=%s",
-				certFile, privKeyFile)
+			return nil, err
 		}
-		cfg := &tls.Config{}
 		cfg.Certificates = append(cfg.Certificates, cert)
-		return cfg, nil
+		certHosts = append(certHosts, hosts)
+		rc.logger.Info("TLS certificate loaded", zap.Strings("hosts", hosts))
 	}
-
-	rc.logger.Warn("No TLS certificate configured")
-
-	return nil, nil
+	for i, hosts := range certHosts { // Certificates won't move any more
+		for _, h := range hosts {
+			h = strings.ToLower(h)
+			if _, dup := sc.byName[h]; !dup { // first one configured wins
+				sc.byName[h] = &cfg.Certificates[i]
+			}
+		}
+	}
+	sc.first = &cfg.Certificates[0]
+	return cfg, nil
 }
 
 // createListeners creates listeners for each of the addresses
@@ -13,13 +13,19 @@ governing permissions and limitations under the License.
 package main
 
 import (
+	"context"
+	"io/ioutil"
 	"log"
 	"os"
-	"sync"
-	"sync/atomic"
+	"strings"
 	"time"
 
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/notify"
+	"github.com/adobe/blackhole/lib/recorder"
 	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
 	dprofile "github.com/pkg/profile"
 	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
@@ -27,35 +33,37 @@ import (
 )
 
 type runtimeContext struct {
-	interruptChan chan os.Signal // handle graceful shutdown for stopping profile
-	exitChans     []chan bool    // to shutdown (ask them to exit) goroutines on interrupt
-	counters      []int64
-	wgConsumers   sync.WaitGroup // needs to be global for interrupt-handler to wait on recorder-threads to exit
+	interruptChan chan os.Signal  // handle graceful shutdown for stopping profile
+	done          chan struct{}   // closed once the recorder is stopped, for main to exit
+	ctx           context.Context // of the uploads of output files, see cancelUploads
+	cancel        context.CancelFunc
+	stopping      context.Context // done once the shutdown starts, for background tasks to stop
+	stop          context.CancelFunc
 	outDir        string
 	compress      bool
 	bufferSize    int
 	servers       []*fasthttp.Server
+	admin         *fasthttp.Server // admin API, stopped after the recorder
+	registry      *fileRegistry    // files finalized, if the admin API or a manifest is on
 	activeProfile interface{ Stop() }
 	logger        *zap.Logger
 	// Because of the need to Flush and Close the profiler output
 	// from the interrupt handler below, this has to managed as a module/global
 }
 
-// A channel used to send incoming messages for Archival.
+// The recorder archiving incoming requests.
 // Needs to be global to be available from http handler.
-// requestConsumer() is the archiver
-var recordReqChan chan *request.MarshalledRequest
+var activeRecorder *recorder.Recorder
 
 func initRunTimeContext(rc *runtimeContext, args cmdArgs) (err error) {
-	for i := 0; i < args.numThreads; i++ {
-		rc.exitChans = append(rc.exitChans, make(chan bool, 1)) // Docs recommend a buffer of 1
-	}
+	rc.done = make(chan struct{})
 	rc.interruptChan = make(chan os.Signal, 1) // Docs recommend a buffer of 1
+	rc.ctx, rc.cancel = context.WithCancel(context.Background())
+	rc.stopping, rc.stop = context.WithCancel(context.Background())
 	rc.outDir = args.outputDir
 	rc.bufferSize = args.bufferSize
 	rc.compress = args.compress
 	rc.activeProfile = nil
-	rc.counters = make([]int64, args.numThreads)
 
 	zapLevel := zapcore.InfoLevel
 	if args.verbose {
@@ -115,14 +123,17 @@ func main() {
 		rc.logger.Fatal("TLS setup failed", zap.Error(err))
 	}
 
-	if args.skip_stats && args.outputDir != "" {
-		rc.logger.Warn("Skipping stats is useful only if you also avoid saving requests")
+	if args.skip_stats && (!strings.HasPrefix(args.outputDir, "null://") || len(args.teeDirs) > 0) {
+		rc.logger.Warn("Skipping stats is useful only if you also avoid saving requests (-o null://)")
 		args.skip_stats = false
 	}
 
 	setupCleanupHandlers(rc, args)
 	if !args.skip_stats {
-		setupWorkflowHandlers(rc, args)
+		err = setupWorkflowHandlers(rc, args)
+		if err != nil {
+			rc.logger.Fatal("Unable to start recorder", zap.Error(err))
+		}
 	}
 	lns, err := createListeners(cfg)
 	if err != nil {
@@ -131,46 +142,198 @@ func main() {
 	startServers(rc, lns)
 
 	rc.logger.Info("main(): Waiting for all reader threads to exit")
-	rc.wgConsumers.Wait()
+	<-rc.done
 }
 
 func reInitGlobals() { // Used for testing
-	recordReqChan = nil
+	activeRecorder = nil
 }
 
-func statsPrinter(rc *runtimeContext) {
+func statsPrinter(rc *runtimeContext, rec *recorder.Recorder) {
 
 	tickerPrint := time.NewTicker(5 * time.Second) // Flush at least once in 5 seconds
 	defer tickerPrint.Stop()
-	var priorCount int64 = 0
+	var prior recorder.Stats
 	priorStatTime := time.Now()
 	for range tickerPrint.C {
-		var totalCount int64 = 0
-		for i := range rc.counters {
-			totalCount += atomic.LoadInt64(&rc.counters[i])
+		st := rec.Stats()
+		var writeLatency time.Duration
+		if st.Writes > prior.Writes {
+			writeLatency = (st.WriteTime - prior.WriteTime) / time.Duration(st.Writes-prior.Writes)
 		}
+		elapsed := time.Since(priorStatTime)
 		rc.logger.Debug("Aggregate",
-			zap.Int64("total", totalCount),
-			zap.Int64("incremental", totalCount-priorCount),
-			zap.Duration("duration", time.Since(priorStatTime)))
-		priorCount = totalCount
+			zap.Int64("total", st.Recorded),
+			zap.Int64("incremental", st.Recorded-prior.Recorded),
+			zap.Duration("duration", elapsed),
+			zap.Int64("received-bytes", st.Received-prior.Received),
+			zap.Int64("stored-bytes", st.Stored-prior.Stored),
+			zap.Float64("received-bytes-per-sec", float64(st.Received-prior.Received)/elapsed.Seconds()),
+			zap.Float64("stored-bytes-per-sec", float64(st.Stored-prior.Stored)/elapsed.Seconds()),
+			zap.Int("threads", st.Threads),
+			zap.Int("queued", st.Queued),
+			zap.Duration("write-latency", writeLatency),
+			zap.Int64("fallbacks", st.Fallbacks),
+			zap.Int("threads-on-fallback", st.Degraded),
+			zap.Int64("spilled", st.Spilled-prior.Spilled),
+			zap.Int64("spill-queued", st.SpillQueued),
+			zap.Int64("spill-lost", st.SpillLost))
+		prior = st
 		priorStatTime = time.Now()
 	}
 }
 
-func setupWorkflowHandlers(rc *runtimeContext, args cmdArgs) {
+func setupWorkflowHandlers(rc *runtimeContext, args cmdArgs) (err error) {
+
+	if args.retention > 0 {
+		for _, dir := range append([]string{args.outputDir}, args.teeDirs...) {
+			if !archive.Prunable(dir) {
+				return errors.Errorf("--retention not supported for %s", dir)
+			}
+		}
+	}
+	archive.SetBandwidth(int64(args.uploadMBps)<<20, 0) // recovered files included
+	options := []func(*recorder.Recorder) error{
+		recorder.OutputDir(args.outputDir),
+		recorder.Tee(args.teeDirs...),
+		recorder.Fallback(args.fallbackDir),
+		recorder.Threads(args.numThreads),
+		recorder.MaxThreads(args.maxThreads),
+		recorder.FlushEvery(args.flushEvery),
+		recorder.FlushAfter(args.flushRecords),
+		recorder.CoalesceRecords(args.coalesce),
+		recorder.Recover(args.recover),
+		recorder.RecoverOlderThan(args.recoverAge),
+		recorder.Leftovers(args.leftovers),
+		recorder.StagingDirectory(args.stageDir),
+		recorder.BufferSize(rc.bufferSize),
+		recorder.Logger(rc.logger),
+		recorder.ArchiveOptions(common.Context(rc.ctx)),
+		recorder.OnError(func(err error) {
+			rc.logger.Fatal("Handler thread failed", zap.Error(err))
+		})}
+	notifier, err := loadNotifier(rc, args.outputDir)
+	if err != nil {
+		return err
+	}
+	if args.adminAddr != "" || args.manifest != "" {
+		rc.registry = newFileRegistry(strings.Join(append([]string{args.outputDir}, args.teeDirs...), ","), args.manifest)
+		if notifier != nil {
+			notifier = notify.All(rc.registry, notifier)
+		} else {
+			notifier = rc.registry
+		}
+	}
+	if args.sshKey != "" {
+		options = append(options, recorder.ArchiveOptions(common.SSHKey(args.sshKey)))
+	}
+	if args.streamUpload {
+		options = append(options, recorder.ArchiveOptions(common.StreamUpload(true)))
+	}
+	if args.footer {
+		options = append(options, recorder.ArchiveOptions(common.ChecksumFooter(true)))
+	}
+	if args.index {
+		options = append(options, recorder.ArchiveOptions(common.Index(true)))
+	}
+	if args.fileName != "" {
+		options = append(options, recorder.ArchiveOptions(common.FilenameTemplate(args.fileName)))
+	}
+	if args.retries > 0 {
+		options = append(options, recorder.ArchiveOptions(common.RetryFinalize(args.retries, args.retryBackoff)))
+	}
+	if args.retryDir != "" {
+		options = append(options, recorder.ArchiveOptions(common.RetryDirectory(args.retryDir)))
+	}
+	if args.maxFileSize > 0 {
+		options = append(options, recorder.ArchiveOptions(common.MaxFileSize(int64(args.maxFileSize)<<20)))
+	}
+	if args.maxRecords > 0 {
+		options = append(options, recorder.ArchiveOptions(common.MaxRows(int64(args.maxRecords))))
+	}
+	if args.keyFile != "" {
+		key, err := common.LoadKey(args.keyFile)
+		if err != nil {
+			return err
+		}
+		options = append(options, recorder.Encrypt(key))
+	}
+	if args.compression != "" {
+		options = append(options, recorder.Compression(args.compression))
+	}
+	if args.spillDir != "" {
+		options = append(options, recorder.Spill(args.spillDir, int64(args.spillSize)<<20))
+	}
+	if notifier != nil {
+		options = append(options, recorder.OnFinalize(notify.OnFinalize(notifier, rc.logger)))
+	}
+	if args.dictionary != "" {
+		raw, err := ioutil.ReadFile(args.dictionary)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to read dictionary %s", args.dictionary)
+		}
+		dict, err := request.NewDictionary(raw)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to use dictionary %s", args.dictionary)
+		}
+		rc.logger.Info("Compressing requests with a dictionary", zap.Uint32("id", dict.ID()))
+		options = append(options, recorder.Dictionary(dict), recorder.Compress(false))
+	}
+
+	rec, err := recorder.New(options...)
+	if err != nil {
+		return err
+	}
+	err = rec.Start()
+	if err != nil {
+		return err
+	}
+	activeRecorder = rec
+
+	if args.adminAddr != "" && rc.registry != nil {
+		err = startAdmin(rc, args.adminAddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	go statsPrinter(rc, rec)
+	if args.retention > 0 {
+		go pruner(rc, append([]string{args.outputDir}, args.teeDirs...), args.retention)
+	}
+	return nil
+}
+
+// pruneEvery is how often pruner looks for files past retention
+const pruneEvery = time.Hour
 
-	go statsPrinter(rc)
+// pruner deletes the files of output directories older than `retention`,
+// now and then every pruneEvery, until the shutdown starts
+func pruner(rc *runtimeContext, dirs []string, retention time.Duration) {
 
-	rc.wgConsumers.Add(args.numThreads)
-	recordReqChan = make(chan *request.MarshalledRequest, 10000)
-	for i := 0; i < args.numThreads; i++ {
-		go func(j int) {
-			err := requestConsumer(j, rc, args.outputDir == "")
+	ticker := time.NewTicker(pruneEvery)
+	defer ticker.Stop()
+	for {
+		for _, dir := range dirs {
+			pruned, err := archive.PruneContext(rc.stopping, dir, retention)
 			if err != nil {
-				rc.logger.Fatal("Handler thread failed", zap.Error(err))
+				rc.logger.Warn("Unable to prune output directory", zap.String("dir", dir), zap.Error(err))
+				continue
 			}
-		}(i)
+			var size int64
+			for _, entry := range pruned {
+				size += entry.Size
+			}
+			if len(pruned) > 0 {
+				rc.logger.Info("Pruned output directory", zap.String("dir", dir),
+					zap.Int("files", len(pruned)), zap.Int64("bytes", size),
+					zap.Duration("retention", retention))
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-rc.stopping.Done():
+			return
+		}
 	}
-
 }
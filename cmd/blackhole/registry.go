@@ -0,0 +1,152 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/adobe/blackhole/lib/notify"
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// session is what this run of blackhole recorded, as written to the
+// manifest and served by the admin API
+type session struct {
+	Host    string         `json:"host"`
+	Output  string         `json:"output"`
+	Started time.Time      `json:"started"`
+	Ended   *time.Time     `json:"ended,omitempty"` // once the recorder stopped
+	Files   []notify.Event `json:"files"`
+}
+
+// fileRegistry keeps track of the archive files finalized (renamed or
+// uploaded) in this run. It is fed the same events as notifiers.
+type fileRegistry struct {
+	mu       sync.Mutex
+	s        session
+	manifest string // local file the session is written to, "" for none
+}
+
+func newFileRegistry(outDir string, manifest string) *fileRegistry {
+	host, _ := os.Hostname()
+	return &fileRegistry{
+		s:        session{Host: host, Output: outDir, Started: time.Now(), Files: []notify.Event{}},
+		manifest: manifest,
+	}
+}
+
+// Notify adds a finalized file, and updates the manifest
+func (fr *fileRegistry) Notify(ev notify.Event) error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.s.Files = append(fr.s.Files, ev)
+	return fr.save()
+}
+
+// close marks the session ended, once the recorder is stopped
+func (fr *fileRegistry) close() error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	now := time.Now()
+	fr.s.Ended = &now
+	return fr.save()
+}
+
+// save writes the manifest, replacing the previous one at once so readers
+// never see half of it
+func (fr *fileRegistry) save() error {
+	if fr.manifest == "" {
+		return nil
+	}
+	buf, err := json.MarshalIndent(&fr.s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := fr.manifest + ".tmp"
+	err = ioutil.WriteFile(tmp, append(buf, '\n'), 0644)
+	if err == nil {
+		err = os.Rename(tmp, fr.manifest)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Unable to write manifest %s", fr.manifest)
+	}
+	return nil
+}
+
+// snapshot returns the session with the files finalized after `since`
+func (fr *fileRegistry) snapshot(since time.Time) session {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	s := fr.s
+	s.Files = make([]notify.Event, 0, len(fr.s.Files))
+	for _, ev := range fr.s.Files {
+		if ev.FinalizedAt.After(since) {
+			s.Files = append(s.Files, ev)
+		}
+	}
+	return s
+}
+
+// handleAdmin serves the admin API:
+//
+//	GET /files              the session, with every file finalized so far
+//	GET /files?since=<time> only files finalized after <time> (RFC 3339)
+func (fr *fileRegistry) handleAdmin(ctx *fasthttp.RequestCtx) {
+
+	if string(ctx.Path()) != "/files" {
+		ctx.Error("Not found", fasthttp.StatusNotFound)
+		return
+	}
+	if !ctx.IsGet() {
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	var since time.Time
+	if v := ctx.QueryArgs().Peek("since"); len(v) > 0 {
+		var err error
+		since, err = time.Parse(time.RFC3339Nano, string(v))
+		if err != nil {
+			ctx.Error("Bad since, expected RFC 3339 time: "+err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+	}
+	s := fr.snapshot(since)
+	ctx.SetContentType("application/json")
+	enc := json.NewEncoder(ctx)
+	enc.SetIndent("", "  ")
+	enc.Encode(&s)
+}
+
+// startAdmin serves the admin API on `addr` (host:port) until shutDown
+func startAdmin(rc *runtimeContext, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to listen on admin address %s", addr)
+	}
+	rc.admin = &fasthttp.Server{Handler: rc.registry.handleAdmin}
+	go func() {
+		err := rc.admin.Serve(ln)
+		if err != nil {
+			rc.logger.Error("Admin API failed", zap.Error(err))
+		}
+	}()
+	rc.logger.Info("Admin API", zap.String("address", ln.Addr().String()))
+	return nil
+}
@@ -13,29 +13,43 @@ governing permissions and limitations under the License.
 /*
 `replay` replays an archive of requests to a different target host. The archive must have been recorded via `blackhole`
 
- Usage of ./replay:
-      --block-profile             (for debug only) Block profile this run
-      --cpu-profile               (for debug only) CPU profile this run
-  -n, --dryrun                    Unpack and show what is in this file, don't run it
-  -x, --exit-on-error             Exit on first error
-  -f, --extract-to-file           Extract requests to one file per request. Please use this only with -r limit or -i options
-      --mem-profile               (for debug only) MEM profile this run
-  -m, --min-delay int             Minimum time in milliseconds to wait before the next request is sent. 0 means no wait. Actual wait till will be max(min-delay, actual-delay)
-      --mutex-profile             (for debug only) Mutex profile this run
-  -o, --output-directory string   Output directory if -f is used (default ".")
-  -q, --quiet                     Run quietly and print only errors
-  -i, --reqid string              Run only this particular request identified by an exchange specific format (do dryrun first to see the ids)
-  -r, --reqs int                  Send only N requests to the bidder (instead of everything from the file)
-  -H, --target-host-port string   Send requests to this host. Example locahost, localhost:8080, host.domain.com
-      --test                      Test integrity of the file. Print ID of each request.
-  -t, --threads int               Number of request threads (parallel) (default 5)
-
+	Usage of ./replay:
+	     --block-profile             (for debug only) Block profile this run
+	     --cpu-profile               (for debug only) CPU profile this run
+	     --dedupe                    Skip requests whose method, URI and body were already sent in this run
+	     --download-ahead int        Download up to this many remote archives in parallel, ahead of the one replayed (0 - one at a time)
+	     --download-bandwidth int    Cap downloads of s3:// and az:// archives at this many MB/s, all together (0 - no limit)
+	 -n, --dryrun                    Unpack and show what is in this file, don't run it
+	 -x, --exit-on-error             Exit on first error
+	 -f, --extract-to-file           Extract requests to one file per request. Please use this only with -r limit or -i options
+	     --mem-profile               (for debug only) MEM profile this run
+	     --max-inflight int          Keep up to this many requests in flight, pipelined over --threads connections, instead of one request per thread (0 - disabled)
+	 -m, --min-delay int             Minimum time in milliseconds to wait before the next request is sent. 0 means no wait. Actual wait till will be max(min-delay, actual-delay)
+	     --mmap                      Memory map local uncompressed archives instead of reading them
+	     --mutex-profile             (for debug only) Mutex profile this run
+	 -o, --output-directory string   Output directory if -f is used (default ".")
+	 -P, --parallel int              Read this many archives at once, all feeding the same --threads (default 1)
+	 -q, --quiet                     Run quietly and print only errors
+	 -i, --reqid string              Run only this particular request identified by an exchange specific format (do dryrun first to see the ids)
+	     --report string             Write a JSON summary of the run to this file (also written when interrupted)
+	 -r, --reqs int                  Send only N requests to the bidder (instead of everything from the file)
+	     --skip-corrupt              Log and skip damaged requests (checksum mismatch) instead of stopping at the first one
+	     --s3-concurrency int        Parts of an S3 archive downloaded in parallel (0 - SDK default, 5)
+	     --s3-part-size int          Size in MB of the parts of S3 downloads (0 - SDK default, 5)
+	     --stream                    Read s3:// and az:// archives as they are downloaded, instead of downloading them first
+	 -H, --target-host-port string   Send requests to this host. Example locahost, localhost:8080, host.domain.com
+	     --test                      Test integrity of the file. Print ID of each request.
+	 -t, --threads int               Number of request threads (parallel) (default 5)
+	     --warmup duration           Replay at --warmup-rate for this long before the measured run. Warm-up requests are not counted. Example: 30s
+	     --warmup-rate int           Requests per second during --warmup (default 10)
 */
 package main
 
 import (
 	"log"
+	"time"
 
+	"github.com/adobe/blackhole/lib/replayer"
 	flag "github.com/spf13/pflag"
 )
 
@@ -55,6 +69,19 @@ type cmdArgs struct {
 	quiet            bool
 	extract2file     bool
 	testIntegrity    bool
+	warmup           time.Duration
+	warmupRate       int
+	maxInflight      int
+	dedupe           bool
+	reportFile       string
+	mmap             bool
+	skipCorrupt      bool
+	parallel         int
+	downloadAhead    int
+	downloadMBps     int
+	stream           bool
+	s3Concurrency    int
+	s3PartSizeMB     int
 }
 
 func processCmdline() (args cmdArgs, err error) {
@@ -76,8 +103,16 @@ func processCmdline() (args cmdArgs, err error) {
 		"Number of request threads (parallel)")
 	flag.StringVarP(&args.outputDir, "output-directory", "o", ".",
 		"Output directory if -f is used")
+	flag.IntVarP(&args.parallel, "parallel", "P", 1,
+		"Read this many archives at once, all feeding the same --threads")
 	flag.IntVarP(&args.minDelayMs, "min-delay", "m", 0,
 		"Minimum time in milliseconds to wait before the next request is sent. 0 means no wait. Actual wait till will be max(min-delay, actual-delay)")
+	flag.IntVarP(&args.maxInflight, "max-inflight", "", 0,
+		"Keep up to this many requests in flight, pipelined over --threads connections, instead of one request per thread (0 - disabled)")
+	flag.BoolVarP(&args.dedupe, "dedupe", "", false,
+		"Skip requests whose method, URI and body were already sent in this run")
+	flag.StringVarP(&args.reportFile, "report", "", "",
+		"Write a JSON summary of the run to this file (also written when interrupted)")
 	flag.BoolVarP(&args.dryRun, "dryrun", "n", false,
 		"Unpack and show what is in this file, don't run it")
 	flag.BoolVarP(&args.exitOnFirstError, "exit-on-error", "x", false,
@@ -90,6 +125,24 @@ func processCmdline() (args cmdArgs, err error) {
 		"Extract requests to one file per request. Please use this only with -r limit or -i options")
 	flag.BoolVarP(&args.testIntegrity, "test", "", false,
 		"Test integrity of the file. Print ID of each request.")
+	flag.BoolVarP(&args.skipCorrupt, "skip-corrupt", "", false,
+		"Log and skip damaged requests (checksum mismatch) instead of stopping at the first one")
+	flag.BoolVarP(&args.mmap, "mmap", "", false,
+		"Memory map local uncompressed archives instead of reading them")
+	flag.IntVarP(&args.downloadAhead, "download-ahead", "", 0,
+		"Download up to this many remote archives in parallel, ahead of the one replayed (0 - one at a time)")
+	flag.IntVarP(&args.downloadMBps, "download-bandwidth", "", 0,
+		"Cap downloads of s3:// and az:// archives at this many MB/s, all together (0 - no limit)")
+	flag.BoolVarP(&args.stream, "stream", "", false,
+		"Read s3:// and az:// archives as they are downloaded, instead of downloading them first")
+	flag.IntVarP(&args.s3Concurrency, "s3-concurrency", "", 0,
+		"Parts of an S3 archive downloaded in parallel (0 - SDK default, 5)")
+	flag.IntVarP(&args.s3PartSizeMB, "s3-part-size", "", 0,
+		"Size in MB of the parts of S3 downloads (0 - SDK default, 5)")
+	flag.DurationVarP(&args.warmup, "warmup", "", 0,
+		"Replay at --warmup-rate for this long before the measured run. Warm-up requests are not counted. Example: 30s")
+	flag.IntVarP(&args.warmupRate, "warmup-rate", "", 10,
+		"Requests per second during --warmup")
 
 	flag.Parse()
 
@@ -104,6 +157,29 @@ func processCmdline() (args cmdArgs, err error) {
 		log.Fatalf("Please supply a bidder targetHostPort (unless you are doing a dryrun)")
 	}
 
+	if args.maxInflight > 0 && args.maxInflight < args.numReqThreads {
+		log.Fatalf("--max-inflight must be at least the number of --threads")
+	}
+
+	if args.parallel <= 0 {
+		log.Fatalf("--parallel must be at least 1")
+	}
+
+	if args.downloadAhead < 0 || args.s3Concurrency < 0 || args.s3PartSizeMB < 0 {
+		log.Fatalf("--download-ahead, --s3-concurrency and --s3-part-size can't be negative")
+	}
+
+	if args.warmup > 0 && args.warmupRate <= 0 {
+		log.Fatalf("Please supply a positive --warmup-rate when --warmup is used")
+	}
+	if args.warmup > 0 && args.warmupRate > replayer.MaxWarmupRate {
+		log.Fatalf("--warmup-rate can't be above %d", replayer.MaxWarmupRate)
+	}
+	if args.warmup > 0 && (args.dryRun || args.testIntegrity) {
+		log.Printf("Ignoring --warmup for a dryrun or integrity test")
+		args.warmup = 0
+	}
+
 	if args.extract2file && !(args.numRequests != 0 || args.reqID != "") {
 		log.Fatalf("Please supply a -r or -i option when enabling this flag. Otherwise we will flood filesystem")
 	}
@@ -13,9 +13,13 @@ governing permissions and limitations under the License.
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
 
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/replayer"
 	dprofile "github.com/pkg/profile"
 	flag "github.com/spf13/pflag"
 	"go.uber.org/zap"
@@ -23,7 +27,16 @@ import (
 
 var buildTS string
 
+// exitCode is set by realMain(). Kept separate so deferred calls (profile
+// flush) in realMain() run before os.Exit()
+var exitCode int
+
 func main() {
+	realMain()
+	os.Exit(exitCode)
+}
+
+func realMain() {
 
 	args, err := processCmdline()
 	if err != nil {
@@ -45,21 +58,71 @@ func main() {
 
 	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 100
 
+	// NoShutdownHook: SIGINT is handled by handleInterrupts(), profile is
+	// stopped by the deferred calls once main() returns.
 	if args.cpuProfile {
-		defer dprofile.Start(dprofile.CPUProfile).Stop()
+		defer dprofile.Start(dprofile.CPUProfile, dprofile.NoShutdownHook).Stop()
 	} else if args.memProfile {
-		defer dprofile.Start(dprofile.MemProfile).Stop()
+		defer dprofile.Start(dprofile.MemProfile, dprofile.NoShutdownHook).Stop()
 	} else if args.mutexProfile {
-		defer dprofile.Start(dprofile.MutexProfile).Stop()
+		defer dprofile.Start(dprofile.MutexProfile, dprofile.NoShutdownHook).Stop()
 	} else if args.blockProfile {
-		defer dprofile.Start(dprofile.BlockProfile).Stop()
+		defer dprofile.Start(dprofile.BlockProfile, dprofile.NoShutdownHook).Stop()
 	}
 
-	files := flag.Args()
-	for _, file := range files {
-		err := replayFile(file, &args, logger)
-		if err != nil {
-			log.Fatalf("Playing file %s failed: %v", file, err)
-		}
+	archive.SetS3Download(args.s3Concurrency, int64(args.s3PartSizeMB)<<20)
+	archive.SetBandwidth(0, int64(args.downloadMBps)<<20)
+	var fetcher *archive.Fetcher
+	if args.downloadAhead > 0 && !args.stream {
+		fetcher = archive.NewFetcher(flag.Args(), args.downloadAhead)
+		defer fetcher.Close()
+	}
+
+	rp, err := replayer.New(replayer.Options{
+		TargetHost:       args.targetHost,
+		Threads:          args.numReqThreads,
+		MaxRequests:      args.numRequests,
+		MinDelayMs:       args.minDelayMs,
+		MaxInflight:      args.maxInflight,
+		Dedupe:           args.dedupe,
+		DryRun:           args.dryRun,
+		ExtractToFile:    args.extract2file,
+		OutputDir:        args.outputDir,
+		ReqID:            args.reqID,
+		Quiet:            args.quiet,
+		ExitOnFirstError: args.exitOnFirstError,
+		TestIntegrity:    args.testIntegrity,
+		Warmup:           args.warmup,
+		WarmupRate:       args.warmupRate,
+		Mmap:             args.mmap,
+		SkipCorrupt:      args.skipCorrupt,
+		Parallel:         args.parallel,
+		Fetcher:          fetcher,
+		Stream:           args.stream,
+		Logger:           logger,
+	})
+	if err != nil {
+		log.Fatalf("%+v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleInterrupts(cancel, logger)
+
+	runErr := rp.ReplayArchives(ctx, flag.Args())
+
+	rep := rp.Report(runErr)
+	if args.dedupe {
+		logger.Info("Deduplication",
+			zap.Int("unique", rep.Requests),
+			zap.Int("collapsed", rep.Duplicates))
+	}
+	err = finish(rep, args.reportFile, logger)
+	if err != nil {
+		logger.Error("Report failed", zap.Error(err))
+	}
+	if runErr != nil {
+		logger.Error("FATAL", zap.Error(runErr))
+		exitCode = 1
 	}
 }
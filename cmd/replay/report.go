@@ -0,0 +1,74 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/adobe/blackhole/lib/replayer"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// handleInterrupts stops intake on the first SIGINT/SIGTERM. Requests
+// already handed to workers are allowed to finish so the report is
+// complete and extracted files are not left half-written.
+// A second signal exits immediately.
+func handleInterrupts(cancel context.CancelFunc, logger *zap.Logger) {
+
+	sigChan := make(chan os.Signal, 1) // Docs recommend a buffer of 1
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		s := <-sigChan
+		logger.Warn("Received signal. Draining in-flight requests (send again to exit immediately)",
+			zap.String("signal", s.String()))
+		cancel()
+		s = <-sigChan
+		logger.Error("Received second signal. Exiting now", zap.String("signal", s.String()))
+		os.Exit(1)
+	}()
+}
+
+// finish logs the final report and writes it to `reportFile` (if set)
+func finish(rep *replayer.Report, reportFile string, logger *zap.Logger) (err error) {
+
+	logger.Info("Final report",
+		zap.Int("files", len(rep.Files)),
+		zap.Int("requests", rep.Requests),
+		zap.Int64("sent", rep.Sent),
+		zap.Int64("failed", rep.Failed),
+		zap.Int64("skipped", rep.Skipped),
+		zap.Int("duplicates", rep.Duplicates),
+		zap.Int64("corrupt", rep.Corrupt),
+		zap.Bool("interrupted", rep.Interrupted),
+		zap.Float64("duration-sec", rep.DurationSec))
+
+	if reportFile == "" {
+		return nil
+	}
+	buf, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Unable to encode report")
+	}
+	err = ioutil.WriteFile(reportFile, buf, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to write report to %s", reportFile)
+	}
+	return nil
+}
@@ -3,25 +3,47 @@ module github.com/adobe/blackhole
 go 1.14
 
 require (
+	cloud.google.com/go/bigquery v1.32.0
+	cloud.google.com/go/pubsub v1.21.1
+	cloud.google.com/go/storage v1.22.1
 	github.com/Azure/azure-pipeline-go v0.2.3
 	github.com/Azure/azure-storage-blob-go v0.15.0
+	github.com/Azure/go-autorest/autorest/adal v0.9.13
+	github.com/aws/aws-sdk-go-v2 v1.16.4
 	github.com/aws/aws-sdk-go-v2/config v1.15.5
+	github.com/aws/aws-sdk-go-v2/credentials v1.12.0
 	github.com/aws/aws-sdk-go-v2/feature/s3/manager v1.11.10
+	github.com/aws/aws-sdk-go-v2/service/firehose v1.14.6
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.26.9
+	github.com/aws/aws-sdk-go-v2/service/sns v1.17.5
+	github.com/aws/aws-sdk-go-v2/service/sqs v1.18.4
+	github.com/aws/aws-sdk-go-v2/service/sts v1.16.4
 	github.com/cespare/xxhash v1.1.0
+	github.com/colinmarc/hdfs/v2 v2.1.1
 	github.com/fsnotify/fsnotify v1.5.4 // indirect
+	github.com/gomodule/redigo v1.8.9
 	github.com/google/flatbuffers v2.0.6+incompatible
-	github.com/klauspost/compress v1.15.2 // indirect
+	github.com/klauspost/compress v1.17.0
 	github.com/mitchellh/mapstructure v1.5.0 // indirect
+	github.com/nats-io/nats.go v1.15.0
 	github.com/pelletier/go-toml v1.9.5 // indirect
-	github.com/pierrec/lz4/v4 v4.1.14
+	github.com/pierrec/lz4/v4 v4.1.15
 	github.com/pkg/errors v0.9.1
 	github.com/pkg/profile v1.6.0
+	github.com/pkg/sftp v1.13.5
+	github.com/prometheus/client_golang v1.12.2
+	github.com/prometheus/common v0.32.1
+	github.com/rabbitmq/amqp091-go v1.5.0
+	github.com/segmentio/kafka-go v0.4.39
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.11.0
 	github.com/valyala/fasthttp v1.36.0
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
 	go.uber.org/zap v1.21.0
-	golang.org/x/sys v0.0.0-20220422013727-9388b58f7150 // indirect
+	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d
+	google.golang.org/api v0.76.0
+	google.golang.org/grpc v1.46.0
+	google.golang.org/protobuf v1.28.0
+	gopkg.in/yaml.v2 v2.4.0
 )
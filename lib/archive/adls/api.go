@@ -0,0 +1,212 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package adls
+
+// There is no Data Lake client for the Azure SDK blackhole uses, so the few
+// calls of the Data Lake Storage Gen2 REST API needed (path create, append,
+// flush, rename, read, list and delete) are made directly, through the azblob
+// pipeline: it signs them with the shared key and retries them the same way.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/pkg/errors"
+)
+
+// apiVersion is the x-ms-version of requests
+const apiVersion = "2020-02-10"
+
+// dfsEndpoint is the Data Lake endpoint of an account
+var dfsEndpoint = "https://%s.dfs.core.windows.net"
+
+// dfsClient makes the calls of one storage account
+type dfsClient struct {
+	account string
+	p       pipeline.Pipeline
+}
+
+// pathEntry is an entry of a path listing
+type pathEntry struct {
+	Name          string `json:"name"`
+	IsDirectory   string `json:"isDirectory"` // "true", or missing for files
+	ContentLength string `json:"contentLength"`
+	LastModified  string `json:"lastModified"` // RFC 1123
+}
+
+// apiError is an error response of the service
+type apiError struct {
+	Status int
+	Err    struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("adls: %s (%d): %s", e.Err.Code, e.Status, strings.SplitN(e.Err.Message, "\n", 2)[0])
+}
+
+// isNotFound is true for errors of paths that don't exist
+func isNotFound(err error) bool {
+	apiErr, ok := errors.Cause(err).(*apiError)
+	return ok && apiErr.Status == http.StatusNotFound
+}
+
+// pathURL is the URL of `p` in `filesystem`, with `query`
+func (c *dfsClient) pathURL(filesystem, p string, query url.Values) url.URL {
+
+	u, _ := url.Parse(fmt.Sprintf(dfsEndpoint, c.account))
+	u.Path = "/" + filesystem
+	if p = strings.Trim(p, "/"); p != "" {
+		u.Path += "/" + p
+	}
+	u.RawQuery = query.Encode()
+	return *u
+}
+
+// do sends a request. Responses other than 2xx are returned as *apiError.
+// The caller must close the body of the response returned.
+func (c *dfsClient) do(ctx context.Context, method string, u url.URL, headers http.Header, body []byte) (resp *http.Response, err error) {
+
+	var rs io.ReadSeeker
+	if body != nil {
+		rs = bytes.NewReader(body)
+	}
+	req, err := pipeline.NewRequest(method, u, rs)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create adls request")
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("x-ms-version", apiVersion)
+	req.Header.Set("Content-Length", strconv.Itoa(len(body))) // signed, so set explicitly
+
+	presp, err := c.p.Do(ctx, nil, req)
+	if err != nil {
+		return nil, err
+	}
+	resp = presp.Response()
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		apiErr := &apiError{Status: resp.StatusCode}
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		json.Unmarshal(respBody, apiErr)
+		if apiErr.Err.Code == "" {
+			apiErr.Err.Code = resp.Header.Get("x-ms-error-code")
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+// call is do for calls whose response body is not needed
+func (c *dfsClient) call(ctx context.Context, method string, u url.URL, headers http.Header, body []byte) (err error) {
+
+	resp, err := c.do(ctx, method, u, headers, body)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// createFile creates an empty file, replacing any, and its parent directories
+func (c *dfsClient) createFile(ctx context.Context, filesystem, p string) error {
+	return c.call(ctx, "PUT", c.pathURL(filesystem, p, url.Values{"resource": {"file"}}), nil, nil)
+}
+
+// appendData uploads `data` at `position` of a file, not visible until flush
+func (c *dfsClient) appendData(ctx context.Context, filesystem, p string, position int64, data []byte) error {
+	query := url.Values{"action": {"append"}, "position": {strconv.FormatInt(position, 10)}}
+	return c.call(ctx, "PATCH", c.pathURL(filesystem, p, query), nil, data)
+}
+
+// flush commits what was appended to a file, `length` bytes in all
+func (c *dfsClient) flush(ctx context.Context, filesystem, p string, length int64) error {
+	query := url.Values{"action": {"flush"}, "position": {strconv.FormatInt(length, 10)}}
+	return c.call(ctx, "PATCH", c.pathURL(filesystem, p, query), nil, nil)
+}
+
+// rename moves `src` to `dst` atomically, replacing `dst` if it exists
+func (c *dfsClient) rename(ctx context.Context, filesystem, src, dst string) error {
+	source := c.pathURL(filesystem, src, nil)
+	headers := http.Header{"x-ms-rename-source": {source.EscapedPath()}}
+	return c.call(ctx, "PUT", c.pathURL(filesystem, dst, nil), headers, nil)
+}
+
+// deletePath deletes a file
+func (c *dfsClient) deletePath(ctx context.Context, filesystem, p string) error {
+	return c.call(ctx, "DELETE", c.pathURL(filesystem, p, nil), nil, nil)
+}
+
+// read returns the content of a file. The caller must close it.
+func (c *dfsClient) read(ctx context.Context, filesystem, p string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, "GET", c.pathURL(filesystem, p, nil), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// list returns the paths under directory `dir` (all of the filesystem if
+// empty), recursively
+func (c *dfsClient) list(ctx context.Context, filesystem, dir string) (paths []pathEntry, err error) {
+
+	query := url.Values{"resource": {"filesystem"}, "recursive": {"true"}}
+	if dir = strings.Trim(dir, "/"); dir != "" {
+		query.Set("directory", dir)
+	}
+	for {
+		resp, err := c.do(ctx, "GET", c.pathURL(filesystem, "", query), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Paths []pathEntry `json:"paths"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to decode adls path list")
+		}
+		paths = append(paths, page.Paths...)
+		continuation := resp.Header.Get("x-ms-continuation")
+		if continuation == "" {
+			return paths, nil
+		}
+		query.Set("continuation", continuation)
+	}
+}
+
+// size and modTime of a path entry
+func (e pathEntry) size() int64 {
+	n, _ := strconv.ParseInt(e.ContentLength, 10, 64)
+	return n
+}
+
+func (e pathEntry) modTime() time.Time {
+	t, _ := time.Parse(time.RFC1123, e.LastModified)
+	return t
+}
@@ -0,0 +1,388 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package adls provides archive interface for Azure Data Lake Storage Gen2,
+// i.e. storage accounts with a hierarchical namespace. Unlike with az://,
+// directories are real and renames atomic: files are uploaded under their
+// `.tmp` name and renamed once complete, as the file backend does, so jobs
+// listing a directory never pick up part of a file.
+package adls
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// appendSize is the size of the chunks files are uploaded in
+const appendSize = 8 * 1024 * 1024
+
+// Clients are shared by all archives of an account, so they are created
+// once per process
+var gADLSSession struct {
+	sync.Mutex
+	clients map[string]*dfsClient
+}
+
+var adlsUrlRegex = regexp.MustCompile("^adls://([^/]+)/([^/]+)/?(.*?)$")
+
+type ADLSArchive struct {
+	common.BasicArchive
+	client     *dfsClient
+	filesystem string
+	dir        string
+}
+
+// getClient returns the client of a storage account, creating it the first
+// time. The account key is AZURE_STORAGE_ACCESS_KEY, as for az:// URLs.
+func getClient(account string) (client *dfsClient, err error) {
+
+	gADLSSession.Lock()
+	defer gADLSSession.Unlock()
+	if gADLSSession.clients == nil {
+		gADLSSession.clients = make(map[string]*dfsClient)
+	}
+	client, ok := gADLSSession.clients[account]
+	if !ok {
+		accountKey := os.Getenv("AZURE_STORAGE_ACCESS_KEY")
+		if len(accountKey) == 0 {
+			return nil, errors.New("The AZURE_STORAGE_ACCESS_KEY environment variable is not set")
+		}
+		credential, err := azblob.NewSharedKeyCredential(account, accountKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid credentials")
+		}
+		client = &dfsClient{account: account,
+			p: azblob.NewPipeline(credential,
+				azblob.PipelineOptions{Retry: azblob.RetryOptions{TryTimeout: time.Minute * 10}})}
+		gADLSSession.clients[account] = client
+	}
+	return client, nil
+}
+
+// parseADLSURL splits adls://account/filesystem/some/path
+func parseADLSURL(adlsURL string) (account, filesystem, filePath string, err error) {
+
+	parts := adlsUrlRegex.FindStringSubmatch(adlsURL)
+	if len(parts) != 4 {
+		return "", "", "", errors.Errorf("Unable to parse adls url format (adls://account/filesystem/path): %s", adlsURL)
+	}
+	return parts[1], parts[2], parts[3], nil
+}
+
+// NewArchive creates a new recorder file (for writing). The caller must call
+// `rf.Close()` on the resulting handle to close out the file.
+// File is uploaded to the filesystem after it is flushed to disk and file is
+// closed, then renamed to its final name.
+// `*ADLSArchive` returned is an io.Writer
+func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *ADLSArchive, err error) {
+
+	account, filesystem, dir, err := parseADLSURL(outDir)
+	if err != nil {
+		return nil, err
+	}
+	client, err := getClient(account)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to initialize adls connection")
+	}
+	ba, err := common.NewBasicArchive(
+		"", prefix, extension, options...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to initialize basic archive")
+	}
+
+	rf = &ADLSArchive{BasicArchive: *ba,
+		client:     client,
+		filesystem: filesystem,
+		dir:        dir}
+	rf.Finalizer = rf.finalizeArchive
+
+	err = rf.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return rf, err
+}
+
+// download downloads a file to a new local temporary file
+func download(ctx context.Context, client *dfsClient, filesystem, filePath string, logger *zap.Logger) (localPath string, err error) {
+
+	fp, err := ioutil.TempFile("", fmt.Sprintf("tmp_*_%s", path.Base(filePath)))
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to create temp file")
+	}
+	defer fp.Close()
+
+	logger.Debug("ADLS Download [BEGIN]",
+		zap.String("remote", filePath),
+		zap.String("local", fp.Name()))
+
+	body, err := client.read(ctx, filesystem, filePath)
+	if err == nil {
+		_, err = io.Copy(fp, body)
+		body.Close()
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return "", errors.Wrapf(err, "unable to download archive file: %s", filePath)
+	}
+
+	logger.Debug("ADLS Download [END]",
+		zap.String("remote", filePath),
+		zap.String("local", fp.Name()))
+
+	return fp.Name(), nil
+}
+
+// upload uploads a local file to `remotePath` of the filesystem. The file is
+// written under a `.tmp` name and renamed once complete.
+func upload(ctx context.Context, localPath string, client *dfsClient, filesystem, remotePath string, logger *zap.Logger) (err error) {
+
+	fp, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to reopen archive file: %s", localPath)
+	}
+	defer fp.Close()
+
+	logger.Debug("ADLS Upload [BEGIN]",
+		zap.String("local", localPath),
+		zap.String("remote", remotePath))
+
+	tmpPath := remotePath + ".tmp"
+	err = client.createFile(ctx, filesystem, tmpPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create adls file: %s", tmpPath)
+	}
+	var position int64
+	buf := make([]byte, appendSize)
+	for {
+		n, rerr := io.ReadFull(fp, buf)
+		if n > 0 {
+			err = client.appendData(ctx, filesystem, tmpPath, position, buf[:n])
+			if err != nil {
+				break
+			}
+			position += int64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			err = rerr
+			break
+		}
+	}
+	if err == nil {
+		err = client.flush(ctx, filesystem, tmpPath, position)
+	}
+	if err == nil {
+		err = client.rename(ctx, filesystem, tmpPath, remotePath)
+	}
+	if err != nil {
+		client.deletePath(ctx, filesystem, tmpPath)
+		return errors.Wrapf(err, "unable to upload archive file: %s", remotePath)
+	}
+
+	logger.Info("ADLS Upload [END]",
+		zap.String("local", localPath),
+		zap.String("remote", remotePath),
+		zap.Int64("bytes", position))
+	return nil
+}
+
+// OpenArchive opens an archive file for reading. `*ADLSArchive` returned is an io.Reader
+func OpenArchive(fileName string, bufferSize int) (rf *ADLSArchive, err error) {
+	return OpenArchiveContext(context.Background(), fileName, bufferSize)
+}
+
+// OpenArchiveContext is OpenArchive, downloading the file with `ctx`
+func OpenArchiveContext(ctx context.Context, fileName string, bufferSize int) (rf *ADLSArchive, err error) {
+
+	localPath, _, err := FetchContext(ctx, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	rfi, err := common.OpenArchive(localPath, bufferSize, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to open downloaded adls file")
+	}
+	return &ADLSArchive{BasicArchive: *rfi}, nil
+}
+
+// Fetch downloads fileName to a local temporary file. Caller must
+// remove localPath when done (`temporary` is always true)
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return FetchContext(context.Background(), fileName)
+}
+
+// FetchContext is Fetch, downloading the file with `ctx`
+func FetchContext(ctx context.Context, fileName string) (localPath string, temporary bool, err error) {
+
+	account, filesystem, filePath, err := parseADLSURL(fileName)
+	if err != nil {
+		return "", false, err
+	}
+	client, err := getClient(account)
+	if err != nil {
+		return "", false, errors.Wrap(err, "Unable to initialize adls connection")
+	}
+	localPath, err = download(ctx, client, filesystem, filePath, common.DefaultLogger)
+	if err != nil {
+		return "", false, err
+	}
+	return localPath, true, nil
+}
+
+// Store uploads the local file into directory `dir` keeping the same base name
+func Store(localPath, dir string) (err error) {
+	return StoreContext(context.Background(), localPath, dir)
+}
+
+// StoreContext is Store, uploading the file with `ctx`
+func StoreContext(ctx context.Context, localPath, dir string) (err error) {
+
+	account, filesystem, subDir, err := parseADLSURL(dir)
+	if err != nil {
+		return err
+	}
+	client, err := getClient(account)
+	if err != nil {
+		return errors.Wrap(err, "Unable to initialize adls connection")
+	}
+	return upload(ctx, localPath, client, filesystem, path.Join(subDir, path.Base(localPath)), common.DefaultLogger)
+}
+
+func List(dir string) (files []string, err error) {
+	return ListContext(context.Background(), dir)
+}
+
+// ListContext is List, with the requests made with `ctx`
+func ListContext(ctx context.Context, dir string) (files []string, err error) {
+
+	entries, err := ListDetailsContext(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		files = append(files, entry.Name)
+	}
+	return files, err
+}
+
+// ListDetails is like List, but includes size and modification time.
+// Names are relative to `dir`, which is listed recursively.
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+	return ListDetailsContext(context.Background(), dir)
+}
+
+// ListDetailsContext is ListDetails, with the requests made with `ctx`
+func ListDetailsContext(ctx context.Context, dir string) (entries []common.ArchiveEntry, err error) {
+
+	account, filesystem, subDir, err := parseADLSURL(dir)
+	if err != nil {
+		return nil, err
+	}
+	client, err := getClient(account)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to initialize adls connection")
+	}
+
+	paths, err := client.list(ctx, filesystem, subDir)
+	if isNotFound(err) {
+		return nil, nil // no such directory, nothing in it
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to list adls directory %s", dir)
+	}
+	prefix := strings.Trim(subDir, "/")
+	for _, p := range paths {
+		if p.IsDirectory == "true" {
+			continue
+		}
+		name := strings.TrimPrefix(p.Name, prefix)
+		entries = append(entries, common.ArchiveEntry{
+			Name:    strings.TrimPrefix(name, "/"),
+			Size:    p.size(),
+			ModTime: p.modTime()})
+	}
+	return entries, nil
+}
+
+// Delete removes files, named as returned by List, from directory `dir`
+func Delete(dir string, files []string) (err error) {
+	return DeleteContext(context.Background(), dir, files)
+}
+
+// DeleteContext is Delete, with the requests made with `ctx`
+func DeleteContext(ctx context.Context, dir string, files []string) (err error) {
+
+	account, filesystem, subDir, err := parseADLSURL(dir)
+	if err != nil {
+		return err
+	}
+	client, err := getClient(account)
+	if err != nil {
+		return errors.Wrap(err, "Unable to initialize adls connection")
+	}
+	for _, fileName := range files {
+		err = client.deletePath(ctx, filesystem, path.Join(subDir, fileName))
+		if err != nil {
+			return errors.Wrapf(err, "Unable to delete adls file: %s", fileName)
+		}
+		fmt.Printf("DELETED: %s\n", fileName)
+	}
+	return nil
+}
+
+// finalizeArchive is the companion function to CreateArchiveFile().
+// finalize will upload to the filesystem and rename into place.
+func (rf *ADLSArchive) finalizeArchive() (finalFile common.ArchiveFileDetails, err error) {
+
+	filePath := rf.Name()
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return finalFile, errors.Wrapf(err, "unable to stat file %s", filePath)
+	}
+	finalPath := path.Join(rf.dir, rf.FinalName())
+	finalFile.FileName = rf.FinalName() // with the directories of FilenameTemplate, if any
+	finalFile.URL = fmt.Sprintf("adls://%s/%s/%s", rf.client.account, rf.filesystem, finalPath)
+	finalFile.BytesWritten = fi.Size()
+	finalFile.ChunksWritten = rf.ChunksWritten
+
+	err = upload(rf.Context(), filePath, rf.client, rf.filesystem, finalPath, rf.Logger)
+	if err != nil {
+		return finalFile, err
+	}
+	rf.StoreIndex(func(indexPath string) error {
+		return upload(rf.Context(), indexPath, rf.client, rf.filesystem, finalPath+common.IndexExt, rf.Logger)
+	})
+
+	err = os.Remove(filePath)
+	if err != nil {
+		return finalFile, errors.Wrapf(err, "unable to remove archive file %s after uploading to adls", filePath)
+	}
+
+	return finalFile, err
+}
@@ -0,0 +1,310 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package adls
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"go.uber.org/zap"
+)
+
+// setenv sets an environment variable for the test
+func setenv(t *testing.T, name, value string) {
+	saved, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, saved)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+// fakeDFS is the Data Lake API of one filesystem: files are visible once
+// flushed, and listed one per page
+type fakeDFS struct {
+	mu         sync.Mutex
+	filesystem string
+	files      map[string][]byte
+	pending    map[string][]byte
+	failRename bool
+}
+
+func (f *fakeDFS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !strings.HasPrefix(r.URL.Path+"/", "/"+f.filesystem+"/") {
+		f.error(w, http.StatusNotFound, "FilesystemNotFound")
+		return
+	}
+	p := strings.Trim(strings.TrimPrefix(r.URL.Path, "/"+f.filesystem), "/")
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPut && query.Get("resource") == "file":
+		f.pending[p] = []byte{}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && r.Header.Get("x-ms-rename-source") != "":
+		src := strings.TrimPrefix(r.Header.Get("x-ms-rename-source"), "/"+f.filesystem+"/")
+		data, ok := f.files[src]
+		if f.failRename {
+			f.error(w, http.StatusConflict, "RenameDestinationParentPathNotFound")
+			return
+		}
+		if !ok {
+			f.error(w, http.StatusNotFound, "SourcePathNotFound")
+			return
+		}
+		delete(f.files, src)
+		f.files[p] = data
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPatch && query.Get("action") == "append":
+		data, _ := ioutil.ReadAll(r.Body)
+		if position, _ := strconv.Atoi(query.Get("position")); position != len(f.pending[p]) {
+			f.error(w, http.StatusBadRequest, "InvalidAppendPosition")
+			return
+		}
+		f.pending[p] = append(f.pending[p], data...)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPatch && query.Get("action") == "flush":
+		if position, _ := strconv.Atoi(query.Get("position")); position != len(f.pending[p]) {
+			f.error(w, http.StatusBadRequest, "InvalidFlushPosition")
+			return
+		}
+		f.files[p] = f.pending[p]
+		delete(f.pending, p)
+	case r.Method == http.MethodDelete:
+		if _, ok := f.files[p]; !ok {
+			f.error(w, http.StatusNotFound, "PathNotFound")
+			return
+		}
+		delete(f.files, p)
+	case r.Method == http.MethodGet && query.Get("resource") == "filesystem":
+		f.list(w, query)
+	case r.Method == http.MethodGet:
+		data, ok := f.files[p]
+		if !ok {
+			f.error(w, http.StatusNotFound, "PathNotFound")
+			return
+		}
+		w.Write(data)
+	default:
+		f.error(w, http.StatusBadRequest, "UnexpectedRequest")
+	}
+}
+
+// list writes the page of the listing starting at the continuation token:
+// files, and the directories they are in
+func (f *fakeDFS) list(w http.ResponseWriter, query map[string][]string) {
+
+	dir := ""
+	if d := query["directory"]; len(d) > 0 {
+		dir = d[0] + "/"
+	}
+	seen := map[string]bool{}
+	var paths []pathEntry
+	for name, data := range f.files {
+		if !strings.HasPrefix(name, dir) {
+			continue
+		}
+		if d := filepath.Dir(name); d != "." && !seen[d] {
+			seen[d] = true
+			paths = append(paths, pathEntry{Name: d, IsDirectory: "true"})
+		}
+		paths = append(paths, pathEntry{Name: name, ContentLength: strconv.Itoa(len(data)),
+			LastModified: time.Now().UTC().Format(http.TimeFormat)})
+	}
+	if len(paths) == 0 && dir != "" {
+		f.error(w, http.StatusNotFound, "PathNotFound")
+		return
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i].Name < paths[j].Name })
+	start := 0
+	if c := query["continuation"]; len(c) > 0 {
+		start, _ = strconv.Atoi(c[0])
+	}
+	if start+1 < len(paths) {
+		w.Header().Set("x-ms-continuation", strconv.Itoa(start+1))
+	}
+	json.NewEncoder(w).Encode(map[string][]pathEntry{"paths": paths[start : start+1]})
+}
+
+func (f *fakeDFS) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{"code": code, "message": code + "\nRequestId:1"}})
+}
+
+// withFakeDFS has the clients send their requests to `f` for the test
+func withFakeDFS(t *testing.T, f *fakeDFS) {
+
+	srv := httptest.NewServer(f)
+	setenv(t, "AZURE_STORAGE_ACCESS_KEY", "a2V5")
+	saved := dfsEndpoint
+	dfsEndpoint = srv.URL + "/%s" // the path is replaced by that of the filesystem
+	gADLSSession.Lock()
+	gADLSSession.clients = nil
+	gADLSSession.Unlock()
+	t.Cleanup(func() {
+		srv.Close()
+		dfsEndpoint = saved
+		gADLSSession.Lock()
+		gADLSSession.clients = nil
+		gADLSSession.Unlock()
+	})
+}
+
+func TestParseADLSURL(t *testing.T) {
+
+	tests := []struct {
+		url, account, filesystem, path string
+		err                            bool
+	}{
+		{"adls://account/fs/captures/2021", "account", "fs", "captures/2021", false},
+		{"adls://account/fs/", "account", "fs", "", false},
+		{"adls://account/fs", "account", "fs", "", false},
+		{"adls://account", "", "", "", true},
+		{"az://account/fs/captures", "", "", "", true},
+	}
+	for _, tt := range tests {
+		account, filesystem, filePath, err := parseADLSURL(tt.url)
+		if account != tt.account || filesystem != tt.filesystem || filePath != tt.path || (err != nil) != tt.err {
+			t.Fatalf("%s: got %q, %q, %q, %v", tt.url, account, filesystem, filePath, err)
+		}
+	}
+}
+
+func TestGetClientNoKey(t *testing.T) {
+
+	withFakeDFS(t, &fakeDFS{})
+	setenv(t, "AZURE_STORAGE_ACCESS_KEY", "")
+	if _, err := getClient("account"); err == nil {
+		t.Fatal("no error without an account key")
+	}
+}
+
+// Archives are renamed into place once uploaded, then listed, fetched and
+// deleted
+func TestArchive(t *testing.T) {
+
+	f := &fakeDFS{filesystem: "fs", files: map[string][]byte{"captures-old/kept.fbf": []byte("kept")},
+		pending: map[string][]byte{}}
+	withFakeDFS(t, f)
+	rf, err := NewArchive("adls://account/fs/captures", "requests", ".fbf",
+		common.Logger(zap.NewNop()), common.Compress(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rf.Write([]byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	finalized := rf.FinalizedFiles()
+	if len(finalized) != 1 {
+		t.Fatalf("got %+v", finalized)
+	}
+	var details common.ArchiveFileDetails
+	for _, details = range finalized {
+	}
+	name := "captures/" + details.FileName
+	if details.URL != "adls://account/fs/"+name || string(f.files[name]) != "content" ||
+		len(f.files) != 2 || len(f.pending) != 0 {
+		t.Fatalf("got %+v, files %q, pending %q", details, f.files, f.pending)
+	}
+
+	// Names relative to the directory, directories left out
+	if err = Store(writeFile(t, "requests_1.fbf", "stored"), "adls://account/fs/captures/2021"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ListDetails("adls://account/fs/captures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name != "2021/requests_1.fbf" || entries[0].Size != 6 ||
+		entries[1].Name != details.FileName || entries[1].Size != 7 || entries[1].ModTime.IsZero() {
+		t.Fatalf("listed %+v", entries)
+	}
+
+	localPath, temporary, err := Fetch(details.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(localPath)
+	if data, _ := ioutil.ReadFile(localPath); !temporary || string(data) != "content" {
+		t.Fatalf("fetched %q to %s", data, localPath)
+	}
+	if err = Delete("adls://account/fs/captures", []string{details.FileName, "2021/requests_1.fbf"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.files) != 1 {
+		t.Fatalf("left %q", f.files)
+	}
+	if _, _, err = Fetch(details.URL); !isNotFound(err) {
+		t.Fatalf("fetched a deleted file: %v", err)
+	}
+	if files, err := List("adls://account/fs/captures"); err != nil || len(files) != 0 {
+		t.Fatalf("listed %q, %v in a missing directory", files, err)
+	}
+}
+
+// What was uploaded under the temporary name is removed when the rename fails
+func TestUploadFailed(t *testing.T) {
+
+	f := &fakeDFS{filesystem: "fs", files: map[string][]byte{}, pending: map[string][]byte{}, failRename: true}
+	withFakeDFS(t, f)
+	err := Store(writeFile(t, "requests_1.fbf", "stored"), "adls://account/fs/captures")
+	if err == nil || !strings.Contains(err.Error(), "RenameDestinationParentPathNotFound (409)") {
+		t.Fatalf("got %v", err)
+	}
+	if len(f.files) != 0 || len(f.pending) != 0 {
+		t.Fatalf("left %q, pending %q", f.files, f.pending)
+	}
+
+	// No such filesystem
+	f.failRename = false
+	err = Store(writeFile(t, "requests_1.fbf", "stored"), "adls://account/other/captures")
+	if err == nil || !strings.Contains(err.Error(), "FilesystemNotFound (404)") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// writeFile writes a local file, removed at the end of the test
+func writeFile(t *testing.T, name, content string) string {
+
+	dir, err := ioutil.TempDir("", "adls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	localPath := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(localPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return localPath
+}
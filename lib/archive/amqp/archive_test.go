@@ -0,0 +1,75 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package amqp
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"go.uber.org/zap"
+)
+
+func TestParseAMQPURL(t *testing.T) {
+
+	tests := []struct {
+		url, broker, exchange string
+		err                   bool
+	}{
+		{"amqp://u:p@rabbit/%2F/requests", "amqp://u:p@rabbit/%2F", "requests", false},
+		{"amqp://rabbit:5672//requests", "amqp://rabbit:5672/%2F", "requests", false},
+		{"amqps://rabbit/capture/bid%2Fv2", "amqps://rabbit/capture", "bid/v2", false},
+		{"amqp://rabbit/requests", "", "", true},
+		{"amqp://rabbit/vhost/", "", "", true},
+		{"amqp://rabbit/vhost/a/b", "", "", true},
+		{"amqp:///vhost/requests", "", "", true},
+	}
+	for _, tt := range tests {
+		broker, exchange, err := parseAMQPURL(tt.url)
+		if broker != tt.broker || exchange != tt.exchange || (err != nil) != tt.err {
+			t.Fatalf("%s: got %q, %q, %v", tt.url, broker, exchange, err)
+		}
+	}
+}
+
+func TestRoutingKey(t *testing.T) {
+
+	tests := []struct {
+		uri, key string
+	}{
+		{"/bid/v2?x=1", "bid.v2"},
+		{"/bid/v2/#top", "bid.v2"},
+		{"/", ""},
+		{"events", "events"},
+		{"/" + strings.Repeat("a", maxKeyLen+10), strings.Repeat("a", maxKeyLen)},
+	}
+	for _, tt := range tests {
+		if key := routingKey([]byte(tt.uri)); key != tt.key {
+			t.Fatalf("%s: got %q, want %q", tt.uri, key, tt.key)
+		}
+	}
+}
+
+func TestNewArchiveUnreachable(t *testing.T) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	if _, err = NewArchive("amqp://"+addr+"//requests", "requests", ".fbf", common.Logger(zap.NewNop())); err == nil {
+		t.Fatal("no error")
+	}
+}
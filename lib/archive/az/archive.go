@@ -16,12 +16,11 @@ package az
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"net/url"
 	"os"
 	"path"
 	"regexp"
-	"strings"
 	"sync"
 	"time"
 
@@ -35,13 +34,16 @@ import (
 )
 
 var gAZSession struct {
-	sync.Mutex  // Used only for writing. Not for reading
-	accountName string
-	azPipeline  pipeline.Pipeline
+	sync.Mutex // Used only for writing. Not for reading
+	serviceURL azblob.ServiceURL
+	azPipeline pipeline.Pipeline
 }
 
 var azUrlRegex = regexp.MustCompile("([^/:]+)://([^/]+)/(.*?)$")
 
+// Bandwidth of uploads and downloads, see SetThrottle. Nil - no limit.
+var uploadThrottle, downloadThrottle *common.Throttle
+
 type AZArchive struct {
 	common.BasicArchive
 	containerName string
@@ -53,20 +55,15 @@ func azInit() (err error) {
 	defer gAZSession.Unlock()
 	if gAZSession.azPipeline == nil {
 
-		accountName, accountKey := os.Getenv("AZURE_STORAGE_ACCOUNT"), os.Getenv("AZURE_STORAGE_ACCESS_KEY")
-		gAZSession.accountName = accountName
-		if len(accountName) == 0 || len(accountKey) == 0 {
-			return errors.New("Either the AZURE_STORAGE_ACCOUNT or AZURE_STORAGE_ACCESS_KEY environment variable is not set")
-		}
-
-		// Create a default request pipeline using your storage account name and account key.
-		credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+		// Shared key, SAS token or Azure AD credential, see newCredential
+		credential, serviceURL, err := newCredential()
 		if err != nil {
-			return errors.Wrapf(err, "Invalid credentials")
+			return err
 		}
 
 		gAZSession.azPipeline = azblob.NewPipeline(credential,
 			azblob.PipelineOptions{Retry: azblob.RetryOptions{TryTimeout: time.Minute * 10}})
+		gAZSession.serviceURL = azblob.NewServiceURL(*serviceURL, gAZSession.azPipeline)
 
 	}
 	return err
@@ -108,6 +105,29 @@ func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicA
 	return rf, err
 }
 
+// SetThrottle caps the bandwidth of uploads and downloads from now on (nil
+// - no limit), see s3f.SetThrottle. Not goroutine safe: meant to be called
+// once, before anything is transferred.
+func SetThrottle(upload, download *common.Throttle) {
+	uploadThrottle = upload
+	downloadThrottle = download
+}
+
+// throttledProgress is the Progress function of an azblob transfer: it
+// passes the bytes transferred so far on to statChan, and holds the transfer
+// back as long as `t` requires. azblob calls it as request bodies are read,
+// one call at a time.
+func throttledProgress(ctx context.Context, t *common.Throttle, statChan chan int64) func(int64) {
+	var prior int64
+	return func(bytesTransferred int64) {
+		statChan <- bytesTransferred
+		if bytesTransferred > prior { // less if a request is retried
+			t.Wait(ctx, int(bytesTransferred-prior)) // the transfer fails as well if ctx is done
+		}
+		prior = bytesTransferred
+	}
+}
+
 func getContainer(fullPath string) (cu azblob.ContainerURL, rest string, err error) {
 
 	err = azInit()
@@ -117,74 +137,271 @@ func getContainer(fullPath string) (cu azblob.ContainerURL, rest string, err err
 
 	parts := azUrlRegex.FindStringSubmatch(fullPath)
 	if len(parts) != 4 { // must be exactly 4 parts
-		return cu, "", errors.Wrap(err, "Unable to parse azure blob url format")
+		return cu, "", errors.Errorf("Unable to parse azure blob url format: %s", fullPath)
 	}
 
 	containerName, rest := parts[2], parts[3]
-
-	// From the Azure portal, get your storage account blob service URL endpoint.
-	URL, _ := url.Parse(
-		fmt.Sprintf("https://%s.blob.core.windows.net/%s", gAZSession.accountName, containerName))
-
-	cu = azblob.NewContainerURL(*URL, gAZSession.azPipeline)
-	return cu, rest, err
+	return gAZSession.serviceURL.NewContainerURL(containerName), rest, err
 
 }
 
-// OpenArchive opens an archive file for reading. `*AZArchive` returned is an io.Reader
-func OpenArchive(fileName string, bufferSize int) (rf *AZArchive, err error) {
-
-	azContainerURL, filePath, err := getContainer(fileName)
-	if err != nil {
-		return nil, errors.Wrap(err, "Unable to initialize azure connection")
-	}
+// download downloads a blob to a new local temporary file
+func download(ctx context.Context, azContainerURL azblob.ContainerURL, filePath string, logger *zap.Logger) (localPath string, err error) {
 
 	blobURL := azContainerURL.NewBlobURL(filePath)
 
 	fp, err := ioutil.TempFile("", fmt.Sprintf("tmp_*_%s", path.Base(filePath)))
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to create temp file")
+		return "", errors.Wrapf(err, "unable to create temp file")
 	}
-	props, err := blobURL.GetProperties(context.Background(), azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	defer fp.Close()
+
+	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to stat blobstore file")
+		os.Remove(fp.Name())
+		return "", errors.Wrapf(err, "unable to stat blobstore file")
 	}
 	fileSize := props.ContentLength()
 
-	rf.Logger.Debug("Azure Download [BEGIN]",
-		zap.String("local", filePath),
+	logger.Debug("Azure Download [BEGIN]",
+		zap.String("remote", filePath),
 		zap.Int64("size", fileSize),
-		zap.String("remote", fp.Name()))
+		zap.String("local", fp.Name()))
 
 	var statChan = make(chan int64)
 	var wg sync.WaitGroup
 	wg.Add(1)
-	go rf.ProgressPrinter(statChan, filePath, fileSize, &wg)
+	go common.ProgressPrinter(logger, statChan, filePath, fileSize, &wg)
+
+	err = azblob.DownloadBlobToFile(ctx, blobURL, 0, 0, fp, azblob.DownloadFromBlobOptions{
+		Progress: throttledProgress(ctx, downloadThrottle, statChan)})
+	close(statChan)
+	wg.Wait() // Waiting for status monitor to exit
+	if err != nil {
+		os.Remove(fp.Name())
+		return "", errors.Wrapf(err, "unable to download file: %s", filePath)
+	}
+
+	logger.Debug("Azure Download [END]",
+		zap.String("remote", filePath),
+		zap.Int64("size", fileSize),
+		zap.String("local", fp.Name()))
+
+	return fp.Name(), nil
+}
+
+// upload uploads a local file as block blob `remotePath` in the container
+func upload(ctx context.Context, localPath string, azContainerURL azblob.ContainerURL, remotePath string, logger *zap.Logger) (err error) {
 
-	err = azblob.DownloadBlobToFile(context.Background(), blobURL, 0, 0, fp, azblob.DownloadFromBlobOptions{
-		Progress: func(bytesTransferred int64) {
-			statChan <- bytesTransferred
-		}})
+	fi, err := os.Stat(localPath)
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to download file: %s", filePath)
+		return errors.Wrapf(err, "unable to stat file %s", localPath)
 	}
+	fileSize := fi.Size()
+
+	blockBlobURL := azContainerURL.NewBlockBlobURL(remotePath)
+
+	fp, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to reopen archive file: %s", localPath)
+	}
+	defer fp.Close()
+
+	logger.Debug("Azure Upload [BEGIN]",
+		zap.String("local", localPath),
+		zap.String("remote", remotePath))
+
+	var statChan = make(chan int64)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go common.ProgressPrinter(logger, statChan, localPath, fileSize, &wg)
 
+	_, err = azblob.UploadFileToBlockBlob(ctx, fp, blockBlobURL, azblob.UploadToBlockBlobOptions{
+		BlockSize:   4 * 1024 * 1024,
+		Parallelism: 4,
+		Progress:    throttledProgress(ctx, uploadThrottle, statChan)})
 	close(statChan)
 	wg.Wait() // Waiting for status monitor to exit
+	if err != nil {
+		return errors.Wrapf(err, "ERROR: Blobstore upload error for: %s", localPath)
+	}
 
-	rf.Logger.Debug("Azure Download [END]",
-		zap.String("local", filePath),
-		zap.Int64("size", fileSize),
-		zap.String("remote", fp.Name()))
+	logger.Info("Azure Upload [END]",
+		zap.String("local", localPath),
+		zap.String("remote", remotePath),
+		zap.Int64("bytes", fileSize))
+	return nil
+}
+
+// OpenArchive opens an archive file for reading. `*AZArchive` returned is an io.Reader
+func OpenArchive(fileName string, bufferSize int) (rf *AZArchive, err error) {
+	return OpenArchiveContext(context.Background(), fileName, bufferSize)
+}
+
+// OpenArchiveContext is OpenArchive, downloading the file with `ctx`
+func OpenArchiveContext(ctx context.Context, fileName string, bufferSize int) (rf *AZArchive, err error) {
+
+	localPath, _, err := FetchContext(ctx, fileName)
+	if err != nil {
+		return nil, err
+	}
 
-	rfi, err := common.OpenArchive(fp.Name(), bufferSize, true)
+	rfi, err := common.OpenArchive(localPath, bufferSize, true)
 	if err != nil {
 		return nil, errors.Wrap(err, "Unable to initialize s3 connection")
 	}
 	return &AZArchive{BasicArchive: *rfi}, nil
 }
 
+// OpenStream opens an archive file for reading as it is downloaded, with
+// ranged GETs, instead of downloading it first, see common.OpenStream.
+// `*AZArchive` returned is an io.Reader
+func OpenStream(fileName string, bufferSize int) (rf *AZArchive, err error) {
+	return OpenStreamContext(context.Background(), fileName, bufferSize)
+}
+
+// OpenStreamContext is OpenStream, downloading the file with `ctx`
+func OpenStreamContext(ctx context.Context, fileName string, bufferSize int) (rf *AZArchive, err error) {
+
+	azContainerURL, filePath, err := getContainer(fileName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to initialize azure connection")
+	}
+	blobURL := azContainerURL.NewBlobURL(filePath)
+
+	props, err := getProperties(ctx, blobURL)
+	if err != nil {
+		return nil, err
+	}
+
+	rfi, err := common.OpenStream(ctx, fileName, props.Size,
+		func(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+			return downloadRange(ctx, blobURL, offset, length)
+		}, bufferSize)
+	if err != nil {
+		return nil, err
+	}
+	return &AZArchive{BasicArchive: *rfi}, nil
+}
+
+// getProperties returns the size and modification time of a blob
+func getProperties(ctx context.Context, blobURL azblob.BlobURL) (entry common.ArchiveEntry, err error) {
+
+	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return entry, errors.Wrapf(err, "unable to stat blobstore file")
+	}
+	return common.ArchiveEntry{Name: blobURL.String(), Size: props.ContentLength(), ModTime: props.LastModified()}, nil
+}
+
+// downloadRange reads `length` bytes of a blob from `offset`
+func downloadRange(ctx context.Context, blobURL azblob.BlobURL, offset, length int64) (io.ReadCloser, error) {
+
+	resp, err := blobURL.Download(ctx, offset, length, azblob.BlobAccessConditions{}, false,
+		azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	body := resp.Body(azblob.RetryReaderOptions{})
+	return struct {
+		io.Reader
+		io.Closer
+	}{downloadThrottle.Reader(ctx, body), body}, nil
+}
+
+// Stat returns the size, modification time, record count and checksum of an
+// archive file without downloading it, see common.StatArchive
+func Stat(fileName string) (st common.ArchiveStat, err error) {
+	return StatContext(context.Background(), fileName)
+}
+
+// StatContext is Stat, with the requests made with `ctx`
+func StatContext(ctx context.Context, fileName string) (st common.ArchiveStat, err error) {
+
+	blobURL := func(name string) (azblob.BlobURL, error) {
+		azContainerURL, filePath, err := getContainer(name)
+		if err != nil {
+			return azblob.BlobURL{}, errors.Wrap(err, "Unable to initialize azure connection")
+		}
+		return azContainerURL.NewBlobURL(filePath), nil
+	}
+	return common.StatArchive(ctx, fileName,
+		func(ctx context.Context, name string) (common.ArchiveEntry, error) {
+			u, err := blobURL(name)
+			if err != nil {
+				return common.ArchiveEntry{}, err
+			}
+			return getProperties(ctx, u)
+		},
+		func(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+			u, err := blobURL(name)
+			if err != nil {
+				return nil, err
+			}
+			return downloadRange(ctx, u, offset, length)
+		})
+}
+
+// Fetch downloads fileName to a local temporary file. Caller must
+// remove localPath when done (`temporary` is always true)
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return FetchContext(context.Background(), fileName)
+}
+
+// FetchContext is Fetch, downloading the file with `ctx`
+func FetchContext(ctx context.Context, fileName string) (localPath string, temporary bool, err error) {
+
+	azContainerURL, filePath, err := getContainer(fileName)
+	if err != nil {
+		return "", false, errors.Wrap(err, "Unable to initialize azure connection")
+	}
+
+	localPath, err = download(ctx, azContainerURL, filePath, common.DefaultLogger)
+	if err != nil {
+		return "", false, err
+	}
+	return localPath, true, nil
+}
+
+// Store uploads the local file into azure directory `dir` keeping the same base name
+func Store(localPath, dir string) (err error) {
+	return StoreContext(context.Background(), localPath, dir)
+}
+
+// StoreContext is Store, uploading the file with `ctx`
+func StoreContext(ctx context.Context, localPath, dir string) (err error) {
+
+	azContainerURL, subDir, err := getContainer(dir)
+	if err != nil {
+		return errors.Wrap(err, "Unable to initialize azure connection")
+	}
+	return upload(ctx, localPath, azContainerURL, path.Join(subDir, path.Base(localPath)), common.DefaultLogger)
+}
+
 func List(dir string) (files []string, err error) {
+	return ListContext(context.Background(), dir)
+}
+
+// ListContext is List, with the requests made with `ctx`
+func ListContext(ctx context.Context, dir string) (files []string, err error) {
+
+	entries, err := ListDetailsContext(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		files = append(files, entry.Name)
+	}
+	return files, err
+}
+
+// ListDetails is like List, but includes size and modification time
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+	return ListDetailsContext(context.Background(), dir)
+}
+
+// ListDetailsContext is ListDetails, with the requests made with `ctx`
+func ListDetailsContext(ctx context.Context, dir string) (entries []common.ArchiveEntry, err error) {
 
 	azContainerURL, subDir, err := getContainer(dir)
 	if err != nil {
@@ -193,8 +410,8 @@ func List(dir string) (files []string, err error) {
 
 	for marker := (azblob.Marker{}); marker.NotDone(); {
 		// Get a result segment starting with the blob indicated by the current Marker.
-		listBlob, err := azContainerURL.ListBlobsFlatSegment(context.Background(), marker,
-			azblob.ListBlobsSegmentOptions{Prefix: subDir})
+		listBlob, err := azContainerURL.ListBlobsFlatSegment(ctx, marker,
+			azblob.ListBlobsSegmentOptions{Prefix: common.DirPrefix(subDir)})
 		if err != nil {
 			return nil, errors.Wrap(err, "Unable to list azure connection")
 		}
@@ -204,14 +421,25 @@ func List(dir string) (files []string, err error) {
 
 		// Process the blobs returned in this result segment (if the segment is empty, the loop body won't execute)
 		for _, blobInfo := range listBlob.Segment.BlobItems {
-			files = append(files, blobInfo.Name)
+			entry := common.ArchiveEntry{
+				Name:    blobInfo.Name,
+				ModTime: blobInfo.Properties.LastModified}
+			if blobInfo.Properties.ContentLength != nil {
+				entry.Size = *blobInfo.Properties.ContentLength
+			}
+			entries = append(entries, entry)
 		}
 	}
 
-	return files, err
+	return entries, err
 }
 
 func Delete(dir string, files []string) (err error) {
+	return DeleteContext(context.Background(), dir, files)
+}
+
+// DeleteContext is Delete, with the requests made with `ctx`
+func DeleteContext(ctx context.Context, dir string, files []string) (err error) {
 
 	azContainerURL, _, err := getContainer(dir)
 	if err != nil {
@@ -221,7 +449,7 @@ func Delete(dir string, files []string) (err error) {
 	// Process the blobs returned in this result segment (if the segment is empty, the loop body won't execute)
 	for _, fileName := range files {
 		blobURL := azContainerURL.NewBlobURL(fileName)
-		_, err = blobURL.Delete(context.Background(), azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+		_, err = blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
 		if err != nil {
 			return errors.Wrapf(err, "Unable to delete azure blob: %s", fileName)
 		}
@@ -242,50 +470,24 @@ func (rf *AZArchive) finalizeArchive() (finalFile common.ArchiveFileDetails, err
 		return finalFile, err
 	}
 	fileSize := fi.Size()
-	finalPath := path.Join(rf.contSubDir, path.Base(filePath))
-	finalPath = strings.TrimSuffix(finalPath, ".tmp")
+	finalPath := path.Join(rf.contSubDir, rf.FinalName())
 	finalFile.BytesWritten = fileSize
-	finalFile.FileName = path.Base(finalPath) // Only filename part
+	finalFile.FileName = rf.FinalName() // with the directories of FilenameTemplate, if any
+	finalFile.URL = fmt.Sprintf("az://%s/%s", rf.containerName, finalPath)
 	finalFile.ChunksWritten = rf.ChunksWritten
 
-	// From the Azure portal, get your storage account blob service URL endpoint.
-	URL, _ := url.Parse(
-		fmt.Sprintf("https://%s.blob.core.windows.net/%s", gAZSession.accountName, rf.containerName))
-
-	// Create a ContainerURL object that wraps the container URL and a request
-	// pipeline to make requests.
-	azContainerURL := azblob.NewContainerURL(*URL, gAZSession.azPipeline)
-
-	blockBlobURL := azContainerURL.NewBlockBlobURL(finalPath)
+	// A ContainerURL wraps the container URL and a request pipeline to make
+	// requests.
+	azContainerURL := gAZSession.serviceURL.NewContainerURL(rf.containerName)
 
-	finalFP, err := os.Open(filePath)
+	err = upload(rf.Context(), filePath, azContainerURL, finalPath, rf.Logger)
 	if err != nil {
-		err = errors.Wrapf(err, "unable to reopen archive file: %s", finalPath)
 		return finalFile, err
 	}
-	defer finalFP.Close()
-
-	rf.Logger.Debug("Azure Upload [BEGIN]",
-		zap.String("local", filePath),
-		zap.String("remote", finalPath))
-
-	var statChan = make(chan int64)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go rf.ProgressPrinter(statChan, filePath, fileSize, &wg)
-
-	_, err = azblob.UploadFileToBlockBlob(context.Background(), finalFP, blockBlobURL, azblob.UploadToBlockBlobOptions{
-		BlockSize:   4 * 1024 * 1024,
-		Parallelism: 4,
-		Progress: func(bytesTransferred int64) {
-			statChan <- bytesTransferred
-		}})
-	if err != nil {
-		err = errors.Wrapf(err, "ERROR: Blobstore upload error for: %s", filePath)
-		return finalFile, err
-	}
-	rf.Logger.Info("Azure Upload [END]",
-		zap.String("local", filePath),
+	rf.StoreIndex(func(indexPath string) error {
+		return upload(rf.Context(), indexPath, azContainerURL, finalPath+common.IndexExt, rf.Logger)
+	})
+	rf.Logger.Debug("Azure Upload",
 		zap.String("remote", finalPath),
 		zap.Int64("content-bytes", rf.TrueContentLength()),
 		zap.Int64("compressed-bytes", fileSize))
@@ -295,8 +497,5 @@ func (rf *AZArchive) finalizeArchive() (finalFile common.ArchiveFileDetails, err
 		return finalFile, errors.Wrapf(err, "unable to remove archive file %s after uploading to azure", filePath)
 	}
 
-	close(statChan)
-	wg.Wait() // Waiting for status monitor to exit
-
 	return finalFile, nil
 }
@@ -0,0 +1,219 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package az
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// storageResource is what Azure AD tokens are requested for
+	storageResource = "https://storage.azure.com/"
+	// defaultAuthorityHost is that of Azure AD tokens, unless
+	// AZURE_AUTHORITY_HOST is set (sovereign clouds)
+	defaultAuthorityHost = "https://login.microsoftonline.com/"
+	// tokenRetry is how soon a token that couldn't be refreshed is tried again
+	tokenRetry = time.Minute
+)
+
+// newCredential returns the credential of the storage account and the URL
+// of its blob service, from the environment. In order of precedence:
+//
+//	AZURE_STORAGE_CONNECTION_STRING  as copied from the portal: account name
+//	                                 and key, or SAS token, and endpoints
+//	AZURE_STORAGE_ACCOUNT with
+//	  AZURE_STORAGE_ACCESS_KEY       shared key of the account
+//	  AZURE_STORAGE_SAS_TOKEN        SAS token of the account or container
+//	  neither                        Azure AD token, see newTokenCredential
+func newCredential() (credential azblob.Credential, serviceURL *url.URL, err error) {
+
+	if connectionString := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); connectionString != "" {
+		return parseConnectionString(connectionString)
+	}
+
+	accountName := os.Getenv("AZURE_STORAGE_ACCOUNT")
+	if len(accountName) == 0 {
+		return nil, nil, errors.New("Neither the AZURE_STORAGE_ACCOUNT nor the AZURE_STORAGE_CONNECTION_STRING environment variable is set")
+	}
+	endpoint := fmt.Sprintf("https://%s.blob.core.windows.net", accountName)
+	accountKey, sasToken := os.Getenv("AZURE_STORAGE_ACCESS_KEY"), os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	switch {
+	case accountKey != "":
+		credential, err = azblob.NewSharedKeyCredential(accountName, accountKey)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Invalid credentials")
+		}
+	case sasToken != "":
+		credential = azblob.NewAnonymousCredential() // the token is in the URL
+	default:
+		credential, err = newTokenCredential()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "No AZURE_STORAGE_ACCESS_KEY or AZURE_STORAGE_SAS_TOKEN, and no Azure AD credentials")
+		}
+	}
+	serviceURL, err = blobServiceURL(endpoint, sasToken)
+	return credential, serviceURL, err
+}
+
+// parseConnectionString returns the credential and blob service URL of a
+// storage account connection string:
+// DefaultEndpointsProtocol=https;AccountName=...;AccountKey=...;EndpointSuffix=core.windows.net,
+// BlobEndpoint=https://account.blob.core.windows.net/;SharedAccessSignature=sv=...
+// or anything in between
+func parseConnectionString(connectionString string) (credential azblob.Credential, serviceURL *url.URL, err error) {
+
+	settings := make(map[string]string)
+	for _, setting := range strings.Split(connectionString, ";") {
+		if setting = strings.TrimSpace(setting); setting == "" {
+			continue
+		}
+		eq := strings.IndexByte(setting, '=')
+		if eq <= 0 {
+			return nil, nil, errors.New("Bad Azure storage connection string, expected Key=Value settings separated by ;")
+		}
+		settings[strings.ToLower(setting[:eq])] = setting[eq+1:]
+	}
+
+	accountName, accountKey := settings["accountname"], settings["accountkey"]
+	sasToken := settings["sharedaccesssignature"]
+	endpoint := settings["blobendpoint"]
+	if endpoint == "" {
+		if accountName == "" {
+			return nil, nil, errors.New("Azure storage connection string has neither AccountName nor BlobEndpoint")
+		}
+		protocol, suffix := settings["defaultendpointsprotocol"], settings["endpointsuffix"]
+		if protocol == "" {
+			protocol = "https"
+		}
+		if suffix == "" {
+			suffix = "core.windows.net"
+		}
+		endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, accountName, suffix)
+	}
+	switch {
+	case accountKey != "":
+		credential, err = azblob.NewSharedKeyCredential(accountName, accountKey)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Invalid credentials in Azure storage connection string")
+		}
+	case sasToken != "":
+		credential = azblob.NewAnonymousCredential()
+	default:
+		return nil, nil, errors.New("Azure storage connection string has neither AccountKey nor SharedAccessSignature")
+	}
+	serviceURL, err = blobServiceURL(endpoint, sasToken)
+	return credential, serviceURL, err
+}
+
+// blobServiceURL is the URL of the blob service at `endpoint`, with the SAS
+// token, if any, that requests to it carry
+func blobServiceURL(endpoint, sasToken string) (serviceURL *url.URL, err error) {
+	serviceURL, err = url.Parse(endpoint)
+	if err != nil || serviceURL.Host == "" {
+		return nil, errors.Errorf("Bad Azure blob endpoint %s", endpoint)
+	}
+	serviceURL.RawQuery = strings.TrimPrefix(sasToken, "?")
+	return serviceURL, nil
+}
+
+// newTokenCredential returns an Azure AD credential, refreshed before it
+// expires, for the role assignments (Storage Blob Data Contributor) of:
+//
+//   - the workload identity of an AKS pod: AZURE_FEDERATED_TOKEN_FILE,
+//     AZURE_TENANT_ID and AZURE_CLIENT_ID, as set by the webhook
+//   - a service principal: AZURE_TENANT_ID, AZURE_CLIENT_ID and
+//     AZURE_CLIENT_SECRET
+//   - or else the managed identity of the VM, or of the pod with AAD pod
+//     identity: the user-assigned one of AZURE_CLIENT_ID if set, the
+//     system-assigned one otherwise
+func newTokenCredential() (credential azblob.Credential, err error) {
+
+	spt, err := servicePrincipalToken()
+	if err != nil {
+		return nil, err
+	}
+	err = spt.Refresh()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to get Azure AD token")
+	}
+	return azblob.NewTokenCredential("", func(tc azblob.TokenCredential) time.Duration {
+		err := spt.EnsureFresh() // refreshed in the last 5 minutes of the token
+		if err != nil {
+			common.DefaultLogger.Error("Unable to refresh Azure AD token", zap.Error(err))
+			return tokenRetry
+		}
+		token := spt.Token()
+		tc.SetToken(token.AccessToken)
+		if next := time.Until(token.Expires()) - 4*time.Minute; next > tokenRetry {
+			return next
+		}
+		return tokenRetry
+	}), nil
+}
+
+// servicePrincipalToken gets Azure AD tokens for storage, see
+// newTokenCredential
+func servicePrincipalToken() (spt *adal.ServicePrincipalToken, err error) {
+
+	tenantID, clientID := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID")
+	tokenFile, clientSecret := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"), os.Getenv("AZURE_CLIENT_SECRET")
+	if tokenFile == "" && clientSecret == "" {
+		spt, err = adal.NewServicePrincipalTokenFromManagedIdentity(storageResource,
+			&adal.ManagedIdentityOptions{ClientID: clientID})
+		return spt, errors.Wrap(err, "Unable to use managed identity")
+	}
+
+	if tenantID == "" || clientID == "" {
+		return nil, errors.New("AZURE_TENANT_ID and AZURE_CLIENT_ID must be set with AZURE_FEDERATED_TOKEN_FILE or AZURE_CLIENT_SECRET")
+	}
+	authorityHost := os.Getenv("AZURE_AUTHORITY_HOST")
+	if authorityHost == "" {
+		authorityHost = defaultAuthorityHost
+	}
+	oauthConfig, err := adal.NewOAuthConfig(authorityHost, tenantID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Bad Azure AD tenant %s", tenantID)
+	}
+	if tokenFile != "" {
+		spt, err = adal.NewServicePrincipalTokenWithSecret(*oauthConfig, clientID, storageResource, federatedToken(tokenFile))
+		return spt, errors.Wrap(err, "Unable to use workload identity")
+	}
+	spt, err = adal.NewServicePrincipalToken(*oauthConfig, clientID, clientSecret, storageResource)
+	return spt, errors.Wrap(err, "Unable to use service principal")
+}
+
+// federatedToken authenticates with the token of a file, which Kubernetes
+// rotates: it is read again for every Azure AD token
+type federatedToken string
+
+// SetAuthenticationValues implements adal.ServicePrincipalSecret
+func (tokenFile federatedToken) SetAuthenticationValues(spt *adal.ServicePrincipalToken, v *url.Values) error {
+	jwt, err := ioutil.ReadFile(string(tokenFile))
+	if err != nil {
+		return errors.Wrap(err, "Unable to read federated token")
+	}
+	v.Set("client_assertion", strings.TrimSpace(string(jwt)))
+	v.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	return nil
+}
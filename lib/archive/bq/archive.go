@@ -0,0 +1,377 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package bq provides archive interface for a BigQuery table,
+// bq://project.dataset.table. Nothing is written to files: every request
+// written to the archive becomes a row (timestamp, id, method, uri,
+// headers, body, batch), and rows are appended to the default stream of the
+// table with the Storage Write API, where they are committed as soon as
+// they are acknowledged.
+package bq
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"cloud.google.com/go/bigquery/storage/managedwriter/adapt"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Rows are appended once BufferSize bytes of them (defaultAppendBytes
+// otherwise) are pending, and on Flush, Rotate and Close. An append request
+// takes up to 10MB, maxAppendBytes leaves room for the rest of it.
+const (
+	defaultAppendBytes = 1024 * 1024
+	maxAppendBytes     = 9 * 1024 * 1024
+)
+
+// maxPending is how many appends are sent before waiting for their
+// acknowledgement, which Flush and Close do as well
+const maxPending = 100
+
+// schema is that of the table, created with it if it doesn't exist
+var schema = bigquery.Schema{
+	{Name: "timestamp", Type: bigquery.TimestampFieldType, Required: true},
+	{Name: "id", Type: bigquery.StringFieldType},
+	{Name: "method", Type: bigquery.StringFieldType},
+	{Name: "uri", Type: bigquery.StringFieldType},
+	{Name: "headers", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+		{Name: "name", Type: bigquery.StringFieldType},
+		{Name: "value", Type: bigquery.StringFieldType},
+	}},
+	{Name: "body", Type: bigquery.BytesFieldType},
+	{Name: "batch", Type: bigquery.StringFieldType},
+}
+
+// rowDescriptor is the protobuf message of a row of schema, and
+// rowSchema its normalized form sent to the service
+var (
+	rowOnce       sync.Once
+	rowDescriptor protoreflect.MessageDescriptor
+	rowSchema     *descriptorpb.DescriptorProto
+	rowErr        error
+)
+
+// Clients are shared by all archives of a project, so they are created once
+// per process (with application default credentials) and never closed.
+// Every archive has its stream.
+var gBQSession struct {
+	sync.Mutex
+	clients map[string]*bqClients
+}
+
+type bqClients struct {
+	bq *bigquery.Client      // for the table
+	mw *managedwriter.Client // for the rows
+}
+
+var bqUrlRegex = regexp.MustCompile("^bq://(.+)\\.([A-Za-z0-9_]+)\\.([A-Za-z0-9_-]+)$")
+
+type BQArchive struct {
+	common.Publisher
+	stream    *managedwriter.ManagedStream // nil once closed
+	rows      [][]byte                     // not appended yet
+	rowBytes  int
+	results   []*managedwriter.AppendResult
+	counts    []int // rows of results
+	pendBytes int   // bytes of results
+}
+
+// getClients returns the clients of a project, creating them the first time
+func getClients(project string) (clients *bqClients, err error) {
+
+	gBQSession.Lock()
+	defer gBQSession.Unlock()
+	if gBQSession.clients == nil {
+		gBQSession.clients = make(map[string]*bqClients)
+	}
+	clients, ok := gBQSession.clients[project]
+	if !ok {
+		ctx := context.Background()
+		clients = &bqClients{}
+		clients.bq, err = bigquery.NewClient(ctx, project)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to create bigquery client with application default credentials")
+		}
+		clients.mw, err = managedwriter.NewClient(ctx, project)
+		if err != nil {
+			clients.bq.Close()
+			return nil, errors.Wrap(err, "Unable to create bigquery write client with application default credentials")
+		}
+		gBQSession.clients[project] = clients
+	}
+	return clients, nil
+}
+
+// getRowDescriptor builds the message of a row from schema, once
+func getRowDescriptor() (md protoreflect.MessageDescriptor, dp *descriptorpb.DescriptorProto, err error) {
+
+	rowOnce.Do(func() {
+		ts, err := adapt.BQSchemaToStorageTableSchema(schema)
+		if err != nil {
+			rowErr = err
+			return
+		}
+		d, err := adapt.StorageSchemaToProto2Descriptor(ts, "root")
+		if err != nil {
+			rowErr = err
+			return
+		}
+		rowDescriptor = d.(protoreflect.MessageDescriptor)
+		rowSchema, rowErr = adapt.NormalizeDescriptor(rowDescriptor)
+	})
+	if rowErr != nil {
+		return nil, nil, errors.Wrap(rowErr, "Unable to convert table schema")
+	}
+	return rowDescriptor, rowSchema, nil
+}
+
+// parseBQURL splits bq://project.dataset.table
+func parseBQURL(bqURL string) (project, dataset, table string, err error) {
+
+	parts := bqUrlRegex.FindStringSubmatch(bqURL)
+	if len(parts) != 4 {
+		return "", "", "", errors.Errorf("Unable to parse bq url format (bq://project.dataset.table): %s", bqURL)
+	}
+	return parts[1], parts[2], parts[3], nil
+}
+
+// ensureTable creates the table with schema, partitioned by day of
+// timestamp, unless it already exists
+func ensureTable(t *bigquery.Table) (err error) {
+
+	ctx := context.Background()
+	_, err = t.Metadata(ctx)
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		err = t.Create(ctx, &bigquery.TableMetadata{
+			Schema:           schema,
+			TimePartitioning: &bigquery.TimePartitioning{Field: "timestamp"},
+		})
+		// Another archive may have created it meanwhile
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusConflict {
+			err = nil
+		}
+	}
+	return err
+}
+
+// NewArchive creates a new archive streaming requests to a BigQuery table.
+// `outDir` is bq://project.dataset.table; the table is created if it
+// doesn't exist. Rows are appended in requests of up to BufferSize bytes,
+// and at every flush. Rotate waits for what is pending and starts a new
+// batch, which stands for a file in FinalizedFiles and OnFinalize. The
+// caller must call `rf.Close()` to append what is left.
+func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *BQArchive, err error) {
+
+	project, dataset, table, err := parseBQURL(outDir)
+	if err != nil {
+		return nil, err
+	}
+	_, dp, err := getRowDescriptor()
+	if err != nil {
+		return nil, err
+	}
+	clients, err := getClients(project)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to initialize bigquery connection")
+	}
+	err = ensureTable(clients.bq.DatasetInProject(project, dataset).Table(table))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to create table %s", outDir)
+	}
+	stream, err := clients.mw.NewManagedStream(context.Background(),
+		managedwriter.WithDestinationTable(managedwriter.TableParentFromParts(project, dataset, table)),
+		managedwriter.WithType(managedwriter.DefaultStream),
+		managedwriter.WithSchemaDescriptor(dp))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to open write stream of %s", outDir)
+	}
+	p, err := common.NewPublisher(outDir, "bigquery", prefix, extension, options...)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	rf = &BQArchive{Publisher: *p, stream: stream}
+	rf.Frames.OnRequest = rf.add
+	rf.OnFlush = rf.flush
+	rf.OnClose = func() error {
+		if rf.stream != nil {
+			rf.stream.Close()
+			rf.stream = nil
+		}
+		return nil
+	}
+
+	err = rf.Rotate()
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return rf, err
+}
+
+// OpenArchive is not supported: tables are queried, not read back
+func OpenArchive(fileName string, bufferSize int) (rf *BQArchive, err error) {
+	return nil, common.NotSupported("Reading", "bigquery tables", fileName)
+}
+
+// Fetch is not supported, see OpenArchive
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return "", false, common.NotSupported("Reading", "bigquery tables", fileName)
+}
+
+// Store streams the requests of a local archive file (compressed or not)
+// to the table of `dir`
+func Store(localPath, dir string) (err error) {
+
+	rf, err := NewArchive(dir, "", "", common.Logger(common.DefaultLogger))
+	if err != nil {
+		return err
+	}
+	return rf.Store(localPath)
+}
+
+func List(dir string) (files []string, err error) {
+	return nil, common.NotSupported("Listing", "bigquery tables", dir)
+}
+
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+	return nil, common.NotSupported("Listing", "bigquery tables", dir)
+}
+
+func Delete(dir string, files []string) (err error) {
+	return common.NotSupported("Deleting", "bigquery tables", dir)
+}
+
+// add encodes the row of a request, appending rows once there are enough
+// and waiting for the appends once maxPending are pending. Requests
+// recorded without a timestamp get the current time.
+func (rf *BQArchive) add(payload []byte) (err error) {
+
+	req := fbr.GetRootAsRequest(payload, 0)
+	ts := req.Timestamp()
+	if ts == 0 {
+		ts = time.Now().UnixNano()
+	}
+	md := rowDescriptor
+	fields := md.Fields()
+	row := dynamicpb.NewMessage(md)
+	row.Set(fields.ByName("timestamp"), protoreflect.ValueOfInt64(ts/1000)) // microseconds
+	row.Set(fields.ByName("id"), protoreflect.ValueOfString(string(req.Id())))
+	row.Set(fields.ByName("method"), protoreflect.ValueOfString(string(req.Method())))
+	row.Set(fields.ByName("uri"), protoreflect.ValueOfString(string(req.Uri())))
+	if body := req.BodyBytes(); len(body) > 0 {
+		row.Set(fields.ByName("body"), protoreflect.ValueOfBytes(body))
+	}
+	row.Set(fields.ByName("batch"), protoreflect.ValueOfString(rf.Batch))
+	headers := common.HeaderMap(req.Headers())
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	field := fields.ByName("headers")
+	list := row.Mutable(field).List()
+	for _, name := range names {
+		header := dynamicpb.NewMessage(field.Message())
+		header.Set(field.Message().Fields().ByName("name"), protoreflect.ValueOfString(name))
+		header.Set(field.Message().Fields().ByName("value"), protoreflect.ValueOfString(headers[name]))
+		list.Append(protoreflect.ValueOfMessage(header))
+	}
+	data, err := proto.Marshal(row)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to encode request %s", req.Id())
+	}
+	rf.rows = append(rf.rows, data)
+	rf.rowBytes += len(data)
+
+	size := rf.WriteBufferSize()
+	if size <= 0 {
+		size = defaultAppendBytes
+	} else if size > maxAppendBytes {
+		size = maxAppendBytes
+	}
+	if rf.rowBytes >= size {
+		err = rf.append()
+		if err != nil {
+			return err
+		}
+	}
+	if len(rf.results) >= maxPending {
+		return rf.wait()
+	}
+	return nil
+}
+
+// append sends the rows not appended yet. The result is checked by wait.
+func (rf *BQArchive) append() (err error) {
+
+	if len(rf.rows) == 0 {
+		return nil
+	}
+	result, err := rf.stream.AppendRows(context.Background(), rf.rows)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to append %d rows to %s", len(rf.rows), rf.URL)
+	}
+	rf.results = append(rf.results, result)
+	rf.counts = append(rf.counts, len(rf.rows))
+	rf.pendBytes += rf.rowBytes
+	rf.rows, rf.rowBytes = nil, 0 // held by the pending append
+	return nil
+}
+
+// wait waits for the appends sent to be acknowledged. Returns the first
+// error, after waiting for all of them.
+func (rf *BQArchive) wait() (err error) {
+
+	failed, total := 0, 0
+	for i, result := range rf.results {
+		total += rf.counts[i]
+		_, rerr := result.GetResult(context.Background())
+		if rerr != nil {
+			failed += rf.counts[i]
+			if err == nil {
+				err = rerr
+			}
+		}
+	}
+	rf.Published(total-failed, rf.pendBytes) // bytes close enough when some failed
+	rf.results, rf.counts, rf.pendBytes = rf.results[:0], rf.counts[:0], 0
+	if err != nil {
+		return errors.Wrapf(err, "Unable to append %d of %d rows to %s", failed, total, rf.URL)
+	}
+	return nil
+}
+
+// flush appends the pending rows and waits for their acknowledgement
+func (rf *BQArchive) flush() (err error) {
+
+	err = rf.append()
+	if err != nil {
+		return err
+	}
+	return rf.wait()
+}
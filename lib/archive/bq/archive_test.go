@@ -0,0 +1,125 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package bq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/fbr"
+	flatbuffers "github.com/google/flatbuffers/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// testPayload is a request recorded at `ts`
+func testPayload(ts int64) []byte {
+	b := flatbuffers.NewBuilder(0)
+	id := b.CreateString("id-1")
+	method := b.CreateString("POST")
+	uri := b.CreateString("/events")
+	headers := b.CreateString("X-B: 2\r\nHost: example.com\r\n\r\n")
+	body := b.CreateByteVector([]byte("body"))
+	fbr.RequestStart(b)
+	fbr.RequestAddId(b, id)
+	fbr.RequestAddMethod(b, method)
+	fbr.RequestAddUri(b, uri)
+	fbr.RequestAddHeaders(b, headers)
+	fbr.RequestAddBody(b, body)
+	fbr.RequestAddTimestamp(b, ts)
+	b.Finish(fbr.RequestEnd(b))
+	return b.FinishedBytes()
+}
+
+func TestParseBQURL(t *testing.T) {
+
+	tests := []struct {
+		url, project, dataset, table string
+		err                          bool
+	}{
+		{"bq://project.dataset.table", "project", "dataset", "table", false},
+		{"bq://example.com:project.dataset.requests-2021", "example.com:project", "dataset", "requests-2021", false},
+		{"bq://dataset.table", "", "", "", true},
+		{"bq://project.data-set.table", "", "", "", true},
+		{"gs://project.dataset.table", "", "", "", true},
+	}
+	for _, tt := range tests {
+		project, dataset, table, err := parseBQURL(tt.url)
+		if project != tt.project || dataset != tt.dataset || table != tt.table || (err != nil) != tt.err {
+			t.Fatalf("%s: got %q, %q, %q, %v", tt.url, project, dataset, table, err)
+		}
+	}
+}
+
+// Requests are encoded as rows of the table schema, kept until there are
+// enough of them to append
+func TestAddRows(t *testing.T) {
+
+	md, _, err := getRowDescriptor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf := &BQArchive{}
+	rf.Batch = "requests_1"
+	ts := time.Date(2021, 3, 4, 5, 6, 7, 8000, time.UTC).UnixNano()
+	before := time.Now().UnixNano() / 1000
+	for _, ts := range []int64{ts, 0} {
+		if err = rf.add(testPayload(ts)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(rf.rows) != 2 || rf.rowBytes != len(rf.rows[0])+len(rf.rows[1]) || len(rf.results) != 0 {
+		t.Fatalf("%d rows of %d bytes, %d appended", len(rf.rows), rf.rowBytes, len(rf.results))
+	}
+
+	fields := md.Fields()
+	row := dynamicpb.NewMessage(md)
+	if err = proto.Unmarshal(rf.rows[0], row); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[protoreflect.Name]interface{}{
+		"timestamp": ts / 1000,
+		"id":        "id-1",
+		"method":    "POST",
+		"uri":       "/events",
+		"body":      "body",
+		"batch":     "requests_1",
+	} {
+		got := row.Get(fields.ByName(name)).Interface()
+		if b, ok := got.([]byte); ok {
+			got = string(b)
+		}
+		if got != want {
+			t.Fatalf("%s: got %v, want %v", name, got, want)
+		}
+	}
+	headers := row.Get(fields.ByName("headers")).List()
+	header := fields.ByName("headers").Message().Fields()
+	var got []string
+	for i := 0; i < headers.Len(); i++ {
+		h := headers.Get(i).Message()
+		got = append(got, h.Get(header.ByName("name")).String()+": "+h.Get(header.ByName("value")).String())
+	}
+	if len(got) != 2 || got[0] != "Host: example.com" || got[1] != "X-B: 2" {
+		t.Fatalf("got headers %q", got)
+	}
+
+	row = dynamicpb.NewMessage(md)
+	if err = proto.Unmarshal(rf.rows[1], row); err != nil {
+		t.Fatal(err)
+	}
+	if now := row.Get(fields.ByName("timestamp")).Int(); now < before || now > time.Now().UnixNano()/1000 {
+		t.Fatalf("no current time for a request without one: %d", now)
+	}
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package clickhouse provides archive interface for a ClickHouse table,
+// clickhouse://host:8123/db.table or clickhouses:// for HTTPS, through the
+// HTTP interface. Nothing is written to files: every request written to the
+// archive becomes a row (timestamp, id, method, uri, headers, body), and
+// rows are inserted in batches, in RowBinary format so that bodies are kept
+// as they are. An insert is sent every 100000 rows or 16MB, and on Flush,
+// Rotate and Close.
+package clickhouse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/pkg/errors"
+)
+
+// An insert is sent once this many rows, or this many bytes, are pending,
+// and on Flush, Rotate and Close. ClickHouse prefers few large inserts.
+const (
+	insertRows  = 100000
+	insertBytes = 16 * 1024 * 1024
+)
+
+// createTable is used when the table does not exist yet. Headers need
+// ClickHouse 21.8+ for the Map type.
+const createTable = "CREATE TABLE IF NOT EXISTS %s (" +
+	"timestamp DateTime64(9, 'UTC'), " +
+	"id String, " +
+	"method LowCardinality(String), " +
+	"uri String, " +
+	"headers Map(String, String), " +
+	"body String" +
+	") ENGINE = MergeTree ORDER BY timestamp"
+
+// insertQuery lists the columns in the order rows are encoded in
+const insertQuery = "INSERT INTO %s (timestamp, id, method, uri, headers, body) FORMAT RowBinary"
+
+var chClient = &http.Client{Timeout: 5 * time.Minute}
+
+var tableRegex = regexp.MustCompile("^([A-Za-z_][A-Za-z0-9_]*)\\.([A-Za-z_][A-Za-z0-9_]*)$")
+
+type ClickHouseArchive struct {
+	common.Publisher
+	baseURL string        // http(s)://host:port
+	table   string        // `db`.`table`
+	user    *url.Userinfo // nil for the default user
+	rows    bytes.Buffer  // RowBinary of the next insert
+	pending int           // rows in rows
+}
+
+// parseClickHouseURL splits clickhouse://[user:pass@]host[:port]/db.table
+// (clickhouses:// for HTTPS, ports 8123 and 8443 by default) into the base
+// URL of the HTTP interface, quoted table and credentials. `display` is the
+// URL without credentials.
+func parseClickHouseURL(chURL string) (display, baseURL, table string, user *url.Userinfo, err error) {
+
+	u, err := url.Parse(chURL)
+	if err != nil {
+		return "", "", "", nil, errors.Wrapf(err, "Unable to parse clickhouse url: %s", chURL)
+	}
+	parts := tableRegex.FindStringSubmatch(strings.Trim(u.Path, "/"))
+	if u.Host == "" || len(parts) != 3 {
+		return "", "", "", nil, errors.Errorf("Unable to parse clickhouse url format (clickhouse://host:8123/db.table): %s", chURL)
+	}
+	scheme, port := "http", "8123"
+	if strings.EqualFold(u.Scheme, "clickhouses") {
+		scheme, port = "https", "8443"
+	}
+	if u.Port() == "" {
+		u.Host += ":" + port
+	}
+	display = strings.ToLower(u.Scheme) + "://" + u.Host + "/" + parts[0]
+	table = "`" + parts[1] + "`.`" + parts[2] + "`"
+	return display, scheme + "://" + u.Host, table, u.User, nil
+}
+
+// NewArchive creates a new archive inserting requests into a ClickHouse
+// table. `outDir` is clickhouse://[user:pass@]host:port/db.table, the port
+// of the HTTP interface, or clickhouses:// for HTTPS with the system roots.
+// The table is created (MergeTree, ordered by timestamp) if it doesn't
+// exist. Rotate inserts what is pending and starts a new batch, which
+// stands for a file in FinalizedFiles and OnFinalize. The caller must call
+// `rf.Close()` to insert what is left.
+func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *ClickHouseArchive, err error) {
+
+	display, baseURL, table, user, err := parseClickHouseURL(outDir)
+	if err != nil {
+		return nil, err
+	}
+	p, err := common.NewPublisher(display, "clickhouse", prefix, extension, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	rf = &ClickHouseArchive{Publisher: *p,
+		baseURL: baseURL,
+		table:   table,
+		user:    user}
+	rf.Frames.OnRequest = rf.add
+	rf.OnFlush = rf.insert
+
+	err = rf.exec(fmt.Sprintf(createTable, table), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create table")
+	}
+	err = rf.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return rf, err
+}
+
+// exec runs `query`, with `data` for an insert
+func (rf *ClickHouseArchive) exec(query string, data []byte) (err error) {
+
+	req, err := http.NewRequest(http.MethodPost, rf.baseURL+"/?query="+url.QueryEscape(query), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if rf.user != nil {
+		password, _ := rf.user.Password()
+		req.SetBasicAuth(rf.user.Username(), password)
+	}
+	resp, err := chClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Query to %s failed", rf.URL)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("Query to %s failed: HTTP %d: %s", rf.URL, resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// OpenArchive is not supported: rows are queried, not read back
+func OpenArchive(fileName string, bufferSize int) (rf *ClickHouseArchive, err error) {
+	return nil, common.NotSupported("Reading", "clickhouse tables", fileName)
+}
+
+// Fetch is not supported, see OpenArchive
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return "", false, common.NotSupported("Reading", "clickhouse tables", fileName)
+}
+
+// Store inserts the requests of a local archive file (compressed or not)
+// into the table of `dir`
+func Store(localPath, dir string) (err error) {
+
+	rf, err := NewArchive(dir, "", "", common.Logger(common.DefaultLogger))
+	if err != nil {
+		return err
+	}
+	return rf.Store(localPath)
+}
+
+func List(dir string) (files []string, err error) {
+	return nil, common.NotSupported("Listing", "clickhouse tables", dir)
+}
+
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+	return nil, common.NotSupported("Listing", "clickhouse tables", dir)
+}
+
+func Delete(dir string, files []string) (err error) {
+	return common.NotSupported("Deleting", "clickhouse tables", dir)
+}
+
+// add appends the row of a request to the next insert, sent once
+// insertRows rows or insertBytes are pending. Requests recorded without a
+// timestamp get the current time.
+func (rf *ClickHouseArchive) add(payload []byte) (err error) {
+
+	req := fbr.GetRootAsRequest(payload, 0)
+	ts := req.Timestamp()
+	if ts == 0 {
+		ts = time.Now().UnixNano()
+	}
+	var scratch [binary.MaxVarintLen64]byte
+	binary.LittleEndian.PutUint64(scratch[:8], uint64(ts))
+	rf.rows.Write(scratch[:8])
+	rf.appendString(req.Id())
+	rf.appendString(req.Method())
+	rf.appendString(req.Uri())
+	headers := common.HeaderMap(req.Headers())
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rf.rows.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(names)))])
+	for _, name := range names {
+		rf.appendString([]byte(name))
+		rf.appendString([]byte(headers[name]))
+	}
+	rf.appendString(req.BodyBytes())
+	rf.pending++
+	if rf.pending >= insertRows || rf.rows.Len() >= insertBytes {
+		return rf.insert()
+	}
+	return nil
+}
+
+// appendString appends a RowBinary String: length, as a varint, and bytes
+func (rf *ClickHouseArchive) appendString(s []byte) {
+	var scratch [binary.MaxVarintLen64]byte
+	rf.rows.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(s)))])
+	rf.rows.Write(s)
+}
+
+// insert sends the pending rows. An insert is all or nothing.
+func (rf *ClickHouseArchive) insert() (err error) {
+
+	if rf.pending == 0 {
+		return nil
+	}
+	sent, size := rf.pending, rf.rows.Len()
+	err = rf.exec(fmt.Sprintf(insertQuery, rf.table), rf.rows.Bytes())
+	rf.rows.Reset()
+	rf.pending = 0
+	if err != nil {
+		return errors.Wrapf(err, "Unable to insert %d requests", sent)
+	}
+	rf.Published(sent, size)
+	return nil
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package clickhouse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/frame"
+	flatbuffers "github.com/google/flatbuffers/go"
+	"go.uber.org/zap"
+)
+
+// testRequest is the frame of a request recorded at `ts`
+func testRequest(id string, ts int64) []byte {
+	b := flatbuffers.NewBuilder(0)
+	idOffset := b.CreateString(id)
+	method := b.CreateString("PUT")
+	uri := b.CreateString("/items/" + id)
+	headers := b.CreateString("X-B: 2\r\nHost: example.com\r\n\r\n")
+	body := b.CreateByteVector([]byte("\x00body\xff"))
+	fbr.RequestStart(b)
+	fbr.RequestAddId(b, idOffset)
+	fbr.RequestAddMethod(b, method)
+	fbr.RequestAddUri(b, uri)
+	fbr.RequestAddHeaders(b, headers)
+	fbr.RequestAddBody(b, body)
+	fbr.RequestAddTimestamp(b, ts)
+	b.Finish(fbr.RequestEnd(b))
+	payload := b.FinishedBytes()
+	buf := make([]byte, frame.PrefixLen, frame.PrefixLen+len(payload))
+	frame.PutPrefix(buf, len(payload), 0)
+	return append(buf, payload...)
+}
+
+// query is what the HTTP interface got
+type query struct {
+	sql, auth string
+	data      []byte
+}
+
+// fakeClickHouse is an HTTP interface keeping the queries it gets, failing
+// inserts if `fail` is set
+type fakeClickHouse struct {
+	mu      sync.Mutex
+	fail    bool
+	queries []query
+}
+
+func (ch *fakeClickHouse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	data, _ := ioutil.ReadAll(r.Body)
+	q := query{r.URL.Query().Get("query"), r.Header.Get("Authorization"), data}
+	ch.queries = append(ch.queries, q)
+	if ch.fail && strings.HasPrefix(q.sql, "INSERT") {
+		http.Error(w, "Code: 241. DB::Exception: Memory limit exceeded", http.StatusInternalServerError)
+	}
+}
+
+// serve runs `ch` until the end of the test, and returns the clickhouse://
+// URL of a table
+func (ch *fakeClickHouse) serve(t *testing.T, user string) string {
+	server := httptest.NewServer(ch)
+	t.Cleanup(server.Close)
+	return "clickhouse://" + user + strings.TrimPrefix(server.URL, "http://") + "/db.requests"
+}
+
+// row is a request as encoded in RowBinary
+type row struct {
+	ts                    int64
+	id, method, uri, body string
+	headers               []string // name, value, ...
+}
+
+// decodeRows decodes RowBinary rows of the insert query
+func decodeRows(t *testing.T, data []byte) (rows []row) {
+
+	r := bytes.NewReader(data)
+	readString := func() string {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := make([]byte, n)
+		if _, err = io.ReadFull(r, s); err != nil {
+			t.Fatal(err)
+		}
+		return string(s)
+	}
+	for r.Len() > 0 {
+		var rw row
+		if err := binary.Read(r, binary.LittleEndian, &rw.ts); err != nil {
+			t.Fatal(err)
+		}
+		rw.id, rw.method, rw.uri = readString(), readString(), readString()
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := uint64(0); i < 2*n; i++ {
+			rw.headers = append(rw.headers, readString())
+		}
+		rw.body = readString()
+		rows = append(rows, rw)
+	}
+	return rows
+}
+
+func TestParseClickHouseURL(t *testing.T) {
+
+	tests := []struct {
+		url, display, baseURL, table string
+		err                          bool
+	}{
+		{"clickhouse://localhost/db.requests", "clickhouse://localhost:8123/db.requests",
+			"http://localhost:8123", "`db`.`requests`", false},
+		{"ClickHouses://u:p@ch/db.requests/", "clickhouses://ch:8443/db.requests", "https://ch:8443", "`db`.`requests`", false},
+		{"clickhouse://localhost/requests", "", "", "", true},
+		{"clickhouse://localhost/db.re-quests", "", "", "", true},
+		{"clickhouse:///db.requests", "", "", "", true},
+	}
+	for _, tt := range tests {
+		display, baseURL, table, _, err := parseClickHouseURL(tt.url)
+		if display != tt.display || baseURL != tt.baseURL || table != tt.table || (err != nil) != tt.err {
+			t.Fatalf("%s: got %q, %q, %q, %v", tt.url, display, baseURL, table, err)
+		}
+	}
+}
+
+// The table is created, then requests are inserted as rows on flush
+func TestInsert(t *testing.T) {
+
+	ch := &fakeClickHouse{}
+	rf, err := NewArchive(ch.serve(t, "user:secret@"), "requests", ".fbf", common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := rf.Batch
+	ts := time.Date(2021, 3, 4, 5, 6, 7, 8, time.UTC).UnixNano()
+	before := time.Now().UnixNano()
+	for i, ts := range []int64{ts, 0} {
+		if _, err = rf.Write(testRequest(fmt.Sprint(i), ts)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ch.queries) != 2 || !strings.HasPrefix(ch.queries[0].sql, "CREATE TABLE IF NOT EXISTS `db`.`requests` (") ||
+		ch.queries[1].sql != "INSERT INTO `db`.`requests` (timestamp, id, method, uri, headers, body) FORMAT RowBinary" {
+		t.Fatalf("got queries %+v", ch.queries)
+	}
+	for _, q := range ch.queries {
+		if q.auth != "Basic dXNlcjpzZWNyZXQ=" {
+			t.Fatalf("got Authorization %q", q.auth)
+		}
+	}
+	rows := decodeRows(t, ch.queries[1].data)
+	if len(rows) != 2 {
+		t.Fatalf("got %+v", rows)
+	}
+	want := row{ts, "0", "PUT", "/items/0", "\x00body\xff", []string{"Host", "example.com", "X-B", "2"}}
+	if fmt.Sprint(rows[0]) != fmt.Sprint(want) {
+		t.Fatalf("got %+v, want %+v", rows[0], want)
+	}
+	if rows[1].ts < before || rows[1].ts > time.Now().UnixNano() {
+		t.Fatalf("no current time for a request without one: %d", rows[1].ts)
+	}
+	files := rf.FinalizedFiles()
+	if details, ok := files[batch]; len(files) != 1 || !ok || details.ChunksWritten != 2 {
+		t.Fatalf("got %+v", files)
+	}
+}
+
+// A failed insert fails the flush, with what the server said
+func TestInsertFailed(t *testing.T) {
+
+	ch := &fakeClickHouse{fail: true}
+	rf, err := NewArchive(ch.serve(t, ""), "requests", ".fbf", common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	rf.Write(testRequest("0", 0))
+	if err = rf.Flush(); err == nil || !strings.Contains(err.Error(), "Memory limit exceeded") {
+		t.Fatalf("got %v", err)
+	}
+	if ch.queries[0].auth != "" {
+		t.Fatalf("got Authorization %q", ch.queries[0].auth)
+	}
+}
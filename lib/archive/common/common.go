@@ -18,20 +18,33 @@ package common
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cespare/xxhash"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pierrec/lz4/v4"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+// DefaultLogger is used where there are no options to pass a logger
+// (OpenArchive, Copy, etc.). Callers may replace it.
+var DefaultLogger, _ = zap.NewProduction()
+
 // FinalizerFunc is a callback that will be called on Close.
 // Typically one would rename the file to the final desired name
 // OR upload the file to S3 or Azure Blobstore. Users of this
@@ -39,11 +52,34 @@ import (
 type FinalizerFunc func() (finalFile ArchiveFileDetails, err error)
 
 type ArchiveFileDetails struct {
-	FileName      string // Not filled when it is a checksum-only writer.
-	BytesWritten  int64  // Always filled
-	ChunksWritten int64  // Always filled, but does not accurately represent rows/requests.
-	RowsWritten   int64  // Not filled by archiver
-	Checksum      string // Sometimes filled: only by checksum-only writer.
+	FileName      string    // Not filled when it is a checksum-only writer.
+	URL           string    // Where the file ended up, in the form accepted by OpenArchive.
+	BytesWritten  int64     // Always filled
+	ChunksWritten int64     // Always filled, but does not accurately represent rows/requests.
+	RowsWritten   int64     // Filled if the writer calls AddRows (request.SaveRequest does)
+	Checksum      string    // Checksum-only writer, or with OnFinalize: xxhash of the uncompressed file
+	Failover      string    // Set if the file is not in its primary output: why, see FailedOver
+	FirstRow      time.Time // Set with RowsWritten: when the first and last rows were added
+	LastRow       time.Time
+}
+
+// DirPrefix is the key prefix of the objects of directory `dir` of a bucket
+// or container: `dir` with a trailing slash, for the listing of "captures" not
+// to take in "captures-old/" or "captures2/" as well. Empty (the whole bucket)
+// stays empty.
+func DirPrefix(dir string) string {
+	if dir == "" || strings.HasSuffix(dir, "/") {
+		return dir
+	}
+	return dir + "/"
+}
+
+// ArchiveEntry is one file as returned by ListDetails. Name is in the
+// same form returned by List (and accepted by Delete) of the same backend.
+type ArchiveEntry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
 }
 
 // BasicArchive encapsulates some common functionality between
@@ -52,21 +88,60 @@ type BasicArchive struct {
 	Logger           *zap.Logger
 	writing          bool
 	deleteOnClose    bool
-	fp               *os.File      // Underlying FP. Needed to close and flush after we are done.
-	zw               *lz4.Writer   // Used only if compression is enabled.
-	zr               *lz4.Reader   // Used only if compression is enabled.
-	bw               *bufio.Writer // If set, all writes are buffered
-	br               *bufio.Reader // If set, all reads are buffered
-	fqfn             string        // name, for debugging/printing only
+	fp               *os.File       // Underlying FP. Needed to close and flush after we are done.
+	rs               io.Closer      // Instead of fp, with OpenStream
+	us               UploadStream   // Instead of fp, with Streamer
+	out              io.Writer      // fp (or us), or fp counting into `stored` when writing
+	hw               *hashingWriter // Used only with the checksum footer, on top of out
+	zw               compressor     // Used only if compression is enabled.
+	ew               *encryptor     // Used only if encryption is enabled, under zw
+	zr               io.ReadCloser  // Used only if compression is enabled.
+	bw               *bufio.Writer  // If set, all writes are buffered
+	br               *bufio.Reader  // If set, all reads are buffered
+	fqfn             string         // name, for debugging/printing only
 	stageDir         string
+	staging          string          // see StagingDirectory
+	ctx              context.Context // see Context
 	prefix           string
 	extension        string
-	compress         bool
+	codec            string // see Compression, empty if uncompressed
 	bufferSize       int
 	bytesWritten     int64 // to see if file is empty at Close (during finalize)
 	ChunksWritten    int64
 	Finalizer        FinalizerFunc
+	Streamer         StreamerFunc  // If set, files are uploaded as they are written, see StreamUpload
+	fileHeader       func() []byte // If set, written at the start of every file created by Rotate
+	onFinalize       func(ArchiveFileDetails)
+	stored           *int64      // If set, bytes written to files (compressed) are added to it
+	xh               hash.Hash64 // Used only with onFinalize, checksum of the current file
+	rowsWritten      int64       // of the current file, see AddRows
+	firstRow         time.Time
+	lastRow          time.Time
 	finalizedDetails map[string]ArchiveFileDetails
+	sshKeyFile       string        // sftp backend, see SSHKey
+	failover         string        // see FailedOver
+	key              []byte        // see Encrypt
+	footer           bool          // see ChecksumFooter
+	streamUpload     bool          // see StreamUpload
+	maxFileSize      int64         // see MaxFileSize
+	fileSize         int64         // stored in the current file, see StoredSize
+	maxRows          int64         // see MaxRows
+	template         string        // see FilenameTemplate
+	hostname         string        // for FilenameTemplate
+	finalName        string        // of the current file, see FinalName
+	index            bool          // see Index
+	iw               *indexWriter  // index of the current file
+	indexFile        string        // index of the file being finalized, see StoreIndex
+	retries          int           // see RetryFinalize
+	retryBackoff     time.Duration // before the first retry
+	retryDir         string        // see RetryDirectory
+	concurrent       bool          // see Concurrent
+	rotateEvery      time.Duration
+	timer            *time.Timer // of the current file, see RotateEvery
+	generation       int64       // files created by Rotate, to tell if the timer is still that of the current file
+	timerErr         error       // rotation by the timer that failed, see RotateEvery
+	mu               *sync.Mutex // held by Write, Flush, Rotate, Close and AddRows
+	nameMu           *sync.Mutex // of fqfn and finalName, which can't be read under mu: Finalizers do
 	//finalizedFiles   []string
 }
 
@@ -82,9 +157,17 @@ func NewBasicArchive(stageDir, prefix, extension string,
 		prefix:           prefix,
 		extension:        extension,
 		finalizedDetails: make(map[string]ArchiveFileDetails),
+		mu:               &sync.Mutex{},
+		nameMu:           &sync.Mutex{},
 	}
 	for _, option := range options {
-		option(ba)
+		err = option(ba)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ba.stageDir == "" {
+		ba.stageDir = ba.staging
 	}
 	if ba.Logger == nil { // still unset, have a default
 		ba.Logger, err = zap.NewProduction()
@@ -95,13 +178,89 @@ func NewBasicArchive(stageDir, prefix, extension string,
 	return ba, nil
 }
 
+// Compress has files written lz4 compressed, or not
 func Compress(c bool) func(*BasicArchive) error {
 	return func(b *BasicArchive) error {
-		b.compress = c
+		b.codec = ""
+		if c {
+			b.codec = "lz4"
+		}
+		return nil
+	}
+}
+
+// Compression has files written compressed with `codec`: lz4 (as Compress),
+// zstd, snappy (framed, cheapest on CPU), or none
+func Compression(codec string) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		_, err := CodecExtension(codec)
+		if err != nil {
+			return err
+		}
+		b.codec = codec
+		if codec == "none" {
+			b.codec = ""
+		}
 		return nil
 	}
 }
 
+// compressor is what the codecs of Compression write through
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// CodecExtension is the extension of files compressed with `codec`, see
+// Compression, empty for none
+func CodecExtension(codec string) (ext string, err error) {
+	switch codec {
+	case "lz4":
+		return ".lz4", nil
+	case "zstd":
+		return ".zst", nil
+	case "snappy":
+		return ".sz", nil
+	case "none", "":
+		return "", nil
+	}
+	return "", errors.Errorf("Unknown compression codec %s (lz4, zstd, snappy or none)", codec)
+}
+
+// NewCompressor picks a compressor by file extension, as NewDecompressor
+// does. Returns nil if the extension is not one of a codec of Compression.
+func NewCompressor(fileName string, w io.Writer) (zw io.WriteCloser, err error) {
+
+	switch compressionExt(fileName) {
+	case ".lz4":
+		return newCompressor("lz4", w)
+	case ".zst":
+		return newCompressor("zstd", w)
+	case ".sz":
+		return newCompressor("snappy", w)
+	}
+	return nil, nil
+}
+
+// newCompressor returns the compressor of `codec`, nil if none
+func newCompressor(codec string, w io.Writer) (zw compressor, err error) {
+
+	switch codec {
+	case "lz4":
+		return lz4.NewWriter(w), nil
+	case "zstd":
+		zw, err = zstd.NewWriter(w)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to create zstd encoder")
+		}
+		return zw, nil
+	case "snappy":
+		// Recorder threads already compress in parallel: one goroutine each
+		return s2.NewWriter(w, s2.WriterSnappyCompat(), s2.WriterConcurrency(1)), nil
+	}
+	return nil, nil
+}
+
 func BufferSize(bufferSize int) func(*BasicArchive) error {
 	return func(b *BasicArchive) error {
 		b.bufferSize = bufferSize
@@ -116,14 +275,204 @@ func Logger(logger *zap.Logger) func(*BasicArchive) error {
 	}
 }
 
+// FileHeader sets a function whose output is written at the start of every new
+// file. Header bytes do not count towards bytes written, so a file with only
+// a header in it is still considered empty and deleted at Close.
+func FileHeader(header func() []byte) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		b.fileHeader = header
+		return nil
+	}
+}
+
+// OnFinalize sets a function called with the details of every file once it
+// is finalized, i.e. renamed or uploaded to its final location. Setting it
+// also has the content checksum computed while writing.
+func OnFinalize(f func(ArchiveFileDetails)) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		b.onFinalize = f
+		return nil
+	}
+}
+
+// CountStored sets a counter bytes written to archive files, after
+// compression and buffering, are added to. It is updated atomically, so it can
+// be read while files are written, and can be shared by several archives.
+func CountStored(counter *int64) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		b.stored = counter
+		return nil
+	}
+}
+
+// SSHKey sets the private key file the sftp backend authenticates with,
+// instead of the default keys of ~/.ssh and the ssh agent. Other backends
+// ignore it.
+func SSHKey(keyFile string) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		if keyFile != "" {
+			if _, err := os.Stat(keyFile); err != nil {
+				return errors.Wrapf(err, "Unable to use ssh key")
+			}
+		}
+		b.sshKeyFile = keyFile
+		return nil
+	}
+}
+
+// StagingDirectory has backends that stage files on local disk before they
+// upload them (s3, az, gs, ...) stage them in `dir`, created if needed,
+// instead of the system temporary directory. Local output is staged in the
+// output directory, for files to be renamed into place: it is ignored there.
+func StagingDirectory(dir string) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		b.staging = dir
+		return nil
+	}
+}
+
+// Context sets the context of the uploads and other requests backends make
+// to store the files of the archive (s3, az, adls, gs so far; others ignore
+// it): once it is cancelled or past its deadline, a file being uploaded fails
+// to be finalized, and is left behind as a failed upload would be.
+func Context(ctx context.Context) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		if ctx == nil {
+			return errors.New("Nil context")
+		}
+		b.ctx = ctx
+		return nil
+	}
+}
+
+// Context is that of Context, context.Background() if not set, for backends
+// to make their requests with
+func (rf *BasicArchive) Context() context.Context {
+	if rf.ctx == nil {
+		return context.Background()
+	}
+	return rf.ctx
+}
+
+// FailedOver marks the files of an archive that stands in for a failed
+// output: `cause` is set as their Failover detail
+func FailedOver(cause string) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		b.failover = cause
+		return nil
+	}
+}
+
+// MaxFileSize has Write rotate the file once `size` bytes are stored in it
+// (compressed, encrypted), before writing more (0 - no limit). What
+// compression and buffers hold is not counted until it is written out, so
+// files end up over `size` by that much and by a write. Every Write must
+// hold whole frames, as request.SaveRequest and request.SaveFrames do,
+// since the file can change between two of them.
+func MaxFileSize(size int64) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		if size < 0 {
+			return errors.Errorf("Largest file size can't be negative, got %d", size)
+		}
+		b.maxFileSize = size
+		return nil
+	}
+}
+
+// MaxRows has Write rotate the file once `n` rows were counted in it with
+// AddRows, before writing more (0 - no limit), so that files have the same
+// number of requests. A Write of several rows can go over: see RowsLeft, used
+// by request.SaveFrames to split them. Backends that don't write files
+// through BasicArchive ignore it.
+func MaxRows(n int64) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		if n < 0 {
+			return errors.Errorf("Largest number of rows can't be negative, got %d", n)
+		}
+		b.maxRows = n
+		return nil
+	}
+}
+
+// RowsLeft is how many rows the next Write can take without going over
+// MaxRows: what is left of the current file, or all of a new one if the
+// file is full, as Write then rotates it. -1 without MaxRows.
+func (rf *BasicArchive) RowsLeft() int64 {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.maxRows == 0 {
+		return -1
+	}
+	if left := rf.maxRows - rf.rowsWritten; left > 0 {
+		return left
+	}
+	return rf.maxRows
+}
+
+// RotateEvery has files rotated by a timer: `d` after it was created, a
+// file anything was written to is finalized and a new one started (0 - only
+// when Rotate is called). Write, Flush, Rotate, Close and AddRows are
+// serialized, since the timer rotates from a goroutine of its own. A
+// rotation of the timer that failed is returned by the next Write or Flush.
+// Backends that don't write files through BasicArchive ignore it.
+func RotateEvery(d time.Duration) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		if d < 0 {
+			return errors.Errorf("Rotation interval can't be negative, got %s", d)
+		}
+		b.rotateEvery = d
+		return nil
+	}
+}
+
+// RotatesOnTimer tells if files are rotated by the timer of RotateEvery, so
+// callers don't need to rotate them on their own
+func (rf *BasicArchive) RotatesOnTimer() bool {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.timer != nil
+}
+
+// countingWriter adds the bytes written through it to *n, atomically
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw countingWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
 func (rf *BasicArchive) Name() string {
+	rf.nameMu.Lock()
+	defer rf.nameMu.Unlock()
 	return rf.fqfn
 }
 
+func (rf *BasicArchive) setName(name, finalName string) {
+	rf.nameMu.Lock()
+	rf.fqfn, rf.finalName = name, finalName
+	rf.nameMu.Unlock()
+}
+
 func (rf *BasicArchive) TrueContentLength() int64 {
 	return rf.bytesWritten
 }
 
+// AddRows counts rows (requests) written to the current file. Writes alone
+// can't tell, as a row may take several of them.
+func (rf *BasicArchive) AddRows(n int64) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.lastRow = time.Now()
+	if rf.rowsWritten == 0 {
+		rf.firstRow = rf.lastRow
+	}
+	rf.rowsWritten += n
+}
+
 // Write satisfies io.Writer interface - main logic is the transparent
 // write to LZ4, Bufio, or Raw FP depending on how the file was
 // opened
@@ -133,23 +482,51 @@ func (rf *BasicArchive) Write(buf []byte) (int, error) {
 		return 0, errors.New("file is not opened for write")
 	}
 
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.timerErr != nil {
+		err := rf.timerErr
+		rf.timerErr = nil
+		return 0, errors.Wrapf(err, "Rotation on timer failed")
+	}
+
+	if rf.bytesWritten > 0 && (rf.maxFileSize > 0 && rf.fileSize >= rf.maxFileSize ||
+		rf.maxRows > 0 && rf.rowsWritten >= rf.maxRows) {
+		rf.Logger.Debug("Rotating at file limit", zap.String("file", rf.fqfn),
+			zap.Int64("size", rf.fileSize), zap.Int64("rows", rf.rowsWritten))
+		err := rf.rotate()
+		if err != nil { // nothing of buf written, it can be written elsewhere
+			return 0, errors.Wrapf(err, "Unable to rotate at file limit")
+		}
+	}
+
 	rf.bytesWritten += int64(len(buf))
 	rf.ChunksWritten += 1
 	// above counter is not meant to be accurate.
 	// so we ignore the cases if actual write below
 	// errors out.
+	if rf.xh != nil {
+		rf.xh.Write(buf)
+	}
+	if rf.iw != nil {
+		rf.iw.add(buf)
+	}
 
 	if rf.zw != nil {
 		return rf.zw.Write(buf)
 	}
 
+	if rf.ew != nil {
+		return rf.ew.Write(buf)
+	}
+
 	if rf.bw != nil {
 		// buffered write: write to the underlying buffer directly
 		return rf.bw.Write(buf)
 	}
 
 	// else write to the underlying file directly
-	return rf.fp.Write(buf)
+	return rf.out.Write(buf)
 }
 
 // Read satisfies io.Reader interface - main logic is the transparent
@@ -174,21 +551,31 @@ func (rf *BasicArchive) Read(p []byte) (n int, err error) {
 	return rf.fp.Read(p)
 }
 
-// Flush complements io.Writer
+// Flush complements io.Writer: data written so far is compressed (as a
+// complete lz4 block or zstd frame), written out of the buffer and synced to disk. After a
+// crash, the file can be read up to there.
 func (rf *BasicArchive) Flush() (err error) {
 
-	if rf.zw == nil {
-		rf.Logger.Debug("Flushing", zap.String("file", rf.Name()))
-		if err == nil && rf.bw != nil {
-			err = rf.bw.Flush()
-		}
-		if err == nil && rf.fp != nil {
-			err = rf.fp.Sync()
-		}
-	} else {
-		rf.Logger.Warn("Flush() supported only for uncompressed streams")
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.timerErr != nil {
+		err = rf.timerErr
+		rf.timerErr = nil
+		return errors.Wrapf(err, "Rotation on timer failed")
+	}
+	rf.Logger.Debug("Flushing", zap.String("file", rf.Name()))
+	if rf.zw != nil {
+		err = rf.zw.Flush()
+	}
+	if err == nil && rf.ew != nil {
+		err = rf.ew.Flush()
+	}
+	if err == nil && rf.bw != nil {
+		err = rf.bw.Flush()
+	}
+	if err == nil && rf.fp != nil {
+		err = rf.fp.Sync()
 	}
-
 	return err
 }
 
@@ -196,6 +583,17 @@ func (rf *BasicArchive) Flush() (err error) {
 // logic for write to finalize the file from temp-name to
 // final-name
 func (rf *BasicArchive) Close() (err error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.close()
+}
+
+func (rf *BasicArchive) close() (err error) {
+
+	if rf.timer != nil {
+		rf.timer.Stop()
+		rf.timer = nil
+	}
 
 	// -------------------------------------------------------
 	// NOTE: Make sure Close() can be called *more than once*
@@ -212,6 +610,14 @@ func (rf *BasicArchive) Close() (err error) {
 		rf.zw = nil
 	}
 
+	if rf.ew != nil {
+		err = rf.ew.Close()
+		if err != nil {
+			return err
+		}
+		rf.ew = nil
+	}
+
 	if rf.bw != nil {
 		err = rf.bw.Flush()
 		if err != nil {
@@ -220,16 +626,43 @@ func (rf *BasicArchive) Close() (err error) {
 		rf.bw = nil
 	}
 
-	// These readers don't have .Close() or .Flush()
-	rf.zr = nil
-	rf.br = nil
-
-	if rf.fp != nil {
-		err = rf.fp.Close()
+	if rf.hw != nil {
+		err = rf.hw.writeFooter()
 		if err != nil {
 			return err
 		}
-		rf.fp = nil
+		rf.hw = nil
+	}
+
+	if rf.iw != nil {
+		ok, ierr := rf.iw.finish(rf.Logger)
+		if ierr != nil { // the file is fine without it
+			rf.Logger.Error("Index failed", zap.String("file", rf.fqfn), zap.Error(ierr))
+		}
+		if ok {
+			rf.indexFile = rf.iw.fp.Name()
+		}
+		rf.iw = nil
+	}
+
+	if rf.zr != nil {
+		rf.zr.Close() // releases decoder resources, nothing to flush
+		rf.zr = nil
+	}
+	rf.br = nil
+	if rf.rs != nil {
+		rf.rs.Close() // stops the download, nothing to delete
+		rf.rs = nil
+	}
+
+	if rf.fp != nil || rf.us != nil {
+		if rf.fp != nil {
+			err = rf.fp.Close()
+			if err != nil {
+				return err
+			}
+			rf.fp = nil
+		}
 
 		filePath := rf.Name()
 		if (rf.writing && rf.bytesWritten == 0) || (!rf.writing && rf.deleteOnClose) {
@@ -237,21 +670,35 @@ func (rf *BasicArchive) Close() (err error) {
 				zap.String("file", filePath),
 				zap.Int64("bytesWritten", rf.bytesWritten),
 				zap.Bool("deleteOnClose", rf.deleteOnClose))
+			rf.removeIndex()
+			if rf.us != nil { // nothing stored yet
+				rf.us.Abort()
+				rf.us = nil
+				return nil
+			}
 			err = os.Remove(filePath)
 			return err
 		}
 
+		if rf.us != nil {
+			err = rf.us.Close() // the upload completes
+			rf.us = nil
+			if err != nil {
+				rf.removeIndex()
+				return errors.Wrapf(err, "Unable to complete upload of %s", filePath)
+			}
+		}
+
 		if rf.writing && rf.Finalizer != nil {
-			finalFile, err := rf.Finalizer()
+			finalFile, err := rf.finalize() // the Finalizer, retried, see RetryFinalize
+			rf.removeIndex()                // unless the Finalizer stored it, see StoreIndex
 			rf.Logger.Debug("Finalizer returned",
 				zap.String("finalName", finalFile.FileName),
 				zap.Error(err))
 			if err != nil {
 				return err
 			}
-			if finalFile.FileName != "" {
-				rf.finalizedDetails[finalFile.FileName] = finalFile
-			}
+			rf.Finalized(finalFile)
 		}
 	}
 
@@ -259,28 +706,96 @@ func (rf *BasicArchive) Close() (err error) {
 	return err
 }
 
+// Finalized records a file that reached its final location: rows counted
+// with AddRows (and the checksum, with OnFinalize) are added to `finalFile`,
+// which is then listed by FinalizedFiles and passed to the OnFinalize
+// function. Close calls it after the Finalizer; backends that don't write
+// files through BasicArchive call it themselves, followed by Reset.
+func (rf *BasicArchive) Finalized(finalFile ArchiveFileDetails) {
+	finalFile.RowsWritten = rf.rowsWritten
+	finalFile.FirstRow, finalFile.LastRow = rf.firstRow, rf.lastRow
+	if rf.xh != nil && finalFile.Checksum == "" {
+		finalFile.Checksum = fmt.Sprintf("%0X", rf.xh.Sum64())
+	}
+	if rf.failover != "" && finalFile.Failover == "" {
+		finalFile.Failover = rf.failover
+	}
+	if finalFile.FileName != "" {
+		rf.finalizedDetails[finalFile.FileName] = finalFile
+	}
+	if rf.onFinalize != nil {
+		rf.onFinalize(finalFile)
+	}
+}
+
+// Header returns what FileHeader has every file start with, or nil if
+// unset. For backends that don't write files through BasicArchive.
+func (rf *BasicArchive) Header() []byte {
+	if rf.fileHeader == nil {
+		return nil
+	}
+	return rf.fileHeader()
+}
+
+// WriteBufferSize is the buffer size set with BufferSize (0 - unbuffered).
+// Backends that don't write files use it to size their batches.
+func (rf *BasicArchive) WriteBufferSize() int {
+	return rf.bufferSize
+}
+
+// AddStored adds `n` bytes stored by a backend that doesn't write files
+// through BasicArchive to the CountStored counter, if any
+func (rf *BasicArchive) AddStored(n int64) {
+	if rf.stored != nil {
+		atomic.AddInt64(rf.stored, n)
+	}
+}
+
+// SSHKeyFile is the key file set with SSHKey, empty if unset
+func (rf *BasicArchive) SSHKeyFile() string {
+	return rf.sshKeyFile
+}
+
+// FinalizedFiles lists the files finalized so far, by name. It is a copy,
+// files may be finalized by the timer of RotateEvery meanwhile.
 func (rf *BasicArchive) FinalizedFiles() map[string]ArchiveFileDetails {
-	return rf.finalizedDetails
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	files := make(map[string]ArchiveFileDetails, len(rf.finalizedDetails))
+	for name, details := range rf.finalizedDetails {
+		files[name] = details
+	}
+	return files
 }
 
 func (rf *BasicArchive) Reset() {
 	// Get it ready for next rotated file
 	rf.bytesWritten = 0 // reset the tracker
-	rf.fqfn = ""
+	rf.rowsWritten = 0
+	rf.firstRow, rf.lastRow = time.Time{}, time.Time{}
+	rf.setName("", "")
 }
 
 // Rotate creates a new archive file or if one already exists,
 // then it closes the current one and create another empty file
 // To keep file sizes small, Rotate() must be called at regular
-// intervals (either by size or time depending on your preference)
+// intervals (either by size or time depending on your preference),
+// or by Write at a size or row limit, see MaxFileSize and MaxRows, or by a timer, see
+// RotateEvery
 func (rf *BasicArchive) Rotate() (err error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.rotate()
+}
+
+func (rf *BasicArchive) rotate() (err error) {
 
 	if !rf.writing {
 		return errors.New("file is not opened for write")
 	}
 
-	if rf.fp != nil { // current active file
-		err = rf.Close() // Close and finalize file
+	if rf.fp != nil || rf.us != nil { // current active file
+		err = rf.close() // Close and finalize file
 		if err != nil {
 			return errors.Wrapf(err, "Error closing the current archive file")
 		}
@@ -294,8 +809,10 @@ func (rf *BasicArchive) Rotate() (err error) {
 	if rf.extension != "" {
 		extension += "." + rf.extension
 	}
-	if rf.compress {
-		extension += ".lz4"
+	codecExt, _ := CodecExtension(rf.codec)
+	extension += codecExt
+	if rf.key != nil {
+		extension += encryptionExt
 	}
 
 	if rf.stageDir != "" {
@@ -305,31 +822,235 @@ func (rf *BasicArchive) Rotate() (err error) {
 		}
 	}
 
-	rf.fp, err = ioutil.TempFile(rf.stageDir, fmt.Sprintf("%s_%s_*%s.tmp", rf.prefix, ts, extension))
-	if err != nil {
-		return errors.Wrap(err, "Unable to open temporary file for writing")
+	if rf.Streamer != nil {
+		random := randomName()
+		finalName := fmt.Sprintf("%s_%s_%s%s", rf.prefix, ts, random, extension)
+		if rf.template != "" {
+			finalName = rf.expandTemplate(n, random, extension)
+		}
+		rf.us, err = rf.Streamer(finalName)
+		if err != nil {
+			return errors.Wrap(err, "Unable to start upload")
+		}
+		rf.setName(rf.us.Name(), finalName)
+	} else {
+		rf.fp, err = ioutil.TempFile(rf.stageDir, fmt.Sprintf("%s_%s_*%s.tmp", rf.prefix, ts, extension))
+		if err != nil {
+			return errors.Wrap(err, "Unable to open temporary file for writing")
+		}
+		finalName := strings.TrimSuffix(filepath.Base(rf.fp.Name()), ".tmp")
+		if rf.template != "" {
+			random := strings.TrimSuffix(strings.TrimPrefix(finalName, fmt.Sprintf("%s_%s_", rf.prefix, ts)), extension)
+			finalName = rf.expandTemplate(n, random, extension)
+		}
+		rf.setName(rf.fp.Name(), finalName)
+	}
+	rf.generation++
+	if rf.rotateEvery > 0 {
+		rf.startTimer()
+	}
+	if rf.onFinalize != nil {
+		rf.xh = xxhash.New()
 	}
-	rf.fqfn = rf.fp.Name()
 
-	var stream io.Writer
-	stream = rf.fp
+	rf.out = rf.fp
+	if rf.us != nil {
+		rf.out = rf.us
+	}
+	if rf.stored != nil {
+		rf.out = countingWriter{w: rf.out, n: rf.stored}
+	}
+	rf.fileSize = 0
+	if rf.maxFileSize > 0 || rf.us != nil {
+		rf.out = countingWriter{w: rf.out, n: &rf.fileSize}
+	}
+	if rf.footer {
+		rf.hw = &hashingWriter{w: rf.out, h: xxhash.New()}
+		rf.out = rf.hw
+	}
+	stream := rf.out
 	if rf.bufferSize > 0 {
-		rf.bw = bufio.NewWriterSize(rf.fp, rf.bufferSize)
+		rf.bw = bufio.NewWriterSize(rf.out, rf.bufferSize)
 		stream = rf.bw
 	}
 
-	if rf.compress {
-		rf.zw = lz4.NewWriter(stream)
+	if rf.key != nil {
+		rf.ew, err = newEncryptor(stream, rf.key)
+		if err != nil {
+			return err
+		}
+		stream = rf.ew
+	}
+
+	rf.zw, err = newCompressor(rf.codec, stream)
+	if err != nil {
+		return err
+	}
+
+	if rf.index {
+		indexFile := strings.TrimSuffix(rf.fqfn, ".tmp") + IndexExt + ".tmp"
+		if rf.us != nil { // staged locally all the same, it is small
+			dir := rf.stageDir
+			if dir == "" {
+				dir = os.TempDir()
+			}
+			indexFile = filepath.Join(dir, path.Base(rf.finalName)+IndexExt+".tmp")
+		}
+		rf.iw, err = newIndexWriter(indexFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if rf.fileHeader != nil {
+		if rf.zw != nil {
+			stream = rf.zw
+		}
+		header := rf.fileHeader()
+		if rf.xh != nil {
+			rf.xh.Write(header)
+		}
+		if rf.iw != nil {
+			rf.iw.add(header)
+		}
+		_, err = stream.Write(header)
+		if err != nil {
+			return errors.Wrap(err, "Unable to write file header")
+		}
 	}
 
-	rf.Logger.Debug("Created", zap.String("file", rf.fqfn), zap.Int("bufferSize", rf.bufferSize), zap.Bool("compress", rf.compress))
+	rf.Logger.Debug("Created", zap.String("file", rf.fqfn), zap.Int("bufferSize", rf.bufferSize), zap.String("codec", rf.codec))
 	return err
 }
 
-// OpenArchive opens an archive file for reading. `*BasicArchive` returned is an io.Reader
+// startTimer has the current file rotated once it is rotateEvery old
+func (rf *BasicArchive) startTimer() {
+	generation := rf.generation
+	rf.timer = time.AfterFunc(rf.rotateEvery, func() {
+		rf.mu.Lock()
+		defer rf.mu.Unlock()
+		if generation != rf.generation || rf.fp == nil && rf.us == nil { // rotated or closed meanwhile
+			return
+		}
+		if rf.bytesWritten == 0 { // nothing to rotate yet
+			rf.startTimer()
+			return
+		}
+		rf.Logger.Debug("Rotating on timer", zap.String("file", rf.fqfn))
+		err := rf.rotate()
+		if err != nil {
+			rf.Logger.Error("Rotation on timer failed", zap.String("file", rf.fqfn), zap.Error(err))
+			rf.timerErr = err
+		}
+	})
+}
+
+// NewDecompressor picks a decompressor by file extension: .lz4, .gz, .zst or .sz,
+// or .enc for encrypted files (see Encrypt), decompressed as well if they
+// need to. Returns nil if the file is not compressed. A trailing .tmp is ignored, so
+// it works with files still being written as well. If `r` is a
+// *bufio.Reader, the magic bytes the file starts with tell instead (see
+// SniffCompression), so that renamed or extension-less files are read right
+// too; the extension only counts for files too short to tell, e.g. still
+// being written.
+func NewDecompressor(fileName string, r io.Reader) (zr io.ReadCloser, err error) {
+
+	ext := compressionExt(fileName)
+	if br, ok := r.(*bufio.Reader); ok {
+		head, _ := br.Peek(magicLen) // short files are handled below, ignore errors
+		if sniffed := SniffCompression(head); sniffed != "" || len(head) >= minMagicLen {
+			ext = sniffed
+		}
+	}
+	return newDecompressor(ext, r)
+}
+
+// newDecompressor returns the decompressor of extension `ext`, nil if none
+func newDecompressor(ext string, r io.Reader) (zr io.ReadCloser, err error) {
+
+	switch ext {
+	case ".lz4":
+		return ioutil.NopCloser(lz4.NewReader(r)), nil
+	case ".gz":
+		return gzip.NewReader(r)
+	case ".zst":
+		zd, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zd.IOReadCloser(), nil
+	case ".sz":
+		return ioutil.NopCloser(s2.NewReader(r)), nil
+	case encryptionExt: // compressed or not, inside
+		dr, err := NewDecryptor(r)
+		if err != nil {
+			return nil, err
+		}
+		inner := bufio.NewReader(dr)
+		zr, err := NewDecompressor("", inner)
+		if err != nil || zr != nil {
+			return zr, err
+		}
+		return ioutil.NopCloser(inner), nil
+	}
+	return nil, nil
+}
+
+// IsCompressed is true if NewDecompressor has a decompressor for the file
+func IsCompressed(fileName string) bool {
+	switch compressionExt(fileName) {
+	case ".lz4", ".gz", ".zst", ".sz", encryptionExt:
+		return true
+	}
+	return false
+}
+
+func compressionExt(fileName string) string {
+	return strings.ToLower(filepath.Ext(strings.TrimSuffix(fileName, ".tmp")))
+}
+
+// magics are what files of each compression start with: the magic number
+// of lz4 and zstd frames, gzip members, the stream identifier of framed
+// snappy, and the header of encrypted files. Archive files (.fbf) start with
+// a frame header, none of these.
+var magics = []struct {
+	ext   string
+	magic []byte
+}{
+	{".lz4", []byte{0x04, 0x22, 0x4d, 0x18}},
+	{".lz4", []byte{0x02, 0x21, 0x4c, 0x18}}, // legacy frame
+	{".zst", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{".gz", []byte{0x1f, 0x8b}},
+	{".sz", []byte("\xff\x06\x00\x00sNaPpY")},
+	{encryptionExt, []byte(encMagic)},
+}
+
+// magicLen is enough of a file to tell all magics apart. Files of
+// minMagicLen bytes or more without any of them are not compressed (gzip
+// has the shortest magic, but no gzip file is that short).
+const (
+	magicLen    = 10
+	minMagicLen = 4
+)
+
+// SniffCompression is the extension of the compression a file starting with
+// `head` has, told by its magic bytes, empty if none is recognized
+func SniffCompression(head []byte) string {
+	for _, m := range magics {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.ext
+		}
+	}
+	return ""
+}
+
+// OpenArchive opens an archive file for reading. `*BasicArchive` returned is an io.Reader.
+// Compression is told by content, or else by extension (see NewDecompressor).
+// A file with a checksum footer is checked first (see ChecksumFooter).
 func OpenArchive(fileName string, bufferSize int, deleteOnClose bool) (rf *BasicArchive, err error) {
 
-	rf = &BasicArchive{writing: false, deleteOnClose: deleteOnClose}
+	rf = &BasicArchive{writing: false, deleteOnClose: deleteOnClose, Logger: DefaultLogger,
+		mu: &sync.Mutex{}, nameMu: &sync.Mutex{}}
 
 	rf.fqfn = fileName
 	rf.fp, err = os.Open(fileName)
@@ -337,20 +1058,37 @@ func OpenArchive(fileName string, bufferSize int, deleteOnClose bool) (rf *Basic
 		rf.Logger.Error("os.Open failed", zap.String("file", fileName), zap.Error(err))
 		return nil, errors.Wrapf(err, "Error opening file %s", fileName)
 	}
+	dataLen, err := VerifyFooter(rf.fp)
+	if err != nil {
+		rf.fp.Close()
+		return nil, err
+	}
 	var stream io.Reader
-	stream = rf.fp
-	if strings.HasSuffix(strings.ToLower(fileName), ".lz4") {
-		rf.zr = lz4.NewReader(rf.fp)
+	stream = bufio.NewReader(io.LimitReader(rf.fp, dataLen)) // to sniff the compression
+	rf.zr, err = NewDecompressor(fileName, stream)
+	if err != nil {
+		rf.fp.Close()
+		return nil, errors.Wrapf(err, "Error opening file %s", fileName)
+	}
+	if rf.zr != nil {
 		stream = rf.zr
 	}
 	if bufferSize > 0 {
 		rf.br = bufio.NewReaderSize(stream, bufferSize)
+	} else if br, ok := stream.(*bufio.Reader); ok { // uncompressed, read on after the sniff
+		rf.br = br
 	}
 	return rf, nil
 }
 
-// ProgressPrinter is a helper function. Currently only usable with Azure blob upload
+// ProgressPrinter is a helper function, for Azure and S3 transfers
 func (rf *BasicArchive) ProgressPrinter(statChan chan int64, fileName string, fileSize int64, wg *sync.WaitGroup) {
+	ProgressPrinter(rf.Logger, statChan, fileName, fileSize, wg)
+}
+
+// ProgressPrinter logs transfer progress received over statChan every 100MB
+// until statChan is closed. Usable where there is no *BasicArchive (yet).
+func ProgressPrinter(logger *zap.Logger, statChan chan int64, fileName string, fileSize int64, wg *sync.WaitGroup) {
 
 	defer wg.Done()
 	total := int64(0)
@@ -361,13 +1099,13 @@ func (rf *BasicArchive) ProgressPrinter(statChan chan int64, fileName string, fi
 			diff := bytesTransferred - lastPrinted
 			if diff > 100_000_000 {
 				if fileSize != 0 {
-					rf.Logger.Debug("Upload Status",
+					logger.Debug("Upload Status",
 						zap.String("file", fileName),
 						zap.Int64("bytesTransferred", bytesTransferred),
 						zap.Int64("fileSize", fileSize),
 						zap.Float64("percentDone", float64(bytesTransferred*100.0)/float64(fileSize)))
 				} else {
-					rf.Logger.Debug("Upload Status",
+					logger.Debug("Upload Status",
 						zap.String("file", fileName),
 						zap.Int64("bytesTransferred", bytesTransferred))
 
@@ -375,7 +1113,7 @@ func (rf *BasicArchive) ProgressPrinter(statChan chan int64, fileName string, fi
 				lastPrinted = bytesTransferred
 			}
 		} else {
-			rf.Logger.Warn("Previous attempt failed",
+			logger.Warn("Previous attempt failed",
 				zap.String("file", fileName),
 				zap.Int64("Previous bytesTransferred", total),
 				zap.Int64("New bytesTransferred", bytesTransferred))
@@ -383,13 +1121,13 @@ func (rf *BasicArchive) ProgressPrinter(statChan chan int64, fileName string, fi
 		total = bytesTransferred
 	}
 	if fileSize != 0 {
-		rf.Logger.Debug("Upload Status [FINAL]",
+		logger.Debug("Upload Status [FINAL]",
 			zap.String("file", fileName),
 			zap.Int64("bytesTransferred", total),
 			zap.Int64("fileSize", fileSize),
 			zap.Float64("percentDone", float64(total*100.0)/float64(fileSize)))
 	} else {
-		rf.Logger.Debug("Upload Status [FINAL]",
+		logger.Debug("Upload Status [FINAL]",
 			zap.String("file", fileName),
 			zap.Int64("bytesTransferred", total))
 	}
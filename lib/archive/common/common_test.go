@@ -0,0 +1,157 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// tempDir is a directory removed at the end of the test
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// writeArchive writes `writes` to a new archive file of `dir`, one Write
+// each, and closes it. There is no Finalizer: the file is left where it was
+// written, as is its index, if any.
+func writeArchive(t *testing.T, dir string, writes [][]byte, options ...func(*BasicArchive) error) (fileName, indexFile string) {
+
+	rf, err := NewBasicArchive(dir, "requests", ".fbf", append(options, Logger(zap.NewNop()))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rf.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, buf := range writes {
+		if _, err = rf.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileName = rf.Name()
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return fileName, rf.indexFile
+}
+
+// readArchive is what an archive file has, decompressed and decrypted
+func readArchive(fileName string) (content []byte, err error) {
+	rf, err := OpenArchive(fileName, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	defer rf.Close()
+	return ioutil.ReadAll(rf)
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+
+	dir := tempDir(t)
+	key := testKey(t, 3)
+	var writes [][]byte
+	var want []byte
+	for i := 0; i < 500; i++ {
+		fr := testFrame(bytes.Repeat([]byte{byte(i)}, i), 0)
+		writes = append(writes, fr)
+		want = append(want, fr...)
+	}
+
+	tests := []struct {
+		name    string
+		options []func(*BasicArchive) error
+		ext     string
+	}{
+		{"plain", nil, ".fbf"},
+		{"buffered", []func(*BasicArchive) error{BufferSize(1000)}, ".fbf"},
+		{"lz4", []func(*BasicArchive) error{Compress(true)}, ".fbf.lz4"},
+		{"zstd", []func(*BasicArchive) error{Compression("zstd")}, ".fbf.zst"},
+		{"snappy", []func(*BasicArchive) error{Compression("snappy")}, ".fbf.sz"},
+		{"encrypted", []func(*BasicArchive) error{Encrypt(key)}, ".fbf.enc"},
+		{"zstd encrypted", []func(*BasicArchive) error{Compression("zstd"), Encrypt(key)}, ".fbf.zst.enc"},
+		{"footer", []func(*BasicArchive) error{ChecksumFooter(true)}, ".fbf"},
+		{"all", []func(*BasicArchive) error{Compression("snappy"), Encrypt(key), ChecksumFooter(true), BufferSize(4096)}, ".fbf.sz.enc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileName, _ := writeArchive(t, dir, writes, tt.options...)
+			if !strings.HasSuffix(fileName, tt.ext+".tmp") {
+				t.Fatalf("got file %s, want extension %s", fileName, tt.ext)
+			}
+			got, err := readArchive(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("got %d bytes back, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+// A file with nothing written is removed at Close
+func TestArchiveEmpty(t *testing.T) {
+	fileName, _ := writeArchive(t, tempDir(t), nil, Compress(true))
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Fatalf("%s left, %v", fileName, err)
+	}
+}
+
+func TestOpenArchiveErrors(t *testing.T) {
+
+	dir := tempDir(t)
+	fileName, _ := writeArchive(t, dir, [][]byte{testFrame([]byte("request"), 0)},
+		Encrypt(testKey(t, 3)))
+	encrypted, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"truncated", encrypted[:len(encrypted)-1]},
+		{"header only", encrypted[:encHeaderLen]},
+		{"unknown key", func() []byte {
+			buf := append([]byte(nil), encrypted...)
+			copy(buf[4:12], "unknown!")
+			return buf
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			damaged := fileName + "." + strings.ReplaceAll(tt.name, " ", "_")
+			if err := ioutil.WriteFile(damaged, tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := readArchive(damaged); err == nil {
+				t.Fatalf("no error, %d bytes read", len(got))
+			}
+		})
+	}
+	if _, err = OpenArchive(dir+"/missing.fbf", 0, false); err == nil {
+		t.Fatal("no error for a missing file")
+	}
+}
@@ -0,0 +1,32 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+// Concurrent has archive.NewArchive return an archive that several
+// goroutines can share (an archive.ConcurrentArchive): Write, Flush, Rotate
+// and Close are serialized, and so are requests saved with
+// request.SaveRequest and request.SaveFrames, rows counted with them, for
+// many producers to write to the same files rather than each to its own.
+// Without it (the default), an archive is to be written by one goroutine at
+// a time. Archives not built on BasicArchive (sum://) ignore it.
+func Concurrent(on bool) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		b.concurrent = on
+		return nil
+	}
+}
+
+// IsConcurrent tells if the archive was created with Concurrent(true)
+func (rf *BasicArchive) IsConcurrent() bool {
+	return rf.concurrent
+}
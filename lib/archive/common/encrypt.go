@@ -0,0 +1,368 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Encrypted files (.enc) are AES-256-GCM encrypted in chunks, after
+// compression, so that a file can be read (and recovered) up to any chunk:
+//
+//	header: "BHE1", key id (8 bytes), nonce prefix (7 random bytes)
+//	chunk:  length of the sealed chunk (4 bytes, big endian), sealed chunk
+//
+// The nonce of a chunk is the prefix, the chunk number (4 bytes, big endian)
+// and 1 for the last chunk, 0 otherwise, so that chunks can't be reordered,
+// nor a file cut short without it showing. The header is authenticated with
+// every chunk. The key id is the start of the SHA-256 of the key, to pick
+// the key a file needs among those known.
+const (
+	encMagic      = "BHE1"
+	encHeaderLen  = 4 + 8 + 7
+	encChunkSize  = 64 * 1024
+	encKeyEnv     = "BLACKHOLE_ENCRYPTION_KEY"
+	encryptionExt = ".enc"
+)
+
+// decryption keys by key id, see AddDecryptionKey
+var decryption struct {
+	sync.Mutex
+	keys    map[string][]byte
+	fromEnv bool
+}
+
+// Encrypt has files written AES-256-GCM encrypted with `key`, 32 bytes (see
+// LoadKey). ".enc" is added to their names. The key is added to those used
+// for reading too.
+func Encrypt(key []byte) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		err := AddDecryptionKey(key)
+		if err != nil {
+			return err
+		}
+		b.key = key
+		return nil
+	}
+}
+
+// AddDecryptionKey adds `key` to those encrypted files are read with. Keys
+// in BLACKHOLE_ENCRYPTION_KEY (comma separated, hex or base64) are always
+// tried as well.
+func AddDecryptionKey(key []byte) error {
+
+	if len(key) != 32 {
+		return errors.Errorf("Encryption key must be 32 bytes (AES-256), got %d", len(key))
+	}
+	decryption.Lock()
+	defer decryption.Unlock()
+	if decryption.keys == nil {
+		decryption.keys = make(map[string][]byte)
+	}
+	decryption.keys[keyID(key)] = key
+	return nil
+}
+
+// decryptionKey is the key of id `id`, if known
+func decryptionKey(id string) (key []byte, err error) {
+
+	decryption.Lock()
+	defer decryption.Unlock()
+	if !decryption.fromEnv {
+		decryption.fromEnv = true
+		if decryption.keys == nil {
+			decryption.keys = make(map[string][]byte)
+		}
+		for _, s := range strings.Split(os.Getenv(encKeyEnv), ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			k, err := ParseKey(s)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Bad key in %s", encKeyEnv)
+			}
+			decryption.keys[keyID(k)] = k
+		}
+	}
+	key, ok := decryption.keys[id]
+	if !ok {
+		return nil, errors.Errorf("No key to decrypt file encrypted with key %x (see %s)", id, encKeyEnv)
+	}
+	return key, nil
+}
+
+// ParseKey decodes a 32 byte key written as hex or base64
+func ParseKey(s string) (key []byte, err error) {
+
+	s = strings.TrimSpace(s)
+	key, err = hex.DecodeString(s)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil {
+		return nil, errors.New("Encryption key is neither hex nor base64")
+	}
+	if len(key) != 32 {
+		return nil, errors.Errorf("Encryption key must be 32 bytes (AES-256), got %d", len(key))
+	}
+	return key, nil
+}
+
+// LoadKey reads a key file: 32 raw bytes, or the key in hex or base64
+func LoadKey(fileName string) (key []byte, err error) {
+
+	raw, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read key file %s", fileName)
+	}
+	if len(raw) == 32 {
+		return raw, nil
+	}
+	key, err = ParseKey(string(raw))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to use key file %s", fileName)
+	}
+	return key, nil
+}
+
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return string(sum[:8])
+}
+
+// chunkNonce is the nonce of chunk `n`
+func chunkNonce(prefix []byte, n uint32, last bool) []byte {
+
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[7:], n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptor seals what is written to it, chunk by chunk, into w
+type encryptor struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+	n      uint32
+	buf    []byte // of the next chunk
+	sealed []byte
+	closed bool
+}
+
+// NewEncryptor returns a writer encrypting into `w` with `key` (see
+// Encrypt). Close writes the last chunk, it doesn't close `w`.
+func NewEncryptor(w io.Writer, key []byte) (io.WriteCloser, error) {
+	ew, err := newEncryptor(w, key)
+	if err != nil {
+		return nil, err
+	}
+	return ew, nil
+}
+
+// newEncryptor is NewEncryptor, with Flush to seal what was written so far
+// into a chunk
+func newEncryptor(w io.Writer, key []byte) (ew *encryptor, err error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create cipher")
+	}
+	ew = &encryptor{w: w, aead: aead, buf: make([]byte, 0, encChunkSize)}
+	ew.header = make([]byte, 0, encHeaderLen)
+	ew.header = append(ew.header, encMagic...)
+	ew.header = append(ew.header, keyID(key)...)
+	ew.prefix = make([]byte, 7)
+	_, err = rand.Read(ew.prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create nonce")
+	}
+	ew.header = append(ew.header, ew.prefix...)
+	_, err = w.Write(ew.header)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to write encryption header")
+	}
+	return ew, nil
+}
+
+func (ew *encryptor) Write(p []byte) (n int, err error) {
+
+	if ew.closed {
+		return 0, errors.New("Write to closed encryptor")
+	}
+	for len(p) > 0 {
+		if len(ew.buf) == encChunkSize {
+			err = ew.seal(false)
+			if err != nil {
+				return n, err
+			}
+		}
+		c := copy(ew.buf[len(ew.buf):encChunkSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// seal writes the pending chunk
+func (ew *encryptor) seal(last bool) (err error) {
+
+	ew.sealed = ew.aead.Seal(ew.sealed[:0], chunkNonce(ew.prefix, ew.n, last), ew.buf, ew.header)
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(ew.sealed)))
+	_, err = ew.w.Write(size[:])
+	if err == nil {
+		_, err = ew.w.Write(ew.sealed)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Unable to write encrypted chunk")
+	}
+	ew.n++
+	ew.buf = ew.buf[:0]
+	return nil
+}
+
+// Flush seals what is pending into a chunk, if anything
+func (ew *encryptor) Flush() error {
+	if ew.closed || len(ew.buf) == 0 {
+		return nil
+	}
+	return ew.seal(false)
+}
+
+// Close seals the last chunk, possibly empty. It can be called more than once.
+func (ew *encryptor) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	return ew.seal(true)
+}
+
+// decryptor opens the chunks read from r
+type decryptor struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+	n      uint32
+	plain  []byte // left of the current chunk
+	opened []byte // buffer of plain
+	sealed []byte
+	done   bool // last chunk read
+}
+
+// NewDecryptor returns a reader of what `r` has, encrypted with one of the
+// known keys (see AddDecryptionKey). Reading fails if a chunk doesn't check
+// out, or if the file ends before its last chunk.
+func NewDecryptor(r io.Reader) (dr io.Reader, err error) {
+
+	header := make([]byte, encHeaderLen)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read encryption header")
+	}
+	if !bytes.HasPrefix(header, []byte(encMagic)) {
+		return nil, errors.New("Not an encrypted file")
+	}
+	key, err := decryptionKey(string(header[4:12]))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create cipher")
+	}
+	return &decryptor{r: r, aead: aead, header: header, prefix: header[12:]}, nil
+}
+
+func (dr *decryptor) Read(p []byte) (n int, err error) {
+
+	for len(dr.plain) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		err = dr.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+// open reads and opens the next chunk
+func (dr *decryptor) open() (err error) {
+
+	var size [4]byte
+	_, err = io.ReadFull(dr.r, size[:])
+	if err == io.EOF {
+		return errors.Wrap(io.ErrUnexpectedEOF, "Encrypted file ends before its last chunk")
+	}
+	if err != nil {
+		return err
+	}
+	length := int(binary.BigEndian.Uint32(size[:]))
+	if length < dr.aead.Overhead() || length > encChunkSize+dr.aead.Overhead() {
+		return errors.Errorf("Bad encrypted chunk size %d", length)
+	}
+	if cap(dr.sealed) < length {
+		dr.sealed = make([]byte, length)
+	}
+	dr.sealed = dr.sealed[:length]
+	_, err = io.ReadFull(dr.r, dr.sealed)
+	if err != nil {
+		return err
+	}
+	// Not in place: a chunk that doesn't check out as a middle one is tried
+	// again as the last one
+	dr.plain, err = dr.aead.Open(dr.opened[:0], chunkNonce(dr.prefix, dr.n, false), dr.sealed, dr.header)
+	if err != nil {
+		dr.plain, err = dr.aead.Open(dr.opened[:0], chunkNonce(dr.prefix, dr.n, true), dr.sealed, dr.header)
+		if err != nil {
+			return errors.Errorf("Encrypted chunk %d does not check out (corrupt, or wrong key)", dr.n)
+		}
+		dr.done = true
+	}
+	dr.opened = dr.plain[:0]
+	dr.n++
+	return nil
+}
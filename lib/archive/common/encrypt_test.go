@@ -0,0 +1,269 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// testKey is a key known to the decryptor, `n` picks one
+func testKey(t *testing.T, n byte) []byte {
+	key := bytes.Repeat([]byte{n}, 32)
+	if err := AddDecryptionKey(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// encrypt is `plain` encrypted with `key`, written `step` bytes at a time
+// (all at once if 0)
+func encrypt(t *testing.T, key, plain []byte, step int) []byte {
+
+	var buf bytes.Buffer
+	ew, err := NewEncryptor(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step == 0 {
+		step = len(plain) + 1
+	}
+	for p := plain; len(p) > 0; {
+		n := step
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err = ew.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err = ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(encrypted []byte) (plain []byte, err error) {
+	dr, err := NewDecryptor(bytes.NewReader(encrypted))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(dr)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+
+	key := testKey(t, 1)
+	random := make([]byte, 3*encChunkSize+100)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name  string
+		plain []byte
+		step  int
+	}{
+		{"empty", nil, 0},
+		{"one byte", []byte{42}, 0},
+		{"short", []byte("a request or two"), 0},
+		{"one chunk", random[:encChunkSize], 0},
+		{"chunk and a byte", random[:encChunkSize+1], 0},
+		{"several chunks", random, 0},
+		{"small writes", random[:encChunkSize+500], 333},
+		{"chunk sized writes", random[:2*encChunkSize], encChunkSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encrypted := encrypt(t, key, tt.plain, tt.step)
+			if len(tt.plain) > 16 && bytes.Contains(encrypted, tt.plain[:16]) {
+				t.Fatal("plain text in encrypted file")
+			}
+			plain, err := decrypt(encrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plain, tt.plain) {
+				t.Fatalf("got %d bytes back, want %d", len(plain), len(tt.plain))
+			}
+		})
+	}
+}
+
+// Flush seals a chunk early, the file still reads the same
+func TestEncryptFlush(t *testing.T) {
+
+	key := testKey(t, 1)
+	var buf bytes.Buffer
+	ew, err := newEncryptor(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ew.Write([]byte("first "))
+	if err = ew.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ew.Flush() // nothing pending
+	ew.Write([]byte("second"))
+	ew.Close()
+	ew.Close()
+	if _, err = ew.Write([]byte("late")); err == nil {
+		t.Fatal("write after close")
+	}
+	plain, err := decrypt(buf.Bytes())
+	if err != nil || string(plain) != "first second" {
+		t.Fatalf("got %q, %v", plain, err)
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+
+	key := testKey(t, 1)
+	plain := make([]byte, 2*encChunkSize+10)
+	rand.New(rand.NewSource(2)).Read(plain)
+	encrypted := encrypt(t, key, plain, 0)
+	unknown := encrypt(t, bytes.Repeat([]byte{0xee}, 32), plain, 0) // never added
+
+	chunk := 4 + encChunkSize + 16 // sealed, with its size
+	tampered := append([]byte(nil), encrypted...)
+	tampered[encHeaderLen+chunk+100] ^= 1
+	otherKey := append([]byte(nil), encrypted...)
+	copy(otherKey[4:12], keyID(testKey(t, 2))) // read with a key that didn't encrypt it
+	swapped := append([]byte(nil), encrypted[:encHeaderLen]...)
+	swapped = append(swapped, encrypted[encHeaderLen+chunk:encHeaderLen+2*chunk]...)
+	swapped = append(swapped, encrypted[encHeaderLen:encHeaderLen+chunk]...)
+	swapped = append(swapped, encrypted[encHeaderLen+2*chunk:]...)
+
+	tests := []struct {
+		name      string
+		encrypted []byte
+	}{
+		{"empty", nil},
+		{"header cut short", encrypted[:encHeaderLen-1]},
+		{"header only", encrypted[:encHeaderLen]},
+		{"not encrypted", append([]byte("BHE0"), encrypted[4:]...)},
+		{"unknown key", unknown},
+		{"wrong key", otherKey},
+		{"chunk size cut short", encrypted[:encHeaderLen+2]},
+		{"chunk cut short", encrypted[:encHeaderLen+chunk-1]},
+		{"last chunk missing", encrypted[:encHeaderLen+2*chunk]},
+		{"last byte missing", encrypted[:len(encrypted)-1]},
+		{"tampered", tampered},
+		{"chunks swapped", swapped},
+		{"bad chunk size", append(append([]byte(nil), encrypted[:encHeaderLen]...), 0xff, 0xff, 0xff, 0xff)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decrypt(tt.encrypted)
+			if err == nil {
+				t.Fatalf("no error, %d bytes read", len(got))
+			}
+		})
+	}
+}
+
+// A file cut short reads up to its last complete chunk
+func TestDecryptTruncatedPrefix(t *testing.T) {
+
+	key := testKey(t, 1)
+	plain := make([]byte, 2*encChunkSize+10)
+	rand.New(rand.NewSource(3)).Read(plain)
+	encrypted := encrypt(t, key, plain, 0)
+
+	dr, err := NewDecryptor(bytes.NewReader(encrypted[:len(encrypted)-5]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(dr)
+	if errors.Cause(err) != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if !bytes.Equal(got, plain[:len(got)]) || len(got) != 2*encChunkSize {
+		t.Fatalf("got %d bytes, want the %d of the complete chunks", len(got), 2*encChunkSize)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+
+	key := bytes.Repeat([]byte{0xab}, 32)
+	tests := []struct {
+		name string
+		s    string
+		ok   bool
+	}{
+		{"hex", hex.EncodeToString(key), true},
+		{"hex with newline", hex.EncodeToString(key) + "\n", true},
+		{"base64", base64.StdEncoding.EncodeToString(key), true},
+		{"short hex", hex.EncodeToString(key[:16]), false},
+		{"short base64", base64.StdEncoding.EncodeToString(key[:31]), false},
+		{"neither", "not a key", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseKey(tt.s)
+			if tt.ok && (err != nil || !bytes.Equal(got, key)) {
+				t.Fatalf("got %x, %v", got, err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatalf("no error, got %x", got)
+			}
+		})
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := bytes.Repeat([]byte{0x0a}, 32) // raw, a newline every byte
+	tests := []struct {
+		name    string
+		content []byte
+		ok      bool
+	}{
+		{"raw", key, true},
+		{"hex", []byte(hex.EncodeToString(key) + "\n"), true},
+		{"base64", []byte(base64.StdEncoding.EncodeToString(key)), true},
+		{"short", key[:31], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileName := filepath.Join(dir, tt.name)
+			if err := ioutil.WriteFile(fileName, tt.content, 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadKey(fileName)
+			if tt.ok && (err != nil || !bytes.Equal(got, key)) {
+				t.Fatalf("got %x, %v", got, err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatalf("no error, got %x", got)
+			}
+		})
+	}
+	if _, err = LoadKey(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("no error for a missing file")
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/cespare/xxhash"
+	"github.com/pkg/errors"
+)
+
+// The checksum footer (see ChecksumFooter) is the last footerLen bytes of a
+// file, after what is stored (compressed, encrypted) as it is:
+//
+//	xxhash64 of the bytes before the footer (8 bytes, little endian)
+//	number of bytes before the footer (8 bytes, little endian)
+//	footerMagic (8 bytes)
+//
+// It is checked before anything is read, so a file that was damaged in
+// storage or in transit fails to open rather than in the middle of a replay.
+const footerLen = 24
+
+var footerMagic = []byte("BHSUM\x00\x00\x01")
+
+// ErrChecksumMismatch is the cause of the error opening a file whose content
+// doesn't match its checksum footer
+var ErrChecksumMismatch = errors.New("archive checksum mismatch")
+
+// ChecksumFooter has a footer with the checksum of the file added at Close.
+// Readers of this version check it, and skip it; older ones fail at the end
+// of such files.
+func ChecksumFooter(on bool) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		b.footer = on
+		return nil
+	}
+}
+
+// hashingWriter writes to w what it adds to h
+type hashingWriter struct {
+	w io.Writer
+	h hash.Hash64
+	n int64
+}
+
+func (hw *hashingWriter) Write(p []byte) (n int, err error) {
+	n, err = hw.w.Write(p)
+	hw.h.Write(p[:n])
+	hw.n += int64(n)
+	return n, err
+}
+
+// writeFooter appends the footer of what went through hw to it
+func (hw *hashingWriter) writeFooter() (err error) {
+
+	footer := make([]byte, footerLen)
+	binary.LittleEndian.PutUint64(footer, hw.h.Sum64())
+	binary.LittleEndian.PutUint64(footer[8:], uint64(hw.n))
+	copy(footer[16:], footerMagic)
+	_, err = hw.w.Write(footer)
+	return err
+}
+
+// VerifyFooter checks the checksum footer of a file, if it has one, reading
+// it all. `dataLen` is what is to be read of the file, without the footer;
+// its size if it has none. The file is left at its start.
+func VerifyFooter(fp *os.File) (dataLen int64, err error) {
+
+	fi, err := fp.Stat()
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to stat %s", fp.Name())
+	}
+	dataLen = fi.Size()
+	if dataLen < footerLen {
+		return dataLen, nil
+	}
+	footer := make([]byte, footerLen)
+	_, err = fp.ReadAt(footer, dataLen-footerLen)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to read %s", fp.Name())
+	}
+	if !bytes.Equal(footer[16:], footerMagic) {
+		return dataLen, nil
+	}
+	dataLen -= footerLen
+	if n := int64(binary.LittleEndian.Uint64(footer[8:])); n != dataLen {
+		return 0, errors.Wrapf(ErrChecksumMismatch, "%s: %d bytes, %d expected", fp.Name(), dataLen, n)
+	}
+	xh := xxhash.New()
+	_, err = io.Copy(xh, io.NewSectionReader(fp, 0, dataLen))
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to read %s", fp.Name())
+	}
+	if sum, expected := xh.Sum64(), binary.LittleEndian.Uint64(footer); sum != expected {
+		return 0, errors.Wrapf(ErrChecksumMismatch, "%s: %016X, %016X expected", fp.Name(), sum, expected)
+	}
+	_, err = fp.Seek(0, io.SeekStart)
+	return dataLen, err
+}
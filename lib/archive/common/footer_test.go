@@ -0,0 +1,106 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestVerifyFooter(t *testing.T) {
+
+	dir := tempDir(t)
+	content := testFrame(bytes.Repeat([]byte("request "), 100), 0)
+	fileName, _ := writeArchive(t, dir, [][]byte{content}, ChecksumFooter(true))
+	withFooter, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(withFooter) != len(content)+footerLen {
+		t.Fatalf("got %d bytes, want %d", len(withFooter), len(content)+footerLen)
+	}
+	data := withFooter[:len(content)]
+
+	tests := []struct {
+		name    string
+		content []byte
+		dataLen int64
+		err     error
+	}{
+		{"footer", withFooter, int64(len(content)), nil},
+		{"no footer", data, int64(len(content)), nil},
+		{"shorter than a footer", data[:footerLen-1], footerLen - 1, nil},
+		{"empty", nil, 0, nil},
+		{"footer only", withFooter[len(content):], 0, ErrChecksumMismatch},
+		{"changed", func() []byte {
+			buf := append([]byte(nil), withFooter...)
+			buf[100] ^= 1
+			return buf
+		}(), 0, ErrChecksumMismatch},
+		{"byte missing", append(append([]byte(nil), data[1:]...), withFooter[len(content):]...), 0, ErrChecksumMismatch},
+		{"byte added", append(append([]byte{0}, data...), withFooter[len(content):]...), 0, ErrChecksumMismatch},
+		// Cut short, the footer is gone: nothing to check, reading fails later
+		{"truncated", withFooter[:len(withFooter)-1], int64(len(withFooter) - 1), nil},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(dir, "footer"+string(rune('a'+i)))
+			if err := ioutil.WriteFile(name, tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			fp, err := os.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fp.Close()
+			dataLen, err := VerifyFooter(fp)
+			if errors.Cause(err) != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if dataLen != tt.dataLen {
+				t.Fatalf("got %d bytes of data, want %d", dataLen, tt.dataLen)
+			}
+			if pos, _ := fp.Seek(0, io.SeekCurrent); pos != 0 {
+				t.Fatalf("file left at %d", pos)
+			}
+		})
+	}
+}
+
+// Opening a file whose footer doesn't check out fails before anything is read
+func TestOpenArchiveChecksumMismatch(t *testing.T) {
+
+	dir := tempDir(t)
+	fileName, _ := writeArchive(t, dir, [][]byte{testFrame([]byte("request"), 0)},
+		Compress(true), ChecksumFooter(true))
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[len(buf)-footerLen-1] ^= 1
+	if err = ioutil.WriteFile(fileName, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenArchive(fileName, 0, false); errors.Cause(err) != ErrChecksumMismatch {
+		t.Fatalf("got %v, want %v", err, ErrChecksumMismatch)
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/adobe/blackhole/lib/frame"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// FrameSplitter is for backends that publish requests one by one (message
+// queues, streams) instead of writing files. What is written to it, a
+// stream of frames as in an archive file, is cut into requests. A frame may
+// span several writes. File headers are taken in, not passed on, and
+// payloads compressed with the dictionary of the header are decompressed.
+type FrameSplitter struct {
+	// OnRequest is called with the payload (fbr.Request) of every request
+	// frame, complete. It is only valid during the call.
+	OnRequest func(payload []byte) error
+	// OnHeader, if set, is called with every file header
+	OnHeader func(h frame.Header) error
+
+	partial []byte // start of a frame whose end was not written yet
+	dict    []byte // of FlagZstd frames, from the last header
+	zd      *zstd.Decoder
+	value   []byte // decompressed payload, reused
+}
+
+// Write satisfies io.Writer interface. After an error, what was not handed
+// over is dropped: the write that failed is the caller's to keep.
+func (fs *FrameSplitter) Write(buf []byte) (n int, err error) {
+
+	n = len(buf)
+	if len(fs.partial) > 0 {
+		fs.partial = append(fs.partial, buf...)
+		buf = fs.partial
+	}
+	for len(buf) >= frame.PrefixLen {
+		payloadLen, flags := frame.ParsePrefix(buf)
+		err = frame.CheckPrefix(payloadLen, flags)
+		if err != nil {
+			fs.Reset()
+			return 0, errors.Wrap(err, "Invalid frame written")
+		}
+		hdrLen := frame.PrefixLen
+		if flags&frame.FlagCRC != 0 {
+			hdrLen += frame.CRCLen
+		}
+		if len(buf) < hdrLen+payloadLen {
+			break
+		}
+		err = fs.split(flags, buf[hdrLen:hdrLen+payloadLen])
+		if err != nil {
+			fs.Reset()
+			return 0, err
+		}
+		buf = buf[hdrLen+payloadLen:]
+	}
+	fs.partial = append(fs.partial[:0], buf...)
+	return n, nil
+}
+
+// split hands over the payload of one frame
+func (fs *FrameSplitter) split(flags byte, payload []byte) (err error) {
+
+	if flags&frame.FlagHeader != 0 {
+		h, err := frame.ParseHeader(payload)
+		if err != nil {
+			return err
+		}
+		err = fs.setDict(h.Dict)
+		if err == nil && fs.OnHeader != nil {
+			err = fs.OnHeader(h)
+		}
+		return err
+	}
+	if flags&frame.FlagZstd != 0 {
+		if fs.zd == nil {
+			return errors.New("Dictionary compressed frame written without a dictionary")
+		}
+		fs.value, err = fs.zd.DecodeAll(payload, fs.value[:0])
+		if err != nil {
+			return errors.Wrap(err, "Unable to decompress frame")
+		}
+		payload = fs.value
+	}
+	return fs.OnRequest(payload)
+}
+
+// setDict has FlagZstd frames decompressed with `dict` from now on
+func (fs *FrameSplitter) setDict(dict []byte) (err error) {
+
+	if len(dict) == 0 || string(dict) == string(fs.dict) {
+		return nil
+	}
+	if fs.zd != nil {
+		fs.zd.Close()
+	}
+	fs.zd, err = zstd.NewReader(nil, zstd.WithDecoderDicts(dict))
+	if err != nil {
+		return errors.Wrap(err, "Unable to create zstd decoder")
+	}
+	fs.dict = dict
+	return nil
+}
+
+// Partial is the size of the incomplete frame at the end of what was written
+func (fs *FrameSplitter) Partial() int {
+	return len(fs.partial)
+}
+
+// Reset drops the incomplete frame, if any
+func (fs *FrameSplitter) Reset() {
+	fs.partial = fs.partial[:0]
+}
+
+// CompleteFrames is the length of the complete frames at the start of
+// `buf`, which may end with the start of another one
+func CompleteFrames(buf []byte) (n int, err error) {
+
+	for len(buf)-n >= frame.PrefixLen {
+		payloadLen, flags := frame.ParsePrefix(buf[n:])
+		err = frame.CheckPrefix(payloadLen, flags)
+		if err != nil {
+			return n, errors.Wrap(err, "Invalid frame written")
+		}
+		frameLen := frame.PrefixLen + payloadLen
+		if flags&frame.FlagCRC != 0 {
+			frameLen += frame.CRCLen
+		}
+		if len(buf)-n < frameLen {
+			break
+		}
+		n += frameLen
+	}
+	return n, nil
+}
+
+// HeaderMap maps the names of raw headers as recorded (`Name: value` lines)
+// to their values, those of repeated headers joined with ", ". Like
+// request.SplitHeaders, which backends can't import, it stops at the first
+// empty line and skips malformed lines.
+func HeaderMap(raw []byte) map[string]string {
+
+	headers := make(map[string]string)
+	for len(raw) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(raw, '\n'); i >= 0 {
+			line, raw = raw[:i], raw[i+1:]
+		} else {
+			line, raw = raw, nil
+		}
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			break
+		}
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		name, value := string(bytes.TrimSpace(line[:i])), string(bytes.TrimSpace(line[i+1:]))
+		if prev, ok := headers[name]; ok {
+			value = prev + ", " + value
+		}
+		headers[name] = value
+	}
+	return headers
+}
+
+// batchSeq numbers batches of this process, see BatchName
+var batchSeq int64
+
+// BatchName names a batch of requests published by a backend that doesn't
+// write files, the stand-in for a file in FinalizedFiles and OnFinalize:
+// <prefix>_<timestamp>_<sequence>, like files.
+func BatchName(prefix string) string {
+	ts := time.Now().Format("20060102150405")
+	return fmt.Sprintf("%s_%s_%d", prefix, ts, atomic.AddInt64(&batchSeq, 1))
+}
+
+// CopyFile writes the content of a local archive file, decompressed, to `w`.
+// Backends that don't write files use it to Store a file through their Write.
+func CopyFile(w io.Writer, localPath string) (err error) {
+
+	rf, err := OpenArchive(localPath, 0, false)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to open %s", localPath)
+	}
+	defer rf.Close()
+	_, err = io.Copy(w, rf)
+	return err
+}
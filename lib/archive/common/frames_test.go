@@ -0,0 +1,256 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/frame"
+	"github.com/pkg/errors"
+)
+
+// testFrame is a frame of `payload`, with a checksum if `flags` has FlagCRC
+func testFrame(payload []byte, flags byte) []byte {
+	buf := make([]byte, frame.PrefixLen+frame.CRCLen, frame.PrefixLen+frame.CRCLen+len(payload))
+	if flags&frame.FlagCRC != 0 {
+		frame.PutPrefixCRC(buf, payload, flags)
+	} else {
+		frame.PutPrefix(buf, len(payload), flags)
+		buf = buf[:frame.PrefixLen]
+	}
+	return append(buf, payload...)
+}
+
+// testHeader is the frame of a file header
+func testHeader(t *testing.T) []byte {
+	buf, err := frame.NewHeader("fbr.Request", 1).Frame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestFrameSplitter(t *testing.T) {
+
+	header := testHeader(t)
+	stream := append([]byte(nil), header...)
+	payloads := []string{"first", "", "third request", "fourth"}
+	for i, p := range payloads {
+		stream = append(stream, testFrame([]byte(p), byte(i%2)*frame.FlagCRC)...)
+	}
+
+	// The stream written `step` bytes at a time, frames cut anywhere
+	for _, step := range []int{len(stream), 1, 3, frame.PrefixLen, frame.PrefixLen + 1, 17} {
+		var got []string
+		headers := 0
+		fs := FrameSplitter{
+			OnRequest: func(payload []byte) error {
+				got = append(got, string(payload))
+				return nil
+			},
+			OnHeader: func(h frame.Header) error {
+				headers++
+				return nil
+			},
+		}
+		for p := stream; len(p) > 0; {
+			n := step
+			if n > len(p) {
+				n = len(p)
+			}
+			if w, err := fs.Write(p[:n]); err != nil || w != n {
+				t.Fatalf("step %d: wrote %d of %d, %v", step, w, n, err)
+			}
+			p = p[n:]
+		}
+		if !reflect.DeepEqual(got, payloads) || headers != 1 || fs.Partial() != 0 {
+			t.Fatalf("step %d: got %q, %d headers, %d bytes left", step, got, headers, fs.Partial())
+		}
+	}
+}
+
+func TestFrameSplitterPartial(t *testing.T) {
+
+	fr := testFrame([]byte("request"), 0)
+	requests := 0
+	fs := FrameSplitter{OnRequest: func(payload []byte) error {
+		requests++
+		return nil
+	}}
+	fs.Write(fr[:5])
+	fs.Write(fr[5:10])
+	if requests != 0 || fs.Partial() != 10 {
+		t.Fatalf("got %d requests, %d bytes left", requests, fs.Partial())
+	}
+	fs.Reset()
+	fs.Write(fr)
+	if requests != 1 || fs.Partial() != 0 {
+		t.Fatalf("got %d requests after Reset, %d bytes left", requests, fs.Partial())
+	}
+}
+
+func TestFrameSplitterErrors(t *testing.T) {
+
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"unknown flags", testFrame([]byte("x"), 0x01)},
+		{"too large", func() []byte {
+			buf := make([]byte, frame.PrefixLen)
+			frame.PutPrefix(buf, frame.SanePayloadLen+1, 0)
+			return buf
+		}()},
+		{"bad header", testFrame([]byte("not json"), frame.FlagHeader)},
+		{"no dictionary", testFrame([]byte("x"), frame.FlagZstd)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := FrameSplitter{OnRequest: func(payload []byte) error { return nil }}
+			if _, err := fs.Write(tt.buf); err == nil {
+				t.Fatal("no error")
+			}
+		})
+	}
+}
+
+func TestCompleteFrames(t *testing.T) {
+
+	a := testFrame([]byte("a request"), 0)
+	b := testFrame([]byte("another"), frame.FlagCRC)
+	ab := append(append([]byte(nil), a...), b...)
+
+	tests := []struct {
+		name string
+		buf  []byte
+		n    int
+		err  bool
+	}{
+		{"empty", nil, 0, false},
+		{"start of a prefix", a[:3], 0, false},
+		{"prefix only", a[:frame.PrefixLen], 0, false},
+		{"one frame", a, len(a), false},
+		{"one frame and a bit", ab[:len(a)+1], len(a), false},
+		{"two frames", ab, len(ab), false},
+		{"second cut short", ab[:len(ab)-1], len(a), false},
+		{"empty payload", testFrame(nil, 0), frame.PrefixLen, false},
+		{"bad second frame", append(append([]byte(nil), a...), testFrame(nil, 0x01)...), len(a), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := CompleteFrames(tt.buf)
+			if n != tt.n || (err != nil) != tt.err {
+				t.Fatalf("got %d, %v, want %d", n, err, tt.n)
+			}
+		})
+	}
+}
+
+func TestHeaderMap(t *testing.T) {
+
+	tests := []struct {
+		name string
+		raw  string
+		want map[string]string
+	}{
+		{"empty", "", map[string]string{}},
+		{"one", "Host: example.com\r\n\r\n", map[string]string{"Host": "example.com"}},
+		{"no final empty line", "A: 1\r\nB: 2", map[string]string{"A": "1", "B": "2"}},
+		{"bare newlines", "A: 1\nB: 2\n", map[string]string{"A": "1", "B": "2"}},
+		{"repeated", "Accept: a\r\nAccept: b\r\n", map[string]string{"Accept": "a, b"}},
+		{"spaces", "  A  :  x y  \r\n", map[string]string{"A": "x y"}},
+		{"colon in value", "Host: example.com:8080\r\n", map[string]string{"Host": "example.com:8080"}},
+		{"empty value", "A:\r\n", map[string]string{"A": ""}},
+		{"malformed skipped", "junk\r\n: no name\r\nA: 1\r\n", map[string]string{"A": "1"}},
+		{"stops at empty line", "A: 1\r\n\r\nB: 2\r\n", map[string]string{"A": "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HeaderMap([]byte(tt.raw)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchName(t *testing.T) {
+	a, b := BatchName("requests"), BatchName("requests")
+	if a == b || !strings.HasPrefix(a, "requests_") {
+		t.Fatalf("got %s and %s", a, b)
+	}
+}
+
+// A request that fails is dropped with what is left of the write, not handed
+// over again with the next one
+func TestFrameSplitterAfterError(t *testing.T) {
+
+	var got []string
+	fs := FrameSplitter{OnRequest: func(payload []byte) error {
+		if string(payload) == "refused" {
+			return errors.New("refused")
+		}
+		got = append(got, string(payload))
+		return nil
+	}}
+	refused := testFrame([]byte("refused"), 0)
+	fs.Write(refused[:3])
+	if _, err := fs.Write(append(refused[3:], testFrame([]byte("lost"), 0)...)); err == nil {
+		t.Fatal("no error")
+	}
+	if fs.Partial() != 0 {
+		t.Fatalf("%d bytes left", fs.Partial())
+	}
+	if _, err := fs.Write(testFrame([]byte("next"), 0)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []string{"next"}) {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// Options of files are refused, those publishers take or leave to callers are not
+func TestNewPublisherOptions(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		option func(*BasicArchive) error
+		err    bool
+	}{
+		{"compress off", Compress(false), false},
+		{"no compression", Compression("none"), false},
+		{"buffer size", BufferSize(1 << 16), false},
+		{"rotate every", RotateEvery(time.Minute), false},
+		{"concurrent", Concurrent(true), false},
+		{"compress", Compress(true), true},
+		{"compression", Compression("zstd"), true},
+		{"encrypt", Encrypt(make([]byte, 32)), true},
+		{"footer", ChecksumFooter(true), true},
+		{"index", Index(true), true},
+		{"max file size", MaxFileSize(1 << 20), true},
+		{"max rows", MaxRows(1000), true},
+		{"template", FilenameTemplate("{prefix}_{timestamp}_{seq}"), true},
+		{"stream upload", StreamUpload(true), true},
+		{"retries", RetryFinalize(3, time.Second), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPublisher("kafka://broker/topic", "kafka", "requests", ".fbf", tt.option)
+			if (err != nil) != tt.err {
+				t.Fatalf("got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/frame"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// The index of an archive (see Index) is a text file with the name of the
+// archive and IndexExt, a line per request:
+//
+//	# blackhole index 1
+//	<offset>\t<request id>
+//	...
+//	# <count> requests
+//
+// The offset is that of the frame of the request in the archive once
+// decompressed (and decrypted), with the file header. The last line tells
+// the index is complete.
+const (
+	IndexExt     = ".idx"
+	indexHeader  = "# blackhole index 1"
+	indexTrailer = " requests"
+)
+
+// Index has an index of the requests of every file written alongside it
+// (see SearchIndex), so that a request can be found without reading the
+// whole file. Files of requests compressed with a dictionary, or whose
+// frames can't be told apart, are not indexed. Files recovered after a
+// crash aren't either.
+func Index(on bool) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		b.index = on
+		return nil
+	}
+}
+
+// indexWriter indexes the frames written to an archive as they go by
+type indexWriter struct {
+	fp      *os.File
+	bw      *bufio.Writer
+	offset  int64  // of the next frame
+	pending []byte // frame cut between writes, put back together
+	count   int64
+	broken  error // why the file can't be indexed
+}
+
+func newIndexWriter(fileName string) (iw *indexWriter, err error) {
+
+	fp, err := os.Create(fileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to create index %s", fileName)
+	}
+	iw = &indexWriter{fp: fp, bw: bufio.NewWriter(fp)}
+	fmt.Fprintln(iw.bw, indexHeader)
+	return iw, nil
+}
+
+// frameLen is the length of the frame `b` starts with, 0 if its prefix is
+// not all there
+func frameLen(b []byte) (n int, err error) {
+	if len(b) < frame.PrefixLen {
+		return 0, nil
+	}
+	payloadLen, flags := frame.ParsePrefix(b)
+	err = frame.CheckPrefix(payloadLen, flags)
+	if err != nil {
+		return 0, err
+	}
+	n = frame.PrefixLen + payloadLen
+	if flags&frame.FlagCRC != 0 {
+		n += frame.CRCLen
+	}
+	return n, nil
+}
+
+// add indexes the frames of `p`, written to the archive
+func (iw *indexWriter) add(p []byte) {
+
+	for len(p) > 0 && iw.broken == nil {
+		if len(iw.pending) == 0 {
+			n, err := frameLen(p)
+			if err != nil {
+				iw.broken = err
+				return
+			}
+			if n > 0 && n <= len(p) {
+				iw.addFrame(p[:n])
+				p = p[n:]
+				continue
+			}
+		}
+		// Cut between writes: the prefix first, then the rest of the frame
+		want := frame.PrefixLen
+		if len(iw.pending) >= frame.PrefixLen {
+			want, _ = frameLen(iw.pending)
+		}
+		take := want - len(iw.pending)
+		if take > len(p) {
+			take = len(p)
+		}
+		iw.pending = append(iw.pending, p[:take]...)
+		p = p[take:]
+		if len(iw.pending) < frame.PrefixLen {
+			continue
+		}
+		n, err := frameLen(iw.pending)
+		if err != nil {
+			iw.broken = err
+			return
+		}
+		if len(iw.pending) == n {
+			iw.addFrame(iw.pending)
+			iw.pending = iw.pending[:0]
+		}
+	}
+}
+
+// addFrame indexes a complete frame
+func (iw *indexWriter) addFrame(fr []byte) {
+
+	payloadLen, flags := frame.ParsePrefix(fr)
+	switch {
+	case flags&frame.FlagZstd != 0:
+		iw.broken = errors.New("requests compressed with a dictionary")
+	case flags&frame.FlagHeader == 0:
+		id := requestID(fr[len(fr)-payloadLen:])
+		if bytes.IndexByte(id, '\n') >= 0 {
+			iw.broken = errors.Errorf("request id %q can't be indexed", id)
+			return
+		}
+		iw.bw.WriteString(strconv.FormatInt(iw.offset, 10))
+		iw.bw.WriteByte('\t')
+		iw.bw.Write(id)
+		iw.bw.WriteByte('\n')
+		iw.count++
+	}
+	iw.offset += int64(len(fr))
+}
+
+// requestID is the id of the request of `payload`, empty if it can't be read
+func requestID(payload []byte) (id []byte) {
+	defer func() {
+		if recover() != nil { // not a valid flatbuffer
+			id = nil
+		}
+	}()
+	return fbr.GetRootAsRequest(payload, 0).Id()
+}
+
+// finish completes the index and closes it. It is removed if the file can't
+// be indexed, or has nothing in it: `ok` is then false.
+func (iw *indexWriter) finish(logger *zap.Logger) (ok bool, err error) {
+
+	if iw.broken == nil && len(iw.pending) > 0 {
+		iw.broken = errors.New("last frame cut short")
+	}
+	if iw.broken == nil && iw.count > 0 {
+		fmt.Fprintf(iw.bw, "# %d%s\n", iw.count, indexTrailer)
+		err = iw.bw.Flush()
+		if err == nil {
+			err = iw.fp.Sync()
+		}
+	}
+	if cerr := iw.fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || iw.broken != nil || iw.count == 0 {
+		if iw.broken != nil {
+			logger.Info("Archive file not indexed", zap.String("index", iw.fp.Name()), zap.NamedError("reason", iw.broken))
+		}
+		os.Remove(iw.fp.Name())
+		return false, errors.Wrapf(err, "Unable to write index %s", iw.fp.Name())
+	}
+	return true, nil
+}
+
+// StoreIndex has the index of the file being finalized (see Index), if
+// any, stored by `store` with the file. Finalizers call it once the file is
+// stored. An index that can't be stored is logged and left out: the file
+// can still be read without it.
+func (rf *BasicArchive) StoreIndex(store func(indexPath string) error) {
+
+	if rf.indexFile == "" {
+		return
+	}
+	err := store(rf.indexFile)
+	if err != nil {
+		rf.Logger.Error("Unable to store index, left out", zap.String("index", rf.indexFile), zap.Error(err))
+	}
+	rf.removeIndex() // if still there
+}
+
+// removeIndex removes the index of the file being finalized, if any
+func (rf *BasicArchive) removeIndex() {
+	if rf.indexFile != "" {
+		os.Remove(rf.indexFile)
+		rf.indexFile = ""
+	}
+}
+
+// SearchIndex looks for request `id` in an index (see Index): the offset of
+// its frame in the archive once decompressed, or -1 if it is not in the
+// archive. An incomplete index is an error.
+func SearchIndex(r io.Reader, id string) (offset int64, err error) {
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	if !sc.Scan() || sc.Text() != indexHeader {
+		if err = sc.Err(); err != nil {
+			return -1, errors.Wrap(err, "Unable to read index")
+		}
+		return -1, errors.New("Not an archive index")
+	}
+	offset = -1
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "#") {
+			if strings.HasSuffix(line, indexTrailer) {
+				return offset, nil
+			}
+			continue
+		}
+		tab := strings.IndexByte(line, '\t')
+		if tab < 0 || offset >= 0 || line[tab+1:] != id {
+			continue
+		}
+		offset, err = strconv.ParseInt(line[:tab], 10, 64)
+		if err != nil {
+			return -1, errors.Wrapf(err, "Bad index line %q", line)
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return -1, errors.Wrap(err, "Unable to read index")
+	}
+	return -1, errors.New("Incomplete index")
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/frame"
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+// testRequest is the frame of a request of id `id`
+func testRequest(id string, flags byte) []byte {
+	b := flatbuffers.NewBuilder(0)
+	idOffset := b.CreateString(id)
+	uri := b.CreateString("/" + id)
+	fbr.RequestStart(b)
+	fbr.RequestAddId(b, idOffset)
+	fbr.RequestAddUri(b, uri)
+	b.Finish(fbr.RequestEnd(b))
+	return testFrame(b.FinishedBytes(), flags)
+}
+
+// cut is `stream` in writes of `step` bytes
+func cut(stream []byte, step int) (writes [][]byte) {
+	for len(stream) > 0 {
+		n := step
+		if n > len(stream) {
+			n = len(stream)
+		}
+		writes = append(writes, stream[:n])
+		stream = stream[n:]
+	}
+	return writes
+}
+
+func TestIndex(t *testing.T) {
+
+	dir := tempDir(t)
+	header := testHeader(t)
+	var frames [][]byte
+	var stream []byte
+	for i := 0; i < 50; i++ {
+		fr := testRequest(fmt.Sprintf("id-%d", i), byte(i%2)*frame.FlagCRC)
+		frames = append(frames, fr)
+		stream = append(stream, fr...)
+	}
+	withHeader := FileHeader(func() []byte { return header })
+
+	tests := []struct {
+		name    string
+		writes  [][]byte
+		options []func(*BasicArchive) error
+	}{
+		{"frame by frame", frames, nil},
+		{"all at once", [][]byte{stream}, nil},
+		{"byte by byte", cut(stream, 1), nil},
+		{"cut in prefixes", cut(stream, 5), nil},
+		{"cut anywhere", cut(stream, 77), nil},
+		{"file header", frames, []func(*BasicArchive) error{withHeader}},
+		{"compressed, encrypted", cut(stream, 100),
+			[]func(*BasicArchive) error{withHeader, Compression("zstd"), Encrypt(testKey(t, 3)), ChecksumFooter(true)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileName, indexFile := writeArchive(t, dir, tt.writes, append(tt.options, Index(true))...)
+			if indexFile == "" {
+				t.Fatal("no index")
+			}
+			content, err := readArchive(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []string{"id-0", "id-1", "id-25", "id-49"} {
+				fp, err := os.Open(indexFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				offset, err := SearchIndex(fp, id)
+				fp.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if offset < 0 || offset >= int64(len(content)) {
+					t.Fatalf("%s: got offset %d of %d bytes", id, offset, len(content))
+				}
+				n, _ := frameLen(content[offset:])
+				payloadLen, _ := frame.ParsePrefix(content[offset:])
+				payload := content[offset+int64(n-payloadLen) : offset+int64(n)]
+				if got := string(requestID(payload)); got != id {
+					t.Fatalf("%s: got request %s at offset %d", id, got, offset)
+				}
+			}
+			fp, _ := os.Open(indexFile)
+			defer fp.Close()
+			if offset, err := SearchIndex(fp, "id-50"); offset != -1 || err != nil {
+				t.Fatalf("got offset %d, %v for a request not in the file", offset, err)
+			}
+		})
+	}
+}
+
+// Files whose requests can't be indexed are written without an index
+func TestIndexLeftOut(t *testing.T) {
+
+	dir := tempDir(t)
+	request := testRequest("id", 0)
+
+	tests := []struct {
+		name   string
+		writes [][]byte
+	}{
+		{"nothing written", nil},
+		{"header only", [][]byte{testHeader(t)}},
+		{"dictionary compressed", [][]byte{request, testFrame([]byte("zstd"), frame.FlagZstd)}},
+		{"newline in id", [][]byte{request, testRequest("a\nb", 0)}},
+		{"last frame cut short", [][]byte{request, request[:len(request)-1]}},
+		{"bad prefix", [][]byte{request, testFrame([]byte("x"), 0x01)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, indexFile := writeArchive(t, dir, tt.writes, Index(true))
+			if indexFile != "" {
+				t.Fatalf("got index %s", indexFile)
+			}
+		})
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "*"+IndexExt+"*")); len(left) > 0 {
+		t.Fatalf("indexes left: %s", left)
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		index  string
+		id     string
+		offset int64
+		ok     bool
+	}{
+		{"found", indexHeader + "\n0\ta\n120\tb\n# 2 requests\n", "b", 120, true},
+		{"first of repeated ids", indexHeader + "\n0\ta\n120\ta\n# 2 requests\n", "a", 0, true},
+		{"not found", indexHeader + "\n0\ta\n# 1 requests\n", "b", -1, true},
+		{"empty id", indexHeader + "\n0\t\n# 1 requests\n", "", 0, true},
+		{"comment", indexHeader + "\n# more to come\n0\ta\n# 1 requests\n", "a", 0, true},
+		{"not an index", "0\ta\n", "a", -1, false},
+		{"empty", "", "a", -1, false},
+		{"incomplete", indexHeader + "\n0\ta\n", "a", -1, false},
+		{"bad offset", indexHeader + "\nx\ta\n# 1 requests\n", "a", -1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offset, err := SearchIndex(strings.NewReader(tt.index), tt.id)
+			if offset != tt.offset || (err == nil) != tt.ok {
+				t.Fatalf("got %d, %v, want %d", offset, err, tt.offset)
+			}
+		})
+	}
+}
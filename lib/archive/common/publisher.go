@@ -0,0 +1,217 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"path"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Publisher is the base of the archives of backends that publish requests
+// (message queues, streams, databases) instead of writing files. What is
+// written to it is cut into requests by Frames, whose OnRequest the backend
+// sets to queue or publish them; OnFlush must publish what is queued and
+// wait for it to be acknowledged, then call Published. Requests are
+// published in batches, each the stand-in for a file in FinalizedFiles and
+// OnFinalize: Rotate flushes and starts a new one.
+type Publisher struct {
+	BasicArchive
+	URL    string // published to, e.g. kafka://brokers/topic
+	Prefix string // of batch names
+	Batch  string // name of the current batch, empty once closed
+	Frames FrameSplitter
+
+	// OnFlush publishes what is queued
+	OnFlush func() error
+	// OnClose, if set, releases the connection of the archive once its last
+	// batch is finalized. It may be called more than once.
+	OnClose func() error
+	// OnWrite, if set, takes what is written instead of Frames, for backends
+	// that pass frames on as they are. The file header is then theirs to send.
+	OnWrite func(buf []byte) error
+
+	kind    string // of backend, in errors
+	bytes   int64  // published in the current batch
+	records int64
+}
+
+// NewPublisher creates the base of an archive publishing to `url`. `kind`
+// names the backend in errors, e.g. "kafka". The backend must set its hooks,
+// then call Rotate to start the first batch. Options of files that requests
+// are not written to are refused, see unsupportedOption; RotateEvery is left
+// to callers, who rotate batches unless RotatesOnTimer.
+func NewPublisher(url, kind, prefix, extension string, options ...func(*BasicArchive) error) (p *Publisher, err error) {
+
+	ba, err := NewBasicArchive(
+		"", prefix, extension, options...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to initialize basic archive")
+	}
+	if option := ba.unsupportedOption(); option != "" {
+		return nil, errors.Errorf("%s is not supported for %s archives: %s", option, kind, url)
+	}
+	return &Publisher{BasicArchive: *ba, URL: url, Prefix: prefix, kind: kind}, nil
+}
+
+// unsupportedOption names the first option set that only applies to files,
+// empty if none is
+func (rf *BasicArchive) unsupportedOption() string {
+	switch {
+	case rf.codec != "":
+		return "Compression"
+	case rf.key != nil:
+		return "Encryption"
+	case rf.footer:
+		return "Checksum footer"
+	case rf.index:
+		return "Index"
+	case rf.maxFileSize > 0:
+		return "Maximum file size"
+	case rf.maxRows > 0:
+		return "Maximum rows"
+	case rf.template != "":
+		return "Filename template"
+	case rf.streamUpload:
+		return "Streaming upload"
+	case rf.staging != "":
+		return "Staging directory"
+	case rf.retries > 0 || rf.retryDir != "":
+		return "Retrying finalization"
+	}
+	return ""
+}
+
+// NotSupported is the error of what a publishing backend can't do, e.g.
+// NotSupported("Listing", "kafka topics", dir)
+func NotSupported(what, targets, name string) error {
+	return errors.Errorf("%s is not supported for %s: %s", what, targets, name)
+}
+
+// Store publishes the requests of a local archive file (compressed or not)
+// as one batch named after the file, then closes the archive
+func (p *Publisher) Store(localPath string) (err error) {
+
+	p.Batch = path.Base(localPath) // the batch stands for the file
+	err = CopyFile(p, localPath)
+	if err != nil {
+		p.OnFlush() // not to leave what was sent unacknowledged
+		if p.OnClose != nil {
+			p.OnClose()
+		}
+		return errors.Wrapf(err, "Unable to publish %s to %s", localPath, p.URL)
+	}
+	return p.Close()
+}
+
+// Published counts requests acknowledged, and their bytes, in the current
+// batch
+func (p *Publisher) Published(records int, bytes int) {
+	p.records += int64(records)
+	p.bytes += int64(bytes)
+	p.AddStored(int64(bytes))
+}
+
+// Write satisfies io.Writer interface. Requests of complete frames are
+// handed over, the start of a frame is kept until the rest is written.
+func (p *Publisher) Write(buf []byte) (n int, err error) {
+
+	if p.OnWrite != nil {
+		err = p.OnWrite(buf)
+		n = len(buf)
+	} else {
+		n, err = p.Frames.Write(buf)
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to write to %s archive", p.kind)
+	}
+	return n, nil
+}
+
+// Read is not supported
+func (p *Publisher) Read(buf []byte) (n int, err error) {
+	return 0, errors.Errorf("Read not supported for %s target", p.kind)
+}
+
+// Flush publishes what is queued
+func (p *Publisher) Flush() (err error) {
+	return p.OnFlush()
+}
+
+// finalize publishes what is queued and finalizes the current batch
+func (p *Publisher) finalize() (err error) {
+
+	if p.Batch == "" {
+		return nil
+	}
+	err = p.OnFlush()
+	if err != nil {
+		return err
+	}
+	if p.Frames.Partial() > 0 {
+		p.Logger.Warn("Incomplete frame left unpublished",
+			zap.String("url", p.URL), zap.Int("bytes", p.Frames.Partial()))
+		p.Frames.Reset()
+	}
+	if p.records > 0 {
+		p.Finalized(ArchiveFileDetails{
+			FileName:      p.Batch,
+			URL:           p.URL,
+			BytesWritten:  p.bytes,
+			ChunksWritten: p.records,
+		})
+	}
+	p.Reset()
+	p.Batch = ""
+	p.bytes, p.records = 0, 0
+	return nil
+}
+
+// Close publishes what is queued, finalizes the current batch and releases
+// the connection. It can be called more than once.
+func (p *Publisher) Close() (err error) {
+
+	err = p.finalize()
+	if err != nil {
+		return err
+	}
+	if p.OnClose != nil {
+		return p.OnClose()
+	}
+	return nil
+}
+
+// Rotate finalizes the current batch, if any, and starts a new one. The
+// connection stays open.
+func (p *Publisher) Rotate() (err error) {
+
+	err = p.finalize()
+	if err != nil {
+		return errors.Wrapf(err, "Error closing the current batch")
+	}
+	p.Batch = BatchName(p.Prefix)
+	if header := p.Header(); header != nil && p.OnWrite == nil {
+		_, err = p.Write(header)
+		if err != nil {
+			return errors.Wrap(err, "Unable to take in file header")
+		}
+	}
+	p.Logger.Debug("Created", zap.String("batch", p.Batch), zap.String("url", p.URL))
+	return nil
+}
+
+// Name is the name of the current batch, at the URL
+func (p *Publisher) Name() string {
+	return p.URL + "#" + p.Batch
+}
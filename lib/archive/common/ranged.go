@@ -0,0 +1,227 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/cespare/xxhash"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Archives opened with OpenStream are downloaded streamChunk bytes at a
+// time, up to streamAhead chunks ahead of the reader, each tried up to
+// streamTries times
+const (
+	streamChunk = 8 << 20
+	streamAhead = 2
+	streamTries = 3
+)
+
+// RangeReader reads `length` bytes of a remote file from `offset`, e.g. with
+// a ranged GET, see OpenStream
+type RangeReader func(ctx context.Context, offset, length int64) (io.ReadCloser, error)
+
+// OpenStream opens remote archive `name`, of `size` bytes, for reading as it
+// is downloaded with `readRange`, rather than downloaded to a temporary file
+// first: reading starts right away and takes no local disk space, only
+// memory for a few chunks of the file. `*BasicArchive` returned is an
+// io.Reader, as with OpenArchive, whose Close stops the download. Compression
+// is told by content. A checksum footer, if any, can't be checked before the
+// file is read: it is at the end, where a mismatch fails with
+// ErrChecksumMismatch instead of io.EOF.
+func OpenStream(ctx context.Context, name string, size int64, readRange RangeReader, bufferSize int) (rf *BasicArchive, err error) {
+
+	rf = &BasicArchive{writing: false, Logger: DefaultLogger,
+		mu: &sync.Mutex{}, nameMu: &sync.Mutex{}}
+	rf.fqfn = name
+
+	dataLen, expected, err := streamFooter(ctx, name, size, readRange)
+	if err != nil {
+		return nil, err
+	}
+	rs := newRangeStream(ctx, dataLen, readRange)
+	rf.rs = rs
+	var stream io.Reader = rs
+	if expected != nil {
+		stream = &verifyingReader{r: rs, h: xxhash.New(), expected: *expected, name: name}
+	}
+	stream = bufio.NewReader(stream) // to sniff the compression
+	rf.zr, err = NewDecompressor(name, stream)
+	if err != nil {
+		rs.Close()
+		return nil, errors.Wrapf(err, "Error opening file %s", name)
+	}
+	if rf.zr != nil {
+		stream = rf.zr
+	}
+	if bufferSize > 0 {
+		rf.br = bufio.NewReaderSize(stream, bufferSize)
+	} else if br, ok := stream.(*bufio.Reader); ok { // uncompressed, read on after the sniff
+		rf.br = br
+	}
+	rf.Logger.Debug("Streaming", zap.String("file", name), zap.Int64("size", size))
+	return rf, nil
+}
+
+// streamFooter reads the checksum footer of a remote file, if it has one, see
+// VerifyFooter: `dataLen` is what is to be read of the file, and `expected`
+// its checksum (nil without a footer)
+func streamFooter(ctx context.Context, name string, size int64, readRange RangeReader) (dataLen int64, expected *uint64, err error) {
+
+	if size < footerLen {
+		return size, nil, nil
+	}
+	body, err := readRange(ctx, size-footerLen, footerLen)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "Unable to read %s", name)
+	}
+	defer body.Close()
+	footer := make([]byte, footerLen)
+	_, err = io.ReadFull(body, footer)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "Unable to read %s", name)
+	}
+	if !bytes.Equal(footer[16:], footerMagic) {
+		return size, nil, nil
+	}
+	dataLen = size - footerLen
+	if n := int64(binary.LittleEndian.Uint64(footer[8:])); n != dataLen {
+		return 0, nil, errors.Wrapf(ErrChecksumMismatch, "%s: %d bytes, %d expected", name, dataLen, n)
+	}
+	sum := binary.LittleEndian.Uint64(footer)
+	return dataLen, &sum, nil
+}
+
+// verifyingReader checks the checksum of what it reads from r once it is
+// all read
+type verifyingReader struct {
+	r        io.Reader
+	h        hash.Hash64
+	expected uint64
+	name     string
+}
+
+func (vr *verifyingReader) Read(p []byte) (n int, err error) {
+	n, err = vr.r.Read(p)
+	vr.h.Write(p[:n])
+	if err == io.EOF {
+		if sum := vr.h.Sum64(); sum != vr.expected {
+			return n, errors.Wrapf(ErrChecksumMismatch, "%s: %016X, %016X expected", vr.name, sum, vr.expected)
+		}
+	}
+	return n, err
+}
+
+// rangeStream reads the first `size` bytes of a remote file, as chunks
+// downloaded in order by a goroutine of its own
+type rangeStream struct {
+	chunks chan []byte
+	errc   chan error // of the download, once chunks is closed
+	cur    []byte
+	err    error
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newRangeStream(ctx context.Context, size int64, readRange RangeReader) (rs *rangeStream) {
+
+	rs = &rangeStream{chunks: make(chan []byte, streamAhead), errc: make(chan error, 1)}
+	ctx, rs.cancel = context.WithCancel(ctx)
+	rs.wg.Add(1)
+	go func() {
+		defer rs.wg.Done()
+		defer close(rs.chunks)
+		for offset := int64(0); offset < size; offset += streamChunk {
+			length := size - offset
+			if length > streamChunk {
+				length = streamChunk
+			}
+			chunk, err := readChunk(ctx, readRange, offset, length)
+			if err != nil {
+				rs.errc <- err
+				return
+			}
+			select {
+			case rs.chunks <- chunk:
+			case <-ctx.Done():
+				rs.errc <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return rs
+}
+
+// readChunk downloads a chunk of the file, trying again if the download fails
+// midway
+func readChunk(ctx context.Context, readRange RangeReader, offset, length int64) (chunk []byte, err error) {
+
+	for try := 1; ; try++ {
+		var body io.ReadCloser
+		body, err = readRange(ctx, offset, length)
+		if err == nil {
+			chunk, err = ioutil.ReadAll(body)
+			body.Close()
+			if err == nil && int64(len(chunk)) != length {
+				err = errors.Errorf("%d bytes read, %d expected", len(chunk), length)
+			}
+		}
+		if err == nil || try == streamTries || ctx.Err() != nil {
+			break
+		}
+		DefaultLogger.Debug("Ranged read failed, retrying",
+			zap.Int64("offset", offset), zap.Int("try", try), zap.Error(err))
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read bytes %d-%d", offset, offset+length-1)
+	}
+	return chunk, nil
+}
+
+func (rs *rangeStream) Read(p []byte) (n int, err error) {
+
+	for len(rs.cur) == 0 {
+		if rs.err != nil {
+			return 0, rs.err
+		}
+		chunk, ok := <-rs.chunks
+		if !ok {
+			select {
+			case rs.err = <-rs.errc:
+			default:
+				rs.err = io.EOF
+			}
+			continue
+		}
+		rs.cur = chunk
+	}
+	n = copy(p, rs.cur)
+	rs.cur = rs.cur[n:]
+	return n, nil
+}
+
+// Close stops the download
+func (rs *rangeStream) Close() error {
+	rs.cancel()
+	rs.wg.Wait()
+	return nil
+}
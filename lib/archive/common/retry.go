@@ -0,0 +1,151 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// maxRetryBackoff caps the wait between two attempts of RetryFinalize
+const maxRetryBackoff = 5 * time.Minute
+
+// RetryFinalize has a file whose Finalizer failed (e.g. a transient s3 or
+// azure error during the upload) finalized again, up to `retries` more
+// times (0 - not retried). Attempts are `backoff` apart, doubled after each
+// one up to 5 minutes, with jitter so that recorder threads failing together
+// don't retry together. Close waits for them, and stops waiting once the
+// Context is done. Files of StreamUpload can't be retried: their upload
+// fails before the Finalizer.
+func RetryFinalize(retries int, backoff time.Duration) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		if retries < 0 {
+			return errors.Errorf("Number of finalize retries can't be negative, got %d", retries)
+		}
+		if retries > 0 && backoff <= 0 {
+			return errors.Errorf("Finalize retry backoff must be positive, got %s", backoff)
+		}
+		b.retries = retries
+		b.retryBackoff = backoff
+		return nil
+	}
+}
+
+// RetryDirectory has a staged file that could not be finalized, retries
+// included (see RetryFinalize), moved to the local directory `dir` under its
+// final name (see FinalName), with its index, rather than left under its
+// .tmp name and Close failing: recording goes on, and the file is uploaded
+// later on, e.g. with `bhctl cp`. Its details have the local path as URL and
+// the error as Failover. Without it (the default), the error is returned.
+func RetryDirectory(dir string) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		b.retryDir = dir
+		return nil
+	}
+}
+
+// finalize calls the Finalizer, again as set with RetryFinalize if it
+// fails, and parks the file in the RetryDirectory if it still does
+func (rf *BasicArchive) finalize() (finalFile ArchiveFileDetails, err error) {
+
+	backoff := rf.retryBackoff
+	for attempt := 0; ; attempt++ {
+		finalFile, err = rf.Finalizer()
+		if err == nil || attempt == rf.retries {
+			break
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		rf.Logger.Warn("Finalize failed, retrying",
+			zap.String("file", rf.Name()),
+			zap.Int("attempt", attempt+1),
+			zap.Duration("wait", wait),
+			zap.Error(err))
+		select {
+		case <-time.After(wait):
+		case <-rf.Context().Done():
+			return finalFile, errors.Wrapf(err, "retries cancelled (%v)", rf.Context().Err())
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+	if err == nil || rf.retryDir == "" || rf.Streamer != nil {
+		return finalFile, err
+	}
+	return rf.park(err)
+}
+
+// park moves the staged file, which failed to be finalized with `cause`, to
+// the RetryDirectory
+func (rf *BasicArchive) park(cause error) (finalFile ArchiveFileDetails, err error) {
+
+	staged := rf.Name()
+	fi, err := os.Stat(staged)
+	if err != nil { // taken away by the Finalizer, nothing to park
+		return finalFile, cause
+	}
+	parked := filepath.Join(rf.retryDir, filepath.FromSlash(rf.FinalName()))
+	err = os.MkdirAll(filepath.Dir(parked), 0755)
+	if err == nil {
+		err = moveFile(staged, parked)
+	}
+	if err != nil {
+		rf.Logger.Error("Unable to move file to retry directory", zap.String("file", staged), zap.Error(err))
+		return finalFile, cause
+	}
+	rf.StoreIndex(func(indexPath string) error {
+		return moveFile(indexPath, parked+IndexExt)
+	})
+	rf.Logger.Error("Finalize failed, file moved to retry directory",
+		zap.String("file", parked), zap.Error(cause))
+
+	finalFile.FileName = rf.FinalName()
+	finalFile.URL = parked
+	finalFile.BytesWritten = fi.Size()
+	finalFile.ChunksWritten = rf.ChunksWritten
+	finalFile.Failover = cause.Error()
+	return finalFile, nil
+}
+
+// moveFile renames `src` to `dst`, copying it over if they are on different
+// file systems
+func moveFile(src, dst string) (err error) {
+
+	if os.Rename(src, dst) == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
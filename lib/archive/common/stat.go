@@ -0,0 +1,137 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// indexTail is how much of the end of an index StatArchive reads to find
+// its trailer: "# <count> requests\n"
+const indexTail = 64
+
+// ArchiveStat is what StatArchive tells of an archive file without reading
+// it. Name is the URL of the file, as given.
+type ArchiveStat struct {
+	ArchiveEntry
+	Records  int64  // requests in the file, from its index (see Index), -1 without one
+	Checksum string // xxhash of the file, from its checksum footer (see ChecksumFooter), empty without one
+}
+
+// StatFunc tells the size and modification time of a file of a backend
+type StatFunc func(ctx context.Context, name string) (ArchiveEntry, error)
+
+// RangeOfFunc is a RangeReader of any file of a backend
+type RangeOfFunc func(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+
+// StatArchive tells what `stat` and ranged reads of `readRange` tell of
+// archive `name`: its size and modification time, and its record count and
+// checksum if it has an index and a checksum footer, reading only their last
+// bytes. An index that can't be read is taken for none.
+func StatArchive(ctx context.Context, name string, stat StatFunc, readRange RangeOfFunc) (st ArchiveStat, err error) {
+
+	st.ArchiveEntry, err = stat(ctx, name)
+	if err != nil {
+		return st, err
+	}
+	st.Name = name
+	st.Records = -1
+
+	if st.Size >= footerLen {
+		footer, err := readTail(ctx, name, st.Size, footerLen, readRange)
+		if err != nil {
+			return st, errors.Wrapf(err, "Unable to read %s", name)
+		}
+		if bytes.Equal(footer[16:], footerMagic) {
+			st.Checksum = fmt.Sprintf("%016X", binary.LittleEndian.Uint64(footer))
+		}
+	}
+
+	indexName := name + IndexExt
+	index, err := stat(ctx, indexName)
+	if err != nil { // no index, most likely
+		return st, nil
+	}
+	tail, err := readTail(ctx, indexName, index.Size, indexTail, readRange)
+	if err != nil {
+		return st, nil
+	}
+	st.Records = indexRecords(tail)
+	return st, nil
+}
+
+// readTail reads the last `n` bytes (at most) of a file of `size` bytes
+func readTail(ctx context.Context, name string, size, n int64, readRange RangeOfFunc) (tail []byte, err error) {
+
+	if n > size {
+		n = size
+	}
+	body, err := readRange(ctx, name, size-n, n)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// indexRecords is the count of the trailer of an index that ends with
+// `tail`, -1 if incomplete
+func indexRecords(tail []byte) int64 {
+
+	lines := strings.Split(strings.TrimSuffix(string(tail), "\n"), "\n")
+	last := lines[len(lines)-1]
+	if !strings.HasPrefix(last, "# ") || !strings.HasSuffix(last, indexTrailer) {
+		return -1
+	}
+	n, err := strconv.ParseInt(strings.TrimSuffix(last[2:], indexTrailer), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// StatLocal is the StatFunc of local files
+func StatLocal(ctx context.Context, name string) (entry ArchiveEntry, err error) {
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return entry, err
+	}
+	if fi.IsDir() {
+		return entry, errors.Errorf("%s is a directory", name)
+	}
+	return ArchiveEntry{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// ReadLocalRange is the RangeOfFunc of local files
+func ReadLocalRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+
+	fp, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(fp, offset, length), fp}, nil
+}
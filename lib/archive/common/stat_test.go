@@ -0,0 +1,96 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIndexRecords(t *testing.T) {
+
+	tests := []struct {
+		tail string
+		want int64
+	}{
+		{"id-1 10\n# 42 requests\n", 42},
+		{"# 0 requests\n", 0},
+		{"# 42 requests", 42},
+		{"id-1 10\nid-2 2", -1},
+		{"# many requests\n", -1},
+		{"# 42 records\n", -1},
+		{"", -1},
+	}
+	for _, tt := range tests {
+		if got := indexRecords([]byte(tt.tail)); got != tt.want {
+			t.Fatalf("%q: got %d, want %d", tt.tail, got, tt.want)
+		}
+	}
+}
+
+func TestStatArchive(t *testing.T) {
+
+	dir := tempDir(t)
+	var frames [][]byte
+	for i := 0; i < 10; i++ {
+		frames = append(frames, testRequest(fmt.Sprintf("id-%d", i), 0))
+	}
+	tmpName, tmpIndex := writeArchive(t, dir, frames, Index(true), ChecksumFooter(true))
+	fileName := filepath.Join(dir, "requests.fbf")
+	indexFile := fileName + IndexExt
+	if err := os.Rename(tmpName, fileName); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpIndex, indexFile); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum := fmt.Sprintf("%016X", binary.LittleEndian.Uint64(data[len(data)-footerLen:]))
+	st, err := StatArchive(context.Background(), fileName, StatLocal, ReadLocalRange)
+	if err != nil || st.Name != fileName || st.Size != int64(len(data)) || st.ModTime.IsZero() ||
+		st.Records != 10 || st.Checksum != checksum {
+		t.Fatalf("got %+v, %v", st, err)
+	}
+
+	// An index cut short is taken for none
+	index, err := ioutil.ReadFile(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(indexFile, index[:len(index)-5], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if st, err = StatArchive(context.Background(), fileName, StatLocal, ReadLocalRange); err != nil ||
+		st.Records != -1 || st.Checksum != checksum {
+		t.Fatalf("got %+v, %v", st, err)
+	}
+
+	fileName, _ = writeArchive(t, dir, frames[:1])
+	if st, err = StatArchive(context.Background(), fileName, StatLocal, ReadLocalRange); err != nil ||
+		st.Size != int64(len(frames[0])) || st.Records != -1 || st.Checksum != "" {
+		t.Fatalf("got %+v, %v", st, err)
+	}
+	for _, name := range []string{dir, fileName + ".missing"} {
+		if _, err = StatArchive(context.Background(), name, StatLocal, ReadLocalRange); err == nil {
+			t.Fatalf("%s: no error", name)
+		}
+	}
+}
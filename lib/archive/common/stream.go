@@ -0,0 +1,74 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"sync/atomic"
+)
+
+// UploadStream is a file being uploaded as it is written, see StreamerFunc
+type UploadStream interface {
+	io.Writer
+	// Close completes the upload, once all of the file is written, and
+	// returns when it is stored
+	Close() error
+	// Abort cancels the upload: nothing is stored
+	Abort()
+	// Name is where the file is uploaded to, for logs
+	Name() string
+}
+
+// StreamerFunc starts the upload of a new file, to be finalized as
+// `finalName` (see FinalName). Backends that can upload files as they are
+// written set it as BasicArchive.Streamer when StreamsUpload is true: Rotate
+// then writes files to the stream it returns instead of staging them on
+// local disk, and Close completes the upload before calling the Finalizer.
+type StreamerFunc func(finalName string) (UploadStream, error)
+
+// StreamUpload has files uploaded as they are written, without a local
+// staging file, by backends that can (s3:// so far, other backends ignore
+// it). Disks of any size can then record files of any size, and there is
+// nothing left to upload at Close. The other side of it: a file is lost if
+// its upload fails or the process crashes, nothing is left for recovery
+// (see recorder.Recover) or for FailoverArchive to store elsewhere.
+func StreamUpload(on bool) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		b.streamUpload = on
+		return nil
+	}
+}
+
+// StreamsUpload tells if StreamUpload is set, for backends to set Streamer
+func (rf *BasicArchive) StreamsUpload() bool {
+	return rf.streamUpload
+}
+
+// StoredSize is how many bytes are stored in the current file (compressed,
+// encrypted), as far as they were written out of buffers. It is counted with
+// MaxFileSize, or for uploads of Streamer, where there is no file to stat:
+// their Finalizer takes it as BytesWritten.
+func (rf *BasicArchive) StoredSize() int64 {
+	return atomic.LoadInt64(&rf.fileSize)
+}
+
+// randomName is a random number for the name of a file that isn't created
+// by ioutil.TempFile, which has it otherwise
+func randomName() string {
+	var b [4]byte
+	rand.Read(b[:]) // never fails on supported platforms
+	return strconv.FormatUint(uint64(binary.LittleEndian.Uint32(b[:])), 10)
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fileSeq numbers the files of FilenameTemplate, over all archives of the
+// process
+var fileSeq int64
+
+var placeholder = regexp.MustCompile(`\{[a-z]*\}`)
+
+var placeholders = map[string]bool{
+	"{prefix}": true, "{ext}": true, "{date}": true, "{year}": true, "{month}": true,
+	"{day}": true, "{hour}": true, "{timestamp}": true, "{hostname}": true,
+	"{seq}": true, "{random}": true}
+
+// FilenameTemplate names finalized files after `tmpl` instead of
+// prefix_YYYYmmddHHMMSS_random.ext, e.g. "{prefix}/dt={date}/{hostname}-{seq}.{ext}"
+// for a Hive-style layout. It is a path relative to the output directory,
+// "/" separated; directories are created as needed. Files are staged under
+// their usual name until finalized. Placeholders:
+//
+//	{prefix}     prefix of the archive
+//	{ext}        extension, with those of compression and encryption (fbf.lz4)
+//	{date}       2006-01-02, when the file was created (local time, as the usual name)
+//	{year}, {month}, {day}, {hour}
+//	             parts of it: 2006, 01, 02, 15
+//	{timestamp}  20060102150405, as in the usual name
+//	{hostname}   name of the host
+//	{seq}        number of the file among those created by the process, from 1
+//	{random}     random number of the usual name
+//
+// Names must not collide: {seq} starts over with the process, so it takes
+// {timestamp} or {random} as well across runs. Files recovered after a crash
+// (see recorder.Recover) keep their usual name.
+func FilenameTemplate(tmpl string) func(*BasicArchive) error {
+	return func(b *BasicArchive) error {
+		if tmpl == "" {
+			b.template = ""
+			return nil
+		}
+		for _, p := range placeholder.FindAllString(tmpl, -1) {
+			if !placeholders[p] {
+				return errors.Errorf("Unknown placeholder %s in file name template %s", p, tmpl)
+			}
+		}
+		clean := path.Clean(tmpl)
+		if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") || strings.HasSuffix(tmpl, "/") {
+			return errors.Errorf("File name template %s must be a file path relative to the output directory", tmpl)
+		}
+		if strings.Contains(tmpl, "{hostname}") {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return errors.Wrap(err, "Unable to get hostname for file name template")
+			}
+			b.hostname = hostname
+		}
+		b.template = clean
+		return nil
+	}
+}
+
+// expandTemplate is the name of a file created at `n`, after the template of
+// FilenameTemplate. `random` is that of its usual name, and `extension`
+// starts with a dot.
+func (rf *BasicArchive) expandTemplate(n time.Time, random, extension string) string {
+
+	name := rf.template
+	if strings.Contains(name, "{seq}") {
+		name = strings.Replace(name, "{seq}", strconv.FormatInt(atomic.AddInt64(&fileSeq, 1), 10), -1)
+	}
+	return strings.NewReplacer(
+		"{prefix}", rf.prefix,
+		"{ext}", strings.TrimPrefix(extension, "."),
+		"{date}", n.Format("2006-01-02"),
+		"{year}", n.Format("2006"),
+		"{month}", n.Format("01"),
+		"{day}", n.Format("02"),
+		"{hour}", n.Format("15"),
+		"{timestamp}", n.Format("20060102150405"),
+		"{hostname}", rf.hostname,
+		"{random}", random,
+	).Replace(name)
+}
+
+// FinalName is the name the current file is finalized under, relative to
+// the output directory: after FilenameTemplate, or its staging name without
+// .tmp. Finalizers use it.
+func (rf *BasicArchive) FinalName() string {
+	rf.nameMu.Lock()
+	defer rf.nameMu.Unlock()
+	return rf.finalName
+}
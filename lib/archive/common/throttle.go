@@ -0,0 +1,121 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the most a throttled Reader reads at once, so that
+// transfers go at an even pace rather than part by part
+const throttleChunk = 64 * 1024
+
+// Throttle caps the bandwidth of the transfers sharing it (uploads and
+// downloads of s3 and az, see archive.SetBandwidth), in bytes per second, so
+// that they don't saturate a link they share with other traffic. A nil
+// *Throttle doesn't limit anything.
+type Throttle struct {
+	mu   sync.Mutex
+	rate int64     // bytes per second
+	next time.Time // when the bytes let through so far are within the rate
+}
+
+// NewThrottle returns a Throttle of `bytesPerSecond`, nil (no limit) if it
+// isn't positive
+func NewThrottle(bytesPerSecond int64) *Throttle {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &Throttle{rate: bytesPerSecond}
+}
+
+// Wait blocks until `n` more bytes can go through without going over the
+// rate, or until `ctx` is done
+func (t *Throttle) Wait(ctx context.Context, n int) error {
+
+	if t == nil || n <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) { // idle meanwhile: that isn't saved up
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(int64(n) * int64(time.Second) / t.rate))
+	wait := t.next.Sub(now)
+	t.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reader returns `r` read at the rate of the Throttle, `r` itself if it is
+// nil. Like any wrapper, it hides the io.ReaderAt and io.Seeker of `r`.
+func (t *Throttle) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &throttledReader{r: r, t: t, ctx: ctx}
+}
+
+// WriterAt returns `w` written to at the rate of the Throttle, `w` itself if
+// it is nil
+func (t *Throttle) WriterAt(ctx context.Context, w io.WriterAt) io.WriterAt {
+	if t == nil {
+		return w
+	}
+	return &throttledWriterAt{w: w, t: t, ctx: ctx}
+}
+
+type throttledReader struct {
+	r   io.Reader
+	t   *Throttle
+	ctx context.Context
+}
+
+func (tr *throttledReader) Read(p []byte) (n int, err error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err = tr.r.Read(p)
+	if werr := tr.t.Wait(tr.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+type throttledWriterAt struct {
+	w   io.WriterAt
+	t   *Throttle
+	ctx context.Context
+}
+
+func (tw *throttledWriterAt) WriteAt(p []byte, off int64) (n int, err error) {
+	err = tw.t.Wait(tw.ctx, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return tw.w.WriteAt(p, off)
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package archive
+
+import (
+	"sync"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+)
+
+// ConcurrentArchive is an archive several goroutines can write to, see
+// common.Concurrent: every call to the archive it wraps is made under a lock.
+// NewArchive returns one with common.Concurrent(true); wrap those of
+// NewMultiArchive and NewFailoverArchive with NewConcurrentArchive.
+//
+// BasicArchive has a lock of its own, but it is held one call at a time,
+// for its rotation timer: a request written with several calls (see Locked)
+// could still be interleaved with the writes of other goroutines, and
+// archives that don't write through BasicArchive (publishers, multi,
+// failover) have no lock at all. Plain Write and Flush take this lock too,
+// not to write in the middle of a Locked request.
+type ConcurrentArchive struct {
+	mu sync.Mutex
+	rf Archive
+}
+
+// NewConcurrentArchive wraps `rf` for concurrent use
+func NewConcurrentArchive(rf Archive) *ConcurrentArchive {
+	return &ConcurrentArchive{rf: rf}
+}
+
+// Locked calls `f` with the archive wrapped, under the lock, for writes that
+// take several calls (e.g. a request and its row count, see
+// request.SaveRequest) not to be interleaved with those of other goroutines.
+// `f` must not call the ConcurrentArchive itself.
+func (rf *ConcurrentArchive) Locked(f func(Archive) error) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return f(rf.rf)
+}
+
+// Write satisfies io.Writer interface
+func (rf *ConcurrentArchive) Write(buf []byte) (n int, err error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.rf.Write(buf)
+}
+
+// Read satisfies io.Reader interface
+func (rf *ConcurrentArchive) Read(p []byte) (n int, err error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.rf.Read(p)
+}
+
+// Flush flushes the archive wrapped
+func (rf *ConcurrentArchive) Flush() (err error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.rf.Flush()
+}
+
+// Rotate rotates the archive wrapped
+func (rf *ConcurrentArchive) Rotate() (err error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.rf.Rotate()
+}
+
+// Close closes the archive wrapped
+func (rf *ConcurrentArchive) Close() (err error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.rf.Close()
+}
+
+// Name is that of the archive wrapped
+func (rf *ConcurrentArchive) Name() string {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.rf.Name()
+}
+
+// FinalizedFiles are those of the archive wrapped
+func (rf *ConcurrentArchive) FinalizedFiles() map[string]common.ArchiveFileDetails {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.rf.FinalizedFiles()
+}
+
+// AddRows counts rows in the archive wrapped, if it keeps count of them
+func (rf *ConcurrentArchive) AddRows(n int64) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rc, ok := rf.rf.(interface{ AddRows(int64) }); ok {
+		rc.AddRows(n)
+	}
+}
+
+// RowsLeft is that of the archive wrapped (see common.MaxRows), -1 if it
+// has no row limit
+func (rf *ConcurrentArchive) RowsLeft() int64 {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rl, ok := rf.rf.(interface{ RowsLeft() int64 }); ok {
+		return rl.RowsLeft()
+	}
+	return -1
+}
+
+// FinalName is that of the archive wrapped, empty if unknown
+func (rf *ConcurrentArchive) FinalName() string {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return finalName(rf.rf)
+}
+
+// RotatesOnTimer is that of the archive wrapped, see common.RotateEvery
+func (rf *ConcurrentArchive) RotatesOnTimer() bool {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rt, ok := rf.rf.(interface{ RotatesOnTimer() bool }); ok {
+		return rt.RotatesOnTimer()
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package archive
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/frame"
+	"go.uber.org/zap"
+)
+
+// testFrame is a frame of `payload`
+func testFrame(payload string) []byte {
+	buf := make([]byte, frame.PrefixLen, frame.PrefixLen+len(payload))
+	frame.PutPrefix(buf, len(payload), 0)
+	return append(buf, payload...)
+}
+
+// readFrames is the payloads of the frames of the archive files of `dir`,
+// sorted. Every file must end with a complete frame.
+func readFrames(t *testing.T, dir string) (payloads []string, files int) {
+
+	entries, err := ListDetails(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		rf, err := OpenArchive(filepath.Join(dir, entry.Name), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadAll(rf)
+		rf.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := common.CompleteFrames(buf)
+		if err != nil || n != len(buf) {
+			t.Fatalf("%s: %d bytes of complete frames of %d, %v", entry.Name, n, len(buf), err)
+		}
+		for len(buf) > 0 {
+			payloadLen, _ := frame.ParsePrefix(buf)
+			payloads = append(payloads, string(buf[frame.PrefixLen:frame.PrefixLen+payloadLen]))
+			buf = buf[frame.PrefixLen+payloadLen:]
+		}
+	}
+	sort.Strings(payloads)
+	return payloads, len(entries)
+}
+
+func TestNewArchiveConcurrent(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		outDir     string
+		options    []func(*common.BasicArchive) error
+		concurrent bool
+	}{
+		{"file", tempDir(t), nil, false},
+		{"concurrent file", tempDir(t), []func(*common.BasicArchive) error{common.Concurrent(true)}, true},
+		{"turned off", tempDir(t), []func(*common.BasicArchive) error{common.Concurrent(true), common.Concurrent(false)}, false},
+		{"null", "null://", []func(*common.BasicArchive) error{common.Concurrent(true)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rf, err := NewArchive(tt.outDir, "requests", ".fbf", append(tt.options, common.Logger(zap.NewNop()))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rf.Close()
+			if _, ok := rf.(*ConcurrentArchive); ok != tt.concurrent {
+				t.Fatalf("got %T", rf)
+			}
+		})
+	}
+}
+
+// Requests written with several calls under Locked aren't interleaved
+func TestConcurrentArchiveLocked(t *testing.T) {
+
+	dir := tempDir(t)
+	rf, err := NewArchive(dir, "requests", ".fbf", common.Concurrent(true), common.BufferSize(64),
+		common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := rf.(*ConcurrentArchive)
+
+	const producers, requests = 8, 300
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				buf := testFrame(fmt.Sprintf("request %d of %d", i, p))
+				switch i % 3 {
+				case 0:
+					ca.Write(buf)
+				case 1:
+					ca.Locked(func(rf Archive) error {
+						for _, b := range buf { // a byte at a time
+							rf.Write([]byte{b})
+						}
+						return nil
+					})
+				case 2:
+					ca.Write(buf)
+					ca.Flush()
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	if err = ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := readFrames(t, dir)
+	if len(got) != producers*requests {
+		t.Fatalf("got %d requests, want %d", len(got), producers*requests)
+	}
+}
@@ -0,0 +1,322 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package es provides archive interface for an Elasticsearch (or
+// OpenSearch) index, es://host:9200/index or ess:// for HTTPS. Nothing is
+// written to files: every request written to the archive becomes a JSON
+// document, with `id`, `time`, `method`, `uri`, `headers` (name to value)
+// and `body` (base64) of the request and the `batch` it belongs to, and
+// documents are sent with the _bulk API. A bulk request is sent every 1000
+// documents or 5MB, and on Flush, Rotate and Close; any document that
+// failed fails it.
+package es
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// A bulk request is sent once this many documents, or this many bytes, are
+// pending, and on Flush, Rotate and Close
+const (
+	bulkCount = 1000
+	bulkBytes = 5 * 1024 * 1024
+)
+
+// esMapping is used when the index does not exist yet, the same as that of
+// `bhctl export es` where fields are the same. Works with Elasticsearch 7+
+// and OpenSearch. Header values are keywords, bodies are kept, not indexed.
+const esMapping = `{
+  "mappings": {
+    "dynamic_templates": [
+      {"headers": {"path_match": "headers.*", "mapping": {"type": "keyword", "ignore_above": 2048}}}
+    ],
+    "properties": {
+      "id":      {"type": "keyword"},
+      "time":    {"type": "date", "format": "strict_date_optional_time_nanos"},
+      "method":  {"type": "keyword"},
+      "uri":     {"type": "text", "fields": {"raw": {"type": "keyword", "ignore_above": 2048}}},
+      "headers": {"type": "object"},
+      "body":    {"type": "binary"},
+      "batch":   {"type": "keyword"}
+    }
+  }
+}`
+
+// bulkAction precedes every document: index it, with an ID of the server,
+// as request IDs may repeat
+const bulkAction = "{\"index\":{}}\n"
+
+var esClient = &http.Client{Timeout: 2 * time.Minute}
+
+type ESArchive struct {
+	common.Publisher
+	baseURL string // http(s)://host:port
+	index   string
+	user    *url.Userinfo // nil without basic auth
+	apiKey  string
+	payload bytes.Buffer // of the next bulk request
+	enc     *json.Encoder
+	pending int // documents in payload
+}
+
+// document is what a request is indexed as
+type document struct {
+	ID      string            `json:"id"`
+	Time    *time.Time        `json:"time,omitempty"`
+	Method  string            `json:"method"`
+	URI     string            `json:"uri"`
+	Headers map[string]string `json:"headers"`
+	Body    []byte            `json:"body,omitempty"` // base64
+	Batch   string            `json:"batch"`
+}
+
+// bulkResponse is the part of the _bulk response we look at
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// parseESURL splits es://[user:pass@]host[:port]/index (ess:// for HTTPS,
+// port 9200 by default) into the base URL of the API, index and credentials.
+// `display` is the URL without credentials.
+func parseESURL(esURL string) (display, baseURL, index string, user *url.Userinfo, err error) {
+
+	u, err := url.Parse(esURL)
+	if err != nil {
+		return "", "", "", nil, errors.Wrapf(err, "Unable to parse es url: %s", esURL)
+	}
+	index = strings.Trim(u.Path, "/")
+	if u.Host == "" || index == "" || strings.Contains(index, "/") || index != strings.ToLower(index) {
+		return "", "", "", nil, errors.Errorf("Unable to parse es url format (es://host:9200/index, lowercase): %s", esURL)
+	}
+	if u.Port() == "" {
+		u.Host += ":9200"
+	}
+	scheme := "http"
+	if strings.EqualFold(u.Scheme, "ess") {
+		scheme = "https"
+	}
+	display = strings.ToLower(u.Scheme) + "://" + u.Host + "/" + index
+	return display, scheme + "://" + u.Host, index, u.User, nil
+}
+
+// NewArchive creates a new archive indexing requests into Elasticsearch.
+// `outDir` is es://[user:pass@]host:port/index, or ess:// for HTTPS with the
+// system roots; ES_API_KEY, if set, is used instead of a user. The index is
+// created with a mapping for the documents if it doesn't exist. Rotate
+// sends what is pending and starts a new batch, which stands for a file in
+// FinalizedFiles and OnFinalize. The caller must call `rf.Close()` to send
+// what is left.
+func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *ESArchive, err error) {
+
+	display, baseURL, index, user, err := parseESURL(outDir)
+	if err != nil {
+		return nil, err
+	}
+	p, err := common.NewPublisher(display, "elasticsearch", prefix, extension, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	rf = &ESArchive{Publisher: *p,
+		baseURL: baseURL,
+		index:   index,
+		user:    user,
+		apiKey:  os.Getenv("ES_API_KEY")}
+	rf.enc = json.NewEncoder(&rf.payload)
+	rf.enc.SetEscapeHTML(false)
+	rf.Frames.OnRequest = rf.add
+	rf.OnFlush = rf.bulk
+
+	err = rf.ensureIndex()
+	if err != nil {
+		return nil, err
+	}
+	err = rf.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return rf, err
+}
+
+// do sends a request to the API and returns the response
+func (rf *ESArchive) do(method, uri, contentType string, body io.Reader) (respBody []byte, status int, err error) {
+
+	req, err := http.NewRequest(method, rf.baseURL+uri, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if rf.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+rf.apiKey)
+	} else if rf.user != nil {
+		password, _ := rf.user.Password()
+		req.SetBasicAuth(rf.user.Username(), password)
+	}
+	resp, err := esClient.Do(req)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "%s %s failed", method, rf.URL)
+	}
+	defer resp.Body.Close()
+	respBody, err = ioutil.ReadAll(resp.Body)
+	return respBody, resp.StatusCode, err
+}
+
+// ensureIndex creates the index with esMapping unless it already exists
+func (rf *ESArchive) ensureIndex() (err error) {
+
+	_, status, err := rf.do(http.MethodHead, "/"+rf.index, "", nil)
+	if err != nil {
+		return errors.Wrap(err, "Unable to check index")
+	}
+	if status == http.StatusOK {
+		return nil
+	}
+	body, status, err := rf.do(http.MethodPut, "/"+rf.index, "application/json", strings.NewReader(esMapping))
+	if err != nil {
+		return errors.Wrap(err, "Unable to create index")
+	}
+	if status >= 300 {
+		// Another archive may have created it meanwhile
+		if bytes.Contains(body, []byte("resource_already_exists_exception")) {
+			return nil
+		}
+		return errors.Errorf("Unable to create index %s: HTTP %d: %s", rf.URL, status, body)
+	}
+	rf.Logger.Info("Created index", zap.String("index", rf.URL))
+	return nil
+}
+
+// OpenArchive is not supported: documents are searched, not read back
+func OpenArchive(fileName string, bufferSize int) (rf *ESArchive, err error) {
+	return nil, common.NotSupported("Reading", "elasticsearch indexes", fileName)
+}
+
+// Fetch is not supported, see OpenArchive
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return "", false, common.NotSupported("Reading", "elasticsearch indexes", fileName)
+}
+
+// Store indexes the requests of a local archive file (compressed or not)
+// into the index of `dir`
+func Store(localPath, dir string) (err error) {
+
+	rf, err := NewArchive(dir, "", "", common.Logger(common.DefaultLogger))
+	if err != nil {
+		return err
+	}
+	return rf.Store(localPath)
+}
+
+func List(dir string) (files []string, err error) {
+	return nil, common.NotSupported("Listing", "elasticsearch indexes", dir)
+}
+
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+	return nil, common.NotSupported("Listing", "elasticsearch indexes", dir)
+}
+
+func Delete(dir string, files []string) (err error) {
+	return common.NotSupported("Deleting", "elasticsearch indexes", dir)
+}
+
+// add appends the document of a request to the next bulk request, sent
+// once bulkCount documents or bulkBytes are pending
+func (rf *ESArchive) add(payload []byte) (err error) {
+
+	req := fbr.GetRootAsRequest(payload, 0)
+	doc := document{
+		ID:      string(req.Id()),
+		Method:  string(req.Method()),
+		URI:     string(req.Uri()),
+		Headers: common.HeaderMap(req.Headers()),
+		Body:    req.BodyBytes(),
+		Batch:   rf.Batch,
+	}
+	if ts := req.Timestamp(); ts != 0 {
+		t := time.Unix(0, ts).UTC()
+		doc.Time = &t
+	}
+	size := rf.payload.Len()
+	rf.payload.WriteString(bulkAction)
+	err = rf.enc.Encode(&doc) // one line, as _bulk wants
+	if err != nil {
+		rf.payload.Truncate(size)
+		return errors.Wrapf(err, "Unable to encode request %s", doc.ID)
+	}
+	rf.pending++
+	if rf.pending >= bulkCount || rf.payload.Len() >= bulkBytes {
+		return rf.bulk()
+	}
+	return nil
+}
+
+// bulk sends the pending documents. Any document that failed fails it, the
+// others are indexed.
+func (rf *ESArchive) bulk() (err error) {
+
+	if rf.pending == 0 {
+		return nil
+	}
+	sent, size := rf.pending, rf.payload.Len()
+	body, status, err := rf.do(http.MethodPost, "/"+rf.index+"/_bulk", "application/x-ndjson", bytes.NewReader(rf.payload.Bytes()))
+	rf.payload.Reset()
+	rf.pending = 0
+	if err != nil {
+		return errors.Wrapf(err, "Unable to index %d requests", sent)
+	}
+	if status >= 300 {
+		return errors.Errorf("Unable to index %d requests into %s: HTTP %d: %s", sent, rf.URL, status, body)
+	}
+	var resp bulkResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to parse bulk response of %s", rf.URL)
+	}
+	failed := 0
+	var firstErr error
+	if resp.Errors {
+		for _, item := range resp.Items {
+			for _, result := range item {
+				if result.Status >= 300 {
+					failed++
+					if firstErr == nil {
+						firstErr = errors.Errorf("HTTP %d: %s", result.Status, result.Error)
+					}
+				}
+			}
+		}
+	}
+	rf.Published(sent-failed, size) // bytes close enough when some failed
+	if firstErr != nil {
+		return errors.Wrapf(firstErr, "Unable to index %d of %d requests into %s", failed, sent, rf.URL)
+	}
+	return nil
+}
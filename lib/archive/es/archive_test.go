@@ -0,0 +1,216 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package es
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/frame"
+	flatbuffers "github.com/google/flatbuffers/go"
+	"go.uber.org/zap"
+)
+
+// testRequest is the frame of a request to `uri`, recorded at `ts`
+func testRequest(id, uri string, ts int64) []byte {
+	b := flatbuffers.NewBuilder(0)
+	idOffset := b.CreateString(id)
+	method := b.CreateString("POST")
+	uriOffset := b.CreateString(uri)
+	headers := b.CreateString("Host: example.com\r\nX-A: 1\r\nX-A: 2\r\n\r\n")
+	body := b.CreateByteVector([]byte("body of " + id))
+	fbr.RequestStart(b)
+	fbr.RequestAddId(b, idOffset)
+	fbr.RequestAddMethod(b, method)
+	fbr.RequestAddUri(b, uriOffset)
+	fbr.RequestAddHeaders(b, headers)
+	fbr.RequestAddBody(b, body)
+	fbr.RequestAddTimestamp(b, ts)
+	b.Finish(fbr.RequestEnd(b))
+	payload := b.FinishedBytes()
+	buf := make([]byte, frame.PrefixLen, frame.PrefixLen+len(payload))
+	frame.PutPrefix(buf, len(payload), 0)
+	return append(buf, payload...)
+}
+
+// fakeES is an Elasticsearch API of one index, failing documents of
+// requests to /fail
+type fakeES struct {
+	mu      sync.Mutex
+	exists  bool
+	mapping string
+	auth    []string
+	bulks   [][]document
+}
+
+func (es *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.auth = append(es.auth, r.Header.Get("Authorization"))
+	switch {
+	case r.Method == http.MethodHead && r.URL.Path == "/requests":
+		if !es.exists {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == http.MethodPut && r.URL.Path == "/requests":
+		body, _ := ioutil.ReadAll(r.Body)
+		es.mapping, es.exists = string(body), true
+	case r.Method == http.MethodPost && r.URL.Path == "/requests/_bulk":
+		var docs []document
+		var items []string
+		failed := false
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			if scanner.Text() != strings.TrimSpace(bulkAction) || !scanner.Scan() {
+				http.Error(w, "bad action "+scanner.Text(), http.StatusBadRequest)
+				return
+			}
+			var doc document
+			if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			docs = append(docs, doc)
+			if doc.URI == "/fail" {
+				failed = true
+				items = append(items, `{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}`)
+			} else {
+				items = append(items, `{"index":{"status":201}}`)
+			}
+		}
+		es.bulks = append(es.bulks, docs)
+		fmt.Fprintf(w, `{"errors":%v,"items":[%s]}`, failed, strings.Join(items, ","))
+	default:
+		http.Error(w, r.Method+" "+r.URL.Path, http.StatusNotFound)
+	}
+}
+
+// serve runs `es` until the end of the test, and returns the es:// URL of
+// its index
+func (es *fakeES) serve(t *testing.T, user string) string {
+	server := httptest.NewServer(es)
+	t.Cleanup(server.Close)
+	return "es://" + user + strings.TrimPrefix(server.URL, "http://") + "/requests"
+}
+
+func TestParseESURL(t *testing.T) {
+
+	tests := []struct {
+		url, display, baseURL, index string
+		err                          bool
+	}{
+		{"es://localhost/requests", "es://localhost:9200/requests", "http://localhost:9200", "requests", false},
+		{"ESS://u:p@search:443/requests/", "ess://search:443/requests", "https://search:443", "requests", false},
+		{"es://localhost:9200/", "", "", "", true},
+		{"es://localhost:9200/a/b", "", "", "", true},
+		{"es://localhost:9200/Requests", "", "", "", true},
+		{"es:///requests", "", "", "", true},
+	}
+	for _, tt := range tests {
+		display, baseURL, index, _, err := parseESURL(tt.url)
+		if display != tt.display || baseURL != tt.baseURL || index != tt.index || (err != nil) != tt.err {
+			t.Fatalf("%s: got %q, %q, %q, %v", tt.url, display, baseURL, index, err)
+		}
+	}
+}
+
+// The index is created, then requests are sent as documents on flush
+func TestIndex(t *testing.T) {
+
+	es := &fakeES{}
+	rf, err := NewArchive(es.serve(t, "user:secret@"), "requests", ".fbf", common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(es.mapping, `"batch":   {"type": "keyword"}`) {
+		t.Fatalf("created with mapping %s", es.mapping)
+	}
+	batch := rf.Batch
+	ts := time.Date(2021, 3, 4, 5, 6, 7, 8, time.UTC)
+	for i := 0; i < 3; i++ {
+		if _, err = rf.Write(testRequest(fmt.Sprint(i), "/events", ts.UnixNano())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(es.bulks) != 0 {
+		t.Fatal("sent before flushing")
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(es.bulks) != 1 || len(es.bulks[0]) != 3 {
+		t.Fatalf("got bulks %+v", es.bulks)
+	}
+	doc := es.bulks[0][2]
+	if doc.ID != "2" || doc.Method != "POST" || doc.URI != "/events" || string(doc.Body) != "body of 2" ||
+		doc.Batch != batch || doc.Time == nil || !doc.Time.Equal(ts) ||
+		doc.Headers["Host"] != "example.com" || doc.Headers["X-A"] != "1, 2" {
+		t.Fatalf("got %+v", doc)
+	}
+	for _, auth := range es.auth {
+		if auth != "Basic dXNlcjpzZWNyZXQ=" {
+			t.Fatalf("got Authorization %q", auth)
+		}
+	}
+	files := rf.FinalizedFiles()
+	if details, ok := files[batch]; len(files) != 1 || !ok || details.ChunksWritten != 3 {
+		t.Fatalf("got %+v", files)
+	}
+}
+
+func TestIndexExists(t *testing.T) {
+
+	es := &fakeES{exists: true}
+	rf, err := NewArchive(es.serve(t, ""), "requests", ".fbf", common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if es.mapping != "" || len(es.bulks) != 0 {
+		t.Fatalf("created with %q, sent %d bulks", es.mapping, len(es.bulks))
+	}
+}
+
+// Any document that failed fails the flush, the others are indexed
+func TestBulkErrors(t *testing.T) {
+
+	es := &fakeES{exists: true}
+	rf, err := NewArchive(es.serve(t, ""), "requests", ".fbf", common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	for _, uri := range []string{"/a", "/fail", "/b"} {
+		rf.Write(testRequest(uri, uri, 0))
+	}
+	if err = rf.Flush(); err == nil || !strings.Contains(err.Error(), "1 of 3") {
+		t.Fatalf("got %v", err)
+	}
+	if len(es.bulks) != 1 || es.bulks[0][0].Time != nil {
+		t.Fatalf("got bulks %+v", es.bulks)
+	}
+}
@@ -0,0 +1,278 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package archive
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// FailoverArchive writes to a primary output directory (e.g. s3://) and
+// falls back to a secondary one (e.g. a local directory) when the primary
+// fails:
+//   - a file that could not be finalized (an upload failed) is stored in
+//     the secondary instead, as it was staged locally
+//   - after a failed write or flush, the file of the primary is left as it
+//     is (under its .tmp name, for recovery if it could not be closed) and
+//     writing goes on in a new file in the secondary
+//
+// Files that end up in the secondary have the error of the primary as their
+// Failover detail, in FinalizedFiles and OnFinalize. The primary is tried
+// again at every rotation.
+type FailoverArchive struct {
+	primary   string
+	secondary string
+	prefix    string
+	extension string
+	options   []func(*common.BasicArchive) error
+	ba        *common.BasicArchive                 // rows of the current file, and files moved to the secondary
+	rf        Archive                              // current archive, in either output
+	failed    error                                // why the primary failed, nil while writing to it
+	finalized map[string]common.ArchiveFileDetails // of archives replaced
+}
+
+// NewFailoverArchive creates an archive in `primary`, or in `secondary` if
+// that fails, both any URL supported by NewArchive, with the same options
+func NewFailoverArchive(primary, secondary, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *FailoverArchive, err error) {
+
+	ba, err := common.NewBasicArchive("", prefix, extension, options...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to initialize basic archive")
+	}
+	rf = &FailoverArchive{
+		primary:   primary,
+		secondary: secondary,
+		prefix:    prefix,
+		extension: extension,
+		options:   options,
+		ba:        ba,
+		finalized: make(map[string]common.ArchiveFileDetails)}
+
+	rf.rf, err = NewArchive(primary, prefix, extension, options...)
+	if err != nil {
+		err = rf.failOver(err, "", "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rf, nil
+}
+
+// failOver replaces the archive of the primary, which failed with `cause`,
+// by one in the secondary, and stores `staged`, a complete file of the
+// primary to be finalized as `name`, there if set
+func (rf *FailoverArchive) failOver(cause error, staged, name string) (err error) {
+
+	if rf.rf != nil {
+		name := rf.rf.Name()
+		if staged == "" {
+			rf.rf.Close() // most likely fails as well
+		}
+		rf.retire()
+		rf.ba.Logger.Warn("Primary output failed, switching to secondary",
+			zap.String("primary", rf.primary), zap.String("file", name),
+			zap.String("secondary", rf.secondary), zap.Error(cause))
+	}
+	rf.failed = cause
+	if staged != "" {
+		err = rf.store(staged, name)
+		if err != nil {
+			rf.ba.Logger.Error("Unable to store file in secondary, left for recovery",
+				zap.String("file", staged), zap.Error(err))
+		}
+	}
+	rf.rf, err = NewArchive(rf.secondary, rf.prefix, rf.extension,
+		append(rf.options, common.FailedOver(cause.Error()))...)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to create archive in secondary %s after: %v", rf.secondary, cause)
+	}
+	return nil
+}
+
+// store moves `staged`, the local file of a primary archive that could not
+// be finalized, to the secondary, and finalizes it there as `name` (see
+// common.FilenameTemplate), or under its staging name if empty
+func (rf *FailoverArchive) store(staged, name string) (err error) {
+
+	fi, err := os.Stat(staged)
+	if err != nil { // not a local file, or nothing left
+		return nil
+	}
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(staged), ".tmp")
+	}
+	finalPath := filepath.Join(filepath.Dir(staged), path.Base(name))
+	err = os.Rename(staged, finalPath)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to rename %s", staged)
+	}
+	dir := rf.secondary
+	if sub := path.Dir(name); sub != "." {
+		dir = strings.TrimRight(dir, "/") + "/" + sub
+	}
+	err = Store(finalPath, dir)
+	if err != nil {
+		os.Rename(finalPath, staged)
+		return err
+	}
+	os.Remove(finalPath)
+
+	rf.ba.Finalized(common.ArchiveFileDetails{
+		FileName:     name,
+		URL:          strings.TrimRight(rf.secondary, "/") + "/" + name,
+		BytesWritten: fi.Size(),
+		Failover:     rf.failed.Error(),
+	})
+	rf.ba.Reset()
+	return nil
+}
+
+// finalName is the name the current file of `a` is to be finalized under,
+// see common.FilenameTemplate, empty if unknown
+func finalName(a Archive) string {
+	if fn, ok := a.(interface{ FinalName() string }); ok {
+		return fn.FinalName()
+	}
+	return ""
+}
+
+// retire keeps what the current archive finalized, before it is replaced
+func (rf *FailoverArchive) retire() {
+	for name, details := range rf.rf.FinalizedFiles() {
+		rf.finalized[name] = details
+	}
+}
+
+// Write satisfies io.Writer interface. If writing to the primary fails,
+// `buf` is written to a new file in the secondary.
+func (rf *FailoverArchive) Write(buf []byte) (n int, err error) {
+
+	n, err = rf.rf.Write(buf)
+	if err == nil || rf.failed != nil {
+		return n, err
+	}
+	err = rf.failOver(err, "", "")
+	if err != nil {
+		return 0, err
+	}
+	rf.ba.Reset() // rows of the primary file are lost with it
+	return rf.rf.Write(buf)
+}
+
+// Read is not supported: read the archives written
+func (rf *FailoverArchive) Read(p []byte) (n int, err error) {
+	return 0, errors.New("Read not supported for failover outputs")
+}
+
+// Flush flushes the current file, going on in the secondary if the primary
+// fails
+func (rf *FailoverArchive) Flush() (err error) {
+
+	err = rf.rf.Flush()
+	if err == nil || rf.failed != nil {
+		return err
+	}
+	rf.ba.Reset()
+	return rf.failOver(err, "", "")
+}
+
+// Rotate finalizes the current file and starts a new one, back in the
+// primary if possible. A file of the primary that could not be finalized
+// is stored in the secondary.
+func (rf *FailoverArchive) Rotate() (err error) {
+
+	if rf.failed != nil {
+		primary, perr := NewArchive(rf.primary, rf.prefix, rf.extension, rf.options...)
+		if perr != nil {
+			rf.ba.Logger.Debug("Primary output still failing", zap.Error(perr))
+			rf.ba.Reset()
+			return rf.rf.Rotate()
+		}
+		err = rf.rf.Close()
+		rf.retire()
+		rf.ba.Reset()
+		rf.rf, rf.failed = primary, nil
+		rf.ba.Logger.Info("Switched back to primary output", zap.String("file", rf.rf.Name()))
+		return err
+	}
+
+	staged, name := rf.rf.Name(), finalName(rf.rf)
+	err = rf.rf.Rotate()
+	if err == nil {
+		rf.ba.Reset()
+		return nil
+	}
+	return rf.failOver(err, staged, name)
+}
+
+// Close finalizes the current file. A file of the primary that could not
+// be finalized is stored in the secondary.
+func (rf *FailoverArchive) Close() (err error) {
+
+	staged, name := rf.rf.Name(), finalName(rf.rf)
+	err = rf.rf.Close()
+	if err == nil || rf.failed != nil {
+		rf.ba.Reset()
+		return err
+	}
+	rf.failed = err
+	rf.retire()
+	rf.ba.Logger.Warn("Primary output failed, storing file in secondary",
+		zap.String("primary", rf.primary), zap.String("file", staged),
+		zap.String("secondary", rf.secondary), zap.Error(err))
+	err = rf.store(staged, name)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to store %s in secondary %s after: %v", staged, rf.secondary, rf.failed)
+	}
+	return nil
+}
+
+// AddRows counts rows in the current archive, if it keeps count of them
+func (rf *FailoverArchive) AddRows(n int64) {
+	rf.ba.AddRows(n)
+	if rc, ok := rf.rf.(interface{ AddRows(int64) }); ok {
+		rc.AddRows(n)
+	}
+}
+
+// RowsLeft is that of the current archive (see common.MaxRows), -1 if it
+// has no row limit
+func (rf *FailoverArchive) RowsLeft() int64 {
+	if rl, ok := rf.rf.(interface{ RowsLeft() int64 }); ok {
+		return rl.RowsLeft()
+	}
+	return -1
+}
+
+// Name is the name of the current file, in either output
+func (rf *FailoverArchive) Name() string {
+	return rf.rf.Name()
+}
+
+// FinalizedFiles lists the files finalized in both outputs
+func (rf *FailoverArchive) FinalizedFiles() map[string]common.ArchiveFileDetails {
+
+	files := make(map[string]common.ArchiveFileDetails)
+	for _, m := range []map[string]common.ArchiveFileDetails{rf.finalized, rf.ba.FinalizedFiles(), rf.rf.FinalizedFiles()} {
+		for name, details := range m {
+			files[name] = details
+		}
+	}
+	return files
+}
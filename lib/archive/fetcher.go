@@ -0,0 +1,156 @@
+// Package archive provides functionality to read and write to an archive file that
+// is written to local, azure blob store, amazon s3 or google cloud storage.
+//
+// Features include
+//  1. Ability to maintain the file as a temporary `.tmp`
+//     until it is `.Close()`-ed at which point it is automatically
+//     renamed to the final name
+//  2. Ability to keep file as a local file until uploaded to S3 or AZ Blob
+//     NOTE: direct streaming upload to S3/AZ is not yet performant.
+//  3. Ability to specify local,s3,az,adls,gs,sftp,hdfs all in a unified URL format
+//     s3://bucket/path/to/diretory/
+//     az://containers/path/to/directory/
+//     adls://account/filesystem/path/to/directory
+//     gs://bucket/path/to/directory/
+//     sftp://user@host/path/to/directory
+//     hdfs://namenode/path/to/directory
+
+package archive
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/pkg/errors"
+)
+
+// Fetcher downloads remote archives ahead of their use, up to `ahead` of them
+// in parallel, in the order given. Replaying a day of captures from S3 then
+// downloads the next archives while one is replayed, instead of one after the
+// other. Local archives are not copied.
+type Fetcher struct {
+	fetches map[string]*fetch
+	slots   chan struct{} // taken by a download until its archive is opened
+	stop    chan struct{}
+	ctx     context.Context // of the downloads, cancelled by Close
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+}
+
+type fetch struct {
+	srcFile   string
+	started   bool
+	slot      bool // holds one of Fetcher.slots
+	done      chan struct{}
+	localPath string
+	temporary bool
+	err       error
+}
+
+// NewFetcher starts downloading the remote ones of `files`, up to `ahead` at
+// a time. A download keeps its slot until the archive is opened with Open, so
+// no more than `ahead` archives wait on local disk.
+func NewFetcher(files []string, ahead int) (f *Fetcher) {
+
+	if ahead <= 0 {
+		ahead = 1
+	}
+	f = &Fetcher{
+		fetches: make(map[string]*fetch),
+		slots:   make(chan struct{}, ahead),
+		stop:    make(chan struct{}),
+	}
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	var queue []*fetch
+	for _, srcFile := range files {
+		if IsLocal(srcFile) || f.fetches[srcFile] != nil {
+			continue
+		}
+		ft := &fetch{srcFile: srcFile, done: make(chan struct{})}
+		f.fetches[srcFile] = ft
+		queue = append(queue, ft)
+	}
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for _, ft := range queue {
+			select {
+			case f.slots <- struct{}{}:
+			case <-f.stop:
+				return
+			}
+			f.mu.Lock()
+			if ft.started { // Open got there first
+				f.mu.Unlock()
+				<-f.slots
+				continue
+			}
+			ft.started, ft.slot = true, true
+			f.mu.Unlock()
+			f.wg.Add(1)
+			go func(ft *fetch) {
+				defer f.wg.Done()
+				ft.localPath, ft.temporary, ft.err = fetchLocal(f.ctx, ft.srcFile)
+				close(ft.done)
+			}(ft)
+		}
+	}()
+	return f
+}
+
+// Open opens an archive file for read, like OpenArchive, waiting for its
+// download if it is one of the files of the Fetcher.
+func (f *Fetcher) Open(fileName string, bufferSize int) (rf Archive, err error) {
+
+	f.mu.Lock()
+	ft := f.fetches[fileName]
+	if ft == nil {
+		f.mu.Unlock()
+		return OpenArchive(fileName, bufferSize)
+	}
+	delete(f.fetches, fileName) // opened once, like any archive
+	fetchNow := !ft.started
+	ft.started = true
+	f.mu.Unlock()
+
+	if fetchNow { // not queued yet: opened out of order
+		ft.localPath, ft.temporary, ft.err = fetchLocal(f.ctx, ft.srcFile)
+		close(ft.done)
+	}
+	<-ft.done
+	if ft.slot {
+		<-f.slots
+	}
+	if ft.err != nil {
+		return nil, errors.Wrapf(ft.err, "Unable to fetch %s", fileName)
+	}
+	rfi, err := common.OpenArchive(ft.localPath, bufferSize, ft.temporary)
+	if err != nil {
+		if ft.temporary {
+			os.Remove(ft.localPath)
+		}
+		return nil, err
+	}
+	return rfi, nil
+}
+
+// Close stops downloading, cancelling the downloads in progress, and removes
+// the downloads that were not opened
+func (f *Fetcher) Close() {
+
+	close(f.stop)
+	f.cancel()
+	f.wg.Wait()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ft := range f.fetches {
+		if ft.started && ft.err == nil && ft.temporary {
+			os.Remove(ft.localPath)
+		}
+	}
+	f.fetches = nil
+}
@@ -14,7 +14,9 @@ governing permissions and limitations under the License.
 package file
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path"
@@ -77,15 +79,20 @@ func (rf *FileArchive) finalizeArchive() (finalFile common.ArchiveFileDetails, e
 		return finalFile, err
 	}
 
-	finalPath := strings.TrimSuffix(filePath, ".tmp")
+	finalPath := filepath.Join(filepath.Dir(filePath), filepath.FromSlash(rf.FinalName()))
+	err = os.MkdirAll(filepath.Dir(finalPath), 0755) // see FilenameTemplate
+	if err != nil {
+		err = errors.Wrapf(err, "unable to create directory for archive file: %s", finalPath)
+		return finalFile, err
+	}
 	err = os.Rename(filePath, finalPath)
 	if err != nil {
 		err = errors.Wrapf(err, "unable to rename archive file: %s", filePath)
 		return finalFile, err
 	}
-	finalFile.FileName = path.Base(finalPath) // Only filename part
+	finalFile.FileName = rf.FinalName() // with the directories of FilenameTemplate, if any
+	finalFile.URL, _ = filepath.Abs(finalPath)
 	finalFile.BytesWritten = fi.Size()
-	finalFile.FileName = path.Base(finalPath) // Only filename part
 	finalFile.ChunksWritten = rf.ChunksWritten
 
 	rf.Logger.Info("Renamed",
@@ -102,12 +109,32 @@ func (rf *FileArchive) finalizeArchive() (finalFile common.ArchiveFileDetails, e
 		err = errors.Wrapf(err, "unable to chmod archive file: %s", finalPath)
 		return finalFile, err
 	}
+	rf.StoreIndex(func(indexPath string) error {
+		return os.Rename(indexPath, finalPath+common.IndexExt)
+	})
 
 	return finalFile, nil
 }
 
 func List(dir string) (files []string, err error) {
 
+	entries, err := ListDetails(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		files = append(files, entry.Name)
+	}
+	return files, err
+}
+
+// ListDetails is like List, but includes size and modification time. Files
+// of subdirectories are listed too, with their path relative to `dir`, in
+// slash form like object keys of s3 or az (e.g. "2021/03/02/requests_1.fbf"):
+// directories themselves are not.
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+
+	dir = strings.TrimPrefix(dir, "file://")
 	err = filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			fmt.Printf("ERROR: %s: %+v\n", path, err)
@@ -119,35 +146,110 @@ func List(dir string) (files []string, err error) {
 			return nil // Skipping weird directories
 		}
 		if !info.IsDir() {
-			files = append(files, relPath)
+			entries = append(entries, common.ArchiveEntry{
+				Name:    filepath.ToSlash(relPath),
+				Size:    info.Size(),
+				ModTime: info.ModTime()})
 		}
-
-		/* this is better code to include sub-directories
-		 * but they are a bit more work to support.
-		 *
-		 * For now, we don't need to list or remove sub-directories
-
-		// fmt.Printf("path = >%s<, relpath=>%s<\n", path, relPath)
-		if relPath != "" && relPath != "." {
-			// add all subdirectories except the root directory
-			files = append(files, relPath)
-		}
-		*/
 		return nil
 	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "list directory failed for: %s", dir)
 	}
-	return files, err
+	return entries, err
 }
 
+// Delete removes files of `dir`, named as returned by List, or whole
+// subdirectories of it (e.g. "2021/03/01" of a date-partitioned layout).
+// Directories left empty by the removal are removed as well, up to `dir`
+// itself, which is kept. Files already gone aren't an error.
 func Delete(dir string, files []string) (err error) {
+
+	dir = filepath.Clean(strings.TrimPrefix(dir, "file://"))
 	for _, file := range files {
-		err = os.Remove(path.Join(dir, file))
+		name := filepath.Clean(filepath.FromSlash(file))
+		if name == "." || filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return errors.Errorf("Can't delete %s: not inside %s", file, dir)
+		}
+		fullPath := filepath.Join(dir, name)
+		err = os.RemoveAll(fullPath)
 		if err != nil {
-			fmt.Printf("ERROR: Can't delete %s: %+v", file, err)
-			return nil
+			return errors.Wrapf(err, "Can't delete %s", file)
+		}
+		removeEmptyParents(dir, filepath.Dir(fullPath))
+	}
+	return nil
+}
+
+// removeEmptyParents removes directory `sub` of `dir` and its parents, up to
+// `dir` excluded, as long as they are empty
+func removeEmptyParents(dir, sub string) {
+	for {
+		rel, err := filepath.Rel(dir, sub)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return
+		}
+		if os.Remove(sub) != nil { // not empty, most likely
+			return
 		}
+		sub = filepath.Dir(sub)
+	}
+}
+
+// Fetch returns a local path to read fileName from. For local files
+// this is the file itself, so `temporary` is always false.
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return strings.TrimPrefix(fileName, "file://"), false, nil
+}
+
+// Stat returns the size, modification time, record count and checksum of an
+// archive file, see common.StatArchive
+func Stat(fileName string) (st common.ArchiveStat, err error) {
+
+	st, err = common.StatArchive(context.Background(), strings.TrimPrefix(fileName, "file://"),
+		common.StatLocal, common.ReadLocalRange)
+	st.Name = fileName
+	return st, err
+}
+
+// Store copies the local file into directory `dir` keeping the same
+// base name. The copy is made under a `.tmp` name and renamed only
+// once it is complete.
+func Store(localPath, dir string) (err error) {
+
+	dir = strings.TrimPrefix(dir, "file://")
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create directory %s", dir)
+	}
+
+	src, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open %s", localPath)
+	}
+	defer src.Close()
+
+	finalPath := path.Join(dir, path.Base(localPath))
+	tmpPath := finalPath + ".tmp"
+	dst, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create %s", tmpPath)
+	}
+
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrapf(err, "unable to copy %s to %s", localPath, tmpPath)
+	}
+
+	err = os.Rename(tmpPath, finalPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to rename %s", tmpPath)
 	}
-	return err
+	return nil
 }
@@ -0,0 +1,142 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testTree creates `files` (relative, slash separated) in a new directory,
+// with a sibling directory holding a file too, and returns the directory
+func testTree(t *testing.T, files ...string) (dir string) {
+
+	root, err := ioutil.TempDir("", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	dir = filepath.Join(root, "captures")
+	for _, name := range append(files, "../captures-old/kept.fbf", "../kept.fbf") {
+		fileName := filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(fileName, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// listed is what ListDetails has of `dir`, sorted
+func listed(t *testing.T, dir string) (names []string) {
+	entries, err := ListDetails(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDelete(t *testing.T) {
+
+	files := []string{"a.fbf", "b.fbf", "2021/03/01/c.fbf", "2021/03/02/d.fbf"}
+	tests := []struct {
+		name   string
+		delete []string
+		left   []string
+		ok     bool
+	}{
+		{"none", nil, files, true},
+		{"one", []string{"a.fbf"}, []string{"2021/03/01/c.fbf", "2021/03/02/d.fbf", "b.fbf"}, true},
+		{"listed name", []string{"2021/03/01/c.fbf"}, []string{"2021/03/02/d.fbf", "a.fbf", "b.fbf"}, true},
+		{"directory", []string{"2021/03"}, []string{"a.fbf", "b.fbf"}, true},
+		{"already gone", []string{"missing.fbf", "a.fbf"}, []string{"2021/03/01/c.fbf", "2021/03/02/d.fbf", "b.fbf"}, true},
+		{"inside after all", []string{"2021/../a.fbf"}, []string{"2021/03/01/c.fbf", "2021/03/02/d.fbf", "b.fbf"}, true},
+		{"parent", []string{".."}, files, false},
+		{"sibling", []string{"../kept.fbf"}, files, false},
+		{"sibling directory", []string{"../captures-old"}, files, false},
+		{"through a subdirectory", []string{"2021/../../kept.fbf"}, files, false},
+		{"itself", []string{"."}, files, false},
+		{"empty name", []string{""}, files, false},
+		{"absolute", []string{"/etc/passwd"}, files, false},
+		{"stops at the first refused", []string{"a.fbf", "../kept.fbf", "b.fbf"},
+			[]string{"2021/03/01/c.fbf", "2021/03/02/d.fbf", "b.fbf"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testTree(t, files...)
+			err := Delete("file://"+dir, tt.delete)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %v", err)
+			}
+			want := append([]string(nil), tt.left...)
+			sort.Strings(want)
+			if got := listed(t, dir); !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %q left, want %q", got, want)
+			}
+			for _, kept := range []string{"../kept.fbf", "../captures-old/kept.fbf"} {
+				if _, err := os.Stat(filepath.Join(dir, kept)); err != nil {
+					t.Fatalf("%s deleted", kept)
+				}
+			}
+			if _, err := os.Stat(dir); err != nil {
+				t.Fatalf("directory deleted: %v", err)
+			}
+		})
+	}
+}
+
+// Directories left empty are removed, up to the directory deleted from
+func TestDeleteEmptyParents(t *testing.T) {
+
+	dir := testTree(t, "2021/03/01/c.fbf", "2021/04/01/d.fbf")
+	if err := Delete(dir, []string{"2021/03/01/c.fbf"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2021", "03")); !os.IsNotExist(err) {
+		t.Fatalf("empty directory left: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2021", "04", "01")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete(dir, []string{"2021/04/01/d.fbf"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := listed(t, dir); len(got) != 0 {
+		t.Fatalf("got %q left", got)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("directory deleted: %v", err)
+	}
+}
+
+// Names are relative to the directory listed, slash separated
+func TestListDetails(t *testing.T) {
+
+	dir := testTree(t, "a.fbf", "2021/03/01/c.fbf")
+	want := []string{"2021/03/01/c.fbf", "a.fbf"}
+	for _, d := range []string{dir, "file://" + dir, dir + "/"} {
+		if got := listed(t, d); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %q, want %q", d, got, want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package file
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/pkg/errors"
+)
+
+// MappedArchive reads a local, uncompressed archive through a read-only
+// memory mapping. Next hands out slices of the mapping instead of copying
+// into buffers; they are valid until Close.
+type MappedArchive struct {
+	name    string
+	mapping []byte // the whole file
+	data    []byte // what is read of it, without a checksum footer
+	off     int
+}
+
+// OpenMapped maps an archive file for reading. The file must not be
+// compressed (that is up to the caller, files found to be compressed anyway
+// are refused), nor be written to while mapped. A checksum footer is checked,
+// and left out of what is read.
+func OpenMapped(fileName string) (rf *MappedArchive, err error) {
+
+	fileName = strings.TrimPrefix(fileName, "file://")
+	fp, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error opening file %s", fileName)
+	}
+	defer fp.Close() // the mapping stays valid
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to stat file %s", fileName)
+	}
+	dataLen, err := common.VerifyFooter(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	rf = &MappedArchive{name: fileName}
+	if fi.Size() > 0 { // empty files can't be mapped, and have nothing to read
+		rf.mapping, err = mmap(fp, fi.Size())
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to map %s", fileName)
+		}
+		rf.data = rf.mapping[:dataLen]
+		if ext := common.SniffCompression(rf.data); ext != "" {
+			rf.Close()
+			return nil, errors.Errorf("Unable to map %s: compressed (%s)", fileName, ext)
+		}
+	}
+	return rf, nil
+}
+
+// Next returns the next `n` bytes, as a slice of the mapping. io.EOF if
+// there are none left, io.ErrUnexpectedEOF if fewer than `n`.
+func (rf *MappedArchive) Next(n int) ([]byte, error) {
+
+	left := len(rf.data) - rf.off
+	if left == 0 {
+		return nil, io.EOF
+	}
+	if left < n {
+		rf.off = len(rf.data)
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := rf.data[rf.off : rf.off+n : rf.off+n]
+	rf.off += n
+	return b, nil
+}
+
+// Read satisfies io.Reader, for readers that don't use Next
+func (rf *MappedArchive) Read(p []byte) (n int, err error) {
+
+	if rf.off == len(rf.data) {
+		return 0, io.EOF
+	}
+	n = copy(p, rf.data[rf.off:])
+	rf.off += n
+	return n, nil
+}
+
+// Skip skips `n` bytes, see archive.SkipTo
+func (rf *MappedArchive) Skip(n int64) error {
+
+	if n < 0 || n > int64(len(rf.data)-rf.off) {
+		return errors.Errorf("Unable to skip %d bytes of %s: out of the file", n, rf.name)
+	}
+	rf.off += int(n)
+	return nil
+}
+
+func (rf *MappedArchive) Write(buf []byte) (int, error) {
+	return 0, errors.New("file is not opened for write")
+}
+
+func (rf *MappedArchive) Rotate() (err error) {
+	return errors.New("file is not opened for write")
+}
+
+func (rf *MappedArchive) Flush() (err error) {
+	return nil
+}
+
+func (rf *MappedArchive) Name() string {
+	return rf.name
+}
+
+func (rf *MappedArchive) FinalizedFiles() map[string]common.ArchiveFileDetails {
+	return nil
+}
+
+// Close unmaps the file. Slices returned by Next must not be used anymore.
+// Can be called more than once.
+func (rf *MappedArchive) Close() (err error) {
+
+	if rf.mapping == nil {
+		return nil
+	}
+	err = munmap(rf.mapping)
+	rf.mapping, rf.data, rf.off = nil, nil, 0
+	if err != nil {
+		return errors.Wrapf(err, "Unable to unmap %s", rf.name)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package file
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func mmap(fp *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("memory mapped archives are not supported on windows")
+}
+
+func munmap(b []byte) error {
+	return nil
+}
@@ -0,0 +1,247 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package firehose provides archive interface for AWS Kinesis Firehose
+// delivery streams. Nothing is written to files: every request written to
+// the archive is put as one record, the request frame as in archive files
+// (uncompressed, without file header). Firehose concatenates records, so
+// the objects it delivers to S3 are archives that replay reads as they are.
+package firehose
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/archive/s3f"
+	"github.com/adobe/blackhole/lib/frame"
+	fh "github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// PutRecordBatch limits
+const (
+	maxBatchRecords = 500
+	maxBatchBytes   = 4 * 1024 * 1024
+	maxRecordBytes  = 1000 * 1024
+)
+
+// apiTimeout bounds one PutRecordBatch call, retries of the SDK included
+const apiTimeout = 30 * time.Second
+
+// Records that failed (throttling, service errors) are sent again up to
+// maxAttempts times in all, waiting from minBackoff, doubled every attempt,
+// up to maxBackoff. Batches that fail as a whole are retried by the SDK.
+const (
+	maxAttempts = 8
+	minBackoff  = 100 * time.Millisecond
+	maxBackoff  = 5 * time.Second
+)
+
+var gFirehoseSession struct {
+	sync.Mutex // Used only for writing. Not for reading
+	client     *fh.Client
+}
+
+var firehoseUrlRegex = regexp.MustCompile("^firehose://([^/]+)/?$")
+
+type FirehoseArchive struct {
+	common.Publisher
+	stream    string
+	pending   []types.Record
+	pendBytes int
+	dropped   int64 // too large to put, since the archive was created
+}
+
+// firehoseInit creates the client, with the AWS config of s3:// archives
+func firehoseInit(ctx context.Context) (err error) {
+	gFirehoseSession.Lock() // gFirehoseSession is goroutine safe only after it has been instantiated
+	defer gFirehoseSession.Unlock()
+	if gFirehoseSession.client == nil {
+		ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+		defer cancel()
+		cfg, err := s3f.LoadConfig(ctx)
+		if err != nil {
+			return err
+		}
+		if cfg.Region == "" {
+			return errors.New("No aws region configured for firehose")
+		}
+		gFirehoseSession.client = fh.NewFromConfig(cfg)
+	}
+	return err
+}
+
+// parseFirehoseURL returns the delivery stream of firehose://stream
+func parseFirehoseURL(firehoseURL string) (stream string, err error) {
+
+	parts := firehoseUrlRegex.FindStringSubmatch(firehoseURL)
+	if len(parts) != 2 {
+		return "", errors.Errorf("Unable to parse firehose url format (firehose://stream-name): %s", firehoseURL)
+	}
+	return parts[1], nil
+}
+
+// NewArchive creates a new archive putting records to a delivery stream.
+// `outDir` is firehose://stream-name; the profile, region and role are those
+// of the S3 backend (see archive.SetS3Credentials). Rotate puts what is pending and starts a
+// new batch, which stands for a file in FinalizedFiles and OnFinalize.
+// The caller must call `rf.Close()` to put what is left.
+func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *FirehoseArchive, err error) {
+
+	stream, err := parseFirehoseURL(outDir)
+	if err != nil {
+		return nil, err
+	}
+	p, err := common.NewPublisher("firehose://"+stream, "firehose", prefix, extension, options...)
+	if err != nil {
+		return nil, err
+	}
+	err = firehoseInit(p.Context())
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to initialize firehose connection")
+	}
+
+	rf = &FirehoseArchive{Publisher: *p, stream: stream}
+	rf.Frames.OnRequest = rf.add
+	rf.OnFlush = rf.put
+
+	err = rf.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return rf, err
+}
+
+// OpenArchive is not supported: read what Firehose delivered instead
+func OpenArchive(fileName string, bufferSize int) (rf *FirehoseArchive, err error) {
+	return nil, common.NotSupported("Reading", "firehose streams", fileName)
+}
+
+// Fetch is not supported, see OpenArchive
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return "", false, common.NotSupported("Reading", "firehose streams", fileName)
+}
+
+// Store puts the requests of a local archive file (compressed or not) to
+// the delivery stream of `dir`
+func Store(localPath, dir string) (err error) {
+
+	rf, err := NewArchive(dir, "", "", common.Logger(common.DefaultLogger))
+	if err != nil {
+		return err
+	}
+	return rf.Store(localPath)
+}
+
+func List(dir string) (files []string, err error) {
+	return nil, common.NotSupported("Listing", "firehose streams", dir)
+}
+
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+	return nil, common.NotSupported("Listing", "firehose streams", dir)
+}
+
+func Delete(dir string, files []string) (err error) {
+	return common.NotSupported("Deleting", "firehose streams", dir)
+}
+
+// add queues a request as a frame record, putting the batch when full
+func (rf *FirehoseArchive) add(payload []byte) (err error) {
+
+	size := frame.PrefixLen + frame.CRCLen + len(payload)
+	if size > maxRecordBytes {
+		rf.dropped++
+		rf.Logger.Warn("Request too large for firehose, dropped",
+			zap.String("stream", rf.stream), zap.Int("bytes", size),
+			zap.Int64("dropped", rf.dropped))
+		return nil
+	}
+	if len(rf.pending) == maxBatchRecords || rf.pendBytes+size > maxBatchBytes {
+		err = rf.put()
+		if err != nil {
+			return err
+		}
+	}
+	data := make([]byte, size)
+	n := frame.PutPrefixCRC(data, payload, 0)
+	copy(data[n:], payload)
+	rf.pending = append(rf.pending, types.Record{Data: data})
+	rf.pendBytes += size
+	return nil
+}
+
+// put sends pending records, sending those that failed again with backoff
+func (rf *FirehoseArchive) put() (err error) {
+
+	records := rf.pending
+	backoff := minBackoff
+	for attempt := 1; len(records) > 0; attempt++ {
+		failed, err := rf.putRecordBatch(records)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to put %d requests to %s", len(records), rf.URL)
+		}
+		if len(failed) == 0 {
+			break
+		}
+		if attempt == maxAttempts {
+			return errors.Errorf("Unable to put %d requests to %s after %d attempts", len(failed), rf.URL, attempt)
+		}
+		rf.Logger.Debug("Putting records again",
+			zap.String("stream", rf.stream), zap.Int("failed", len(failed)),
+			zap.Int("attempt", attempt))
+		retry := make([]types.Record, 0, len(failed))
+		for _, i := range failed {
+			retry = append(retry, records[i])
+		}
+		records = retry
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+
+	rf.Published(len(rf.pending), rf.pendBytes)
+	for i := range rf.pending {
+		rf.pending[i] = types.Record{} // don't hold on to records put
+	}
+	rf.pending = rf.pending[:0]
+	rf.pendBytes = 0
+	return nil
+}
+
+// putRecordBatch sends records to the delivery stream. Returns the indexes
+// of the records that failed, to be sent again.
+func (rf *FirehoseArchive) putRecordBatch(records []types.Record) (failed []int, err error) {
+
+	ctx, cancel := context.WithTimeout(rf.Context(), apiTimeout)
+	defer cancel()
+	out, err := gFirehoseSession.client.PutRecordBatch(ctx, &fh.PutRecordBatchInput{
+		DeliveryStreamName: &rf.stream,
+		Records:            records,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.FailedPutCount != nil && *out.FailedPutCount > 0 {
+		for i, r := range out.RequestResponses {
+			if r.ErrorCode != nil {
+				failed = append(failed, i)
+			}
+		}
+	}
+	return failed, nil
+}
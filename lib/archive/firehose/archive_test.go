@@ -0,0 +1,186 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package firehose
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/frame"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	fh "github.com/aws/aws-sdk-go-v2/service/firehose"
+	"go.uber.org/zap"
+)
+
+// testFrame is a frame of `payload`
+func testFrame(payload string) []byte {
+	buf := make([]byte, frame.PrefixLen, frame.PrefixLen+len(payload))
+	frame.PutPrefix(buf, len(payload), 0)
+	return append(buf, payload...)
+}
+
+// fakeFirehose answers PutRecordBatch requests, recording the payloads of
+// each, and failing records of a "fail" payload the first time
+type fakeFirehose struct {
+	mu      sync.Mutex
+	stream  string
+	batches [][]string
+	failed  bool
+}
+
+func (f *fakeFirehose) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if target := r.Header.Get("X-Amz-Target"); target != "Firehose_20150804.PutRecordBatch" {
+		http.Error(w, "unexpected request "+target, http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		DeliveryStreamName string
+		Records            []struct{ Data []byte }
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.DeliveryStreamName != f.stream {
+		http.Error(w, fmt.Sprintf("bad request to %s: %v", req.DeliveryStreamName, err), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var payloads, responses []string
+	failed := 0
+	for _, rec := range req.Records {
+		payloadLen, flags := frame.ParsePrefix(rec.Data)
+		if flags != frame.FlagCRC || len(rec.Data) != frame.PrefixLen+frame.CRCLen+payloadLen {
+			http.Error(w, fmt.Sprintf("bad record %q", rec.Data), http.StatusBadRequest)
+			return
+		}
+		payload := string(rec.Data[frame.PrefixLen+frame.CRCLen:])
+		payloads = append(payloads, payload)
+		if payload == "fail" && !f.failed {
+			f.failed = true
+			failed++
+			responses = append(responses, `{"ErrorCode":"ServiceUnavailableException","ErrorMessage":"Slow down."}`)
+		} else {
+			responses = append(responses, `{"RecordId":"1"}`)
+		}
+	}
+	f.batches = append(f.batches, payloads)
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	fmt.Fprintf(w, `{"Encrypted":false,"FailedPutCount":%d,"RequestResponses":[%s]}`, failed, strings.Join(responses, ","))
+}
+
+// withFakeFirehose has the client send its requests to `f` for the test
+func withFakeFirehose(t *testing.T, f *fakeFirehose) {
+
+	srv := httptest.NewServer(f)
+	client := fh.New(fh.Options{
+		Region:           "us-east-1",
+		Credentials:      aws.NewCredentialsCache(aws.CredentialsProviderFunc(testCredentials)),
+		EndpointResolver: fh.EndpointResolverFromURL(srv.URL),
+	})
+	gFirehoseSession.Lock()
+	saved := gFirehoseSession.client
+	gFirehoseSession.client = client
+	gFirehoseSession.Unlock()
+	t.Cleanup(func() {
+		srv.Close()
+		gFirehoseSession.Lock()
+		gFirehoseSession.client = saved
+		gFirehoseSession.Unlock()
+	})
+}
+
+func testCredentials(ctx context.Context) (aws.Credentials, error) {
+	return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+}
+
+func TestParseFirehoseURL(t *testing.T) {
+
+	tests := []struct {
+		url, stream string
+		err         bool
+	}{
+		{"firehose://captures", "captures", false},
+		{"firehose://captures/", "captures", false},
+		{"firehose://", "", true},
+		{"firehose://captures/sub", "", true},
+		{"s3://captures", "", true},
+	}
+	for _, tt := range tests {
+		if stream, err := parseFirehoseURL(tt.url); stream != tt.stream || (err != nil) != tt.err {
+			t.Fatalf("%s: got %q, %v", tt.url, stream, err)
+		}
+	}
+}
+
+// Records are put in batches of up to maxBatchRecords, as CRC frames
+func TestPut(t *testing.T) {
+
+	f := &fakeFirehose{stream: "captures"}
+	withFakeFirehose(t, f)
+	rf, err := NewArchive("firehose://captures", "requests", ".fbf", common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := rf.Batch
+	var stream bytes.Buffer
+	for i := 0; i < maxBatchRecords+100; i++ {
+		stream.Write(testFrame(fmt.Sprint(i)))
+	}
+	for stream.Len() > 0 { // in writes cutting frames
+		if _, err = rf.Write(stream.Next(7)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.batches) != 2 || len(f.batches[0]) != maxBatchRecords || len(f.batches[1]) != 100 ||
+		f.batches[0][0] != "0" || f.batches[1][99] != fmt.Sprint(maxBatchRecords+99) {
+		t.Fatalf("got %d batches", len(f.batches))
+	}
+	files := rf.FinalizedFiles()
+	if details, ok := files[batch]; len(files) != 1 || !ok || details.ChunksWritten != maxBatchRecords+100 {
+		t.Fatalf("got %+v", files)
+	}
+}
+
+// Records that failed are put again, the others are not; requests too
+// large for a record are dropped
+func TestPutAgain(t *testing.T) {
+
+	f := &fakeFirehose{stream: "captures"}
+	withFakeFirehose(t, f)
+	rf, err := NewArchive("firehose://captures", "requests", ".fbf", common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"a", "fail", strings.Repeat("x", maxRecordBytes), "b"} {
+		if _, err = rf.Write(testFrame(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(f.batches) != "[[a fail b] [fail]]" || rf.dropped != 1 {
+		t.Fatalf("got batches %q, %d dropped", f.batches, rf.dropped)
+	}
+}
@@ -0,0 +1,346 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package gcs provides archive interface for Google Cloud Storage
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+)
+
+var gGCSSession struct {
+	sync.Mutex // Used only for writing. Not for reading
+	client     *storage.Client
+}
+
+var gcsUrlRegex = regexp.MustCompile("([^/:]+)://([^/]+)/(.*?)$")
+
+type GCSArchive struct {
+	common.BasicArchive
+	bucketName string
+	contSubDir string
+}
+
+// gcsInit creates the client shared by all archives. Credentials are the
+// application default ones: GOOGLE_APPLICATION_CREDENTIALS, gcloud's, or those
+// of the GCE/GKE service account (workload identity)
+func gcsInit() (err error) {
+	gGCSSession.Lock() // gGCSSession is goroutine safe only after it has been instantiated
+	defer gGCSSession.Unlock()
+	if gGCSSession.client == nil {
+		client, err := storage.NewClient(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "Unable to create gcs client with application default credentials")
+		}
+		gGCSSession.client = client
+	}
+	return err
+}
+
+// NewArchive creates a new recorder file (for writing). The caller must call
+// `rf.Close()` on the resulting handle to close out the file.
+// File is uploaded to gcs after it is flushed to disk and file is closed.
+// `*GCSArchive` returned is an io.Writer
+func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *GCSArchive, err error) {
+
+	err = gcsInit()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to initialize gcs connection")
+	}
+
+	bucketName, subDir, err := parseGCSURL(outDir)
+	if err != nil {
+		return nil, err
+	}
+	ba, err := common.NewBasicArchive(
+		"", prefix, extension, options...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to initialize basic archive")
+	}
+
+	rf = &GCSArchive{BasicArchive: *ba,
+		bucketName: bucketName,
+		contSubDir: subDir}
+	rf.Finalizer = rf.finalizeArchive
+
+	err = rf.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return rf, err
+}
+
+// parseGCSURL splits gs://bucket/some/path into bucket and path
+func parseGCSURL(gcsURL string) (bucketName, objPath string, err error) {
+
+	parts := gcsUrlRegex.FindStringSubmatch(gcsURL)
+	if len(parts) != 4 { // must be exactly 4 parts
+		return "", "", errors.Errorf("Unable to parse gcs url format: %s", gcsURL)
+	}
+	return parts[2], parts[3], nil
+}
+
+// download downloads a gcs object to a new local temporary file
+func download(ctx context.Context, bucketName, filePath string, logger *zap.Logger) (localPath string, err error) {
+
+	fp, err := ioutil.TempFile("", fmt.Sprintf("tmp_*_%s", path.Base(filePath)))
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to create temp file")
+	}
+	defer fp.Close()
+
+	logger.Debug("GCS Download [BEGIN]",
+		zap.String("remote", filePath),
+		zap.String("local", fp.Name()))
+
+	or, err := gGCSSession.client.Bucket(bucketName).Object(filePath).NewReader(ctx)
+	if err == nil {
+		_, err = io.Copy(fp, or)
+		or.Close()
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return "", errors.Wrapf(err, "unable to download archive file: %s", filePath)
+	}
+
+	logger.Debug("GCS Download [END]",
+		zap.String("remote", filePath),
+		zap.String("local", fp.Name()))
+
+	return fp.Name(), nil
+}
+
+// upload uploads a local file to gcs under bucketName/remotePath
+func upload(ctx context.Context, localPath, bucketName, remotePath string, logger *zap.Logger) (err error) {
+
+	fp, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to reopen archive file: %s", localPath)
+	}
+	defer fp.Close()
+
+	logger.Debug("GCS Upload [BEGIN]",
+		zap.String("local", localPath),
+		zap.String("remote", remotePath))
+
+	// The writer sends the object in chunks (resumable upload). Canceling
+	// the context, not Close, is what aborts it
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ow := gGCSSession.client.Bucket(bucketName).Object(remotePath).NewWriter(ctx)
+	ow.ContentType = "application/octet-stream"
+	_, err = io.Copy(ow, fp)
+	if err == nil {
+		err = ow.Close()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to upload archive file: %s", remotePath)
+	}
+
+	logger.Info("GCS Upload [END]",
+		zap.String("local", localPath),
+		zap.String("remote", remotePath))
+	return nil
+}
+
+// OpenArchive opens an archive file for reading. `*GCSArchive` returned is an io.Reader
+func OpenArchive(fileName string, bufferSize int) (rf *GCSArchive, err error) {
+	return OpenArchiveContext(context.Background(), fileName, bufferSize)
+}
+
+// OpenArchiveContext is OpenArchive, downloading the file with `ctx`
+func OpenArchiveContext(ctx context.Context, fileName string, bufferSize int) (rf *GCSArchive, err error) {
+
+	localPath, _, err := FetchContext(ctx, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	rfi, err := common.OpenArchive(localPath, bufferSize, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to open downloaded gcs file")
+	}
+	return &GCSArchive{BasicArchive: *rfi}, nil
+}
+
+// Fetch downloads fileName to a local temporary file. Caller must
+// remove localPath when done (`temporary` is always true)
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return FetchContext(context.Background(), fileName)
+}
+
+// FetchContext is Fetch, downloading the file with `ctx`
+func FetchContext(ctx context.Context, fileName string) (localPath string, temporary bool, err error) {
+
+	err = gcsInit()
+	if err != nil {
+		return "", false, errors.Wrap(err, "Unable to initialize gcs connection")
+	}
+
+	bucketName, filePath, err := parseGCSURL(fileName)
+	if err != nil {
+		return "", false, err
+	}
+
+	localPath, err = download(ctx, bucketName, filePath, common.DefaultLogger)
+	if err != nil {
+		return "", false, err
+	}
+	return localPath, true, nil
+}
+
+// Store uploads the local file into gcs directory `dir` keeping the same base name
+func Store(localPath, dir string) (err error) {
+	return StoreContext(context.Background(), localPath, dir)
+}
+
+// StoreContext is Store, uploading the file with `ctx`
+func StoreContext(ctx context.Context, localPath, dir string) (err error) {
+
+	err = gcsInit()
+	if err != nil {
+		return errors.Wrap(err, "Unable to initialize gcs connection")
+	}
+
+	bucketName, subDir, err := parseGCSURL(dir)
+	if err != nil {
+		return err
+	}
+	return upload(ctx, localPath, bucketName, path.Join(subDir, path.Base(localPath)), common.DefaultLogger)
+}
+
+func List(dir string) (files []string, err error) {
+	return ListContext(context.Background(), dir)
+}
+
+// ListContext is List, with the requests made with `ctx`
+func ListContext(ctx context.Context, dir string) (files []string, err error) {
+
+	entries, err := ListDetailsContext(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		files = append(files, entry.Name)
+	}
+	return files, err
+}
+
+// ListDetails is like List, but includes size and modification time.
+// Names are object names, i.e. they include the path inside the bucket.
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+	return ListDetailsContext(context.Background(), dir)
+}
+
+// ListDetailsContext is ListDetails, with the requests made with `ctx`
+func ListDetailsContext(ctx context.Context, dir string) (entries []common.ArchiveEntry, err error) {
+
+	err = gcsInit()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to initialize gcs connection")
+	}
+
+	bucketName, subDir, err := parseGCSURL(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	it := gGCSSession.client.Bucket(bucketName).Objects(ctx,
+		&storage.Query{Prefix: common.DirPrefix(subDir)})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to list gcs bucket %s", bucketName)
+		}
+		entries = append(entries, common.ArchiveEntry{
+			Name:    attrs.Name,
+			Size:    attrs.Size,
+			ModTime: attrs.Updated})
+	}
+	return entries, nil
+}
+
+// Delete removes objects, named as returned by List, from the bucket of `dir`
+func Delete(dir string, files []string) (err error) {
+	return DeleteContext(context.Background(), dir, files)
+}
+
+// DeleteContext is Delete, with the requests made with `ctx`
+func DeleteContext(ctx context.Context, dir string, files []string) (err error) {
+
+	err = gcsInit()
+	if err != nil {
+		return errors.Wrap(err, "Unable to initialize gcs connection")
+	}
+
+	bucketName, _, err := parseGCSURL(dir)
+	if err != nil {
+		return err
+	}
+
+	bucket := gGCSSession.client.Bucket(bucketName)
+	for _, fileName := range files {
+		err = bucket.Object(fileName).Delete(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to delete gcs object: %s", fileName)
+		}
+		fmt.Printf("DELETED: %s\n", fileName)
+	}
+	return nil
+}
+
+// finalizeArchive is the companion function to CreateArchiveFile().
+// finalize will upload to GCS.
+func (rf *GCSArchive) finalizeArchive() (finalFile common.ArchiveFileDetails, err error) {
+
+	filePath := rf.Name()
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return finalFile, errors.Wrapf(err, "unable to stat file %s", filePath)
+	}
+	finalPath := path.Join(rf.contSubDir, rf.FinalName())
+	finalFile.FileName = rf.FinalName() // with the directories of FilenameTemplate, if any
+	finalFile.URL = fmt.Sprintf("gs://%s/%s", rf.bucketName, finalPath)
+	finalFile.BytesWritten = fi.Size()
+	finalFile.ChunksWritten = rf.ChunksWritten
+
+	err = upload(rf.Context(), filePath, rf.bucketName, finalPath, rf.Logger)
+	if err != nil {
+		return finalFile, err
+	}
+	rf.StoreIndex(func(indexPath string) error {
+		return upload(rf.Context(), indexPath, rf.bucketName, finalPath+common.IndexExt, rf.Logger)
+	})
+
+	err = os.Remove(filePath)
+	if err != nil {
+		return finalFile, errors.Wrapf(err, "unable to remove archive file %s after uploading to gcs", filePath)
+	}
+
+	return finalFile, err
+}
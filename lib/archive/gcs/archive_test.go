@@ -0,0 +1,229 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"go.uber.org/zap"
+	"google.golang.org/api/option"
+)
+
+// fakeGCS is the JSON API of one bucket, enough for multipart uploads,
+// downloads, listing and deleting
+type fakeGCS struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	objects := "/storage/v1/b/" + f.bucket + "/o"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/upload"+objects:
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		var attrs struct{ Name string }
+		part, err := mr.NextPart()
+		if err == nil {
+			err = json.NewDecoder(part).Decode(&attrs)
+		}
+		if err == nil {
+			part, err = mr.NextPart()
+		}
+		var data []byte
+		if err == nil {
+			data, err = ioutil.ReadAll(part)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[attrs.Name] = data
+		f.writeObject(w, attrs.Name)
+	case r.Method == http.MethodGet && r.URL.Path == objects:
+		var names []string
+		for name := range f.objects {
+			if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		fmt.Fprint(w, `{"kind":"storage#objects","items":[`)
+		for i, name := range names {
+			if i > 0 {
+				fmt.Fprint(w, ",")
+			}
+			f.writeObject(w, name)
+		}
+		fmt.Fprint(w, "]}")
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, objects+"/"):
+		name := strings.TrimPrefix(r.URL.Path, objects+"/")
+		if _, ok := f.objects[name]; !ok {
+			http.Error(w, `{"error":{"code":404,"message":"No such object"}}`, http.StatusNotFound)
+			return
+		}
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/"+f.bucket+"/"):
+		data, ok := f.objects[strings.TrimPrefix(r.URL.Path, "/"+f.bucket+"/")]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+	}
+}
+
+// writeObject writes the resource of an object
+func (f *fakeGCS) writeObject(w http.ResponseWriter, name string) {
+	fmt.Fprintf(w, `{"kind":"storage#object","bucket":%q,"name":%q,"size":"%d","updated":%q}`,
+		f.bucket, name, len(f.objects[name]), time.Now().UTC().Format(time.RFC3339))
+}
+
+// withFakeGCS has the client send its requests to `f` for the test
+func withFakeGCS(t *testing.T, f *fakeGCS) {
+
+	srv := httptest.NewServer(f)
+	client, err := storage.NewClient(context.Background(),
+		option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gGCSSession.Lock()
+	saved := gGCSSession.client
+	gGCSSession.client = client
+	gGCSSession.Unlock()
+	t.Cleanup(func() {
+		srv.Close()
+		gGCSSession.Lock()
+		gGCSSession.client = saved
+		gGCSSession.Unlock()
+	})
+}
+
+func TestParseGCSURL(t *testing.T) {
+
+	tests := []struct {
+		url, bucket, path string
+		err               bool
+	}{
+		{"gs://bucket/captures/2021", "bucket", "captures/2021", false},
+		{"gs://bucket/", "bucket", "", false},
+		{"gs://bucket", "", "", true},
+	}
+	for _, tt := range tests {
+		bucket, objPath, err := parseGCSURL(tt.url)
+		if bucket != tt.bucket || objPath != tt.path || (err != nil) != tt.err {
+			t.Fatalf("%s: got %q, %q, %v", tt.url, bucket, objPath, err)
+		}
+	}
+}
+
+// Archives are uploaded once closed, then listed, fetched and deleted
+func TestArchive(t *testing.T) {
+
+	f := &fakeGCS{bucket: "bucket", objects: map[string][]byte{"captures-old/kept.fbf": []byte("kept")}}
+	withFakeGCS(t, f)
+	rf, err := NewArchive("gs://bucket/captures", "requests", ".fbf",
+		common.Logger(zap.NewNop()), common.Compress(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rf.Write([]byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	finalized := rf.FinalizedFiles()
+	if len(finalized) != 1 {
+		t.Fatalf("got %+v", finalized)
+	}
+	var details common.ArchiveFileDetails
+	for _, details = range finalized {
+	}
+	name := "captures/" + details.FileName
+	if details.URL != "gs://bucket/"+name || string(f.objects[name]) != "content" {
+		t.Fatalf("got %+v, objects %q", details, f.objects)
+	}
+
+	files, err := List("gs://bucket/captures")
+	if err != nil || len(files) != 1 || files[0] != name {
+		t.Fatalf("listed %q, %v", files, err)
+	}
+	localPath, temporary, err := Fetch(details.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(localPath)
+	if data, _ := ioutil.ReadFile(localPath); !temporary || string(data) != "content" ||
+		!strings.HasSuffix(localPath, "_"+details.FileName) {
+		t.Fatalf("fetched %q to %s", data, localPath)
+	}
+	if err = Delete("gs://bucket/captures", files); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.objects) != 1 {
+		t.Fatalf("left %q", f.objects)
+	}
+	if _, _, err = Fetch(details.URL); err == nil {
+		t.Fatal("fetched a deleted object")
+	}
+}
+
+func TestStore(t *testing.T) {
+
+	f := &fakeGCS{bucket: "bucket", objects: map[string][]byte{}}
+	withFakeGCS(t, f)
+	dir, err := ioutil.TempDir("", "gcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	localPath := filepath.Join(dir, "requests_1.fbf")
+	if err = ioutil.WriteFile(localPath, []byte("stored"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = Store(localPath, "gs://bucket/captures"); err != nil {
+		t.Fatal(err)
+	}
+	if string(f.objects["captures/requests_1.fbf"]) != "stored" {
+		t.Fatalf("got %q", f.objects)
+	}
+}
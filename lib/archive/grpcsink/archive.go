@@ -0,0 +1,234 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package grpcsink provides archive interface for a gRPC ingestion service
+// implementing blackhole.Sink (see sink.proto), grpc://host:port or
+// grpcs://host:port for TLS. Nothing is written to files: requests are
+// streamed to Sink.Record, one request flatbuffer (fbr.Request) per message,
+// and every call is closed at flush and rotation, when the service returns
+// how many requests it got. A count that doesn't match fails the flush.
+package grpcsink
+
+import (
+	"context"
+	"crypto/tls"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/frame"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// recordMethod is Sink.Record, see sink.proto
+const recordMethod = "/blackhole.Sink/Record"
+
+var recordStream = grpc.StreamDesc{StreamName: "Record", ClientStreams: true}
+
+// Connections are shared by all archives of the same service, so they are
+// created once per process and never closed. Every archive has its calls.
+var gGRPCSession struct {
+	sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+var grpcUrlRegex = regexp.MustCompile("^(?i)(grpcs?)://([^/]+:[0-9]+)/?$")
+
+type GRPCArchive struct {
+	common.Publisher
+	conn      *grpc.ClientConn
+	stream    grpc.ClientStream // of the current call, nil if none
+	cancel    context.CancelFunc
+	schema    string
+	schemaVer string
+	sent      uint64 // requests sent in the current call
+	sentBytes int
+}
+
+// parseGRPCURL splits grpc://host:port or grpcs://host:port
+func parseGRPCURL(grpcURL string) (address string, useTLS bool, err error) {
+
+	parts := grpcUrlRegex.FindStringSubmatch(grpcURL)
+	if len(parts) != 3 {
+		return "", false, errors.Errorf("Unable to parse grpc url format (grpc://host:port or grpcs://host:port): %s", grpcURL)
+	}
+	return parts[2], strings.EqualFold(parts[1], "grpcs"), nil
+}
+
+// getConn returns the connection to the service at `address`, created the
+// first time. It connects in the background, and again when needed.
+func getConn(address string, useTLS bool) (conn *grpc.ClientConn, err error) {
+
+	gGRPCSession.Lock()
+	defer gGRPCSession.Unlock()
+	if gGRPCSession.conns == nil {
+		gGRPCSession.conns = make(map[string]*grpc.ClientConn)
+	}
+	key := address + "," + strconv.FormatBool(useTLS)
+	conn, ok := gGRPCSession.conns[key]
+	if !ok {
+		creds := insecure.NewCredentials()
+		if useTLS {
+			creds = credentials.NewTLS(&tls.Config{})
+		}
+		conn, err = grpc.Dial(address, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to connect to %s", address)
+		}
+		gGRPCSession.conns[key] = conn
+	}
+	return conn, nil
+}
+
+// NewArchive creates a new archive streaming to a blackhole.Sink service.
+// `outDir` is grpc://host:port, or grpcs://host:port for TLS with the
+// system roots. Rotate waits for the acknowledgement of what was sent and
+// starts a new batch, which stands for a file in FinalizedFiles and
+// OnFinalize. The caller must call `rf.Close()` to send what is left.
+func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *GRPCArchive, err error) {
+
+	address, useTLS, err := parseGRPCURL(outDir)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := getConn(address, useTLS)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to initialize grpc connection")
+	}
+	p, err := common.NewPublisher(strings.ToLower(outDir[:strings.Index(outDir, "://")])+"://"+address,
+		"grpc", prefix, extension, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	rf = &GRPCArchive{Publisher: *p, conn: conn}
+	rf.Frames.OnRequest = rf.add
+	rf.Frames.OnHeader = func(h frame.Header) error {
+		schema, schemaVer := h.Schema, strconv.Itoa(h.SchemaVersion)
+		if schema == rf.schema && schemaVer == rf.schemaVer {
+			return nil
+		}
+		rf.schema, rf.schemaVer = schema, schemaVer
+		return rf.commit() // the metadata of the next call has the new schema
+	}
+	rf.OnFlush = rf.commit
+
+	err = rf.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return rf, err
+}
+
+// OpenArchive is not supported: the service keeps what it gets
+func OpenArchive(fileName string, bufferSize int) (rf *GRPCArchive, err error) {
+	return nil, common.NotSupported("Reading", "grpc services", fileName)
+}
+
+// Fetch is not supported, see OpenArchive
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return "", false, common.NotSupported("Reading", "grpc services", fileName)
+}
+
+// Store streams the requests of a local archive file (compressed or not)
+// to the service of `dir`
+func Store(localPath, dir string) (err error) {
+
+	rf, err := NewArchive(dir, "", "", common.Logger(common.DefaultLogger))
+	if err != nil {
+		return err
+	}
+	return rf.Store(localPath)
+}
+
+func List(dir string) (files []string, err error) {
+	return nil, common.NotSupported("Listing", "grpc services", dir)
+}
+
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+	return nil, common.NotSupported("Listing", "grpc services", dir)
+}
+
+func Delete(dir string, files []string) (err error) {
+	return common.NotSupported("Deleting", "grpc services", dir)
+}
+
+// add sends a request payload, starting a call if there is none
+func (rf *GRPCArchive) add(payload []byte) (err error) {
+
+	if rf.stream == nil {
+		md := metadata.Pairs("blackhole-batch", rf.Batch)
+		if rf.schema != "" {
+			md.Append("blackhole-schema", rf.schema)
+			md.Append("blackhole-schema-version", rf.schemaVer)
+		}
+		var ctx context.Context
+		ctx, rf.cancel = context.WithCancel(context.Background())
+		rf.stream, err = rf.conn.NewStream(metadata.NewOutgoingContext(ctx, md), &recordStream, recordMethod)
+		if err != nil {
+			rf.abort()
+			return errors.Wrapf(err, "Unable to call %s on %s", recordMethod, rf.URL)
+		}
+	}
+	msg := &wrapperspb.BytesValue{Value: make([]byte, len(payload))}
+	copy(msg.Value, payload) // payload is only valid during the call
+	err = rf.stream.SendMsg(msg)
+	if err != nil {
+		// The status of the call is what tells why
+		err = rf.stream.RecvMsg(&wrapperspb.UInt64Value{})
+		rf.abort()
+		return errors.Wrapf(err, "Unable to send to %s", rf.URL)
+	}
+	rf.sent++
+	rf.sentBytes += len(payload)
+	return nil
+}
+
+// commit ends the current call, if any, and checks that the service got
+// every request sent
+func (rf *GRPCArchive) commit() (err error) {
+
+	if rf.stream == nil {
+		return nil
+	}
+	defer rf.abort()
+	err = rf.stream.CloseSend()
+	if err != nil {
+		return errors.Wrapf(err, "Unable to end call to %s", rf.URL)
+	}
+	var got wrapperspb.UInt64Value
+	err = rf.stream.RecvMsg(&got)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to send %d requests to %s", rf.sent, rf.URL)
+	}
+	if got.Value != rf.sent {
+		return errors.Errorf("%s got %d requests of %d sent", rf.URL, got.Value, rf.sent)
+	}
+	rf.Published(int(rf.sent), rf.sentBytes)
+	return nil
+}
+
+// abort drops the current call, if any
+func (rf *GRPCArchive) abort() {
+	if rf.cancel != nil {
+		rf.cancel()
+	}
+	rf.stream, rf.cancel = nil, nil
+	rf.sent, rf.sentBytes = 0, 0
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package grpcsink
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/frame"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// testFrame is a frame of `payload`
+func testFrame(payload string) []byte {
+	buf := make([]byte, frame.PrefixLen, frame.PrefixLen+len(payload))
+	frame.PutPrefix(buf, len(payload), 0)
+	return append(buf, payload...)
+}
+
+// sink is a blackhole.Sink service keeping the calls it gets
+type sink struct {
+	mu    sync.Mutex
+	calls []call
+	short uint64 // acknowledged less than received
+}
+
+// call is what a call of Sink.Record got
+type call struct {
+	batch    string
+	requests []string
+}
+
+func (s *sink) record(srv interface{}, stream grpc.ServerStream) error {
+
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	c := call{batch: md.Get("blackhole-batch")[0]}
+	for {
+		var msg wrapperspb.BytesValue
+		err := stream.RecvMsg(&msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		c.requests = append(c.requests, string(msg.Value))
+	}
+	s.mu.Lock()
+	s.calls = append(s.calls, c)
+	short := s.short
+	s.mu.Unlock()
+	return stream.SendMsg(wrapperspb.UInt64(uint64(len(c.requests)) - short))
+}
+
+// serve runs `s` until the end of the test, and returns its URL
+func (s *sink) serve(t *testing.T) string {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "blackhole.Sink",
+		HandlerType: (*interface{})(nil),
+		Streams:     []grpc.StreamDesc{{StreamName: "Record", Handler: s.record, ClientStreams: true}},
+	}, struct{}{})
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+	return "grpc://" + ln.Addr().String()
+}
+
+func TestParseGRPCURL(t *testing.T) {
+
+	tests := []struct {
+		url, address string
+		tls, err     bool
+	}{
+		{"grpc://sink:50051", "sink:50051", false, false},
+		{"GRPCS://sink:443/", "sink:443", true, false},
+		{"grpc://sink", "", false, true},
+		{"http://sink:50051", "", false, true},
+	}
+	for _, tt := range tests {
+		address, useTLS, err := parseGRPCURL(tt.url)
+		if address != tt.address || useTLS != tt.tls || (err != nil) != tt.err {
+			t.Fatalf("%s: got %q, %v, %v", tt.url, address, useTLS, err)
+		}
+	}
+}
+
+// Every flush and rotation ends a call, named after the batch
+func TestRecord(t *testing.T) {
+
+	s := &sink{}
+	rf, err := NewArchive(s.serve(t), "requests", ".fbf", common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := rf.Batch
+	fa, fb, fc := testFrame("a"), testFrame("b"), testFrame("c")
+	for _, buf := range [][]byte{fa[:2], fa[2:], fb} {
+		if _, err = rf.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	rf.Write(fc)
+	if err = rf.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err = rf.Flush(); err != nil { // no call to end
+		t.Fatal(err)
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.calls) != 2 || s.calls[0].batch != first || s.calls[1].batch != first ||
+		len(s.calls[0].requests) != 2 || s.calls[0].requests[1] != "b" || s.calls[1].requests[0] != "c" {
+		t.Fatalf("got calls %+v", s.calls)
+	}
+	files := rf.FinalizedFiles()
+	if details, ok := files[first]; len(files) != 1 || !ok || details.ChunksWritten != 3 {
+		t.Fatalf("got %+v", files)
+	}
+}
+
+// A service that got fewer requests than sent fails the flush
+func TestRecordShort(t *testing.T) {
+
+	s := &sink{short: 1}
+	rf, err := NewArchive(s.serve(t), "requests", ".fbf", common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	rf.Write(testFrame("a"))
+	if err = rf.Flush(); err == nil {
+		t.Fatal("no error")
+	}
+}
@@ -0,0 +1,400 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package hdfs provides archive interface for HDFS. Files are written
+// locally and copied to HDFS when finalized, like with the blob store
+// backends. URLs are hdfs://[user@]namenode1[:port],namenode2/path, or
+// hdfs:///path for the namenodes of the Hadoop configuration
+// (HADOOP_CONF_DIR or HADOOP_HOME). Kerberos is not supported.
+package hdfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/colinmarc/hdfs/v2"
+	"github.com/colinmarc/hdfs/v2/hadoopconf"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// defaultPort is the RPC port of namenodes given without one
+const defaultPort = "8020"
+
+// dialTimeout bounds connections to namenodes and datanodes
+const dialTimeout = 30 * time.Second
+
+// Clients are shared by all archives of the same namenodes and user, so they
+// are created once per process and never closed.
+var gHDFSSession struct {
+	sync.Mutex
+	clients map[string]*hdfs.Client
+}
+
+var hdfsUrlRegex = regexp.MustCompile("^hdfs://(([^@/]+)@)?([^/]*)(/.*)?$")
+
+type HDFSArchive struct {
+	common.BasicArchive
+	cluster cluster
+	dir     string
+}
+
+// cluster is the part of an hdfs URL before the path
+type cluster struct {
+	user      string
+	namenodes []string // with ports, empty for the Hadoop configuration
+	authority string   // as in the URL, to make URLs of finalized files
+}
+
+// parseHDFSURL splits hdfs://[user@]namenodes/path into cluster and path.
+// The user defaults to HADOOP_USER_NAME, then the current user.
+func parseHDFSURL(hdfsURL string) (c cluster, filePath string, err error) {
+
+	parts := hdfsUrlRegex.FindStringSubmatch(hdfsURL)
+	if len(parts) != 5 {
+		return c, "", errors.Errorf("Unable to parse hdfs url format (hdfs://user@namenode/path): %s", hdfsURL)
+	}
+	c.user = parts[2]
+	if c.user == "" {
+		c.user = os.Getenv("HADOOP_USER_NAME")
+	}
+	if c.user == "" {
+		current, err := user.Current()
+		if err != nil {
+			return c, "", errors.Wrap(err, "No user in hdfs url and unable to get the current one")
+		}
+		c.user = current.Username
+	}
+	for _, nn := range strings.Split(parts[3], ",") {
+		if nn == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(nn); err != nil {
+			nn = net.JoinHostPort(nn, defaultPort)
+		}
+		c.namenodes = append(c.namenodes, nn)
+	}
+	c.authority = parts[1] + parts[3]
+	filePath = parts[4]
+	if filePath == "" {
+		filePath = "/"
+	}
+	return c, filePath, nil
+}
+
+func (c cluster) url(filePath string) string {
+	return fmt.Sprintf("hdfs://%s%s", c.authority, filePath)
+}
+
+// getClient returns the client of a cluster, connecting the first time
+func getClient(c cluster) (client *hdfs.Client, err error) {
+
+	gHDFSSession.Lock()
+	defer gHDFSSession.Unlock()
+	if gHDFSSession.clients == nil {
+		gHDFSSession.clients = make(map[string]*hdfs.Client)
+	}
+	key := c.user + "@" + strings.Join(c.namenodes, ",")
+	if client, ok := gHDFSSession.clients[key]; ok {
+		return client, nil
+	}
+
+	options := hdfs.ClientOptions{Addresses: c.namenodes}
+	if len(c.namenodes) == 0 {
+		conf, err := hadoopconf.LoadFromEnvironment()
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to load hadoop configuration")
+		}
+		options = hdfs.ClientOptionsFromConf(conf)
+		if options.KerberosClient != nil {
+			return nil, errors.New("Kerberos authentication is not supported for hdfs")
+		}
+		if len(options.Addresses) == 0 {
+			return nil, errors.New("No namenode in hdfs url nor in hadoop configuration (HADOOP_CONF_DIR)")
+		}
+	}
+	options.User = c.user
+	dialFunc := (&net.Dialer{Timeout: dialTimeout, KeepAlive: dialTimeout}).DialContext
+	options.NamenodeDialFunc = dialFunc
+	options.DatanodeDialFunc = dialFunc
+
+	client, err = hdfs.NewClient(options)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to connect to namenode %s", strings.Join(options.Addresses, ","))
+	}
+	gHDFSSession.clients[key] = client
+	return client, nil
+}
+
+// NewArchive creates a new recorder file (for writing). The caller must call
+// `rf.Close()` on the resulting handle to close out the file.
+// File is copied to hdfs after it is flushed to disk and file is closed.
+// `*HDFSArchive` returned is an io.Writer
+func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *HDFSArchive, err error) {
+
+	c, dir, err := parseHDFSURL(outDir)
+	if err != nil {
+		return nil, err
+	}
+	_, err = getClient(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to initialize hdfs connection")
+	}
+	ba, err := common.NewBasicArchive(
+		"", prefix, extension, options...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to initialize basic archive")
+	}
+
+	rf = &HDFSArchive{BasicArchive: *ba,
+		cluster: c,
+		dir:     dir}
+	rf.Finalizer = rf.finalizeArchive
+
+	err = rf.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return rf, err
+}
+
+// download copies an hdfs file to a new local temporary file
+func download(c cluster, filePath string, logger *zap.Logger) (localPath string, err error) {
+
+	client, err := getClient(c)
+	if err != nil {
+		return "", err
+	}
+	fp, err := ioutil.TempFile("", fmt.Sprintf("tmp_*_%s", path.Base(filePath)))
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to create temp file")
+	}
+	defer fp.Close()
+
+	logger.Debug("HDFS Download [BEGIN]",
+		zap.String("remote", filePath),
+		zap.String("local", fp.Name()))
+
+	hr, err := client.Open(filePath)
+	if err == nil {
+		_, err = io.Copy(fp, hr)
+		hr.Close()
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return "", errors.Wrapf(err, "unable to download archive file: %s", filePath)
+	}
+
+	logger.Debug("HDFS Download [END]",
+		zap.String("remote", filePath),
+		zap.String("local", fp.Name()))
+
+	return fp.Name(), nil
+}
+
+// upload copies a local file to `remotePath`. The file is written under a
+// `.tmp` name and renamed once complete, so jobs reading the directory
+// never see part of it.
+func upload(localPath string, c cluster, remotePath string, logger *zap.Logger) (err error) {
+
+	client, err := getClient(c)
+	if err != nil {
+		return err
+	}
+	fp, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to reopen archive file: %s", localPath)
+	}
+	defer fp.Close()
+
+	logger.Debug("HDFS Upload [BEGIN]",
+		zap.String("local", localPath),
+		zap.String("remote", remotePath))
+
+	err = client.MkdirAll(path.Dir(remotePath), 0755)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create hdfs directory: %s", path.Dir(remotePath))
+	}
+	tmpPath := remotePath + ".tmp"
+	client.Remove(tmpPath) // left by an upload that failed, Create won't overwrite it
+	hw, err := client.Create(tmpPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create hdfs file: %s", tmpPath)
+	}
+	_, err = io.Copy(hw, fp)
+	if cerr := hw.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = client.Rename(tmpPath, remotePath)
+	}
+	if err != nil {
+		client.Remove(tmpPath)
+		return errors.Wrapf(err, "unable to upload archive file: %s", remotePath)
+	}
+
+	logger.Info("HDFS Upload [END]",
+		zap.String("local", localPath),
+		zap.String("remote", remotePath))
+	return nil
+}
+
+// OpenArchive opens an archive file for reading. `*HDFSArchive` returned is an io.Reader
+func OpenArchive(fileName string, bufferSize int) (rf *HDFSArchive, err error) {
+
+	localPath, _, err := Fetch(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	rfi, err := common.OpenArchive(localPath, bufferSize, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to open downloaded hdfs file")
+	}
+	return &HDFSArchive{BasicArchive: *rfi}, nil
+}
+
+// Fetch copies fileName to a local temporary file. Caller must
+// remove localPath when done (`temporary` is always true)
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+
+	c, filePath, err := parseHDFSURL(fileName)
+	if err != nil {
+		return "", false, err
+	}
+	localPath, err = download(c, filePath, common.DefaultLogger)
+	if err != nil {
+		return "", false, err
+	}
+	return localPath, true, nil
+}
+
+// Store copies the local file into hdfs directory `dir` keeping the same base name
+func Store(localPath, dir string) (err error) {
+
+	c, dirPath, err := parseHDFSURL(dir)
+	if err != nil {
+		return err
+	}
+	return upload(localPath, c, path.Join(dirPath, path.Base(localPath)), common.DefaultLogger)
+}
+
+func List(dir string) (files []string, err error) {
+
+	entries, err := ListDetails(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		files = append(files, entry.Name)
+	}
+	return files, err
+}
+
+// ListDetails is like List, but includes size and modification time.
+// Names are relative to `dir`, which is walked recursively.
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+
+	c, dirPath, err := parseHDFSURL(dir)
+	if err != nil {
+		return nil, err
+	}
+	client, err := getClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "Unable to list %s", filePath)
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(dirPath, filePath)
+		if err != nil {
+			return nil // Skipping weird directories
+		}
+		entries = append(entries, common.ArchiveEntry{
+			Name:    relPath,
+			Size:    info.Size(),
+			ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Delete removes files, named as returned by List, from hdfs directory `dir`
+func Delete(dir string, files []string) (err error) {
+
+	c, dirPath, err := parseHDFSURL(dir)
+	if err != nil {
+		return err
+	}
+	client, err := getClient(c)
+	if err != nil {
+		return err
+	}
+	for _, fileName := range files {
+		err = client.Remove(path.Join(dirPath, fileName))
+		if err != nil {
+			return errors.Wrapf(err, "Unable to delete hdfs file: %s", fileName)
+		}
+		fmt.Printf("DELETED: %s\n", fileName)
+	}
+	return nil
+}
+
+// finalizeArchive is the companion function to CreateArchiveFile().
+// finalize will copy to hdfs.
+func (rf *HDFSArchive) finalizeArchive() (finalFile common.ArchiveFileDetails, err error) {
+
+	filePath := rf.Name()
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return finalFile, errors.Wrapf(err, "unable to stat file %s", filePath)
+	}
+	finalPath := path.Join(rf.dir, rf.FinalName())
+	finalFile.FileName = rf.FinalName() // with the directories of FilenameTemplate, if any
+	finalFile.URL = rf.cluster.url(finalPath)
+	finalFile.BytesWritten = fi.Size()
+	finalFile.ChunksWritten = rf.ChunksWritten
+
+	err = upload(filePath, rf.cluster, finalPath, rf.Logger)
+	if err != nil {
+		return finalFile, err
+	}
+	rf.StoreIndex(func(indexPath string) error {
+		return upload(indexPath, rf.cluster, finalPath+common.IndexExt, rf.Logger)
+	})
+
+	err = os.Remove(filePath)
+	if err != nil {
+		return finalFile, errors.Wrapf(err, "unable to remove archive file %s after copying to hdfs", filePath)
+	}
+
+	return finalFile, err
+}
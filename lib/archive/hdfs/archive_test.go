@@ -0,0 +1,74 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package hdfs
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// setenv sets an environment variable for the test
+func setenv(t *testing.T, name, value string) {
+	saved, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, saved)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func TestParseHDFSURL(t *testing.T) {
+
+	setenv(t, "HADOOP_USER_NAME", "hadoop")
+	tests := []struct {
+		url, user, namenodes, path, back string
+	}{
+		{"hdfs://nn/captures", "hadoop", "nn:8020", "/captures", "hdfs://nn/captures/x"},
+		{"hdfs://etl@nn1:9000,nn2/captures/", "etl", "nn1:9000,nn2:8020", "/captures/", "hdfs://etl@nn1:9000,nn2/captures/x"},
+		{"hdfs:///captures", "hadoop", "", "/captures", "hdfs:///captures/x"},
+		{"hdfs://nn", "hadoop", "nn:8020", "/", "hdfs://nn/captures/x"},
+	}
+	for _, tt := range tests {
+		c, filePath, err := parseHDFSURL(tt.url)
+		if err != nil || c.user != tt.user || strings.Join(c.namenodes, ",") != tt.namenodes || filePath != tt.path ||
+			c.url("/captures/x") != tt.back {
+			t.Fatalf("%s: got %+v, %q, %v", tt.url, c, filePath, err)
+		}
+	}
+	if _, _, err := parseHDFSURL("s3://bucket/captures"); err == nil {
+		t.Fatal("no error")
+	}
+}
+
+// Without namenodes in the URL, they come from the Hadoop configuration
+func TestGetClientNoNamenode(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	setenv(t, "HADOOP_CONF_DIR", dir)
+	c, _, err := parseHDFSURL("hdfs:///captures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = getClient(c); err == nil || !strings.Contains(err.Error(), "No namenode") {
+		t.Fatalf("got %v", err)
+	}
+}
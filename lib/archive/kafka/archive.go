@@ -0,0 +1,268 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package kafka provides archive interface for Kafka topics. Nothing is
+// written to files: every request frame written to the archive is published
+// as one message, whose value is the request flatbuffer (fbr.Request), i.e.
+// the frame payload, decompressed if it was compressed with a dictionary.
+// Messages carry the schema of the file header in their `schema` and
+// `schema_version` headers. File headers themselves are not published.
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/frame"
+	"github.com/pkg/errors"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// defaultPort is used for brokers given without one
+const defaultPort = "9092"
+
+// Messages are published once this many of them, or this many bytes, are
+// pending, and on Flush, Rotate and Close
+const (
+	publishCount = 1000
+	publishBytes = 4 * 1024 * 1024
+)
+
+// maxMessageBytes is the largest message published. Larger requests would be
+// refused by brokers with the default `message.max.bytes`, failing everything
+// published with them: writing one fails instead, before it is queued, for
+// the recorder to keep it some other way (fallback output or spill file).
+const maxMessageBytes = 1000000
+
+// publishTimeout bounds the wait for a batch to be acknowledged, retries
+// included
+const publishTimeout = 30 * time.Second
+
+// Writers are shared by all archives of a topic: created by the first,
+// closed with the last. Publishing is synchronous: once Flush or Close
+// returned, messages were acknowledged by all in-sync replicas.
+var gKafkaSession struct {
+	sync.Mutex
+	writers map[string]*kafka.Writer
+	users   map[string]int // archives using each writer
+}
+
+var kafkaUrlRegex = regexp.MustCompile("^kafka://([^/]+)/([^/]+)/?$")
+
+type KafkaArchive struct {
+	common.Publisher
+	topic     string
+	w         *kafka.Writer // nil once released
+	writerKey string
+	pending   []kafka.Message
+	pendBytes int
+	headers   []kafka.Header // of every message, from the file header
+}
+
+// parseKafkaURL splits kafka://broker1,broker2/topic into brokers (with the
+// default port added where missing) and topic
+func parseKafkaURL(kafkaURL string) (brokers []string, topic string, err error) {
+
+	parts := kafkaUrlRegex.FindStringSubmatch(kafkaURL)
+	if len(parts) != 3 {
+		return nil, "", errors.Errorf("Unable to parse kafka url format (kafka://broker1,broker2/topic): %s", kafkaURL)
+	}
+	for _, broker := range strings.Split(parts[1], ",") {
+		if broker == "" {
+			continue
+		}
+		if !strings.Contains(broker, ":") {
+			broker += ":" + defaultPort
+		}
+		brokers = append(brokers, broker)
+	}
+	if len(brokers) == 0 {
+		return nil, "", errors.Errorf("No brokers in kafka url: %s", kafkaURL)
+	}
+	return brokers, parts[2], nil
+}
+
+// getWriter returns the writer of a topic, and its key for releaseWriter,
+// creating it the first time
+func getWriter(brokers []string, topic string) (w *kafka.Writer, key string) {
+
+	key = strings.Join(brokers, ",") + "/" + topic
+	gKafkaSession.Lock()
+	defer gKafkaSession.Unlock()
+	if gKafkaSession.writers == nil {
+		gKafkaSession.writers = make(map[string]*kafka.Writer)
+		gKafkaSession.users = make(map[string]int)
+	}
+	w, ok := gKafkaSession.writers[key]
+	if !ok {
+		w = &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.LeastBytes{},
+			BatchSize:    publishCount,
+			BatchBytes:   publishBytes,
+			BatchTimeout: 10 * time.Millisecond, // publishing is synchronous, don't wait for more
+			RequiredAcks: kafka.RequireAll,
+			Compression:  kafka.Lz4,
+		}
+		gKafkaSession.writers[key] = w
+	}
+	gKafkaSession.users[key]++
+	return w, key
+}
+
+// releaseWriter closes the writer of `key` once no archive uses it
+func releaseWriter(key string) (err error) {
+
+	gKafkaSession.Lock()
+	defer gKafkaSession.Unlock()
+	gKafkaSession.users[key]--
+	if gKafkaSession.users[key] > 0 {
+		return nil
+	}
+	w := gKafkaSession.writers[key]
+	delete(gKafkaSession.writers, key)
+	delete(gKafkaSession.users, key)
+	return w.Close()
+}
+
+// NewArchive creates a new archive publishing to a kafka topic. `outDir` is
+// kafka://broker1,broker2/topic. Rotate publishes what is pending and starts
+// a new batch, which stands for a file in FinalizedFiles and OnFinalize.
+// The caller must call `rf.Close()` to publish what is left.
+func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *KafkaArchive, err error) {
+
+	brokers, topic, err := parseKafkaURL(outDir)
+	if err != nil {
+		return nil, err
+	}
+	p, err := common.NewPublisher(fmt.Sprintf("kafka://%s/%s", strings.Join(brokers, ","), topic),
+		"kafka", prefix, extension, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	rf = &KafkaArchive{Publisher: *p, topic: topic}
+	rf.w, rf.writerKey = getWriter(brokers, topic)
+	rf.Frames.OnRequest = rf.add
+	rf.Frames.OnHeader = rf.setHeader
+	rf.OnFlush = rf.publish
+	rf.OnClose = rf.release
+
+	err = rf.Rotate()
+	if err != nil {
+		rf.release()
+		return nil, err
+	}
+	return rf, err
+}
+
+// OpenArchive is not supported: topics are read with kafka consumers
+func OpenArchive(fileName string, bufferSize int) (rf *KafkaArchive, err error) {
+	return nil, common.NotSupported("Reading", "kafka topics", fileName)
+}
+
+// Fetch is not supported, see OpenArchive
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return "", false, common.NotSupported("Reading", "kafka topics", fileName)
+}
+
+// Store publishes the requests of a local archive file (compressed or not)
+// to the topic of `dir`
+func Store(localPath, dir string) (err error) {
+
+	rf, err := NewArchive(dir, "", "", common.Logger(common.DefaultLogger))
+	if err != nil {
+		return err
+	}
+	return rf.Store(localPath)
+}
+
+func List(dir string) (files []string, err error) {
+	return nil, common.NotSupported("Listing", "kafka topics", dir)
+}
+
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+	return nil, common.NotSupported("Listing", "kafka topics", dir)
+}
+
+func Delete(dir string, files []string) (err error) {
+	return common.NotSupported("Deleting", "kafka topics", dir)
+}
+
+// add queues a request payload, publishing when enough are pending
+func (rf *KafkaArchive) add(payload []byte) (err error) {
+
+	if len(payload) > maxMessageBytes {
+		return errors.Errorf("Request of %d bytes too large for kafka, at most %d", len(payload), maxMessageBytes)
+	}
+	value := make([]byte, len(payload))
+	copy(value, payload) // payload is only valid during the call
+	rf.pending = append(rf.pending, kafka.Message{Value: value, Headers: rf.headers})
+	rf.pendBytes += len(value)
+	if len(rf.pending) >= publishCount || rf.pendBytes >= publishBytes {
+		return rf.publish()
+	}
+	return nil
+}
+
+// setHeader takes the schema of a file header
+func (rf *KafkaArchive) setHeader(h frame.Header) error {
+	rf.headers = []kafka.Header{
+		{Key: "schema", Value: []byte(h.Schema)},
+		{Key: "schema_version", Value: []byte(strconv.Itoa(h.SchemaVersion))}}
+	return nil
+}
+
+// release lets go of the writer of the topic, closed with its last archive
+func (rf *KafkaArchive) release() (err error) {
+
+	if rf.w == nil {
+		return nil
+	}
+	rf.w = nil
+	err = releaseWriter(rf.writerKey)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to close writer of %s", rf.URL)
+	}
+	return nil
+}
+
+// publish sends pending messages and waits for their acknowledgement
+func (rf *KafkaArchive) publish() (err error) {
+
+	if len(rf.pending) == 0 {
+		return nil
+	}
+	if rf.w == nil {
+		return errors.Errorf("Archive of %s closed", rf.URL)
+	}
+	ctx, cancel := context.WithTimeout(rf.Context(), publishTimeout)
+	defer cancel()
+	err = rf.w.WriteMessages(ctx, rf.pending...)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to publish %d requests to %s", len(rf.pending), rf.URL)
+	}
+	rf.Published(len(rf.pending), rf.pendBytes)
+	for i := range rf.pending {
+		rf.pending[i] = kafka.Message{} // don't hold on to published values
+	}
+	rf.pending = rf.pending[:0]
+	rf.pendBytes = 0
+	return nil
+}
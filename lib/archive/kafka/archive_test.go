@@ -0,0 +1,124 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package kafka
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/frame"
+	"go.uber.org/zap"
+)
+
+// No broker listens there: writers only connect to publish
+const testURL = "kafka://127.0.0.1:1/captures"
+
+func newTestArchive(t *testing.T) *KafkaArchive {
+	rf, err := NewArchive(testURL, "requests", ".fbf", common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rf
+}
+
+// testFrame is a frame of `payload`
+func testFrame(payload []byte) []byte {
+	buf := make([]byte, frame.PrefixLen, frame.PrefixLen+len(payload))
+	frame.PutPrefix(buf, len(payload), 0)
+	return append(buf, payload...)
+}
+
+func TestParseKafkaURL(t *testing.T) {
+
+	tests := []struct {
+		url     string
+		brokers []string
+		topic   string
+		err     bool
+	}{
+		{"kafka://broker/topic", []string{"broker:9092"}, "topic", false},
+		{"kafka://b1:9093,b2/topic/", []string{"b1:9093", "b2:9092"}, "topic", false},
+		{"kafka://,/topic", nil, "", true},
+		{"kafka://broker", nil, "", true},
+		{"kafka://broker/topic/sub", nil, "", true},
+	}
+	for _, tt := range tests {
+		brokers, topic, err := parseKafkaURL(tt.url)
+		if (err != nil) != tt.err || topic != tt.topic || len(brokers) != len(tt.brokers) {
+			t.Fatalf("%s: got %q, %q, %v", tt.url, brokers, topic, err)
+		}
+		for i := range brokers {
+			if brokers[i] != tt.brokers[i] {
+				t.Fatalf("%s: got %q", tt.url, brokers)
+			}
+		}
+	}
+}
+
+// Requests too large to publish fail the write, before anything is queued
+func TestWriteTooLarge(t *testing.T) {
+
+	rf := newTestArchive(t)
+	defer rf.Close()
+	large := testFrame(bytes.Repeat([]byte("x"), maxMessageBytes+1))
+	if _, err := rf.Write(large[:100]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rf.Write(large[100:]); err == nil {
+		t.Fatal("no error")
+	}
+	if len(rf.pending) != 0 || rf.Frames.Partial() != 0 {
+		t.Fatalf("%d pending, %d bytes left", len(rf.pending), rf.Frames.Partial())
+	}
+
+	// The next request is taken as usual
+	if _, err := rf.Write(testFrame([]byte("request"))); err != nil {
+		t.Fatal(err)
+	}
+	if len(rf.pending) != 1 {
+		t.Fatalf("%d pending", len(rf.pending))
+	}
+	rf.pending, rf.pendBytes = nil, 0 // nowhere to publish them
+}
+
+// Archives of a topic share its writer, closed with the last of them
+func TestWriterShared(t *testing.T) {
+
+	a, b := newTestArchive(t), newTestArchive(t)
+	if a.w != b.w {
+		t.Fatal("writers not shared")
+	}
+	key, w := a.writerKey, a.w
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil { // released once
+		t.Fatal(err)
+	}
+	if gKafkaSession.writers[key] != w || gKafkaSession.users[key] != 1 {
+		t.Fatalf("writer released with %d users left", gKafkaSession.users[key])
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gKafkaSession.writers[key]; ok {
+		t.Fatal("writer not closed")
+	}
+
+	c := newTestArchive(t) // a new one
+	defer c.Close()
+	if c.w == nil || c.w == w {
+		t.Fatal("closed writer reused")
+	}
+}
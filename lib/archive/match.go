@@ -0,0 +1,63 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package archive
+
+import (
+	"context"
+	"path"
+	"sort"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/pkg/errors"
+)
+
+// ListMatching is ListDetails, only of the files whose base name matches
+// glob `pattern` (see path.Match), e.g. "*.fbf.lz4" or "requests_2021*":
+// names returned by some backends include a path. An empty pattern matches
+// every file.
+func ListMatching(dir, pattern string) (entries []common.ArchiveEntry, err error) {
+	return ListMatchingContext(context.Background(), dir, pattern)
+}
+
+// ListMatchingContext is ListMatching, with the requests of remote backends
+// made with `ctx`
+func ListMatchingContext(ctx context.Context, dir, pattern string) (entries []common.ArchiveEntry, err error) {
+
+	if _, err = path.Match(pattern, ""); err != nil {
+		return nil, errors.Wrapf(err, "Invalid pattern %q", pattern)
+	}
+	all, err := ListDetailsContext(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	if pattern == "" {
+		return all, nil
+	}
+	for _, entry := range all {
+		if ok, _ := path.Match(pattern, path.Base(entry.Name)); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Newest sorts `entries` by modification time, most recent first, and returns
+// the first `n` of them (all of them if n <= 0)
+func Newest(entries []common.ArchiveEntry, n int) []common.ArchiveEntry {
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].ModTime.After(entries[j].ModTime) })
+	if n > 0 && n < len(entries) {
+		entries = entries[:n]
+	}
+	return entries
+}
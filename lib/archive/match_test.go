@@ -0,0 +1,99 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+)
+
+func TestListMatching(t *testing.T) {
+
+	dir := tempDir(t)
+	for _, name := range []string{"requests_1.fbf.lz4", "requests_2.fbf", "2021/03/requests_3.fbf.lz4", "other.fbf.lz4"} {
+		fileName := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fileName, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"", []string{"2021/03/requests_3.fbf.lz4", "other.fbf.lz4", "requests_1.fbf.lz4", "requests_2.fbf"}},
+		{"*.fbf.lz4", []string{"2021/03/requests_3.fbf.lz4", "other.fbf.lz4", "requests_1.fbf.lz4"}},
+		{"requests_*", []string{"2021/03/requests_3.fbf.lz4", "requests_1.fbf.lz4", "requests_2.fbf"}},
+		{"2021*", nil}, // base names only
+		{"requests_[12].fbf*", []string{"requests_1.fbf.lz4", "requests_2.fbf"}},
+	}
+	for _, tt := range tests {
+		entries, err := ListMatching(dir, tt.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, entry := range entries {
+			got = append(got, filepath.ToSlash(entry.Name))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%q: got %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+	if _, err := ListMatching(dir, "requests_["); err == nil {
+		t.Fatal("no error for an invalid pattern")
+	}
+}
+
+func TestNewest(t *testing.T) {
+
+	now := time.Now()
+	entries := func() []common.ArchiveEntry {
+		return []common.ArchiveEntry{
+			{Name: "old", ModTime: now.Add(-time.Hour)},
+			{Name: "new", ModTime: now},
+			{Name: "a", ModTime: now.Add(-time.Minute)},
+			{Name: "b", ModTime: now.Add(-time.Minute)},
+		}
+	}
+	tests := []struct {
+		n    int
+		want []string
+	}{
+		{0, []string{"new", "a", "b", "old"}},
+		{-1, []string{"new", "a", "b", "old"}},
+		{2, []string{"new", "a"}}, // same time: listing order kept
+		{3, []string{"new", "a", "b"}},
+		{10, []string{"new", "a", "b", "old"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, entry := range Newest(entries(), tt.n) {
+			got = append(got, entry.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%d: got %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package archive
+
+import (
+	"strings"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/pkg/errors"
+)
+
+// MultiArchive writes the same requests to several archives, one per output
+// directory, e.g. a local copy, a cloud copy and a checksum. Every call goes
+// to all of them, in order; a write fails if any of them fails.
+type MultiArchive struct {
+	archives []Archive
+	outDirs  []string
+}
+
+// NewMultiArchive creates an archive for each of `outDirs`, any URL
+// supported by NewArchive, with the same options. Files of every archive
+// are finalized on their own, and passed to OnFinalize, if set. Bytes
+// counted with CountStored add up over all of them.
+func NewMultiArchive(outDirs []string, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *MultiArchive, err error) {
+
+	if len(outDirs) == 0 {
+		return nil, errors.New("No output directory")
+	}
+	rf = &MultiArchive{outDirs: outDirs}
+	for _, outDir := range outDirs {
+		a, err := NewArchive(outDir, prefix, extension, options...)
+		if err != nil {
+			rf.Close()
+			return nil, errors.Wrapf(err, "Unable to create archive in %s", outDir)
+		}
+		rf.archives = append(rf.archives, a)
+	}
+	return rf, nil
+}
+
+// Write satisfies io.Writer interface. `buf` is written to every archive;
+// the first error, if any, is returned after trying all of them.
+func (rf *MultiArchive) Write(buf []byte) (n int, err error) {
+
+	n = len(buf)
+	for i, a := range rf.archives {
+		written, werr := a.Write(buf)
+		if werr != nil && err == nil {
+			err = errors.Wrapf(werr, "Unable to write to %s", rf.outDirs[i])
+		}
+		if written < n {
+			n = written
+		}
+	}
+	return n, err
+}
+
+// Read is not supported: read one of the archives written
+func (rf *MultiArchive) Read(p []byte) (n int, err error) {
+	return 0, errors.New("Read not supported for multiple outputs")
+}
+
+// each calls `f` on every archive, returning the first error
+func (rf *MultiArchive) each(what string, f func(Archive) error) (err error) {
+
+	for i, a := range rf.archives {
+		ferr := f(a)
+		if ferr != nil && err == nil {
+			err = errors.Wrapf(ferr, "Unable to %s %s", what, rf.outDirs[i])
+		}
+	}
+	return err
+}
+
+// Flush flushes every archive
+func (rf *MultiArchive) Flush() (err error) {
+	return rf.each("flush", Archive.Flush)
+}
+
+// Rotate rotates every archive
+func (rf *MultiArchive) Rotate() (err error) {
+	return rf.each("rotate", Archive.Rotate)
+}
+
+// Close closes every archive, even if closing one of them fails
+func (rf *MultiArchive) Close() (err error) {
+	return rf.each("close", Archive.Close)
+}
+
+// AddRows counts rows in the archives that keep count of them
+func (rf *MultiArchive) AddRows(n int64) {
+	for _, a := range rf.archives {
+		if rc, ok := a.(interface{ AddRows(int64) }); ok {
+			rc.AddRows(n)
+		}
+	}
+}
+
+// RowsLeft is the fewest rows one of the archives takes before going over
+// its row limit (see common.MaxRows), -1 if none has any
+func (rf *MultiArchive) RowsLeft() (left int64) {
+	left = -1
+	for _, a := range rf.archives {
+		if rl, ok := a.(interface{ RowsLeft() int64 }); ok {
+			if n := rl.RowsLeft(); n > 0 && (left < 0 || n < left) {
+				left = n
+			}
+		}
+	}
+	return left
+}
+
+// Name is the names of the current files of all archives, comma separated
+func (rf *MultiArchive) Name() string {
+
+	names := make([]string, len(rf.archives))
+	for i, a := range rf.archives {
+		names[i] = a.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// FinalizedFiles lists the files finalized by all archives. As files of
+// different archives may have the same name, they are listed by URL.
+func (rf *MultiArchive) FinalizedFiles() map[string]common.ArchiveFileDetails {
+
+	files := make(map[string]common.ArchiveFileDetails)
+	for _, a := range rf.archives {
+		for name, details := range a.FinalizedFiles() {
+			if details.URL != "" {
+				name = details.URL
+			}
+			files[name] = details
+		}
+	}
+	return files
+}
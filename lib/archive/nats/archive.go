@@ -0,0 +1,239 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package nats provides archive interface for NATS JetStream. Nothing is
+// written to files: every request written to the archive is published to a
+// subject captured by a stream, as one message whose data is the request
+// flatbuffer (fbr.Request). Its `Nats-Msg-Id` header is the request ID, so
+// requests published twice (e.g. the same archive stored again) are only
+// kept once within the duplicate window of the stream. Messages carry the
+// schema of the file header in `Blackhole-Schema` and `Blackhole-Schema-Version`.
+package nats
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/frame"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// maxPending is how many messages are published before waiting for their
+// acknowledgement, which Flush and Close do as well
+const maxPending = 4000
+
+// ackWait bounds the wait for the acknowledgement of one message
+const ackWait = 30 * time.Second
+
+// Connections are shared by all archives of the same servers, so they are
+// created once per process and never closed.
+var gNATSSession struct {
+	sync.Mutex
+	streams map[string]nats.JetStreamContext
+}
+
+var natsUrlRegex = regexp.MustCompile("^nats://([^/]+)/([^/]+)$")
+
+// natsUserRegex matches the credentials of a server, if any
+var natsUserRegex = regexp.MustCompile("[^,@]*@")
+
+type NATSArchive struct {
+	common.Publisher
+	subject   string
+	js        nats.JetStreamContext
+	schema    string
+	schemaVer string
+	acks      []nats.PubAckFuture
+	pendBytes int // bytes of acks
+}
+
+// parseNATSURL splits nats://[user:pass@]server1[:port],server2/subject into
+// server URLs and subject
+func parseNATSURL(natsURL string) (servers, subject string, err error) {
+
+	parts := natsUrlRegex.FindStringSubmatch(natsURL)
+	if len(parts) != 3 {
+		return "", "", errors.Errorf("Unable to parse nats url format (nats://server1,server2/subject): %s", natsURL)
+	}
+	var urls []string
+	for _, server := range strings.Split(parts[1], ",") {
+		if server != "" {
+			urls = append(urls, "nats://"+server)
+		}
+	}
+	if len(urls) == 0 {
+		return "", "", errors.Errorf("No servers in nats url: %s", natsURL)
+	}
+	return strings.Join(urls, ","), parts[2], nil
+}
+
+// getJetStream returns the JetStream context of the connection to
+// `servers`, connecting the first time
+func getJetStream(servers string) (js nats.JetStreamContext, err error) {
+
+	gNATSSession.Lock()
+	defer gNATSSession.Unlock()
+	if gNATSSession.streams == nil {
+		gNATSSession.streams = make(map[string]nats.JetStreamContext)
+	}
+	js, ok := gNATSSession.streams[servers]
+	if !ok {
+		nc, err := nats.Connect(servers, nats.Name("blackhole"), nats.MaxReconnects(-1))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to connect to %s", servers)
+		}
+		js, err = nc.JetStream(nats.PublishAsyncMaxPending(maxPending))
+		if err != nil {
+			nc.Close()
+			return nil, errors.Wrapf(err, "Unable to use JetStream on %s", servers)
+		}
+		gNATSSession.streams[servers] = js
+	}
+	return js, nil
+}
+
+// NewArchive creates a new archive publishing to JetStream. `outDir` is
+// nats://server1,server2/subject, the subject a stream must capture. Rotate
+// waits for what is pending and starts a new batch, which stands for a
+// file in FinalizedFiles and OnFinalize. The caller must call `rf.Close()`
+// to publish what is left.
+func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *NATSArchive, err error) {
+
+	servers, subject, err := parseNATSURL(outDir)
+	if err != nil {
+		return nil, err
+	}
+	js, err := getJetStream(servers)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to initialize nats connection")
+	}
+	p, err := common.NewPublisher("nats://"+natsUserRegex.ReplaceAllString(outDir[len("nats://"):], ""),
+		"nats", prefix, extension, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	rf = &NATSArchive{Publisher: *p, subject: subject, js: js}
+	rf.Frames.OnRequest = rf.add
+	rf.Frames.OnHeader = func(h frame.Header) error {
+		rf.schema, rf.schemaVer = h.Schema, strconv.Itoa(h.SchemaVersion)
+		return nil
+	}
+	rf.OnFlush = rf.wait
+
+	err = rf.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return rf, err
+}
+
+// OpenArchive is not supported: streams are read with consumers
+func OpenArchive(fileName string, bufferSize int) (rf *NATSArchive, err error) {
+	return nil, common.NotSupported("Reading", "nats subjects", fileName)
+}
+
+// Fetch is not supported, see OpenArchive
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return "", false, common.NotSupported("Reading", "nats subjects", fileName)
+}
+
+// Store publishes the requests of a local archive file (compressed or not)
+// to the subject of `dir`
+func Store(localPath, dir string) (err error) {
+
+	rf, err := NewArchive(dir, "", "", common.Logger(common.DefaultLogger))
+	if err != nil {
+		return err
+	}
+	return rf.Store(localPath)
+}
+
+func List(dir string) (files []string, err error) {
+	return nil, common.NotSupported("Listing", "nats subjects", dir)
+}
+
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+	return nil, common.NotSupported("Listing", "nats subjects", dir)
+}
+
+func Delete(dir string, files []string) (err error) {
+	return common.NotSupported("Deleting", "nats subjects", dir)
+}
+
+// add publishes a request payload, asynchronously, waiting for the
+// acknowledgement of what was published once maxPending are pending
+func (rf *NATSArchive) add(payload []byte) (err error) {
+
+	msg := nats.NewMsg(rf.subject)
+	msg.Data = make([]byte, len(payload))
+	copy(msg.Data, payload) // payload is only valid during the call
+	if id := fbr.GetRootAsRequest(msg.Data, 0).Id(); len(id) > 0 {
+		msg.Header.Set(nats.MsgIdHdr, string(id))
+	}
+	if rf.schema != "" {
+		msg.Header.Set("Blackhole-Schema", rf.schema)
+		msg.Header.Set("Blackhole-Schema-Version", rf.schemaVer)
+	}
+	ack, err := rf.js.PublishMsgAsync(msg)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to publish to %s", rf.URL)
+	}
+	rf.acks = append(rf.acks, ack)
+	rf.pendBytes += len(msg.Data)
+	if len(rf.acks) >= maxPending {
+		return rf.wait()
+	}
+	return nil
+}
+
+// wait waits for the acknowledgement of everything published. Returns the
+// first error, after waiting for all of them.
+func (rf *NATSArchive) wait() (err error) {
+
+	if len(rf.acks) == 0 {
+		return nil
+	}
+	failed := 0
+	timeout := time.NewTimer(ackWait)
+	defer timeout.Stop()
+	for i, ack := range rf.acks {
+		var perr error
+		select {
+		case <-ack.Ok():
+		case perr = <-ack.Err():
+		case <-timeout.C:
+			perr = errors.New("timed out waiting for acknowledgement")
+			timeout.Reset(0) // don't wait for the others either
+		}
+		if perr != nil {
+			failed++
+			if err == nil {
+				err = perr
+			}
+		}
+		rf.acks[i] = nil
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "Unable to publish %d of %d requests to %s", failed, len(rf.acks), rf.URL)
+	}
+	rf.Published(len(rf.acks)-failed, rf.pendBytes) // bytes close enough when some failed
+	rf.acks = rf.acks[:0]
+	rf.pendBytes = 0
+	return err
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/frame"
+	flatbuffers "github.com/google/flatbuffers/go"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+// testRequest is the frame of a request of ID `id`
+func testRequest(id string) []byte {
+	b := flatbuffers.NewBuilder(0)
+	idOffset := b.CreateString(id)
+	uri := b.CreateString("/" + id)
+	fbr.RequestStart(b)
+	fbr.RequestAddId(b, idOffset)
+	fbr.RequestAddUri(b, uri)
+	b.Finish(fbr.RequestEnd(b))
+	payload := b.FinishedBytes()
+	buf := make([]byte, frame.PrefixLen, frame.PrefixLen+len(payload))
+	frame.PutPrefix(buf, len(payload), 0)
+	return append(buf, payload...)
+}
+
+// fakeJetStream keeps the messages published, failing those of requests
+// to /fail
+type fakeJetStream struct {
+	nats.JetStreamContext
+	msgs []*nats.Msg
+}
+
+// ackFuture is acknowledged already, or failed
+type ackFuture struct {
+	msg *nats.Msg
+	ok  chan *nats.PubAck
+	err chan error
+}
+
+func (a *ackFuture) Ok() <-chan *nats.PubAck { return a.ok }
+func (a *ackFuture) Err() <-chan error       { return a.err }
+func (a *ackFuture) Msg() *nats.Msg          { return a.msg }
+
+func (js *fakeJetStream) PublishMsgAsync(msg *nats.Msg, opts ...nats.PubOpt) (nats.PubAckFuture, error) {
+
+	js.msgs = append(js.msgs, msg)
+	ack := &ackFuture{msg: msg, ok: make(chan *nats.PubAck, 1), err: make(chan error, 1)}
+	if string(fbr.GetRootAsRequest(msg.Data, 0).Uri()) == "/fail" {
+		ack.err <- errors.New("nats: no response from stream")
+	} else {
+		ack.ok <- &nats.PubAck{Stream: "CAPTURES", Sequence: uint64(len(js.msgs))}
+	}
+	return ack, nil
+}
+
+// withFakeJetStream has archives of `servers` publish to `js` for the test
+func withFakeJetStream(t *testing.T, servers string, js *fakeJetStream) {
+
+	gNATSSession.Lock()
+	if gNATSSession.streams == nil {
+		gNATSSession.streams = make(map[string]nats.JetStreamContext)
+	}
+	gNATSSession.streams[servers] = js
+	gNATSSession.Unlock()
+	t.Cleanup(func() {
+		gNATSSession.Lock()
+		delete(gNATSSession.streams, servers)
+		gNATSSession.Unlock()
+	})
+}
+
+func TestParseNATSURL(t *testing.T) {
+
+	tests := []struct {
+		url, servers, subject string
+		err                   bool
+	}{
+		{"nats://localhost/captures", "nats://localhost", "captures", false},
+		{"nats://u:p@n1:4222,n2/captures.bid", "nats://u:p@n1:4222,nats://n2", "captures.bid", false},
+		{"nats://,/captures", "", "", true},
+		{"nats://localhost", "", "", true},
+		{"nats://localhost/captures/bid", "", "", true},
+	}
+	for _, tt := range tests {
+		servers, subject, err := parseNATSURL(tt.url)
+		if servers != tt.servers || subject != tt.subject || (err != nil) != tt.err {
+			t.Fatalf("%s: got %q, %q, %v", tt.url, servers, subject, err)
+		}
+	}
+}
+
+// Requests are published with their ID, to drop duplicates, and the schema
+// of the file header
+func TestPublish(t *testing.T) {
+
+	js := &fakeJetStream{}
+	withFakeJetStream(t, "nats://u:p@n1:4222,nats://n2", js)
+	rf, err := NewArchive("nats://u:p@n1:4222,n2/captures", "requests", ".fbf", common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rf.URL != "nats://n1:4222,n2/captures" {
+		t.Fatalf("got URL %s", rf.URL)
+	}
+	batch := rf.Batch
+	header, err := frame.NewHeader("fbr.Request", 2).Frame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, buf := range [][]byte{testRequest("0"), header, testRequest("1"), testRequest("")} {
+		if _, err = rf.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(js.msgs) != 3 {
+		t.Fatalf("got %d messages", len(js.msgs))
+	}
+	for i, want := range []string{"0 captures  ", "1 captures fbr.Request 2", " captures fbr.Request 2"} {
+		msg := js.msgs[i]
+		got := fmt.Sprintf("%s %s %s %s", msg.Header.Get(nats.MsgIdHdr), msg.Subject,
+			msg.Header.Get("Blackhole-Schema"), msg.Header.Get("Blackhole-Schema-Version"))
+		if got != want {
+			t.Fatalf("message %d: got %q, want %q", i, got, want)
+		}
+	}
+	files := rf.FinalizedFiles()
+	if details, ok := files[batch]; len(files) != 1 || !ok || details.ChunksWritten != 3 {
+		t.Fatalf("got %+v", files)
+	}
+}
+
+// Messages that were not acknowledged fail the flush
+func TestPublishErrors(t *testing.T) {
+
+	js := &fakeJetStream{}
+	withFakeJetStream(t, "nats://localhost", js)
+	rf, err := NewArchive("nats://localhost/captures", "requests", ".fbf", common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	for _, id := range []string{"a", "fail", "b"} {
+		rf.Write(testRequest(id))
+	}
+	if err = rf.Flush(); err == nil || !strings.Contains(err.Error(), "1 of 3") {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package null provides an archive interface that discards everything
+// (null://). Like the sum backend without the hashing, it only counts:
+// bytes, chunks and requests written. Every rotation finalizes a batch with
+// these counts, which stands for a file in FinalizedFiles and OnFinalize, so
+// recording can be benchmarked without any storage.
+package null
+
+import (
+	"strings"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type NullArchive struct {
+	common.BasicArchive
+	prefix   string
+	name     string // of the current batch
+	started  time.Time
+	bytes    int64
+	chunks   int64
+	requests int64
+}
+
+// NewArchive creates a new archive discarding what is written to it.
+// `outDir` is null://, anything after it is ignored.
+func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *NullArchive, err error) {
+
+	if !strings.HasPrefix(outDir, "null://") {
+		return nil, errors.Errorf("Unable to parse null url format (null://): %s", outDir)
+	}
+	ba, err := common.NewBasicArchive(
+		"", prefix, extension, options...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to initialize basic archive")
+	}
+
+	rf = &NullArchive{BasicArchive: *ba, prefix: prefix}
+
+	err = rf.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return rf, err
+}
+
+// OpenArchive is not supported: nothing is kept
+func OpenArchive(fileName string, bufferSize int) (rf *NullArchive, err error) {
+	return nil, errors.Errorf("Reading is not supported for null targets: %s", fileName)
+}
+
+// Fetch is not supported, see OpenArchive
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return "", false, errors.Errorf("Reading is not supported for null targets: %s", fileName)
+}
+
+// Store discards the file, there is nothing to do
+func Store(localPath, dir string) (err error) {
+	return nil
+}
+
+// List returns no files, nothing is kept
+func List(dir string) (files []string, err error) {
+	return nil, nil
+}
+
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+	return nil, nil
+}
+
+func Delete(dir string, files []string) (err error) {
+	return errors.Errorf("Deleting is not supported for null targets: %s", dir)
+}
+
+// Write satisfies io.Writer interface. Nothing is written, only counted.
+func (rf *NullArchive) Write(buf []byte) (n int, err error) {
+	rf.bytes += int64(len(buf))
+	rf.chunks++
+	return len(buf), nil
+}
+
+// AddRows counts requests, for the request rate of the batch
+func (rf *NullArchive) AddRows(n int64) {
+	rf.requests += n
+	rf.BasicArchive.AddRows(n)
+}
+
+// Read is not supported, see OpenArchive
+func (rf *NullArchive) Read(p []byte) (n int, err error) {
+	return 0, errors.New("Read not supported for null target")
+}
+
+// Flush complements io.Writer, there is nothing to flush
+func (rf *NullArchive) Flush() (err error) {
+	return nil
+}
+
+// Close finalizes the current batch, if anything was written. It can be
+// called more than once.
+func (rf *NullArchive) Close() (err error) {
+
+	if rf.name == "" {
+		return nil
+	}
+	if rf.chunks > 0 {
+		elapsed := time.Since(rf.started)
+		rf.Logger.Debug("Discarded",
+			zap.String("batch", rf.name),
+			zap.Int64("bytes", rf.bytes),
+			zap.Int64("chunks", rf.chunks),
+			zap.Int64("requests", rf.requests),
+			zap.Duration("duration", elapsed),
+			zap.Float64("requests-per-sec", float64(rf.requests)/elapsed.Seconds()))
+		rf.Finalized(common.ArchiveFileDetails{
+			FileName:      rf.name,
+			URL:           "null://" + rf.name,
+			BytesWritten:  rf.bytes,
+			ChunksWritten: rf.chunks,
+		})
+	}
+	rf.Reset()
+	rf.name = ""
+	rf.bytes, rf.chunks, rf.requests = 0, 0, 0
+	return nil
+}
+
+// Rotate finalizes the current batch, if any, and starts a new one
+func (rf *NullArchive) Rotate() (err error) {
+
+	err = rf.Close()
+	if err != nil {
+		return errors.Wrapf(err, "Error closing the current batch")
+	}
+	rf.name = common.BatchName(rf.prefix)
+	rf.started = time.Now()
+	return nil
+}
+
+// Name is the name of the current batch
+func (rf *NullArchive) Name() string {
+	return "null://" + rf.name
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package null
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"go.uber.org/zap"
+)
+
+func TestNewArchiveErrors(t *testing.T) {
+
+	if _, err := NewArchive("/tmp/null", "requests", ".fbf"); err == nil {
+		t.Fatal("no error without null://")
+	}
+	if _, err := OpenArchive("null://", 0); err == nil {
+		t.Fatal("no error reading")
+	}
+}
+
+// Each rotation finalizes a batch with what was counted, unless nothing was
+// written
+func TestCount(t *testing.T) {
+
+	rf, err := NewArchive("null://anything", "requests", ".fbf", common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := rf.Name()
+	for _, chunk := range []string{"abc", "de", "f"} {
+		if n, err := rf.Write([]byte(chunk)); err != nil || n != len(chunk) {
+			t.Fatalf("wrote %d, %v", n, err)
+		}
+	}
+	rf.AddRows(2)
+	if err = rf.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if rf.Name() == first || !strings.HasPrefix(rf.Name(), "null://requests_") {
+		t.Fatalf("got names %s then %s", first, rf.Name())
+	}
+	if err = rf.Rotate(); err != nil { // nothing written
+		t.Fatal(err)
+	}
+	rf.Write([]byte("gh"))
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := rf.FinalizedFiles()
+	if len(files) != 2 {
+		t.Fatalf("got %d batches: %+v", len(files), files)
+	}
+	details, ok := files[strings.TrimPrefix(first, "null://")]
+	if !ok || details.URL != first || details.BytesWritten != 6 || details.ChunksWritten != 3 || details.RowsWritten != 2 {
+		t.Fatalf("got %+v", files)
+	}
+}
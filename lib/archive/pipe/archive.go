@@ -0,0 +1,332 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package pipe provides archive interface for the standard output ("-") and
+// named pipes (pipe:///path/to/fifo), so recorded requests can be streamed
+// straight into another process. There are no files: all archives of the
+// same target share one output, which only ever gets complete frames, and
+// the file header once. Rotation is a no-op and nothing is compressed.
+package pipe
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Outputs are shared by all archives of the same target, and closed with
+// the last of them
+var gPipes struct {
+	sync.Mutex
+	outputs map[string]*output
+}
+
+// output is the standard output or a named pipe open for writing
+type output struct {
+	sync.Mutex
+	target string
+	fp     *os.File // nil for the standard output, which is never closed
+	w      io.Writer
+	bw     *bufio.Writer // If set, all writes are buffered
+	header []byte        // last file header written
+	refs   int
+}
+
+type PipeArchive struct {
+	common.BasicArchive
+	target  string // "-" or pipe:///path
+	out     *output
+	partial []byte // start of a frame whose end was not written yet
+	r       io.Reader
+	fp      *os.File // named pipe open for reading
+}
+
+// parsePipeURL returns the path of a named pipe, or "" for "-"
+func parsePipeURL(pipeURL string) (fifoPath string, err error) {
+
+	if pipeURL == "-" {
+		return "", nil
+	}
+	fifoPath = strings.TrimPrefix(pipeURL, "pipe://")
+	if fifoPath == pipeURL || !strings.HasPrefix(fifoPath, "/") {
+		return "", errors.Errorf("Unable to parse pipe url format (- or pipe:///path/to/fifo): %s", pipeURL)
+	}
+	return fifoPath, nil
+}
+
+// openOutput returns the output of `target`, opening it the first time. A
+// named pipe must exist; opening it blocks until a reader opens it as well.
+func openOutput(target string, bufferSize int) (out *output, err error) {
+
+	fifoPath, err := parsePipeURL(target)
+	if err != nil {
+		return nil, err
+	}
+	gPipes.Lock()
+	defer gPipes.Unlock()
+	if gPipes.outputs == nil {
+		gPipes.outputs = make(map[string]*output)
+	}
+	out, ok := gPipes.outputs[target]
+	if !ok {
+		out = &output{target: target, w: os.Stdout}
+		if fifoPath != "" {
+			out.fp, err = os.OpenFile(fifoPath, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Unable to open pipe %s", fifoPath)
+			}
+			out.w = out.fp
+		}
+		if bufferSize > 0 {
+			out.bw = bufio.NewWriterSize(out.w, bufferSize)
+			out.w = out.bw
+		}
+		gPipes.outputs[target] = out
+	}
+	out.refs++
+	return out, nil
+}
+
+// write writes complete frames, as one piece
+func (out *output) write(p []byte) (err error) {
+	out.Lock()
+	defer out.Unlock()
+	_, err = out.w.Write(p)
+	return err
+}
+
+// writeHeader writes a file header, unless it is the last one written
+func (out *output) writeHeader(header []byte) (err error) {
+
+	out.Lock()
+	defer out.Unlock()
+	if bytes.Equal(header, out.header) {
+		return nil
+	}
+	_, err = out.w.Write(header)
+	if err != nil {
+		return err
+	}
+	out.header = append(out.header[:0], header...)
+	return nil
+}
+
+func (out *output) flush() (err error) {
+	out.Lock()
+	defer out.Unlock()
+	if out.bw != nil {
+		err = out.bw.Flush()
+	}
+	return err
+}
+
+// release flushes the output, and closes it if no other archive uses it
+func (out *output) release() (err error) {
+
+	gPipes.Lock()
+	defer gPipes.Unlock()
+	err = out.flush()
+	out.refs--
+	if out.refs > 0 {
+		return err
+	}
+	delete(gPipes.outputs, out.target)
+	if out.fp != nil {
+		cerr := out.fp.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// NewArchive creates a new archive writing to the standard output ("-") or
+// a named pipe (pipe:///path/to/fifo). `prefix` and `extension` are not
+// used: there are no files, so FinalizedFiles stays empty. The buffer size
+// of the first archive of the target is that of the shared output. The
+// caller must call `rf.Close()` to flush what is buffered.
+func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *PipeArchive, err error) {
+
+	ba, err := common.NewBasicArchive(
+		"", prefix, extension, options...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to initialize basic archive")
+	}
+	out, err := openOutput(outDir, ba.WriteBufferSize())
+	if err != nil {
+		return nil, err
+	}
+
+	rf = &PipeArchive{BasicArchive: *ba,
+		target: outDir,
+		out:    out}
+
+	err = rf.Rotate()
+	if err != nil {
+		rf.Close()
+		return nil, err
+	}
+	return rf, err
+}
+
+// OpenArchive opens the standard input ("-") or a named pipe for reading.
+// `*PipeArchive` returned is an io.Reader
+func OpenArchive(fileName string, bufferSize int) (rf *PipeArchive, err error) {
+
+	fifoPath, err := parsePipeURL(fileName)
+	if err != nil {
+		return nil, err
+	}
+	rf = &PipeArchive{target: fileName, r: os.Stdin}
+	rf.Logger = common.DefaultLogger
+	if fifoPath != "" {
+		rf.fp, err = os.Open(fifoPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to open pipe %s", fifoPath)
+		}
+		rf.r = rf.fp
+	}
+	if bufferSize > 0 {
+		rf.r = bufio.NewReaderSize(rf.r, bufferSize)
+	}
+	return rf, nil
+}
+
+// Fetch is not supported: what is read from a pipe is gone
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return "", false, errors.Errorf("Fetching is not supported for pipes: %s", fileName)
+}
+
+// Store writes the requests of a local archive file (compressed or not) to
+// the pipe of `dir`
+func Store(localPath, dir string) (err error) {
+
+	rf, err := NewArchive(dir, "", "", common.Logger(common.DefaultLogger))
+	if err != nil {
+		return err
+	}
+	err = common.CopyFile(rf, localPath)
+	if err != nil {
+		rf.Close()
+		return errors.Wrapf(err, "Unable to write %s to %s", localPath, dir)
+	}
+	return rf.Close()
+}
+
+func List(dir string) (files []string, err error) {
+	return nil, errors.Errorf("Listing is not supported for pipes: %s", dir)
+}
+
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+	return nil, errors.Errorf("Listing is not supported for pipes: %s", dir)
+}
+
+func Delete(dir string, files []string) (err error) {
+	return errors.Errorf("Deleting is not supported for pipes: %s", dir)
+}
+
+// Write satisfies io.Writer interface. Complete frames are written to the
+// output, the start of a frame is kept until the rest is written, so frames
+// of archives sharing the output are never mixed.
+func (rf *PipeArchive) Write(buf []byte) (n int, err error) {
+
+	if rf.out == nil {
+		return 0, errors.New("pipe is not opened for write")
+	}
+	data := buf
+	if len(rf.partial) > 0 {
+		rf.partial = append(rf.partial, buf...)
+		data = rf.partial
+	}
+	complete, err := common.CompleteFrames(data)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to write to %s", rf.target)
+	}
+	if complete > 0 {
+		err = rf.out.write(data[:complete])
+		if err != nil {
+			return 0, errors.Wrapf(err, "Unable to write to %s", rf.target)
+		}
+		rf.ChunksWritten++
+		rf.AddStored(int64(complete))
+	}
+	rf.partial = append(rf.partial[:0], data[complete:]...)
+	return len(buf), nil
+}
+
+// Read satisfies io.Reader interface
+func (rf *PipeArchive) Read(p []byte) (n int, err error) {
+	if rf.r == nil {
+		return 0, errors.New("pipe is not opened for read")
+	}
+	return rf.r.Read(p)
+}
+
+// Flush writes out what the shared output buffers
+func (rf *PipeArchive) Flush() (err error) {
+	if rf.out == nil {
+		return nil
+	}
+	return rf.out.flush()
+}
+
+// Close flushes the output, closed with the last archive using it. It can
+// be called more than once.
+func (rf *PipeArchive) Close() (err error) {
+
+	if rf.fp != nil {
+		err = rf.fp.Close()
+		rf.fp = nil
+	}
+	if rf.out == nil {
+		return err
+	}
+	if len(rf.partial) > 0 {
+		rf.Logger.Warn("Incomplete frame left unwritten",
+			zap.String("pipe", rf.target), zap.Int("bytes", len(rf.partial)))
+		rf.partial = rf.partial[:0]
+	}
+	err = rf.out.release()
+	rf.out = nil
+	if err != nil {
+		return errors.Wrapf(err, "Unable to flush %s", rf.target)
+	}
+	return nil
+}
+
+// Rotate is a no-op, but for writing the file header if it is not the last
+// one the output got
+func (rf *PipeArchive) Rotate() (err error) {
+
+	if rf.out == nil {
+		return errors.New("pipe is not opened for write")
+	}
+	if header := rf.Header(); header != nil {
+		err = rf.out.writeHeader(header)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to write file header to %s", rf.target)
+		}
+	}
+	return nil
+}
+
+// Name is "-" or the pipe URL
+func (rf *PipeArchive) Name() string {
+	return rf.target
+}
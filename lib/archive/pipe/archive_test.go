@@ -0,0 +1,125 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package pipe
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/frame"
+	"go.uber.org/zap"
+)
+
+// testFrame is a frame of `payload`
+func testFrame(payload string) []byte {
+	buf := make([]byte, frame.PrefixLen, frame.PrefixLen+len(payload))
+	frame.PutPrefix(buf, len(payload), 0)
+	return append(buf, payload...)
+}
+
+func TestParsePipeURL(t *testing.T) {
+
+	tests := []struct {
+		url, path string
+		err       bool
+	}{
+		{"-", "", false},
+		{"pipe:///tmp/fifo", "/tmp/fifo", false},
+		{"pipe://tmp/fifo", "", true},
+		{"/tmp/fifo", "", true},
+	}
+	for _, tt := range tests {
+		if path, err := parsePipeURL(tt.url); path != tt.path || (err != nil) != tt.err {
+			t.Fatalf("%s: got %q, %v", tt.url, path, err)
+		}
+	}
+}
+
+// Archives of the same pipe share it: the header is written once and
+// frames are never mixed, however they are split across writes
+func TestSharedPipe(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fifoPath := filepath.Join(dir, "fifo")
+	if err = syscall.Mkfifo(fifoPath, 0600); err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		data []byte
+		err  error
+	}
+	read := make(chan result, 1)
+	go func() {
+		rf, err := OpenArchive("pipe://"+fifoPath, 0)
+		if err != nil {
+			read <- result{err: err}
+			return
+		}
+		defer rf.Close()
+		data, err := ioutil.ReadAll(rf)
+		read <- result{data, err}
+	}()
+
+	header := []byte("HDR")
+	options := []func(*common.BasicArchive) error{
+		common.Logger(zap.NewNop()),
+		common.FileHeader(func() []byte { return header }),
+		common.BufferSize(64),
+	}
+	a, err := NewArchive("pipe://"+fifoPath, "requests", ".fbf", options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewArchive("pipe://"+fifoPath, "requests", ".fbf", options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fa, fb, fc := testFrame("first"), testFrame("second"), testFrame("left")
+	for _, w := range []struct {
+		rf  *PipeArchive
+		buf []byte
+	}{{a, fa[:3]}, {b, fb}, {a, fa[3:]}, {a, fc[:5]}} {
+		if _, err = w.rf.Write(w.buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Close(); err != nil { // the last one closes the pipe
+		t.Fatal(err)
+	}
+
+	r := <-read
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if want := bytes.Join([][]byte{header, fb, fa}, nil); !bytes.Equal(r.data, want) {
+		t.Fatalf("got %q, want %q", r.data, want)
+	}
+	if _, err = a.Write(fa); err == nil {
+		t.Fatal("no error writing once closed")
+	}
+}
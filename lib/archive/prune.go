@@ -0,0 +1,76 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package archive
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/pkg/errors"
+)
+
+// Prune deletes the files of directory `dir`, any URL supported by
+// ListDetails and Delete, last modified more than `olderThan` ago, and
+// returns them. Files being written (.tmp) or recovered (.part) are left
+// alone, as are the entries of backends that have no modification time.
+// Directories of other backends (streams, databases) are refused.
+func Prune(dir string, olderThan time.Duration) (pruned []common.ArchiveEntry, err error) {
+	return PruneContext(context.Background(), dir, olderThan)
+}
+
+// PruneContext is Prune, with the requests of remote backends made with
+// `ctx`
+func PruneContext(ctx context.Context, dir string, olderThan time.Duration) (pruned []common.ArchiveEntry, err error) {
+
+	if olderThan <= 0 {
+		return nil, errors.Errorf("Retention must be positive, got %s", olderThan)
+	}
+	if !Prunable(dir) {
+		return nil, errors.Errorf("Retention not supported for %s", dir)
+	}
+	entries, err := ListDetailsContext(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	var names []string
+	for _, entry := range entries {
+		if entry.ModTime.IsZero() || !entry.ModTime.Before(cutoff) ||
+			strings.HasSuffix(entry.Name, ".tmp") || strings.HasSuffix(entry.Name, ".part") {
+			continue
+		}
+		names = append(names, entry.Name)
+		pruned = append(pruned, entry)
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	err = DeleteContext(ctx, dir, names)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to prune %s", dir)
+	}
+	return pruned, nil
+}
+
+// Prunable tells if files of `dir` can be pruned: it is a directory of a file
+// store, which lists and deletes files
+func Prunable(dir string) bool {
+	switch getProto(dir) {
+	case "file", "s3", "az", "adls", "gs", "sftp", "hdfs":
+		return true
+	}
+	return false
+}
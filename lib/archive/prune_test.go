@@ -0,0 +1,146 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// tempDir is a directory removed at the end of the test
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestPrune(t *testing.T) {
+
+	now := time.Now()
+	files := map[string]time.Time{ // relative to captures, modified at
+		"new.fbf":                     now,
+		"hour.fbf":                    now.Add(-time.Hour),
+		"day.fbf":                     now.Add(-24 * time.Hour),
+		"2021/03/01/week.fbf":         now.Add(-7 * 24 * time.Hour),
+		"writing.fbf.tmp":             now.Add(-24 * time.Hour),
+		"recovering.fbf.part":         now.Add(-24 * time.Hour),
+		"../captures-old/sibling.fbf": now.Add(-7 * 24 * time.Hour),
+	}
+
+	tests := []struct {
+		name      string
+		olderThan time.Duration
+		pruned    []string
+	}{
+		{"week and a day", 8 * 24 * time.Hour, nil},
+		{"two days", 48 * time.Hour, []string{"2021/03/01/week.fbf"}},
+		{"two hours", 2 * time.Hour, []string{"2021/03/01/week.fbf", "day.fbf"}},
+		{"a minute", time.Minute, []string{"2021/03/01/week.fbf", "day.fbf", "hour.fbf"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(tempDir(t), "captures")
+			for name, modTime := range files {
+				fileName := filepath.Join(dir, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(fileName, []byte(name), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(fileName, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			entries, err := Prune(dir, tt.olderThan)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var pruned []string
+			for _, entry := range entries {
+				pruned = append(pruned, entry.Name)
+			}
+			sort.Strings(pruned)
+			if !reflect.DeepEqual(pruned, tt.pruned) {
+				t.Fatalf("got %q pruned, want %q", pruned, tt.pruned)
+			}
+			for name := range files {
+				_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+				if deleted := os.IsNotExist(err); deleted != contains(tt.pruned, name) {
+					t.Fatalf("%s: deleted %v", name, deleted)
+				}
+			}
+		})
+	}
+}
+
+func TestPruneRefused(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		dir       string
+		olderThan time.Duration
+	}{
+		{"no retention", tempDir(t), 0},
+		{"negative retention", tempDir(t), -time.Hour},
+		{"stream", "kafka://localhost:9092/requests", time.Hour},
+		{"collector", "tcp://localhost:9000", time.Hour},
+		{"null", "null://", time.Hour},
+		{"checksums", "sum://", time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if pruned, err := Prune(tt.dir, tt.olderThan); err == nil {
+				t.Fatalf("no error, %d pruned", len(pruned))
+			}
+		})
+	}
+}
+
+func TestPrunable(t *testing.T) {
+
+	tests := []struct {
+		dir      string
+		prunable bool
+	}{
+		{"/var/captures", true},
+		{"file:///var/captures", true},
+		{"s3://bucket/captures", true},
+		{"gs://bucket/captures", true},
+		{"kafka://localhost:9092/requests", false},
+		{"null://", false},
+	}
+	for _, tt := range tests {
+		if got := Prunable(tt.dir); got != tt.prunable {
+			t.Errorf("%s: got %v", tt.dir, got)
+		}
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package pubsub provides archive interface for Google Pub/Sub topics.
+// Nothing is written to files: every request written to the archive is
+// published as one message, whose data is the request flatbuffer
+// (fbr.Request) and whose `request_id` attribute is the ID of the request.
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/pkg/errors"
+)
+
+// Batches are sent once BufferSize bytes (pubsub.DefaultPublishSettings
+// otherwise, 1 MB) are pending, or after batchDelay. Pub/Sub takes up to
+// pubsub.MaxPublishRequestBytes per request.
+const batchDelay = 10 * time.Millisecond
+
+// maxPending is how many messages are published before waiting for their
+// acknowledgement, which Flush and Close do as well
+const maxPending = 10000
+
+// Clients are shared by all archives of a project, so they are created once
+// per process (with application default credentials) and never closed.
+var gPubSubSession struct {
+	sync.Mutex
+	clients map[string]*pubsub.Client
+}
+
+var pubsubUrlRegex = regexp.MustCompile("^pubsub://([^/]+)/([^/]+)/?$")
+
+type PubSubArchive struct {
+	common.Publisher
+	topic    *pubsub.Topic
+	results  []*pubsub.PublishResult
+	pendSize int // bytes of results
+}
+
+// getClient returns the client of a project, creating it the first time
+func getClient(project string) (client *pubsub.Client, err error) {
+
+	gPubSubSession.Lock()
+	defer gPubSubSession.Unlock()
+	if gPubSubSession.clients == nil {
+		gPubSubSession.clients = make(map[string]*pubsub.Client)
+	}
+	client, ok := gPubSubSession.clients[project]
+	if !ok {
+		client, err = pubsub.NewClient(context.Background(), project)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to create pubsub client with application default credentials")
+		}
+		gPubSubSession.clients[project] = client
+	}
+	return client, nil
+}
+
+// parsePubSubURL splits pubsub://project/topic into project and topic
+func parsePubSubURL(pubsubURL string) (project, topic string, err error) {
+
+	parts := pubsubUrlRegex.FindStringSubmatch(pubsubURL)
+	if len(parts) != 3 {
+		return "", "", errors.Errorf("Unable to parse pubsub url format (pubsub://project/topic): %s", pubsubURL)
+	}
+	return parts[1], parts[2], nil
+}
+
+// NewArchive creates a new archive publishing to a Pub/Sub topic. `outDir`
+// is pubsub://project/topic. Messages are sent in batches of up to
+// BufferSize bytes. Rotate waits for what is pending and starts a new
+// batch, which stands for a file in FinalizedFiles and OnFinalize.
+// The caller must call `rf.Close()` to publish what is left.
+func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *PubSubArchive, err error) {
+
+	project, topicID, err := parsePubSubURL(outDir)
+	if err != nil {
+		return nil, err
+	}
+	client, err := getClient(project)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to initialize pubsub connection")
+	}
+	p, err := common.NewPublisher(fmt.Sprintf("pubsub://%s/%s", project, topicID),
+		"pubsub", prefix, extension, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	rf = &PubSubArchive{Publisher: *p, topic: client.Topic(topicID)}
+	rf.topic.PublishSettings.DelayThreshold = batchDelay
+	if size := rf.WriteBufferSize(); size > 0 {
+		if size > pubsub.MaxPublishRequestBytes {
+			size = pubsub.MaxPublishRequestBytes
+		}
+		rf.topic.PublishSettings.ByteThreshold = size
+		rf.topic.PublishSettings.CountThreshold = pubsub.MaxPublishRequestCount
+	}
+	rf.Frames.OnRequest = rf.add
+	rf.OnFlush = rf.wait
+
+	err = rf.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return rf, err
+}
+
+// OpenArchive is not supported: topics are read with subscriptions
+func OpenArchive(fileName string, bufferSize int) (rf *PubSubArchive, err error) {
+	return nil, common.NotSupported("Reading", "pubsub topics", fileName)
+}
+
+// Fetch is not supported, see OpenArchive
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return "", false, common.NotSupported("Reading", "pubsub topics", fileName)
+}
+
+// Store publishes the requests of a local archive file (compressed or not)
+// to the topic of `dir`
+func Store(localPath, dir string) (err error) {
+
+	rf, err := NewArchive(dir, "", "", common.Logger(common.DefaultLogger))
+	if err != nil {
+		return err
+	}
+	return rf.Store(localPath)
+}
+
+func List(dir string) (files []string, err error) {
+	return nil, common.NotSupported("Listing", "pubsub topics", dir)
+}
+
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+	return nil, common.NotSupported("Listing", "pubsub topics", dir)
+}
+
+func Delete(dir string, files []string) (err error) {
+	return common.NotSupported("Deleting", "pubsub topics", dir)
+}
+
+// add publishes a request payload, with its ID as attribute, waiting for
+// the acknowledgement of what was published once maxPending are pending
+func (rf *PubSubArchive) add(payload []byte) error {
+
+	data := make([]byte, len(payload))
+	copy(data, payload) // payload is only valid during the call
+	msg := &pubsub.Message{Data: data}
+	if id := fbr.GetRootAsRequest(data, 0).Id(); len(id) > 0 {
+		msg.Attributes = map[string]string{"request_id": string(id)}
+	}
+	rf.results = append(rf.results, rf.topic.Publish(context.Background(), msg))
+	rf.pendSize += len(data)
+	if len(rf.results) >= maxPending {
+		return rf.wait()
+	}
+	return nil
+}
+
+// wait waits for the acknowledgement of everything published. Returns the
+// first error, after waiting for all of them.
+func (rf *PubSubArchive) wait() (err error) {
+
+	if len(rf.results) == 0 {
+		return nil
+	}
+	failed := 0
+	for i, res := range rf.results {
+		_, perr := res.Get(context.Background())
+		if perr != nil {
+			failed++
+			if err == nil {
+				err = perr
+			}
+		}
+		rf.results[i] = nil
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "Unable to publish %d of %d requests to %s", failed, len(rf.results), rf.URL)
+	}
+	rf.Published(len(rf.results)-failed, rf.pendSize) // bytes close enough when some failed
+	rf.results = rf.results[:0]
+	rf.pendSize = 0
+	return err
+}
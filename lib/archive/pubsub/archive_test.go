@@ -0,0 +1,145 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/frame"
+	flatbuffers "github.com/google/flatbuffers/go"
+	"go.uber.org/zap"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// testRequest is the frame of a request of ID `id`
+func testRequest(id string) []byte {
+	b := flatbuffers.NewBuilder(0)
+	idOffset := b.CreateString(id)
+	uri := b.CreateString("/" + id)
+	fbr.RequestStart(b)
+	fbr.RequestAddId(b, idOffset)
+	fbr.RequestAddUri(b, uri)
+	b.Finish(fbr.RequestEnd(b))
+	payload := b.FinishedBytes()
+	buf := make([]byte, frame.PrefixLen, frame.PrefixLen+len(payload))
+	frame.PutPrefix(buf, len(payload), 0)
+	return append(buf, payload...)
+}
+
+// withFakePubSub has the client of `project` use a fake server, with topic
+// `topic`, for the test
+func withFakePubSub(t *testing.T, project, topic string) *pstest.Server {
+
+	srv := pstest.NewServer()
+	client, err := pubsub.NewClient(context.Background(), project,
+		option.WithEndpoint(srv.Addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.CreateTopic(context.Background(), topic); err != nil {
+		t.Fatal(err)
+	}
+	gPubSubSession.Lock()
+	if gPubSubSession.clients == nil {
+		gPubSubSession.clients = make(map[string]*pubsub.Client)
+	}
+	gPubSubSession.clients[project] = client
+	gPubSubSession.Unlock()
+	t.Cleanup(func() {
+		gPubSubSession.Lock()
+		delete(gPubSubSession.clients, project)
+		gPubSubSession.Unlock()
+		client.Close()
+		srv.Close()
+	})
+	return srv
+}
+
+func TestParsePubSubURL(t *testing.T) {
+
+	tests := []struct {
+		url, project, topic string
+		err                 bool
+	}{
+		{"pubsub://project/captures", "project", "captures", false},
+		{"pubsub://project/captures/", "project", "captures", false},
+		{"pubsub://project", "", "", true},
+		{"pubsub://project/captures/sub", "", "", true},
+	}
+	for _, tt := range tests {
+		project, topic, err := parsePubSubURL(tt.url)
+		if project != tt.project || topic != tt.topic || (err != nil) != tt.err {
+			t.Fatalf("%s: got %q, %q, %v", tt.url, project, topic, err)
+		}
+	}
+}
+
+// Every request is a message, with its ID as attribute
+func TestPublish(t *testing.T) {
+
+	srv := withFakePubSub(t, "project", "captures")
+	rf, err := NewArchive("pubsub://project/captures", "requests", ".fbf", common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := rf.Batch
+	for i := 0; i < 10; i++ {
+		if _, err = rf.Write(testRequest(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 10 {
+		t.Fatalf("got %d messages", len(msgs))
+	}
+	for _, msg := range msgs {
+		id := string(fbr.GetRootAsRequest(msg.Data, 0).Id())
+		if msg.Attributes["request_id"] != id {
+			t.Fatalf("got message of %s with attributes %v", id, msg.Attributes)
+		}
+	}
+	files := rf.FinalizedFiles()
+	if details, ok := files[batch]; len(files) != 1 || !ok || details.ChunksWritten != 10 {
+		t.Fatalf("got %+v", files)
+	}
+}
+
+// Messages that were not published fail the flush
+func TestPublishErrors(t *testing.T) {
+
+	withFakePubSub(t, "project", "captures")
+	rf, err := NewArchive("pubsub://project/missing", "requests", ".fbf", common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	rf.Write(testRequest("0"))
+	rf.Write(testRequest("1"))
+	if err = rf.Flush(); err == nil || !strings.Contains(err.Error(), "2 of 2") {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package redis provides archive interface for Redis Streams. Nothing is
+// written to files: every request written to the archive is added to the
+// stream (XADD) as one entry, with fields `id`, `method`, `uri` and `body`
+// of the request. Commands are pipelined and their replies checked on
+// Flush, Rotate and Close.
+package redis
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// Commands are sent once this many of them, or this many bytes, are
+// pending, and on Flush, Rotate and Close
+const (
+	publishCount = 1000
+	publishBytes = 4 * 1024 * 1024
+)
+
+// timeout bounds connecting, and every read or write of the connection
+const timeout = 30 * time.Second
+
+type RedisArchive struct {
+	common.Publisher
+	server    string // redis://[user:pass@]host:port, to connect to
+	stream    string
+	maxLen    string     // of the stream, approximate, if set
+	conn      redis.Conn // nil until connected, and after an error
+	pending   int        // commands sent, reply not read yet
+	pendBytes int
+}
+
+// parseRedisURL splits redis://[user:pass@]host[:port]/stream[?maxlen=N]
+// (rediss:// for TLS) into the server to connect to, stream and maximum
+// length
+func parseRedisURL(redisURL string) (server, stream, maxLen string, err error) {
+
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return "", "", "", errors.Wrapf(err, "Unable to parse redis url: %s", redisURL)
+	}
+	stream = strings.Trim(u.Path, "/")
+	if u.Host == "" || stream == "" || strings.Contains(stream, "/") {
+		return "", "", "", errors.Errorf("Unable to parse redis url format (redis://host:port/stream): %s", redisURL)
+	}
+	maxLen = u.Query().Get("maxlen")
+	if maxLen != "" {
+		if _, err = strconv.ParseUint(maxLen, 10, 64); err != nil {
+			return "", "", "", errors.Errorf("Invalid maxlen in redis url: %s", redisURL)
+		}
+	}
+	u.Path, u.RawQuery = "", ""
+	return u.String(), stream, maxLen, nil
+}
+
+// NewArchive creates a new archive adding requests to a Redis stream.
+// `outDir` is redis://[user:pass@]host:port/stream, rediss:// for TLS. With
+// `?maxlen=N`, the stream is trimmed to about N entries as they are added.
+// Rotate waits for what is pending and starts a new batch, which stands for
+// a file in FinalizedFiles and OnFinalize. The caller must call
+// `rf.Close()` to send what is left.
+func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *RedisArchive, err error) {
+
+	server, stream, maxLen, err := parseRedisURL(outDir)
+	if err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(server)
+	u.User = nil
+	p, err := common.NewPublisher(u.String()+"/"+stream, "redis", prefix, extension, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	rf = &RedisArchive{Publisher: *p,
+		server: server,
+		stream: stream,
+		maxLen: maxLen}
+	rf.Frames.OnRequest = rf.add
+	rf.OnFlush = rf.wait
+	rf.OnClose = func() error {
+		rf.disconnect()
+		return nil
+	}
+
+	err = rf.connect()
+	if err != nil {
+		return nil, err
+	}
+	err = rf.Rotate()
+	if err != nil {
+		rf.disconnect()
+		return nil, err
+	}
+	return rf, err
+}
+
+// connect connects to the server. Every archive has its connection.
+func (rf *RedisArchive) connect() (err error) {
+
+	rf.conn, err = redis.DialURL(rf.server,
+		redis.DialConnectTimeout(timeout),
+		redis.DialReadTimeout(timeout),
+		redis.DialWriteTimeout(timeout))
+	if err != nil {
+		rf.conn = nil
+		return errors.Wrapf(err, "Unable to connect to %s", rf.URL)
+	}
+	return nil
+}
+
+// disconnect drops the connection, and with it the replies not read yet
+func (rf *RedisArchive) disconnect() {
+	if rf.conn != nil {
+		rf.conn.Close()
+		rf.conn = nil
+	}
+	rf.pending, rf.pendBytes = 0, 0
+}
+
+// OpenArchive is not supported: streams are read with XREAD
+func OpenArchive(fileName string, bufferSize int) (rf *RedisArchive, err error) {
+	return nil, common.NotSupported("Reading", "redis streams", fileName)
+}
+
+// Fetch is not supported, see OpenArchive
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return "", false, common.NotSupported("Reading", "redis streams", fileName)
+}
+
+// Store adds the requests of a local archive file (compressed or not) to
+// the stream of `dir`
+func Store(localPath, dir string) (err error) {
+
+	rf, err := NewArchive(dir, "", "", common.Logger(common.DefaultLogger))
+	if err != nil {
+		return err
+	}
+	return rf.Store(localPath)
+}
+
+func List(dir string) (files []string, err error) {
+	return nil, common.NotSupported("Listing", "redis streams", dir)
+}
+
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+	return nil, common.NotSupported("Listing", "redis streams", dir)
+}
+
+func Delete(dir string, files []string) (err error) {
+	return common.NotSupported("Deleting", "redis streams", dir)
+}
+
+// add sends the XADD of a request, connecting again after an error. The
+// reply is read by wait, once publishCount or publishBytes are pending.
+func (rf *RedisArchive) add(payload []byte) (err error) {
+
+	if rf.conn == nil {
+		err = rf.connect()
+		if err != nil {
+			return err
+		}
+	}
+	req := fbr.GetRootAsRequest(payload, 0)
+	args := make([]interface{}, 0, 12)
+	args = append(args, rf.stream)
+	if rf.maxLen != "" {
+		args = append(args, "MAXLEN", "~", rf.maxLen)
+	}
+	args = append(args, "*",
+		"id", req.Id(),
+		"method", req.Method(),
+		"uri", req.Uri(),
+		"body", req.BodyBytes())
+	err = rf.conn.Send("XADD", args...) // written out (buffered) right away
+	if err != nil {
+		rf.disconnect()
+		return errors.Wrapf(err, "Unable to add to %s", rf.URL)
+	}
+	rf.pending++
+	rf.pendBytes += len(payload)
+	if rf.pending >= publishCount || rf.pendBytes >= publishBytes {
+		return rf.wait()
+	}
+	return nil
+}
+
+// wait sends what is buffered and reads the replies of the commands sent.
+// Returns the first error, after reading all of them.
+func (rf *RedisArchive) wait() (err error) {
+
+	if rf.pending == 0 {
+		return nil
+	}
+	err = rf.conn.Flush()
+	if err != nil {
+		failed := rf.pending
+		rf.disconnect()
+		return errors.Wrapf(err, "Unable to add %d requests to %s", failed, rf.URL)
+	}
+	failed := 0
+	for i := 0; i < rf.pending; i++ {
+		_, rerr := rf.conn.Receive()
+		if rerr == nil {
+			continue
+		}
+		if _, ok := rerr.(redis.Error); !ok { // the connection failed
+			failed += rf.pending - i
+			err = rerr
+			break
+		}
+		failed++
+		if err == nil {
+			err = rerr
+		}
+	}
+	rf.Published(rf.pending-failed, rf.pendBytes) // bytes close enough when some failed
+	if err != nil {
+		err = errors.Wrapf(err, "Unable to add %d of %d requests to %s", failed, rf.pending, rf.URL)
+		rf.disconnect()
+	}
+	rf.pending, rf.pendBytes = 0, 0
+	return err
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/frame"
+	flatbuffers "github.com/google/flatbuffers/go"
+	"go.uber.org/zap"
+)
+
+// testRequest is the frame of a request to `uri`
+func testRequest(id, uri string) []byte {
+	b := flatbuffers.NewBuilder(0)
+	idOffset := b.CreateString(id)
+	method := b.CreateString("POST")
+	uriOffset := b.CreateString(uri)
+	body := b.CreateByteVector([]byte("body\r\n"))
+	fbr.RequestStart(b)
+	fbr.RequestAddId(b, idOffset)
+	fbr.RequestAddMethod(b, method)
+	fbr.RequestAddUri(b, uriOffset)
+	fbr.RequestAddBody(b, body)
+	b.Finish(fbr.RequestEnd(b))
+	payload := b.FinishedBytes()
+	buf := make([]byte, frame.PrefixLen, frame.PrefixLen+len(payload))
+	frame.PutPrefix(buf, len(payload), 0)
+	return append(buf, payload...)
+}
+
+// fakeRedis answers XADD, failing those of requests to /fail, and keeps
+// the commands it gets
+type fakeRedis struct {
+	mu       sync.Mutex
+	commands [][]string
+}
+
+// readCommand reads a command, an array of bulk strings
+func readCommand(r *bufio.Reader) (args []string, err error) {
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, size+2)
+		if _, err = io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args = append(args, string(arg[:size]))
+	}
+	return args, nil
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		fr.mu.Lock()
+		fr.commands = append(fr.commands, args)
+		seq := len(fr.commands)
+		fr.mu.Unlock()
+		switch {
+		case args[0] != "XADD":
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		case strings.Contains(strings.Join(args, " "), " uri /fail "):
+			fmt.Fprint(conn, "-ERR failed\r\n")
+		default:
+			id := fmt.Sprintf("1-%d", seq)
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(id), id)
+		}
+	}
+}
+
+// listen runs `fr` until the end of the test, and returns its address
+func (fr *fakeRedis) listen(t *testing.T) string {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestParseRedisURL(t *testing.T) {
+
+	tests := []struct {
+		url, server, stream, maxLen string
+		err                         bool
+	}{
+		{"redis://localhost:6379/requests", "redis://localhost:6379", "requests", "", false},
+		{"rediss://u:p@cache:6380/requests/?maxlen=1000", "rediss://u:p@cache:6380", "requests", "1000", false},
+		{"redis://localhost:6379/", "", "", "", true},
+		{"redis://localhost:6379/a/b", "", "", "", true},
+		{"redis://localhost:6379/requests?maxlen=-1", "", "", "", true},
+	}
+	for _, tt := range tests {
+		server, stream, maxLen, err := parseRedisURL(tt.url)
+		if server != tt.server || stream != tt.stream || maxLen != tt.maxLen || (err != nil) != tt.err {
+			t.Fatalf("%s: got %q, %q, %q, %v", tt.url, server, stream, maxLen, err)
+		}
+	}
+}
+
+// Requests are added as entries, trimming the stream if asked
+func TestAdd(t *testing.T) {
+
+	fr := &fakeRedis{}
+	rf, err := NewArchive("redis://"+fr.listen(t)+"/requests?maxlen=100", "requests", ".fbf",
+		common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := rf.Batch
+	for i := 0; i < 3; i++ {
+		if _, err = rf.Write(testRequest(fmt.Sprint(i), "/events")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fr.commands) != 3 {
+		t.Fatalf("got %q", fr.commands)
+	}
+	want := "XADD requests MAXLEN ~ 100 * id 2 method POST uri /events body body\r\n"
+	if got := strings.Join(fr.commands[2], " "); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	files := rf.FinalizedFiles()
+	if details, ok := files[batch]; len(files) != 1 || !ok || details.ChunksWritten != 3 {
+		t.Fatalf("got %+v", files)
+	}
+}
+
+// Entries that failed fail the flush, the others are added
+func TestAddErrors(t *testing.T) {
+
+	fr := &fakeRedis{}
+	rf, err := NewArchive("redis://"+fr.listen(t)+"/requests", "requests", ".fbf", common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	for _, uri := range []string{"/a", "/fail", "/b"} {
+		rf.Write(testRequest(uri, uri))
+	}
+	if err = rf.Flush(); err == nil || !strings.Contains(err.Error(), "1 of 3") {
+		t.Fatalf("got %v", err)
+	}
+
+	// Connected again for what comes next
+	rf.Write(testRequest("/c", "/c"))
+	if err = rf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fr.commands) != 4 || strings.Join(fr.commands[0][:2], " ") != "XADD requests" {
+		t.Fatalf("got %q", fr.commands)
+	}
+}
@@ -15,18 +15,27 @@ package s3f
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"regexp"
-	"strings"
+	"strconv"
 	"sync"
 
 	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
@@ -38,8 +47,52 @@ var gS3Session struct {
 	S3Downloader *manager.Downloader
 }
 
+// defaultRegion is the region of requests to an S3-compatible store when
+// none is configured
+const defaultRegion = "us-east-1"
+
 var s3UrlRegex = regexp.MustCompile("([^/:]+)://([^/]+)/(.*?)$")
 
+// Parts downloaded in parallel and their size, for each object. Zero means
+// the SDK default (5 parts of 5 MB). See SetDownloadOptions.
+var downloadConcurrency int
+var downloadPartSize int64
+
+// Bandwidth of uploads and downloads, see SetThrottle. Nil - no limit.
+var uploadThrottle, downloadThrottle *common.Throttle
+
+// S3-compatible store (MinIO, Ceph, ...) used instead of AWS, see SetEndpoint.
+// Unless set, taken from the environment when the client is created.
+var endpoint struct {
+	set       bool
+	url       string
+	pathStyle bool
+	insecure  bool
+}
+
+// Parameters of objects uploaded, see SetUploadOptions. Unless set, taken
+// from the environment when the client is created.
+var uploadOptions struct {
+	set          bool
+	storageClass types.StorageClass
+	sse          types.ServerSideEncryption
+	kmsKeyID     string
+	tagging      string
+}
+
+// Profile, region and role the client takes its credentials from, see
+// SetCredentials. Unless set, the role is taken from the environment when the
+// client is created (the SDK reads AWS_PROFILE and AWS_REGION itself).
+var awsCredentials struct {
+	set     bool
+	profile string
+	region  string
+	roleARN string
+}
+
+// roleSessionName names the sessions of the role assumed, in CloudTrail
+const roleSessionName = "blackhole"
+
 type S3Archive struct {
 	common.BasicArchive
 	bucketName string
@@ -50,20 +103,88 @@ func s3Init() (err error) {
 	gS3Session.Lock() // gS3Session is goroutine safe only after it has been instantiated
 	defer gS3Session.Unlock()
 	if gS3Session.S3Client == nil {
-		cfg, err := config.LoadDefaultConfig(context.TODO())
+		if !endpoint.set {
+			endpointFromEnv()
+		}
+		if !uploadOptions.set {
+			err = uploadOptionsFromEnv()
+			if err != nil {
+				return err
+			}
+		}
+		var loadOptions []func(*config.LoadOptions) error
+		if endpoint.insecure {
+			loadOptions = append(loadOptions, config.WithHTTPClient(awshttp.NewBuildableClient().
+				WithTransportOptions(func(tr *http.Transport) {
+					if tr.TLSClientConfig == nil {
+						tr.TLSClientConfig = &tls.Config{}
+					}
+					tr.TLSClientConfig.InsecureSkipVerify = true
+				})))
+		}
+		cfg, err := loadConfig(context.TODO(), loadOptions...)
 		if err != nil {
-			return errors.Wrap(err, "Unable to load default s3 config")
+			return err
+		}
+		if endpoint.url != "" && cfg.Region == "" {
+			cfg.Region = defaultRegion // S3-compatible stores mostly ignore it, the SDK requires it
 		}
-		gS3Session.S3Client = s3.NewFromConfig(cfg)
+		gS3Session.S3Client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+			if endpoint.url != "" {
+				o.EndpointResolver = s3.EndpointResolverFromURL(endpoint.url)
+				o.UsePathStyle = endpoint.pathStyle
+			}
+		})
 		gS3Session.S3Uploader = manager.NewUploader(gS3Session.S3Client)
 		gS3Session.S3Downloader = manager.NewDownloader(gS3Session.S3Client)
 	}
 	return err
 }
 
+// LoadConfig loads the AWS config of the profile, region and role of
+// SetCredentials (or the environment), for other AWS services to take their
+// credentials from the same place as s3:// archives. The endpoint of
+// SetEndpoint is S3's alone.
+func LoadConfig(ctx context.Context) (cfg aws.Config, err error) {
+	gS3Session.Lock()
+	defer gS3Session.Unlock()
+	return loadConfig(ctx)
+}
+
+// loadConfig is LoadConfig, with `loadOptions` added, gS3Session locked
+func loadConfig(ctx context.Context, loadOptions ...func(*config.LoadOptions) error) (cfg aws.Config, err error) {
+
+	if !awsCredentials.set {
+		credentialsFromEnv()
+	}
+	if awsCredentials.profile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(awsCredentials.profile))
+	}
+	if awsCredentials.region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(awsCredentials.region))
+	}
+	cfg, err = config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return cfg, errors.Wrap(err, "Unable to load default aws config")
+	}
+	if awsCredentials.roleARN != "" {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg),
+			awsCredentials.roleARN, func(o *stscreds.AssumeRoleOptions) {
+				o.RoleSessionName = roleSessionName
+			}))
+		// Clients sign with empty credentials when they can't be retrieved:
+		// have it fail here rather than with a signature error
+		if _, err = cfg.Credentials.Retrieve(ctx); err != nil {
+			return cfg, errors.Wrapf(err, "Unable to assume role %s", awsCredentials.roleARN)
+		}
+	}
+	return cfg, nil
+}
+
 // NewArchive creates a new recorder file (for writing). The caller must call
 // `rf.Close()` on the resulting handle to close out the file.
-// File is uploaded to s3 after it is flushed to disk and file is closed.
+// File is uploaded to s3 after it is flushed to disk and file is closed, or
+// as it is written with common.StreamUpload.
 // `*S3Archive` returned is an io.Writer
 func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *S3Archive, err error) {
 
@@ -72,12 +193,10 @@ func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicA
 		return nil, errors.Wrap(err, "Unable to initialize s3 connection")
 	}
 
-	// https://play.golang.org/p/vZ4NZzi6vrK
-	parts := s3UrlRegex.FindStringSubmatch(outDir)
-	if len(parts) != 4 { // must be exactly 4 parts
-		return nil, errors.Wrap(err, "Unable to parse s3 url format")
+	bucketName, s3SubDir, err := parseS3URL(outDir)
+	if err != nil {
+		return nil, err
 	}
-	bucketName, s3SubDir := parts[2], parts[3]
 	ba, err := common.NewBasicArchive(
 		"", prefix, extension, options...)
 	if err != nil {
@@ -88,6 +207,10 @@ func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicA
 		bucketName: bucketName,
 		contSubDir: s3SubDir}
 	rf.Finalizer = rf.finalizeArchive
+	if rf.StreamsUpload() {
+		rf.Streamer = rf.startUpload
+		rf.Finalizer = rf.finalizeUpload
+	}
 
 	err = rf.Rotate()
 	if err != nil {
@@ -96,121 +219,615 @@ func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicA
 	return rf, err
 }
 
+// SetDownloadOptions sets how many parts of an object are downloaded in
+// parallel, and their size in bytes, for archives opened or fetched from now
+// on. Zero keeps the SDK default. Not goroutine safe: meant to be called once,
+// before anything is downloaded.
+func SetDownloadOptions(concurrency int, partSize int64) {
+	downloadConcurrency = concurrency
+	downloadPartSize = partSize
+}
+
+// SetThrottle caps the bandwidth of uploads and downloads from now on (nil
+// - no limit). Throttles can be shared with other backends, for a limit of
+// the host. Not goroutine safe: meant to be called once, before anything is
+// transferred.
+func SetThrottle(upload, download *common.Throttle) {
+	uploadThrottle = upload
+	downloadThrottle = download
+}
+
+// SetEndpoint has the S3 client talk to an S3-compatible store at `url`
+// (e.g. http://minio.lab:9000) instead of AWS. With `pathStyle`, buckets are
+// addressed as url/bucket rather than bucket.host, which stores without
+// wildcard DNS need. `insecure` skips TLS certificate verification. Empty
+// `url` is AWS. Not goroutine safe: meant to be called once, before the first
+// archive is created, opened or fetched. Without it, the settings come from
+// AWS_ENDPOINT_URL_S3 (or AWS_ENDPOINT_URL), BLACKHOLE_S3_PATH_STYLE and
+// BLACKHOLE_S3_INSECURE (true/false).
+func SetEndpoint(url string, pathStyle, insecure bool) {
+	endpoint.set = true
+	endpoint.url = url
+	endpoint.pathStyle = pathStyle
+	endpoint.insecure = insecure
+}
+
+// endpointFromEnv sets the endpoint from the environment, see SetEndpoint
+func endpointFromEnv() {
+	endpoint.url = os.Getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint.url == "" {
+		endpoint.url = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	endpoint.pathStyle, _ = strconv.ParseBool(os.Getenv("BLACKHOLE_S3_PATH_STYLE"))
+	endpoint.insecure, _ = strconv.ParseBool(os.Getenv("BLACKHOLE_S3_INSECURE"))
+}
+
+// SetCredentials has the S3 client load the credentials and settings of the
+// named `profile` of ~/.aws/config and ~/.aws/credentials, send requests to
+// `region`, and assume the role `roleARN` with those credentials (empty -
+// default credentials, region of the profile or environment, no role). Not
+// goroutine safe: meant to be called once, before the first archive is
+// created, opened or fetched. Without it, the profile and region come from
+// AWS_PROFILE and AWS_REGION, as for any AWS tool, and the role from
+// BLACKHOLE_S3_ROLE_ARN.
+func SetCredentials(profile, region, roleARN string) {
+	awsCredentials.set = true
+	awsCredentials.profile = profile
+	awsCredentials.region = region
+	awsCredentials.roleARN = roleARN
+}
+
+// credentialsFromEnv sets the role to assume from the environment, see
+// SetCredentials
+func credentialsFromEnv() {
+	awsCredentials.roleARN = os.Getenv("BLACKHOLE_S3_ROLE_ARN")
+}
+
+// SetUploadOptions sets parameters of the objects uploaded from now on (empty
+// - default of the bucket): their storage class (STANDARD_IA, GLACIER_IR,
+// ...), server-side encryption (AES256 for SSE-S3, aws:kms for SSE-KMS) with
+// the KMS key `kmsKeyID` (id, ARN or alias; the AWS managed key if empty),
+// and their tags, URL-encoded (team=capture&env=prod). Not goroutine safe:
+// meant to be called once, before the first archive is created or stored.
+// Without it, the settings come from BLACKHOLE_S3_STORAGE_CLASS,
+// BLACKHOLE_S3_SSE, BLACKHOLE_S3_KMS_KEY_ID and BLACKHOLE_S3_TAGGING.
+func SetUploadOptions(storageClass, sse, kmsKeyID, tagging string) (err error) {
+
+	if storageClass != "" && !knownStorageClass(types.StorageClass(storageClass)) {
+		return errors.Errorf("Unknown s3 storage class %s", storageClass)
+	}
+	switch types.ServerSideEncryption(sse) {
+	case "", types.ServerSideEncryptionAes256, types.ServerSideEncryptionAwsKms:
+	default:
+		return errors.Errorf("Unknown s3 server-side encryption %s (AES256 or aws:kms)", sse)
+	}
+	if kmsKeyID != "" && types.ServerSideEncryption(sse) != types.ServerSideEncryptionAwsKms {
+		return errors.New("A KMS key takes aws:kms server-side encryption")
+	}
+	if _, err = url.ParseQuery(tagging); err != nil {
+		return errors.Wrapf(err, "Bad s3 tagging %s, expected key1=value1&key2=value2", tagging)
+	}
+	uploadOptions.set = true
+	uploadOptions.storageClass = types.StorageClass(storageClass)
+	uploadOptions.sse = types.ServerSideEncryption(sse)
+	uploadOptions.kmsKeyID = kmsKeyID
+	uploadOptions.tagging = tagging
+	return nil
+}
+
+// uploadOptionsFromEnv sets the upload options from the environment, see
+// SetUploadOptions
+func uploadOptionsFromEnv() error {
+	return SetUploadOptions(os.Getenv("BLACKHOLE_S3_STORAGE_CLASS"), os.Getenv("BLACKHOLE_S3_SSE"),
+		os.Getenv("BLACKHOLE_S3_KMS_KEY_ID"), os.Getenv("BLACKHOLE_S3_TAGGING"))
+}
+
+func knownStorageClass(class types.StorageClass) bool {
+	for _, known := range class.Values() {
+		if class == known {
+			return true
+		}
+	}
+	return false
+}
+
+// putObjectInput is the upload of `body` to bucketName/remotePath, with the
+// options of SetUploadOptions
+func putObjectInput(bucketName, remotePath string, body io.Reader) *s3.PutObjectInput {
+
+	input := &s3.PutObjectInput{
+		Bucket:               &bucketName,
+		Key:                  &remotePath,
+		Body:                 body,
+		StorageClass:         uploadOptions.storageClass,
+		ServerSideEncryption: uploadOptions.sse,
+	}
+	if uploadOptions.kmsKeyID != "" {
+		input.SSEKMSKeyId = aws.String(uploadOptions.kmsKeyID)
+	}
+	if uploadOptions.tagging != "" {
+		input.Tagging = aws.String(uploadOptions.tagging)
+	}
+	return input
+}
+
+// parseS3URL splits s3://bucket/some/path into bucket and path
+func parseS3URL(s3URL string) (bucketName, s3Path string, err error) {
+
+	// https://play.golang.org/p/vZ4NZzi6vrK
+	parts := s3UrlRegex.FindStringSubmatch(s3URL)
+	if len(parts) != 4 { // must be exactly 4 parts
+		return "", "", errors.Errorf("Unable to parse s3 url format: %s", s3URL)
+	}
+	return parts[2], parts[3], nil
+}
+
+// download downloads an s3 object to a new local temporary file
+func download(ctx context.Context, bucketName, filePath string, logger *zap.Logger) (localPath string, err error) {
+
+	fp, err := ioutil.TempFile("", fmt.Sprintf("tmp_*_%s", path.Base(filePath)))
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to create temp file")
+	}
+	defer fp.Close()
+
+	head, err := gS3Session.S3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &bucketName,
+		Key:    &filePath,
+	})
+	if err != nil {
+		os.Remove(fp.Name())
+		return "", errors.Wrapf(err, "unable to stat s3 object: %s", filePath)
+	}
+	fileSize := head.ContentLength
+
+	logger.Debug("S3 Download [BEGIN]",
+		zap.String("remote", filePath),
+		zap.Int64("size", fileSize),
+		zap.String("local", fp.Name()))
+
+	var statChan = make(chan int64)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go common.ProgressPrinter(logger, statChan, filePath, fileSize, &wg)
+
+	_, err = gS3Session.S3Downloader.Download(ctx, &countingWriterAt{w: downloadThrottle.WriterAt(ctx, fp), statChan: statChan}, &s3.GetObjectInput{
+		Bucket: &bucketName,
+		Key:    &filePath,
+	}, func(d *manager.Downloader) {
+		if downloadConcurrency > 0 {
+			d.Concurrency = downloadConcurrency
+		}
+		if downloadPartSize > 0 {
+			d.PartSize = downloadPartSize
+		}
+	})
+	close(statChan)
+	wg.Wait() // Waiting for status monitor to exit
+	if err != nil {
+		os.Remove(fp.Name())
+		return "", errors.Wrapf(err, "unable to download archive file: %s", filePath)
+	}
+
+	logger.Debug("S3 Download [END]",
+		zap.String("remote", filePath),
+		zap.Int64("size", fileSize),
+		zap.String("local", fp.Name()))
+
+	return fp.Name(), nil
+}
+
+// upload uploads a local file to s3 under bucketName/remotePath
+func upload(ctx context.Context, localPath, bucketName, remotePath string, logger *zap.Logger) (err error) {
+
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to stat file %s", localPath)
+	}
+	fileSize := fi.Size()
+
+	fp, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to reopen archive file: %s", localPath)
+	}
+	defer fp.Close()
+
+	logger.Debug("S3 Upload [BEGIN]",
+		zap.String("local", localPath),
+		zap.String("remote", remotePath))
+
+	// S3manager API has no progress callback: count what the uploader reads
+	var statChan = make(chan int64)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go common.ProgressPrinter(logger, statChan, localPath, fileSize, &wg)
+
+	_, err = gS3Session.S3Uploader.Upload(ctx, putObjectInput(bucketName, remotePath,
+		&progressReader{r: uploadThrottle.Reader(ctx, fp), statChan: statChan}))
+	close(statChan)
+	wg.Wait() // Waiting for status monitor to exit
+	if err != nil {
+		return errors.Wrapf(err, "unable to upload archive file: %s", remotePath)
+	}
+
+	logger.Info("S3 Upload [END]",
+		zap.String("local", localPath),
+		zap.String("remote", remotePath),
+		zap.Int64("bytes", fileSize))
+	return nil
+}
+
+// errAborted is what an upload of uploadStream fails with when aborted
+var errAborted = errors.New("upload aborted")
+
+// uploadStream is a file uploaded to s3 as it is written: in parts of the
+// uploader, buffered in memory, with a multipart upload unless it fits in one
+type uploadStream struct {
+	pw   *io.PipeWriter
+	done chan error // of the upload
+	url  string
+}
+
+// startUpload starts the upload of a file, see common.StreamerFunc
+func (rf *S3Archive) startUpload(finalName string) (us common.UploadStream, err error) {
+
+	remotePath := path.Join(rf.contSubDir, finalName)
+	pr, pw := io.Pipe()
+	s := &uploadStream{pw: pw, done: make(chan error, 1),
+		url: fmt.Sprintf("s3://%s/%s", rf.bucketName, remotePath)}
+
+	rf.Logger.Debug("S3 Upload [BEGIN]", zap.String("remote", remotePath))
+	go func() {
+		_, err := gS3Session.S3Uploader.Upload(rf.Context(), putObjectInput(rf.bucketName, remotePath,
+			uploadThrottle.Reader(rf.Context(), pr)))
+		if err != nil {
+			err = errors.Wrapf(err, "unable to upload archive file: %s", remotePath)
+		}
+		pr.CloseWithError(err) // writes fail from now on, if the upload did
+		s.done <- err
+	}()
+	return s, nil
+}
+
+func (s *uploadStream) Write(p []byte) (n int, err error) {
+	return s.pw.Write(p)
+}
+
+func (s *uploadStream) Close() (err error) {
+	s.pw.Close()
+	return <-s.done
+}
+
+func (s *uploadStream) Abort() {
+	s.pw.CloseWithError(errAborted)
+	<-s.done
+}
+
+func (s *uploadStream) Name() string {
+	return s.url
+}
+
 // OpenArchive opens an archive file for reading. `*S3Archive` returned is an io.Reader
 func OpenArchive(fileName string, bufferSize int) (rf *S3Archive, err error) {
+	return OpenArchiveContext(context.Background(), fileName, bufferSize)
+}
+
+// OpenArchiveContext is OpenArchive, downloading the file with `ctx`
+func OpenArchiveContext(ctx context.Context, fileName string, bufferSize int) (rf *S3Archive, err error) {
+
+	localPath, _, err := FetchContext(ctx, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	rfi, err := common.OpenArchive(localPath, bufferSize, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to initialize s3 connection")
+	}
+	return &S3Archive{BasicArchive: *rfi}, nil
+}
+
+// OpenStream opens an archive file for reading as it is downloaded, with
+// ranged GETs, instead of downloading it first, see common.OpenStream.
+// `*S3Archive` returned is an io.Reader
+func OpenStream(fileName string, bufferSize int) (rf *S3Archive, err error) {
+	return OpenStreamContext(context.Background(), fileName, bufferSize)
+}
+
+// OpenStreamContext is OpenStream, downloading the file with `ctx`
+func OpenStreamContext(ctx context.Context, fileName string, bufferSize int) (rf *S3Archive, err error) {
 
 	err = s3Init()
 	if err != nil {
 		return nil, errors.Wrap(err, "Unable to initialize s3 connection")
 	}
 
-	parts := s3UrlRegex.FindStringSubmatch(fileName)
-	if len(parts) != 4 { // must be exactly 4 parts
-		return nil, errors.Wrap(err, "Unable to parse azure blob url format")
+	bucketName, filePath, err := parseS3URL(fileName)
+	if err != nil {
+		return nil, err
+	}
+	head, err := headObject(ctx, bucketName, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	rfi, err := common.OpenStream(ctx, fileName, head.Size,
+		func(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+			return getRange(ctx, bucketName, filePath, offset, length)
+		}, bufferSize)
+	if err != nil {
+		return nil, err
 	}
+	return &S3Archive{BasicArchive: *rfi}, nil
+}
 
-	bucketName, filePath := parts[2], parts[3]
+// headObject returns the size and modification time of an object
+func headObject(ctx context.Context, bucketName, filePath string) (entry common.ArchiveEntry, err error) {
 
-	fp, err := ioutil.TempFile("", fmt.Sprintf("tmp_*_%s", path.Base(filePath)))
+	head, err := gS3Session.S3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &bucketName,
+		Key:    &filePath,
+	})
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to create temp file")
+		return entry, errors.Wrapf(err, "unable to stat s3 object: %s", filePath)
+	}
+	entry = common.ArchiveEntry{Name: filePath, Size: head.ContentLength}
+	if head.LastModified != nil {
+		entry.ModTime = *head.LastModified
 	}
+	return entry, nil
+}
 
-	rf.Logger.Debug("S3 Download [BEGIN]",
-		zap.String("local", filePath),
-		zap.String("remote", fp.Name()))
+// getRange reads `length` bytes of an object from `offset`, with a ranged GET
+func getRange(ctx context.Context, bucketName, filePath string, offset, length int64) (io.ReadCloser, error) {
 
-	_, err = gS3Session.S3Downloader.Download(context.Background(), fp, &s3.GetObjectInput{
+	out, err := gS3Session.S3Client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: &bucketName,
 		Key:    &filePath,
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
 	})
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to download archive file: %s", filePath)
+		return nil, err
 	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{downloadThrottle.Reader(ctx, out.Body), out.Body}, nil
+}
+
+// Stat returns the size, modification time, record count and checksum of an
+// archive file without downloading it, see common.StatArchive
+func Stat(fileName string) (st common.ArchiveStat, err error) {
+	return StatContext(context.Background(), fileName)
+}
 
-	rf.Logger.Debug("S3 Download [END]",
-		zap.String("local", filePath),
-		zap.String("remote", fp.Name()))
+// StatContext is Stat, with the requests made with `ctx`
+func StatContext(ctx context.Context, fileName string) (st common.ArchiveStat, err error) {
 
-	rfi, err := common.OpenArchive(fp.Name(), bufferSize, true)
+	err = s3Init()
 	if err != nil {
-		return nil, errors.Wrap(err, "Unable to initialize s3 connection")
+		return st, errors.Wrap(err, "Unable to initialize s3 connection")
 	}
-	return &S3Archive{BasicArchive: *rfi}, nil
+
+	return common.StatArchive(ctx, fileName,
+		func(ctx context.Context, name string) (common.ArchiveEntry, error) {
+			bucketName, filePath, err := parseS3URL(name)
+			if err != nil {
+				return common.ArchiveEntry{}, err
+			}
+			return headObject(ctx, bucketName, filePath)
+		},
+		func(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+			bucketName, filePath, err := parseS3URL(name)
+			if err != nil {
+				return nil, err
+			}
+			return getRange(ctx, bucketName, filePath, offset, length)
+		})
 }
 
-func List(dir string) (files []string, err error) {
-	panic("Not implemented")
+// Fetch downloads fileName to a local temporary file. Caller must
+// remove localPath when done (`temporary` is always true)
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return FetchContext(context.Background(), fileName)
 }
 
-func Delete(dir string, files []string) (err error) {
-	panic("Not implemented")
+// FetchContext is Fetch, downloading the file with `ctx`
+func FetchContext(ctx context.Context, fileName string) (localPath string, temporary bool, err error) {
+
+	err = s3Init()
+	if err != nil {
+		return "", false, errors.Wrap(err, "Unable to initialize s3 connection")
+	}
+
+	bucketName, filePath, err := parseS3URL(fileName)
+	if err != nil {
+		return "", false, err
+	}
+
+	localPath, err = download(ctx, bucketName, filePath, common.DefaultLogger)
+	if err != nil {
+		return "", false, err
+	}
+	return localPath, true, nil
 }
 
-// finalizeArchive is the companion function to CreateArchiveFile().
-// finalize will upload to S3.
-func (rf *S3Archive) finalizeArchive() (finalFile common.ArchiveFileDetails, err error) {
+// Store uploads the local file into s3 directory `dir` keeping the same base name
+func Store(localPath, dir string) (err error) {
+	return StoreContext(context.Background(), localPath, dir)
+}
 
-	filePath := rf.Name()
-	finalPath := path.Join(rf.contSubDir, path.Base(filePath))
-	finalPath = strings.TrimSuffix(finalPath, ".tmp")
+// StoreContext is Store, uploading the file with `ctx`
+func StoreContext(ctx context.Context, localPath, dir string) (err error) {
+
+	err = s3Init()
+	if err != nil {
+		return errors.Wrap(err, "Unable to initialize s3 connection")
+	}
 
-	finalFP, err := os.Open(filePath)
+	bucketName, s3SubDir, err := parseS3URL(dir)
 	if err != nil {
-		return finalFile, errors.Wrapf(err, "unable to reopen archive file: %s", filePath)
+		return err
 	}
-	defer finalFP.Close()
-	finalFile.FileName = path.Base(finalPath) // Only filename part
+	return upload(ctx, localPath, bucketName, path.Join(s3SubDir, path.Base(localPath)), common.DefaultLogger)
+}
 
-	rf.Logger.Debug("S3 Upload [BEGIN]",
-		zap.String("local", filePath),
-		zap.String("remote", finalPath))
+func List(dir string) (files []string, err error) {
+	return ListContext(context.Background(), dir)
+}
 
-	/* Progress tracking is not possible with S3manager API
-	 * suggested work around is hacky
-	 * https://github.com/aws/aws-sdk-go/pull/1868#issuecomment-514097090
+// ListContext is List, with the requests made with `ctx`
+func ListContext(ctx context.Context, dir string) (files []string, err error) {
 
-	fi, err := os.Stat(rf.name)
+	entries, err := ListDetailsContext(ctx, dir)
 	if err != nil {
-		return errors.Wrapf(err, "unable to stat file %s", rf.name)
+		return nil, err
 	}
+	for _, entry := range entries {
+		files = append(files, entry.Name)
+	}
+	return files, err
+}
 
-	finalFileSize := fi.Size()
-	// this will be different from `rf.bytesWritten`
-	// because of possible compression
+// ListDetails is like List, but includes size and modification time.
+// Names are object keys, i.e. they include the path inside the bucket.
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+	return ListDetailsContext(context.Background(), dir)
+}
 
-	var statChan = make(chan int64)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go common.UploadProgressPrinter(statChan, rf.name, finalFileSize, &wg)
-	*/
+// ListDetailsContext is ListDetails, with the requests made with `ctx`
+func ListDetailsContext(ctx context.Context, dir string) (entries []common.ArchiveEntry, err error) {
+
+	err = s3Init()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to initialize s3 connection")
+	}
+
+	bucketName, s3SubDir, err := parseS3URL(dir)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err = gS3Session.S3Uploader.Upload(context.Background(), &s3.PutObjectInput{
-		Bucket: &rf.bucketName,
-		Key:    &finalPath,
-		Body:   finalFP,
+	paginator := s3.NewListObjectsV2Paginator(gS3Session.S3Client, &s3.ListObjectsV2Input{
+		Bucket: &bucketName,
+		Prefix: aws.String(common.DirPrefix(s3SubDir)),
 	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to list s3 bucket %s", bucketName)
+		}
+		for _, object := range page.Contents {
+			entry := common.ArchiveEntry{Name: aws.ToString(object.Key), Size: object.Size}
+			if object.LastModified != nil {
+				entry.ModTime = *object.LastModified
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// deleteBatch is the most objects DeleteObjects deletes at once
+const deleteBatch = 1000
+
+// Delete removes objects, named as returned by List, from the bucket of
+// `dir`, deleteBatch at a time
+func Delete(dir string, files []string) (err error) {
+	return DeleteContext(context.Background(), dir, files)
+}
+
+// DeleteContext is Delete, with the requests made with `ctx`
+func DeleteContext(ctx context.Context, dir string, files []string) (err error) {
+
+	err = s3Init()
+	if err != nil {
+		return errors.Wrap(err, "Unable to initialize s3 connection")
+	}
+
+	bucketName, _, err := parseS3URL(dir)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(files); start += deleteBatch {
+		batch := files[start:]
+		if len(batch) > deleteBatch {
+			batch = batch[:deleteBatch]
+		}
+		objects := make([]types.ObjectIdentifier, len(batch))
+		for i, fileName := range batch {
+			objects[i].Key = aws.String(fileName)
+		}
+		out, err := gS3Session.S3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: &bucketName,
+			Delete: &types.Delete{Objects: objects, Quiet: true}, // only errors are returned
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Unable to delete s3 objects of bucket %s", bucketName)
+		}
+		failed := make(map[string]bool, len(out.Errors))
+		for _, e := range out.Errors {
+			failed[aws.ToString(e.Key)] = true
+		}
+		for _, fileName := range batch {
+			if !failed[fileName] {
+				fmt.Printf("DELETED: %s\n", fileName)
+			}
+		}
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return errors.Errorf("Unable to delete %d s3 objects, %s first: %s (%s)",
+				len(out.Errors), aws.ToString(e.Key), aws.ToString(e.Message), aws.ToString(e.Code))
+		}
+	}
+	return nil
+}
+
+// finalizeArchive is the companion function to CreateArchiveFile().
+// finalize will upload to S3.
+func (rf *S3Archive) finalizeArchive() (finalFile common.ArchiveFileDetails, err error) {
+
+	filePath := rf.Name()
+	fi, err := os.Stat(filePath)
 	if err != nil {
-		return finalFile, errors.Wrapf(err, "unable to reopen archive file: %s", finalPath)
+		return finalFile, errors.Wrapf(err, "unable to stat file %s", filePath)
 	}
+	finalPath := path.Join(rf.contSubDir, rf.FinalName())
+	finalFile.FileName = rf.FinalName() // with the directories of FilenameTemplate, if any
+	finalFile.URL = fmt.Sprintf("s3://%s/%s", rf.bucketName, finalPath)
+	finalFile.BytesWritten = fi.Size()
+	finalFile.ChunksWritten = rf.ChunksWritten
 
-	rf.Logger.Info("S3 Upload [END]",
-		zap.String("local", filePath),
-		zap.String("remote", finalPath))
+	err = upload(rf.Context(), filePath, rf.bucketName, finalPath, rf.Logger)
+	if err != nil {
+		return finalFile, err
+	}
+	rf.StoreIndex(func(indexPath string) error {
+		return upload(rf.Context(), indexPath, rf.bucketName, finalPath+common.IndexExt, rf.Logger)
+	})
 
 	err = os.Remove(filePath)
 	if err != nil {
-		return finalFile, errors.Wrapf(err, "unable to remove archive file %s after uploading to azure", filePath)
+		return finalFile, errors.Wrapf(err, "unable to remove archive file %s after uploading to s3", filePath)
 	}
 
-	/* Progress tracking is not possible with S3manager API
-	 * suggested work around is hacky
-	 * https://github.com/aws/aws-sdk-go/pull/1868#issuecomment-514097090
+	return finalFile, err
+}
 
-	close(statChan)
-	wg.Wait() // Waiting for status monitor to exit
+// finalizeUpload is finalizeArchive for files uploaded as they were written
+// (see startUpload): their upload is complete already.
+func (rf *S3Archive) finalizeUpload() (finalFile common.ArchiveFileDetails, err error) {
 
-	*/
+	finalPath := path.Join(rf.contSubDir, rf.FinalName())
+	finalFile.FileName = rf.FinalName()
+	finalFile.URL = fmt.Sprintf("s3://%s/%s", rf.bucketName, finalPath)
+	finalFile.BytesWritten = rf.StoredSize()
+	finalFile.ChunksWritten = rf.ChunksWritten
 
-	return finalFile, err
+	rf.Logger.Info("S3 Upload [END]", zap.String("remote", finalPath))
+	rf.StoreIndex(func(indexPath string) error {
+		return upload(rf.Context(), indexPath, rf.bucketName, finalPath+common.IndexExt, rf.Logger)
+	})
+	return finalFile, nil
 }
@@ -0,0 +1,219 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package s3f
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fakeS3 answers DeleteObjects requests, recording the keys of each, and
+// failing those of `failing`
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	batches [][]string
+	failing map[string]bool
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if _, ok := r.URL.Query()["delete"]; r.Method != http.MethodPost || !ok || r.URL.Path != "/"+f.bucket {
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var keys []string
+	var errs strings.Builder
+	for _, o := range req.Objects {
+		keys = append(keys, o.Key)
+		if f.failing[o.Key] {
+			fmt.Fprintf(&errs, "<Error><Key>%s</Key><Code>AccessDenied</Code><Message>Access Denied</Message></Error>", o.Key)
+		}
+	}
+	f.mu.Lock()
+	f.batches = append(f.batches, keys)
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>`+
+		`<DeleteResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">%s</DeleteResult>`, errs.String())
+}
+
+// withFakeS3 has the client send its requests to `f` for the test
+func withFakeS3(t *testing.T, f *fakeS3) {
+
+	srv := httptest.NewServer(f)
+	client := s3.New(s3.Options{
+		Region:           defaultRegion,
+		Credentials:      aws.NewCredentialsCache(aws.CredentialsProviderFunc(testCredentials)),
+		EndpointResolver: s3.EndpointResolverFromURL(srv.URL),
+		UsePathStyle:     true,
+	})
+	gS3Session.Lock()
+	saved := gS3Session.S3Client
+	gS3Session.S3Client = client
+	gS3Session.Unlock()
+	t.Cleanup(func() {
+		srv.Close()
+		gS3Session.Lock()
+		gS3Session.S3Client = saved
+		gS3Session.Unlock()
+	})
+}
+
+func testCredentials(ctx context.Context) (aws.Credentials, error) {
+	return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+}
+
+// keys are `n` object keys of captures/
+func keys(n int) (names []string) {
+	for i := 0; i < n; i++ {
+		names = append(names, fmt.Sprintf("captures/requests_%05d.fbf", i))
+	}
+	return names
+}
+
+func TestDeleteBatches(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		files   []string
+		batches []int // sizes of the DeleteObjects requests
+	}{
+		{"none", nil, nil},
+		{"one", keys(1), []int{1}},
+		{"one batch", keys(deleteBatch - 1), []int{deleteBatch - 1}},
+		{"full batch", keys(deleteBatch), []int{deleteBatch}},
+		{"batch and one", keys(deleteBatch + 1), []int{deleteBatch, 1}},
+		{"several batches", keys(2*deleteBatch + 500), []int{deleteBatch, deleteBatch, 500}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeS3{bucket: "bucket"}
+			withFakeS3(t, f)
+			if err := Delete("s3://bucket/captures", tt.files); err != nil {
+				t.Fatal(err)
+			}
+			if len(f.batches) != len(tt.batches) {
+				t.Fatalf("got %d requests, want %d", len(f.batches), len(tt.batches))
+			}
+			var deleted []string
+			for i, batch := range f.batches {
+				if len(batch) != tt.batches[i] {
+					t.Fatalf("request %d: got %d keys, want %d", i, len(batch), tt.batches[i])
+				}
+				deleted = append(deleted, batch...)
+			}
+			for i := range tt.files { // all of them, in order
+				if deleted[i] != tt.files[i] {
+					t.Fatalf("got %s deleted, want %s", deleted[i], tt.files[i])
+				}
+			}
+		})
+	}
+}
+
+// Keys that can't be deleted fail Delete at the end of their batch
+func TestDeleteErrors(t *testing.T) {
+
+	files := keys(deleteBatch + 10)
+	f := &fakeS3{bucket: "bucket", failing: map[string]bool{files[3]: true, files[4]: true}}
+	withFakeS3(t, f)
+	err := Delete("s3://bucket/captures", files)
+	if err == nil || !strings.Contains(err.Error(), files[3]) {
+		t.Fatalf("got %v", err)
+	}
+	if len(f.batches) != 1 {
+		t.Fatalf("got %d requests, want the first batch only", len(f.batches))
+	}
+
+	if err = Delete("not an s3 url", files); err == nil {
+		t.Fatal("no error for a bad url")
+	}
+}
+
+// setenv sets an environment variable for the test
+func setenv(t *testing.T, key, value string) {
+	saved, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, saved)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// Other AWS backends get the profile and region of SetCredentials
+func TestLoadConfig(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "s3f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	configFile := filepath.Join(dir, "config")
+	err = ioutil.WriteFile(configFile, []byte("[profile capture]\nregion = ap-south-1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "AWS_CONFIG_FILE", configFile)
+	setenv(t, "AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	setenv(t, "AWS_REGION", "")
+	saved := awsCredentials
+	t.Cleanup(func() { awsCredentials = saved })
+
+	tests := []struct {
+		name    string
+		profile string
+		region  string
+		want    string
+	}{
+		{"region", "", "eu-west-3", "eu-west-3"},
+		{"profile", "capture", "", "ap-south-1"},
+		{"region of profile overridden", "capture", "eu-west-3", "eu-west-3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetCredentials(tt.profile, tt.region, "")
+			cfg, err := LoadConfig(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Region != tt.want {
+				t.Fatalf("got region %q, want %q", cfg.Region, tt.want)
+			}
+		})
+	}
+}
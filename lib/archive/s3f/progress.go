@@ -0,0 +1,62 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package s3f
+
+import (
+	"io"
+	"sync"
+)
+
+// The s3 manager API has no progress callback, unlike azblob. Uploads and
+// downloads are tracked by counting the bytes going through their body or
+// destination instead, and sent to common.ProgressPrinter.
+
+// progressReader counts bytes read by the uploader from r.
+// It hides any io.ReaderAt/io.Seeker of r, so that the uploader reads it
+// once, in order, rather than concurrently by section (with seekable bodies
+// the SDK would read parts again to sign them, counting them twice).
+type progressReader struct {
+	r        io.Reader
+	total    int64
+	statChan chan<- int64
+}
+
+func (pr *progressReader) Read(p []byte) (n int, err error) {
+	n, err = pr.r.Read(p)
+	if n > 0 {
+		pr.total += int64(n)
+		pr.statChan <- pr.total
+	}
+	return n, err
+}
+
+// countingWriterAt counts bytes written by the downloader to w. Parts are
+// written concurrently: the running total is sent under mu, so that the
+// totals sent only grow.
+type countingWriterAt struct {
+	w        io.WriterAt
+	mu       sync.Mutex
+	total    int64
+	statChan chan<- int64
+}
+
+func (cw *countingWriterAt) WriteAt(p []byte, off int64) (n int, err error) {
+	n, err = cw.w.WriteAt(p, off)
+	if n > 0 {
+		cw.mu.Lock()
+		cw.total += int64(n)
+		cw.statChan <- cw.total
+		cw.mu.Unlock()
+	}
+	return n, err
+}
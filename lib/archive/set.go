@@ -0,0 +1,154 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package archive
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/pkg/errors"
+)
+
+// ArchiveSet writes to `n` archives of the same output directory at once,
+// shards of its requests, for producers not to wait on each other (nor on
+// the compression of a single file), as recorder threads each write their
+// own. Shards are ConcurrentArchives: any of them can be written by several
+// goroutines, and one written by a goroutine of its own (see Shard) isn't
+// waited on. Writes to the set itself go to the shards in turn, a whole
+// request to one of them (see Locked), so a Write must have complete frames.
+// Rotate, Flush and Close apply to all shards, together.
+type ArchiveSet struct {
+	shards []*ConcurrentArchive
+	next   uint64 // shard of the next write, modulo len(shards)
+}
+
+// NewSet creates `n` archives in `outDir`, any URL supported by NewArchive,
+// with the same options. Their files are named as those of the recorder
+// (requests_<timestamp>_<random>.fbf, see common.FilenameTemplate).
+func NewSet(outDir string, n int, options ...func(*common.BasicArchive) error) (set *ArchiveSet, err error) {
+
+	if n <= 0 {
+		return nil, errors.Errorf("Number of archives must be positive, got %d", n)
+	}
+	set = &ArchiveSet{}
+	options = append(options, common.Concurrent(true))
+	for i := 0; i < n; i++ {
+		rf, err := NewArchive(outDir, "requests", ".fbf", options...)
+		if err != nil {
+			set.Close()
+			return nil, errors.Wrapf(err, "Unable to create archive %d of %s", i, outDir)
+		}
+		shard, ok := rf.(*ConcurrentArchive)
+		if !ok { // sum:// takes no options
+			shard = NewConcurrentArchive(rf)
+		}
+		set.shards = append(set.shards, shard)
+	}
+	return set, nil
+}
+
+// Len is the number of shards
+func (set *ArchiveSet) Len() int {
+	return len(set.shards)
+}
+
+// Shard is shard `key` modulo Len, e.g. that of a producer, for it to
+// write to the same files every time
+func (set *ArchiveSet) Shard(key uint64) *ConcurrentArchive {
+	return set.shards[key%uint64(len(set.shards))]
+}
+
+// nextShard is the shard of the next write
+func (set *ArchiveSet) nextShard() *ConcurrentArchive {
+	return set.Shard(atomic.AddUint64(&set.next, 1) - 1)
+}
+
+// Locked calls `f` with the archive of a shard, under its lock, see
+// ConcurrentArchive.Locked: request.SaveRequest and request.SaveFrames
+// write a whole request, or batch of them, to one shard
+func (set *ArchiveSet) Locked(f func(Archive) error) error {
+	return set.nextShard().Locked(f)
+}
+
+// Write satisfies io.Writer interface. `buf`, of complete frames, is
+// written to the next shard.
+func (set *ArchiveSet) Write(buf []byte) (n int, err error) {
+	return set.nextShard().Write(buf)
+}
+
+// Read is not supported: read the archives written
+func (set *ArchiveSet) Read(p []byte) (n int, err error) {
+	return 0, errors.New("Read not supported for archive sets")
+}
+
+// each calls `f` on every shard, all at once (uploads of files finalized by
+// a rotation run side by side), returning the first error
+func (set *ArchiveSet) each(what string, f func(Archive) error) (err error) {
+
+	errs := make([]error, len(set.shards))
+	var wg sync.WaitGroup
+	for i, rf := range set.shards {
+		wg.Add(1)
+		go func(i int, rf Archive) {
+			defer wg.Done()
+			errs[i] = f(rf)
+		}(i, rf)
+	}
+	wg.Wait()
+	for i, ferr := range errs {
+		if ferr != nil {
+			return errors.Wrapf(ferr, "Unable to %s archive %d", what, i)
+		}
+	}
+	return nil
+}
+
+// Flush flushes every shard
+func (set *ArchiveSet) Flush() (err error) {
+	return set.each("flush", Archive.Flush)
+}
+
+// Rotate finalizes the current file of every shard and starts new ones
+func (set *ArchiveSet) Rotate() (err error) {
+	return set.each("rotate", Archive.Rotate)
+}
+
+// Close finalizes the files of every shard, even if closing one of them
+// fails
+func (set *ArchiveSet) Close() (err error) {
+	return set.each("close", Archive.Close)
+}
+
+// Name is the names of the current files of all shards, comma separated
+func (set *ArchiveSet) Name() string {
+
+	names := make([]string, len(set.shards))
+	for i, rf := range set.shards {
+		names[i] = rf.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// FinalizedFiles lists the files finalized by all shards
+func (set *ArchiveSet) FinalizedFiles() map[string]common.ArchiveFileDetails {
+
+	files := make(map[string]common.ArchiveFileDetails)
+	for _, rf := range set.shards {
+		for name, details := range rf.FinalizedFiles() {
+			files[name] = details
+		}
+	}
+	return files
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package archive
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"go.uber.org/zap"
+)
+
+func TestArchiveSet(t *testing.T) {
+
+	const producers, requests = 8, 200
+	tests := []struct {
+		name   string
+		shards int
+		write  func(set *ArchiveSet, producer int, buf []byte) error
+	}{
+		{"write", 3, func(set *ArchiveSet, producer int, buf []byte) error {
+			_, err := set.Write(buf)
+			return err
+		}},
+		{"shard of producer", 4, func(set *ArchiveSet, producer int, buf []byte) error {
+			_, err := set.Shard(uint64(producer)).Write(buf)
+			return err
+		}},
+		{"locked, in two writes", 2, func(set *ArchiveSet, producer int, buf []byte) error {
+			return set.Locked(func(rf Archive) error {
+				if _, err := rf.Write(buf[:5]); err != nil {
+					return err
+				}
+				_, err := rf.Write(buf[5:])
+				return err
+			})
+		}},
+		{"one shard", 1, func(set *ArchiveSet, producer int, buf []byte) error {
+			_, err := set.Write(buf)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tempDir(t)
+			set, err := NewSet(dir, tt.shards, common.Logger(zap.NewNop()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if set.Len() != tt.shards {
+				t.Fatalf("got %d shards", set.Len())
+			}
+
+			var want []string
+			var wg sync.WaitGroup
+			errs := make(chan error, producers)
+			for p := 0; p < producers; p++ {
+				wg.Add(1)
+				go func(p int) {
+					defer wg.Done()
+					for i := 0; i < requests; i++ {
+						if err := tt.write(set, p, testFrame(fmt.Sprintf("request %d of %d", i, p))); err != nil {
+							errs <- err
+							return
+						}
+					}
+				}(p)
+				for i := 0; i < requests; i++ {
+					want = append(want, fmt.Sprintf("request %d of %d", i, p))
+				}
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+			if err = set.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			sort.Strings(want)
+			got, files := readFrames(t, dir)
+			if len(got) != len(want) {
+				t.Fatalf("got %d requests, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("got %q, want %q", got[i], want[i])
+				}
+			}
+			if finalized := len(set.FinalizedFiles()); finalized != files || files > tt.shards {
+				t.Fatalf("%d files finalized, %d written, for %d shards", finalized, files, tt.shards)
+			}
+		})
+	}
+}
+
+func TestArchiveSetRotate(t *testing.T) {
+
+	dir := tempDir(t)
+	set, err := NewSet(dir, 2, common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 4; i++ {
+			set.Write(testFrame(fmt.Sprintf("%d.%d", round, i)))
+		}
+		if err = set.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set.Close()
+	got, files := readFrames(t, dir)
+	if len(got) != 12 || files != 6 {
+		t.Fatalf("got %d requests in %d files, want 12 in 6", len(got), files)
+	}
+}
+
+func TestNewSetErrors(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		if _, err := NewSet(tempDir(t), n); err == nil {
+			t.Errorf("no error for %d shards", n)
+		}
+	}
+}
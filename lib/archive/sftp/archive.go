@@ -0,0 +1,459 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package sftp provides archive interface for remote hosts reached over SSH
+// (SFTP). Files are written locally and uploaded when finalized, like with
+// the blob store backends. URLs are sftp://[user@]host[:port]/path, where
+// the path is absolute, or relative to the home directory of the user when
+// it starts with /~/.
+package sftp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// dialTimeout bounds the connection and SSH handshake with a host
+const dialTimeout = 30 * time.Second
+
+// Private keys tried, in ~/.ssh, when no key file is set
+var defaultKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// Connections are shared by all archives of the same host, user and key, so
+// they are created once per process. One that fails is dropped, and made
+// again the next time it is needed.
+var gSFTPSession struct {
+	sync.Mutex
+	clients map[string]*sftp.Client
+}
+
+type SFTPArchive struct {
+	common.BasicArchive
+	remote  remote
+	keyFile string
+}
+
+// remote is where an sftp URL points to
+type remote struct {
+	user string
+	host string // with port
+	dir  string // as given to the sftp client, see parseSFTPURL
+}
+
+func (r remote) url(p string) string {
+	if !path.IsAbs(p) {
+		p = "/~/" + p
+	}
+	return fmt.Sprintf("sftp://%s@%s%s", r.user, r.host, p)
+}
+
+// parseSFTPURL splits sftp://[user@]host[:port]/path. Paths starting with
+// /~/ are made relative, which the server resolves from the home directory.
+func parseSFTPURL(sftpURL string) (r remote, err error) {
+
+	u, err := url.Parse(sftpURL)
+	if err != nil || u.Scheme != "sftp" || u.Host == "" {
+		return r, errors.Errorf("Unable to parse sftp url format (sftp://user@host/path): %s", sftpURL)
+	}
+	r.host = u.Host
+	if u.Port() == "" {
+		r.host = net.JoinHostPort(u.Hostname(), "22")
+	}
+	if u.User != nil {
+		r.user = u.User.Username()
+	} else {
+		current, err := user.Current()
+		if err != nil {
+			return r, errors.Wrap(err, "No user in sftp url and unable to get the current one")
+		}
+		r.user = current.Username
+	}
+	r.dir = u.Path
+	if r.dir == "/~" || strings.HasPrefix(r.dir, "/~/") {
+		r.dir = strings.TrimPrefix(strings.TrimPrefix(r.dir, "/~"), "/")
+	}
+	if r.dir == "" {
+		r.dir = "."
+	}
+	return r, nil
+}
+
+// authMethods returns how to authenticate: with `keyFile` if set, or else
+// with the ssh agent and the default keys of ~/.ssh
+func authMethods(keyFile string) (methods []ssh.AuthMethod, err error) {
+
+	if keyFile != "" {
+		signer, err := readKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil
+	}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	home, _ := os.UserHomeDir()
+	var signers []ssh.Signer
+	for _, name := range defaultKeys {
+		signer, err := readKey(filepath.Join(home, ".ssh", name))
+		if err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("No ssh key found: set one, add one to the ssh agent or to ~/.ssh")
+	}
+	return methods, nil
+}
+
+// readKey reads a private key, which can't be protected by a passphrase
+func readKey(keyFile string) (signer ssh.Signer, err error) {
+
+	pem, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read ssh key %s", keyFile)
+	}
+	signer, err = ssh.ParsePrivateKey(pem)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, errors.Errorf("ssh key %s is protected by a passphrase, add it to the ssh agent instead", keyFile)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to parse ssh key %s", keyFile)
+	}
+	return signer, nil
+}
+
+// getClient returns the sftp client of a remote host, connecting the first
+// time. Host keys are checked against ~/.ssh/known_hosts.
+func getClient(r remote, keyFile string) (client *sftp.Client, err error) {
+
+	gSFTPSession.Lock()
+	defer gSFTPSession.Unlock()
+	if gSFTPSession.clients == nil {
+		gSFTPSession.clients = make(map[string]*sftp.Client)
+	}
+	key := r.user + "@" + r.host + " " + keyFile
+	if client, ok := gSFTPSession.clients[key]; ok {
+		return client, nil
+	}
+
+	auth, err := authMethods(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	home, _ := os.UserHomeDir()
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read known ssh hosts")
+	}
+	conn, err := ssh.Dial("tcp", r.host, &ssh.ClientConfig{
+		User:            r.user,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         dialTimeout})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to connect to %s@%s", r.user, r.host)
+	}
+	client, err = sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "Unable to start sftp on %s", r.host)
+	}
+	gSFTPSession.clients[key] = client
+	go func() { // forget the connection once it is gone
+		client.Wait()
+		gSFTPSession.Lock()
+		if gSFTPSession.clients[key] == client {
+			delete(gSFTPSession.clients, key)
+		}
+		gSFTPSession.Unlock()
+	}()
+	return client, nil
+}
+
+// NewArchive creates a new recorder file (for writing). The caller must call
+// `rf.Close()` on the resulting handle to close out the file.
+// File is uploaded over sftp after it is flushed to disk and file is closed,
+// authenticating with the key of common.SSHKey if set.
+// `*SFTPArchive` returned is an io.Writer
+func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *SFTPArchive, err error) {
+
+	r, err := parseSFTPURL(outDir)
+	if err != nil {
+		return nil, err
+	}
+	ba, err := common.NewBasicArchive(
+		"", prefix, extension, options...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to initialize basic archive")
+	}
+	_, err = getClient(r, ba.SSHKeyFile())
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to initialize sftp connection")
+	}
+
+	rf = &SFTPArchive{BasicArchive: *ba,
+		remote:  r,
+		keyFile: ba.SSHKeyFile()}
+	rf.Finalizer = rf.finalizeArchive
+
+	err = rf.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return rf, err
+}
+
+// download downloads a remote file to a new local temporary file
+func download(r remote, filePath, keyFile string, logger *zap.Logger) (localPath string, err error) {
+
+	client, err := getClient(r, keyFile)
+	if err != nil {
+		return "", err
+	}
+	fp, err := ioutil.TempFile("", fmt.Sprintf("tmp_*_%s", path.Base(filePath)))
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to create temp file")
+	}
+	defer fp.Close()
+
+	logger.Debug("SFTP Download [BEGIN]",
+		zap.String("remote", filePath),
+		zap.String("local", fp.Name()))
+
+	rfp, err := client.Open(filePath)
+	if err == nil {
+		_, err = rfp.WriteTo(fp)
+		rfp.Close()
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return "", errors.Wrapf(err, "unable to download archive file: %s", filePath)
+	}
+
+	logger.Debug("SFTP Download [END]",
+		zap.String("remote", filePath),
+		zap.String("local", fp.Name()))
+
+	return fp.Name(), nil
+}
+
+// upload uploads a local file to `remotePath`. The file is written under a
+// `.tmp` name and renamed once complete, so readers never see part of it.
+func upload(localPath string, r remote, remotePath, keyFile string, logger *zap.Logger) (err error) {
+
+	client, err := getClient(r, keyFile)
+	if err != nil {
+		return err
+	}
+	fp, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to reopen archive file: %s", localPath)
+	}
+	defer fp.Close()
+
+	logger.Debug("SFTP Upload [BEGIN]",
+		zap.String("local", localPath),
+		zap.String("remote", remotePath))
+
+	err = client.MkdirAll(path.Dir(remotePath))
+	if err != nil {
+		return errors.Wrapf(err, "unable to create remote directory: %s", path.Dir(remotePath))
+	}
+	tmpPath := remotePath + ".tmp"
+	rfp, err := client.Create(tmpPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create remote file: %s", tmpPath)
+	}
+	_, err = rfp.ReadFrom(fp)
+	if cerr := rfp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = client.PosixRename(tmpPath, remotePath)
+		if err != nil { // server without the posix-rename extension
+			client.Remove(remotePath)
+			err = client.Rename(tmpPath, remotePath)
+		}
+	}
+	if err != nil {
+		client.Remove(tmpPath)
+		return errors.Wrapf(err, "unable to upload archive file: %s", remotePath)
+	}
+
+	logger.Info("SFTP Upload [END]",
+		zap.String("local", localPath),
+		zap.String("remote", remotePath))
+	return nil
+}
+
+// OpenArchive opens an archive file for reading. `*SFTPArchive` returned is an io.Reader
+func OpenArchive(fileName string, bufferSize int) (rf *SFTPArchive, err error) {
+
+	localPath, _, err := Fetch(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	rfi, err := common.OpenArchive(localPath, bufferSize, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to open downloaded sftp file")
+	}
+	return &SFTPArchive{BasicArchive: *rfi}, nil
+}
+
+// Fetch downloads fileName to a local temporary file. Caller must
+// remove localPath when done (`temporary` is always true)
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+
+	r, err := parseSFTPURL(fileName)
+	if err != nil {
+		return "", false, err
+	}
+	localPath, err = download(r, r.dir, "", common.DefaultLogger)
+	if err != nil {
+		return "", false, err
+	}
+	return localPath, true, nil
+}
+
+// Store uploads the local file into remote directory `dir` keeping the same base name
+func Store(localPath, dir string) (err error) {
+
+	r, err := parseSFTPURL(dir)
+	if err != nil {
+		return err
+	}
+	return upload(localPath, r, path.Join(r.dir, path.Base(localPath)), "", common.DefaultLogger)
+}
+
+func List(dir string) (files []string, err error) {
+
+	entries, err := ListDetails(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		files = append(files, entry.Name)
+	}
+	return files, err
+}
+
+// ListDetails is like List, but includes size and modification time.
+// Names are relative to `dir`, which is walked recursively.
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+
+	r, err := parseSFTPURL(dir)
+	if err != nil {
+		return nil, err
+	}
+	client, err := getClient(r, "")
+	if err != nil {
+		return nil, err
+	}
+
+	walker := client.Walk(r.dir)
+	for walker.Step() {
+		if walker.Err() != nil {
+			return nil, errors.Wrapf(walker.Err(), "Unable to list %s", walker.Path())
+		}
+		info := walker.Stat()
+		if info.IsDir() {
+			continue
+		}
+		relPath, err := filepath.Rel(r.dir, walker.Path())
+		if err != nil {
+			continue // Skipping weird directories
+		}
+		entries = append(entries, common.ArchiveEntry{
+			Name:    filepath.ToSlash(relPath),
+			Size:    info.Size(),
+			ModTime: info.ModTime()})
+	}
+	return entries, nil
+}
+
+// Delete removes files, named as returned by List, from remote directory `dir`
+func Delete(dir string, files []string) (err error) {
+
+	r, err := parseSFTPURL(dir)
+	if err != nil {
+		return err
+	}
+	client, err := getClient(r, "")
+	if err != nil {
+		return err
+	}
+	for _, fileName := range files {
+		err = client.Remove(path.Join(r.dir, fileName))
+		if err != nil {
+			return errors.Wrapf(err, "Unable to delete remote file: %s", fileName)
+		}
+		fmt.Printf("DELETED: %s\n", fileName)
+	}
+	return nil
+}
+
+// finalizeArchive is the companion function to CreateArchiveFile().
+// finalize will upload over sftp.
+func (rf *SFTPArchive) finalizeArchive() (finalFile common.ArchiveFileDetails, err error) {
+
+	filePath := rf.Name()
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return finalFile, errors.Wrapf(err, "unable to stat file %s", filePath)
+	}
+	finalPath := path.Join(rf.remote.dir, rf.FinalName())
+	finalFile.FileName = rf.FinalName() // with the directories of FilenameTemplate, if any
+	finalFile.URL = rf.remote.url(finalPath)
+	finalFile.BytesWritten = fi.Size()
+	finalFile.ChunksWritten = rf.ChunksWritten
+
+	err = upload(filePath, rf.remote, finalPath, rf.keyFile, rf.Logger)
+	if err != nil {
+		return finalFile, err
+	}
+	rf.StoreIndex(func(indexPath string) error {
+		return upload(indexPath, rf.remote, finalPath+common.IndexExt, rf.keyFile, rf.Logger)
+	})
+
+	err = os.Remove(filePath)
+	if err != nil {
+		return finalFile, errors.Wrapf(err, "unable to remove archive file %s after uploading over sftp", filePath)
+	}
+
+	return finalFile, err
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package sftp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// setenv sets an environment variable for the test
+func setenv(t *testing.T, name, value string) {
+	saved, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, saved)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+// tempDir is a directory removed at the end of the test
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// newKey returns a new private key, as a signer and PEM
+func newKey(t *testing.T) (ssh.Signer, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// serveSFTP runs an SFTP server of the local file system until the end of
+// the test, and returns its address. It is a known host of a new home
+// directory, with the only key it accepts in ~/.ssh.
+func serveSFTP(t *testing.T) string {
+
+	hostKey, _ := newKey(t)
+	userKey, userPEM := newKey(t)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() != "tester" || string(key.Marshal()) != string(userKey.PublicKey().Marshal()) {
+				return nil, ssh.ErrNoAuth
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, config)
+		}
+	}()
+
+	home := tempDir(t)
+	setenv(t, "HOME", home)
+	setenv(t, "SSH_AUTH_SOCK", "")
+	sshDir := filepath.Join(home, ".ssh")
+	line := knownhosts.Line([]string{knownhosts.Normalize(ln.Addr().String())}, hostKey.PublicKey())
+	if err = os.Mkdir(sshDir, 0700); err == nil {
+		err = ioutil.WriteFile(filepath.Join(sshDir, "known_hosts"), []byte(line+"\n"), 0600)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(sshDir, "id_ecdsa"), userPEM, 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln.Addr().String()
+}
+
+// serveConn serves the sftp subsystem on an SSH connection
+func serveConn(conn net.Conn, config *ssh.ServerConfig) {
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		ch, reqs, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range reqs {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						server, err := sftp.NewServer(ch)
+						if err == nil {
+							server.Serve()
+						}
+						ch.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func TestParseSFTPURL(t *testing.T) {
+
+	tests := []struct {
+		url, user, host, dir, back string
+	}{
+		{"sftp://etl@example.com/captures", "etl", "example.com:22", "/captures", "sftp://etl@example.com:22/captures/x"},
+		{"sftp://etl@example.com:2222/~/captures", "etl", "example.com:2222", "captures", "sftp://etl@example.com:2222/~/captures/x"},
+		{"sftp://etl@example.com/~", "etl", "example.com:22", ".", "sftp://etl@example.com:22/~/x"},
+	}
+	for _, tt := range tests {
+		r, err := parseSFTPURL(tt.url)
+		if err != nil || r.user != tt.user || r.host != tt.host || r.dir != tt.dir || r.url(path.Join(r.dir, "x")) != tt.back {
+			t.Fatalf("%s: got %+v (%s), %v", tt.url, r, r.url(path.Join(r.dir, "x")), err)
+		}
+	}
+	for _, bad := range []string{"sftp:///captures", "ssh://etl@example.com/captures"} {
+		if _, err := parseSFTPURL(bad); err == nil {
+			t.Fatalf("%s: no error", bad)
+		}
+	}
+}
+
+// Archives are uploaded once closed, then listed, fetched and deleted
+func TestArchive(t *testing.T) {
+
+	addr := serveSFTP(t)
+	remoteDir := filepath.Join(tempDir(t), "captures")
+	dir := "sftp://tester@" + addr + remoteDir
+	keyFile := filepath.Join(os.Getenv("HOME"), ".ssh", "id_ecdsa")
+	rf, err := NewArchive(dir, "requests", ".fbf",
+		common.Logger(zap.NewNop()), common.Compress(false), common.SSHKey(keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rf.Write([]byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	finalized := rf.FinalizedFiles()
+	if len(finalized) != 1 {
+		t.Fatalf("got %+v", finalized)
+	}
+	var details common.ArchiveFileDetails
+	for _, details = range finalized {
+	}
+	remotePath := filepath.Join(remoteDir, details.FileName)
+	if data, _ := ioutil.ReadFile(remotePath); details.URL != "sftp://tester@"+addr+remotePath || string(data) != "content" {
+		t.Fatalf("got %+v, uploaded %q", details, data)
+	}
+
+	// With the default keys of ~/.ssh
+	localPath := filepath.Join(tempDir(t), "requests_1.fbf")
+	if err = ioutil.WriteFile(localPath, []byte("stored"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = Store(localPath, dir+"/2021"); err != nil {
+		t.Fatal(err)
+	}
+	files, err := List(dir)
+	sort.Strings(files)
+	if err != nil || len(files) != 2 || files[0] != "2021/requests_1.fbf" || files[1] != details.FileName {
+		t.Fatalf("listed %q, %v", files, err)
+	}
+	fetched, temporary, err := Fetch(dir + "/2021/requests_1.fbf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fetched)
+	if data, _ := ioutil.ReadFile(fetched); !temporary || string(data) != "stored" {
+		t.Fatalf("fetched %q", data)
+	}
+	if err = Delete(dir, files); err != nil {
+		t.Fatal(err)
+	}
+	if files, err = List(dir); err != nil || len(files) != 0 {
+		t.Fatalf("left %q, %v", files, err)
+	}
+}
+
+// Hosts must be known
+func TestUnknownHost(t *testing.T) {
+
+	addr := serveSFTP(t)
+	if err := ioutil.WriteFile(filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := List("sftp://tester@" + addr + "/tmp"); err == nil {
+		t.Fatal("no error")
+	}
+}
@@ -14,12 +14,14 @@ governing permissions and limitations under the License.
 package sum
 
 import (
-	"errors"
 	"fmt"
 	"hash"
+	"io"
 
 	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/frame"
 	"github.com/cespare/xxhash"
+	"github.com/pkg/errors"
 )
 
 /*
@@ -39,6 +41,14 @@ type ChecksumArchive struct {
 	chunksWritten    int64
 	finalizedFiles   []string
 	finalizedDetails map[string]common.ArchiveFileDetails
+
+	// Reading, see OpenArchive
+	r       io.ReadCloser // the archive read through, nil when writing
+	name    string        // its URL
+	records int64         // frames of requests read so far
+	prefix  []byte        // of the frame being read, until it is all there
+	skip    int64         // what is left of the frame being read, after its prefix
+	eof     bool          // read all the way
 }
 
 // NewArchive creates a new recorder file (for writing). The caller must call
@@ -55,10 +65,22 @@ func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicA
 	return rf, err
 }
 
-// OpenArchive opens an archive file for reading. `*FileArchive` returned is an io.Reader
-func OpenArchive(fileName string, bufferSize int) (rf *ChecksumArchive, err error) {
-
-	panic("Not implemented")
+// OpenArchive reads through the archive `r` reads, `fileName` opened with
+// archive.OpenArchive (decompressed, decrypted) as sum://<fileName>: its
+// xxhash64 and number of requests are computed as it is read. Once read all
+// the way and closed, FinalizedFiles has them, as Checksum and RowsWritten of
+// the archive under its checksum. They are those OnFinalize got when the
+// archive was written (see the manifest of blackhole), so that an archive
+// that was uploaded, copied or moved can be checked against them.
+func OpenArchive(fileName string, r io.ReadCloser) (rf *ChecksumArchive) {
+
+	return &ChecksumArchive{
+		xh:               xxhash.New(),
+		finalizedDetails: make(map[string]common.ArchiveFileDetails),
+		r:                r,
+		name:             fileName,
+		prefix:           make([]byte, 0, frame.PrefixLen),
+	}
 }
 
 // finalizeArchive is the companion function to CreateArchiveFile().
@@ -71,11 +93,11 @@ func (rf *ChecksumArchive) finalizeArchive() (finalFile string, err error) {
 }
 
 func List(dir string) (files []string, err error) {
-	panic("Not implemented")
+	return nil, common.NotSupported("Listing", "checksums", dir)
 }
 
 func Delete(dir string, files []string) (err error) {
-	panic("Not implemented")
+	return common.NotSupported("Deleting", "checksums", dir)
 }
 
 // Write satisfies io.Writer interface - main logic is the transparent
@@ -83,6 +105,9 @@ func Delete(dir string, files []string) (err error) {
 // opened
 func (rf *ChecksumArchive) Write(buf []byte) (int, error) {
 
+	if rf.r != nil {
+		return 0, errors.New("Write not supported for checksum of an archive read")
+	}
 	rf.bytesWritten += int64(len(buf))
 	rf.chunksWritten += 1
 	return rf.xh.Write(buf)
@@ -93,7 +118,62 @@ func (rf *ChecksumArchive) Write(buf []byte) (int, error) {
 // opened
 func (rf *ChecksumArchive) Read(p []byte) (n int, err error) {
 
-	return 0, errors.New("Read not supported for checksum target")
+	if rf.r == nil {
+		return 0, errors.New("Read not supported for checksum target")
+	}
+	n, err = rf.r.Read(p)
+	rf.xh.Write(p[:n])
+	rf.bytesWritten += int64(n)
+	rf.chunksWritten++
+	if cerr := rf.count(p[:n]); cerr != nil {
+		return n, errors.Wrapf(cerr, "Unable to read %s", rf.name)
+	}
+	if err == io.EOF {
+		if len(rf.prefix) > 0 || rf.skip > 0 {
+			return n, errors.Wrapf(io.ErrUnexpectedEOF, "Last request of %s cut short", rf.name)
+		}
+		rf.eof = true
+	}
+	return n, err
+}
+
+// count counts the frames of requests of `b`, read from the archive
+func (rf *ChecksumArchive) count(b []byte) error {
+
+	for len(b) > 0 {
+		if rf.skip > 0 {
+			n := int64(len(b))
+			if n > rf.skip {
+				n = rf.skip
+			}
+			rf.skip -= n
+			b = b[n:]
+			continue
+		}
+		take := frame.PrefixLen - len(rf.prefix)
+		if take > len(b) {
+			take = len(b)
+		}
+		rf.prefix = append(rf.prefix, b[:take]...)
+		b = b[take:]
+		if len(rf.prefix) < frame.PrefixLen {
+			continue
+		}
+		payloadLen, flags := frame.ParsePrefix(rf.prefix)
+		rf.prefix = rf.prefix[:0]
+		err := frame.CheckPrefix(payloadLen, flags)
+		if err != nil {
+			return err
+		}
+		rf.skip = int64(payloadLen)
+		if flags&frame.FlagCRC != 0 {
+			rf.skip += frame.CRCLen
+		}
+		if flags&frame.FlagHeader == 0 {
+			rf.records++
+		}
+	}
+	return nil
 }
 
 // Flush complements io.Writer
@@ -106,6 +186,9 @@ func (rf *ChecksumArchive) Flush() (err error) {
 // final-name
 func (rf *ChecksumArchive) Close() (err error) {
 
+	if rf.r != nil {
+		return rf.closeRead()
+	}
 	fileName, err := rf.finalizeArchive()
 	if err != nil {
 		return err
@@ -120,12 +203,32 @@ func (rf *ChecksumArchive) Close() (err error) {
 	return nil
 }
 
+// closeRead closes the archive read, and has its checksum listed by
+// FinalizedFiles if it was read all the way
+func (rf *ChecksumArchive) closeRead() (err error) {
+
+	if rf.eof {
+		checksum := fmt.Sprintf("%0X", rf.xh.Sum64())
+		rf.finalizedDetails[checksum] = common.ArchiveFileDetails{
+			FileName:      rf.name,
+			BytesWritten:  rf.bytesWritten,
+			ChunksWritten: rf.chunksWritten,
+			RowsWritten:   rf.records,
+			Checksum:      checksum}
+		rf.eof = false // in case Close() gets called again
+	}
+	return rf.r.Close()
+}
+
 func (rf *ChecksumArchive) FinalizedFiles() map[string]common.ArchiveFileDetails {
 
 	return rf.finalizedDetails
 }
 
 func (rf *ChecksumArchive) Name() string {
+	if rf.r != nil {
+		return rf.name
+	}
 	return "placeholder.checksum"
 }
 
@@ -0,0 +1,275 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package tcp provides archive interface for a remote collector socket,
+// tcp://host:port or tls://host:port. Nothing is written to files: every
+// archive has its own connection, which gets what an archive file would,
+// the file header and then length-prefixed request frames, complete ones
+// only. When a write fails, the archive reconnects with backoff and sends
+// the file header and the frames of that write again, so a collector must
+// drop the incomplete frame a connection may end with, and may get a few
+// requests twice. There are no acknowledgements: what was sent but not read
+// by the collector when a connection broke is lost.
+package tcp
+
+import (
+	"crypto/tls"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/frame"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// A write is attempted maxAttempts times in all, reconnecting first, waiting
+// from minBackoff, doubled every attempt, up to maxBackoff.
+const (
+	maxAttempts = 8
+	minBackoff  = 100 * time.Millisecond
+	maxBackoff  = 5 * time.Second
+)
+
+// dialTimeout and writeTimeout bound connecting and every write
+const (
+	dialTimeout  = 10 * time.Second
+	writeTimeout = 30 * time.Second
+)
+
+var tcpUrlRegex = regexp.MustCompile("^(?i)(tcp|tls)://([^/]+:[0-9]+)/?$")
+
+type TCPArchive struct {
+	common.Publisher
+	address string
+	useTLS  bool
+	conn    net.Conn
+	partial []byte // start of a frame whose end was not written yet
+	pending []byte // complete frames not sent yet
+	header  []byte // last file header frame written, sent again on reconnecting
+}
+
+// parseTCPURL splits tcp://host:port or tls://host:port
+func parseTCPURL(tcpURL string) (address string, useTLS bool, err error) {
+
+	parts := tcpUrlRegex.FindStringSubmatch(tcpURL)
+	if len(parts) != 3 {
+		return "", false, errors.Errorf("Unable to parse tcp url format (tcp://host:port or tls://host:port): %s", tcpURL)
+	}
+	return parts[2], strings.EqualFold(parts[1], "tls"), nil
+}
+
+// NewArchive creates a new archive streaming to a collector socket. `outDir`
+// is tcp://host:port, or tls://host:port for TLS with the system roots. The
+// collector must be reachable: the first connection is not retried. Frames
+// are sent in writes of up to the buffer size (0 - every write). Rotate
+// sends what is pending and starts a new batch, which stands for a file in
+// FinalizedFiles and OnFinalize; the connection stays open. The caller must
+// call `rf.Close()` to send what is left.
+func NewArchive(outDir, prefix, extension string, options ...func(*common.BasicArchive) error) (rf *TCPArchive, err error) {
+
+	address, useTLS, err := parseTCPURL(outDir)
+	if err != nil {
+		return nil, err
+	}
+	p, err := common.NewPublisher(strings.ToLower(outDir[:3])+"://"+address, "tcp", prefix, extension, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	rf = &TCPArchive{Publisher: *p,
+		address: address,
+		useTLS:  useTLS}
+	rf.OnWrite = rf.take
+	rf.OnFlush = rf.send
+	rf.OnClose = rf.release
+
+	err = rf.connect()
+	if err != nil {
+		return nil, err
+	}
+	err = rf.Rotate()
+	if err != nil {
+		rf.conn.Close()
+		return nil, err
+	}
+	return rf, err
+}
+
+// connect opens the connection and sends the file header: the last one
+// written, or else that of FileHeader
+func (rf *TCPArchive) connect() (err error) {
+
+	dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}
+	if rf.useTLS {
+		host, _, _ := net.SplitHostPort(rf.address)
+		rf.conn, err = tls.DialWithDialer(dialer, "tcp", rf.address, &tls.Config{ServerName: host})
+	} else {
+		rf.conn, err = dialer.Dial("tcp", rf.address)
+	}
+	if err != nil {
+		rf.conn = nil
+		return errors.Wrapf(err, "Unable to connect to %s", rf.URL)
+	}
+	header := rf.header
+	if header == nil {
+		header = rf.Header()
+	}
+	if header != nil {
+		err = rf.write(header)
+		if err != nil {
+			rf.disconnect()
+			return errors.Wrapf(err, "Unable to send file header to %s", rf.URL)
+		}
+	}
+	rf.Logger.Debug("Connected", zap.String("collector", rf.URL))
+	return nil
+}
+
+func (rf *TCPArchive) disconnect() {
+	if rf.conn != nil {
+		rf.conn.Close()
+		rf.conn = nil
+	}
+}
+
+// write writes `p` to the connection, all of it or fails
+func (rf *TCPArchive) write(p []byte) (err error) {
+	rf.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = rf.conn.Write(p)
+	return err
+}
+
+// send sends the pending frames, reconnecting with backoff if need be
+func (rf *TCPArchive) send() (err error) {
+
+	if len(rf.pending) == 0 {
+		return nil
+	}
+	backoff := minBackoff
+	for attempt := 1; ; attempt++ {
+		if rf.conn == nil {
+			err = rf.connect()
+		}
+		if err == nil {
+			err = rf.write(rf.pending)
+			if err != nil {
+				rf.disconnect()
+				err = errors.Wrapf(err, "Unable to send to %s", rf.URL)
+			}
+		}
+		if err == nil {
+			break
+		}
+		if attempt == maxAttempts {
+			return errors.Wrapf(err, "Giving up after %d attempts", attempt)
+		}
+		rf.Logger.Warn("Sending failed, will reconnect",
+			zap.String("collector", rf.URL), zap.Int("attempt", attempt), zap.Error(err))
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	rf.Published(1, len(rf.pending)) // a chunk
+	rf.pending = rf.pending[:0]
+	return nil
+}
+
+// OpenArchive is not supported: the collector keeps what it gets
+func OpenArchive(fileName string, bufferSize int) (rf *TCPArchive, err error) {
+	return nil, common.NotSupported("Reading", "collector sockets", fileName)
+}
+
+// Fetch is not supported, see OpenArchive
+func Fetch(fileName string) (localPath string, temporary bool, err error) {
+	return "", false, common.NotSupported("Reading", "collector sockets", fileName)
+}
+
+// Store sends the requests of a local archive file (compressed or not) to
+// the collector of `dir`, on a connection of its own
+func Store(localPath, dir string) (err error) {
+
+	rf, err := NewArchive(dir, "", "", common.Logger(common.DefaultLogger))
+	if err != nil {
+		return err
+	}
+	return rf.Store(localPath)
+}
+
+func List(dir string) (files []string, err error) {
+	return nil, common.NotSupported("Listing", "collector sockets", dir)
+}
+
+func ListDetails(dir string) (entries []common.ArchiveEntry, err error) {
+	return nil, common.NotSupported("Listing", "collector sockets", dir)
+}
+
+func Delete(dir string, files []string) (err error) {
+	return common.NotSupported("Deleting", "collector sockets", dir)
+}
+
+// take queues the complete frames written, sent once they fill the buffer.
+// The start of a frame is kept until the rest is written.
+func (rf *TCPArchive) take(buf []byte) (err error) {
+
+	data := buf
+	if len(rf.partial) > 0 {
+		rf.partial = append(rf.partial, buf...)
+		data = rf.partial
+	}
+	complete, err := common.CompleteFrames(data)
+	if err != nil {
+		return err
+	}
+	if header := lastHeader(data[:complete]); header != nil {
+		rf.header = append(rf.header[:0], header...)
+	}
+	rf.pending = append(rf.pending, data[:complete]...)
+	rf.partial = append(rf.partial[:0], data[complete:]...)
+	if len(rf.pending) > 0 && len(rf.pending) >= rf.WriteBufferSize() {
+		return rf.send()
+	}
+	return nil
+}
+
+// lastHeader returns the last file header frame of `frames`, complete
+// frames, or nil if there is none
+func lastHeader(frames []byte) (header []byte) {
+
+	for len(frames) >= frame.PrefixLen {
+		payloadLen, flags := frame.ParsePrefix(frames)
+		frameLen := frame.PrefixLen + payloadLen
+		if flags&frame.FlagCRC != 0 {
+			frameLen += frame.CRCLen
+		}
+		if flags&frame.FlagHeader != 0 {
+			header = frames[:frameLen]
+		}
+		frames = frames[frameLen:]
+	}
+	return header
+}
+
+// release drops the incomplete frame left, if any, and the connection
+func (rf *TCPArchive) release() error {
+
+	if len(rf.partial) > 0 {
+		rf.Logger.Warn("Incomplete frame left unsent",
+			zap.String("collector", rf.URL), zap.Int("bytes", len(rf.partial)))
+		rf.partial = rf.partial[:0]
+	}
+	rf.disconnect()
+	return nil
+}
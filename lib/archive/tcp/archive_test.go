@@ -0,0 +1,148 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package tcp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/frame"
+	"go.uber.org/zap"
+)
+
+// testFrame is a frame of `payload`
+func testFrame(payload string, flags byte) []byte {
+	buf := make([]byte, frame.PrefixLen, frame.PrefixLen+len(payload))
+	frame.PutPrefix(buf, len(payload), flags)
+	return append(buf, payload...)
+}
+
+// collect accepts connections until the end of the test, and returns its
+// address along with what each connection gets, once it is closed
+func collect(t *testing.T) (string, chan []byte) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	got := make(chan []byte, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				data, _ := ioutil.ReadAll(conn)
+				conn.Close()
+				got <- data
+			}()
+		}
+	}()
+	return ln.Addr().String(), got
+}
+
+func TestParseTCPURL(t *testing.T) {
+
+	tests := []struct {
+		url, address string
+		tls, err     bool
+	}{
+		{"tcp://collector:9000", "collector:9000", false, false},
+		{"TLS://collector:9000/", "collector:9000", true, false},
+		{"tcp://collector", "", false, true},
+		{"tcp://collector:9000/path", "", false, true},
+		{"udp://collector:9000", "", false, true},
+	}
+	for _, tt := range tests {
+		address, useTLS, err := parseTCPURL(tt.url)
+		if address != tt.address || useTLS != tt.tls || (err != nil) != tt.err {
+			t.Fatalf("%s: got %q, %v, %v", tt.url, address, useTLS, err)
+		}
+	}
+}
+
+func TestNewArchiveUnreachable(t *testing.T) {
+
+	addr, _ := collect(t)
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	unreachable := ln.Addr().String()
+	ln.Close()
+	if _, err := NewArchive("tcp://"+unreachable, "requests", ".fbf", common.Logger(zap.NewNop())); err == nil {
+		t.Fatal("no error")
+	}
+	if _, err := NewArchive("tcp://"+addr, "requests", ".fbf", common.Compress(true)); err == nil {
+		t.Fatal("no error compressing")
+	}
+}
+
+// The collector gets the file header, then complete frames only
+func TestSend(t *testing.T) {
+
+	addr, got := collect(t)
+	header := testFrame(`{"v":1}`, frame.FlagHeader)
+	rf, err := NewArchive("tcp://"+addr, "requests", ".fbf", common.Logger(zap.NewNop()),
+		common.FileHeader(func() []byte { return header }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fa, fb := testFrame("first", 0), testFrame("second", 0)
+	for _, buf := range [][]byte{fa[:3], fa[3:], fb, fa[:5]} {
+		if _, err = rf.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, want := <-got, bytes.Join([][]byte{header, fa, fb}, nil); !bytes.Equal(data, want) {
+		t.Fatalf("got %q, want %q", data, want)
+	}
+	if files := rf.FinalizedFiles(); len(files) != 1 {
+		t.Fatalf("got %d batches", len(files))
+	}
+}
+
+// A write that fails is sent again on a new connection, after the file
+// header
+func TestReconnect(t *testing.T) {
+
+	addr, got := collect(t)
+	header := testFrame(`{"v":1}`, frame.FlagHeader)
+	rf, err := NewArchive("tcp://"+addr, "requests", ".fbf", common.Logger(zap.NewNop()),
+		common.FileHeader(func() []byte { return header }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fa, fb := testFrame("first", 0), testFrame("second", 0)
+	if _, err = rf.Write(fa); err != nil {
+		t.Fatal(err)
+	}
+	rf.conn.Close() // broken, under the archive
+	if _, err = rf.Write(fb); err != nil {
+		t.Fatal(err)
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, want := <-got, append(header, fa...); !bytes.Equal(data, want) {
+		t.Fatalf("first connection got %q, want %q", data, want)
+	}
+	if data, want := <-got, append(header, fb...); !bytes.Equal(data, want) {
+		t.Fatalf("second connection got %q, want %q", data, want)
+	}
+}
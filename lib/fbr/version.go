@@ -0,0 +1,24 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package fbr
+
+// SchemaName and SchemaVersion identify request.fbs in archive file headers.
+// Bump SchemaVersion whenever fields are added to request.fbs.
+//
+//  1. id, method, uri, headers, body
+//  2. timestamp
+//  3. status, response_headers, response_body, duration
+const (
+	SchemaName    = "fbr.Request"
+	SchemaVersion = 3
+)
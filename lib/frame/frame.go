@@ -0,0 +1,171 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package frame defines how records are laid out in an archive stream.
+//
+// Every record (frame) starts with a little-endian uint64 prefix. The low 56 bits
+// are the length of the payload that follows, the high 8 bits are flags. Archives
+// written before flags existed have all flag bits zero and read the same way.
+//
+// A frame flagged FlagHeader carries a file header (JSON, see Header) instead of a
+// request. Writers put one at the start of each file. Request readers skip it.
+//
+// A frame flagged FlagCRC has a little-endian CRC32C (Castagnoli) of the payload
+// between the prefix and the payload. The length in the prefix does not include it.
+//
+// A frame flagged FlagZstd has its payload compressed with zstd, using a dictionary
+// the file header carries (Header.Dict). The length and checksum are those of the
+// compressed payload, as stored.
+//
+// This package does not depend on any other blackhole package on purpose:
+// both lib/request and the archive backends need it.
+package frame
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PrefixLen is the size of the length+flags prefix of every frame
+const PrefixLen = 8
+
+// Frame flags (high byte of the prefix)
+const (
+	FlagHeader byte = 0x80 // payload is a file header, not a request
+	FlagCRC    byte = 0x40 // CRCLen bytes of checksum follow the prefix
+	FlagZstd   byte = 0x20 // payload is zstd compressed with the dictionary of the header
+
+	KnownFlags = FlagHeader | FlagCRC | FlagZstd
+)
+
+// CRCLen is the size of the checksum of a FlagCRC frame
+const CRCLen = 4
+
+// MaxPayloadLen is the largest payload the prefix can describe
+const MaxPayloadLen = 1<<56 - 1
+
+// SanePayloadLen is the largest payload readers accept. A length above
+// this is far more likely to be a corrupted prefix than a real request.
+const SanePayloadLen = 1 << 30
+
+// Errors returned for frames that can't be right
+var (
+	ErrUnknownFlags = errors.New("unknown frame flags")
+	ErrTooLarge     = errors.New("frame length is too large")
+	ErrCRCMismatch  = errors.New("frame checksum mismatch")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Format is the value of Header.Format and Version is the current framing version
+//
+//  1. length+flags prefix, file header
+//  2. per frame checksums (FlagCRC)
+//  3. payloads compressed with a dictionary (FlagZstd)
+const (
+	Format  = "blackhole"
+	Version = 3
+)
+
+// PutPrefix writes the frame prefix into buf[:PrefixLen]
+func PutPrefix(buf []byte, payloadLen int, flags byte) {
+	binary.LittleEndian.PutUint64(buf, uint64(payloadLen)|uint64(flags)<<56)
+}
+
+// ParsePrefix reads the frame prefix from buf[:PrefixLen]
+func ParsePrefix(buf []byte) (payloadLen int, flags byte) {
+	v := binary.LittleEndian.Uint64(buf)
+	return int(v & MaxPayloadLen), byte(v >> 56)
+}
+
+// CheckPrefix returns an error if a parsed prefix can't be right
+func CheckPrefix(payloadLen int, flags byte) error {
+	if flags&^KnownFlags != 0 {
+		return errors.Wrapf(ErrUnknownFlags, "flags 0x%02x", flags)
+	}
+	if payloadLen > SanePayloadLen {
+		return errors.Wrapf(ErrTooLarge, "%d bytes", payloadLen)
+	}
+	return nil
+}
+
+// Checksum returns the CRC32C of a payload
+func Checksum(payload []byte) uint32 {
+	return crc32.Checksum(payload, crcTable)
+}
+
+// PutPrefixCRC writes the prefix, with FlagCRC added to `flags`, followed by
+// the checksum of `payload` into buf[:PrefixLen+CRCLen]. Returns PrefixLen+CRCLen.
+func PutPrefixCRC(buf []byte, payload []byte, flags byte) int {
+	PutPrefix(buf, len(payload), flags|FlagCRC)
+	binary.LittleEndian.PutUint32(buf[PrefixLen:], Checksum(payload))
+	return PrefixLen + CRCLen
+}
+
+// ParseCRC reads the checksum from buf[:CRCLen]
+func ParseCRC(buf []byte) uint32 {
+	return binary.LittleEndian.Uint32(buf)
+}
+
+// Header is the payload of a FlagHeader frame. It describes the file,
+// not the codec used to store it (that is visible from outside).
+type Header struct {
+	Format        string    `json:"format"`  // always "blackhole"
+	Version       int       `json:"version"` // framing version
+	Schema        string    `json:"schema"`  // payload schema of the requests, e.g. "fbr.Request"
+	SchemaVersion int       `json:"schema_version"`
+	Created       time.Time `json:"created"`
+	Host          string    `json:"host,omitempty"`
+	Dict          []byte    `json:"dict,omitempty"` // zstd dictionary of FlagZstd frames
+}
+
+// NewHeader returns a header for a file created now, on this host
+func NewHeader(schema string, schemaVersion int) Header {
+	host, _ := os.Hostname()
+	return Header{
+		Format:        Format,
+		Version:       Version,
+		Schema:        schema,
+		SchemaVersion: schemaVersion,
+		Created:       time.Now().UTC(),
+		Host:          host,
+	}
+}
+
+// Frame returns the header as a complete frame (prefix included)
+func (h Header) Frame() (buf []byte, err error) {
+	payload, err := json.Marshal(h)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to encode header")
+	}
+	buf = make([]byte, PrefixLen+CRCLen+len(payload))
+	n := PutPrefixCRC(buf, payload, FlagHeader)
+	copy(buf[n:], payload)
+	return buf, nil
+}
+
+// ParseHeader decodes the payload of a FlagHeader frame
+func ParseHeader(payload []byte) (h Header, err error) {
+	err = json.Unmarshal(payload, &h)
+	if err != nil {
+		return h, errors.Wrap(err, "Unable to decode header")
+	}
+	if h.Format != Format {
+		return h, errors.Errorf("Unknown header format: %q", h.Format)
+	}
+	return h, nil
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package frame
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestPrefix(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		payloadLen int
+		flags      byte
+		err        error
+	}{
+		{"empty", 0, 0, nil},
+		{"request", 1234, 0, nil},
+		{"header", 200, FlagHeader | FlagCRC, nil},
+		{"all flags", 1, KnownFlags, nil},
+		{"sane", SanePayloadLen, FlagZstd, nil},
+		{"too large", SanePayloadLen + 1, 0, ErrTooLarge},
+		{"largest", MaxPayloadLen, 0, ErrTooLarge},
+		{"unknown flag", 10, 0x01, ErrUnknownFlags},
+		{"unknown and known flags", 10, FlagCRC | 0x10, ErrUnknownFlags},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, PrefixLen)
+			PutPrefix(buf, tt.payloadLen, tt.flags)
+			payloadLen, flags := ParsePrefix(buf)
+			if payloadLen != tt.payloadLen || flags != tt.flags {
+				t.Fatalf("got %d bytes, flags 0x%02x, want %d, 0x%02x", payloadLen, flags, tt.payloadLen, tt.flags)
+			}
+			if err := CheckPrefix(payloadLen, flags); errors.Cause(err) != tt.err {
+				t.Fatalf("CheckPrefix: got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+// Archives written before flags existed have plain lengths
+func TestPrefixWithoutFlags(t *testing.T) {
+	buf := []byte{5, 0, 0, 0, 0, 0, 0, 0}
+	if payloadLen, flags := ParsePrefix(buf); payloadLen != 5 || flags != 0 {
+		t.Fatalf("got %d bytes, flags 0x%02x", payloadLen, flags)
+	}
+}
+
+func TestPrefixCRC(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		payload []byte
+		flags   byte
+	}{
+		{"empty", nil, 0},
+		{"request", []byte("a request"), 0},
+		{"header", []byte(`{"format":"blackhole"}`), FlagHeader},
+		{"crc already set", []byte("x"), FlagCRC},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, PrefixLen+CRCLen)
+			if n := PutPrefixCRC(buf, tt.payload, tt.flags); n != len(buf) {
+				t.Fatalf("got %d bytes, want %d", n, len(buf))
+			}
+			payloadLen, flags := ParsePrefix(buf)
+			if payloadLen != len(tt.payload) || flags != tt.flags|FlagCRC {
+				t.Fatalf("got %d bytes, flags 0x%02x", payloadLen, flags)
+			}
+			if crc := ParseCRC(buf[PrefixLen:]); crc != Checksum(tt.payload) {
+				t.Fatalf("got checksum %08x, want %08x", crc, Checksum(tt.payload))
+			}
+		})
+	}
+}
+
+func TestHeader(t *testing.T) {
+
+	tests := []struct {
+		name string
+		h    Header
+	}{
+		{"new", NewHeader("fbr.Request", 1)},
+		{"with dictionary", func() Header {
+			h := NewHeader("fbr.Request", 2)
+			h.Dict = []byte{0x37, 0xa4, 0x30, 0xec, 1, 2, 3}
+			return h
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := tt.h.Frame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			payloadLen, flags := ParsePrefix(buf)
+			if flags != FlagHeader|FlagCRC || payloadLen != len(buf)-PrefixLen-CRCLen {
+				t.Fatalf("got %d bytes, flags 0x%02x", payloadLen, flags)
+			}
+			payload := buf[PrefixLen+CRCLen:]
+			if ParseCRC(buf[PrefixLen:]) != Checksum(payload) {
+				t.Fatal("checksum mismatch")
+			}
+			h, err := ParseHeader(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !h.Created.Equal(tt.h.Created) || h.Schema != tt.h.Schema ||
+				h.SchemaVersion != tt.h.SchemaVersion || h.Version != Version || !bytes.Equal(h.Dict, tt.h.Dict) {
+				t.Fatalf("got %+v, want %+v", h, tt.h)
+			}
+		})
+	}
+}
+
+func TestParseHeaderErrors(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"not json", "fbr"},
+		{"other format", `{"format":"other","version":1}`},
+		{"no format", `{"version":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseHeader([]byte(tt.payload)); err == nil {
+				t.Fatal("no error")
+			}
+		})
+	}
+}
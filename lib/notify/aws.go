@@ -0,0 +1,160 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/cespare/xxhash"
+	"github.com/pkg/errors"
+)
+
+// awsTimeout bounds one SQS/SNS call, including the SDK's own retries
+const awsTimeout = 30 * time.Second
+
+var s3URLRegex = regexp.MustCompile("^s3://([^/]+)/(.+)$")
+
+// s3Message is the body of SQS and SNS messages: the uploaded object, and
+// the event as its manifest. Bucket and key are message attributes as well,
+// for subscription filter policies.
+type s3Message struct {
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	Manifest Event  `json:"manifest"`
+}
+
+// newS3Message fails if the file was not uploaded to S3
+func newS3Message(ev Event) (msg s3Message, body string, err error) {
+
+	parts := s3URLRegex.FindStringSubmatch(ev.URL)
+	if parts == nil {
+		return msg, "", errors.Errorf("Not an S3 object: %s", ev.URL)
+	}
+	msg = s3Message{Bucket: parts[1], Key: parts[2], Manifest: ev}
+	b, err := json.Marshal(&msg)
+	if err != nil {
+		return msg, "", errors.Wrap(err, "Unable to encode event")
+	}
+	return msg, string(b), nil
+}
+
+// SQS sends a message per S3 upload to a queue. Credentials and region are
+// found the same way as for the S3 backend.
+type SQS struct {
+	client   *sqs.Client
+	queueURL string
+}
+
+// NewSQS returns an SQS notifier sending to `queueURL`
+// (https://sqs.<region>.amazonaws.com/<account>/<queue>). FIFO queues are
+// supported, with all messages in a single group.
+func NewSQS(queueURL string) (q *SQS, err error) {
+
+	if queueURL == "" {
+		return nil, errors.New("SQS queue URL is empty")
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load default aws config")
+	}
+	return &SQS{client: sqs.NewFromConfig(cfg), queueURL: queueURL}, nil
+}
+
+func (q *SQS) Notify(ev Event) (err error) {
+
+	msg, body, err := newS3Message(ev)
+	if err != nil {
+		return err
+	}
+	input := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(q.queueURL),
+		MessageBody: aws.String(body),
+		MessageAttributes: map[string]sqstypes.MessageAttributeValue{
+			"bucket": {DataType: aws.String("String"), StringValue: aws.String(msg.Bucket)},
+			"key":    {DataType: aws.String("String"), StringValue: aws.String(msg.Key)},
+		},
+	}
+	if strings.HasSuffix(q.queueURL, ".fifo") {
+		input.MessageGroupId = aws.String("blackhole")
+		// keys may be longer than the 128 characters allowed
+		input.MessageDeduplicationId = aws.String(fmt.Sprintf("%0X", xxhash.Sum64String(ev.URL)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), awsTimeout)
+	defer cancel()
+	_, err = q.client.SendMessage(ctx, input)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to send SQS message to %s", q.queueURL)
+	}
+	return nil
+}
+
+// SNS publishes a notification per S3 upload to a topic. Credentials and
+// region are found the same way as for the S3 backend.
+type SNS struct {
+	client   *sns.Client
+	topicARN string
+}
+
+// NewSNS returns an SNS notifier publishing to `topicARN`
+func NewSNS(topicARN string) (t *SNS, err error) {
+
+	if topicARN == "" {
+		return nil, errors.New("SNS topic ARN is empty")
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load default aws config")
+	}
+	return &SNS{client: sns.NewFromConfig(cfg), topicARN: topicARN}, nil
+}
+
+func (t *SNS) Notify(ev Event) (err error) {
+
+	msg, body, err := newS3Message(ev)
+	if err != nil {
+		return err
+	}
+	input := &sns.PublishInput{
+		TopicArn: aws.String(t.topicARN),
+		Subject:  aws.String("Archive finalized"),
+		Message:  aws.String(body),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"bucket": {DataType: aws.String("String"), StringValue: aws.String(msg.Bucket)},
+			"key":    {DataType: aws.String("String"), StringValue: aws.String(msg.Key)},
+		},
+	}
+	if strings.HasSuffix(t.topicARN, ".fifo") {
+		input.MessageGroupId = aws.String("blackhole")
+		input.MessageDeduplicationId = aws.String(fmt.Sprintf("%0X", xxhash.Sum64String(ev.URL)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), awsTimeout)
+	defer cancel()
+	_, err = t.client.Publish(ctx, input)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to publish to SNS topic %s", t.topicARN)
+	}
+	return nil
+}
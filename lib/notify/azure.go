@@ -0,0 +1,180 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/cespare/xxhash"
+	"github.com/pkg/errors"
+)
+
+var azURLRegex = regexp.MustCompile("^az://([^/]+)/(.+)$")
+
+// azMessage is the data of Event Grid events and the content of Storage
+// Queue messages: the blob, its checksum, and the event as its manifest.
+type azMessage struct {
+	Container string `json:"container"`
+	Path      string `json:"path"`
+	Checksum  string `json:"checksum"`
+	Manifest  Event  `json:"manifest"`
+}
+
+// newAZMessage fails if the file was not uploaded to Azure
+func newAZMessage(ev Event) (msg azMessage, err error) {
+
+	parts := azURLRegex.FindStringSubmatch(ev.URL)
+	if parts == nil {
+		return msg, errors.Errorf("Not an Azure blob: %s", ev.URL)
+	}
+	return azMessage{Container: parts[1], Path: parts[2], Checksum: ev.Checksum, Manifest: ev}, nil
+}
+
+// eventGridEvent is an event in the Event Grid schema
+type eventGridEvent struct {
+	ID          string    `json:"id"`
+	EventType   string    `json:"eventType"`
+	Subject     string    `json:"subject"`
+	EventTime   time.Time `json:"eventTime"`
+	Data        azMessage `json:"data"`
+	DataVersion string    `json:"dataVersion"`
+}
+
+// EventGrid publishes an event per blob upload to an Event Grid custom
+// topic. Its subject is the same as the one of Storage BlobCreated events,
+// /blobServices/default/containers/<container>/blobs/<path>, so
+// subscriptions can filter on it the same way.
+type EventGrid struct {
+	wh *Webhook
+}
+
+// NewEventGrid returns an EventGrid notifier for the topic `endpoint`
+// (https://<topic>.<region>-1.eventgrid.azure.net/api/events) and access key.
+func NewEventGrid(endpoint, key string) (eg *EventGrid, err error) {
+
+	if key == "" {
+		return nil, errors.New("Event Grid topic key is empty")
+	}
+	wh, err := NewWebhook(endpoint, Header("aeg-sas-key", key))
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid Event Grid topic endpoint")
+	}
+	return &EventGrid{wh: wh}, nil
+}
+
+func (eg *EventGrid) Notify(ev Event) (err error) {
+
+	msg, err := newAZMessage(ev)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal([]eventGridEvent{{
+		ID:          fmt.Sprintf("%0X", xxhash.Sum64String(ev.URL)),
+		EventType:   "Blackhole.ArchiveFinalized",
+		Subject:     fmt.Sprintf("/blobServices/default/containers/%s/blobs/%s", msg.Container, msg.Path),
+		EventTime:   ev.FinalizedAt,
+		Data:        msg,
+		DataVersion: "1.0",
+	}})
+	if err != nil {
+		return errors.Wrap(err, "Unable to encode event")
+	}
+	return eg.wh.send(payload)
+}
+
+// StorageQueue puts a message per blob upload in a Storage Queue of the
+// storage account the az backend writes to (AZURE_STORAGE_ACCOUNT and
+// AZURE_STORAGE_ACCESS_KEY). Message content is base64 encoded JSON, as
+// Azure Functions queue triggers expect by default.
+type StorageQueue struct {
+	p        pipeline.Pipeline
+	messages url.URL
+}
+
+// NewStorageQueue returns a StorageQueue notifier for queue `name`
+func NewStorageQueue(name string) (sq *StorageQueue, err error) {
+
+	if name == "" {
+		return nil, errors.New("Storage Queue name is empty")
+	}
+	accountName, accountKey := os.Getenv("AZURE_STORAGE_ACCOUNT"), os.Getenv("AZURE_STORAGE_ACCESS_KEY")
+	if len(accountName) == 0 || len(accountKey) == 0 {
+		return nil, errors.New("Either the AZURE_STORAGE_ACCOUNT or AZURE_STORAGE_ACCESS_KEY environment variable is not set")
+	}
+	// Queue requests are signed the same way as blob ones
+	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid credentials")
+	}
+	u, err := url.Parse(fmt.Sprintf("https://%s.queue.core.windows.net/%s/messages", accountName, name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid queue name %s", name)
+	}
+	return &StorageQueue{
+		p:        azblob.NewPipeline(credential, azblob.PipelineOptions{}),
+		messages: *u,
+	}, nil
+}
+
+func (sq *StorageQueue) Notify(ev Event) (err error) {
+
+	msg, err := newAZMessage(ev)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(&msg)
+	if err != nil {
+		return errors.Wrap(err, "Unable to encode event")
+	}
+	body, err := xml.Marshal(struct {
+		XMLName     xml.Name `xml:"QueueMessage"`
+		MessageText string
+	}{MessageText: base64.StdEncoding.EncodeToString(content)})
+	if err != nil {
+		return errors.Wrap(err, "Unable to encode event")
+	}
+
+	req, err := pipeline.NewRequest(http.MethodPost, sq.messages, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Unable to create queue request")
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("x-ms-version", azblob.ServiceVersion)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	resp, err := sq.p.Do(ctx, nil, req)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to put message in %s", sq.messages.String())
+	}
+	hresp := resp.Response()
+	defer hresp.Body.Close()
+	if hresp.StatusCode < 200 || hresp.StatusCode > 299 {
+		detail, _ := ioutil.ReadAll(hresp.Body)
+		return errors.Errorf("Put message in %s returned %s: %s", sq.messages.String(), hresp.Status, detail)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+/*
+Package notify tells downstream pipelines about archive files as soon as they
+are finalized (renamed or uploaded), so they don't have to poll listings.
+Events are POSTed to webhooks, or, for uploads to S3, sent to SQS queues or
+SNS topics, and for uploads to Azure, to Event Grid topics or Storage Queues.
+
+	wh, err := notify.NewWebhook("https://pipeline.example.com/hooks/blackhole")
+	...
+	rec, err := recorder.New(recorder.OutputDir("s3://bucket/captures/"),
+		recorder.OnFinalize(notify.OnFinalize(wh, logger)))
+*/
+package notify
+
+import (
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive/common"
+	"go.uber.org/zap"
+)
+
+// Event describes one finalized archive file. It is sent as JSON.
+type Event struct {
+	URL         string    `json:"url"`
+	FileName    string    `json:"file_name"`
+	Records     int64     `json:"records"`
+	Bytes       int64     `json:"bytes"`              // size of the file, compressed if it is
+	Checksum    string    `json:"checksum,omitempty"` // xxhash of the uncompressed file, hex
+	FirstRecord time.Time `json:"first_record"`
+	LastRecord  time.Time `json:"last_record"`
+	FinalizedAt time.Time `json:"finalized_at"`
+	Failover    string    `json:"failover,omitempty"` // why the file is not in the primary output
+}
+
+// NewEvent returns the event of a file finalized just now
+func NewEvent(d common.ArchiveFileDetails) Event {
+	return Event{
+		URL:         d.URL,
+		FileName:    d.FileName,
+		Records:     d.RowsWritten,
+		Bytes:       d.BytesWritten,
+		Checksum:    d.Checksum,
+		FirstRecord: d.FirstRow,
+		LastRecord:  d.LastRow,
+		FinalizedAt: time.Now(),
+		Failover:    d.Failover,
+	}
+}
+
+// Notifier sends an event somewhere
+type Notifier interface {
+	Notify(ev Event) error
+}
+
+// All returns a Notifier sending events to each of `notifiers`. All of them
+// are tried; the first error is returned.
+func All(notifiers ...Notifier) Notifier {
+	return multi(notifiers)
+}
+
+type multi []Notifier
+
+func (m multi) Notify(ev Event) (err error) {
+	for _, n := range m {
+		if nerr := n.Notify(ev); nerr != nil && err == nil {
+			err = nerr
+		}
+	}
+	return err
+}
+
+// OnFinalize adapts a Notifier to common.OnFinalize (and recorder.OnFinalize).
+// A failed notification is logged; it doesn't fail the archive, whose file
+// is already in place.
+func OnFinalize(n Notifier, logger *zap.Logger) func(common.ArchiveFileDetails) {
+	return func(d common.ArchiveFileDetails) {
+		ev := NewEvent(d)
+		err := n.Notify(ev)
+		if err != nil {
+			logger.Error("Notification failed", zap.String("url", ev.URL), zap.Error(err))
+			return
+		}
+		logger.Debug("Notified", zap.String("url", ev.URL), zap.Int64("records", ev.Records))
+	}
+}
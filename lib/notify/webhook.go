@@ -0,0 +1,136 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Webhook POSTs events as JSON to a URL
+type Webhook struct {
+	url     string
+	headers map[string]string
+	retries int
+	client  *http.Client
+}
+
+// NewWebhook returns a Webhook posting to `url`. Defaults: 10 second timeout,
+// 3 retries.
+func NewWebhook(url string, options ...func(*Webhook) error) (wh *Webhook, err error) {
+
+	if url == "" {
+		return nil, errors.New("Webhook URL is empty")
+	}
+	wh = &Webhook{
+		url:     url,
+		headers: make(map[string]string),
+		retries: 3,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, option := range options {
+		err = option(wh)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return wh, nil
+}
+
+// Header adds a header to every POST, e.g. Authorization
+func Header(name, value string) func(*Webhook) error {
+	return func(wh *Webhook) error {
+		wh.headers[name] = value
+		return nil
+	}
+}
+
+// Timeout sets the timeout of each attempt
+func Timeout(d time.Duration) func(*Webhook) error {
+	return func(wh *Webhook) error {
+		if d <= 0 {
+			return errors.Errorf("Webhook timeout must be positive, got %s", d)
+		}
+		wh.client.Timeout = d
+		return nil
+	}
+}
+
+// Retries sets how many times a failed POST is retried, with 1, 2, 4...
+// seconds in between. Client errors (4xx) are not retried.
+func Retries(n int) func(*Webhook) error {
+	return func(wh *Webhook) error {
+		if n < 0 {
+			return errors.Errorf("Webhook retries can't be negative, got %d", n)
+		}
+		wh.retries = n
+		return nil
+	}
+}
+
+// Notify POSTs the event. Any 2xx response is a success.
+func (wh *Webhook) Notify(ev Event) (err error) {
+
+	payload, err := json.Marshal(&ev)
+	if err != nil {
+		return errors.Wrap(err, "Unable to encode event")
+	}
+	return wh.send(payload)
+}
+
+// send POSTs `payload`, retrying as configured
+func (wh *Webhook) send(payload []byte) (err error) {
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = wh.post(payload)
+		if err == nil || !retry || attempt == wh.retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes one attempt. retry tells whether a failure may be temporary.
+func (wh *Webhook) post(payload []byte) (retry bool, err error) {
+
+	req, err := http.NewRequest(http.MethodPost, wh.url, bytes.NewReader(payload))
+	if err != nil {
+		return false, errors.Wrapf(err, "Invalid webhook URL %s", wh.url)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range wh.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return true, errors.Wrapf(err, "POST to %s failed", wh.url)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body) // so the connection can be reused
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests,
+			errors.Errorf("POST to %s returned %s", wh.url, resp.Status)
+	}
+	return false, nil
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+/*
+Package grpcrec provides gRPC server interceptors that record incoming calls
+with a recorder.Recorder. It is a separate package so that users of
+lib/recorder do not pull in gRPC.
+
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(grpcrec.UnaryServerInterceptor(rec)),
+		grpc.ChainStreamInterceptor(grpcrec.StreamServerInterceptor(rec)))
+
+Calls are recorded as the HTTP/2 requests they are on the wire: method POST,
+URI /package.Service/Method, metadata as headers along with the content-type,
+te and grpc-timeout headers gRPC keeps out of it, and the message, with its
+5 byte gRPC length prefix, as body. The message is marshalled again,
+uncompressed, so grpc-encoding is not recorded. A streaming call is recorded
+as one record per message received from the client, with the message number
+appended to the request ID (`<id>.1`, `<id>.2`...).
+*/
+package grpcrec
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/adobe/blackhole/lib/recorder"
+	"github.com/adobe/blackhole/lib/request"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/proto" // registers the "proto" codec
+	"google.golang.org/grpc/metadata"
+)
+
+// grpcPrefixLen is the length of the prefix of each gRPC message on the
+// wire: 1 byte compressed flag, then a 4 byte big endian length.
+const grpcPrefixLen = 5
+
+var seq uint64
+
+// UnaryServerInterceptor records each unary call before handling it
+func UnaryServerInterceptor(rec *recorder.Recorder) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+
+		record(ctx, rec, info.FullMethod, callID(ctx), req)
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor records every message received on client and
+// bidirectional streams
+func StreamServerInterceptor(rec *recorder.Recorder) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+
+		return handler(srv, &recordingStream{
+			ServerStream: ss,
+			rec:          rec,
+			method:       info.FullMethod,
+			id:           callID(ss.Context()),
+		})
+	}
+}
+
+// recordingStream records messages as the handler receives them
+type recordingStream struct {
+	grpc.ServerStream
+	rec    *recorder.Recorder
+	method string
+	id     string
+	n      int
+}
+
+func (rs *recordingStream) RecvMsg(m interface{}) error {
+	err := rs.ServerStream.RecvMsg(m)
+	if err == nil {
+		rs.n++
+		record(rs.Context(), rs.rec, rs.method, rs.id+"."+strconv.Itoa(rs.n), m)
+	}
+	return err
+}
+
+// callID returns the x-request-id of the call, or one made up like
+// lib/request does for fasthttp: time + sequence
+func callID(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get("x-request-id"); len(ids) > 0 && ids[0] != "" {
+			return ids[0]
+		}
+	}
+	return "GR-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "-" +
+		strconv.FormatUint(atomic.AddUint64(&seq, 1), 10)
+}
+
+// record saves one message. Messages that can't be marshalled again
+// (not protobuf) are recorded with an empty body rather than dropped.
+func record(ctx context.Context, rec *recorder.Recorder, method, id string, msg interface{}) {
+
+	var payload []byte
+	if codec := encoding.GetCodec("proto"); codec != nil {
+		payload, _ = codec.Marshal(msg)
+	}
+	body := make([]byte, grpcPrefixLen+len(payload))
+	binary.BigEndian.PutUint32(body[1:grpcPrefixLen], uint32(len(payload)))
+	copy(body[grpcPrefixLen:], payload)
+
+	rec.Record(request.CreateRequest(
+		[]byte(id), []byte("POST"), []byte(method),
+		rawHeaders(ctx), body))
+}
+
+// rawHeaders formats incoming metadata as `name: value` lines ending with an
+// empty line, like recorded HTTP headers. Of the pseudo headers, only
+// :authority is in metadata: it is recorded as Host. Binary (-bin) values are kept base64
+// encoded, as they are on the wire. The reserved headers gRPC keeps out of
+// metadata are added back: content-type (application/grpc if the call had
+// none, e.g. in process), te and grpc-timeout, what is left of it.
+func rawHeaders(ctx context.Context) []byte {
+
+	in, _ := metadata.FromIncomingContext(ctx)
+	md := in.Copy()
+	if len(md["content-type"]) == 0 {
+		md["content-type"] = []string{"application/grpc"}
+	}
+	md["te"] = []string{"trailers"}
+	if deadline, ok := ctx.Deadline(); ok {
+		md["grpc-timeout"] = []string{grpcTimeout(time.Until(deadline))}
+	}
+	names := make([]string, 0, len(md))
+	for name := range md {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	if hosts := md.Get(":authority"); len(hosts) > 0 {
+		buf.WriteString("Host: " + hosts[0] + "\r\n")
+	}
+	for _, name := range names {
+		if name == ":authority" {
+			continue
+		}
+		for _, value := range md[name] {
+			if strings.HasSuffix(name, "-bin") {
+				value = base64.RawStdEncoding.EncodeToString([]byte(value))
+			}
+			buf.WriteString(name + ": " + value + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// grpcTimeout formats `d` as a grpc-timeout value: at most 8 digits and a
+// unit, rounded up
+func grpcTimeout(d time.Duration) string {
+
+	if d <= 0 {
+		return "0n"
+	}
+	units := []struct {
+		d    time.Duration
+		name string
+	}{{time.Nanosecond, "n"}, {time.Microsecond, "u"}, {time.Millisecond, "m"},
+		{time.Second, "S"}, {time.Minute, "M"}, {time.Hour, "H"}}
+	for _, unit := range units {
+		if n := (d + unit.d - 1) / unit.d; n < 1e8 {
+			return strconv.FormatInt(int64(n), 10) + unit.name
+		}
+	}
+	return "99999999H"
+}
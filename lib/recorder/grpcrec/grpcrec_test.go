@@ -0,0 +1,138 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package grpcrec
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/recorder"
+	"github.com/adobe/blackhole/lib/request"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestGRPCTimeout(t *testing.T) {
+
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0n"},
+		{-time.Second, "0n"},
+		{1500 * time.Nanosecond, "1500n"},
+		{time.Second, "1000000u"},
+		{150 * time.Second, "150000m"},
+		{time.Duration(1e8) * time.Millisecond, "100000S"},
+		{time.Duration(1e8)*time.Millisecond + 1, "100001S"}, // rounded up
+		{1 << 62, "76861434M"},
+	}
+	for _, tt := range tests {
+		if got := grpcTimeout(tt.d); got != tt.want {
+			t.Fatalf("%s: got %s, want %s", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestRawHeaders(t *testing.T) {
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		":authority", "api.example.com",
+		"x-request-id", "id-1",
+		"trace-bin", "\x00\x01",
+		"b", "2", "b", "3"))
+	want := "Host: api.example.com\r\nb: 2\r\nb: 3\r\ncontent-type: application/grpc\r\nte: trailers\r\n" +
+		"trace-bin: AAE\r\nx-request-id: id-1\r\n\r\n"
+	if got := string(rawHeaders(ctx)); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	if got := string(rawHeaders(ctx)); got != "content-type: application/grpc\r\ngrpc-timeout: 3600000m\r\nte: trailers\r\n\r\n" &&
+		got != "content-type: application/grpc\r\ngrpc-timeout: 3599999m\r\nte: trailers\r\n\r\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "grpcrec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	rec, err := recorder.New(recorder.OutputDir(dir), recorder.Compress(false), recorder.Threads(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rec.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := wrapperspb.String("hello")
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-request-id", "id-1"))
+	handled := false
+	_, err = UnaryServerInterceptor(rec)(ctx, msg, &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Method"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			handled = true
+			return req, nil
+		})
+	if err != nil || !handled {
+		t.Fatalf("handled %v, %v", handled, err)
+	}
+	if err = rec.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "requests_*.fbf"))
+	if len(files) != 1 {
+		t.Fatalf("got files %q", files)
+	}
+	rf, err := archive.OpenArchive(files[0], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	umr, err := request.GetNextRequest(rf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer umr.Release()
+	r := umr.Request()
+	if string(r.Id()) != "id-1" || string(r.Method()) != "POST" || string(r.Uri()) != "/pkg.Service/Method" {
+		t.Fatalf("got %s %s %s", r.Id(), r.Method(), r.Uri())
+	}
+
+	// The message as on the wire, after its gRPC prefix
+	body := r.BodyBytes()
+	if len(body) < grpcPrefixLen || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:])) != len(body)-grpcPrefixLen {
+		t.Fatalf("bad prefix of %q", body)
+	}
+	var got wrapperspb.StringValue
+	if err = proto.Unmarshal(body[grpcPrefixLen:], &got); err != nil || got.Value != "hello" {
+		t.Fatalf("got %q, %v", got.Value, err)
+	}
+	if _, err = request.GetNextRequest(rf, false); err != io.EOF {
+		t.Fatalf("more than one request: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package recorder
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/valyala/fasthttp"
+)
+
+// Middleware returns a net/http handler recording every request before
+// passing it on to `next`. Requests are recorded the same way `blackhole`
+// records them, so archives can be replayed with `replay`.
+//
+// The request body is read up to MaxBody, and handed to `next` in full. Stop
+// the http.Server (Shutdown) before calling Stop on the recorder.
+//
+//	srv := &http.Server{Addr: ":8080", Handler: rec.Middleware(mux)}
+func (rec *Recorder) Middleware(next http.Handler) http.Handler {
+
+	var seq uint64
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		var body []byte
+		truncated := false
+		if r.Body != nil {
+			var err error
+			rest := r.Body
+			if rec.maxBody >= 0 {
+				rest = ioutil.NopCloser(io.LimitReader(r.Body, rec.maxBody+1))
+			}
+			body, err = ioutil.ReadAll(rest)
+			if err != nil {
+				r.Body.Close()
+				http.Error(w, "Unable to read request body", http.StatusBadRequest)
+				return
+			}
+			// What was read, then what is left, for `next`
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			if rec.maxBody >= 0 && int64(len(body)) > rec.maxBody {
+				body, truncated = body[:rec.maxBody], true
+			}
+		}
+
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			// Same as for fasthttp, except for the prefix: time + per-server sequence
+			id = "NH-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "-" +
+				strconv.FormatUint(atomic.AddUint64(&seq, 1), 10)
+		}
+		uri := r.Header.Get("X-Original-URI")
+		if uri == "" {
+			uri = r.RequestURI
+		}
+		if uri == "" { // handler called directly, not through a server
+			uri = r.URL.RequestURI()
+		}
+
+		headers := rawHeaders(r)
+		if truncated {
+			// Before the empty line ending them
+			headers = append(headers[:len(headers)-2],
+				"X-Blackhole-Truncated: "+strconv.FormatInt(r.ContentLength, 10)+"\r\n\r\n"...)
+		}
+		rec.Record(request.CreateRequest(
+			[]byte(id), []byte(r.Method), []byte(uri),
+			headers, body))
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WrapHandler returns a fasthttp handler recording every request before
+// calling `h`, for fasthttp services that want to record their own traffic.
+// As with Middleware, stop the server before stopping the recorder.
+//
+//	server := &fasthttp.Server{Handler: recorder.WrapHandler(handler, rec)}
+func WrapHandler(h fasthttp.RequestHandler, rec *Recorder) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		rec.HandleFastHTTP(ctx) // copies what it needs, h is free to modify the request
+		h(ctx)
+	}
+}
+
+// rawHeaders formats headers the way fasthttp's RawHeaders returns them:
+// `Name: value` lines, ending with an empty line. net/http keeps no original
+// order, so Host comes first, then other headers sorted by name.
+func rawHeaders(r *http.Request) []byte {
+
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	if r.Host != "" {
+		buf.WriteString("Host: ")
+		buf.WriteString(r.Host)
+		buf.WriteString("\r\n")
+	}
+	for _, name := range names {
+		for _, value := range r.Header[name] {
+			buf.WriteString(name)
+			buf.WriteString(": ")
+			buf.WriteString(value)
+			buf.WriteString("\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
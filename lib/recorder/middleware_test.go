@@ -0,0 +1,130 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package recorder
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// serve has `body` posted to `uri` through the middleware of `rec`, with
+// `headers`, and returns what the next handler read of the body
+func serve(t *testing.T, rec *Recorder, uri, body string, headers map[string]string) string {
+
+	var got []byte
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		got, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	r := httptest.NewRequest("POST", uri, strings.NewReader(body))
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	rec.Middleware(next).ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d", w.Code)
+	}
+	return string(got)
+}
+
+func TestMiddleware(t *testing.T) {
+
+	dir := tempDir(t)
+	rec := startRecorder(t, dir, Threads(1), MaxBody(4))
+	if got := serve(t, rec, "/events?a=1", "body", map[string]string{
+		"X-Request-ID": "id-1", "Content-Type": "text/plain"}); got != "body" {
+		t.Fatalf("next got %q", got)
+	}
+	if got := serve(t, rec, "/events", "longer body", map[string]string{
+		"X-Request-ID": "id-2", "X-Original-URI": "/original"}); got != "longer body" {
+		t.Fatalf("next got %q", got)
+	}
+	serve(t, rec, "/events", "", nil)
+	if err := rec.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := recordedRequests(t, dir)
+	if len(reqs) != 3 {
+		t.Fatalf("got %d requests", len(reqs))
+	}
+	want := []testRequest{
+		{"NH-", "POST", "/events", "Host: example.com\r\n\r\n", ""},
+		{"id-1", "POST", "/events?a=1", "Host: example.com\r\nContent-Type: text/plain\r\nX-Request-Id: id-1\r\n\r\n", "body"},
+		{"id-2", "POST", "/original",
+			"Host: example.com\r\nX-Original-Uri: /original\r\nX-Request-Id: id-2\r\nX-Blackhole-Truncated: 11\r\n\r\n", "long"},
+	}
+	if !strings.HasPrefix(reqs[0].id, want[0].id) {
+		t.Fatalf("got ID %q", reqs[0].id)
+	}
+	reqs[0].id = want[0].id
+	for i := range want {
+		if reqs[i] != want[i] {
+			t.Fatalf("got %q, want %q", reqs[i], want[i])
+		}
+	}
+}
+
+func TestWrapHandler(t *testing.T) {
+
+	dir := tempDir(t)
+	rec := startRecorder(t, dir, Threads(1))
+	ln := fasthttputil.NewInmemoryListener()
+	server := &fasthttp.Server{Handler: WrapHandler(func(ctx *fasthttp.RequestCtx) {
+		ctx.Request.SetBody([]byte("changed")) // recorded already
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	}, rec)}
+	go server.Serve(ln)
+	client := &fasthttp.HostClient{Addr: "example.com", Dial: func(addr string) (net.Conn, error) { return ln.Dial() }}
+
+	req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI("http://example.com/events")
+	req.Header.SetMethod("PUT")
+	req.Header.Set("X-Request-ID", "id-1")
+	req.SetBodyString("body")
+	if err := client.Do(req, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != fasthttp.StatusNoContent {
+		t.Fatalf("got status %d", resp.StatusCode())
+	}
+	if err := server.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := recordedRequests(t, dir)
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests", len(reqs))
+	}
+	if r := reqs[0]; r.id != "id-1" || r.method != "PUT" || r.uri != "/events" || r.body != "body" ||
+		!strings.Contains(r.headers, "X-Request-Id: id-1\r\n") {
+		t.Fatalf("got %q", r)
+	}
+}
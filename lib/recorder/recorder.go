@@ -0,0 +1,1016 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+/*
+Package recorder records requests into archives, the same way the `blackhole`
+binary does, for Go services that want to embed request recording.
+
+	rec, err := recorder.New(recorder.OutputDir("s3://bucket/captures/"), recorder.Threads(4))
+	...
+	err = rec.Start()
+	...
+	rec.Record(request.CreateRequest(id, method, uri, headers, body))
+	...
+	err = rec.Stop() // once nothing calls Record anymore
+
+Requests are handed over to a number of recorder threads, each writing its own
+archive file, through a buffered channel per thread. fasthttp requests go to
+the thread of their connection and others round-robin, so there is no single
+channel for all request handlers to contend on. Files are rotated on a timer
+and finalized (uploaded if remote) on Stop.
+
+With MaxThreads, the number of threads follows the load: a thread is added
+when queues fill up or threads spend most of their time writing, and the last
+one is retired (its file finalized) after a while of little traffic. See Stats
+for the metrics this is based on.
+
+With Spill, a request that finds the queue of its thread full is written to a
+local overflow file instead of blocking Record, and archived once the thread
+caught up.
+*/
+package recorder
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/frame"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// Recorder archives requests given to Record. With no output directory set,
+// requests are only counted.
+type Recorder struct {
+	outDir      string
+	teeDirs     []string // written the same as outDir, see Tee
+	fallbackDir string
+	stageDir    string // see StagingDirectory
+	threads     int
+	maxThreads  int
+	bufferSize  int
+	compress    bool
+	codec       string // see Compression, lz4 if empty
+	key         []byte // see Encrypt
+	dict        *request.Dictionary
+	rotateEvery time.Duration
+	flushEvery  time.Duration
+	flushAfter  int
+	coalesce    int
+	recoverTmp  bool
+	recoverAge  time.Duration // see RecoverOlderThan
+	leftovers   string        // see Leftovers
+	queueSize   int
+	maxBody     int64 // see MaxBody
+	spillDir    string
+	spillMax    int64
+	onError     func(error)
+	onFinalize  func(common.ArchiveFileDetails)
+	archiveOpts []func(*common.BasicArchive) error
+	logger      *zap.Logger
+
+	reqChans   []chan *request.MarshalledRequest // one per recorder thread, up to maxThreads
+	active     int32                             // threads given requests: reqChans[:active]
+	next       uint64                            // round-robin of Record
+	counters   []int64
+	writes     []int64 // archive writes of each thread
+	writeNanos []int64 // time these writes took
+	received   []int64 // frame bytes of requests taken by each thread
+	stored     int64   // bytes written to archive files, see common.CountStored
+	fallbacks  int64   // switches of a thread to fallbackDir
+	onFallback int32   // threads writing to fallbackDir
+	spill      *spill  // nil without Spill
+	spillLost  int64   // spilled requests lost to spill file errors
+	wg         sync.WaitGroup
+	done       chan struct{} // stops the scaler
+	scalerWg   sync.WaitGroup
+	mu         sync.Mutex
+	err        error // first error of a recorder thread
+}
+
+// Stats are the backpressure and throughput metrics of a Recorder
+type Stats struct {
+	Threads     int           // recorder threads given requests
+	Queued      int           // requests waiting for them
+	QueueCap    int           // how many requests can wait before Record blocks
+	Writes      int64         // archive writes so far (requests are written in batches)
+	WriteTime   time.Duration // time these writes took, in all
+	Recorded    int64         // same as Count
+	Received    int64         // bytes of requests recorded (as frames, uncompressed)
+	Stored      int64         // bytes written to archive files, after compression
+	Fallbacks   int64         // times a thread switched to the fallback directory
+	Degraded    int           // threads writing to the fallback directory now
+	Spilled     int64         // requests that went through the spill file, see Spill
+	SpillQueued int64         // requests in the spill file now
+	SpillLost   int64         // requests lost to spill file errors
+}
+
+// New returns a Recorder with the given options applied. Defaults are the same
+// as the `blackhole` binary: 5 threads, compressed, rotated every 10 minutes.
+func New(options ...func(*Recorder) error) (rec *Recorder, err error) {
+
+	rec = &Recorder{
+		threads:     5,
+		compress:    true,
+		rotateEvery: 10 * time.Minute,
+		queueSize:   10000,
+		maxBody:     fasthttp.DefaultMaxRequestBodySize,
+	}
+	for _, option := range options {
+		err = option(rec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rec.logger == nil {
+		rec.logger = zap.NewNop()
+	}
+	if rec.outDir == "" {
+		rec.outDir = "null://"
+	}
+	if rec.maxThreads < rec.threads {
+		rec.maxThreads = rec.threads // fixed
+	}
+	return rec, nil
+}
+
+// OutputDir sets where archives are written, any URL supported by lib/archive.
+// Empty (the default) is null://: requests are counted, not saved.
+func OutputDir(outDir string) func(*Recorder) error {
+	return func(r *Recorder) error {
+		r.outDir = outDir
+		return nil
+	}
+}
+
+// Dictionary has requests compressed one by one with a zstd dictionary, see
+// request.Dictionary. Files are better left uncompressed then (Compress(false)):
+// there is little left for lz4 to gain.
+func Dictionary(d *request.Dictionary) func(*Recorder) error {
+	return func(r *Recorder) error {
+		r.dict = d
+		return nil
+	}
+}
+
+// Tee has requests written to `outDirs` as well as to the output directory,
+// e.g. a local copy and a cloud copy, with an archive.MultiArchive. A write
+// fails, and the thread falls back (see Fallback), if any of them fails.
+func Tee(outDirs ...string) func(*Recorder) error {
+	return func(r *Recorder) error {
+		r.teeDirs = append(r.teeDirs, outDirs...)
+		return nil
+	}
+}
+
+// Fallback sets where a recorder thread goes on writing, any URL supported by
+// lib/archive, when its file in the output directory can't be created or
+// written. What was written to the failed file stays under its .tmp name (see
+// Recover). The thread tries the output directory again at every rotation.
+// Without a fallback (the default), such failures stop the thread.
+func Fallback(fallbackDir string) func(*Recorder) error {
+	return func(r *Recorder) error {
+		r.fallbackDir = fallbackDir
+		return nil
+	}
+}
+
+// StagingDirectory sets the local directory where files of a remote output
+// directory (s3, az, gs, ...) are staged until uploaded, instead of the
+// system temporary directory, see common.StagingDirectory. Recover looks for
+// their leftovers there.
+func StagingDirectory(dir string) func(*Recorder) error {
+	return func(r *Recorder) error {
+		r.stageDir = dir
+		return nil
+	}
+}
+
+// Threads sets the number of recorder threads, i.e. of files written in parallel
+func Threads(n int) func(*Recorder) error {
+	return func(r *Recorder) error {
+		if n <= 0 {
+			return errors.Errorf("Number of recorder threads must be positive, got %d", n)
+		}
+		r.threads = n
+		return nil
+	}
+}
+
+// MaxThreads lets the number of recorder threads grow up to `n` under load,
+// and shrink back to Threads when idle. 0 (the default), or anything up to
+// Threads, keeps it fixed.
+func MaxThreads(n int) func(*Recorder) error {
+	return func(r *Recorder) error {
+		if n < 0 {
+			return errors.Errorf("Maximum number of recorder threads can't be negative, got %d", n)
+		}
+		r.maxThreads = n
+		return nil
+	}
+}
+
+// BufferSize sets the write buffer size of archive files (0 - unbuffered)
+func BufferSize(bufferSize int) func(*Recorder) error {
+	return func(r *Recorder) error {
+		r.bufferSize = bufferSize
+		return nil
+	}
+}
+
+// Compress sets whether archive files are lz4 compressed
+func Compress(c bool) func(*Recorder) error {
+	return func(r *Recorder) error {
+		r.compress = c
+		return nil
+	}
+}
+
+// Compression sets the codec archive files are compressed with: lz4 (the
+// default), zstd, snappy or none
+func Compression(codec string) func(*Recorder) error {
+	return func(r *Recorder) error {
+		_, err := common.CodecExtension(codec)
+		if err != nil {
+			return err
+		}
+		r.compress = codec != "none"
+		r.codec = codec
+		return nil
+	}
+}
+
+// Encrypt has archive files AES-256-GCM encrypted with `key`, 32 bytes (see
+// common.Encrypt). Leftover files are recovered with it as well.
+func Encrypt(key []byte) func(*Recorder) error {
+	return func(r *Recorder) error {
+		err := common.AddDecryptionKey(key)
+		if err != nil {
+			return err
+		}
+		r.key = key
+		return nil
+	}
+}
+
+// RotateEvery sets how often a recorder thread starts a new file, if it
+// recorded anything since the last one. Archives that write files rotate
+// them on their own timer (see common.RotateEvery); the thread rotates the
+// others, and files of several output directories (Tee) together.
+func RotateEvery(d time.Duration) func(*Recorder) error {
+	return func(r *Recorder) error {
+		if d <= 0 {
+			return errors.Errorf("Rotation interval must be positive, got %s", d)
+		}
+		r.rotateEvery = d
+		return nil
+	}
+}
+
+// FlushEvery sets how often a recorder thread flushes and syncs its file to
+// disk, if it recorded anything since, so a crash loses at most that much of
+// recent requests. 0 (the default) leaves it to buffers filling up and to
+// rotation. Frequent flushes make smaller lz4 blocks, i.e. less compression.
+func FlushEvery(d time.Duration) func(*Recorder) error {
+	return func(r *Recorder) error {
+		if d < 0 {
+			return errors.Errorf("Flush interval can't be negative, got %s", d)
+		}
+		r.flushEvery = d
+		return nil
+	}
+}
+
+// FlushAfter has a recorder thread flush and sync its file to disk once it
+// recorded `n` requests since the last flush (0 - never), see FlushEvery.
+func FlushAfter(n int) func(*Recorder) error {
+	return func(r *Recorder) error {
+		if n < 0 {
+			return errors.Errorf("Number of requests between flushes can't be negative, got %d", n)
+		}
+		r.flushAfter = n
+		return nil
+	}
+}
+
+// CoalesceRecords has a recorder thread hold requests in memory until it has
+// `n` of them (or maxBatch bytes) and write them to its file together, rather
+// than writing whatever is queued right away. At low rates, requests otherwise
+// go out one by one: tiny writes that make for more lz4 blocks and less
+// compression. Held requests are written at least every 5 seconds, before a
+// flush and on rotation; a crash loses them. 0 (the default) holds none.
+func CoalesceRecords(n int) func(*Recorder) error {
+	return func(r *Recorder) error {
+		if n < 0 {
+			return errors.Errorf("Number of requests to coalesce can't be negative, got %d", n)
+		}
+		r.coalesce = n
+		return nil
+	}
+}
+
+// QueueSize sets how many requests can be waiting for recorder threads, in
+// all, before Record blocks. Each thread gets an equal share. Threads added
+// under load (see MaxThreads) get a share of the same size.
+func QueueSize(n int) func(*Recorder) error {
+	return func(r *Recorder) error {
+		r.queueSize = n
+		return nil
+	}
+}
+
+// MaxBody sets how much of a request body Middleware records, 4 MB by
+// default as fasthttp (-1: no limit). Longer bodies are recorded cut at
+// `n` bytes, with an X-Blackhole-Truncated header telling their length, if
+// known, or -1; `next` still gets all of it.
+func MaxBody(n int64) func(*Recorder) error {
+	return func(r *Recorder) error {
+		r.maxBody = n
+		return nil
+	}
+}
+
+// OnError sets a function called when a recorder thread fails (and stops).
+// The error is also returned by Stop. Requests queued for the thread from
+// then on are dropped.
+func OnError(f func(error)) func(*Recorder) error {
+	return func(r *Recorder) error {
+		r.onError = f
+		return nil
+	}
+}
+
+// OnFinalize sets a function called by recorder threads with the details of
+// each archive file once it is finalized (renamed or uploaded). Threads
+// finalize files independently, so it may be called concurrently. See
+// lib/notify for webhooks.
+func OnFinalize(f func(common.ArchiveFileDetails)) func(*Recorder) error {
+	return func(r *Recorder) error {
+		r.onFinalize = f
+		return nil
+	}
+}
+
+// ArchiveOptions adds options given to every archive the recorder creates,
+// after its own, e.g. common.SSHKey for an sftp:// output directory
+func ArchiveOptions(options ...func(*common.BasicArchive) error) func(*Recorder) error {
+	return func(r *Recorder) error {
+		r.archiveOpts = append(r.archiveOpts, options...)
+		return nil
+	}
+}
+
+// Logger sets the logger of the recorder and of the archives it writes
+func Logger(logger *zap.Logger) func(*Recorder) error {
+	return func(r *Recorder) error {
+		r.logger = logger
+		return nil
+	}
+}
+
+// Start starts the recorder threads. Archive files are created before it
+// returns, so a bad output directory is reported here. Threads added later
+// (see MaxThreads) create theirs when they get their first request.
+func (rec *Recorder) Start() (err error) {
+
+	if rec.recoverTmp && !archive.IsNull(rec.outDir) { // leftovers would be discarded
+		var rep RecoveryReport
+		dirs := []string{rec.outDir, rec.fallbackDir}
+		for _, dir := range rec.teeDirs {
+			if archive.IsLocal(dir) { // others stage in the same temp dir as outDir
+				dirs = append(dirs, dir)
+			}
+		}
+		for _, dir := range dirs {
+			if dir != "" {
+				err = rec.recoverOrphans(dir, &rep)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		rec.logger.Info("Recovery of leftover files",
+			zap.Int("files", rep.Files),
+			zap.Int("recovered", rep.Recovered),
+			zap.Int("truncated", rep.Truncated),
+			zap.Int("empty", rep.Empty),
+			zap.Int("failed", rep.Failed),
+			zap.Int("recent", rep.Recent),
+			zap.Int("deleted", rep.Deleted),
+			zap.Int("quarantined", rep.Quarantined),
+			zap.Int64("requests", rep.Requests))
+	}
+
+	files := make([]archive.Archive, rec.maxThreads)
+	for i := range files[:rec.threads] {
+		files[i], err = rec.newArchive(rec.outDir)
+		if err != nil && rec.fallbackDir != "" {
+			rec.logger.Warn("Unable to create archive file, will use the fallback",
+				zap.Int("thread", i), zap.Error(err))
+			err = nil // the thread falls back when it gets its first request
+			continue
+		}
+		if err != nil {
+			for _, rf := range files[:i] {
+				rf.Close()
+			}
+			return errors.Wrapf(err, "Unable to create archive file for worker %d", i)
+		}
+	}
+
+	rec.counters = make([]int64, rec.maxThreads)
+	rec.writes = make([]int64, rec.maxThreads)
+	rec.writeNanos = make([]int64, rec.maxThreads)
+	rec.received = make([]int64, rec.maxThreads)
+	if rec.spillDir != "" {
+		rec.spill, err = newSpill(rec.spillDir, rec.spillMax)
+		if err != nil {
+			for _, rf := range files {
+				if rf != nil {
+					rf.Close()
+				}
+			}
+			return err
+		}
+	}
+
+	rec.reqChans = make([]chan *request.MarshalledRequest, rec.maxThreads)
+	for i := range rec.reqChans {
+		rec.reqChans[i] = make(chan *request.MarshalledRequest, (rec.queueSize+rec.threads-1)/rec.threads)
+	}
+	rec.active = int32(rec.threads)
+	rec.wg.Add(rec.maxThreads)
+	for i := range files {
+		go func(grID int, rf archive.Archive) {
+			defer rec.wg.Done()
+			err := rec.requestConsumer(grID, rf)
+			if err != nil {
+				rec.mu.Lock()
+				if rec.err == nil {
+					rec.err = err
+				}
+				rec.mu.Unlock()
+				if rec.onError != nil {
+					rec.onError(err)
+				}
+				for mr := range rec.reqChans[grID] { // so Record doesn't block
+					mr.Release()
+				}
+			}
+		}(i, files[i])
+	}
+
+	rec.done = make(chan struct{})
+	if rec.maxThreads > rec.threads {
+		rec.scalerWg.Add(1)
+		go rec.scaler()
+	}
+	return nil
+}
+
+// newArchive creates the archive file of a recorder thread in `outDir`, and
+// in the Tee directories too for the output directory
+func (rec *Recorder) newArchive(outDir string) (archive.Archive, error) {
+	header := request.FileHeader
+	if rec.dict != nil {
+		header = rec.dict.FileHeader
+	}
+	options := []func(*common.BasicArchive) error{
+		common.Compress(rec.compress),
+		common.BufferSize(rec.bufferSize),
+		common.FileHeader(header),
+		common.Logger(rec.logger),
+		common.CountStored(&rec.stored)}
+	if rec.compress && rec.codec != "" {
+		options = append(options, common.Compression(rec.codec))
+	}
+	if rec.key != nil {
+		options = append(options, common.Encrypt(rec.key))
+	}
+	if rec.onFinalize != nil {
+		options = append(options, common.OnFinalize(rec.onFinalize))
+	}
+	if rec.stageDir != "" {
+		options = append(options, common.StagingDirectory(rec.stageDir))
+	}
+	options = append(options, rec.archiveOpts...)
+	if outDir == rec.outDir && len(rec.teeDirs) > 0 { // rotated together by the thread
+		return archive.NewMultiArchive(append([]string{outDir}, rec.teeDirs...), "requests", ".fbf", options...)
+	}
+	return archive.NewArchive(outDir, "requests", ".fbf", append(options, common.RotateEvery(rec.rotateEvery))...)
+}
+
+// rotatesOnTimer tells if `rf` rotates its files on its own (see
+// common.RotateEvery), else the thread rotates it
+func rotatesOnTimer(rf archive.Archive) bool {
+	rt, ok := rf.(interface{ RotatesOnTimer() bool })
+	return ok && rt.RotatesOnTimer()
+}
+
+// Record queues a request to be saved. The recorder takes ownership of `mr`
+// and releases it. Record must not be called after Stop.
+func (rec *Recorder) Record(mr *request.MarshalledRequest) {
+	rec.enqueue(rec.reqChans[atomic.AddUint64(&rec.next, 1)%uint64(atomic.LoadInt32(&rec.active))], mr)
+}
+
+// HandleFastHTTP records the request of a fasthttp handler. Requests of a
+// connection all go to the same recorder thread.
+func (rec *Recorder) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
+	rec.enqueue(rec.reqChans[ctx.ConnID()%uint64(atomic.LoadInt32(&rec.active))], request.CreateRequestFromFastHTTPCtx(ctx))
+}
+
+// Count returns the number of requests recorded so far. It is updated by
+// recorder threads every few seconds, and exact once Stop returns.
+func (rec *Recorder) Count() (total int64) {
+	for i := range rec.counters {
+		total += atomic.LoadInt64(&rec.counters[i])
+	}
+	return total
+}
+
+// Stats returns the current backpressure and throughput metrics. Counters are
+// cumulative: the average write latency over a period is the difference of
+// WriteTime divided by the difference of Writes, and bytes per second the
+// difference of Received or Stored divided by the period.
+func (rec *Recorder) Stats() (st Stats) {
+	st.Threads = int(atomic.LoadInt32(&rec.active))
+	for _, reqChan := range rec.reqChans[:st.Threads] {
+		st.Queued += len(reqChan)
+		st.QueueCap += cap(reqChan)
+	}
+	for i := range rec.writes {
+		st.Writes += atomic.LoadInt64(&rec.writes[i])
+		st.WriteTime += time.Duration(atomic.LoadInt64(&rec.writeNanos[i]))
+		st.Received += atomic.LoadInt64(&rec.received[i])
+	}
+	st.Stored = atomic.LoadInt64(&rec.stored)
+	st.Fallbacks = atomic.LoadInt64(&rec.fallbacks)
+	st.Degraded = int(atomic.LoadInt32(&rec.onFallback))
+	if rec.spill != nil {
+		st.Spilled = atomic.LoadInt64(&rec.spill.total)
+		st.SpillQueued = atomic.LoadInt64(&rec.spill.queued)
+		st.SpillLost = atomic.LoadInt64(&rec.spillLost)
+	}
+	st.Recorded = rec.Count()
+	return st
+}
+
+// Stop waits for queued requests to be saved and closes (finalizes) all
+// archive files. Returns the first error of any recorder thread.
+func (rec *Recorder) Stop() (err error) {
+
+	// **********************************************************
+	// WARNING: DO NOT SET reqChans CHANNELS TO NIL
+	// A nil channel is not equivalent to a "closed" channel.
+	// Behavior is completely opposite (block vs release)
+	// https://dave.cheney.net/2014/03/19/channel-axioms
+	// We want all readers to come out of the for-range/select
+	// **********************************************************
+	close(rec.done)
+	rec.scalerWg.Wait()
+	for _, reqChan := range rec.reqChans {
+		close(reqChan)
+	}
+
+	rec.logger.Info("shutdown: Waiting for all reader threads to exit")
+	rec.wg.Wait()
+	rec.logger.Info("All reader threads finished")
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.spill != nil {
+		serr := rec.spill.close()
+		if serr != nil && rec.err == nil {
+			rec.err = serr
+		}
+	}
+	return rec.err
+}
+
+const (
+	// scaleEvery is how often the scaler looks at the metrics
+	scaleEvery = time.Second
+	// scaleDownAfter is how many quiet periods in a row retire a thread
+	scaleDownAfter = 30
+)
+
+// scaler adds a thread when more than a quarter of the queues is taken or
+// threads spend most of the time writing, and retires the last one after
+// scaleDownAfter periods of short queues and threads mostly waiting. A
+// retired thread finalizes its file once it has saved what was queued for it.
+func (rec *Recorder) scaler() {
+
+	defer rec.scalerWg.Done()
+	ticker := time.NewTicker(scaleEvery)
+	defer ticker.Stop()
+
+	last := rec.Stats()
+	quiet := 0
+	for {
+		select {
+		case <-rec.done:
+			return
+		case <-ticker.C:
+		}
+
+		st := rec.Stats()
+		busy := float64(st.WriteTime-last.WriteTime) / float64(scaleEvery) / float64(st.Threads) // share of time spent writing
+		last = st
+
+		switch {
+		case (st.Queued*4 > st.QueueCap || busy > 0.75) && st.Threads < rec.maxThreads:
+			atomic.StoreInt32(&rec.active, int32(st.Threads+1))
+			quiet = 0
+			rec.logger.Info("Recorder thread added",
+				zap.Int("threads", st.Threads+1), zap.Int("queued", st.Queued), zap.Float64("busy", busy))
+		case st.Queued*20 < st.QueueCap && busy < 0.25 && st.Threads > rec.threads:
+			quiet++
+			if quiet >= scaleDownAfter {
+				atomic.StoreInt32(&rec.active, int32(st.Threads-1))
+				quiet = 0
+				rec.logger.Info("Recorder thread retired",
+					zap.Int("threads", st.Threads-1), zap.Int("queued", st.Queued), zap.Float64("busy", busy))
+			}
+		default:
+			quiet = 0
+		}
+	}
+}
+
+// maxBatch is the most bytes of requests a recorder thread coalesces into a
+// single write, and maxBatchRequests the most requests it takes off the
+// queue at once
+const (
+	maxBatch         = 256 << 10
+	maxBatchRequests = 1024
+)
+
+// requestConsumer is called as a goroutine, handling
+// a single recorder file. To maximize IO, there will be many such recorder threads.
+// With no output directory, the file is null:// and only counts requests. rf is nil until
+// the thread gets requests if it was added by the scaler, and again once it is
+// retired and has saved what was queued.
+func (rec *Recorder) requestConsumer(grID int, rf archive.Archive) (err error) {
+
+	llg := rec.logger.With(zap.Int("thread", grID))
+	reqChan := rec.reqChans[grID]
+
+	numRequests := 0
+	numRequestsAtLastSave := 0
+	numRequestsAtLastFlush := 0
+	var bytesReceived int64
+
+	// fallBack replaces the file of the thread, which failed with `cause`, by
+	// one in the fallback directory. The failed file is left as it is.
+	onFallback := false
+	fallBack := func(cause error) error {
+		if rec.fallbackDir == "" || onFallback {
+			return cause
+		}
+		name := ""
+		if rf != nil {
+			name = rf.Name()
+			rf.Close() // most likely fails as well
+		}
+		frf, err := rec.newArchive(rec.fallbackDir)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to create archive file in fallback %s after: %v", rec.fallbackDir, cause)
+		}
+		rf = frf
+		onFallback = true
+		atomic.AddInt64(&rec.fallbacks, 1)
+		atomic.AddInt32(&rec.onFallback, 1)
+		numRequestsAtLastSave, numRequestsAtLastFlush = numRequests, numRequests
+		llg.Warn("Switched to fallback",
+			zap.String("failed", name), zap.String("file", rf.Name()), zap.Error(cause))
+		return nil
+	}
+	leftFallback := func() {
+		if onFallback {
+			onFallback = false
+			atomic.AddInt32(&rec.onFallback, -1)
+		}
+	}
+
+	// rotate starts a new file, back in the output directory if possible
+	rotate := func() error {
+		if !onFallback {
+			return rf.Rotate()
+		}
+		primary, err := rec.newArchive(rec.outDir)
+		if err != nil {
+			llg.Debug("Output directory still failing", zap.Error(err))
+			if rotatesOnTimer(rf) {
+				return nil
+			}
+			return rf.Rotate()
+		}
+		err = rf.Close()
+		if err != nil {
+			llg.Error("Closing failed", zap.String("file", rf.Name()), zap.Error(err))
+		}
+		rf = primary
+		leftFallback()
+		llg.Info("Switched back from fallback", zap.String("file", rf.Name()))
+		return nil
+	}
+
+	// Requests taken off the queue together are coalesced into `batch` and
+	// written at once, or held there until there are rec.coalesce of them.
+	// With a fallback, a batch that failed is written there again.
+	var batch []byte
+	batched := 0
+	saveBatch := func() error {
+		if batched == 0 {
+			return nil
+		}
+		start := time.Now()
+		err := request.SaveFrames(rf, batch, batched)
+		rec.wrote(grID, start)
+		if err != nil && fallBack(err) == nil {
+			start = time.Now()
+			err = request.SaveFrames(rf, batch, batched)
+			rec.wrote(grID, start)
+		}
+		batch, batched = batch[:0], 0
+		if cap(batch) > 2*maxBatch { // grown by a huge request, don't keep it
+			batch = nil
+		}
+		return err
+	}
+
+	flush := func() {
+		if rf == nil || numRequests == numRequestsAtLastFlush {
+			return
+		}
+		err := rf.Flush()
+		if err != nil {
+			llg.Error("Flush failed",
+				zap.String("file", rf.Name()), zap.Error(err))
+			fallBack(err)
+		}
+		numRequestsAtLastFlush = numRequests
+	}
+
+	// A retired thread finalizes its file, unless requests are still queued
+	retire := func() error {
+		if rf == nil || len(reqChan) > 0 || grID < int(atomic.LoadInt32(&rec.active)) {
+			return nil
+		}
+		name := rf.Name()
+		err := saveBatch()
+		if err != nil {
+			rf.Close()
+			rf = nil
+			leftFallback()
+			return errors.Wrapf(err, "FATAL: writing to file %s of retired thread failed.", name)
+		}
+		err = rf.Close()
+		rf = nil
+		leftFallback()
+		if err != nil && rec.fallbackDir != "" {
+			llg.Error("Closing failed, file left for recovery", zap.String("file", name), zap.Error(err))
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "FATAL: closing file %s of retired thread failed.", name)
+		}
+		llg.Debug("Retired", zap.Int("requests", numRequests))
+		return nil
+	}
+
+	// unspill archives requests that were spilled while queues were full, as
+	// long as this thread keeps up with its own queue. Frames are taken back as
+	// they were queued, so they are compressed again with a dictionary.
+	var spilled []byte
+	unspill := func() error {
+		for rf != nil && len(reqChan) == 0 {
+			var n int
+			var lost int64
+			var err error
+			spilled, n, lost, err = rec.spill.take(spilled[:0], maxBatch)
+			if err != nil {
+				atomic.AddInt64(&rec.spillLost, lost)
+				llg.Error("Spill file failed, requests left in it are lost",
+					zap.Int64("requests", lost), zap.Error(err))
+				return nil
+			}
+			if n == 0 {
+				return nil
+			}
+			if rec.dict == nil {
+				batch = append(batch, spilled...)
+			} else {
+				for off := 0; off < len(spilled); {
+					payloadLen, _ := frame.ParsePrefix(spilled[off:])
+					off += frame.PrefixLen + frame.CRCLen
+					batch = rec.dict.AppendFrame(batch, spilled[off:off+payloadLen])
+					off += payloadLen
+				}
+			}
+			batched += n
+			numRequests += n
+			bytesReceived += int64(len(spilled))
+			atomic.StoreInt64(&rec.received[grID], bytesReceived)
+			err = saveBatch()
+			if err != nil {
+				return err
+			}
+		}
+		if cap(spilled) > 2*maxBatch {
+			spilled = nil
+		}
+		return nil
+	}
+
+	// writeFailed closes the file after a failed write, and returns the error
+	// stopping the thread
+	writeFailed := func(err error) error {
+		msg := fmt.Sprintf("FATAL: writing to file %s failed.", rf.Name())
+		llg.Error("Write failed",
+			zap.String("file", rf.Name()))
+		rf.Close()
+		return errors.Wrap(err, msg)
+	}
+
+	tickerPrint := time.NewTicker(5 * time.Second) // Update counters at least once in 5 seconds
+	defer tickerPrint.Stop()
+
+	tickerSave := time.NewTicker(rec.rotateEvery)
+	defer tickerSave.Stop()
+
+	var flushC <-chan time.Time // nil: never
+	if rec.flushEvery > 0 {
+		tickerFlush := time.NewTicker(rec.flushEvery)
+		defer tickerFlush.Stop()
+		flushC = tickerFlush.C
+	}
+
+	var spillC <-chan time.Time // nil: no spill file
+	if rec.spill != nil {
+		tickerSpill := time.NewTicker(spillEvery)
+		defer tickerSpill.Stop()
+		spillC = tickerSpill.C
+	}
+
+Loop:
+	for {
+
+		select {
+
+		case <-tickerPrint.C:
+			atomic.StoreInt64(&rec.counters[grID], int64(numRequests))
+			llg.Debug("Got requests",
+				zap.Int("requests", numRequests))
+			err = saveBatch() // held requests, see CoalesceRecords
+			if err != nil {
+				return writeFailed(err)
+			}
+			err = retire()
+			if err != nil {
+				llg.Error("Closing failed", zap.Error(err))
+				return err
+			}
+
+		case <-tickerSave.C:
+			// Archives rotating on their own timer are only rotated here to go
+			// back from the fallback
+			if rf != nil && numRequests > numRequestsAtLastSave && (onFallback || !rotatesOnTimer(rf)) { // there is something to rotate
+				err = saveBatch()
+				if err != nil {
+					return writeFailed(err)
+				}
+				err = rotate()
+				if err != nil {
+					llg.Error("Rotate failed",
+						zap.String("file", rf.Name()), zap.Error(err))
+					fallBack(err)
+				}
+				numRequestsAtLastSave = numRequests
+				numRequestsAtLastFlush = numRequests // a new file
+			}
+
+		case <-flushC:
+			err = saveBatch()
+			if err != nil {
+				return writeFailed(err)
+			}
+			flush()
+
+		case <-spillC:
+			err = unspill()
+			if err != nil {
+				return writeFailed(err)
+			}
+
+		case req, more := <-reqChan: // Got new request data from bidder?
+			// Take whatever else is queued right away, up to a batch, instead
+			// of going through the select (and tickers) for each request
+			closed := false
+			if more && rf == nil {
+				rf, err = rec.newArchive(rec.outDir)
+				if err != nil {
+					err = fallBack(err)
+				}
+				if err != nil {
+					req.Release()
+					return errors.Wrapf(err, "Unable to create archive file for worker %d", grID)
+				}
+				numRequestsAtLastSave, numRequestsAtLastFlush = numRequests, numRequests
+			}
+			for n := 1; ; n++ {
+				if !more {
+					closed = true
+					break
+				}
+				numRequests++
+				bytesReceived += int64(req.FrameSize())
+				if rec.dict != nil {
+					batch = rec.dict.AppendFrame(batch, req.Bytes())
+					batched++
+					req.Release()
+				} else if batched == 0 && len(reqChan) == 0 && rec.fallbackDir == "" && rec.coalesce <= 1 {
+					start := time.Now()
+					err = req.SaveRequest(rf, false) // nothing to coalesce with
+					rec.wrote(grID, start)
+					if err != nil {
+						break
+					}
+				} else {
+					batch = req.AppendFrame(batch)
+					batched++
+				}
+				if n == maxBatchRequests || len(batch) >= maxBatch {
+					break
+				}
+				select {
+				case req, more = <-reqChan:
+					continue
+				default:
+				}
+				break
+			}
+			atomic.StoreInt64(&rec.received[grID], bytesReceived)
+			if err == nil && (closed || batched >= rec.coalesce || len(batch) >= maxBatch) {
+				err = saveBatch()
+			}
+			if err == nil && closed && rec.spill != nil {
+				err = unspill() // what is left of it, before the file is closed
+			}
+			if err != nil {
+				return writeFailed(err)
+			}
+			if closed {
+				break Loop
+			}
+			if rec.flushAfter > 0 && numRequests-numRequestsAtLastFlush >= rec.flushAfter {
+				err = saveBatch()
+				if err != nil {
+					return writeFailed(err)
+				}
+				flush()
+			}
+			err = retire()
+			if err != nil {
+				llg.Error("Closing failed", zap.Error(err))
+				return err
+			}
+		}
+	}
+	atomic.StoreInt64(&rec.counters[grID], int64(numRequests))
+
+	leftFallback()
+	if rf != nil {
+		err = rf.Close()
+		if err != nil {
+			msg := fmt.Sprintf("FATAL: closing file %s failed.", rf.Name())
+			llg.Error("Closing failed",
+				zap.String("file", rf.Name()))
+			return errors.Wrap(err, msg)
+		}
+		llg.Debug("Done",
+			zap.Int("requests", numRequests))
+	}
+	return nil
+}
+
+// wrote accounts for an archive write of thread grID started at `start`
+func (rec *Recorder) wrote(grID int, start time.Time) {
+	atomic.AddInt64(&rec.writes[grID], 1)
+	atomic.AddInt64(&rec.writeNanos[grID], int64(time.Since(start)))
+}
@@ -0,0 +1,302 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package recorder
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/request"
+)
+
+// tempDir is a directory removed at the end of the test
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// startRecorder starts a recorder writing uncompressed files to `dir`
+func startRecorder(t *testing.T, dir string, options ...func(*Recorder) error) *Recorder {
+	rec, err := New(append([]func(*Recorder) error{OutputDir(dir), Compress(false)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rec.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+// record records requests with IDs `first` to `first+n-1`
+func record(rec *Recorder, first, n int) {
+	for i := first; i < first+n; i++ {
+		rec.Record(request.CreateRequest([]byte(fmt.Sprint(i)), []byte("POST"), []byte("/events"),
+			[]byte("Host: example.com\r\n\r\n"), []byte("body")))
+	}
+}
+
+// testRequest is what was recorded of a request
+type testRequest struct {
+	id, method, uri, headers, body string
+}
+
+// recordedRequests is the requests of the finalized files of `dir`, sorted
+// by ID
+func recordedRequests(t *testing.T, dir string) (reqs []testRequest) {
+	files, err := filepath.Glob(filepath.Join(dir, "requests_*.fbf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fileName := range files {
+		rf, err := archive.OpenArchive(fileName, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			umr, err := request.GetNextRequest(rf, false)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", fileName, err)
+			}
+			r := umr.Request()
+			reqs = append(reqs, testRequest{string(r.Id()), string(r.Method()), string(r.Uri()),
+				string(r.Headers()), string(r.BodyBytes())})
+			umr.Release()
+		}
+		rf.Close()
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].id < reqs[j].id })
+	return reqs
+}
+
+// recorded is the sorted IDs of the requests in the finalized files of `dir`
+func recorded(t *testing.T, dir string) (ids []string) {
+	for _, r := range recordedRequests(t, dir) {
+		ids = append(ids, r.id)
+	}
+	return ids
+}
+
+// waitFor waits up to 5 seconds for `cond` to hold, else fails the test
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("still waiting for %s", what)
+		}
+	}
+}
+
+// ids is the sorted IDs given by record to `n` requests from 0
+func ids(n int) (ids []string) {
+	for i := 0; i < n; i++ {
+		ids = append(ids, fmt.Sprint(i))
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// checkRecorded fails unless `dir` has the `n` requests given by record
+func checkRecorded(t *testing.T, dir string, n int) {
+	t.Helper()
+	got, want := recorded(t, dir), ids(n)
+	if len(got) != len(want) {
+		t.Fatalf("got %d requests, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got request %s, want %s", got[i], want[i])
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+
+	dir := tempDir(t)
+	rec := startRecorder(t, dir, Threads(3))
+	record(rec, 0, 1000)
+	if err := rec.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	checkRecorded(t, dir, 1000)
+	if n := rec.Count(); n != 1000 {
+		t.Fatalf("counted %d requests", n)
+	}
+}
+
+// Without an output directory, requests are only counted
+func TestRecordNull(t *testing.T) {
+
+	rec, err := New(Threads(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rec.Start(); err != nil {
+		t.Fatal(err)
+	}
+	record(rec, 0, 100)
+	if err = rec.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if n := rec.Count(); n != 100 {
+		t.Fatalf("counted %d requests", n)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		option func(*Recorder) error
+	}{
+		{"no threads", Threads(0)},
+		{"negative max threads", MaxThreads(-1)},
+		{"no rotation", RotateEvery(0)},
+		{"negative flush interval", FlushEvery(-1)},
+		{"negative flush count", FlushAfter(-1)},
+		{"negative coalescing", CoalesceRecords(-1)},
+		{"unknown codec", Compression("gzip")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.option); err == nil {
+				t.Fatal("no error")
+			}
+		})
+	}
+}
+
+// Coalesced requests are held until there are enough of them, or Stop
+func TestCoalesceRecords(t *testing.T) {
+
+	dir := tempDir(t)
+	rec := startRecorder(t, dir, Threads(1), CoalesceRecords(100))
+	record(rec, 0, 50)
+	waitFor(t, "requests to be taken", func() bool { return rec.Stats().Queued == 0 })
+	time.Sleep(20 * time.Millisecond)
+	if st := rec.Stats(); st.Writes != 0 {
+		t.Fatalf("%d writes of 50 requests", st.Writes)
+	}
+	record(rec, 50, 100)
+	if err := rec.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	checkRecorded(t, dir, 150)
+	if st := rec.Stats(); st.Writes > 2 { // at least 100, then the rest on Stop
+		t.Fatalf("%d writes", st.Writes)
+	}
+}
+
+// The scaler adds a thread when queues fill up
+func TestScalerAddsThread(t *testing.T) {
+
+	rec, err := New(Threads(1), MaxThreads(2), QueueSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Started without threads, for requests to stay queued
+	rec.reqChans = []chan *request.MarshalledRequest{make(chan *request.MarshalledRequest, 8), make(chan *request.MarshalledRequest, 8)}
+	rec.active = 1
+	rec.counters, rec.writes, rec.writeNanos, rec.received = make([]int64, 2), make([]int64, 2), make([]int64, 2), make([]int64, 2)
+	rec.done = make(chan struct{})
+	rec.scalerWg.Add(1)
+	go rec.scaler()
+	defer func() {
+		close(rec.done)
+		rec.scalerWg.Wait()
+	}()
+
+	for i := 0; i < 3; i++ { // over a quarter of the queues
+		rec.Record(request.CreateRequest([]byte(fmt.Sprint(i)), []byte("GET"), []byte("/"), nil, nil))
+	}
+	waitFor(t, "a thread to be added", func() bool { return rec.Stats().Threads == 2 })
+}
+
+// Threads added under load create their file with their first request, and
+// finalize it on Stop
+func TestAddedThreadRecords(t *testing.T) {
+
+	dir := tempDir(t)
+	rec := startRecorder(t, dir, Threads(1), MaxThreads(2))
+	atomic.StoreInt32(&rec.active, 2) // as the scaler does
+	record(rec, 0, 100)
+	if err := rec.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	checkRecorded(t, dir, 100)
+	if files, _ := filepath.Glob(filepath.Join(dir, "requests_*.fbf")); len(files) != 2 {
+		t.Fatalf("got files %q", files)
+	}
+}
+
+// Threads that can't write to the output directory fall back, and go back
+// to it at the next rotation once it works again
+func TestFallback(t *testing.T) {
+
+	root := tempDir(t)
+	outDir, fallbackDir := filepath.Join(root, "out"), filepath.Join(root, "fallback")
+	if err := ioutil.WriteFile(outDir, nil, 0644); err != nil { // no directory can be created there
+		t.Fatal(err)
+	}
+	rec := startRecorder(t, outDir, Threads(1), Fallback(fallbackDir), RotateEvery(50*time.Millisecond))
+	record(rec, 0, 100)
+	waitFor(t, "the fallback", func() bool { return rec.Stats().Degraded == 1 })
+	if err := os.Remove(outDir); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the output directory", func() bool { return rec.Stats().Degraded == 0 })
+	record(rec, 100, 100)
+	if err := rec.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	st := rec.Stats()
+	if st.Fallbacks != 1 || st.Degraded != 0 {
+		t.Fatalf("%d fallbacks, %d threads degraded", st.Fallbacks, st.Degraded)
+	}
+	fallback, out := recorded(t, fallbackDir), recorded(t, outDir)
+	if len(fallback) != 100 || len(out) != 100 {
+		t.Fatalf("got %d requests in the fallback, %d in the output directory", len(fallback), len(out))
+	}
+}
+
+// Without a fallback, a thread that can't write stops the recorder
+func TestNoFallback(t *testing.T) {
+
+	outDir := filepath.Join(tempDir(t), "out")
+	if err := ioutil.WriteFile(outDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := New(OutputDir(outDir), Threads(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rec.Start(); err == nil {
+		rec.Stop()
+		t.Fatal("no error")
+	}
+}
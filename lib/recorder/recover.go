@@ -0,0 +1,347 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package recorder
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/cespare/xxhash"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// RecoveryReport is what recovery did with the temporary (.tmp) archive files
+// left behind by a recorder that did not stop cleanly
+type RecoveryReport struct {
+	Files       int   // .tmp files found
+	Recovered   int   // finalized, with the requests that could be read
+	Truncated   int   // of those, files cut short after the last complete request
+	Empty       int   // removed: not a single complete request in them
+	Failed      int   // left in place, see the log
+	Recent      int   // left in place, modified too recently, see RecoverOlderThan
+	Deleted     int   // removed as they were, see Leftovers
+	Quarantined int   // moved to the quarantine directory, see Leftovers
+	Requests    int64 // requests recovered
+}
+
+// QuarantineDir is where Leftovers("quarantine") moves leftover files, under
+// the staging directory
+const QuarantineDir = "quarantine"
+
+// Recover has Start finalize the .tmp archive files found in the staging
+// directory (the output directory if local, else the StagingDirectory or the
+// system temporary directory) before creating new ones, or else do with them
+// what Leftovers says. Each is cut at its last complete and
+// valid request, then renamed or uploaded like any archive. Those of the
+// Fallback directory are recovered there. Recorders sharing
+// the output directory must not run at the same time: the files of the other
+// one would be taken for leftovers, unless RecoverOlderThan tells them apart.
+// Indexes of leftover files (see common.Index) are removed, recovered files
+// are not indexed.
+func Recover(r bool) func(*Recorder) error {
+	return func(rec *Recorder) error {
+		rec.recoverTmp = r
+		return nil
+	}
+}
+
+// Leftovers sets what Recover does with leftover files: "recover" them (the
+// default), "delete" them, or "quarantine" them, i.e. move them as they are
+// to QuarantineDir of the staging directory, to be looked at or recovered
+// later (by moving them back). Whatever it is, Recover(false) leaves them in
+// place.
+func Leftovers(policy string) func(*Recorder) error {
+	return func(rec *Recorder) error {
+		switch policy {
+		case "", "recover", "delete", "quarantine":
+		default:
+			return errors.Errorf("Unknown policy for leftover files %s (recover, delete or quarantine)", policy)
+		}
+		rec.leftovers = policy
+		return nil
+	}
+}
+
+// RecoverOlderThan has Recover leave alone the .tmp files modified less
+// than `d` ago (0 - recover all), which may be those of another recorder
+// still writing to the same directory. `d` must be longer than the files
+// of that recorder go without a write: its rotation interval (see
+// RotateEvery), or longer if it is idle.
+func RecoverOlderThan(d time.Duration) func(*Recorder) error {
+	return func(rec *Recorder) error {
+		if d < 0 {
+			return errors.Errorf("Age of files to recover can't be negative, got %s", d)
+		}
+		rec.recoverAge = d
+		return nil
+	}
+}
+
+// stale tells if a leftover file is old enough to be recovered, see
+// RecoverOlderThan
+func (rec *Recorder) stale(fileName string) bool {
+	if rec.recoverAge == 0 {
+		return true
+	}
+	fi, err := os.Stat(fileName)
+	return err == nil && time.Since(fi.ModTime()) >= rec.recoverAge
+}
+
+// recoverOrphans recovers the leftover archive files of output directory
+// `outDir` and adds them up in `rep`
+func (rec *Recorder) recoverOrphans(outDir string, rep *RecoveryReport) (err error) {
+
+	stageDir := os.TempDir()
+	if rec.stageDir != "" {
+		stageDir = rec.stageDir
+	}
+	if archive.IsLocal(outDir) {
+		stageDir = strings.TrimPrefix(outDir, "file://")
+	}
+	var files []string
+	for _, ext := range []string{".fbf", ".fbf.lz4", ".fbf.zst", ".fbf.sz", // what recorders write
+		".fbf.enc", ".fbf.lz4.enc", ".fbf.zst.enc", ".fbf.sz.enc"} {
+		matches, err := filepath.Glob(filepath.Join(stageDir, "requests_*"+ext+".tmp"))
+		if err != nil {
+			return errors.Wrapf(err, "Unable to look for leftover files in %s", stageDir)
+		}
+		files = append(files, matches...)
+
+		// Copies of a recovery that was itself interrupted, their .tmp is still there
+		parts, _ := filepath.Glob(filepath.Join(stageDir, "requests_*"+ext+".part"))
+		for _, partPath := range parts {
+			os.Remove(partPath)
+		}
+	}
+
+	// Indexes of leftovers, the files they index are recovered without one
+	indexes, _ := filepath.Glob(filepath.Join(stageDir, "requests_*"+common.IndexExt+".tmp"))
+	for _, indexPath := range indexes {
+		if rec.stale(indexPath) {
+			rec.logger.Debug("Removing leftover index", zap.String("file", indexPath))
+			os.Remove(indexPath)
+		}
+	}
+
+	for _, tmpPath := range files {
+		rep.Files++
+		if !rec.stale(tmpPath) {
+			rep.Recent++
+			rec.logger.Info("Leftover file too recent, not recovered", zap.String("file", tmpPath))
+			continue
+		}
+		switch rec.leftovers {
+		case "delete":
+			if err := os.Remove(tmpPath); err != nil {
+				rep.Failed++
+				rec.logger.Error("Unable to delete leftover file", zap.String("file", tmpPath), zap.Error(err))
+				continue
+			}
+			rep.Deleted++
+			rec.logger.Info("Deleted leftover file", zap.String("file", tmpPath))
+			continue
+		case "quarantine":
+			quarantined, err := quarantine(tmpPath)
+			if err != nil {
+				rep.Failed++
+				rec.logger.Error("Unable to quarantine leftover file", zap.String("file", tmpPath), zap.Error(err))
+				continue
+			}
+			rep.Quarantined++
+			rec.logger.Info("Quarantined leftover file", zap.String("file", quarantined))
+			continue
+		}
+		details, truncated, err := rec.recoverFile(tmpPath, outDir)
+		switch {
+		case err != nil:
+			rep.Failed++
+			rec.logger.Error("Recovery failed", zap.String("file", tmpPath), zap.Error(err))
+		case details.RowsWritten == 0:
+			rep.Empty++
+		default:
+			rep.Recovered++
+			rep.Requests += details.RowsWritten
+			if truncated {
+				rep.Truncated++
+			}
+			if rec.onFinalize != nil {
+				rec.onFinalize(details)
+			}
+		}
+	}
+	return nil
+}
+
+// quarantine moves a leftover file to QuarantineDir, next to it
+func quarantine(tmpPath string) (quarantined string, err error) {
+
+	dir := filepath.Join(filepath.Dir(tmpPath), QuarantineDir)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", errors.Wrapf(err, "Unable to create %s", dir)
+	}
+	quarantined = filepath.Join(dir, filepath.Base(tmpPath))
+	err = os.Rename(tmpPath, quarantined)
+	if err != nil {
+		return "", errors.Wrapf(err, "Unable to move %s", tmpPath)
+	}
+	return quarantined, nil
+}
+
+// recoverFile copies the complete requests of a leftover file to its final
+// name (without .tmp), finalizes that and removes the leftover. Details are
+// those OnFinalize gets, with request timestamps as first and last rows.
+func (rec *Recorder) recoverFile(tmpPath, outDir string) (details common.ArchiveFileDetails, truncated bool, err error) {
+
+	src, err := os.Open(tmpPath)
+	if err != nil {
+		return details, false, errors.Wrapf(err, "Unable to open %s", tmpPath)
+	}
+	defer src.Close()
+	var r io.Reader = bufio.NewReaderSize(src, 65536)
+	zr, err := common.NewDecompressor(tmpPath, r)
+	if err != nil {
+		return details, false, errors.Wrapf(err, "Unable to open %s", tmpPath)
+	}
+	if zr != nil {
+		r = zr
+	}
+
+	finalPath := strings.TrimSuffix(tmpPath, ".tmp")
+	partPath := finalPath + ".part" // not picked up as a leftover, nor as an archive
+	part, err := os.Create(partPath)
+	if err != nil {
+		return details, false, errors.Wrapf(err, "Unable to create %s", partPath)
+	}
+	defer os.Remove(partPath) // if not renamed
+	bw := bufio.NewWriterSize(part, 65536)
+	var w io.Writer = bw
+	var ew io.WriteCloser // encrypted files are encrypted again, with the key of the recorder
+	if strings.HasSuffix(finalPath, ".enc") {
+		if rec.key == nil {
+			part.Close()
+			return details, false, errors.Errorf("Unable to recover %s without its encryption key", tmpPath)
+		}
+		ew, err = common.NewEncryptor(bw, rec.key)
+		if err != nil {
+			part.Close()
+			return details, false, err
+		}
+		w = ew
+	}
+	zw, err := common.NewCompressor(strings.TrimSuffix(finalPath, ".enc"), w)
+	if err != nil {
+		part.Close()
+		return details, false, err
+	}
+	if zw != nil {
+		w = zw
+	}
+	xh := xxhash.New() // of the uncompressed file, as BasicArchive does
+	w = io.MultiWriter(w, xh)
+
+	// Copy frames up to the first that is incomplete or does not check out
+	for {
+		umr, err := request.GetNextFrame(r, false)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = umr.VerifyCRC()
+			if err == nil && !umr.IsHeader() {
+				err = umr.Validate()
+			}
+		}
+		if err != nil {
+			if umr != nil {
+				umr.Release()
+			}
+			truncated = true
+			rec.logger.Debug("Recovery: cut short", zap.String("file", tmpPath),
+				zap.Int64("requests", details.RowsWritten), zap.Error(err))
+			break
+		}
+		if !umr.IsHeader() {
+			details.RowsWritten++
+			if ts := umr.Request().Timestamp(); ts != 0 {
+				if details.FirstRow.IsZero() {
+					details.FirstRow = time.Unix(0, ts)
+				}
+				details.LastRow = time.Unix(0, ts)
+			}
+		}
+		_, err = umr.WriteFrame(w)
+		umr.Release()
+		if err != nil {
+			part.Close()
+			return details, false, errors.Wrapf(err, "Unable to write %s", partPath)
+		}
+		details.ChunksWritten++
+	}
+	if zw != nil {
+		err = zw.Close()
+	}
+	if err == nil && ew != nil {
+		err = ew.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = part.Sync()
+	}
+	if cerr := part.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return details, false, errors.Wrapf(err, "Unable to write %s", partPath)
+	}
+	src.Close()
+
+	if details.RowsWritten == 0 {
+		return details, truncated, os.Remove(tmpPath)
+	}
+	fi, err := os.Stat(partPath)
+	if err != nil {
+		return details, false, errors.Wrapf(err, "Unable to stat %s", partPath)
+	}
+	err = os.Rename(partPath, finalPath)
+	if err != nil {
+		return details, false, errors.Wrapf(err, "Unable to rename %s", partPath)
+	}
+	details.FileName = filepath.Base(finalPath)
+	details.BytesWritten = fi.Size()
+	details.Checksum = fmt.Sprintf("%0X", xh.Sum64())
+	if archive.IsLocal(outDir) {
+		details.URL, _ = filepath.Abs(finalPath)
+	} else {
+		err = archive.Store(finalPath, outDir)
+		os.Remove(finalPath) // the leftover is still there if the upload failed
+		if err != nil {
+			return details, false, errors.Wrapf(err, "Unable to upload %s", finalPath)
+		}
+		details.URL = strings.TrimRight(outDir, "/") + "/" + details.FileName
+	}
+	rec.logger.Info("Recovered", zap.String("file", details.URL),
+		zap.Int64("requests", details.RowsWritten), zap.Bool("truncated", truncated))
+	return details, truncated, os.Remove(tmpPath)
+}
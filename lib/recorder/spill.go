@@ -0,0 +1,197 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package recorder
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adobe/blackhole/lib/frame"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+)
+
+// spillEvery is how often recorder threads look for spilled requests to
+// take back, when they get none from their queue
+const spillEvery = 100 * time.Millisecond
+
+// errSpillFull is returned by put once the spill file reached its size limit
+var errSpillFull = errors.New("spill file is full")
+
+// Spill has requests that find the queue of their recorder thread full
+// written to a local overflow file in `dir` instead of blocking Record. Threads
+// take them back and archive them once they caught up with their queue, so
+// bursts beyond what the output directory sustains are absorbed by local disk.
+// The file grows up to `maxSize` bytes (0 - no limit), then Record blocks as
+// without it. It is removed on Stop; requests in it when the process dies are
+// lost, so it is best kept on fast, local storage (not tmpfs, which is memory).
+func Spill(dir string, maxSize int64) func(*Recorder) error {
+	return func(r *Recorder) error {
+		if maxSize < 0 {
+			return errors.Errorf("Spill file size limit can't be negative, got %d", maxSize)
+		}
+		r.spillDir = dir
+		r.spillMax = maxSize
+		return nil
+	}
+}
+
+// spill is the overflow file of a Recorder. Frames are appended by Record
+// and taken back, oldest first, by recorder threads. The file is truncated
+// whenever everything in it was taken back.
+type spill struct {
+	mu      sync.Mutex
+	fp      *os.File
+	w       *bufio.Writer
+	written int64 // end of the frames put in the file
+	read    int64 // where frames not taken back yet start
+	maxSize int64
+	err     error // first read or write error, after which the file is not used
+
+	queued int64 // requests put and not taken back yet
+	total  int64 // requests put so far
+}
+
+// newSpill creates the overflow file in `dir`
+func newSpill(dir string, maxSize int64) (s *spill, err error) {
+	fp, err := ioutil.TempFile(dir, "blackhole-spill-*.fbf")
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to create spill file in %s", dir)
+	}
+	return &spill{fp: fp, w: bufio.NewWriterSize(fp, 65536), maxSize: maxSize}, nil
+}
+
+// put appends a request frame (see request.MarshalledRequest.Frame)
+func (s *spill) put(f []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.maxSize > 0 && s.written+int64(len(f)) > s.maxSize {
+		return errSpillFull
+	}
+	_, err := s.w.Write(f)
+	if err != nil {
+		s.err = errors.Wrapf(err, "Unable to write spill file %s", s.fp.Name())
+		return s.err
+	}
+	s.written += int64(len(f))
+	atomic.AddInt64(&s.queued, 1)
+	atomic.AddInt64(&s.total, 1)
+	return nil
+}
+
+// take appends to `buf` the oldest frames put, up to about `maxBytes` (at
+// least one frame if there is any), and returns how many. After an error,
+// whatever was left in the file is lost, and `lost` is how many requests.
+func (s *spill) take(buf []byte, maxBytes int) (_ []byte, n int, lost int64, err error) {
+	if atomic.LoadInt64(&s.queued) == 0 {
+		return buf, 0, 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return buf, 0, s.fail(s.err), s.err
+	}
+	if s.read == s.written {
+		return buf, 0, 0, nil
+	}
+	err = s.w.Flush()
+	if err != nil {
+		return buf, 0, s.fail(errors.Wrapf(err, "Unable to write spill file %s", s.fp.Name())), s.err
+	}
+
+	hdrLen := frame.PrefixLen + frame.CRCLen
+	var prefix [frame.PrefixLen]byte
+	size := 0
+	for s.read+int64(size) < s.written && size < maxBytes {
+		_, err = s.fp.ReadAt(prefix[:], s.read+int64(size))
+		if err != nil {
+			return buf, 0, s.fail(errors.Wrapf(err, "Unable to read spill file %s", s.fp.Name())), s.err
+		}
+		payloadLen, _ := frame.ParsePrefix(prefix[:])
+		if n > 0 && size+hdrLen+payloadLen > maxBytes {
+			break
+		}
+		size += hdrLen + payloadLen
+		n++
+	}
+	start := len(buf)
+	buf = append(buf, make([]byte, size)...)
+	_, err = s.fp.ReadAt(buf[start:], s.read)
+	if err != nil {
+		return buf[:start], 0, s.fail(errors.Wrapf(err, "Unable to read spill file %s", s.fp.Name())), s.err
+	}
+	s.read += int64(size)
+	atomic.AddInt64(&s.queued, int64(-n))
+
+	if s.read == s.written { // all taken back, start over
+		s.read, s.written = 0, 0
+		_, err = s.fp.Seek(0, 0)
+		if err == nil {
+			err = s.fp.Truncate(0)
+		}
+		if err != nil {
+			s.fail(errors.Wrapf(err, "Unable to truncate spill file %s", s.fp.Name()))
+		}
+	}
+	return buf, n, 0, nil
+}
+
+// fail stops the use of the file after `err` and returns how many requests
+// in it are lost
+func (s *spill) fail(err error) (lost int64) {
+	if s.err == nil {
+		s.err = err
+	}
+	return atomic.SwapInt64(&s.queued, 0)
+}
+
+// close removes the file, unless requests are left in it
+func (s *spill) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := s.fp.Name()
+	left := atomic.LoadInt64(&s.queued)
+	if left > 0 {
+		s.w.Flush()
+		s.fp.Close()
+		return errors.Errorf("%d spilled requests left in %s", left, name)
+	}
+	s.fp.Close()
+	return os.Remove(name)
+}
+
+// enqueue hands a request over to a recorder thread, through the spill file
+// if the queue of the thread is full
+func (rec *Recorder) enqueue(reqChan chan *request.MarshalledRequest, mr *request.MarshalledRequest) {
+	if rec.spill == nil {
+		reqChan <- mr
+		return
+	}
+	select {
+	case reqChan <- mr:
+		return
+	default:
+	}
+	if rec.spill.put(mr.Frame()) == nil {
+		mr.Release()
+		return
+	}
+	reqChan <- mr // spill full or failing: wait, as without it
+}
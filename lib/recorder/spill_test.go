@@ -0,0 +1,125 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package recorder
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/request"
+)
+
+// testFrame is the frame of a request with ID `id`
+func testFrame(id int) []byte {
+	mr := request.CreateRequest([]byte(fmt.Sprint(id)), []byte("GET"), []byte("/"), nil, nil)
+	defer mr.Release()
+	return append([]byte(nil), mr.Frame()...)
+}
+
+func TestSpill(t *testing.T) {
+
+	frames := [][]byte{testFrame(0), testFrame(1), testFrame(2)}
+	s, err := newSpill(tempDir(t), int64(3*len(frames[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range frames {
+		if err = s.put(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := testFrame(3)
+	if err = s.put(f); err != errSpillFull {
+		t.Fatalf("got %v, want %v", err, errSpillFull)
+	}
+
+	// Oldest first, at least one frame however small maxBytes
+	buf, n, lost, err := s.take(nil, 1)
+	if err != nil || n != 1 || lost != 0 || !bytes.Equal(buf, frames[0]) {
+		t.Fatalf("got %d frames, %d lost, %v", n, lost, err)
+	}
+	buf, n, _, err = s.take(nil, 1<<20)
+	if err != nil || n != 2 || !bytes.Equal(buf, append(frames[1], frames[2]...)) {
+		t.Fatalf("got %d frames, %v", n, err)
+	}
+	if s.read != 0 || s.written != 0 || s.queued != 0 || s.total != 3 {
+		t.Fatalf("not truncated: read %d, written %d, %d queued, %d in all", s.read, s.written, s.queued, s.total)
+	}
+	if _, n, _, _ = s.take(nil, 1<<20); n != 0 {
+		t.Fatalf("took %d frames of an empty file", n)
+	}
+
+	// Room again once taken back
+	if err = s.put(f); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.close(); err == nil {
+		t.Fatal("closed with a request left")
+	}
+	if _, err = os.Stat(s.fp.Name()); err != nil {
+		t.Fatalf("file with a request left removed: %v", err)
+	}
+}
+
+func TestSpillClose(t *testing.T) {
+
+	s, err := newSpill(tempDir(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.put(testFrame(0))
+	s.take(nil, 1<<20)
+	if err = s.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(s.fp.Name()); !os.IsNotExist(err) {
+		t.Fatalf("file left: %v", err)
+	}
+}
+
+// Requests that find their queue full are spilled instead of waiting
+func TestEnqueueSpills(t *testing.T) {
+
+	s, err := newSpill(tempDir(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	rec := &Recorder{spill: s}
+	reqChan := make(chan *request.MarshalledRequest, 1)
+	for i := 0; i < 3; i++ {
+		rec.enqueue(reqChan, request.CreateRequest([]byte(fmt.Sprint(i)), []byte("GET"), []byte("/"), nil, nil))
+	}
+	if len(reqChan) != 1 || s.queued != 2 {
+		t.Fatalf("%d queued, %d spilled", len(reqChan), s.queued)
+	}
+	(<-reqChan).Release()
+	s.take(nil, 1<<20)
+}
+
+// Spilled requests are archived by threads, none lost
+func TestRecordSpill(t *testing.T) {
+
+	dir := tempDir(t)
+	rec := startRecorder(t, dir, Threads(1), QueueSize(1), Spill(tempDir(t), 0))
+	record(rec, 0, 2000)
+	if err := rec.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	checkRecorded(t, dir, 2000)
+	if st := rec.Stats(); st.SpillQueued != 0 || st.SpillLost != 0 {
+		t.Fatalf("%d spilled requests left, %d lost", st.SpillQueued, st.SpillLost)
+	}
+}
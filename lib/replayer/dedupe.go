@@ -0,0 +1,63 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package replayer
+
+import (
+	"hash"
+	"sync"
+
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/cespare/xxhash"
+)
+
+// deduper remembers a hash of every request sent during this run
+// (across all files) so `--dedupe` can skip repeats. Captures of
+// retry-storms otherwise hammer idempotent endpoints with the same
+// request over and over. Archives read in parallel share it, hence mu.
+type deduper struct {
+	mu        sync.Mutex
+	seen      map[uint64]struct{}
+	digest    hash.Hash64
+	collapsed int
+}
+
+func newDeduper() *deduper {
+	return &deduper{
+		seen:   make(map[uint64]struct{}),
+		digest: xxhash.New(),
+	}
+}
+
+// isDuplicate returns true if a request with the same method, URI and body
+// was already seen in this run. Headers are ignored on purpose: they tend to
+// carry per-attempt values (timestamps, trace ids).
+func (d *deduper) isDuplicate(req *fbr.Request) bool {
+
+	sep := []byte{0}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.digest.Reset()
+	_, _ = d.digest.Write(req.Method())
+	_, _ = d.digest.Write(sep)
+	_, _ = d.digest.Write(req.Uri())
+	_, _ = d.digest.Write(sep)
+	_, _ = d.digest.Write(req.BodyBytes())
+	h := d.digest.Sum64()
+
+	if _, ok := d.seen[h]; ok {
+		d.collapsed++
+		return true
+	}
+	d.seen[h] = struct{}{}
+	return false
+}
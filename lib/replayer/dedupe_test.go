@@ -0,0 +1,48 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package replayer
+
+import (
+	"testing"
+
+	"github.com/adobe/blackhole/lib/request"
+)
+
+func TestIsDuplicate(t *testing.T) {
+
+	tests := []struct {
+		name                  string
+		id, method, uri, body string
+		headers               string
+		dup                   bool
+	}{
+		{"first", "1", "POST", "/a", "x", "A: 1\r\n\r\n", false},
+		{"other ID and headers", "2", "POST", "/a", "x", "A: 2\r\n\r\n", true},
+		{"other method", "3", "PUT", "/a", "x", "", false},
+		{"other URI", "4", "POST", "/b", "x", "", false},
+		{"other body", "5", "POST", "/a", "y", "", false},
+		{"fields not run together", "6", "POST", "/a\x00x", "", "", false},
+	}
+	dd := newDeduper()
+	for _, tt := range tests {
+		umr := request.CreateRequest([]byte(tt.id), []byte(tt.method), []byte(tt.uri),
+			[]byte(tt.headers), []byte(tt.body)).Unmarshalled()
+		if dup := dd.isDuplicate(umr.Request()); dup != tt.dup {
+			t.Fatalf("%s: got %v", tt.name, dup)
+		}
+		umr.Release()
+	}
+	if dd.collapsed != 1 {
+		t.Fatalf("%d collapsed", dd.collapsed)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package replayer
+
+import (
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/request"
+)
+
+// prefetchChunk is how many requests the read-ahead goroutine hands over at
+// once, so the channel isn't touched for every request
+const prefetchChunk = 256
+
+// chunk is a run of requests read ahead. err is set on the last chunk of an
+// archive: io.EOF, or why reading stopped.
+type chunk struct {
+	umrs []*request.UnmarshalledRequest
+	err  error
+}
+
+// prefetcher reads (decompresses and frames) the requests of an archive on
+// its own goroutine, up to `depth` chunks ahead of the replay loop. Reading
+// lz4 archives otherwise takes turns with handing requests to workers, and
+// is what limits the rate of a replay.
+type prefetcher struct {
+	chunks chan chunk
+	stop   chan struct{}
+	cur    chunk
+	pos    int
+}
+
+// newPrefetcher starts reading requests of `rf` ahead with `read`
+func newPrefetcher(rf archive.Archive, depth int,
+	read func(archive.Archive) (*request.UnmarshalledRequest, error)) (pf *prefetcher) {
+	pf = &prefetcher{
+		chunks: make(chan chunk, depth),
+		stop:   make(chan struct{}),
+	}
+	go pf.run(rf, read)
+	return pf
+}
+
+func (pf *prefetcher) run(rf archive.Archive, read func(archive.Archive) (*request.UnmarshalledRequest, error)) {
+
+	defer close(pf.chunks)
+	for {
+		c := chunk{umrs: make([]*request.UnmarshalledRequest, 0, prefetchChunk)}
+		for len(c.umrs) < prefetchChunk {
+			umr, err := read(rf)
+			if err != nil {
+				c.err = err
+				break
+			}
+			c.umrs = append(c.umrs, umr)
+		}
+		select {
+		case pf.chunks <- c:
+		case <-pf.stop:
+			releaseAll(c.umrs)
+			return
+		}
+		if c.err != nil {
+			return
+		}
+	}
+}
+
+// next returns the next request of the archive, like request.GetNextRequest
+func (pf *prefetcher) next() (umr *request.UnmarshalledRequest, err error) {
+	for pf.pos == len(pf.cur.umrs) {
+		if pf.cur.err != nil {
+			return nil, pf.cur.err
+		}
+		pf.cur = <-pf.chunks
+		pf.pos = 0
+	}
+	umr = pf.cur.umrs[pf.pos]
+	pf.cur.umrs[pf.pos] = nil
+	pf.pos++
+	return umr, nil
+}
+
+// close stops reading ahead and releases the requests read but not taken.
+// The archive can be closed once it returns.
+func (pf *prefetcher) close() {
+	close(pf.stop)
+	for c := range pf.chunks {
+		releaseAll(c.umrs)
+	}
+	releaseAll(pf.cur.umrs[pf.pos:])
+}
+
+func releaseAll(umrs []*request.UnmarshalledRequest) {
+	for _, umr := range umrs {
+		umr.Release()
+	}
+}
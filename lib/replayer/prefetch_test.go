@@ -0,0 +1,97 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package replayer
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/pkg/errors"
+)
+
+// openTest opens an archive of `n` requests, more than a chunk
+func openTest(t *testing.T, n int) archive.Archive {
+	rf, err := archive.OpenArchive(writeArchive(t, tempDir(t), uris("/a", n)...), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rf.Close() })
+	return rf
+}
+
+func readRequest(rf archive.Archive) (*request.UnmarshalledRequest, error) {
+	return request.GetNextRequest(rf, false)
+}
+
+// Requests come in order, then the error that ended reading, for good
+func TestPrefetcher(t *testing.T) {
+
+	n := 2*prefetchChunk + 10
+	pf := newPrefetcher(openTest(t, n), 2, readRequest)
+	defer pf.close()
+	for i := 0; i < n; i++ {
+		umr, err := pf.next()
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if uri := string(umr.Request().Uri()); uri != fmt.Sprintf("/a/%d", i) {
+			t.Fatalf("request %d: got %s", i, uri)
+		}
+		umr.Release()
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := pf.next(); err != io.EOF {
+			t.Fatalf("got %v", err)
+		}
+	}
+}
+
+// Read errors come after the requests read before them
+func TestPrefetcherError(t *testing.T) {
+
+	rf := openTest(t, 5)
+	read, left := readRequest, 3
+	pf := newPrefetcher(rf, 2, func(rf archive.Archive) (*request.UnmarshalledRequest, error) {
+		if left == 0 {
+			return nil, errors.New("damaged")
+		}
+		left--
+		return read(rf)
+	})
+	defer pf.close()
+	for i := 0; i < 3; i++ {
+		umr, err := pf.next()
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		umr.Release()
+	}
+	if _, err := pf.next(); err == nil || err.Error() != "damaged" {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// close stops reading ahead whatever was taken
+func TestPrefetcherClose(t *testing.T) {
+
+	pf := newPrefetcher(openTest(t, 10*prefetchChunk), 1, readRequest)
+	umr, err := pf.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	umr.Release()
+	pf.close() // with chunks left to read, doesn't block
+}
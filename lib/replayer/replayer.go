@@ -0,0 +1,575 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+/*
+Package replayer replays archives recorded by `blackhole` to a target host,
+the same way the `replay` binary does, so replays can be run from Go code
+(CI jobs, load tests) instead of shelling out.
+
+	rep, err := replayer.ReplayArchive(ctx, "s3://bucket/captures/requests_1.fbf.lz4",
+		replayer.Options{TargetHost: "localhost:8080", Threads: 10})
+
+Use a Replayer to replay several archives as one run: deduplication,
+warm-up and the report then span all of them. ReplayArchives can read
+several of them at once.
+*/
+package replayer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/adobe/blackhole/lib/sender"
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// Options control a replay. Zero values are the defaults of the `replay` binary
+// except for Threads (0 means 5).
+type Options struct {
+	TargetHost       string           // host or host:port to send requests to
+	Threads          int              // parallel request threads
+	MaxRequests      int              // stop each archive after this many requests (0 - all)
+	MinDelayMs       int              // minimum milliseconds between requests of a thread
+	MaxInflight      int              // pipelined requests in flight over Threads connections (0 - disabled)
+	Dedupe           bool             // skip requests whose method, URI and body were already sent
+	DryRun           bool             // print requests instead of sending them
+	ExtractToFile    bool             // with DryRun, write each request to files in OutputDir
+	OutputDir        string           // for ExtractToFile
+	ReqID            string           // replay only the request with this ID, found with the index of archives if they have one
+	Quiet            bool             // print only errors
+	ExitOnFirstError bool             // stop at the first failed request
+	TestIntegrity    bool             // only read archives and print request IDs
+	Warmup           time.Duration    // replay at WarmupRate for this long before the measured run
+	WarmupRate       int              // requests per second during Warmup, at most MaxWarmupRate
+	Mmap             bool             // memory map local uncompressed archives instead of reading them
+	SkipCorrupt      bool             // log and skip damaged requests instead of ending the archive there
+	Parallel         int              // archives read at once by ReplayArchives (0 or 1 - one after another)
+	Fetcher          *archive.Fetcher // opens remote archives, downloaded ahead (nil - downloaded when replayed)
+	Stream           bool             // read s3:// and az:// archives as they are downloaded, see archive.OpenStream (Fetcher is then unused)
+	Logger           *zap.Logger      // defaults to a no-op logger
+}
+
+// MaxWarmupRate is the highest WarmupRate, one request per nanosecond
+const MaxWarmupRate = int(time.Second)
+
+// Replayer replays archives, one after another or several at once (see
+// ReplayArchives), accumulating a single Report
+type Replayer struct {
+	opts           Options
+	logger         *zap.Logger
+	pipelineClient *fasthttp.PipelineClient // shared by all workers (warm-up included) if MaxInflight is set
+	dd             *deduper                 // nil unless Dedupe
+	warmedUp       bool
+	interrupted    bool
+	corrupt        int64 // damaged requests skipped, see SkipCorrupt
+	rep            Report
+}
+
+// New checks options and returns a Replayer ready to replay archives
+func New(opts Options) (rp *Replayer, err error) {
+
+	if opts.Threads == 0 {
+		opts.Threads = 5
+	}
+	if opts.OutputDir == "" {
+		opts.OutputDir = "."
+	}
+	if opts.ExtractToFile {
+		opts.DryRun = true
+	}
+	switch {
+	case opts.Threads < 0:
+		return nil, errors.Errorf("Number of threads must be positive, got %d", opts.Threads)
+	case opts.Parallel < 0:
+		return nil, errors.Errorf("Number of archives read at once can't be negative, got %d", opts.Parallel)
+	case !opts.DryRun && opts.TargetHost == "":
+		return nil, errors.New("A target host is required unless doing a dry run")
+	case opts.MaxInflight > 0 && opts.MaxInflight < opts.Threads:
+		return nil, errors.New("MaxInflight must be at least the number of threads")
+	case opts.Warmup > 0 && opts.WarmupRate <= 0:
+		return nil, errors.New("A positive WarmupRate is required when Warmup is used")
+	case opts.Warmup > 0 && opts.WarmupRate > MaxWarmupRate:
+		return nil, errors.Errorf("WarmupRate can't be above %d, got %d", MaxWarmupRate, opts.WarmupRate)
+	}
+	if opts.DryRun || opts.TestIntegrity {
+		opts.Warmup = 0
+	}
+
+	rp = &Replayer{opts: opts, logger: opts.Logger}
+	if rp.logger == nil {
+		rp.logger = zap.NewNop()
+	}
+	if opts.Dedupe {
+		rp.dd = newDeduper()
+	}
+	if opts.MaxInflight > 0 && !opts.DryRun {
+		addr := opts.TargetHost
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "80") // PipelineClient wants host:port
+		}
+		rp.pipelineClient = &fasthttp.PipelineClient{
+			Addr:               addr,
+			MaxConns:           opts.Threads,
+			MaxPendingRequests: opts.MaxInflight,
+		}
+	}
+	rp.rep.Start = time.Now()
+	return rp, nil
+}
+
+// ReplayArchive replays a single archive with a new Replayer and returns its report.
+// The report is returned even if err is not nil.
+func ReplayArchive(ctx context.Context, fileName string, opts Options) (rep *Report, err error) {
+
+	rp, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	err = rp.ReplayArchive(ctx, fileName)
+	return rp.Report(err), err
+}
+
+// Report returns the report of everything replayed so far. `runErr`, if
+// not nil, is recorded as the error that ended the run.
+func (rp *Replayer) Report(runErr error) *Report {
+
+	rep := rp.rep
+	rep.Files = append([]string(nil), rp.rep.Files...)
+	rep.End = time.Now()
+	rep.DurationSec = rep.End.Sub(rep.Start).Seconds()
+	rep.Interrupted = rp.interrupted
+	rep.Corrupt = atomic.LoadInt64(&rp.corrupt)
+	if runErr != nil {
+		rep.Error = runErr.Error()
+	}
+	return &rep
+}
+
+// startWorkers creates `Threads` workers reading from the returned
+// request channel. Caller must close reqChan and then wg.Wait() when done.
+func (rp *Replayer) startWorkers(stats *sender.Stats, warmup bool) (reqChan chan *request.UnmarshalledRequest,
+	errorRespChan chan bool, wg *sync.WaitGroup) {
+
+	opts := &rp.opts
+	reqChan = make(chan *request.UnmarshalledRequest)
+	wg = &sync.WaitGroup{}
+	errorRespChan = make(chan bool, opts.Threads)
+	// Buffer of `errorRespChan` must match worker count. Every worker must be
+	// able to write an error an exit (without blocking) even if
+	// main already bailed out of the select after getting an
+	// error from another worker.
+
+	perWorkerInflight := 0
+	if opts.MaxInflight > 0 {
+		perWorkerInflight = (opts.MaxInflight + opts.Threads - 1) / opts.Threads
+	}
+
+	for i := 0; i < opts.Threads; i++ {
+		wrk := sender.NewWorker(reqChan, errorRespChan, opts.TargetHost, wg, i)
+		wrk.WithOption(
+			sender.Quiet(opts.Quiet), sender.Dryrun(opts.DryRun),
+			sender.ExtractToFile(opts.ExtractToFile), sender.MatchReqID(opts.ReqID),
+			sender.ExitOnFirstError(opts.ExitOnFirstError && !warmup), sender.MinDelayMS(opts.MinDelayMs),
+			sender.OutputDirectory(opts.OutputDir), sender.CollectStats(stats),
+			sender.Pipelined(rp.pipelineClient, perWorkerInflight),
+		)
+		wg.Add(1)
+		go wrk.Run()
+	}
+	return reqChan, errorRespChan, wg
+}
+
+// warmUp replays requests from the head of the archive at `WarmupRate`
+// for `Warmup` duration. Nothing sent here is counted towards the final
+// numbers, errors included. The idea is to give caches and connection pools
+// on the target a chance to settle before we start measuring.
+// Returns io.EOF if the archive ran out before the warm-up was over.
+func (rp *Replayer) warmUp(ctx context.Context, rf archive.Archive) (err error) {
+
+	var stats sender.Stats
+	reqChan, _, wg := rp.startWorkers(&stats, true)
+
+	rp.logger.Info("Warm-up [BEGIN]",
+		zap.Duration("duration", rp.opts.Warmup),
+		zap.Int("rate", rp.opts.WarmupRate))
+
+	deadline := time.NewTimer(rp.opts.Warmup)
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Second / time.Duration(rp.opts.WarmupRate))
+	defer ticker.Stop()
+
+Loop:
+	for {
+		select {
+		case <-deadline.C:
+			break Loop
+		case <-ctx.Done():
+			break Loop
+		case <-ticker.C:
+		}
+
+		var umr *request.UnmarshalledRequest
+		umr, err = rp.nextRequest(rf)
+		if err != nil {
+			if err != io.EOF {
+				err = errors.Wrapf(err, "corrupted replay file during warm-up")
+			}
+			break Loop
+		}
+		reqChan <- umr
+	}
+
+	close(reqChan)
+	wg.Wait()
+	s := stats.Snapshot()
+	rp.logger.Info("Warm-up [END]",
+		zap.Int64("sent", s.Sent),
+		zap.Int64("failed", s.Failed))
+
+	return err
+}
+
+// nextRequest reads the next request of an archive. With SkipCorrupt,
+// damaged requests are logged, counted and skipped.
+func (rp *Replayer) nextRequest(rf archive.Archive) (*request.UnmarshalledRequest, error) {
+	if !rp.opts.SkipCorrupt {
+		return request.GetNextRequest(rf, false)
+	}
+	return request.GetNextRequestSkipCorrupt(rf, false, func(err error, frameSize int) {
+		atomic.AddInt64(&rp.corrupt, 1)
+		rp.logger.Warn("Skipped corrupted request",
+			zap.String("file", rf.Name()), zap.Int("frame-size", frameSize), zap.Error(err))
+	})
+}
+
+// archiveFileReadBufSize is the read buffer of archives replayed
+const archiveFileReadBufSize = 65536 // 64 K
+
+// errNotInArchive is returned by openArchive for an archive whose index tells
+// Options.ReqID is not in it
+var errNotInArchive = errors.New("Request not in archive")
+
+// openArchive opens an archive to replay. With Options.ReqID, an archive
+// with an index is read from that request on.
+func (rp *Replayer) openArchive(fileName string) (rf archive.Archive, err error) {
+	if rp.opts.ReqID != "" {
+		offset, indexed, err := archive.FindInIndex(fileName, rp.opts.ReqID)
+		switch {
+		case err != nil: // read it all instead
+			rp.logger.Warn("Index not used", zap.String("file", fileName), zap.Error(err))
+		case indexed && offset < 0:
+			rp.logger.Info("Request not in archive, as told by its index", zap.String("file", fileName))
+			return nil, errNotInArchive
+		case indexed:
+			rf, err = rp.open(fileName)
+			if err != nil {
+				return nil, err
+			}
+			err = archive.SkipTo(rf, offset)
+			if err != nil {
+				rf.Close()
+				return nil, err
+			}
+			rp.logger.Info("Request found in index", zap.String("file", fileName), zap.Int64("offset", offset))
+			return rf, nil
+		}
+	}
+	return rp.open(fileName)
+}
+
+// open opens an archive to read from the start
+func (rp *Replayer) open(fileName string) (rf archive.Archive, err error) {
+	switch {
+	case rp.opts.Stream && !archive.IsLocal(fileName):
+		rf, err = archive.OpenStream(fileName, archiveFileReadBufSize)
+	case rp.opts.Fetcher != nil && !archive.IsLocal(fileName):
+		rf, err = rp.opts.Fetcher.Open(fileName, archiveFileReadBufSize)
+	case rp.opts.Mmap: // requests point into the mapping: rf must outlive the workers using them
+		rf, err = archive.OpenArchiveMapped(fileName, archiveFileReadBufSize)
+	default:
+		rf, err = archive.OpenArchive(fileName, archiveFileReadBufSize)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to open archive file: %s", fileName)
+	}
+	return rf, nil
+}
+
+// ReplayArchive replays a given file. The warm-up, if any, is run first using
+// requests from the beginning of the first archive replayed. Cancelling `ctx`
+// stops reading the archive; requests already handed to workers are allowed
+// to finish. Counters are added to the report even if replay is stopped half way.
+func (rp *Replayer) ReplayArchive(ctx context.Context, fileName string) (err error) {
+
+	if ctx.Err() != nil {
+		rp.interrupted = true
+		return nil
+	}
+
+	rf, err := rp.openArchive(fileName)
+	if err == errNotInArchive {
+		rp.rep.add(fileName, 0, 0)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer rf.Close()
+
+	if rp.opts.Warmup > 0 && !rp.warmedUp {
+		rp.warmedUp = true
+		err = rp.warmUp(ctx, rf)
+		if err == io.EOF {
+			rp.logger.Warn("Archive exhausted during warm-up. Nothing left to measure.", zap.String("file", fileName))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var stats sender.Stats
+	reqChan, errorRespChan, wg := rp.startWorkers(&stats, false)
+	numRequestsMade, collapsed, err := rp.feed(ctx, rf, reqChan, errorRespChan)
+	if ctx.Err() != nil {
+		rp.interrupted = true
+	}
+
+	rp.logger.Info("Closing channel.")
+	close(reqChan)
+	rp.logger.Info("Waiting for all threads to finish")
+	wg.Wait()
+	s := stats.Snapshot()
+	rp.logger.Info("All threads completed.",
+		zap.Int("total-requests", numRequestsMade),
+		zap.Int64("sent", s.Sent),
+		zap.Int64("failed", s.Failed),
+		zap.Int64("skipped", s.Skipped),
+		zap.Int("duplicates", collapsed))
+	rp.rep.add(fileName, numRequestsMade, collapsed)
+	rp.rep.addSent(s)
+
+	return err
+}
+
+// replayJob is an archive for a reader of ReplayArchives, already open (rf)
+// if the warm-up was taken from it
+type replayJob struct {
+	fileName string
+	rf       archive.Archive
+}
+
+// ReplayArchives replays files as one run. With Options.Parallel above 1,
+// that many archives are read at once, all feeding the same Threads workers
+// (so the pace set by MinDelayMs and MaxInflight is shared too), instead of
+// one after the other. The warm-up, if any, comes from the first file before
+// the others are opened. Returns the error of the first file that failed,
+// after which the other readers stop.
+func (rp *Replayer) ReplayArchives(ctx context.Context, fileNames []string) (err error) {
+
+	if rp.opts.Parallel <= 1 {
+		for _, fileName := range fileNames {
+			err = rp.ReplayArchive(ctx, fileName)
+			if err != nil {
+				return errors.Wrapf(err, "Playing file %s failed", fileName)
+			}
+		}
+		return nil
+	}
+
+	if ctx.Err() != nil {
+		rp.interrupted = true
+		return nil
+	}
+
+	jobs := make(chan replayJob, len(fileNames))
+	if rp.opts.Warmup > 0 && !rp.warmedUp && len(fileNames) > 0 {
+		rp.warmedUp = true
+		rf, err := rp.openArchive(fileNames[0])
+		if err != nil && err != errNotInArchive {
+			return errors.Wrapf(err, "Playing file %s failed", fileNames[0])
+		}
+		if err == nil {
+			err = rp.warmUp(ctx, rf)
+		}
+		switch {
+		case err == errNotInArchive:
+			rp.rep.add(fileNames[0], 0, 0)
+		case err == io.EOF:
+			rp.logger.Warn("Archive exhausted during warm-up. Nothing left to measure.", zap.String("file", fileNames[0]))
+			rf.Close()
+		case err != nil:
+			rf.Close()
+			return errors.Wrapf(err, "Playing file %s failed", fileNames[0])
+		default:
+			jobs <- replayJob{fileName: fileNames[0], rf: rf}
+		}
+		fileNames = fileNames[1:]
+	}
+	for _, fileName := range fileNames {
+		jobs <- replayJob{fileName: fileName}
+	}
+	close(jobs)
+
+	runCtx, cancel := context.WithCancel(ctx) // cancelled by the first failure
+	defer cancel()
+	var stats sender.Stats
+	reqChan, errorRespChan, wg := rp.startWorkers(&stats, false)
+
+	var readers sync.WaitGroup
+	var mu sync.Mutex            // err, the report and mapped
+	var mapped []archive.Archive // closed once workers are done with their requests
+	for i := 0; i < rp.opts.Parallel; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for job := range jobs {
+				if runCtx.Err() != nil {
+					if job.rf != nil {
+						job.rf.Close()
+					}
+					continue
+				}
+				rf := job.rf
+				var ferr error
+				if rf == nil {
+					rf, ferr = rp.openArchive(job.fileName)
+				}
+				if ferr == errNotInArchive {
+					mu.Lock()
+					rp.rep.add(job.fileName, 0, 0)
+					mu.Unlock()
+					continue
+				}
+				if ferr == nil {
+					var requests, collapsed int
+					requests, collapsed, ferr = rp.feed(runCtx, rf, reqChan, errorRespChan)
+					rp.logger.Info("Archive read",
+						zap.String("file", job.fileName),
+						zap.Int("requests", requests),
+						zap.Int("duplicates", collapsed))
+					mu.Lock()
+					rp.rep.add(job.fileName, requests, collapsed)
+					if rp.opts.Mmap { // workers may still hold requests of it
+						mapped = append(mapped, rf)
+					} else {
+						rf.Close()
+					}
+					mu.Unlock()
+				}
+				if ferr != nil {
+					mu.Lock()
+					if err == nil {
+						err = errors.Wrapf(ferr, "Playing file %s failed", job.fileName)
+						cancel()
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	readers.Wait()
+	if ctx.Err() != nil {
+		rp.interrupted = true
+	}
+
+	rp.logger.Info("Closing channel.")
+	close(reqChan)
+	rp.logger.Info("Waiting for all threads to finish")
+	wg.Wait()
+	for _, rf := range mapped {
+		rf.Close()
+	}
+	s := stats.Snapshot()
+	rp.logger.Info("All threads completed.",
+		zap.Int64("sent", s.Sent),
+		zap.Int64("failed", s.Failed),
+		zap.Int64("skipped", s.Skipped))
+	rp.rep.addSent(s)
+
+	return err
+}
+
+// feed reads the requests of an archive and hands them to workers, until
+// the end of the archive, MaxRequests, a worker giving up (ExitOnFirstError)
+// or `ctx` is cancelled. Returns the number of requests read and of
+// duplicates skipped.
+func (rp *Replayer) feed(ctx context.Context, rf archive.Archive,
+	reqChan chan *request.UnmarshalledRequest, errorRespChan chan bool) (numRequestsMade, collapsed int, err error) {
+
+	const readAhead = 4 // chunks of requests read ahead, see prefetcher
+
+	pf := newPrefetcher(rf, readAhead, rp.nextRequest) // closed before rf
+	defer pf.close()
+
+	dd := rp.dd
+	bytesRead := 0
+Loop:
+	for {
+		if ctx.Err() != nil {
+			break Loop
+		}
+
+		var umr *request.UnmarshalledRequest
+		umr, err = pf.next()
+		if err != nil {
+			if err == io.EOF { // only valid non-error "error" - signifies end of file.
+				err = nil
+				break Loop
+			}
+			err = errors.Wrapf(err, "corrupted replay file after %d bytes\n", bytesRead)
+			rp.logger.Error("Corrupted file", zap.Error(err), zap.Int("byte-offset", bytesRead)) // early print here is intentional (in case we get stuck at wg.Wait() below)
+			break Loop
+		}
+		bytesRead += umr.FrameSize()
+
+		if dd != nil && dd.isDuplicate(umr.Request()) {
+			umr.Release()
+			collapsed++
+			continue
+		}
+
+		if rp.opts.TestIntegrity {
+			req := umr.Request()
+			fmt.Printf("ID: %s\n", req.Id())
+			umr.Release()
+		} else {
+			select {
+			case reqChan <- umr:
+			case <-ctx.Done():
+				umr.Release()
+				break Loop
+			case <-errorRespChan:
+				err = errors.New("Received exit signal from one thread")
+				// this error will be returned to the caller
+				rp.logger.Error("Exit", zap.Error(err)) // early print here is intentional (in case we get stuck at wg.Wait() below)
+				break Loop
+			}
+		}
+
+		numRequestsMade++
+		if rp.opts.MaxRequests > 0 && numRequestsMade >= rp.opts.MaxRequests {
+			break Loop
+		}
+
+	}
+	return numRequestsMade, collapsed, err
+}
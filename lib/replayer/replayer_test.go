@@ -0,0 +1,311 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package replayer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"github.com/adobe/blackhole/lib/request"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// tempDir is a directory removed at the end of the test
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "replayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// writeArchive writes an uncompressed archive of requests to `uris` in
+// `dir`, and returns its name
+func writeArchive(t *testing.T, dir string, uris ...string) string {
+
+	rf, err := archive.NewArchive(dir, "requests", ".fbf", common.Compress(false), common.Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, uri := range uris {
+		mr := request.CreateRequest([]byte(fmt.Sprint(i)), []byte("POST"), []byte(uri),
+			[]byte("Host: example.com\r\n\r\n"), []byte("body"))
+		if err = mr.SaveRequest(rf, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, details := range rf.FinalizedFiles() {
+		return filepath.Join(dir, details.FileName)
+	}
+	t.Fatal("no file written")
+	return ""
+}
+
+// uris is `n` distinct URIs, starting with `prefix`
+func uris(prefix string, n int) (uris []string) {
+	for i := 0; i < n; i++ {
+		uris = append(uris, fmt.Sprintf("%s/%d", prefix, i))
+	}
+	return uris
+}
+
+// target is an HTTP server keeping the URIs of the requests it gets
+type target struct {
+	host string
+	mu   sync.Mutex
+	uris []string
+}
+
+func newTarget(t *testing.T) *target {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg := &target{host: ln.Addr().String()}
+	server := &fasthttp.Server{Handler: func(ctx *fasthttp.RequestCtx) {
+		tg.mu.Lock()
+		tg.uris = append(tg.uris, string(ctx.RequestURI()))
+		tg.mu.Unlock()
+	}}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Shutdown() })
+	return tg
+}
+
+// got is the URIs requested so far, sorted
+func (tg *target) got() []string {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	got := append([]string(nil), tg.uris...)
+	sort.Strings(got)
+	return got
+}
+
+// checkGot fails unless the target got requests to `want`, in any order
+func (tg *target) checkGot(t *testing.T, want []string) {
+	t.Helper()
+	want = append([]string(nil), want...)
+	sort.Strings(want)
+	got := tg.got()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("target got %d requests %q, want %d", len(got), got, len(want))
+	}
+}
+
+func TestReplayArchive(t *testing.T) {
+
+	tg := newTarget(t)
+	fileName := writeArchive(t, tempDir(t), uris("/a", 100)...)
+	rep, err := ReplayArchive(context.Background(), fileName, Options{TargetHost: tg.host, Quiet: true, Threads: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg.checkGot(t, uris("/a", 100))
+	if rep.Requests != 100 || rep.Sent != 100 || rep.Failed != 0 || len(rep.Files) != 1 || rep.Error != "" {
+		t.Fatalf("got report %+v", rep)
+	}
+}
+
+func TestMaxRequests(t *testing.T) {
+
+	tg := newTarget(t)
+	fileName := writeArchive(t, tempDir(t), uris("/a", 100)...)
+	rep, err := ReplayArchive(context.Background(), fileName, Options{TargetHost: tg.host, Quiet: true, MaxRequests: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg.checkGot(t, uris("/a", 10))
+	if rep.Requests != 10 {
+		t.Fatalf("got report %+v", rep)
+	}
+}
+
+// Nothing is sent once the context is cancelled
+func TestReplayCancelled(t *testing.T) {
+
+	tg := newTarget(t)
+	fileName := writeArchive(t, tempDir(t), uris("/a", 10)...)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rep, err := ReplayArchive(ctx, fileName, Options{TargetHost: tg.host, Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Interrupted || len(tg.got()) != 0 {
+		t.Fatalf("got report %+v, %d requests sent", rep, len(tg.got()))
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"no target", Options{}},
+		{"negative threads", Options{TargetHost: "localhost", Threads: -1}},
+		{"negative parallel", Options{TargetHost: "localhost", Parallel: -1}},
+		{"inflight below threads", Options{TargetHost: "localhost", Threads: 5, MaxInflight: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.opts); err == nil {
+				t.Fatal("no error")
+			}
+		})
+	}
+	if _, err := New(Options{DryRun: true}); err != nil { // no target needed
+		t.Fatal(err)
+	}
+}
+
+// Requests of the same method, URI and body are sent once, across archives
+func TestDedupe(t *testing.T) {
+
+	tg := newTarget(t)
+	dir := tempDir(t)
+	a := writeArchive(t, dir, "/a", "/b", "/a", "/c", "/b")
+	b := writeArchive(t, dir, "/c", "/d")
+	rp, err := New(Options{TargetHost: tg.host, Quiet: true, Dedupe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rp.ReplayArchives(context.Background(), []string{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	tg.checkGot(t, []string{"/a", "/b", "/c", "/d"})
+	if rep := rp.Report(nil); rep.Requests != 4 || rep.Duplicates != 3 || rep.Sent != 4 {
+		t.Fatalf("got report %+v", rep)
+	}
+}
+
+// Requests of the warm-up come from the head of the first archive and are
+// not counted
+func TestWarmup(t *testing.T) {
+
+	tg := newTarget(t)
+	fileName := writeArchive(t, tempDir(t), uris("/a", 100)...)
+	rep, err := ReplayArchive(context.Background(), fileName,
+		Options{TargetHost: tg.host, Quiet: true, Warmup: 200 * time.Millisecond, WarmupRate: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg.checkGot(t, uris("/a", 100))
+	if warm := 100 - rep.Requests; warm < 1 || warm > 11 || rep.Sent != int64(rep.Requests) {
+		t.Fatalf("got report %+v", rep)
+	}
+
+	// All of it taken by the warm-up: nothing to measure
+	tg = newTarget(t)
+	fileName = writeArchive(t, tempDir(t), uris("/a", 3)...)
+	rep, err = ReplayArchive(context.Background(), fileName,
+		Options{TargetHost: tg.host, Quiet: true, Warmup: time.Second, WarmupRate: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg.checkGot(t, uris("/a", 3))
+	if rep.Requests != 0 || rep.Sent != 0 {
+		t.Fatalf("got report %+v", rep)
+	}
+}
+
+func TestWarmupErrors(t *testing.T) {
+
+	for _, rate := range []int{0, -1, MaxWarmupRate + 1} {
+		if _, err := New(Options{TargetHost: "localhost", Warmup: time.Second, WarmupRate: rate}); err == nil {
+			t.Fatalf("rate %d: no error", rate)
+		}
+	}
+	if _, err := New(Options{TargetHost: "localhost", Warmup: time.Second, WarmupRate: MaxWarmupRate}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Archives read at once feed the same workers, each request sent once
+func TestReplayArchivesParallel(t *testing.T) {
+
+	for _, mmap := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mmap=%v", mmap), func(t *testing.T) {
+			tg := newTarget(t)
+			dir := tempDir(t)
+			var files, want []string
+			for i := 0; i < 5; i++ {
+				prefix := fmt.Sprintf("/%d", i)
+				files = append(files, writeArchive(t, dir, uris(prefix, 50)...))
+				want = append(want, uris(prefix, 50)...)
+			}
+			rp, err := New(Options{TargetHost: tg.host, Quiet: true, Parallel: 3, Threads: 4, Mmap: mmap})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = rp.ReplayArchives(context.Background(), files); err != nil {
+				t.Fatal(err)
+			}
+			tg.checkGot(t, want)
+			if rep := rp.Report(nil); rep.Requests != 250 || rep.Sent != 250 || len(rep.Files) != 5 {
+				t.Fatalf("got report %+v", rep)
+			}
+		})
+	}
+}
+
+// The warm-up comes from the first archive, the rest of it is read with the others
+func TestReplayArchivesParallelWarmup(t *testing.T) {
+
+	tg := newTarget(t)
+	dir := tempDir(t)
+	a, b := writeArchive(t, dir, uris("/a", 50)...), writeArchive(t, dir, uris("/b", 50)...)
+	rp, err := New(Options{TargetHost: tg.host, Quiet: true, Parallel: 2,
+		Warmup: 100 * time.Millisecond, WarmupRate: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rp.ReplayArchives(context.Background(), []string{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	tg.checkGot(t, append(uris("/a", 50), uris("/b", 50)...))
+	if rep := rp.Report(nil); rep.Requests >= 100 || rep.Requests < 90 || len(rep.Files) != 2 {
+		t.Fatalf("got report %+v", rep)
+	}
+}
+
+// The first archive that fails stops the others
+func TestReplayArchivesParallelError(t *testing.T) {
+
+	tg := newTarget(t)
+	dir := tempDir(t)
+	files := []string{writeArchive(t, dir, uris("/a", 10)...), filepath.Join(dir, "missing.fbf")}
+	rp, err := New(Options{TargetHost: tg.host, Quiet: true, Parallel: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rp.ReplayArchives(context.Background(), files); err == nil {
+		t.Fatal("no error")
+	}
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package replayer
+
+import (
+	"time"
+
+	"github.com/adobe/blackhole/lib/sender"
+)
+
+// Report is the summary of a replay run (all archives replayed by one Replayer).
+// Its JSON form is what `replay --report` writes.
+type Report struct {
+	Files       []string  `json:"files"`
+	Requests    int       `json:"requests"` // read from archives, duplicates excluded
+	Sent        int64     `json:"sent"`
+	Failed      int64     `json:"failed"`
+	Skipped     int64     `json:"skipped"`
+	Duplicates  int       `json:"duplicates"`
+	Corrupt     int64     `json:"corrupt"` // damaged requests skipped, see Options.SkipCorrupt
+	Interrupted bool      `json:"interrupted"`
+	Error       string    `json:"error,omitempty"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	DurationSec float64   `json:"duration_sec"`
+}
+
+// add accumulates the counters of reading one file into the report
+func (rep *Report) add(fileName string, requests int, duplicates int) {
+	rep.Files = append(rep.Files, fileName)
+	rep.Requests += requests
+	rep.Duplicates += duplicates
+}
+
+// addSent accumulates the counters of workers into the report
+func (rep *Report) addSent(s sender.Stats) {
+	rep.Sent += s.Sent
+	rep.Failed += s.Failed
+	rep.Skipped += s.Skipped
+}
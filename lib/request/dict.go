@@ -0,0 +1,197 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package request
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/frame"
+	"github.com/cespare/xxhash"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// DefaultDictSize is the size of dictionaries trained by TrainDictionary
+// when none is given, the same as the zstd command line tool
+const DefaultDictSize = 112640
+
+// Dictionary compresses requests one frame at a time (frame.FlagZstd) with a
+// zstd dictionary. Small, similar requests, e.g. JSON API calls, compress much
+// better that way than a whole file does with lz4. Files written with it must
+// start with its FileHeader: readers find the dictionary there.
+type Dictionary struct {
+	raw []byte
+	id  uint32
+	enc *zstd.Encoder
+}
+
+// decoders has a decoder for each dictionary seen, by dictionary ID.
+// Dictionaries are registered as file headers are read (see GetNextFrame).
+var decoders = struct {
+	sync.RWMutex
+	raw map[uint32][]byte
+	dec map[uint32]*zstd.Decoder
+}{raw: make(map[uint32][]byte), dec: make(map[uint32]*zstd.Decoder)}
+
+// registerDictionary makes frames compressed with `raw` readable
+func registerDictionary(raw []byte) (id uint32, err error) {
+
+	info, err := zstd.InspectDictionary(raw)
+	if err != nil {
+		return 0, errors.Wrap(err, "Invalid zstd dictionary")
+	}
+	id = info.ID()
+
+	decoders.RLock()
+	known, ok := decoders.raw[id]
+	decoders.RUnlock()
+	if ok {
+		if !bytes.Equal(known, raw) {
+			return 0, errors.Errorf("Another dictionary with ID %d is already in use", id)
+		}
+		return id, nil
+	}
+
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderDicts(raw))
+	if err != nil {
+		return 0, errors.Wrap(err, "Unable to create zstd decoder")
+	}
+	decoders.Lock()
+	defer decoders.Unlock()
+	if _, ok := decoders.raw[id]; ok { // registered meanwhile
+		dec.Close()
+		return id, nil
+	}
+	decoders.raw[id] = append([]byte(nil), raw...)
+	decoders.dec[id] = dec
+	return id, nil
+}
+
+// decompress appends the payload of a FlagZstd frame, decompressed, to `dst`
+func decompress(dst, payload []byte) ([]byte, error) {
+
+	var h zstd.Header
+	err := h.Decode(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid compressed frame")
+	}
+	decoders.RLock()
+	dec, ok := decoders.dec[h.DictionaryID]
+	decoders.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("Frame compressed with dictionary %d, not found in a file header read so far", h.DictionaryID)
+	}
+	dst, err = dec.DecodeAll(payload, dst)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to decompress frame")
+	}
+	return dst, nil
+}
+
+// NewDictionary returns a Dictionary compressing with `raw`, a zstd
+// dictionary as written by TrainDictionary (or `zstd --train`)
+func NewDictionary(raw []byte) (d *Dictionary, err error) {
+
+	d = &Dictionary{raw: raw}
+	d.id, err = registerDictionary(raw) // so that what is written can be read back
+	if err != nil {
+		return nil, err
+	}
+	d.enc, err = zstd.NewWriter(nil,
+		zstd.WithEncoderDict(raw),
+		zstd.WithEncoderCRC(false)) // frames have their own checksum
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create zstd encoder")
+	}
+	return d, nil
+}
+
+// ID is the dictionary ID, as found in the frames it compresses
+func (d *Dictionary) ID() uint32 {
+	return d.id
+}
+
+// FileHeader returns a file header frame carrying the dictionary. Use it
+// instead of the package FileHeader: `common.FileHeader(d.FileHeader)`
+func (d *Dictionary) FileHeader() []byte {
+	h := frame.NewHeader(fbr.SchemaName, fbr.SchemaVersion)
+	h.Dict = d.raw
+	buf, err := h.Frame()
+	if err != nil {
+		panic(err) // Header is a plain struct: can't fail to encode
+	}
+	return buf
+}
+
+// AppendFrame compresses a request payload (e.g. MarshalledRequest.Bytes)
+// and appends it as a FlagZstd frame to `buf`. Safe for concurrent use.
+func (d *Dictionary) AppendFrame(buf []byte, payload []byte) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, frame.PrefixLen+frame.CRCLen)...)
+	buf = d.enc.EncodeAll(payload, buf)
+	frame.PutPrefixCRC(buf[start:], buf[start+frame.PrefixLen+frame.CRCLen:], frame.FlagZstd)
+	return buf
+}
+
+// AppendFrame appends a request payload to `buf` as an uncompressed frame,
+// with checksum, the same as MarshalledRequest.AppendFrame
+func AppendFrame(buf []byte, payload []byte) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, frame.PrefixLen+frame.CRCLen)...)
+	frame.PutPrefixCRC(buf[start:], payload, 0)
+	return append(buf, payload...)
+}
+
+// TrainDictionary builds a zstd dictionary of about `size` bytes (0 -
+// DefaultDictSize) from sample request payloads. The most recent samples
+// make up its content, the others tune its statistics.
+func TrainDictionary(samples [][]byte, size int) (raw []byte, err error) {
+
+	if size <= 0 {
+		size = DefaultDictSize
+	}
+	if len(samples) == 0 {
+		return nil, errors.New("No samples to train a dictionary with")
+	}
+	var history []byte
+	for i := len(samples) - 1; i >= 0 && len(history) < size; i-- {
+		history = append(append([]byte(nil), samples[i]...), history...)
+	}
+	if len(history) > size {
+		history = history[len(history)-size:]
+	}
+
+	// BuildDict divides by zero when samples have too few matches to
+	// gather statistics from
+	defer func() {
+		if r := recover(); r != nil {
+			raw, err = nil, errors.Errorf("Unable to train dictionary, too few samples: %v", r)
+		}
+	}()
+
+	// IDs below 32768 are reserved and above 2^31 too
+	id := 32768 + uint32(xxhash.Sum64(history)%(1<<31-32768))
+	raw, err = zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       id,
+		Contents: samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.SpeedDefault,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to train dictionary")
+	}
+	return raw, nil
+}
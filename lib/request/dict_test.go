@@ -0,0 +1,76 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// dictSamples are payloads of `n` similar JSON API calls
+func dictSamples(n int) (samples [][]byte) {
+	for i := 0; i < n; i++ {
+		mr := CreateRequest([]byte(fmt.Sprint(i)), []byte("POST"), []byte(fmt.Sprintf("/api/v1/events/%d", i)),
+			[]byte("Host: api.example.com\r\nContent-Type: application/json\r\n\r\n"),
+			[]byte(fmt.Sprintf(`{"event": "click", "user": "user-%d", "page": "/products/%d"}`, i%7, i%13)))
+		samples = append(samples, append([]byte(nil), mr.Bytes()...))
+		mr.Release()
+	}
+	return samples
+}
+
+// Frames compressed with a trained dictionary read back after its file header
+func TestTrainDictionary(t *testing.T) {
+
+	samples := dictSamples(200)
+	raw, err := TrainDictionary(samples, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDictionary(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := d.FileHeader()
+	for _, sample := range samples {
+		frames = d.AppendFrame(frames, sample)
+	}
+
+	r := bytes.NewReader(frames)
+	for i := -1; i < len(samples); i++ {
+		umr, err := GetNextFrame(r, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 0 {
+			if !umr.IsHeader() {
+				t.Fatal("no file header")
+			}
+		} else if !umr.IsCompressed() || !bytes.Equal(umr.Payload(), samples[i]) ||
+			string(umr.Request().Uri()) != fmt.Sprintf("/api/v1/events/%d", i) {
+			t.Fatalf("request %d: got %q", i, umr.Payload())
+		}
+		umr.Release()
+	}
+}
+
+func TestTrainDictionaryErrors(t *testing.T) {
+
+	if _, err := TrainDictionary(nil, 0); err == nil {
+		t.Fatal("no error without samples")
+	}
+	if _, err := TrainDictionary(dictSamples(5), 4096); err == nil {
+		t.Fatal("no error with too few samples")
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package request
+
+import (
+	"bytes"
+)
+
+// Header is a single name/value pair from the raw headers of a request
+type Header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// SplitHeaders splits raw headers as recorded (`Name: value` lines, the
+// request line is not included) into name/value pairs, in the original order.
+// Parsing stops at the first empty line. Malformed lines are skipped.
+func SplitHeaders(raw []byte) (headers []Header) {
+
+	for len(raw) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(raw, '\n'); i >= 0 {
+			line, raw = raw[:i], raw[i+1:]
+		} else {
+			line, raw = raw, nil
+		}
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			break
+		}
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		headers = append(headers, Header{
+			Name:  string(bytes.TrimSpace(line[:i])),
+			Value: string(bytes.TrimSpace(line[i+1:]))})
+	}
+	return headers
+}
+
+// HeaderValue returns the value of the first header named `name`
+// (case insensitive) or "" if there is none
+func HeaderValue(headers []Header, name string) string {
+	for _, h := range headers {
+		if len(h.Name) == len(name) && bytes.EqualFold([]byte(h.Name), []byte(name)) {
+			return h.Value
+		}
+	}
+	return ""
+}
@@ -15,34 +15,60 @@ governing permissions and limitations under the License.
 package request
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/adobe/blackhole/lib/fbr"
+	"github.com/adobe/blackhole/lib/frame"
 	"github.com/adobe/blackhole/lib/slicehacks"
 	flatbuffers "github.com/google/flatbuffers/go"
 	"github.com/valyala/fasthttp"
 )
 
-var arPool = sync.Pool{
-	New: func() interface{} {
-		// The Pool's New function should generally only return pointer
-		// types, since a pointer can be put into the return interface
-		// value without an allocation:
-		return &MarshalledRequest{fb: flatbuffers.NewBuilder(2048)}
-	},
+// builderTiers are the buffer sizes of the builder pools, smallest first. A
+// request takes a builder from the smallest tier it fits in, so a multi-MB
+// body neither makes the builder grow (copying all that is built so far each
+// time) nor leaves a huge buffer in the pool that small requests then pin.
+// Requests above the largest tier get a builder of their own, not pooled.
+var builderTiers = [...]int{4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+var builderPools [len(builderTiers)]sync.Pool
+
+func init() {
+	for i := range builderPools {
+		size := builderTiers[i]
+		tier := i
+		builderPools[i].New = func() interface{} {
+			// The Pool's New function should generally only return pointer
+			// types, since a pointer can be put into the return interface
+			// value without an allocation:
+			return &MarshalledRequest{fb: flatbuffers.NewBuilder(size), tier: tier}
+		}
+	}
 }
 
-var idPool = sync.Pool{
-	New: func() interface{} {
-		// The Pool's New function should generally only return pointer
-		// types, since a pointer can be put into the return interface
-		// value without an allocation:
-		v := make([]byte, 50) // FH-<64-bit-decimal>-<64-bit-decimal>
-		// this is just initial size - doesn't need to be accurate.
-		return v
-	},
+const (
+	// frameRoom is kept free in front of the flatbuffer, for Frame() to put
+	// the frame prefix right before the payload
+	frameRoom = frame.PrefixLen + frame.CRCLen
+	// fbOverhead is more than the vtable, offsets, string terminators and
+	// padding of a request add to the size of its fields
+	fbOverhead = 256
+)
+
+// getBuilder returns a MarshalledRequest whose builder holds `size` bytes
+// without growing
+func getBuilder(size int) (mr *MarshalledRequest) {
+	for i, tierSize := range builderTiers {
+		if size <= tierSize {
+			return builderPools[i].Get().(*MarshalledRequest)
+		}
+	}
+	return &MarshalledRequest{fb: flatbuffers.NewBuilder(size), tier: -1}
 }
 
 var requestReadPool = sync.Pool{
@@ -56,7 +82,8 @@ var requestReadPool = sync.Pool{
 }
 
 type MarshalledRequest struct {
-	fb *flatbuffers.Builder
+	fb   *flatbuffers.Builder
+	tier int // index in builderPools, -1 if not pooled
 }
 
 // UnmarshalledRequest holds an fbr.Request that has just been
@@ -68,7 +95,12 @@ type MarshalledRequest struct {
 // MarshalledRequest where we need a flatbuffers builder instead
 // MarshalledRequest is for writing, UnmarshalledRequest is for reading
 type UnmarshalledRequest struct {
-	data []byte
+	data   []byte
+	own    []byte // the pooled buffer, while data is a slice of a mapped archive
+	mapped bool
+	flags  byte   // frame flags
+	crc    uint32 // valid only if flags has frame.FlagCRC
+	plain  []byte // payload of a frame.FlagZstd frame, decompressed
 }
 
 // CreateRequestFromFastHTTPCtx returns *MarshalledRequest ready to be saved
@@ -77,24 +109,30 @@ type UnmarshalledRequest struct {
 // A *MarshalledRequest contains pointers from a buffer pool.
 // You must call `.Release()` on it as soon as you are done with it.
 func CreateRequestFromFastHTTPCtx(ctx *fasthttp.RequestCtx) (mr *MarshalledRequest) {
+	return CreateExchangeFromFastHTTPCtx(ctx, time.Now().UnixNano(), nil)
+}
+
+// CreateExchangeFromFastHTTPCtx is like CreateRequestFromFastHTTPCtx, with the
+// recording time `ts` (unix nano) given and the response to the request, if
+// not nil, recorded as well.
+func CreateExchangeFromFastHTTPCtx(ctx *fasthttp.RequestCtx, ts int64, resp *Response) (mr *MarshalledRequest) {
 	destURL := ctx.Request.Header.Peek("X-Original-URI")
 	if len(destURL) == 0 { // nil or ""
 		destURL = ctx.RequestURI()
 	}
 
+	var idBuf [64]byte // FH-<64-bit-decimal>-<64-bit-decimal>, on the stack
 	id := ctx.Request.Header.Peek("X-Request-ID")
 	if len(id) == 0 { // nil or ""
-		id = idPool.Get().([]byte)
-		defer idPool.Put(id)
-		id = append(id[:0], []byte("FH-")...)
+		id = append(idBuf[:0], "FH-"...)
 		id = strconv.AppendInt(id, time.Now().UnixNano(), 10)
-		id = append(id, []byte("-")...)
+		id = append(id, '-')
 		id = strconv.AppendUint(id, ctx.ID(), 10)
 	}
-	return CreateRequest(
+	return CreateExchangeAt(ts,
 		id, ctx.Method(), destURL,
 		ctx.Request.Header.RawHeaders(),
-		ctx.Request.Body())
+		ctx.Request.Body(), resp)
 }
 
 // CreateRequest returns *MarshalledRequest ready to be saved
@@ -102,20 +140,61 @@ func CreateRequestFromFastHTTPCtx(ctx *fasthttp.RequestCtx) (mr *MarshalledReque
 // You must call `.Release()` on it as soon as you are done with it.
 func CreateRequest(
 	id, method, uri, headers, body []byte) (mr *MarshalledRequest) {
-	mr = arPool.Get().(*MarshalledRequest)
+	return CreateRequestAt(time.Now().UnixNano(), id, method, uri, headers, body)
+}
 
+// CreateRequestAt is like CreateRequest, with the recording time `ts`
+// (unix nano) given. Used when rewriting or importing requests.
+func CreateRequestAt(ts int64,
+	id, method, uri, headers, body []byte) (mr *MarshalledRequest) {
+	return CreateExchangeAt(ts, id, method, uri, headers, body, nil)
+}
+
+// Response is what the upstream answered to a request. Recorded along with
+// the request by a proxy (see cmd/bhproxy).
+type Response struct {
+	Status   int
+	Headers  []byte // `Name: value` lines, like request headers (no status line)
+	Body     []byte
+	Duration time.Duration // time the upstream took to answer
+}
+
+// CreateExchangeAt is like CreateRequestAt, with the response to the request
+// recorded as well. `resp` can be nil.
+func CreateExchangeAt(ts int64,
+	id, method, uri, headers, body []byte, resp *Response) (mr *MarshalledRequest) {
+
+	// Size the buffer up front. The builder would otherwise grow it, copying
+	// all that is built so far each time, a few times for large bodies.
+	size := frameRoom + fbOverhead + len(id) + len(method) + len(uri) + len(headers) + len(body)
+	if resp != nil {
+		size += len(resp.Headers) + len(resp.Body)
+	}
+	mr = getBuilder(size)
 	mr.fb.Reset()
 	idFB := mr.fb.CreateByteString(id)
 	methodFB := mr.fb.CreateByteString(method)
 	uriFB := mr.fb.CreateByteString(uri)
 	headersFB := mr.fb.CreateByteString(headers)
 	bodyFB := mr.fb.CreateByteVector(body)
+	var respHeadersFB, respBodyFB flatbuffers.UOffsetT
+	if resp != nil {
+		respHeadersFB = mr.fb.CreateByteString(resp.Headers)
+		respBodyFB = mr.fb.CreateByteVector(resp.Body)
+	}
 	fbr.RequestStart(mr.fb)
 	fbr.RequestAddId(mr.fb, idFB)
 	fbr.RequestAddMethod(mr.fb, methodFB)
 	fbr.RequestAddUri(mr.fb, uriFB)
 	fbr.RequestAddHeaders(mr.fb, headersFB)
 	fbr.RequestAddBody(mr.fb, bodyFB)
+	fbr.RequestAddTimestamp(mr.fb, ts)
+	if resp != nil {
+		fbr.RequestAddStatus(mr.fb, int32(resp.Status))
+		fbr.RequestAddResponseHeaders(mr.fb, respHeadersFB)
+		fbr.RequestAddResponseBody(mr.fb, respBodyFB)
+		fbr.RequestAddDuration(mr.fb, int64(resp.Duration))
+	}
 	req := fbr.RequestEnd(mr.fb)
 	mr.fb.Finish(req)
 
@@ -128,10 +207,61 @@ func (mr *MarshalledRequest) Bytes() []byte {
 	return mr.fb.FinishedBytes()
 }
 
+// Frame returns the request as a frame: prefix, checksum and payload. The
+// builder leaves room in front of the payload, so the prefix is put there and
+// the frame is a slice of the builder's buffer, written with a single Write
+// and no copy. Valid until Release.
+func (mr *MarshalledRequest) Frame() []byte {
+	head := int(mr.fb.Head())
+	fbBytes := mr.fb.Bytes[head:]
+	if head < frameRoom { // can't happen with the buffer sized up front
+		buf := make([]byte, frameRoom+len(fbBytes))
+		frame.PutPrefixCRC(buf, fbBytes, 0)
+		copy(buf[frameRoom:], fbBytes)
+		return buf
+	}
+	frame.PutPrefixCRC(mr.fb.Bytes[head-frameRoom:head], fbBytes, 0)
+	return mr.fb.Bytes[head-frameRoom:]
+}
+
+// FrameSize is the size of the request as a frame, see Frame
+func (mr *MarshalledRequest) FrameSize() int {
+	return frameRoom + len(mr.fb.Bytes) - int(mr.fb.Head())
+}
+
+// AppendFrame appends the request as a frame to `buf` and releases it. Used
+// to write several requests with a single Write, see SaveFrames.
+func (mr *MarshalledRequest) AppendFrame(buf []byte) []byte {
+	buf = append(buf, mr.Frame()...)
+	mr.Release()
+	return buf
+}
+
+// WriteFrame writes the request as a single frame, the same way SaveRequest
+// does, to any io.Writer. Unlike SaveRequest, it does not Release().
+func (mr *MarshalledRequest) WriteFrame(w io.Writer) (n int, err error) {
+	return w.Write(mr.Frame())
+}
+
+// Unmarshalled copies the request into an UnmarshalledRequest, as if it was
+// read back from an archive, and releases `mr`. Used to hand requests that
+// were just created to lib/sender workers.
+func (mr *MarshalledRequest) Unmarshalled() (umr *UnmarshalledRequest) {
+	fbBytes := mr.Bytes()
+	umr = CreateUMRequest()
+	umr.Grow(len(fbBytes))
+	copy(umr.data, fbBytes)
+	mr.Release()
+	return umr
+}
+
 // Release releases the object back to the pool
 func (mr *MarshalledRequest) Release() {
+	if mr.tier < 0 {
+		return // left to the GC
+	}
 	mr.fb.Reset()
-	arPool.Put(mr)
+	builderPools[mr.tier].Put(mr)
 }
 
 // Bytes returns underlying buffer. This is exposed *only* to be passed to readFull / io.ReadFull
@@ -142,7 +272,104 @@ func (umr *UnmarshalledRequest) Bytes() []byte {
 
 // Request returns a pointer to the fbr.Request represented by the UnmarshalledRequest
 func (umr *UnmarshalledRequest) Request() *fbr.Request {
-	return fbr.GetRootAsRequest(umr.data, 0)
+	return fbr.GetRootAsRequest(umr.Payload(), 0)
+}
+
+// Payload is the flatbuffer of the request, decompressed if the frame was
+// compressed with a dictionary. Bytes is the payload as stored.
+func (umr *UnmarshalledRequest) Payload() []byte {
+	if umr.flags&frame.FlagZstd != 0 {
+		return umr.plain
+	}
+	return umr.data
+}
+
+// IsCompressed is true if the frame was compressed with a dictionary, see Dictionary
+func (umr *UnmarshalledRequest) IsCompressed() bool {
+	return umr.flags&frame.FlagZstd != 0
+}
+
+// unpack registers the dictionary of a file header, and decompresses the
+// payload of a frame.FlagZstd frame. A frame failing its checksum is left
+// as is, for VerifyCRC to report.
+func (umr *UnmarshalledRequest) unpack() (err error) {
+	switch {
+	case umr.IsHeader():
+		if bytes.Contains(umr.data, []byte(`"dict"`)) {
+			h, err := umr.Header()
+			if err == nil && len(h.Dict) > 0 {
+				_, err = registerDictionary(h.Dict)
+			}
+			return err
+		}
+	case umr.IsCompressed():
+		if umr.VerifyCRC() != nil {
+			return nil
+		}
+		umr.plain, err = decompress(umr.plain[:0], umr.data)
+	}
+	return err
+}
+
+// IsHeader is true if this is a file header frame (see GetNextFrame),
+// in which case Header() must be used instead of Request()
+func (umr *UnmarshalledRequest) IsHeader() bool {
+	return umr.flags&frame.FlagHeader != 0
+}
+
+// Header decodes a file header frame
+func (umr *UnmarshalledRequest) Header() (h frame.Header, err error) {
+	return frame.ParseHeader(umr.data)
+}
+
+// FrameSize is the number of bytes this record took in the (uncompressed) archive stream
+func (umr *UnmarshalledRequest) FrameSize() int {
+	if umr.flags&frame.FlagCRC != 0 {
+		return frame.PrefixLen + frame.CRCLen + len(umr.data)
+	}
+	return frame.PrefixLen + len(umr.data)
+}
+
+// HasCRC is true if the frame was written with a checksum
+func (umr *UnmarshalledRequest) HasCRC() bool {
+	return umr.flags&frame.FlagCRC != 0
+}
+
+// VerifyCRC returns frame.ErrCRCMismatch if the frame has a checksum and
+// the payload does not match it. Frames without a checksum always pass.
+func (umr *UnmarshalledRequest) VerifyCRC() error {
+	if umr.HasCRC() && frame.Checksum(umr.data) != umr.crc {
+		return frame.ErrCRCMismatch
+	}
+	return nil
+}
+
+// WriteFrame writes the frame back out, as is (flags included). Used to copy
+// records between archives without re-encoding them.
+func (umr *UnmarshalledRequest) WriteFrame(w io.Writer) (n int, err error) {
+	var lbuf [frame.PrefixLen + frame.CRCLen]byte
+	prefixLen := frame.PrefixLen
+	frame.PutPrefix(lbuf[:], len(umr.data), umr.flags)
+	if umr.HasCRC() {
+		binary.LittleEndian.PutUint32(lbuf[frame.PrefixLen:], umr.crc)
+		prefixLen += frame.CRCLen
+	}
+	n, err = w.Write(lbuf[:prefixLen])
+	if err != nil {
+		return n, err
+	}
+	m, err := w.Write(umr.data)
+	return n + m, err
+}
+
+// FileHeader returns a file header frame for a new archive file.
+// Pass it to the archive with `common.FileHeader(request.FileHeader)`
+func FileHeader() []byte {
+	buf, err := frame.NewHeader(fbr.SchemaName, fbr.SchemaVersion).Frame()
+	if err != nil {
+		panic(err) // Header is a plain struct: can't fail to encode
+	}
+	return buf
 }
 
 // Grow can be used to grow the underlying buffer. This is required to for later use with readFull / io.ReadFull
@@ -158,5 +385,11 @@ func CreateUMRequest() (umr *UnmarshalledRequest) {
 
 // Release releases the object back to the pool
 func (umr *UnmarshalledRequest) Release() {
+	if umr.mapped { // never write into the mapping
+		umr.data, umr.own, umr.mapped = umr.own, nil, false
+	}
+	umr.flags = 0
+	umr.crc = 0
+	umr.plain = umr.plain[:0]
 	requestReadPool.Put(umr)
 }
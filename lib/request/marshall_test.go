@@ -0,0 +1,41 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+// BenchmarkWriteFrame marshalls requests and writes them as frames, as
+// recorder threads do, for bodies of growing size
+func BenchmarkWriteFrame(b *testing.B) {
+
+	headers := []byte("Host: example.com\r\nContent-Type: application/json\r\nUser-Agent: bench\r\n\r\n")
+	for _, size := range []int{100, 4 << 10, 64 << 10, 1 << 20} {
+		body := bytes.Repeat([]byte("x"), size)
+		b.Run(fmt.Sprintf("body=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				mr := CreateRequest([]byte("FH-1-1"), []byte("POST"), []byte("/events"), headers, body)
+				if _, err := mr.WriteFrame(ioutil.Discard); err != nil {
+					b.Fatal(err)
+				}
+				mr.Release()
+			}
+		})
+	}
+}
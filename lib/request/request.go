@@ -1,44 +1,56 @@
 package request
 
 import (
-	"encoding/binary"
 	"fmt"
 	"io"
 	"time"
 
 	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/frame"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
 var gLogger, _ = zap.NewDevelopment()
 
+// rowCounter is implemented by archives that keep count of rows per file
+type rowCounter interface {
+	AddRows(n int64)
+}
+
+// locker is implemented by archives shared by several goroutines
+// (archive.ConcurrentArchive), for a request and its row count to be written
+// together
+type locker interface {
+	Locked(f func(archive.Archive) error) error
+}
+
 // SaveRequest saves the data held by MarshalledRequest to the archive file.
 // MarshalledRequest typically holds a flatbuffer builder that is already
 func (req *MarshalledRequest) SaveRequest(rf archive.Archive, flushNow bool) (err error) {
 
-	const UINT64LEN = 8
-	var lbuf = make([]byte, UINT64LEN)
-
-	fbBytes := req.Bytes()
-	fbLen := len(fbBytes)
-
 	defer req.Release()
 
-	binary.LittleEndian.PutUint64(lbuf, uint64(fbLen))
+	if l, ok := rf.(locker); ok {
+		return l.Locked(func(rf archive.Archive) error {
+			return req.saveRequest(rf, flushNow)
+		})
+	}
+	return req.saveRequest(rf, flushNow)
+}
+
+func (req *MarshalledRequest) saveRequest(rf archive.Archive, flushNow bool) (err error) {
 
-	n, err := rf.Write(lbuf)
+	buf := req.Frame()
+	n, err := rf.Write(buf)
 	if err != nil {
-		msg := fmt.Sprintf("FATAL: Wrote only %d bytes, %d expected.", n, UINT64LEN)
+		msg := fmt.Sprintf("FATAL: Wrote only %d bytes, %d expected.", n, len(buf))
 		gLogger.Error(msg, zap.Error(err))
 		return errors.Wrap(err, msg)
 	}
 
-	n, err = rf.Write(fbBytes)
-	if err != nil {
-		msg := fmt.Sprintf("FATAL: Wrote only %d bytes, %d expected.", n, fbLen)
-		gLogger.Error(msg, zap.Error(err))
-		return errors.Wrap(err, msg)
+	if rc, ok := rf.(rowCounter); ok {
+		rc.AddRows(1)
 	}
 
 	if flushNow {
@@ -47,6 +59,74 @@ func (req *MarshalledRequest) SaveRequest(rf archive.Archive, flushNow bool) (er
 	return err
 }
 
+// rowLimiter is implemented by archives that start a new file after a number
+// of rows (common.MaxRows)
+type rowLimiter interface {
+	RowsLeft() int64
+}
+
+// SaveFrames writes `frames`, `n` requests appended with AppendFrame, to the
+// archive file with a single Write. At high rates this saves most of the
+// syscalls of writing requests one by one to an unbuffered file. With
+// common.MaxRows, frames are written in as many writes as it takes for files
+// not to go over.
+func SaveFrames(rf archive.Archive, frames []byte, n int) (err error) {
+
+	if l, ok := rf.(locker); ok {
+		return l.Locked(func(rf archive.Archive) error {
+			return splitFrames(rf, frames, n)
+		})
+	}
+	return splitFrames(rf, frames, n)
+}
+
+// splitFrames is SaveFrames, with `rf` written by this goroutine only
+func splitFrames(rf archive.Archive, frames []byte, n int) (err error) {
+
+	if rl, ok := rf.(rowLimiter); ok {
+		for {
+			left := rl.RowsLeft()
+			if left <= 0 || int64(n) <= left {
+				break
+			}
+			split := framesLen(frames, int(left))
+			err = saveFrames(rf, frames[:split], int(left))
+			if err != nil {
+				return err
+			}
+			frames, n = frames[split:], n-int(left)
+		}
+	}
+	return saveFrames(rf, frames, n)
+}
+
+// framesLen is the length of the first `n` frames of `frames`
+func framesLen(frames []byte, n int) (off int) {
+	for ; n > 0; n-- {
+		payloadLen, flags := frame.ParsePrefix(frames[off:])
+		off += frame.PrefixLen + payloadLen
+		if flags&frame.FlagCRC != 0 {
+			off += frame.CRCLen
+		}
+	}
+	return off
+}
+
+func saveFrames(rf archive.Archive, frames []byte, n int) (err error) {
+
+	written, err := rf.Write(frames)
+	if err != nil {
+		msg := fmt.Sprintf("FATAL: Wrote only %d bytes of %d requests, %d expected.", written, n, len(frames))
+		gLogger.Error(msg, zap.Error(err))
+		return errors.Wrap(err, msg)
+	}
+
+	if rc, ok := rf.(rowCounter); ok {
+		rc.AddRows(int64(n))
+	}
+	return nil
+}
+
 // GetNextRequest reads an archived request from a stream (io.Reader), allocates
 // a buffer from a Pool and returns a lease to that buffer. Caller must do the following
 //
@@ -63,12 +143,86 @@ func (req *MarshalledRequest) SaveRequest(rf archive.Archive, flushNow bool) (er
 // is needed to identity if the intermediate object `*UnmarshalledRequest` can be removed.
 // Anyways this intermediate object does not cause inefficiency,
 // except for the wierdness in the API
+//
+// File header frames are skipped. Use GetNextFrame to see them. Requests
+// written with a checksum that doesn't match return frame.ErrCRCMismatch.
 func GetNextRequest(rf archive.Archive, waitForData bool) (umr *UnmarshalledRequest, err error) {
 
+	for {
+		umr, err = GetNextFrame(rf, waitForData)
+		if err != nil {
+			return nil, err
+		}
+		if !umr.IsHeader() {
+			err = umr.VerifyCRC()
+			if err != nil {
+				err = &corruptError{err: err, frameSize: umr.FrameSize()}
+				umr.Release()
+				return nil, err
+			}
+			return umr, nil
+		}
+		umr.Release()
+	}
+}
+
+// GetNextRequestSkipCorrupt is GetNextRequest going on past damaged records.
+// A request whose checksum doesn't match, that can't be decompressed or, if
+// written without a checksum, isn't a valid flatbuffer (see Validate) is
+// passed to `skip` with the size of its frame, and the next one is read.
+// Damaged framing (a length prefix that can't be right, a cut off file) still
+// ends reading, since where the next record starts is unknown.
+func GetNextRequestSkipCorrupt(rf archive.Archive, waitForData bool,
+	skip func(err error, frameSize int)) (umr *UnmarshalledRequest, err error) {
+
+	for {
+		umr, err = GetNextRequest(rf, waitForData)
+		if ce, ok := err.(*corruptError); ok {
+			skip(ce.err, ce.frameSize)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !umr.HasCRC() {
+			if verr := umr.Validate(); verr != nil {
+				skip(verr, umr.FrameSize())
+				umr.Release()
+				continue
+			}
+		}
+		return umr, nil
+	}
+}
+
+// corruptError is the error of a record that was read whole but can't be
+// used, so the next one can be read. Cause is the original error.
+type corruptError struct {
+	err       error
+	frameSize int
+}
+
+func (e *corruptError) Error() string { return e.err.Error() }
+func (e *corruptError) Cause() error  { return e.err }
+func (e *corruptError) Unwrap() error { return e.err }
+
+// sliceReader is implemented by readers that hand out their data without
+// copying it, i.e. memory mapped archives (archive.OpenArchiveMapped)
+type sliceReader interface {
+	Next(n int) ([]byte, error)
+}
+
+// GetNextFrame is like GetNextRequest but also returns file header frames.
+// Check umr.IsHeader() before calling umr.Request()
+func GetNextFrame(rf io.Reader, waitForData bool) (umr *UnmarshalledRequest, err error) {
+
+	if sr, ok := rf.(sliceReader); ok {
+		return getNextMappedFrame(sr)
+	}
+
 	umr = CreateUMRequest()
-	const UINT64LEN = 8
 
-	sizeBuf := make([]byte, UINT64LEN)
+	sizeBuf := make([]byte, frame.PrefixLen)
 	_, err = ReadFull(rf, sizeBuf, waitForData)
 	if err != nil {
 		if err == io.EOF {
@@ -79,7 +233,24 @@ func GetNextRequest(rf archive.Archive, waitForData bool) (umr *UnmarshalledRequ
 		return nil, err
 	}
 
-	fbLen := int(binary.LittleEndian.Uint64(sizeBuf))
+	fbLen, flags := frame.ParsePrefix(sizeBuf)
+	err = frame.CheckPrefix(fbLen, flags)
+	if err != nil {
+		umr.Release()
+		return nil, err
+	}
+	umr.flags = flags
+	if flags&frame.FlagCRC != 0 {
+		_, err = ReadFull(rf, sizeBuf[:frame.CRCLen], waitForData)
+		if err != nil {
+			umr.Release()
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, errors.Wrap(err, "FATAL: Unable to read frame checksum")
+		}
+		umr.crc = frame.ParseCRC(sizeBuf)
+	}
 	umr.Grow(fbLen)
 	n, err := ReadFull(rf, umr.Bytes(), waitForData)
 	if err != nil {
@@ -94,6 +265,57 @@ func GetNextRequest(rf archive.Archive, waitForData bool) (umr *UnmarshalledRequ
 	}
 
 	// req = archive.GetRootAsRequest(lease[:fbLen], 0)
+	err = umr.unpack()
+	if err != nil {
+		err = &corruptError{err: err, frameSize: umr.FrameSize()}
+		umr.Release()
+		return nil, err
+	}
+	return umr, nil
+}
+
+// getNextMappedFrame is GetNextFrame for a sliceReader: the payload is not
+// copied, umr.data is a slice of the reader's data. A mapped file does not
+// grow, so there is no waiting for data.
+func getNextMappedFrame(sr sliceReader) (umr *UnmarshalledRequest, err error) {
+
+	prefix, err := sr.Next(frame.PrefixLen)
+	if err != nil {
+		return nil, err // io.EOF at a frame boundary
+	}
+	fbLen, flags := frame.ParsePrefix(prefix)
+	err = frame.CheckPrefix(fbLen, flags)
+	if err != nil {
+		return nil, err
+	}
+	var crc uint32
+	if flags&frame.FlagCRC != 0 {
+		b, err := sr.Next(frame.CRCLen)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, errors.Wrap(err, "FATAL: Unable to read frame checksum")
+		}
+		crc = frame.ParseCRC(b)
+	}
+	payload, err := sr.Next(fbLen)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrapf(err, "FATAL: Frame of %d bytes is cut short", fbLen)
+	}
+
+	umr = CreateUMRequest()
+	umr.own, umr.data, umr.mapped = umr.data, payload, true
+	umr.flags, umr.crc = flags, crc
+	err = umr.unpack()
+	if err != nil {
+		err = &corruptError{err: err, frameSize: umr.FrameSize()}
+		umr.Release()
+		return nil, err
+	}
 	return umr, nil
 }
 
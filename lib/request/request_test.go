@@ -0,0 +1,116 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package request
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/adobe/blackhole/lib/archive"
+	"github.com/adobe/blackhole/lib/archive/common"
+	"go.uber.org/zap"
+)
+
+// testFrames is `n` requests appended with AppendFrame, IDs from 0
+func testFrames(n int) (frames []byte) {
+	for i := 0; i < n; i++ {
+		mr := CreateRequest([]byte(fmt.Sprint(i)), []byte("GET"), []byte("/"), nil, nil)
+		frames = mr.AppendFrame(frames)
+	}
+	return frames
+}
+
+// writeFrames saves `n` requests with SaveFrames to a new archive of `dir`
+// and returns its finalized files
+func writeFrames(t *testing.T, dir string, n int, options ...func(*common.BasicArchive) error) []string {
+
+	rf, err := archive.NewArchive(dir, "requests", ".fbf",
+		append(options, common.Compress(false), common.Logger(zap.NewNop()))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SaveFrames(rf, testFrames(n), n); err != nil {
+		t.Fatal(err)
+	}
+	if err = rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, details := range rf.FinalizedFiles() {
+		files = append(files, filepath.Join(dir, details.FileName))
+	}
+	return files
+}
+
+// readIDs is the IDs of the requests of `fileName`, in order
+func readIDs(t *testing.T, fileName string) (ids []string) {
+
+	rf, err := archive.OpenArchive(fileName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	for {
+		umr, err := GetNextRequest(rf, false)
+		if err == io.EOF {
+			return ids
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, string(umr.Request().Id()))
+		umr.Release()
+	}
+}
+
+func TestSaveFrames(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	files := writeFrames(t, dir, 10)
+	if len(files) != 1 {
+		t.Fatalf("got files %q", files)
+	}
+	got := readIDs(t, files[0])
+	if fmt.Sprint(got) != "[0 1 2 3 4 5 6 7 8 9]" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// With common.MaxRows, frames saved together are split among files
+func TestSaveFramesMaxRows(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	var got []string
+	for _, fileName := range writeFrames(t, dir, 5, common.MaxRows(2)) {
+		got = append(got, fmt.Sprint(readIDs(t, fileName)))
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != "[[0 1] [2 3] [4]]" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2021 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package request
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// Field slots of fbr.Request (see request.fbs), in vtable order
+const (
+	slotID = iota
+	slotMethod
+	slotURI
+	slotHeaders
+	slotBody
+	slotTimestamp
+	slotStatus
+	slotResponseHeaders
+	slotResponseBody
+	slotDuration
+)
+
+// Validate checks that the payload is a well formed fbr.Request: every offset
+// and length stays inside the buffer, so calling the fbr accessors can't panic.
+// The flatbuffers Go runtime has no verifier, hence this hand written one for
+// our single table. Header frames are checked with Header() instead.
+func (umr *UnmarshalledRequest) Validate() error {
+
+	if umr.IsHeader() {
+		_, err := umr.Header()
+		return err
+	}
+
+	buf := umr.Payload()
+	size := uint64(len(buf))
+	u32 := func(at uint64) uint64 { return uint64(binary.LittleEndian.Uint32(buf[at:])) }
+	u16 := func(at uint64) uint64 { return uint64(binary.LittleEndian.Uint16(buf[at:])) }
+
+	if size < 4 {
+		return errors.Errorf("flatbuffer too short: %d bytes", size)
+	}
+	table := u32(0)
+	if table+4 > size {
+		return errors.Errorf("root table offset %d out of bounds", table)
+	}
+	vtable := int64(table) - int64(int32(u32(table)))
+	if vtable < 0 || uint64(vtable)+4 > size {
+		return errors.Errorf("vtable offset %d out of bounds", vtable)
+	}
+	vt := uint64(vtable)
+	vtSize, tableSize := u16(vt), u16(vt+2)
+	if vtSize < 4 || vtSize%2 != 0 || vt+vtSize > size {
+		return errors.Errorf("bad vtable size %d", vtSize)
+	}
+	if tableSize < 4 || table+tableSize > size {
+		return errors.Errorf("bad table size %d", tableSize)
+	}
+
+	for slot := uint64(0); slot < (vtSize-4)/2; slot++ {
+		field := u16(vt + 4 + 2*slot)
+		if field == 0 { // absent, default value
+			continue
+		}
+		switch slot {
+		case slotID, slotMethod, slotURI, slotHeaders, slotBody,
+			slotResponseHeaders, slotResponseBody: // vectors/strings
+			if field+4 > tableSize {
+				return errors.Errorf("field %d out of table", slot)
+			}
+			at := table + field
+			vector := at + u32(at)
+			if vector+4 > size {
+				return errors.Errorf("field %d: vector offset %d out of bounds", slot, vector)
+			}
+			if vector+4+u32(vector) > size {
+				return errors.Errorf("field %d: vector length %d out of bounds", slot, u32(vector))
+			}
+		case slotTimestamp, slotDuration:
+			if field+8 > tableSize {
+				return errors.Errorf("field %d out of table", slot)
+			}
+		case slotStatus:
+			if field+4 > tableSize {
+				return errors.Errorf("field %d out of table", slot)
+			}
+		}
+		// Unknown slots are from newer schema versions, nothing to check
+	}
+	return nil
+}
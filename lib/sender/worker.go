@@ -13,12 +13,16 @@ governing permissions and limitations under the License.
 /*
 sender provides async http(s) egress functionality over a channel.
 The code follows a
- [driver] -> [channel] -> [worker(s)]
+
+	[driver] -> [channel] -> [worker(s)]
+
 pattern that is common in Go. Requests are sent over a channel and response
 body is currently ignored. Each worker will wait for http request to finish.
 Caller is expected to create multiple worker independently for throughput.
 One worker will only have one outstanding http request. Parallelism is controlled
-entirely by how many workers are created by the caller.
+entirely by how many workers are created by the caller. The exception is the
+pipelined mode (see Pipelined()) where each worker keeps up to N requests in
+flight over a shared fasthttp.PipelineClient.
 TODO: track and record request status by X-Request-ID
 */
 package sender
@@ -28,6 +32,7 @@ import (
 	"bytes"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/adobe/blackhole/lib/fbr"
@@ -55,6 +60,32 @@ type Worker struct {
 	minDelayMs       int
 	exitOnFirstError bool
 	outputDir        string
+	stats            *Stats
+
+	// pipelined mode only
+	client   *fasthttp.PipelineClient
+	inflight chan struct{} // semaphore, one slot per in-flight request
+	pending  sync.WaitGroup
+	stopOnce sync.Once
+	stopped  int32
+}
+
+// Stats keeps a tally of what one or more workers did. Counters are
+// updated atomically, so a single Stats can be shared by all workers
+// of a replay run. Use Snapshot() to read a consistent copy.
+type Stats struct {
+	Sent    int64 // requests sent (or extracted/printed in dryrun)
+	Failed  int64 // requests that errored
+	Skipped int64 // requests skipped because of a reqid filter
+}
+
+// Snapshot returns a copy of the counters
+func (s *Stats) Snapshot() Stats {
+	return Stats{
+		Sent:    atomic.LoadInt64(&s.Sent),
+		Failed:  atomic.LoadInt64(&s.Failed),
+		Skipped: atomic.LoadInt64(&s.Skipped),
+	}
 }
 
 // Option controlls a set of options that can be set on Worker
@@ -147,6 +178,35 @@ func OutputDirectory(outputDir string) Option {
 	}
 }
 
+// CollectStats makes the worker count what it did into `stats`.
+// The same *Stats may be passed to many workers.
+func CollectStats(stats *Stats) Option {
+	return func(wrk *Worker) {
+		wrk.stats = stats
+	}
+}
+
+// Pipelined makes the worker send requests asynchronously over `client`,
+// keeping up to `maxInflight` requests outstanding at any time instead of
+// waiting for each response. `client` is typically shared by all workers.
+// With `minDelayMs`, the delay paces how fast requests are dispatched.
+func Pipelined(client *fasthttp.PipelineClient, maxInflight int) Option {
+	return func(wrk *Worker) {
+		if client == nil || maxInflight <= 0 {
+			return
+		}
+		wrk.client = client
+		wrk.inflight = make(chan struct{}, maxInflight)
+	}
+}
+
+func (wrk *Worker) do(req *fasthttp.Request, resp *fasthttp.Response) error {
+	if wrk.client != nil {
+		return wrk.client.Do(req, resp)
+	}
+	return fasthttp.Do(req, resp)
+}
+
 func (wrk *Worker) replayRequest(reqEnvelope *fbr.Request) (err error) {
 
 	if !wrk.dryRun {
@@ -188,7 +248,7 @@ func (wrk *Worker) replayRequest(reqEnvelope *fbr.Request) (err error) {
 		defer fasthttp.ReleaseResponse(resp)
 
 		//log.Printf("%+v", req)
-		err = fasthttp.Do(req, resp)
+		err = wrk.do(req, resp)
 		if err != nil {
 			return errors.Wrap(err, "Proxy request failed")
 		}
@@ -234,18 +294,72 @@ func (wrk *Worker) processAndRelease(umr *request.UnmarshalledRequest) (stop boo
 		}
 		err = wrk.replayRequest(req)
 		if err != nil {
+			if wrk.stats != nil {
+				atomic.AddInt64(&wrk.stats.Failed, 1)
+			}
 			return stop, errors.Wrap(err, "Request replay failed")
 		}
+		if wrk.stats != nil {
+			atomic.AddInt64(&wrk.stats.Sent, 1)
+		}
 
-	} else if !wrk.quiet {
-		wrk.logger.Debug("Skipping",
-			zap.ByteString("Request-ID", req.Id()),
-			zap.ByteString("URL", req.Uri()))
+	} else {
+		if wrk.stats != nil {
+			atomic.AddInt64(&wrk.stats.Skipped, 1)
+		}
+		if !wrk.quiet {
+			wrk.logger.Debug("Skipping",
+				zap.ByteString("Request-ID", req.Id()),
+				zap.ByteString("URL", req.Uri()))
+		}
 	}
 
 	return stop, nil
 }
 
+// signalStop tells the caller (once) that this worker wants to stop
+func (wrk *Worker) signalStop() {
+	wrk.stopOnce.Do(func() {
+		atomic.StoreInt32(&wrk.stopped, 1)
+		wrk.errorRespChan <- true
+	})
+}
+
+// dispatch sends the request on its own goroutine. It blocks only while
+// all `maxInflight` slots are taken. Returns true if the worker should
+// stop taking new requests.
+func (wrk *Worker) dispatch(umr *request.UnmarshalledRequest) (stop bool) {
+
+	if atomic.LoadInt32(&wrk.stopped) == 1 {
+		umr.Release()
+		return true
+	}
+
+	wrk.inflight <- struct{}{}
+	wrk.pending.Add(1)
+	go func() {
+		defer func() {
+			<-wrk.inflight
+			wrk.pending.Done()
+		}()
+		stop, err := wrk.processAndRelease(umr)
+		if err != nil {
+			wrk.logger.Error("Unexpected response from server",
+				zap.Error(err))
+			if wrk.exitOnFirstError {
+				wrk.signalStop()
+			}
+		} else if stop {
+			wrk.signalStop()
+		}
+	}()
+
+	if wrk.minDelayMs > 0 {
+		time.Sleep(time.Millisecond * time.Duration(wrk.minDelayMs))
+	}
+	return false
+}
+
 func (wrk *Worker) Run() {
 
 	expectedDelay := time.Millisecond * time.Duration(wrk.minDelayMs)
@@ -257,6 +371,13 @@ func (wrk *Worker) Run() {
 Loop:
 	for req := range wrk.reqChan {
 
+		if wrk.inflight != nil {
+			if wrk.dispatch(req) {
+				break Loop
+			}
+			continue
+		}
+
 		st := time.Now()
 		stop, err = wrk.processAndRelease(req)
 		if err != nil {
@@ -285,6 +406,7 @@ Loop:
 			break Loop
 		}
 	}
+	wrk.pending.Wait() // pipelined mode: wait for in-flight requests
 	wrk.wg.Done()
 
 }